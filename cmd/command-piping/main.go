@@ -7,7 +7,7 @@ import (
 	"strings"
 	"time"
 
-	log "github.com/sirupsen/logrus"
+	log "github.com/Comcast/Ravel/pkg/logging"
 )
 
 func main() {
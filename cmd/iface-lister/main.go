@@ -4,8 +4,8 @@ import (
 	"context"
 	"log"
 
+	"github.com/Comcast/Ravel/pkg/logging"
 	"github.com/Comcast/Ravel/pkg/system"
-	"github.com/sirupsen/logrus"
 )
 
 // retrieveDummyIFaces tries to greb for interfaces with 'dummy' in the output from 'ip -details link show'.
@@ -14,7 +14,7 @@ func main() {
 	gateway := "10.131.153.65" // anvil2-net-test ravel node 10.131.153.73
 	announce := 2              // anvil2-net-test ravel node 10.131.153.73
 	loIgnore := 1              // anvil2-net-test ravel node 10.131.153.73
-	logger := logrus.New()
+	logger := logging.New()
 
 	// make a new IPManager
 	ipManager, err := system.NewIP(context.TODO(), "po0", gateway, announce, loIgnore, logger)
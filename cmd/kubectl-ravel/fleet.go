@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// The fleet view is put together from the /statusz of the health listener
+// of every ravel pod, read through the pods proxy of the apiserver, so that
+// it needs nothing on the nodes but what the kubelet probes already use.
+// Directors and bgp directors answer on 10201, realservers on 10200.
+
+// healthPorts are the ports a ravel serves its health on, tried in turn.
+var healthPorts = []string{"10201", "10200"}
+
+// roleChecks are the health checks whose messages say what part a process
+// plays, as ravel status shows them.
+var roleChecks = []string{"vrrp", "colocation", "membership", "maintenance"}
+
+// workers are the health checks of the workers that reconcile, by mode.
+var workers = []string{"bgp", "director", "realserver"}
+
+// statusz is the /statusz of a ravel.
+type statusz struct {
+	Ready      bool `json:"ready"`
+	Subsystems map[string]struct {
+		Ready   bool            `json:"ready"`
+		Message string          `json:"message"`
+		Detail  json.RawMessage `json:"detail"`
+	} `json:"subsystems"`
+}
+
+// member is what the fleet view shows of the ravel on a node.
+type member struct {
+	Node       string                            `json:"node"`
+	Pod        string                            `json:"pod"`
+	Mode       string                            `json:"mode,omitempty"`
+	Ready      bool                              `json:"ready"`
+	Role       map[string]string                 `json:"role,omitempty"`
+	ConfigHash string                            `json:"configHash,omitempty"`
+	Reconcile  map[string]health.ReconcileDetail `json:"reconcile,omitempty"`
+	BGPPeers   map[string]string                 `json:"bgpPeers,omitempty"`
+	// Announced are the VIPs a bgp director announces
+	Announced []string          `json:"announced,omitempty"`
+	Unready   map[string]string `json:"unready,omitempty"`
+	// Error is why the status of the pod couldn't be read
+	Error string `json:"error,omitempty"`
+}
+
+// fleet is the fleet view of a config key.
+type fleet struct {
+	Members []member `json:"members"`
+	// Unannounced are the VIPs of the config that no bgp director announces
+	Unannounced []string `json:"unannounced,omitempty"`
+}
+
+// readMember reads the status of the ravel in pod.
+func readMember(ctx context.Context, client kubernetes.Interface, pod v1.Pod) member {
+	m := member{Node: pod.Spec.NodeName, Pod: pod.Name}
+	if pod.Status.Phase != v1.PodRunning {
+		m.Error = "pod is " + strings.ToLower(string(pod.Status.Phase))
+		return m
+	}
+	errs := []string{}
+	for _, port := range healthPorts {
+		b, err := client.CoreV1().Pods(pod.Namespace).ProxyGet("http", pod.Name, port, "/statusz", nil).DoRaw(ctx)
+		if err == nil {
+			return parseMember(m, b)
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", port, err))
+	}
+	m.Error = "unable to read /statusz. " + strings.Join(errs, "; ")
+	return m
+}
+
+// parseMember fills m in from the /statusz of its ravel.
+func parseMember(m member, b []byte) member {
+	s := statusz{}
+	if err := json.Unmarshal(b, &s); err != nil {
+		m.Error = fmt.Sprintf("invalid /statusz. %v", err)
+		return m
+	}
+	m.Ready = s.Ready
+	m.Role = map[string]string{}
+	m.Reconcile = map[string]health.ReconcileDetail{}
+	m.Unready = map[string]string{}
+
+	_, bgp := s.Subsystems["bgp"]
+	_, director := s.Subsystems["director"]
+	_, realserver := s.Subsystems["realserver"]
+	switch {
+	case bgp:
+		m.Mode = "bgp"
+	case director && realserver:
+		m.Mode = "colocated"
+	case director:
+		m.Mode = "director"
+	case realserver:
+		m.Mode = "realserver"
+	}
+
+	for _, name := range roleChecks {
+		if status, ok := s.Subsystems[name]; ok {
+			m.Role[name] = status.Message
+		}
+	}
+	for _, name := range workers {
+		detail := health.ReconcileDetail{}
+		if status, ok := s.Subsystems[name]; ok && json.Unmarshal(status.Detail, &detail) == nil {
+			m.Reconcile[name] = detail
+		}
+	}
+	if status, ok := s.Subsystems["watcher"]; ok {
+		detail := struct {
+			ConfigHash string `json:"configHash"`
+		}{}
+		json.Unmarshal(status.Detail, &detail)
+		m.ConfigHash = detail.ConfigHash
+	}
+	if status, ok := s.Subsystems["bgp-peers"]; ok {
+		json.Unmarshal(status.Detail, &m.BGPPeers)
+	}
+	if status, ok := s.Subsystems["bgp-prefixes"]; ok {
+		prefixes := map[string][]string{}
+		json.Unmarshal(status.Detail, &prefixes)
+		for _, family := range []string{"ipv4", "ipv6"} {
+			for _, prefix := range prefixes[family] {
+				m.Announced = append(m.Announced, strings.SplitN(prefix, "/", 2)[0])
+			}
+		}
+	}
+	for name, status := range s.Subsystems {
+		if !status.Ready {
+			m.Unready[name] = status.Message
+		}
+	}
+	return m
+}
+
+// readFleet reads the status of the ravel in each of pods at once.
+func readFleet(ctx context.Context, client kubernetes.Interface, pods []v1.Pod) []member {
+	members := make([]member, len(pods))
+	var wg sync.WaitGroup
+	for ix := range pods {
+		wg.Add(1)
+		go func(ix int) {
+			defer wg.Done()
+			members[ix] = readMember(ctx, client, pods[ix])
+		}(ix)
+	}
+	wg.Wait()
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Node != members[j].Node {
+			return members[i].Node < members[j].Node
+		}
+		return members[i].Pod < members[j].Pod
+	})
+	return members
+}
+
+// unannounced returns the VIPs of config that none of the bgp directors in
+// members announces, or nil when there are no bgp directors to announce
+// them.
+func unannounced(config *types.ClusterConfig, members []member) []string {
+	announced := map[string]bool{}
+	directors := 0
+	for _, m := range members {
+		if m.Mode != "bgp" {
+			continue
+		}
+		directors++
+		for _, vip := range m.Announced {
+			announced[canonicalIP(vip)] = true
+		}
+	}
+	if directors == 0 || config == nil {
+		return nil
+	}
+	out := []string{}
+	for _, vips := range []map[types.ServiceIP]types.PortMap{config.Config, config.Config6} {
+		for vip := range vips {
+			if !announced[canonicalIP(string(vip))] {
+				out = append(out, string(vip))
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// canonicalIP is addr as net.IP prints it, so that the spellings of a v6
+// address match.
+func canonicalIP(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr
+}
+
+// writeFleet prints the fleet view for people: a line for each node, the
+// config hashes that differ from the one most nodes apply, and the VIPs no
+// bgp director announces.
+func writeFleet(w io.Writer, f fleet) error {
+	hashes := map[string]int{}
+	for _, m := range f.Members {
+		if m.ConfigHash != "" {
+			hashes[m.ConfigHash]++
+		}
+	}
+	common := ""
+	for hash, n := range hashes {
+		if n > hashes[common] || n == hashes[common] && hash < common {
+			common = hash
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tPOD\tMODE\tREADY\tROLE\tCONFIG\tRECONCILE\tPARITY\tBGP PEERS")
+	for _, m := range f.Members {
+		if m.Error != "" {
+			fmt.Fprintf(tw, "%s\t%s\t-\t-\t%s\t\t\t\t\n", m.Node, m.Pod, m.Error)
+			continue
+		}
+		ready := "yes"
+		if !m.Ready {
+			ready = "no: " + strings.Join(sortedKeys(m.Unready), ",")
+		}
+		role := []string{}
+		for _, name := range roleChecks {
+			if msg, ok := m.Role[name]; ok && msg != "" {
+				role = append(role, name+" "+msg)
+			}
+		}
+		config := short(m.ConfigHash)
+		if m.ConfigHash != "" && m.ConfigHash != common {
+			config += " (differs)"
+		}
+		reconcile, parity := reconcileOf(m)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", m.Node, m.Pod, orDash(m.Mode), ready, orDash(strings.Join(role, ", ")), orDash(config), reconcile, parity, peersOf(m))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(hashes) > 1 {
+		fmt.Fprintf(w, "\n%d configs are applied across the nodes. most apply %s\n", len(hashes), short(common))
+	}
+	if len(f.Unannounced) > 0 {
+		fmt.Fprintf(w, "\n%d VIPs are announced by no bgp director: %s\n", len(f.Unannounced), strings.Join(f.Unannounced, ", "))
+	}
+	return nil
+}
+
+// reconcileOf sums up the last reconcile and parity check of the workers of
+// m.
+func reconcileOf(m member) (string, string) {
+	reconcile, parity := []string{}, []string{}
+	for _, name := range sortedKeys(m.Reconcile) {
+		r := m.Reconcile[name]
+		switch {
+		case r.Error != "":
+			reconcile = append(reconcile, "failed: "+r.Error)
+		case r.Last != "":
+			reconcile = append(reconcile, "ok at "+r.Last)
+		default:
+			reconcile = append(reconcile, "none yet")
+		}
+		switch {
+		case r.Parity == nil:
+		case *r.Parity:
+			parity = append(parity, "in sync")
+		default:
+			parity = append(parity, "out of sync")
+		}
+	}
+	return orDash(strings.Join(reconcile, ", ")), orDash(strings.Join(parity, ", "))
+}
+
+// peersOf counts the established bgp peers of m.
+func peersOf(m member) string {
+	if len(m.BGPPeers) == 0 {
+		return "-"
+	}
+	up := 0
+	for _, state := range m.BGPPeers {
+		if state == "Establ" {
+			up++
+		}
+	}
+	return strconv.Itoa(up) + "/" + strconv.Itoa(len(m.BGPPeers)) + " established"
+}
+
+func short(hash string) string {
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	return hash
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch m := m.(type) {
+	case map[string]string:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]health.ReconcileDetail:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+const bgpStatusz = `{
+ "ready": true,
+ "uptime": "1h0m0s",
+ "subsystems": {
+  "bgp": {"ready": true, "detail": {"reconciles": 12, "last": "2021-06-01T12:00:00Z", "parity": true, "parityChecked": "2021-06-01T12:00:05Z"}},
+  "bgp-peers": {"ready": true, "detail": {"10.0.0.1": "Establ", "10.0.0.2": "Active"}},
+  "bgp-prefixes": {"ready": true, "detail": {"ipv4": ["10.54.213.148/32"], "ipv6": ["2001:558:1044:1ae::7/128"]}},
+  "maintenance": {"ready": true, "message": "in service"},
+  "watcher": {"ready": true, "detail": {"configHash": "3q2+7wAAAAAA", "ipv4VIPs": 2}}
+ }
+}`
+
+const directorStatusz = `{
+ "ready": false,
+ "subsystems": {
+  "director": {"ready": false, "message": "last reconcile failed", "detail": {"reconciles": 3, "error": "ipvsadm failed"}},
+  "vrrp": {"ready": true, "message": "master"},
+  "watcher": {"ready": true, "detail": {"configHash": "9zzzzzzzzzzz"}}
+ }
+}`
+
+func TestFleet(t *testing.T) {
+	lb01 := parseMember(member{Node: "lb01", Pod: "ravel-bgp-a"}, []byte(bgpStatusz))
+	if lb01.Error != "" || lb01.Mode != "bgp" || lb01.ConfigHash != "3q2+7wAAAAAA" || lb01.Role["maintenance"] != "in service" {
+		t.Fatalf("unexpected member %+v", lb01)
+	}
+	if r := lb01.Reconcile["bgp"]; r.Parity == nil || !*r.Parity || r.Reconciles != 12 {
+		t.Fatalf("expected the reconcile of the bgp worker, got %+v", r)
+	}
+	if !reflect.DeepEqual(lb01.Announced, []string{"10.54.213.148", "2001:558:1044:1ae::7"}) {
+		t.Fatalf("expected the prefixes announced as VIPs, got %v", lb01.Announced)
+	}
+	lb02 := parseMember(member{Node: "lb02", Pod: "ravel-bgp-b"}, []byte(bgpStatusz))
+	lb03 := parseMember(member{Node: "lb03", Pod: "ravel-director-a"}, []byte(directorStatusz))
+	if lb03.Mode != "director" || lb03.Ready || lb03.Unready["director"] != "last reconcile failed" {
+		t.Fatalf("unexpected member %+v", lb03)
+	}
+	members := []member{lb01, lb02, lb03, {Node: "lb04", Pod: "ravel-bgp-c", Error: "pod is pending"}}
+
+	config := &types.ClusterConfig{
+		Config:  map[types.ServiceIP]types.PortMap{"10.54.213.148": {}, "10.54.213.149": {}},
+		Config6: map[types.ServiceIP]types.PortMap{"2001:558:1044:1ae:0:0:0:7": {}},
+	}
+	f := fleet{Members: members, Unannounced: unannounced(config, members)}
+	if !reflect.DeepEqual(f.Unannounced, []string{"10.54.213.149"}) {
+		t.Fatalf("expected only 10.54.213.149 unannounced, got %v", f.Unannounced)
+	}
+	if vips := unannounced(config, []member{lb03}); vips != nil {
+		t.Fatalf("expected nothing to be unannounced without bgp directors, got %v", vips)
+	}
+
+	b := &bytes.Buffer{}
+	if err := writeFleet(b, f); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"1/2 established", "in sync", "vrrp master", "9zzzzzzz (differs)", "failed: ipvsadm failed", "pod is pending", "2 configs are applied", "announced by no bgp director: 10.54.213.149"} {
+		if !strings.Contains(b.String(), line) {
+			t.Fatalf("expected %q in\n%s", line, b.String())
+		}
+	}
+}
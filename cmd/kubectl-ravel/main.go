@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// kubectl-ravel is a kubectl plugin, run as kubectl ravel, that shows the
+// ravel of every node in one view.
+func main() {
+	if err := command().Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func command() *cobra.Command {
+	var (
+		kubeconfig, kubecontext string
+		namespace, selector     string
+		configNamespace         string
+		configName, configKey   string
+		timeout                 time.Duration
+		output                  string
+	)
+
+	var cmd = &cobra.Command{
+		Use:           "kubectl-ravel",
+		Short:         "show the ravel of every node of the cluster",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		Long: `
+kubectl ravel reads the status of every ravel pod matching --selector in
+--namespace, through the pods proxy of the apiserver, and shows a line for
+each node: its mode, whether it is ready, the role it plays (the vrrp master
+or backup, the colocation owner, the director members and maintenance), the
+cluster config it applies, the outcome of its last reconcile and parity
+check, and its established bgp peers. Nodes applying a config that differs
+from the one most apply are marked. With --config-key, and the configmap of
+--config-namespace and --config-name, the VIPs of the config that no bgp
+director announces are listed too.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if output != "text" && output != "json" {
+				return fmt.Errorf("output must be one of text|json")
+			}
+			rules := clientcmd.NewDefaultClientConfigLoadingRules()
+			rules.ExplicitPath = kubeconfig
+			kubeConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: kubecontext}).ClientConfig()
+			if err != nil {
+				return err
+			}
+			client, err := kubernetes.NewForConfig(kubeConfig)
+			if err != nil {
+				return err
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+			if err != nil {
+				return fmt.Errorf("unable to list the ravel pods. %v", err)
+			}
+			if len(pods.Items) == 0 {
+				return fmt.Errorf("no pods in %s match %s", namespace, selector)
+			}
+			f := fleet{Members: readFleet(ctx, client, pods.Items)}
+
+			if configKey != "" {
+				cm, err := client.CoreV1().ConfigMaps(configNamespace).Get(ctx, configName, metav1.GetOptions{})
+				if err != nil {
+					return fmt.Errorf("unable to get configmap %s/%s. %v", configNamespace, configName, err)
+				}
+				config, err := types.NewClusterConfig(cm, configKey)
+				if err != nil {
+					return err
+				}
+				f.Unannounced = unannounced(config, f.Members)
+			}
+
+			if output == "json" {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(f)
+			}
+			return writeFleet(os.Stdout, f)
+		},
+	}
+	cmd.Flags().StringVar(&kubeconfig, "kubeconfig", "", "the kubeconfig to use, instead of $KUBECONFIG or ~/.kube/config")
+	cmd.Flags().StringVar(&kubecontext, "context", "", "the kubeconfig context to use")
+	cmd.Flags().StringVarP(&namespace, "namespace", "n", "kube-system", "the namespace of the ravel pods")
+	cmd.Flags().StringVarP(&selector, "selector", "l", "app=ravel", "the label selector of the ravel pods")
+	cmd.Flags().StringVar(&configNamespace, "config-namespace", "", "the namespace containing the configmap")
+	cmd.Flags().StringVar(&configName, "config-name", "", "the name of the configmap")
+	cmd.Flags().StringVar(&configKey, "config-key", "", "the key of the cluster config in the configmap, to find the VIPs no bgp director announces")
+	cmd.Flags().DurationVar(&timeout, "timeout", 10*time.Second, "how long to wait for the status of every pod")
+	cmd.Flags().StringVarP(&output, "output", "o", "text", "report format. one of text|json")
+
+	return cmd
+}
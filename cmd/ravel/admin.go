@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/admin"
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// startAdmin starts the admin endpoint when --admin-listen is set, and returns
+// nil otherwise. Handlers shared by every mode are registered here.
+func startAdmin(ctx context.Context, config *config.Config, s *stats.Stats, w *watcher.Watcher, logger logging.Logger) (*admin.Server, error) {
+	if config.Admin.Listen == "" {
+		return nil, nil
+	}
+
+	token, err := adminToken(config)
+	if err != nil {
+		return nil, err
+	}
+	var access *admin.Access
+	if config.Admin.AccessFile != "" {
+		if access, err = admin.LoadAccess(config.Admin.AccessFile); err != nil {
+			return nil, err
+		}
+	}
+	var tlsConfig *tls.Config
+	if config.Admin.CertFile != "" {
+		// without a token, a client certificate is the only way in
+		tokens := token != "" || access != nil && len(access.Tokens) > 0
+		tlsConfig, err = admin.ServerTLS(config.Admin.CertFile, config.Admin.KeyFile, config.Admin.CAFile, !tokens)
+		if err != nil {
+			return nil, err
+		}
+	}
+	srv, err := admin.NewServer(config.Admin.Listen, token, access, tlsConfig, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.Handle("/loglevel", logLevels)
+	srv.Handle("/audit", audit.Default())
+	srv.Handle("/changes", w.ChangesHandler())
+	srv.Handle("/config", w.ConfigHandler())
+	srv.Handle("/nodes", w.NodesHandler())
+	drainHandlers(ctx, srv, config, w)
+	if config.Stats.Enabled && config.Stats.TopTalkers > 0 {
+		srv.Handle("/talkers", s.TalkersHandler())
+	}
+
+	if err := srv.Start(ctx); err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
+
+// adminToken reads the bearer token of the admin endpoint, if there is one.
+func adminToken(config *config.Config) (string, error) {
+	if config.Admin.TokenFile == "" {
+		return "", nil
+	}
+	b, err := ioutil.ReadFile(config.Admin.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read admin token file: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// adminTimeout bounds a request of the admin CLI commands.
+const adminTimeout = 10 * time.Second
+
+// adminRequest sends a request to the admin endpoint of the ravel on this
+// node, found through --admin-listen and authenticated with --admin-token-file
+// or the certificate of --admin-cert, and copies the response body to out.
+func adminRequest(config *config.Config, method, path string, query url.Values, out io.Writer) error {
+	if config.Admin.Listen == "" || config.Admin.TokenFile == "" && config.Admin.CAFile == "" {
+		return withExitCode(exitUsage, fmt.Errorf("admin-listen and one of admin-token-file or admin-ca must be set"))
+	}
+	token, err := adminToken(config)
+	if err != nil {
+		return err
+	}
+	host, port, err := net.SplitHostPort(config.Admin.Listen)
+	if err != nil {
+		return fmt.Errorf("invalid admin-listen %s: %v", config.Admin.Listen, err)
+	}
+
+	client := &http.Client{Timeout: adminTimeout}
+	u := url.URL{Scheme: "http", Host: net.JoinHostPort(localHost(host), port), Path: path, RawQuery: query.Encode()}
+	if config.Admin.CertFile != "" {
+		tlsConfig, err := admin.ClientTLS(config.Admin.CertFile, config.Admin.KeyFile, config.Admin.CAFile, config.Admin.ServerName)
+		if err != nil {
+			return err
+		}
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+		u.Scheme = "https"
+	}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return withExitCode(exitTransient, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return withExitCode(adminExitCode(resp.StatusCode), fmt.Errorf("%s %s: %s", method, path, strings.TrimSpace(string(b))))
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+// adminExitCode is the exit code of an admin command refused with status.
+func adminExitCode(status int) int {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return exitDenied
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return exitTransient
+	case http.StatusBadRequest, http.StatusNotFound:
+		return exitUsage
+	}
+	return exitFailure
+}
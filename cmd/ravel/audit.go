@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+// initAudit sizes the audit trail and attaches the sinks that are enabled.
+// It must run before the worker starts making changes.
+func initAudit(config *config.Config, logger logging.Logger) error {
+	trail := audit.NewTrail(config.Audit.Size)
+
+	if config.Audit.File != "" {
+		sink, err := audit.NewFileSink(config.Audit.File)
+		if err != nil {
+			return err
+		}
+		trail.AddSink(sink)
+		logger.Infof("audit: writing events to %s", config.Audit.File)
+	}
+	if config.Audit.Journald {
+		sink, err := audit.NewJournaldSink()
+		if err != nil {
+			return err
+		}
+		trail.AddSink(sink)
+		logger.Infof("audit: writing events to the journal")
+	}
+
+	audit.SetDefault(trail)
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/role"
+)
+
+// AUTO runs the role that the labels of the node, and the election of
+// directors between candidate nodes, choose for it.
+func AUTO(ctx context.Context, logger logging.Logger) *cobra.Command {
+
+	var cmd = &cobra.Command{
+		Use:           "auto",
+		Short:         "run the director, bgp director or realserver, as the node's labels and the election of directors decide",
+		SilenceUsage:  false,
+		SilenceErrors: true,
+		Long: `
+auto lets a single DaemonSet run everywhere. The ravel.comcast.com/role label
+of a node pins it to director, bgp, colocated or realserver. A node without
+the label, or with it set to candidate, takes part in electing
+--auto-directors directors of the config key, through leases in
+config-namespace. An elected candidate runs --auto-director-role and the
+others run the realserver. When a director's node goes away, its slot passes
+to another candidate once it expires.
+
+A process that finds its role has changed stops the one it runs and exits,
+to be restarted in the new one. --mode pins the role instead of the label.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			a, err := newAuto(cmd, logger)
+			if err != nil {
+				return err
+			}
+			return a.run(ctx)
+		},
+	}
+
+	cmd.Flags().StringSlice("ipvs-sysctl", []string{""}, "sysctl setting for ipvs, for the director roles. can be passed multiple times. '--ipvs-sysctl=conntrack=0 --ipvs-sysctl=ignore_tunneled=0'")
+
+	return cmd
+}
+
+// RUN runs the role that --mode, or else the labels of the node and the
+// election of directors, choose for it, switching to a new role in place.
+func RUN(ctx context.Context, logger logging.Logger) *cobra.Command {
+
+	var cmd = &cobra.Command{
+		Use:           "run",
+		Short:         "run the director, bgp director or realserver, as --mode or the node's labels decide, switching roles in place",
+		SilenceUsage:  false,
+		SilenceErrors: true,
+		Long: `
+run lets a single manifest deploy ravel to every node. The role of the node is
+--mode, which can also be set as RAVEL_MODE or in the --config file, when it
+is director, bgp, colocated or realserver. Otherwise it is the one the
+ravel.comcast.com/role label of the node pins, and a node without the label,
+or with it set to candidate, takes part in electing --auto-directors
+directors as auto does.
+
+The label is checked every --auto-interval. When the role changes, run stops
+the one it runs, as on exit, and executes itself again in its place to run
+the new one, so that the container isn't restarted and the new role starts
+from a clean process.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			a, err := newAuto(cmd, logger)
+			if err != nil {
+				return err
+			}
+			a.inPlace = true
+			err = a.run(ctx)
+			if change, ok := err.(roleChange); ok {
+				return reexec(change, a.logger)
+			}
+			return err
+		},
+	}
+
+	cmd.Flags().StringSlice("ipvs-sysctl", []string{""}, "sysctl setting for ipvs, for the director roles. can be passed multiple times. '--ipvs-sysctl=conntrack=0 --ipvs-sysctl=ignore_tunneled=0'")
+
+	return cmd
+}
+
+// auto runs the role of its node, until the role changes.
+type auto struct {
+	config  *config.Config
+	client  kubernetes.Interface
+	elector *role.Elector
+	flags   *cobra.Command
+	logger  logging.Logger
+	// inPlace has run return a roleChange when the role changes, for the
+	// process to switch to the new role
+	inPlace bool
+}
+
+// newAuto validates the settings of the auto or run command cmd, and returns
+// the auto that runs the role of the node.
+func newAuto(cmd *cobra.Command, logger logging.Logger) (*auto, error) {
+	config := NewConfig(cmd.Flags())
+	if err := config.Validate(""); err != nil {
+		return nil, withExitCode(exitInvalid, err)
+	}
+	if config.DryRun {
+		return nil, withExitCode(exitInvalid, fmt.Errorf("dry-run can't be used with %s, which would take part in electing the directors. run the role of the node with dry-run instead", cmd.Name()))
+	}
+	kubeConfig, err := clientcmd.BuildConfigFromFlags("", config.KubeConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	elector, err := role.NewElector(client, config.ConfigMapNamespace, config.ConfigKey, config.NodeName, config.Auto.Directors, config.Auto.SlotTTL, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &auto{config: config, client: client, elector: elector, flags: cmd, logger: logger.WithFields(logging.Fields{"module": "auto"})}, nil
+}
+
+// roleChange is the change of role that run stopped for.
+type roleChange struct {
+	from, to string
+}
+
+func (c roleChange) Error() string {
+	return fmt.Sprintf("the role changed from %s to %s", c.from, c.to)
+}
+
+// reexec replaces the process with a new one of the same command line and
+// environment, which runs the role the node has changed to. The process
+// state of the role before it, such as its metrics and listeners, goes with
+// the old process.
+func reexec(change roleChange, logger logging.Logger) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find the executable to switch to the %s with. %v", change.to, err)
+	}
+	logger.Warnf("AUTO: switching from the %s to the %s in place", change.from, change.to)
+	for _, sink := range logSinks {
+		sink.Flush(time.Second)
+	}
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
+
+// decide returns the role of the node: the one --mode pins, the one its label
+// pins, or the one the election gives a candidate.
+func (a *auto) decide(ctx context.Context) (string, error) {
+	if mode := a.config.Auto.Mode; mode != "" && mode != role.Candidate {
+		return mode, nil
+	}
+	node, err := a.client.CoreV1().Nodes().Get(ctx, a.config.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	pinned, err := role.Of(node)
+	if err != nil || pinned != role.Candidate {
+		return pinned, err
+	}
+	elected, err := a.elector.Elect(ctx)
+	if err != nil {
+		a.logger.Warnf("AUTO: unable to reach every director slot. %v", err)
+	}
+	if elected {
+		return a.config.Auto.DirectorRole, nil
+	}
+	return role.Realserver, nil
+}
+
+// command returns the command of a role, running under ctx.
+func (a *auto) command(ctx context.Context, r string) *cobra.Command {
+	var cmd *cobra.Command
+	switch r {
+	case role.Director:
+		cmd = IPVSMASTER(ctx, a.logger)
+	case role.BGP:
+		cmd = BGP_DIRECTOR(ctx, a.logger)
+	case role.Colocated:
+		cmd = COLOCATED(ctx, a.logger)
+	default:
+		cmd = IPVSBACKEND_REALSERVER(ctx, a.logger)
+	}
+	// building a director binds ipvs-sysctl to its own flag, which auto
+	// didn't parse
+	viper.BindPFlag("ipvs-sysctl", a.flags.Flags().Lookup("ipvs-sysctl"))
+	return cmd
+}
+
+// run runs the role of the node until ctx is done, the role fails or the role
+// changes. A director gives up its slot unless it is to be restarted as one.
+// A change of role is returned as a roleChange when switching in place.
+func (a *auto) run(ctx context.Context) error {
+	current, err := a.decide(ctx)
+	if err != nil {
+		return err
+	}
+	a.logger.Infof("AUTO: node %s runs the %s", a.config.NodeName, current)
+
+	roleCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmd := a.command(roleCtx, current)
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.RunE(cmd, nil)
+	}()
+
+	next := current
+	defer func() {
+		if next == a.config.Auto.DirectorRole {
+			return
+		}
+		if err := a.elector.Release(context.Background()); err != nil {
+			a.logger.Errorf("AUTO: unable to release the director slot. %v", err)
+		}
+	}()
+
+	for {
+		interval := a.config.Auto.Interval
+		if current == a.config.Auto.DirectorRole {
+			interval = a.elector.RenewInterval()
+		}
+		select {
+		case <-ctx.Done():
+			next = ""
+			return <-done
+		case err := <-done:
+			next = ""
+			return err
+		case <-time.After(interval):
+		}
+
+		r, err := a.decide(ctx)
+		if err != nil {
+			a.logger.Warnf("AUTO: unable to check the role of node %s. keeping the %s. %v", a.config.NodeName, current, err)
+			continue
+		}
+		if r == current {
+			continue
+		}
+		a.logger.Warnf("AUTO: the role of node %s changed from %s to %s. stopping to restart as the %s", a.config.NodeName, current, r, r)
+		next = r
+		cancel()
+		err = <-done
+		if !a.inPlace {
+			return err
+		}
+		if err != nil {
+			a.logger.Errorf("AUTO: the %s stopped with an error. %v", current, err)
+		}
+		return roleChange{from: current, to: r}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/role"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+func TestDecide(t *testing.T) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "lb01", Labels: map[string]string{types.LabelRole: role.BGP}}}
+	a := &auto{config: &config.Config{NodeName: "lb01"}, client: fake.NewSimpleClientset(node), logger: logging.New()}
+
+	if r, err := a.decide(context.Background()); err != nil || r != role.BGP {
+		t.Fatalf("expected the role the label pins, got %q %v", r, err)
+	}
+	a.config.Auto.Mode = role.Realserver
+	if r, err := a.decide(context.Background()); err != nil || r != role.Realserver {
+		t.Fatalf("expected --mode to override the label, got %q %v", r, err)
+	}
+	a.config.Auto.Mode = role.Candidate
+	if r, err := a.decide(context.Background()); err != nil || r != role.BGP {
+		t.Fatalf("expected --mode=candidate to leave the role to the label, got %q %v", r, err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/Comcast/Ravel/pkg/bench"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/simulate"
+)
+
+// Bench times the reconcile of a mode over a generated cluster.
+func Bench(ctx context.Context, logger logging.Logger) *cobra.Command {
+	var (
+		spec       bench.Spec
+		iterations int
+		maxPhase   time.Duration
+		output     string
+	)
+
+	var cmd = &cobra.Command{
+		Use:           "bench <bgp|director|realserver>",
+		Short:         "time the reconcile of a mode over a generated cluster",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.ExactArgs(1),
+		Long: `
+bench generates a cluster of --vips services, each with --ports ports and
+--endpoints endpoints spread over --nodes nodes, and a cluster config with a
+VIP for each, and times how long a mode takes to reconcile it, so that a
+change that slows the reconcile of a large cluster down is caught before it
+ships. Each phase is run --iterations times: the watcher taking the listing
+of the cluster, the build of the cluster config, and the generating and
+merging of the rules of each subsystem of the mode, as simulate does it,
+against a node with nothing on it and against one already holding the
+config. The mean and slowest run, the bytes and allocations of a run and the
+changes planned are reported for each.
+
+Nothing is read from the cluster or changed on the node. The helpers are
+configured as the mode configures them, with the same settings. With
+--max-phase-duration, bench exits with 6 when the mean of a phase is over it.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config := NewConfig(cmd.Flags())
+			mode := args[0]
+			if simulate.Subsystems(mode) == nil {
+				return withExitCode(exitUsage, fmt.Errorf("unknown mode %s. must be one of bgp|director|realserver", mode))
+			}
+			if err := checkOutput(output); err != nil {
+				return err
+			}
+			if iterations < 1 {
+				return withExitCode(exitUsage, fmt.Errorf("iterations must be at least 1"))
+			}
+			if _, err := bench.Generate(spec); err != nil {
+				return withExitCode(exitUsage, err)
+			}
+			helpers, err := simulateHelpers(ctx, mode, config, logger)
+			if err != nil {
+				return err
+			}
+			// the watcher logs every service it builds at debug
+			quiet := logrus.New()
+			quiet.SetLevel(logrus.WarnLevel)
+			report, err := bench.Run(mode, spec, iterations, helpers, logging.FromLogrus(quiet))
+			if err != nil {
+				return err
+			}
+
+			if err := writeOutput(os.Stdout, output, report, func(w io.Writer) error { return writeBench(w, report) }); err != nil {
+				return err
+			}
+			if maxPhase > 0 {
+				for _, p := range report.Phases {
+					if p.Mean > maxPhase {
+						return withExitCode(exitUnhealthy, fmt.Errorf("phase %s took %s, over %s", p.Name, p.Mean, maxPhase))
+					}
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().IntVar(&spec.VIPs, "vips", 1000, "the number of VIPs to generate, each for a service of its own")
+	cmd.Flags().IntVar(&spec.Nodes, "nodes", 100, "the number of nodes to generate")
+	cmd.Flags().IntVar(&spec.Ports, "ports", 2, "the number of ports of each VIP")
+	cmd.Flags().IntVar(&spec.Endpoints, "endpoints", 3, "the number of endpoints of each service")
+	cmd.Flags().IntVar(&iterations, "iterations", 3, "how many times to run each phase")
+	cmd.Flags().DurationVar(&maxPhase, "max-phase-duration", 0, "exit with 6 when the mean of a phase is over this. 0 to not check")
+	outputFlag(cmd.Flags(), &output)
+
+	return cmd
+}
+
+// writeBench prints a line for each phase of report.
+func writeBench(w io.Writer, report bench.Report) error {
+	fmt.Fprintf(w, "%s over %d VIPs of %d ports, %d endpoints each, on %d nodes\n\n", report.Mode, report.Spec.VIPs, report.Spec.Ports, report.Spec.Endpoints, report.Spec.Nodes)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PHASE\tRUNS\tMEAN\tMAX\tBYTES/RUN\tALLOCS/RUN\tCHANGES")
+	for _, p := range report.Phases {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%d\t%d\n", p.Name, p.Runs, p.Mean.Round(time.Microsecond), p.Max.Round(time.Microsecond), humanRate(int64(p.AllocBytes)), p.Allocs, p.Changes)
+	}
+	return tw.Flush()
+}
@@ -4,17 +4,25 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 
+	"github.com/Comcast/Ravel/pkg/audit"
 	"github.com/Comcast/Ravel/pkg/bgp"
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/observe"
+	"github.com/Comcast/Ravel/pkg/profiling"
+	"github.com/Comcast/Ravel/pkg/role"
 	"github.com/Comcast/Ravel/pkg/stats"
 	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
 	"github.com/Comcast/Ravel/pkg/watcher"
 )
 
 // BGP_DIRECTOR configures IPVS, attracts packets in multi-master BGP_DIRECTOR mode
-func BGP_DIRECTOR(ctx context.Context, logger logrus.FieldLogger) *cobra.Command {
+func BGP_DIRECTOR(ctx context.Context, logger logging.Logger) *cobra.Command {
 
 	var cmd = &cobra.Command{
 		Use:           "bgp",
@@ -24,14 +32,39 @@ func BGP_DIRECTOR(ctx context.Context, logger logrus.FieldLogger) *cobra.Command
 		Long:          ``,
 		RunE: func(cmd *cobra.Command, _ []string) error {
 			log.Debugln("BGP_DIRECTOR: Ravel starting in BGP_DIRECTOR mode")
+			logger := logger.WithField(logging.FieldRole, role.BGP)
 
 			config := NewConfig(cmd.Flags())
-			logger.Debugf("BGP_DIRECTOR: Got config %+v", config)
+			logger.Infof("BGP_DIRECTOR: got config %s", config)
 
 			// validate flags
-			if err := config.Invalid(); err != nil {
+			if err := config.Validate(role.BGP); err != nil {
+				return withExitCode(exitInvalid, err)
+			}
+
+			// record changes made to the node from here on
+			if err := initAudit(config, logger); err != nil {
 				return err
 			}
+
+			// leave the node as it is, if observe-only or a dry run
+			if config.ObserveOnly || config.DryRun {
+				logger.Warn("BGP_DIRECTOR: observe-only or dry-run. changes to the node are recorded, not made")
+				observe.Enable(stats.KindBGPDirector, config.ConfigKey)
+			}
+
+			// refuse to run beside another ravel of this mode and config key
+			release, err := lockInstance(ctx, config, stats.KindBGPDirector, logger)
+			if err != nil {
+				return err
+			}
+			defer release()
+
+			// check the environment before taking traffic
+			if err := selfTest(ctx, config, stats.KindBGPDirector, logger); err != nil {
+				return err
+			}
+
 			log.Debugln("BGP_DIRECTOR: Done validating config flags")
 
 			// write IPVS Sysctl flags to director node
@@ -46,6 +79,7 @@ func BGP_DIRECTOR(ctx context.Context, logger logrus.FieldLogger) *cobra.Command
 			if err != nil {
 				return err
 			}
+			watcher.SetStrict(config.StrictConfig)
 
 			// and Stats for the BGP_DIRECTOR VIPs.
 			log.Infoln("BGP_DIRECTOR: creating BGP_DIRECTOR stats")
@@ -55,33 +89,101 @@ func BGP_DIRECTOR(ctx context.Context, logger logrus.FieldLogger) *cobra.Command
 			}
 			log.Debugln("BGP_DIRECTOR: checking if BGP_DIRECTOR stats enabled")
 			if config.Stats.Enabled {
+				if err := startFlowExport(ctx, config, s, logger); err != nil {
+					return fmt.Errorf("failed to initialize flow export. %v", err)
+				}
+				s.EnableTopTalkers(config.Stats.TopTalkers)
 				if err := s.EnableBPFStats(); err != nil {
-					return fmt.Errorf("failed to initialize BPF capture. if=%v sa=%s %v", config.Stats.Interface, config.Stats.ListenAddr, err)
+					return fmt.Errorf("failed to initialize eBPF counters. if=%v sa=%s %v", config.Stats.Interface, config.Stats.ListenAddr, err)
 				}
+				s.FollowConfig(func() *types.ClusterConfig { return watcher.ClusterConfig })
 			}
 
 			// emit the version metric
 			emitVersionMetric(stats.KindBGPDirector, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey)
 
+			// export the capacity of the conntrack and ipvs tables
+			if err := registerCapacity(config, stats.KindBGPDirector, logger); err != nil {
+				return err
+			}
+
+			// push the metrics to a remote-write endpoint, if enabled
+			if err := startRemoteWrite(config, s, logger); err != nil {
+				return err
+			}
+
+			// export reconfigure traces, if enabled
+			stopTracing, err := startTracing(ctx, config, stats.KindBGPDirector, logger)
+			if err != nil {
+				return err
+			}
+			defer stopTracing()
+
+			// serve the admin endpoint, if enabled
+			adminServer, err := startAdmin(ctx, config, s, watcher, logger)
+			if err != nil {
+				return err
+			}
+
+			// reload some settings without a restart
+			reload := newReloader(config, cmd.Flags(), logger)
+			reload.Handle(reloadStats(s))
+			if adminServer != nil {
+				adminServer.Handle("/reload", reload.handler())
+			}
+
+			// serve pprof and runtime metrics on localhost, if enabled. the
+			// port may be taken by another process on the node, which
+			// profiling isn't worth failing the mode over
+			if config.PprofPort != 0 {
+				if err := profiling.Serve(ctx, fmt.Sprintf("127.0.0.1:%d", config.PprofPort), logger); err != nil {
+					logger.Errorf("%v. continuing without profiling", err)
+				}
+			}
+
 			/* cmd/ipvsmaster.go does this, but original cmd/director_bgp.go did not. Should this one?
 						// Starting up control port.
 			            logger.Infof("starting listen controllers on %v", config.Coordinator.Ports)
 			            cm := NewCoordinationMetrics(stats.KindIpvsMaster)
-			            for _, port := range config.Coordinator.Ports {
-			                go listenController(port, cm, logger)
+			            listeners := newCoordinatorListeners(ctx, coordinatorTLS, newCoordinator(directorBeat(config, watcher, nil), cm, logger), cm, logger)
+			            if err := listeners.set(config.Coordinator.Ports); err != nil {
+			                return err
 			            }
-
-			            // listen for health
-			            logger.Info("starting health endpoint")
-			            go util.ListenForHealth(config.Net.Interface, 10201, logger)
 			*/
 
+			// listen for health
+			logger.Info("BGP_DIRECTOR: starting health endpoint")
+			checks := health.NewRegistry()
+			checks.Register("watcher", watcher.Health)
+			go util.ListenForHealth(config.Net.Interface, 10201, checks, logger)
+			if adminServer != nil {
+				adminServer.Handle("/status", statusHandler(config, stats.KindBGPDirector, watcher, checks))
+			}
+			if err := startStatusSocket(ctx, config, stats.KindBGPDirector, watcher, checks, logger); err != nil {
+				return err
+			}
+
+			// feed the cluster config and nodes to realservers, if enabled
+			if err := startConfigFeed(ctx, config, stats.KindBGPDirector, watcher, logger); err != nil {
+				return err
+			}
+
+			// every director announces the VIPs and programs ipvs either way;
+			// in active-active mode they also track each other
+			members, err := startMembership(ctx, config, stats.KindBGPDirector, watcher, checks, logger)
+			if err != nil {
+				return err
+			}
+
 			// instantiate a new IPVS manager
 			log.Infoln("BGP_DIRECTOR: Initializing ipvs helper with primary ip:", config.Net.PrimaryIP, "weight override", config.IPVS.WeightOverride, "ignore cordon", config.IPVS.IgnoreCordon)
 			ipvs, err := system.NewIPVS(ctx, config.Net.PrimaryIP, config.IPVS.WeightOverride, config.IPVS.IgnoreCordon, logger, stats.KindBGPDirector)
 			if err != nil {
 				return err
 			}
+			if err := ipvs.Own(config.Ownership()); err != nil {
+				return err
+			}
 
 			// instantiate an IP helper for loopback
 			log.Infoln("BGP_DIRECTOR: Initializing loopback IP helper")
@@ -89,6 +191,7 @@ func BGP_DIRECTOR(ctx context.Context, logger logrus.FieldLogger) *cobra.Command
 			if err != nil {
 				return err
 			}
+			ipLoopback.Own(config.Ownership())
 			if err := ipLoopback.SetARP(); err != nil {
 				return err
 			}
@@ -99,6 +202,7 @@ func BGP_DIRECTOR(ctx context.Context, logger logrus.FieldLogger) *cobra.Command
 			if err != nil {
 				return err
 			}
+			ipPrimary.Own(config.Ownership())
 
 			log.Debugln("BGP_DIRECTOR: Setting ARP on primary IP")
 			if err := ipPrimary.SetARP(); err != nil {
@@ -108,7 +212,54 @@ func BGP_DIRECTOR(ctx context.Context, logger logrus.FieldLogger) *cobra.Command
 			// instantiate BGP_DIRECTOR handler
 			log.Infoln("BGP_DIRECTOR: initializing BGP_DIRECTOR helper")
 			bgpController := bgp.NewBGPDController(config.BGP.Binary, logger)
-			worker, err := bgp.NewBGPWorker(ctx, config.ConfigKey, watcher, ipLoopback, ipPrimary, ipvs, bgpController, config.BGP.Communities, logger)
+			worker, err := bgp.NewBGPWorker(ctx, config.ConfigKey, watcher, ipLoopback, ipPrimary, ipvs, bgpController, config.BGP.Communities, config.OnExit, logger)
+			if err != nil {
+				return err
+			}
+			startSharding(config, members, worker, logger)
+			// hold the VIPs announced and withdrawn by hand
+			overrides, err := bgp.LoadOverrides(overridesFile(config))
+			if err != nil {
+				return err
+			}
+			if n := len(overrides.List()); n > 0 {
+				logger.Warnf("BGP_DIRECTOR: holding %d bgp overrides from an earlier run. see ravel bgp overrides", n)
+			}
+			worker.Override(overrides)
+			// announce with the communities in the config file
+			reload.Handle(reloadCommunities(worker.SetCommunities))
+			checks.Register("bgp", worker.Health)
+			checks.Register("bgp-peers", bgpController.Health)
+			checks.Register("bgp-prefixes", prefixesCheck(bgpController))
+			if adminServer != nil {
+				controlHandlers(adminServer, watcher, ipvs, worker)
+				adminServer.Handle("/prefixes", prefixesHandler(bgpController))
+				overrideHandlers(adminServer, watcher, overrides, worker)
+				exportHandler(adminServer, watcher, exportSources{ipvs: ipvs, ipvs6: true, ip: ipLoopback, rib: bgpController})
+			}
+			// withdraw the routes while the node is in maintenance
+			startMaintenance(ctx, config, stats.KindBGPDirector, watcher, checks, logger, worker.Maintenance)
+
+			// export the rib next to the config, with the announcements made
+			// from here on
+			prefixes := bgp.NewPrefixTracker()
+			audit.Default().AddSink(prefixes)
+			prometheus.MustRegister(bgp.NewRIBCollector(stats.KindBGPDirector, bgpController, func() *types.ClusterConfig { return watcher.ClusterConfig }, prefixes, logger))
+
+			// probe the VIPs, if enabled
+			if err := startProbe(ctx, config, stats.KindBGPDirector, watcher, logger); err != nil {
+				return err
+			}
+			// override settings at runtime through the admin endpoint
+			startLive(ctx, config, stats.KindBGPDirector, true, watcher, adminServer, logger)
+
+			// register with snmpd, if enabled
+			if err := startSNMP(ctx, config, stats.KindBGPDirector, watcher, s, ipvs, bgpController.Neighbors, logger); err != nil {
+				return err
+			}
+
+			// supervise the worker loops, if enabled
+			dog, err := startWatchdog(ctx, config, stats.KindBGPDirector, logger)
 			if err != nil {
 				return err
 			}
@@ -118,14 +269,24 @@ func BGP_DIRECTOR(ctx context.Context, logger logrus.FieldLogger) *cobra.Command
 			if err != nil {
 				return err
 			}
+			reload.start(ctx, config.ReloadInterval)
 
 			log.Debugln("BGP_DIRECTOR: Waiting for shutdown")
 
-			// catching exit signals sent from the parent context
-			<-ctx.Done()
-			return worker.Stop()
+			select {
+			case <-ctx.Done():
+				// catching exit signals sent from the parent context
+				shutdown, cancel := context.WithTimeout(context.Background(), config.ShutdownGracePeriod)
+				defer cancel()
+				return worker.Shutdown(shutdown)
+			case err := <-dog.Stalled():
+				// the stalled worker is left as it is for its replacement
+				return err
+			}
 		},
 	}
 
+	cmd.AddCommand(overrideCommands()...)
+
 	return cmd
 }
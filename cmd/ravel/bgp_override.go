@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/Comcast/Ravel/pkg/config"
+)
+
+// overridesFile is where a bgp director records the VIPs announced and
+// withdrawn by hand, so that they outlast a restart. Without a state-dir they
+// are kept in memory.
+func overridesFile(config *config.Config) string {
+	if config.StateDir == "" {
+		return ""
+	}
+	return filepath.Join(config.StateDir, "bgp-overrides-"+config.ConfigKey)
+}
+
+// overrideCommands announce and withdraw the VIPs of the bgp director on this
+// node by hand, through its admin endpoint.
+func overrideCommands() []*cobra.Command {
+	var (
+		communities []string
+		reason      string
+		output      string
+	)
+	run := func(method, path string) func(*cobra.Command, []string) error {
+		return func(cmd *cobra.Command, args []string) error {
+			q := url.Values{}
+			if len(args) > 0 {
+				q.Set("vip", args[0])
+			}
+			if len(communities) > 0 {
+				q.Set("communities", strings.Join(communities, ","))
+			}
+			if reason != "" {
+				q.Set("reason", reason)
+			}
+			return adminOutput(NewConfig(cmd.Flags()), method, path, q, output)
+		}
+	}
+
+	announce := &cobra.Command{
+		Use:          "announce <vip>",
+		Short:        "announce a VIP by hand, until the override is cleared",
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+		Long: `
+announce has the bgp director on this node announce a VIP of its cluster
+config whatever its shard, with --communities instead of --bgp-communities
+when given, over every reconfigure until the override is cleared. It talks to
+the admin endpoint of the director, using --admin-listen and
+--admin-token-file. Overrides are recorded in --state-dir, so that they
+outlast a restart, and maintenance still withdraws every route.`,
+		RunE: run(http.MethodPost, "/bgp/announce"),
+	}
+	announce.Flags().StringSliceVar(&communities, "communities", nil, "the communities to announce the VIP with, instead of --bgp-communities")
+	announce.Flags().StringVar(&reason, "reason", "", "why the VIP is announced by hand, kept with the override")
+
+	withdraw := &cobra.Command{
+		Use:          "withdraw <vip>",
+		Short:        "withdraw a VIP by hand, until the override is cleared",
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+		Long: `
+withdraw has the bgp director on this node keep the route to a VIP of its
+cluster config withdrawn, over every reconfigure until the override is
+cleared. The VIP stays on loopback and in ipvs, so that connections already
+routed to the director finish.`,
+		RunE: run(http.MethodPost, "/bgp/withdraw"),
+	}
+	withdraw.Flags().StringVar(&reason, "reason", "", "why the VIP is withdrawn by hand, kept with the override")
+
+	cmds := []*cobra.Command{
+		announce,
+		withdraw,
+		{
+			Use:          "clear <vip>",
+			Short:        "clear the override of a VIP, which the director announces as the config says again",
+			SilenceUsage: true,
+			Args:         cobra.ExactArgs(1),
+			RunE:         run(http.MethodPost, "/bgp/clear"),
+		},
+		{
+			Use:          "overrides",
+			Short:        "list the VIPs announced and withdrawn by hand",
+			SilenceUsage: true,
+			Args:         cobra.NoArgs,
+			RunE:         run(http.MethodGet, "/bgp/overrides"),
+		},
+	}
+	for _, cmd := range cmds {
+		outputFlag(cmd.Flags(), &output)
+	}
+	return cmds
+}
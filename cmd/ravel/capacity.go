@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Comcast/Ravel/pkg/capacity"
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// registerCapacity exports the size of the kernel connection tables, read
+// from /proc on every scrape.
+func registerCapacity(config *config.Config, kind stats.LBKind, logger logging.Logger) error {
+	c, err := capacity.NewCollector(kind, config.Capacity.Thresholds(), logger)
+	if err != nil {
+		return err
+	}
+	return prometheus.Register(c)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/Comcast/Ravel/pkg/bgp"
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/haproxy"
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/observe"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/system"
+)
+
+// healthPorts are where a running realserver and director answer health
+// checks.
+var healthPorts = []int{10200, 10201}
+
+// running returns the health ports a ravel on the node answers on.
+func running() []int {
+	ports := []int{}
+	for _, port := range healthPorts {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// cleanupStep is a part of the node that cleanup removes.
+type cleanupStep struct {
+	name string
+	run  func(ctx context.Context) (string, error)
+}
+
+// cleanupSteps returns the steps removing what ravel left on the node, in
+// order: the bgp routes first, so that traffic moves away before the rest is
+// removed, and the VIP devices last, since the steps before tell what is
+// theirs by them on a shared node.
+func cleanupSteps(config *config.Config, logger logging.Logger) ([]cleanupStep, error) {
+	ownership := config.Ownership()
+	ip, err := system.NewIP(context.Background(), config.Net.Interface, config.Net.Gateway, config.Arp.PrimaryAnnounce, config.Arp.PrimaryIgnore, logger)
+	if err != nil {
+		return nil, err
+	}
+	ip.Own(ownership)
+	ipvs, err := system.NewIPVS(context.Background(), config.Net.PrimaryIP, config.IPVS.WeightOverride, config.IPVS.IgnoreCordon, logger, stats.KindIpvsMaster)
+	if err != nil {
+		return nil, err
+	}
+	if err := ipvs.Own(ownership); err != nil {
+		return nil, err
+	}
+	ipt, err := iptables.NewIPTables(context.Background(), stats.KindIpvsMaster, config.ConfigKey, config.PodCIDRMasq, config.IPTablesChain, config.IPTablesMasq, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// owned tells the addresses of the VIP devices ravel owns on the node
+	owned := func(addr string) (bool, error) {
+		v4, v6, err := ip.Get()
+		if err != nil {
+			return false, err
+		}
+		isV6 := strings.Contains(addr, ":")
+		devices := v4
+		if isV6 {
+			devices = v6
+		}
+		for _, device := range devices {
+			if device == ip.Device(addr, isV6) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	steps := []cleanupStep{}
+	// gobgp is only on the nodes of bgp directors
+	if _, err := exec.LookPath(config.BGP.Binary); err == nil {
+		controller := bgp.NewBGPDController(config.BGP.Binary, logger)
+		steps = append(steps, cleanupStep{name: "bgp", run: func(ctx context.Context) (string, error) {
+			if !ownership.Shared {
+				return "every route withdrawn", controller.Teardown(ctx)
+			}
+			withdrawn := 0
+			for _, family := range []string{"ipv4", "ipv6"} {
+				prefixes, err := controller.RIB(ctx, family)
+				if err != nil {
+					return "", err
+				}
+				addresses := []string{}
+				for _, prefix := range prefixes {
+					addr := strings.SplitN(prefix, "/", 2)[0]
+					if ok, err := owned(addr); err != nil {
+						return "", err
+					} else if ok {
+						addresses = append(addresses, addr)
+					}
+				}
+				if err := controller.Withdraw(ctx, family, addresses); err != nil {
+					return "", err
+				}
+				withdrawn += len(addresses)
+			}
+			return fmt.Sprintf("%d routes of %s withdrawn", withdrawn, config.ConfigKey), nil
+		}})
+	}
+	steps = append(steps,
+		cleanupStep{name: "haproxy", run: func(ctx context.Context) (string, error) {
+			var ownedErr error
+			cleaned, err := haproxy.Cleanup("/etc/ravel", func(addr string) bool {
+				if !ownership.Shared {
+					return true
+				}
+				ok, err := owned(addr)
+				if err != nil {
+					ownedErr = err
+				}
+				return ok
+			})
+			if err == nil {
+				err = ownedErr
+			}
+			return fmt.Sprintf("%d listeners stopped", len(cleaned)), err
+		}},
+		cleanupStep{name: "iptables", run: func(ctx context.Context) (string, error) {
+			return "the chains under " + config.IPTablesChain + " removed", ipt.Remove()
+		}},
+		cleanupStep{name: "ipvs", run: func(ctx context.Context) (string, error) {
+			if ownership.Shared {
+				return "the services of " + config.ConfigKey + " deleted", ipvs.Teardown(ctx)
+			}
+			return "every service deleted", ipvs.Teardown(ctx)
+		}},
+		cleanupStep{name: "devices", run: func(ctx context.Context) (string, error) {
+			return "the VIP devices removed", ip.Release(ctx)
+		}},
+	)
+	return steps, nil
+}
+
+// cleanupResult is the outcome of a cleanup step, as cleanup prints it.
+type cleanupResult struct {
+	Step   string `json:"step"`
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+	DryRun bool   `json:"dryRun,omitempty"`
+}
+
+// writeCleanup prints the outcome of each cleanup step for people.
+func writeCleanup(w io.Writer, results []cleanupResult) error {
+	for _, r := range results {
+		switch {
+		case r.Error != "":
+			fmt.Fprintf(w, "%s: failed: %s\n", r.Step, r.Error)
+		case r.DryRun:
+			fmt.Fprintf(w, "%s: %s (dry run)\n", r.Step, r.Result)
+		default:
+			fmt.Fprintf(w, "%s: %s\n", r.Step, r.Result)
+		}
+	}
+	return nil
+}
+
+// Cleanup removes what ravel leaves on a node, to decommission it.
+func Cleanup(ctx context.Context, logger logging.Logger) *cobra.Command {
+	var (
+		force  bool
+		output string
+	)
+
+	var cmd = &cobra.Command{
+		Use:           "cleanup",
+		Short:         "remove everything ravel left on this node",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		Long: `
+cleanup removes what ravel leaves on a node, since a director leaves it
+serving when it stops unless --on-exit says otherwise: it withdraws the bgp
+routes where gobgp is installed, stops the haproxy listeners and removes their
+configs, removes the iptables chains under --iptables-chain, deletes the ipvs
+services and removes the VIP devices. Each step runs even if one before it
+failed, and the command exits non-zero if any did.
+
+With --shared-node, only what the --config-key owns is removed: the VIP
+devices tagged as its own, the routes, listeners and services of their
+addresses and those recorded under --state-dir, and the chains that no other
+instance jumps into. Otherwise every VIP device and ipvs service on the node
+is removed.
+
+It refuses to run while a ravel answers health checks on the node, which
+would put it all back, unless --force is given. With --dry-run, what it would
+remove is logged and recorded in the audit trail instead.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if err := checkOutput(output); err != nil {
+				return err
+			}
+			config := NewConfig(cmd.Flags())
+			if config.DryRun {
+				observe.Enable("cleanup", config.ConfigKey)
+			}
+			if ports := running(); len(ports) > 0 && !force && !config.DryRun {
+				return fmt.Errorf("a ravel is running on this node, answering health checks on %v. stop it first, or pass --force", ports)
+			}
+
+			steps, err := cleanupSteps(config, logger)
+			if err != nil {
+				return err
+			}
+			results := []cleanupResult{}
+			failed := []string{}
+			for _, step := range steps {
+				result, err := step.run(ctx)
+				if err != nil {
+					results = append(results, cleanupResult{Step: step.name, Error: err.Error()})
+					failed = append(failed, step.name)
+					continue
+				}
+				results = append(results, cleanupResult{Step: step.name, Result: result, DryRun: config.DryRun})
+			}
+			if err := writeOutput(os.Stdout, output, results, func(w io.Writer) error { return writeCleanup(w, results) }); err != nil {
+				return err
+			}
+			if len(failed) > 0 {
+				return fmt.Errorf("unable to clean up %s", strings.Join(failed, ", "))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&force, "force", false, "clean up even while a ravel answers health checks on the node, such as another instance on a shared node")
+	outputFlag(cmd.Flags(), &output)
+
+	return cmd
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/Comcast/Ravel/pkg/colocation"
+	"github.com/Comcast/Ravel/pkg/director"
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/observe"
+	"github.com/Comcast/Ravel/pkg/profiling"
+	"github.com/Comcast/Ravel/pkg/realserver"
+	"github.com/Comcast/Ravel/pkg/role"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// COLOCATED runs the director and the realserver of a node in one process.
+func COLOCATED(ctx context.Context, logger logging.Logger) *cobra.Command {
+
+	var cmd = &cobra.Command{
+		Use:           "colocated",
+		Short:         "kube2ipvs director and realserver in one process",
+		SilenceUsage:  false,
+		SilenceErrors: true,
+		Long: `
+kube2ipvs colocated runs the director and the realserver of a node in one
+process, for small clusters that can't dedicate nodes to directors.
+
+The two roles share one watcher, one metrics endpoint and one health
+endpoint. Instead of following each other over the coordinator heartbeat,
+they hand the node's VIP addresses and iptables chain between them: the
+director owns them while it holds the VIPs, and the realserver the rest of
+the time, so a vrrp backup still serves its local pods for the master.
+Requires an ipvs-colocation-mode of iptables or ipvs.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+
+			log.Debugln("COLOCATED: Starting in COLOCATED mode")
+			logger := logger.WithField(logging.FieldRole, role.Colocated)
+
+			config := NewConfig(cmd.Flags())
+			logger.Infof("COLOCATED: got config %s", config)
+
+			// validate flags
+			logger.Info("COLOCATED: validating")
+			if err := config.Validate(role.Colocated); err != nil {
+				return withExitCode(exitInvalid, err)
+			}
+
+			// record changes made to the node from here on
+			if err := initAudit(config, logger); err != nil {
+				return err
+			}
+
+			// leave the node as it is, if a dry run
+			if config.DryRun {
+				logger.Warn("COLOCATED: dry-run. changes to the node are recorded, not made")
+				observe.Enable(stats.KindColocated, config.ConfigKey)
+			}
+
+			// refuse to run beside another ravel of this mode and config key
+			release, err := lockInstance(ctx, config, stats.KindColocated, logger)
+			if err != nil {
+				return err
+			}
+			defer release()
+
+			// check the environment of both roles before taking traffic
+			if err := selfTest(ctx, config, stats.KindColocated, logger); err != nil {
+				return err
+			}
+
+			// write IPVS Sysctl flags to the node
+			if err := config.IPVS.WriteToNode(); err != nil {
+				return err
+			}
+
+			// one watcher serves both roles
+			logger.Info("COLOCATED: starting watcher")
+			watcher, err := watcher.NewWatcher(ctx, config.KubeConfigFile, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey, stats.KindColocated, config.DefaultListener.Service, config.DefaultListener.Port, logger)
+			if err != nil {
+				return err
+			}
+			watcher.SetStrict(config.StrictConfig)
+
+			// initialize statistics
+			s, err := stats.NewStats(ctx, stats.KindColocated, config.Stats.Interface, config.Stats.ListenAddr, config.Stats.ListenPort, config.Stats.Interval, logger)
+			if err != nil {
+				return fmt.Errorf("failed to initialize metrics. %v", err)
+			}
+			if config.Stats.Enabled {
+				if err := startFlowExport(ctx, config, s, logger); err != nil {
+					return fmt.Errorf("failed to initialize flow export. %v", err)
+				}
+				s.EnableTopTalkers(config.Stats.TopTalkers)
+				if err := s.EnableBPFStats(); err != nil {
+					return fmt.Errorf("failed to initialize eBPF counters. if=%v sa=%s %v", config.Stats.Interface, config.Stats.ListenAddr, err)
+				}
+				s.FollowConfig(func() *types.ClusterConfig { return watcher.ClusterConfig })
+			}
+			// emit the version metric
+			emitVersionMetric(stats.KindColocated, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey)
+
+			// export the capacity of the conntrack and ipvs tables
+			if err := registerCapacity(config, stats.KindColocated, logger); err != nil {
+				return err
+			}
+
+			// push the metrics to a remote-write endpoint, if enabled
+			if err := startRemoteWrite(config, s, logger); err != nil {
+				return err
+			}
+
+			// export reconfigure traces, if enabled
+			stopTracing, err := startTracing(ctx, config, stats.KindColocated, logger)
+			if err != nil {
+				return err
+			}
+			defer stopTracing()
+
+			// serve the admin endpoint, if enabled
+			adminServer, err := startAdmin(ctx, config, s, watcher, logger)
+			if err != nil {
+				return err
+			}
+
+			// reload some settings without a restart
+			reload := newReloader(config, cmd.Flags(), logger)
+			reload.Handle(reloadStats(s))
+			if adminServer != nil {
+				adminServer.Handle("/reload", reload.handler())
+			}
+
+			// serve pprof and runtime metrics on localhost, if enabled. the
+			// port may be taken by another process on the node, which
+			// profiling isn't worth failing the mode over
+			if config.PprofPort != 0 {
+				if err := profiling.Serve(ctx, fmt.Sprintf("127.0.0.1:%d", config.PprofPort), logger); err != nil {
+					logger.Errorf("%v. continuing without profiling", err)
+				}
+			}
+
+			// listen for health
+			logger.Info("COLOCATED: starting health endpoint")
+			checks := health.NewRegistry()
+			checks.Register("watcher", watcher.Health)
+			go util.ListenForHealth(config.Net.Interface, 10201, checks, logger)
+			if adminServer != nil {
+				adminServer.Handle("/status", statusHandler(config, stats.KindColocated, watcher, checks))
+			}
+			if err := startStatusSocket(ctx, config, stats.KindColocated, watcher, checks, logger); err != nil {
+				return err
+			}
+
+			// the director programs ipvs, and the realserver doesn't touch
+			// it, so they share the helper
+			logger.Info("COLOCATED: initializing ipvs helper")
+			ipvs, err := system.NewIPVS(ctx, config.Net.PrimaryIP, config.IPVS.WeightOverride, config.IPVS.IgnoreCordon, logger, stats.KindIpvsMaster)
+			if err != nil {
+				return err
+			}
+			if err := ipvs.Own(config.Ownership()); err != nil {
+				return err
+			}
+
+			// probe the VIPs, if enabled
+			if err := startProbe(ctx, config, stats.KindColocated, watcher, logger); err != nil {
+				return err
+			}
+			// override settings at runtime through the admin endpoint
+			live := startLive(ctx, config, stats.KindColocated, true, watcher, adminServer, logger)
+
+			// register with snmpd, if enabled
+			if err := startSNMP(ctx, config, stats.KindColocated, watcher, s, ipvs, nil, logger); err != nil {
+				return err
+			}
+
+			// the director's arp rules on loopback only apply at startup
+			logger.Info("COLOCATED: initializing loopback ip helpers")
+			ipLoopback, err := system.NewIP(ctx, "lo", config.Net.Gateway, config.Arp.LoAnnounce, config.Arp.LoIgnore, logger)
+			if err != nil {
+				return err
+			}
+			ipLoopback.Own(config.Ownership())
+			if err := ipLoopback.SetARP(); err != nil {
+				return err
+			}
+			ipDevices, err := system.NewIP(ctx, config.Net.LocalInterface, config.Net.Gateway, config.Arp.LoAnnounce, config.Arp.LoIgnore, logger)
+			if err != nil {
+				return err
+			}
+			ipDevices.Own(config.Ownership())
+
+			logger.Info("COLOCATED: initializing primary ip helper")
+			ip, err := system.NewIP(ctx, config.Net.Interface, config.Net.Gateway, config.Arp.PrimaryAnnounce, config.Arp.PrimaryIgnore, logger)
+			if err != nil {
+				return err
+			}
+			ip.Own(config.Ownership())
+
+			// each role writes the chain under its own kind, but only while
+			// it owns the node
+			logger.Info("COLOCATED: initializing iptables")
+			directorIPT, err := iptables.NewIPTables(ctx, stats.KindIpvsMaster, config.ConfigKey, config.PodCIDRMasq, config.IPTablesChain, config.IPTablesMasq, logger)
+			if err != nil {
+				return err
+			}
+			realserverIPT, err := iptables.NewIPTables(ctx, stats.KindIpvsBackend, config.ConfigKey, config.PodCIDRMasq, config.IPTablesChain, config.IPTablesMasq, logger)
+			if err != nil {
+				return err
+			}
+			reload.Handle(reloadMasq(directorIPT, realserverIPT))
+
+			// float the VIPs between directors over vrrp, if enabled
+			claim, err := startFence(config, stats.KindIpvsMaster, watcher, checks, logger)
+			if err != nil {
+				return err
+			}
+			router, err := startVRRP(ctx, config, stats.KindIpvsMaster, watcher, claim, checks, logger)
+			if err != nil {
+				return err
+			}
+			if err := startIPVSSync(ctx, config, stats.KindIpvsMaster, router, logger); err != nil {
+				return err
+			}
+
+			// the realserver only runs while the director gives it the
+			// node, and hands it straight back, as the node's pods are
+			// then served through ipvs
+			logger.Info("COLOCATED: initializing realserver")
+			haproxySet, err := startHAProxy(ctx, config, logger)
+			if err != nil {
+				return err
+			}
+			if adminServer != nil {
+				adminServer.Handle("/haproxy/", haproxySet.AdminHandler())
+			}
+			rs, err := realserver.NewRealServer(ctx, config.NodeName, config.ConfigKey, watcher, ip, ipDevices, ipvs, realserverIPT, config.ForcedReconfigure, 0, haproxySet, logger)
+			if err != nil {
+				return err
+			}
+			checks.Register("realserver", rs.Health)
+			if config.WarmStandbyInterval > 0 {
+				rs.Standby(config.WarmStandbyInterval)
+			}
+			// take the node out of rotation while it can't serve, if enabled
+			if err := startSelfHealth(ctx, config, stats.KindColocated, watcher, realserverIPT, haproxySet, checks, logger); err != nil {
+				return err
+			}
+			arbiter := colocation.New(rs, config.ConfigKey, logger)
+			checks.Register("colocation", arbiter.Health)
+
+			logger.Info("COLOCATED: initializing director")
+			worker, err := director.NewDirector(ctx, config.NodeName, config.ConfigKey, config.OnExit, watcher, ipvs, ip, directorIPT, config.IPVS.ColocationMode, config.ForcedReconfigure, router, arbiter)
+			if err != nil {
+				return err
+			}
+			checks.Register("director", worker.Health)
+			setInterval := worker.SetForcedReconfigureInterval
+			if live != nil {
+				setInterval = live.ReconfigureInterval(setInterval)
+			}
+			setInterval(config.ForcedReconfigureInterval)
+			reload.Handle(reloadForcedInterval(setInterval))
+			if adminServer != nil {
+				controlHandlers(adminServer, watcher, ipvs, worker)
+				exportHandler(adminServer, watcher, exportSources{ipvs: ipvs, ipt: realserverIPT, ip: ipLoopback})
+			}
+			// step down while the node is in maintenance
+			startMaintenance(ctx, config, stats.KindColocated, watcher, checks, logger, worker.Maintenance)
+
+			// supervise the worker loops, if enabled
+			dog, err := startWatchdog(ctx, config, stats.KindColocated, logger)
+			if err != nil {
+				return err
+			}
+
+			logger.Info("COLOCATED: starting director")
+			if err := worker.Start(); err != nil {
+				return err
+			}
+			reload.start(ctx, config.ReloadInterval)
+			logger.Info("COLOCATED: started")
+			select {
+			case <-ctx.Done():
+				// the director applies on-exit to a node it owns, the
+				// realserver cleans up after itself, and a vrrp director
+				// hands the VIPs to a backup
+				shutdown, cancel := context.WithTimeout(context.Background(), config.ShutdownGracePeriod)
+				defer cancel()
+				err := worker.Shutdown(shutdown)
+				if rsErr := arbiter.Shutdown(shutdown); err == nil {
+					err = rsErr
+				}
+				if router != nil {
+					releaseVIPs(config, logger)
+					router.Withdrawn(context.Background())
+				}
+				return err
+			case err := <-dog.Stalled():
+				return err
+			}
+		},
+	}
+
+	cmd.Flags().StringSlice("ipvs-sysctl", []string{""}, "sysctl setting for ipvs. can be passed multiple times. '--ipvs-sysctl=conntrack=0 --ipvs-sysctl=ignore_tunneled=0'")
+	viper.BindPFlag("ipvs-sysctl", cmd.Flags().Lookup("ipvs-sysctl"))
+
+	return cmd
+}
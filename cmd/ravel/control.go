@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Comcast/Ravel/pkg/admin"
+	"github.com/Comcast/Ravel/pkg/bgp"
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/maintenance"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// controllable is a worker the admin endpoint can pause and reconfigure.
+type controllable interface {
+	Pause(paused bool)
+	Reconfigure()
+}
+
+// ribReader lists the prefixes announced for family ipv4 or ipv6.
+type ribReader interface {
+	RIB(ctx context.Context, family string) ([]string, error)
+}
+
+// controlHandlers registers the introspection and control handlers of a
+// director on the admin endpoint: the ipvs rules it programs and how they
+// differ from the config, its virtual services as ravel sees them, flushing
+// those of a VIP, pausing and resuming it, and a reconfigure now.
+func controlHandlers(srv *admin.Server, w *watcher.Watcher, ipvs *system.IPVS, worker controllable) {
+	srv.Handle("/ipvs", getHandler(func(r *http.Request) (interface{}, error) {
+		v4, err := ipvs.Get()
+		if err != nil {
+			return nil, err
+		}
+		v6, err := ipvs.GetV6()
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]string{"v4": v4, "v6": v6}, nil
+	}))
+	srv.Handle("/parity", getHandler(func(r *http.Request) (interface{}, error) {
+		missing, extra, err := ipvs.ParityDiff(w, w.ClusterConfig)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]string{"missing": missing, "extra": extra}, nil
+	}))
+	srv.Handle("/ipvs/services", getHandler(func(r *http.Request) (interface{}, error) {
+		services, err := ipvs.Inspect(w, w.ClusterConfig)
+		if err != nil {
+			return nil, err
+		}
+		vip := net.ParseIP(r.URL.Query().Get("vip"))
+		if vip == nil {
+			return services, nil
+		}
+		out := []system.VirtualService{}
+		for _, svc := range services {
+			if vip.Equal(net.ParseIP(svc.VIP)) {
+				out = append(out, svc)
+			}
+		}
+		return out, nil
+	}))
+	srv.Handle("/ipvs/flush", postHandler("flush", func(r *http.Request) (string, error) {
+		vip := r.URL.Query().Get("vip")
+		services, err := ipvs.FlushVIP(vip)
+		if err != nil {
+			return "", err
+		}
+		worker.Reconfigure()
+		return fmt.Sprintf("flushed %s. the reconfigure requested programs what the config wants again", strings.Join(services, ", ")), nil
+	}))
+	srv.Handle("/pause", postHandler("pause", func(r *http.Request) (string, error) {
+		worker.Pause(true)
+		return "paused", nil
+	}))
+	srv.Handle("/resume", postHandler("resume", func(r *http.Request) (string, error) {
+		worker.Pause(false)
+		return "resumed", nil
+	}))
+	srv.Handle("/reconfigure", postHandler("reconfigure", func(r *http.Request) (string, error) {
+		worker.Reconfigure()
+		return "reconfigure requested", nil
+	}))
+}
+
+// prefixesHandler serves the prefixes a bgp director announces.
+func prefixesHandler(rib ribReader) http.Handler {
+	return getHandler(func(r *http.Request) (interface{}, error) {
+		out := map[string][]string{}
+		for _, family := range []string{"ipv4", "ipv6"} {
+			prefixes, err := rib.RIB(r.Context(), family)
+			if err != nil {
+				return nil, err
+			}
+			out[family] = prefixes
+		}
+		return out, nil
+	})
+}
+
+// prefixesCheck reports the prefixes a bgp director announces in its
+// status, so that a fleet view can find the VIPs no director announces. It is
+// always ready, as the sessions that announce them are the bgp-peers check's
+// concern.
+func prefixesCheck(rib ribReader) health.Check {
+	return func(ctx context.Context) health.Status {
+		out := map[string][]string{}
+		for _, family := range []string{"ipv4", "ipv6"} {
+			prefixes, err := rib.RIB(ctx, family)
+			if err != nil {
+				return health.Status{Ready: true, Message: fmt.Sprintf("unable to read the %s RIB. %v", family, err)}
+			}
+			out[family] = prefixes
+		}
+		return health.Status{Ready: true, Detail: out}
+	}
+}
+
+// overrideHandlers registers announcing and withdrawing the VIPs of a bgp
+// director by hand on the admin endpoint, until the override is cleared, and
+// listing the overrides. Only the VIPs of the cluster config can be
+// overridden.
+func overrideHandlers(srv *admin.Server, w *watcher.Watcher, overrides *bgp.Overrides, worker controllable) {
+	set := func(action, doing string) http.Handler {
+		return postHandler(action, func(r *http.Request) (string, error) {
+			q := r.URL.Query()
+			vip := q.Get("vip")
+			if !isVIP(w.ClusterConfig, vip) {
+				return "", fmt.Errorf("%s is not a VIP of the cluster config", vip)
+			}
+			ov := bgp.Override{VIP: vip, Action: action, Reason: q.Get("reason")}
+			if c := q.Get("communities"); c != "" {
+				ov.Communities = strings.Split(c, ",")
+			}
+			if err := overrides.Set(ov); err != nil {
+				return "", err
+			}
+			worker.Reconfigure()
+			return doing + " " + vip + " until the override is cleared", nil
+		})
+	}
+	srv.HandleScoped("/bgp/announce", admin.ScopeAnnounce, set(bgp.OverrideAnnounce, "announcing"))
+	srv.HandleScoped("/bgp/withdraw", admin.ScopeAnnounce, set(bgp.OverrideWithdraw, "withdrawing"))
+	srv.HandleScoped("/bgp/clear", admin.ScopeAnnounce, postHandler("clear", func(r *http.Request) (string, error) {
+		vip := r.URL.Query().Get("vip")
+		ok, err := overrides.Clear(vip)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", fmt.Errorf("%s is not overridden", vip)
+		}
+		worker.Reconfigure()
+		return "the override of " + vip + " is cleared", nil
+	}))
+	srv.Handle("/bgp/overrides", getHandler(func(r *http.Request) (interface{}, error) {
+		return overrides.List(), nil
+	}))
+}
+
+// isVIP reports whether vip is a v4 or v6 VIP of config.
+func isVIP(config *types.ClusterConfig, vip string) bool {
+	ip := net.ParseIP(vip)
+	if config == nil || ip == nil {
+		return false
+	}
+	for _, vips := range []map[types.ServiceIP]types.PortMap{config.Config, config.Config6} {
+		for addr := range vips {
+			if ip.Equal(net.ParseIP(string(addr))) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// drainHandlers registers putting the node in maintenance, and taking it out,
+// on the admin endpoint. The annotation they set is what the maintenance
+// command sets, so every ravel on the node follows it.
+func drainHandlers(ctx context.Context, srv *admin.Server, config *config.Config, w *watcher.Watcher) {
+	srv.HandleScoped("/drain", admin.ScopeDrain, postHandler("drain", func(r *http.Request) (string, error) {
+		reason := r.URL.Query().Get("reason")
+		if reason == "" {
+			reason = "drained through the admin endpoint"
+		}
+		return "node " + config.NodeName + " is in maintenance: " + reason, maintenance.Set(ctx, w.Clientset(), config.NodeName, reason)
+	}))
+	srv.HandleScoped("/undrain", admin.ScopeDrain, postHandler("undrain", func(r *http.Request) (string, error) {
+		return "node " + config.NodeName + " is in service", maintenance.Set(ctx, w.Clientset(), config.NodeName, "")
+	}))
+}
+
+// getHandler serves the json of what get returns.
+func getHandler(get func(r *http.Request) (interface{}, error)) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.Header().Set("Allow", "GET")
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		out, err := get(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(out)
+	})
+}
+
+// postHandler runs the operation do on POST, and reports it for the audit
+// trail.
+func postHandler(action string, do func(r *http.Request) (string, error)) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			rw.Header().Set("Allow", "POST")
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		result, err := do(r)
+		admin.Record(r, action, result, err)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Write([]byte(result + "\n"))
+	})
+}
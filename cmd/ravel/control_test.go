@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/Comcast/Ravel/pkg/audit"
+)
+
+type fakeRIB map[string][]string
+
+func (f fakeRIB) RIB(ctx context.Context, family string) ([]string, error) {
+	return f[family], nil
+}
+
+func TestControlHandlers(t *testing.T) {
+	paused := false
+	pause := postHandler("pause", func(r *http.Request) (string, error) {
+		paused = true
+		return "paused", nil
+	})
+
+	rec := httptest.NewRecorder()
+	pause.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/pause", nil))
+	if rec.Code != http.StatusMethodNotAllowed || paused {
+		t.Fatalf("expected GET /pause to be refused. saw %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	pause.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/pause", nil))
+	if rec.Code != http.StatusOK || !paused {
+		t.Fatalf("expected POST /pause to pause. saw %d", rec.Code)
+	}
+	events := audit.Default().Events(audit.SubsystemAdmin, "", 1)
+	if len(events) == 0 || events[len(events)-1].Action != "pause" {
+		t.Fatalf("expected the pause to be audited. saw %+v", events)
+	}
+
+	rec = httptest.NewRecorder()
+	prefixesHandler(fakeRIB{"ipv4": {"10.0.0.1/32"}}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/prefixes", nil))
+	prefixes := map[string][]string{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &prefixes); err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string][]string{"ipv4": {"10.0.0.1/32"}, "ipv6": nil}; !reflect.DeepEqual(prefixes, expected) {
+		t.Fatalf("expected %v. saw %v", expected, prefixes)
+	}
+}
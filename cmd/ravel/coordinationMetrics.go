@@ -16,6 +16,20 @@ type coordinationMetrics struct {
 
 	// hazard is incremented when a master's state changes
 	hazard *prometheus.CounterVec
+
+	// decisions counts the failover decisions of each probe
+	decisions *prometheus.CounterVec
+
+	// what the realserver last heard from the director on its node
+	generation *prometheus.GaugeVec
+	skew       *prometheus.GaugeVec
+	mismatch   *prometheus.CounterVec
+	pushes     *prometheus.CounterVec
+	healthy    *prometheus.GaugeVec
+
+	// what the other end of the heartbeat last sent in the handshake
+	versionSkew *prometheus.GaugeVec
+	compat      *prometheus.GaugeVec
 }
 
 func (c *coordinationMetrics) Running(connected bool) {
@@ -29,11 +43,11 @@ func (c *coordinationMetrics) Running(connected bool) {
 }
 
 func (c *coordinationMetrics) Check(connected bool) {
-	c.connectCounter.With(prometheus.Labels{"lb": c.lb, "result": "total"}).Add(1)
+	c.connectCounter.With(prometheus.Labels{"lb": c.lb, "outcome": "total"}).Add(1)
 	if connected {
-		c.connectCounter.With(prometheus.Labels{"lb": c.lb, "result": "success"}).Add(1)
+		c.connectCounter.With(prometheus.Labels{"lb": c.lb, "outcome": "success"}).Add(1)
 	} else {
-		c.connectCounter.With(prometheus.Labels{"lb": c.lb, "result": "fail"}).Add(1)
+		c.connectCounter.With(prometheus.Labels{"lb": c.lb, "outcome": "fail"}).Add(1)
 	}
 }
 
@@ -41,35 +55,148 @@ func (c *coordinationMetrics) Hazard() {
 	c.hazard.With(prometheus.Labels{"lb": c.lb}).Add(1)
 }
 
+// Decision records the failover decision made on a probe of the director.
+func (c *coordinationMetrics) Decision(decision string) {
+	c.decisions.With(prometheus.Labels{"lb": c.lb, "decision": decision}).Add(1)
+}
+
+// Beat records a heartbeat of the director, and whether its config has been
+// skewed from the realserver's for longer than a publish takes.
+func (c *coordinationMetrics) Beat(generation uint64, skewed bool) {
+	c.generation.With(prometheus.Labels{"lb": c.lb}).Set(float64(generation))
+	val := 0.0
+	if skewed {
+		val = 1.0
+	}
+	c.skew.With(prometheus.Labels{"lb": c.lb}).Set(val)
+}
+
+// Mismatch records a heartbeat from a director of another node or config key.
+func (c *coordinationMetrics) Mismatch() {
+	c.mismatch.With(prometheus.Labels{"lb": c.lb}).Add(1)
+}
+
+// Healthy records whether the director's heartbeat reported a recent,
+// successful reconcile.
+func (c *coordinationMetrics) Healthy(healthy bool) {
+	val := 0.0
+	if healthy {
+		val = 1.0
+	}
+	c.healthy.With(prometheus.Labels{"lb": c.lb}).Set(val)
+}
+
+// Pushed records a config the director pushed once it applied it.
+func (c *coordinationMetrics) Pushed() {
+	c.pushes.With(prometheus.Labels{"lb": c.lb}).Add(1)
+}
+
+// Peer records whether the other end of the heartbeat is another version,
+// and whether it lacks features of this one.
+func (c *coordinationMetrics) Peer(skewed, compat bool) {
+	val := 0.0
+	if skewed {
+		val = 1.0
+	}
+	c.versionSkew.With(prometheus.Labels{"lb": c.lb}).Set(val)
+	val = 0.0
+	if compat {
+		val = 1.0
+	}
+	c.compat.With(prometheus.Labels{"lb": c.lb}).Set(val)
+}
+
+var (
+	workerRunningDef = stats.Define(stats.Definition{
+		Type:     stats.Gauge,
+		Name:     "worker_running",
+		Help:     "denotes whether the worker is in a running state or a stopped state",
+		Labels:   []string{"lb"},
+		Replaces: "rdei_lb_worker_running",
+	})
+	workerConnectDef = stats.Define(stats.Definition{
+		Type:     stats.Counter,
+		Name:     "worker_connect_total",
+		Help:     "denotes whether any connection attempt has taken place. outcome field indicates total|success|fail.",
+		Labels:   []string{"lb", "outcome"},
+		Replaces: "rdei_lb_worker_connect",
+	})
+	workerHazardDef = stats.Define(stats.Definition{
+		Type:     stats.Counter,
+		Name:     "worker_hazard_total",
+		Help:     "incremented when a connection attempt has occurred and the master status has changed from prior observations",
+		Labels:   []string{"lb"},
+		Replaces: "rdei_lb_worker_hazard",
+	})
+	failoverDecisionDef = stats.Define(stats.Definition{
+		Type:   stats.Counter,
+		Name:   "failover_decisions_total",
+		Help:   "is a count of the decisions the realserver made on probing the director of its node, by decision",
+		Labels: []string{"lb", "decision"},
+	})
+	directorGenerationDef = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "coordinator_director_generation",
+		Help:   "is the number of cluster configs the director on the node had published as of its last heartbeat",
+		Labels: []string{"lb"},
+	})
+	configSkewDef = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "coordinator_config_skew",
+		Help:   "is 1 while the director on the node has reported a different cluster config hash than the realserver's for longer than the skew grace period, and 0 otherwise",
+		Labels: []string{"lb"},
+	})
+	directorMismatchDef = stats.Define(stats.Definition{
+		Type:   stats.Counter,
+		Name:   "coordinator_director_mismatch_total",
+		Help:   "is a count of heartbeats answered by a director of another node or config key",
+		Labels: []string{"lb"},
+	})
+	directorHealthyDef = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "coordinator_director_healthy",
+		Help:   "is 1 while the director on the node last reported a successful reconcile within coordinator-stale-after, and 0 while it answers without one",
+		Labels: []string{"lb"},
+	})
+	directorPushDef = stats.Define(stats.Definition{
+		Type:   stats.Counter,
+		Name:   "coordinator_pushes_total",
+		Help:   "is a count of the applied configs the director on the node pushed to the realserver",
+		Labels: []string{"lb"},
+	})
+	versionSkewDef = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "coordinator_version_skew",
+		Help:   "is 1 while the other end of the coordinator heartbeat last reported another version than this one, and 0 otherwise",
+		Labels: []string{"lb"},
+	})
+	compatModeDef = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "coordinator_compat_mode",
+		Help:   "is 1 while the other end of the coordinator heartbeat lacks coordinator features of this one, which are then left unused, and 0 otherwise",
+		Labels: []string{"lb"},
+	})
+)
+
 func NewCoordinationMetrics(lb string) *coordinationMetrics {
-	// gauge config_info
-	running := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: stats.Prefix + "worker_running",
-		Help: "denotes whether the worker is in a running state or a stopped state",
-	}, []string{"lb"})
-
-	connectCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: stats.Prefix + "worker_connect",
-		Help: "denotes whether any connection attempt has taken place. result field indicates total|success|fail.",
-	}, []string{"lb", "result"})
-
-	hazard := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: stats.Prefix + "worker_hazard",
-		Help: "incremented when a connection attempt has occurred and the master status has changed from prior observations",
-	}, []string{"lb"})
-
-	prometheus.MustRegister(running)
-	prometheus.MustRegister(connectCounter)
-	prometheus.MustRegister(hazard)
+	hazard := workerHazardDef.CounterVec()
 
 	// init error counter to  0
 	hazard.With(prometheus.Labels{"lb": lb})
 
 	return &coordinationMetrics{
 		lb:             lb,
-		running:        running,
-		connectCounter: connectCounter,
+		running:        workerRunningDef.GaugeVec(),
+		connectCounter: workerConnectDef.CounterVec(),
 		hazard:         hazard,
+		decisions:      failoverDecisionDef.CounterVec(),
+		generation:     directorGenerationDef.GaugeVec(),
+		skew:           configSkewDef.GaugeVec(),
+		mismatch:       directorMismatchDef.CounterVec(),
+		pushes:         directorPushDef.CounterVec(),
+		healthy:        directorHealthyDef.GaugeVec(),
+		versionSkew:    versionSkewDef.GaugeVec(),
+		compat:         compatModeDef.GaugeVec(),
 	}
 
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/diagnose"
+)
+
+// adminViews are what the bundle takes from the admin endpoint. Those a mode
+// doesn't serve are noted as failed in the manifest.
+var adminViews = []string{"status", "config", "nodes", "audit", "changes", "loglevel", "ipvs", "parity", "prefixes", "bgp/overrides"}
+
+// diagnoseItems returns what a support bundle collects on this node.
+func diagnoseItems(config *config.Config, v *viper.Viper, since time.Duration, logFiles []string) []diagnose.Item {
+	items := []diagnose.Item{
+		{Name: "version.json", Collect: func(ctx context.Context) ([]byte, error) {
+			v := versionInfo{Version: version, GoVersion: goVersion, Commit: commit, BuildDate: buildDate, Arch: arch, Environment: environment(ctx, config)}
+			return json.MarshalIndent(v, "", "  ")
+		}},
+		{Name: "settings.txt", Collect: func(context.Context) ([]byte, error) {
+			file, _ := fileKeys(config.ConfigFile)
+			b := &bytes.Buffer{}
+			err := writeSettings(b, resolveSettings(v, rootCmd.PersistentFlags(), file), "text")
+			return b.Bytes(), err
+		}},
+	}
+
+	// the running process
+	for _, view := range adminViews {
+		path := "/" + view
+		items = append(items, diagnose.Item{Name: "admin/" + view + ".json", Collect: func(context.Context) ([]byte, error) {
+			b := &bytes.Buffer{}
+			err := adminRequest(config, http.MethodGet, path, nil, b)
+			return b.Bytes(), err
+		}})
+	}
+	items = append(items, diagnose.Item{Name: "metrics.txt", Collect: func(ctx context.Context) ([]byte, error) {
+		return localGet(ctx, net.JoinHostPort(localHost(config.Stats.ListenAddr), config.Stats.ListenPort), "/metrics")
+	}})
+	if config.PprofPort != 0 {
+		items = append(items, diagnose.Item{Name: "goroutines.txt", Collect: func(ctx context.Context) ([]byte, error) {
+			return localGet(ctx, fmt.Sprintf("127.0.0.1:%d", config.PprofPort), "/debug/pprof/goroutine?debug=2")
+		}})
+	}
+
+	// the node
+	items = append(items,
+		diagnose.Command("node/ipvsadm.txt", "ipvsadm", "-Ln", "--stats"),
+		diagnose.Command("node/ipvsadm-save.txt", "ipvsadm", "-Sn"),
+		diagnose.Command("node/ip-addr.txt", "ip", "addr"),
+		diagnose.Command("node/ip-link.txt", "ip", "-details", "link", "show"),
+		diagnose.Command("node/ip-route.txt", "ip", "route", "show", "table", "all"),
+		diagnose.Command("node/ip6-route.txt", "ip", "-6", "route", "show", "table", "all"),
+		diagnose.Command("node/iptables-save.txt", "iptables-save"),
+		diagnose.Command("node/ip6tables-save.txt", "ip6tables-save"),
+	)
+	// gobgp is only on the nodes of bgp directors
+	if _, err := exec.LookPath(config.BGP.Binary); err == nil {
+		items = append(items,
+			diagnose.Command("bgp/rib-ipv4.txt", config.BGP.Binary, "global", "rib", "-a", "ipv4"),
+			diagnose.Command("bgp/rib-ipv6.txt", config.BGP.Binary, "global", "rib", "-a", "ipv6"),
+			diagnose.Command("bgp/neighbors.txt", config.BGP.Binary, "neighbor"),
+		)
+	}
+
+	// logs go to stdout, so they are only here if they are also sent to the
+	// journal, or written to a file by whatever runs ravel
+	if _, err := exec.LookPath("journalctl"); err == nil {
+		items = append(items, diagnose.Command("logs/journal.txt", "journalctl", "--no-pager", "-t", "ravel", "--since", fmt.Sprintf("-%ds", int(since.Seconds()))))
+	}
+	for _, pattern := range logFiles {
+		pattern := pattern
+		paths, err := filepath.Glob(pattern)
+		if err != nil || len(paths) == 0 {
+			items = append(items, diagnose.Item{Name: "logs/" + filepath.Base(pattern), Collect: func(context.Context) ([]byte, error) {
+				return nil, fmt.Errorf("no log file matches %s", pattern)
+			}})
+			continue
+		}
+		for _, path := range paths {
+			path := path
+			items = append(items, diagnose.Item{Name: "logs/" + filepath.Base(path), Collect: func(context.Context) ([]byte, error) {
+				return ioutil.ReadFile(path)
+			}})
+		}
+	}
+	return items
+}
+
+// localHost is the host to reach a listener on host from this node.
+func localHost(host string) string {
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		return "127.0.0.1"
+	}
+	return host
+}
+
+// localGet returns the body of a GET of path on the listener at addr.
+func localGet(ctx context.Context, addr, path string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return b, err
+}
+
+// diagnoseSecrets are the contents of the secret files config names, which
+// are redacted wherever they appear in the bundle.
+func diagnoseSecrets(config *config.Config) []string {
+	secrets := []string{}
+	for _, path := range []string{config.Admin.TokenFile, config.Stats.RemoteWrite.PasswordFile, config.Stats.RemoteWrite.BearerTokenFile} {
+		if path == "" {
+			continue
+		}
+		if b, err := ioutil.ReadFile(path); err == nil {
+			secrets = append(secrets, string(b))
+		}
+	}
+	return secrets
+}
+
+// Diagnose collects a support bundle for an incident ticket.
+func Diagnose(ctx context.Context) *cobra.Command {
+	var (
+		file     string
+		since    time.Duration
+		logFiles []string
+		output   string
+	)
+
+	var cmd = &cobra.Command{
+		Use:           "diagnose",
+		Short:         "collect a support bundle of the ravel on this node and the node itself",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		Long: `
+diagnose collects what is needed to look into an incident into a single
+gzipped tarball to attach to a ticket: the version and settings of ravel; the
+status, cluster config, nodes, audit trail, config changes, ipvs rules, parity,
+bgp prefixes and bgp overrides of the running process from its admin endpoint;
+its metrics and goroutines; the ipvs rules, addresses, routes and iptables
+rules of the node; the bgp RIB and neighbors where gobgp is installed; and the logs of the
+last --since from the journal and from each --log-file.
+
+Anything that can't be collected is noted in the manifest.json of the bundle,
+and the rest is still collected. Passwords, tokens, credentials, private keys
+and the contents of the admin token and remote write secret files are
+redacted.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if err := checkOutput(output); err != nil {
+				return err
+			}
+			config := NewConfig(cmd.Flags())
+			name := fmt.Sprintf("ravel-diagnose-%s-%s", config.NodeName, time.Now().UTC().Format("20060102T150405Z"))
+			if file == "" {
+				file = name + ".tar.gz"
+			}
+
+			f, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			items := diagnoseItems(config, viper.GetViper(), since, logFiles)
+			manifest, err := diagnose.Write(ctx, f, name, items, diagnose.NewRedactor(diagnoseSecrets(config)...))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return fmt.Errorf("unable to write %s. %v", file, err)
+			}
+
+			// the manifest, with where the bundle was written
+			bundle := struct {
+				File string `json:"file"`
+				diagnose.Manifest
+			}{file, manifest}
+			return writeOutput(os.Stdout, output, bundle, func(w io.Writer) error {
+				failed := manifest.Failed()
+				fmt.Fprintf(w, "wrote %s: %d items, %d not collected\n", file, len(manifest.Items), len(failed))
+				for _, e := range failed {
+					fmt.Fprintf(w, "  %s: %s\n", e.Name, strings.TrimSpace(e.Error))
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&file, "file", "f", "", "where to write the bundle. defaults to ravel-diagnose-<node>-<time>.tar.gz in the working directory")
+	cmd.Flags().DurationVar(&since, "since", time.Hour, "how far back to collect logs from the journal")
+	cmd.Flags().StringSliceVar(&logFiles, "log-file", nil, "a log file, or glob of them, to include, such as the container logs of ravel. can be passed multiple times")
+	outputFlag(cmd.Flags(), &output)
+
+	return cmd
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/doctor"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// doctorChecks returns the environment checks for a mode. The checks mirror
+// what each mode touches on the node once it starts. The binaries and
+// sysctls of a mode that changes the node through a privileged helper are
+// the helper's, so only the helper is checked for them.
+func doctorChecks(config *config.Config, mode string) []doctor.Check {
+	local := config.PrivilegedHelper == ""
+	checks := []doctor.Check{
+		doctor.KernelModule("ip_vs", true),
+		// the schedulers of services that don't set one, and of the rr
+		// option
+		doctor.KernelModule("ip_vs_wrr", true),
+		doctor.KernelModule("ip_vs_rr", true),
+	}
+	if local {
+		checks = append(checks,
+			doctor.Binary("ip", true),
+			doctor.Binary("ipvsadm", true),
+			doctor.Binary("iptables", true),
+			doctor.Binary("iptables-save", true),
+			doctor.Binary("iptables-restore", true),
+		)
+	} else {
+		checks = append(checks, doctor.PrivilegedHelper(config.PrivilegedHelper))
+	}
+	checks = append(checks,
+		doctor.IPTablesBackend(),
+		doctor.KubeAPI(config.KubeConfigFile, config.ConfigMapNamespace, config.ConfigMapName),
+	)
+
+	// every mode sets arp_announce and arp_ignore on both interfaces
+	ifaces := []string{config.Net.Interface}
+	if config.Net.LocalInterface != config.Net.Interface {
+		ifaces = append(ifaces, config.Net.LocalInterface)
+	}
+	for _, iface := range ifaces {
+		checks = append(checks, doctor.Interface(iface, true))
+		if local {
+			checks = append(checks,
+				doctor.Sysctl(fmt.Sprintf("/netconf/%s/arp_announce", iface), true),
+				doctor.Sysctl(fmt.Sprintf("/netconf/%s/arp_ignore", iface), true),
+			)
+		}
+	}
+
+	// the director modes write the ipvs sysctls at startup
+	if local && (mode == stats.KindBGPDirector || mode == stats.KindIpvsMaster || mode == stats.KindColocated) {
+		names := make([]string, 0, len(config.IPVS.SysctlSettings))
+		for name := range config.IPVS.SysctlSettings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			checks = append(checks, doctor.Sysctl("/proc/sys/net/ipv4/vs/"+name, true))
+		}
+	}
+
+	switch mode {
+	case stats.KindBGPDirector:
+		// the worker tolerates gobgpd starting after it, so this only warns
+		checks = append(checks,
+			doctor.Binary(config.BGP.Binary, true),
+			doctor.GoBGP(config.BGP.Binary, false),
+		)
+	case stats.KindIpvsBackend, stats.KindColocated:
+		checks = append(checks, doctor.KernelModule("dummy", true))
+		if local {
+			checks = append(checks,
+				doctor.Sysctl("/netconf/all/rp_filter", true),
+				doctor.Sysctl("/netconf/tunl0/rp_filter", false),
+				// haproxy is only needed for v6 services
+				doctor.Binary("/usr/sbin/haproxy", false),
+			)
+		}
+	}
+	return checks
+}
+
+var selfTestDef = stats.Define(stats.Definition{
+	Type:   stats.Gauge,
+	Name:   "self_test_passed",
+	Help:   "is 1 if a self-test check passed at startup, and 0 if it failed",
+	Labels: []string{"lb", "check"},
+})
+
+// selfTest runs the checks for a mode before it takes traffic, logging each
+// result, with what to do about a failure, and exporting it as a gauge. It
+// fails when a required check fails, unless self-test is disabled.
+func selfTest(ctx context.Context, config *config.Config, mode string, logger logging.Logger) error {
+	if !config.SelfTest {
+		return nil
+	}
+	report := doctor.Run(ctx, doctorChecks(config, mode))
+	gauge := selfTestDef.GaugeVec()
+	for _, r := range report.Results {
+		l := logger.WithFields(logging.Fields{"check": r.Name, "required": r.Required})
+		if r.Fix != "" {
+			l = l.WithField("fix", r.Fix)
+		}
+		switch {
+		case r.Passed:
+			l.Infof("self-test: pass: %s", r.Message)
+		case r.Required:
+			l.Errorf("self-test: fail: %s", r.Message)
+		default:
+			l.Warnf("self-test: warn: %s", r.Message)
+		}
+		val := 0.0
+		if r.Passed {
+			val = 1.0
+		}
+		gauge.WithLabelValues(mode, r.Name).Set(val)
+	}
+	return withExitCode(exitUnhealthy, report.Err())
+}
+
+// Doctor runs the self-test checks for a mode, prints the report, and exits.
+func Doctor(ctx context.Context, logger logging.Logger) *cobra.Command {
+	var output string
+
+	var cmd = &cobra.Command{
+		Use:           "doctor [bgp|director|realserver|colocated]",
+		Short:         "check the node environment for a mode and exit",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.ExactArgs(1),
+		Long: `
+doctor runs the same checks that each mode runs at startup: kernel modules,
+sysctls, the iptables and ipvsadm binaries, gobgpd, and access to the
+kubernetes API. It prints a pass/fail line per check and exits non-zero if
+a required check failed.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			switch args[0] {
+			case stats.KindBGPDirector, stats.KindIpvsMaster, stats.KindIpvsBackend, stats.KindColocated:
+			default:
+				return withExitCode(exitUsage, fmt.Errorf("mode must be one of bgp|director|realserver|colocated"))
+			}
+			if err := checkOutput(output); err != nil {
+				return err
+			}
+			config := NewConfig(cmd.Flags())
+			report := doctor.Run(ctx, doctorChecks(config, args[0]))
+
+			if err := writeOutput(os.Stdout, output, report, report.WriteText); err != nil {
+				return err
+			}
+			return withExitCode(exitUnhealthy, report.Err())
+		},
+	}
+	outputFlag(cmd.Flags(), &output)
+
+	return cmd
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Exit codes of the ravel commands, so that automation wrapping them can tell
+// a config to fix from a failure to retry without reading the error.
+const (
+	exitOK = 0
+	// exitFailure is any failure not classified below
+	exitFailure = 1
+	// exitUsage is an unknown command, flag or argument
+	exitUsage = 2
+	// exitInvalid is a configmap, cluster config or setting that doesn't
+	// validate, which retrying won't fix
+	exitInvalid = 3
+	// exitTransient is a timeout, an endpoint or apiserver that can't be
+	// reached or is unavailable, or a conflict, which retrying may fix
+	exitTransient = 4
+	// exitDenied is a request the apiserver or admin endpoint refused to
+	// authorize, or an operation the user may not run on the node
+	exitDenied = 5
+	// exitUnhealthy is a command that ran and found a problem, such as a
+	// process that isn't ready or a required self-test that failed
+	exitUnhealthy = 6
+)
+
+// exitError is an error that exits with code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// withExitCode has err exit with code. A nil err stays nil.
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+// exitCodeOf returns the code to exit with after err. Errors not given one
+// with withExitCode are classified by what they are.
+func exitCodeOf(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	switch {
+	case apierrors.IsForbidden(err), apierrors.IsUnauthorized(err), errors.Is(err, os.ErrPermission):
+		return exitDenied
+	case apierrors.IsTimeout(err), apierrors.IsServerTimeout(err), apierrors.IsServiceUnavailable(err),
+		apierrors.IsTooManyRequests(err), apierrors.IsConflict(err), errors.Is(err, context.DeadlineExceeded):
+		return exitTransient
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return exitTransient
+	}
+	// cobra doesn't type the errors of commands it can't find
+	if strings.HasPrefix(err.Error(), "unknown command") {
+		return exitUsage
+	}
+	return exitFailure
+}
+
+// usageErrors has the errors of the flags and arguments of cmd and its
+// subcommands exit with exitUsage.
+func usageErrors(cmd *cobra.Command) {
+	cmd.SetFlagErrorFunc(func(_ *cobra.Command, err error) error {
+		return withExitCode(exitUsage, err)
+	})
+	if args := cmd.Args; args != nil {
+		cmd.Args = func(c *cobra.Command, a []string) error {
+			return withExitCode(exitUsage, args(c, a))
+		}
+	}
+	for _, c := range cmd.Commands() {
+		usageErrors(c)
+	}
+}
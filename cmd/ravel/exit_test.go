@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/cobra"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestExitCodes(t *testing.T) {
+	nodes := schema.GroupResource{Resource: "nodes"}
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{nil, exitOK},
+		{errors.New("something broke"), exitFailure},
+		{withExitCode(exitInvalid, errors.New("bad config")), exitInvalid},
+		{fmt.Errorf("set: %w", withExitCode(exitUnhealthy, errors.New("not ready"))), exitUnhealthy},
+		{apierrors.NewForbidden(nodes, "lb01", errors.New("rbac")), exitDenied},
+		{fmt.Errorf("unable to read admin token file: %w", &os.PathError{Op: "open", Path: "token", Err: os.ErrPermission}), exitDenied},
+		{apierrors.NewServiceUnavailable("try later"), exitTransient},
+		{apierrors.NewConflict(nodes, "lb01", errors.New("modified")), exitTransient},
+		{context.DeadlineExceeded, exitTransient},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, exitTransient},
+		{errors.New(`unknown command "nope" for "kube2ipvs"`), exitUsage},
+	} {
+		if code := exitCodeOf(c.err); code != c.code {
+			t.Errorf("expected %v to exit with %d, got %d", c.err, c.code, code)
+		}
+	}
+
+	for status, code := range map[int]int{401: exitDenied, 403: exitDenied, 503: exitTransient, 400: exitUsage, 500: exitFailure} {
+		if got := adminExitCode(status); got != code {
+			t.Errorf("expected status %d to exit with %d, got %d", status, code, got)
+		}
+	}
+
+	root := &cobra.Command{Use: "ravel", SilenceUsage: true, SilenceErrors: true}
+	root.AddCommand(&cobra.Command{Use: "status", Args: cobra.NoArgs, RunE: func(*cobra.Command, []string) error { return nil }})
+	usageErrors(root)
+	for _, args := range [][]string{{"status", "extra"}, {"status", "--nope"}, {"nope"}} {
+		root.SetArgs(args)
+		if code := exitCodeOf(root.Execute()); code != exitUsage {
+			t.Errorf("expected %v to exit with %d, got %d", args, exitUsage, code)
+		}
+	}
+}
+
+func TestOutput(t *testing.T) {
+	v := nodeMaintenance{Node: "lb01", Maintenance: true, Reason: "kernel upgrade"}
+
+	b := &bytes.Buffer{}
+	if err := writeOutput(b, "yaml", v, nil); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "maintenance: true\nnode: lb01\nreason: kernel upgrade\n" {
+		t.Fatalf("expected yaml named as the json is, got\n%s", b.String())
+	}
+	b.Reset()
+	if err := writeOutput(b, "json", v, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), `"reason": "kernel upgrade"`) {
+		t.Fatalf("expected indented json, got\n%s", b.String())
+	}
+	if err := writeOutput(b, "xml", v, nil); exitCodeOf(err) != exitUsage {
+		t.Fatalf("expected an unknown output to be a usage error, got %v", err)
+	}
+}
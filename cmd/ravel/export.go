@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Comcast/Ravel/pkg/admin"
+	"github.com/Comcast/Ravel/pkg/export"
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// exportSources are the parts of a node's state a mode programs, which
+// /export rebuilds its config from. Those a mode doesn't program are nil.
+type exportSources struct {
+	// ipvs and ipvs6 read the v4 and v6 ipvs services
+	ipvs  *system.IPVS
+	ipvs6 bool
+	ipt   *iptables.IPTables
+	ip    *system.IP
+	rib   ribReader
+}
+
+// exportHandler serves the config rebuilt from what the node has programmed,
+// with how it drifts from the config in effect.
+func exportHandler(srv *admin.Server, w *watcher.Watcher, sources exportSources) {
+	srv.Handle("/export", getHandler(func(r *http.Request) (interface{}, error) {
+		state := export.State{}
+		if sources.ipvs != nil {
+			rules, err := sources.ipvs.Get()
+			if err != nil {
+				return nil, err
+			}
+			state.IPVS4 = sources.ipvs.Owned(rules)
+			if sources.ipvs6 {
+				if rules, err = sources.ipvs.GetV6(); err != nil {
+					return nil, err
+				}
+				state.IPVS6 = sources.ipvs.Owned(rules)
+			}
+		}
+		if sources.ipt != nil {
+			saved, err := sources.ipt.Save()
+			if err != nil {
+				return nil, err
+			}
+			state.Chain = []string{}
+			if chain, ok := saved[sources.ipt.BaseChain()]; ok {
+				state.Chain = chain.Rules
+			}
+		}
+		if sources.ip != nil {
+			devices, _, err := sources.ip.Get()
+			if err != nil {
+				return nil, err
+			}
+			state.Addresses = []string{}
+			for _, device := range devices {
+				if addr := system.DeviceAddress(device); addr != "" {
+					state.Addresses = append(state.Addresses, addr)
+				}
+			}
+		}
+		if sources.rib != nil {
+			state.Prefixes = []string{}
+			for _, family := range []string{"ipv4", "ipv6"} {
+				prefixes, err := sources.rib.RIB(r.Context(), family)
+				if err != nil {
+					return nil, err
+				}
+				state.Prefixes = append(state.Prefixes, prefixes...)
+			}
+		}
+		e := export.Build(state)
+		e.Compare(w.ClusterConfig)
+		return e, nil
+	}))
+}
+
+// Export rebuilds the cluster config of the process on this node from what
+// it has programmed.
+func Export() *cobra.Command {
+	var output string
+	var configMap bool
+
+	// get reads the export of the process on this node
+	get := func(cmd *cobra.Command) (*export.Export, error) {
+		if err := checkOutput(output); err != nil {
+			return nil, err
+		}
+		b := &bytes.Buffer{}
+		if err := adminRequest(NewConfig(cmd.Flags()), http.MethodGet, "/export", nil, b); err != nil {
+			return nil, err
+		}
+		e := &export.Export{}
+		if err := json.Unmarshal(b.Bytes(), e); err != nil {
+			return nil, fmt.Errorf("invalid response from /export. %v", err)
+		}
+		return e, nil
+	}
+
+	var cmd = &cobra.Command{
+		Use:          "export",
+		Short:        "rebuild the cluster config from what the process on this node has programmed",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		Long: `
+export talks to the admin endpoint of the process on this node, using
+--admin-listen and --admin-token-file, to rebuild its cluster config from
+what the node has programmed: the ipvs services, the rules of the iptables
+chain, the VIP devices and the prefixes announced over bgp, as the mode has
+them. It prints the config as the configmap holds it, or with --configmap
+the configmap itself, named by --config-namespace, --config-name and
+--config-key, to recover a configmap that was lost.
+
+Only what the node holds is rebuilt. What couldn't be, such as a service
+whose kubernetes service is unknown, is noted on stderr.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			e, err := get(cmd)
+			if err != nil {
+				return err
+			}
+			for _, note := range e.Notes {
+				fmt.Fprintln(os.Stderr, "note:", note)
+			}
+			var doc interface{} = e.Config
+			if configMap {
+				config := NewConfig(cmd.Flags())
+				b, err := json.Marshal(e.Config)
+				if err != nil {
+					return err
+				}
+				doc = &v1.ConfigMap{
+					TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+					ObjectMeta: metav1.ObjectMeta{Namespace: config.ConfigMapNamespace, Name: config.ConfigMapName},
+					Data:       map[string]string{config.ConfigKey: string(b)},
+				}
+			}
+			// the config is a document for people too
+			if output == "text" {
+				output = "json"
+			}
+			return writeOutput(os.Stdout, output, doc, nil)
+		},
+	}
+	outputFlag(cmd.PersistentFlags(), &output)
+	cmd.Flags().BoolVar(&configMap, "configmap", false, "print the configmap holding the config")
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "drift",
+		Short: "show how what the process on this node has programmed differs from its config",
+		Args:  cobra.NoArgs,
+		Long: `
+drift compares the config rebuilt from the node with the config in effect,
+in what the mode programs: the VIPs the node holds, the services of each
+family and their protocols, kubernetes services, schedulers, flags and
+forwarding. It exits with 6 when they differ. A director that isn't master,
+or a bgp director that doesn't announce every VIP, holds fewer VIPs than its
+config has.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			e, err := get(cmd)
+			if err != nil {
+				return err
+			}
+			if err := writeOutput(os.Stdout, output, e.Drift, func(w io.Writer) error {
+				if len(e.Drift) == 0 {
+					_, err := fmt.Fprintln(w, "the node has programmed what the config says")
+					return err
+				}
+				for _, d := range e.Drift {
+					fmt.Fprintln(w, d)
+				}
+				_, err := fmt.Fprintf(w, "%d differences\n", len(e.Drift))
+				return err
+			}); err != nil {
+				return err
+			}
+			if len(e.Drift) > 0 {
+				return withExitCode(exitUnhealthy, fmt.Errorf("the node has drifted from its config in %d ways", len(e.Drift)))
+			}
+			return nil
+		},
+	})
+	return cmd
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/config"
+)
+
+// The realserver probes the director on its node every interval, and takes
+// over once enough probes in a row have failed. Until it has heard from the
+// director once, a single failed probe is enough, so that a realserver
+// without a director starts straight away. It hands the node back once enough
+// probes in a row have succeeded.
+//
+// A director that keeps coming and going would have the realserver set the
+// node up and tear it down each time, so after a takeover that ended within
+// the backoff limit, the next one is held off once its threshold is reached,
+// for twice as long as the last hold off, up to the limit. The hold off
+// resets once the realserver stays in charge for the limit. Each wait is
+// jittered, so that the realservers of a cluster don't all act at the same
+// instant when the directors restart together.
+
+// failover decisions, as counted by decision.
+const (
+	// decisionHold keeps the worker as it is
+	decisionHold = "hold"
+	// decisionWait counts a probe towards a threshold
+	decisionWait = "wait"
+	// decisionTakeover starts the worker, as the director is gone
+	decisionTakeover = "takeover"
+	// decisionGiveback stops the worker, as the director is back
+	decisionGiveback = "giveback"
+	// decisionBackoff holds off a takeover after the director flapped
+	decisionBackoff = "backoff"
+	// decisionMaintenance keeps the worker stopped, as the node is in
+	// maintenance
+	decisionMaintenance = "maintenance"
+)
+
+// failoverPolicy decides when the realserver takes over from the director on
+// its node, and when it hands the node back.
+type failoverPolicy struct {
+	config config.FailoverConfig
+
+	running   bool
+	seen      bool
+	failures  int
+	successes int
+	// backoff is the hold off after the last flap, which the next takeover
+	// waits out while flapped is set, until holdUntil
+	backoff   time.Duration
+	flapped   bool
+	holdUntil time.Time
+	tookOver  time.Time
+}
+
+func newFailoverPolicy(config config.FailoverConfig) *failoverPolicy {
+	return &failoverPolicy{config: config}
+}
+
+// decide returns the decision for a probe of the director at now, which up
+// reports the outcome of.
+func (p *failoverPolicy) decide(up bool, now time.Time) string {
+	if up {
+		p.seen, p.failures, p.holdUntil = true, 0, time.Time{}
+		if !p.running {
+			return decisionHold
+		}
+		p.successes++
+		if p.successes < p.config.RecoveryThreshold {
+			return decisionWait
+		}
+		p.running, p.successes = false, 0
+		if p.config.BackoffMax > 0 && now.Sub(p.tookOver) < p.config.BackoffMax {
+			p.backoff *= 2
+			if p.backoff < p.config.Interval {
+				p.backoff = p.config.Interval
+			}
+			if p.backoff > p.config.BackoffMax {
+				p.backoff = p.config.BackoffMax
+			}
+			p.flapped = true
+		} else {
+			p.backoff = 0
+		}
+		return decisionGiveback
+	}
+
+	p.successes = 0
+	if p.running {
+		return decisionHold
+	}
+	p.failures++
+	threshold := p.config.FailureThreshold
+	if !p.seen {
+		threshold = 1
+	}
+	if p.failures < threshold {
+		return decisionWait
+	}
+	if p.flapped {
+		if p.holdUntil.IsZero() {
+			p.holdUntil = now.Add(p.jitter(p.backoff))
+		}
+		if now.Before(p.holdUntil) {
+			return decisionBackoff
+		}
+	}
+	p.running, p.failures, p.tookOver = true, 0, now
+	p.flapped, p.holdUntil = false, time.Time{}
+	return decisionTakeover
+}
+
+// maintain returns the decision for a probe while the node is in
+// maintenance: a running worker hands the node back at once, and a stopped
+// one doesn't take it. The thresholds start over once maintenance ends.
+func (p *failoverPolicy) maintain() string {
+	p.failures, p.successes, p.holdUntil = 0, 0, time.Time{}
+	if !p.running {
+		return decisionMaintenance
+	}
+	p.running = false
+	return decisionGiveback
+}
+
+// wait returns how long until the next probe.
+func (p *failoverPolicy) wait() time.Duration {
+	return p.jitter(p.config.Interval)
+}
+
+// jitter spreads d by up to the jitter fraction either way.
+func (p *failoverPolicy) jitter(d time.Duration) time.Duration {
+	if p.config.Jitter <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*p.config.Jitter*float64(d))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/config"
+)
+
+func TestFailoverPolicy(t *testing.T) {
+	p := newFailoverPolicy(config.FailoverConfig{Interval: time.Second, FailureThreshold: 3, RecoveryThreshold: 2, BackoffMax: time.Minute})
+	now := time.Now()
+	step := func(up bool, expected string) {
+		t.Helper()
+		now = now.Add(time.Second)
+		if decision := p.decide(up, now); decision != expected {
+			t.Fatalf("expected %s, got %s", expected, decision)
+		}
+	}
+
+	// a realserver that has never heard from the director takes over at once
+	step(false, decisionTakeover)
+	step(false, decisionHold)
+	// and hands the node back once the director is up for long enough
+	step(true, decisionWait)
+	step(true, decisionGiveback)
+	step(true, decisionHold)
+
+	// once the director has been seen, it takes three failures in a row
+	step(false, decisionWait)
+	step(true, decisionHold)
+	step(false, decisionWait)
+	step(false, decisionWait)
+	// the director flapped within the backoff limit, so the takeover is
+	// held off for the probe interval first
+	step(false, decisionBackoff)
+	step(false, decisionTakeover)
+
+	// a second flap doubles the hold off
+	step(true, decisionWait)
+	step(true, decisionGiveback)
+	if p.backoff != 2*time.Second {
+		t.Fatalf("expected the hold off to double, got %v", p.backoff)
+	}
+
+	// a takeover that outlasts the limit resets it
+	step(false, decisionWait)
+	step(false, decisionWait)
+	step(false, decisionBackoff)
+	step(false, decisionBackoff)
+	step(false, decisionTakeover)
+	now = now.Add(time.Hour)
+	step(true, decisionWait)
+	step(true, decisionGiveback)
+	if p.backoff != 0 {
+		t.Fatalf("expected the hold off to reset, got %v", p.backoff)
+	}
+}
+
+func TestFailoverMaintenance(t *testing.T) {
+	p := newFailoverPolicy(config.FailoverConfig{Interval: time.Second, FailureThreshold: 2, RecoveryThreshold: 2})
+	now := time.Now()
+	for _, expected := range []string{decisionHold, decisionWait, decisionTakeover} {
+		if decision := p.decide(expected == decisionHold, now); decision != expected {
+			t.Fatalf("expected %s, got %s", expected, decision)
+		}
+	}
+
+	// maintenance hands the node back without waiting on the director, and
+	// keeps it handed back
+	if decision := p.maintain(); decision != decisionGiveback {
+		t.Fatalf("expected a giveback, got %s", decision)
+	}
+	if decision := p.maintain(); decision != decisionMaintenance {
+		t.Fatalf("expected the worker to stay stopped, got %s", decision)
+	}
+
+	// afterwards, the director is given the usual number of probes
+	if decision := p.decide(false, now); decision != decisionWait {
+		t.Fatalf("expected a wait, got %s", decision)
+	}
+	if decision := p.decide(false, now); decision != decisionTakeover {
+		t.Fatalf("expected a takeover, got %s", decision)
+	}
+}
+
+func TestFailoverJitter(t *testing.T) {
+	p := newFailoverPolicy(config.FailoverConfig{Interval: time.Second, Jitter: 0.2})
+	for i := 0; i < 100; i++ {
+		if d := p.wait(); d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("expected a wait within 20%% of a second, got %v", d)
+		}
+	}
+}
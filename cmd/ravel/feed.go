@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/heartbeat"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// feedInterval is how often a director checks for a new snapshot to feed,
+// and a realserver retries a feed it lost.
+const feedInterval = time.Second
+
+var (
+	feedFollowersDef = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "config_feed_followers",
+		Help:   "is the number of realservers following the config feed of the director",
+		Labels: []string{"lb", "seczone"},
+	})
+	feedConnectedDef = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "config_feed_connected",
+		Help:   "is 1 while the realserver takes its cluster config and nodes from the config feed of a director, and 0 while it watches them itself",
+		Labels: []string{"lb", "seczone"},
+	})
+)
+
+// startConfigFeed serves the cluster config and nodes of w to realservers on
+// --config-feed-listen, if set, until ctx is done. A snapshot is sent when
+// either changes.
+func startConfigFeed(ctx context.Context, config *config.Config, kind stats.LBKind, w *watcher.Watcher, logger logging.Logger) error {
+	if config.Coordinator.FeedListen == "" {
+		return nil
+	}
+	tlsConfig, err := config.Coordinator.ServerTLS()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", config.Coordinator.FeedListen)
+	if err != nil {
+		return err
+	}
+	logger.Infof("feeding the cluster config and nodes to realservers on %s", config.Coordinator.FeedListen)
+	feed := heartbeat.NewFeed(logger)
+	go func() {
+		if err := feed.Serve(ctx, ln, tlsConfig); err != nil && ctx.Err() == nil {
+			logger.Errorf("stopped serving the config feed on %s. %v", config.Coordinator.FeedListen, err)
+		}
+	}()
+
+	followers := feedFollowersDef.GaugeVec().WithLabelValues(string(kind), config.ConfigKey)
+	go func() {
+		t := time.NewTicker(feedInterval)
+		defer t.Stop()
+		var last heartbeat.Snapshot
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			followers.Set(float64(len(feed.Followers())))
+			s, err := w.Snapshot()
+			if err != nil {
+				continue
+			}
+			if s.ConfigHash == last.ConfigHash && bytes.Equal(s.Nodes, last.Nodes) {
+				continue
+			}
+			feed.Publish(s)
+			last = s
+		}
+	}()
+	return nil
+}
+
+// feedFollower keeps a fed watcher on the config feed of the directors, and
+// has it watch for itself while the feed is lost for longer than fallback.
+type feedFollower struct {
+	sync.Mutex
+	addrs     []string
+	tlsConfig *tls.Config
+	hello     heartbeat.Hello
+	fallback  time.Duration
+	w         *watcher.Watcher
+	connected prometheus.Gauge
+	logger    logging.Logger
+
+	addr       string
+	generation uint64
+	lastSeen   time.Time
+	fed        bool
+	err        error
+}
+
+// followConfigFeed has w follow the config feed of the --config-feed
+// directors, and reports it through checks.
+func followConfigFeed(ctx context.Context, config *config.Config, kind stats.LBKind, w *watcher.Watcher, checks *health.Registry, logger logging.Logger) error {
+	tlsConfig, err := config.Coordinator.ClientTLS()
+	if err != nil {
+		return err
+	}
+	f := &feedFollower{
+		addrs:     config.Coordinator.Feed,
+		tlsConfig: tlsConfig,
+		hello:     heartbeat.Hello{Identity: config.NodeName, ConfigKey: config.ConfigKey, Version: version, Capabilities: heartbeat.Capabilities},
+		fallback:  config.Coordinator.FeedFallback,
+		w:         w,
+		connected: feedConnectedDef.GaugeVec().WithLabelValues(string(kind), config.ConfigKey),
+		logger:    logger.WithFields(logging.Fields{"module": "feed"}),
+		lastSeen:  time.Now(),
+		fed:       true,
+	}
+	checks.Register("config-feed", f.Health)
+	go f.run(ctx)
+	return nil
+}
+
+// run follows each director in turn until ctx is done.
+func (f *feedFollower) run(ctx context.Context) {
+	for i := 0; ctx.Err() == nil; i++ {
+		addr := f.addrs[i%len(f.addrs)]
+		followed := false
+		client, err := heartbeat.DialFeed(addr, f.tlsConfig, f.hello)
+		if err == nil {
+			err = client.Follow(ctx, func(s heartbeat.Snapshot) {
+				followed = true
+				f.snapshot(addr, s)
+			})
+			client.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		f.lost(addr, followed, err)
+		select {
+		case <-time.After(feedInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// snapshot applies a snapshot from the director at addr, returning the
+// watcher to the feed if it was watching for itself.
+func (f *feedFollower) snapshot(addr string, s heartbeat.Snapshot) {
+	f.Lock()
+	if !f.fed || f.addr != addr {
+		f.logger.Infof("following the config feed of %s", addr)
+	}
+	f.addr, f.generation, f.lastSeen, f.fed, f.err = addr, s.Generation, time.Now(), true, nil
+	f.Unlock()
+
+	f.connected.Set(1)
+	f.w.Fed(true)
+	if err := f.w.ApplySnapshot(s); err != nil {
+		f.logger.Errorf("unable to apply generation %d of the config feed of %s. %v", s.Generation, addr, err)
+	}
+}
+
+// lost records that the feed of addr ended, having followed it or not, and
+// falls back on the watcher's own watches once there has been no feed for
+// fallback.
+func (f *feedFollower) lost(addr string, followed bool, err error) {
+	f.Lock()
+	defer f.Unlock()
+	if followed {
+		f.lastSeen = time.Now()
+	}
+	if f.err == nil {
+		f.logger.Warnf("lost the config feed of %s. %v", addr, err)
+	}
+	f.err = err
+	if !f.fed || f.fallback == 0 || time.Since(f.lastSeen) < f.fallback {
+		return
+	}
+	f.logger.Warnf("no config feed for %v. watching the configmap and nodes until it returns", time.Since(f.lastSeen).Round(time.Second))
+	f.fed = false
+	f.connected.Set(0)
+	f.w.Fed(false)
+}
+
+// Health reports where the cluster config and nodes come from. The
+// realserver is as ready watching for itself as on the feed.
+func (f *feedFollower) Health(context.Context) health.Status {
+	f.Lock()
+	defer f.Unlock()
+	detail := map[string]interface{}{"directors": f.addrs}
+	if f.addr != "" {
+		detail["director"] = f.addr
+		detail["generation"] = f.generation
+		detail["lastSeen"] = f.lastSeen.UTC().Format(time.RFC3339)
+	}
+	if f.err != nil {
+		detail["error"] = f.err.Error()
+	}
+	if !f.fed {
+		return health.Status{Ready: true, Message: "watching the configmap and nodes until the config feed returns", Detail: detail}
+	}
+	return health.Status{Ready: true, Message: "following the config feed", Detail: detail}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/flowexport"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// startFlowExport starts exporting sampled VIP traffic when --flow-export is
+// set. It must be called before the eBPF counters are enabled, since the
+// sampling is compiled into the counter programs.
+func startFlowExport(ctx context.Context, config *config.Config, s *stats.Stats, logger logging.Logger) error {
+	fe := config.Stats.FlowExport
+	if fe.Protocol == "" {
+		return nil
+	}
+
+	iface, err := net.InterfaceByName(config.Stats.Interface)
+	if err != nil {
+		return fmt.Errorf("unable to find stats interface %s: %v", config.Stats.Interface, err)
+	}
+
+	exporter, err := flowexport.New(ctx, flowexport.Config{
+		Protocol:   fe.Protocol,
+		Collector:  fe.Collector,
+		SampleRate: fe.SampleRate,
+		Interval:   fe.Interval,
+		AgentIP:    net.ParseIP(config.Net.PrimaryIP),
+		IfIndex:    uint32(iface.Index),
+	}, logger)
+	if err != nil {
+		return err
+	}
+	s.EnableFlowExport(fe.SampleRate, exporter)
+	return nil
+}
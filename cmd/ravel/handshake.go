@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/Comcast/Ravel/pkg/heartbeat"
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+// peerVersion follows the version and capabilities the other end of the
+// coordinator heartbeat sent, and logs when they change. While the other end
+// lacks features of this one, the two run in compatibility mode, where this
+// end doesn't rely on them.
+type peerVersion struct {
+	sync.Mutex
+	// peer names the other end in logs
+	peer   string
+	cm     *coordinationMetrics
+	logger logging.Logger
+
+	seen    bool
+	version string
+	missing string
+}
+
+func newPeerVersion(peer string, cm *coordinationMetrics, logger logging.Logger) *peerVersion {
+	return &peerVersion{peer: peer, cm: cm, logger: logger}
+}
+
+// observe records what the other end sent, and returns its capabilities.
+func (p *peerVersion) observe(peerVersion string, sent []string) []string {
+	caps := heartbeat.PeerCapabilities(sent)
+	missing := strings.Join(heartbeat.Missing(caps), ",")
+	skewed := peerVersion != version
+	p.cm.Peer(skewed, missing != "")
+
+	p.Lock()
+	defer p.Unlock()
+	if p.seen && p.version == peerVersion && p.missing == missing {
+		return caps
+	}
+	if skewed {
+		p.logger.Warnf("the %s on the coordinator port is version %q, and this is %q", p.peer, peerVersion, version)
+	} else if p.seen && p.version != peerVersion {
+		p.logger.Infof("the %s on the coordinator port is version %q, the same as this", p.peer, peerVersion)
+	}
+	if missing != "" {
+		p.logger.Warnf("the %s on the coordinator port doesn't support %s. running in compatibility mode without them", p.peer, missing)
+	} else if p.missing != "" {
+		p.logger.Infof("the %s on the coordinator port supports every feature. leaving compatibility mode", p.peer)
+	}
+	p.seen, p.version, p.missing = true, peerVersion, missing
+	return caps
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cobra"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/haproxy"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// startHAProxy creates the set of haproxy listeners for the realserver, with
+// the configuration template and snippets from --haproxy-template and
+// --haproxy-snippet-dir, and exports the stats of each listener. Their access
+// logs go to logger with --haproxy-access-log. Listeners run by the native
+// proxy need no haproxy binary.
+func startHAProxy(ctx context.Context, config *config.Config, logger logging.Logger) (*haproxy.HAProxySetManager, error) {
+	templates, err := haproxy.NewTemplates(config.HAProxy.Template, config.HAProxy.SnippetDir)
+	if err != nil {
+		return nil, err
+	}
+	set, err := haproxy.NewHAProxySet(ctx, "/usr/sbin/haproxy", "/etc/ravel", logger)
+	if err != nil {
+		return nil, err
+	}
+	set.UseTemplates(templates)
+	set.UseMasterWorker(config.HAProxy.MasterWorker)
+	set.UseProxy(config.HAProxy.Proxy)
+	set.UsePools(config.HAProxy.Pools)
+	if config.HAProxy.AccessLog {
+		access, err := haproxy.NewAccessLog(ctx, "/etc/ravel/access.sock", config.HAProxy.AccessLogSample, logger)
+		if err != nil {
+			return nil, fmt.Errorf("unable to listen for haproxy access logs. %v", err)
+		}
+		set.UseAccessLog(access)
+	}
+	prometheus.MustRegister(haproxy.NewCollector(set, stats.KindIpvsBackend))
+	return set, nil
+}
+
+// HAProxy runs the haproxy operations of the admin API against the
+// realserver on this node.
+func HAProxy() *cobra.Command {
+	var output string
+
+	var cmd = &cobra.Command{
+		Use:          "haproxy",
+		Short:        "inspect and operate the haproxy listeners of the realserver on this node",
+		SilenceUsage: true,
+		Long: `
+haproxy talks to the admin endpoint of the realserver on this node, using
+--admin-listen and --admin-token-file, so that the stats socket of each
+listener doesn't have to be found by hand. Listeners are named vip:port, and
+servers by pod IP, by server name, or as backend/server for the servers of a
+route. Changes last until the listener reloads.`,
+	}
+	outputFlag(cmd.PersistentFlags(), &output)
+
+	run := func(method, path string, args func([]string) url.Values) func(*cobra.Command, []string) error {
+		return func(cmd *cobra.Command, a []string) error {
+			return adminOutput(NewConfig(cmd.Flags()), method, path, args(a), output)
+		}
+	}
+	server := func(action string) func([]string) url.Values {
+		return func(a []string) url.Values {
+			q := url.Values{"listener": {a[0]}, "server": {a[1]}, "action": {action}}
+			if len(a) > 2 {
+				q.Set("weight", a[2])
+			}
+			return q
+		}
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "listeners",
+		Short: "list the listeners, their health and their servers",
+		Args:  cobra.NoArgs,
+		RunE:  run(http.MethodGet, "/haproxy/listeners", func([]string) url.Values { return url.Values{} }),
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "sessions <vip:port>",
+		Short: "show the sessions of a listener",
+		Args:  cobra.ExactArgs(1),
+		RunE:  run(http.MethodGet, "/haproxy/sessions", func(a []string) url.Values { return url.Values{"listener": {a[0]}} }),
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "disable <vip:port> <server>",
+		Short: "stop sending new connections to a server",
+		Args:  cobra.ExactArgs(2),
+		RunE:  run(http.MethodPost, "/haproxy/server", server("disable")),
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "enable <vip:port> <server>",
+		Short: "send connections to a disabled server again",
+		Args:  cobra.ExactArgs(2),
+		RunE:  run(http.MethodPost, "/haproxy/server", server("enable")),
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "weight <vip:port> <server> <0-256>",
+		Short: "set the weight of a server",
+		Args:  cobra.ExactArgs(3),
+		RunE:  run(http.MethodPost, "/haproxy/server", server("weight")),
+	})
+	return cmd
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/privsep"
+)
+
+// Helper runs the privileged helper of an unprivileged ravel.
+func Helper(ctx context.Context, logger logging.Logger) *cobra.Command {
+	var (
+		socket     string
+		uid        int
+		haproxyDir string
+	)
+
+	var cmd = &cobra.Command{
+		Use:           "helper",
+		Short:         "make the changes to the node for a ravel that runs without root",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		Long: `
+helper runs as root beside a ravel that runs as --uid, with only the
+capabilities it needs for the stats it loads into the kernel, and makes the
+changes to the node that ravel asks it to over a unix socket at --socket. The
+mode is started with --privileged-helper set to the same socket.
+
+Only --uid and root may connect. The helper runs nothing but ip, ipvsadm,
+iptables, iptables-save, iptables-restore and their ip6tables counterparts,
+tc, ifconfig, arping and haproxy, from its own PATH, and writes nothing but
+the ipvs sysctls and the rp_filter and arp sysctls of the interfaces. Their
+arguments are checked: ip and tc only run the commands ravel does, with
+every word in full, iptables can't be given a --modprobe program, however
+abbreviated, and haproxy only runs
+the configs of --haproxy-config-dir, which can't run external checks, lua or
+programs. haproxy runs a copy of the config checked, which only root can
+write, and not in master-worker mode, whose master would reload the config
+unchecked. Everything else is refused, and logged.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if uid < 1 {
+				return withExitCode(exitUsage, fmt.Errorf("uid must be set to the user ravel runs as, not root"))
+			}
+			l, err := privsep.Listen(socket, uid)
+			if err != nil {
+				return fmt.Errorf("unable to listen on %s: %v", socket, err)
+			}
+			h := &privsep.Helper{
+				UID:      uid,
+				Commands: privsep.DefaultCommands(haproxyDir),
+				Settings: privsep.DefaultSettings,
+				Logger:   logger,
+			}
+			logger.Infof("helper: listening on %s for uid %d", socket, uid)
+			return h.Serve(ctx, l)
+		},
+	}
+	cmd.Flags().StringVar(&socket, "socket", privsep.DefaultSocket, "the unix socket to listen on")
+	cmd.Flags().IntVar(&uid, "uid", 0, "the user ravel runs as, which alone may connect")
+	cmd.Flags().StringVar(&haproxyDir, "haproxy-config-dir", "/etc/ravel", "the directory of the haproxy configs and stats sockets of realserver listeners. haproxy isn't run if it is empty.")
+
+	return cmd
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/instance"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/observe"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// lockInstance takes the lock of the mode and config key on the node, so
+// that a second ravel started beside this one refuses to run rather than
+// fight it over ipvs and iptables. A ravel that only observes changes
+// nothing, and runs beside the one that does. release gives the lock up.
+func lockInstance(ctx context.Context, config *config.Config, kind stats.LBKind, logger logging.Logger) (release func(), err error) {
+	if observe.Enabled() {
+		return func() {}, nil
+	}
+	lock, err := instance.Acquire(ctx, kind, config.ConfigKey, logger)
+	if err != nil {
+		// the conflict clears once the other ravel stops
+		return nil, withExitCode(exitTransient, err)
+	}
+	return lock.Release, nil
+}
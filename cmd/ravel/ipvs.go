@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/Comcast/Ravel/pkg/system"
+)
+
+// writeServices prints the virtual services of a director for people, with
+// the weights the config wants where they differ from those programmed.
+func writeServices(w io.Writer, services []system.VirtualService) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, svc := range services {
+		notes := []string{}
+		if svc.Service != "" {
+			notes = append(notes, fmt.Sprintf("%s/%s:%s", svc.Namespace, svc.Service, svc.PortName))
+		}
+		switch {
+		case !svc.Owned:
+			notes = append(notes, "not ours")
+		case !svc.Wanted:
+			notes = append(notes, "not in the config, removed on the next reconfigure")
+		}
+		fmt.Fprintf(tw, "%s %s\t%s\t%s\n", svc.Protocol, net.JoinHostPort(svc.VIP, svc.Port), svc.Options, strings.Join(notes, ", "))
+		for _, dst := range svc.Destinations {
+			note := ""
+			switch {
+			case !svc.Owned:
+			case dst.Want == nil:
+				note = "not in the config"
+			case *dst.Want != dst.Weight:
+				note = fmt.Sprintf("the config wants weight %d", *dst.Want)
+			}
+			fmt.Fprintf(tw, "  -> %s\t%s weight %d\t%s\n", dst.Address, dst.Forwarding, dst.Weight, note)
+		}
+	}
+	return tw.Flush()
+}
+
+// writeParity prints the rules a reconfigure would add with +, and those it
+// would delete with -.
+func writeParity(w io.Writer, parity map[string][]string) error {
+	missing, extra := parity["missing"], parity["extra"]
+	if len(missing) == 0 && len(extra) == 0 {
+		_, err := fmt.Fprintln(w, "ipvs is in sync with the config")
+		return err
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	for _, rule := range missing {
+		fmt.Fprintln(w, "+", rule)
+	}
+	for _, rule := range extra {
+		fmt.Fprintln(w, "-", rule)
+	}
+	_, err := fmt.Fprintf(w, "%d rules missing, %d extra\n", len(missing), len(extra))
+	return err
+}
+
+// IPVSCmd inspects the ipvs services of the director on this node, and
+// flushes those of a VIP.
+func IPVSCmd() *cobra.Command {
+	var output string
+
+	var cmd = &cobra.Command{
+		Use:          "ipvs",
+		Short:        "inspect the ipvs services of the director on this node",
+		SilenceUsage: true,
+		Long: `
+ipvs talks to the admin endpoint of the director on this node, using
+--admin-listen and --admin-token-file, to show the virtual services it
+programs as ravel sees them rather than as ipvsadm lists them: the service of
+the config each is for, whether this instance reconciles it, and where the
+weight of a real server differs from the one the config wants.`,
+	}
+	outputFlag(cmd.PersistentFlags(), &output)
+
+	// show gets path and prints it with write, as it came with -o json, or
+	// converted with -o yaml
+	show := func(path string, q url.Values, into interface{}, write func(io.Writer) error) func(*cobra.Command) error {
+		return func(cmd *cobra.Command) error {
+			if err := checkOutput(output); err != nil {
+				return err
+			}
+			b := &bytes.Buffer{}
+			if err := adminRequest(NewConfig(cmd.Flags()), http.MethodGet, path, q, b); err != nil {
+				return err
+			}
+			if output == "json" {
+				_, err := os.Stdout.Write(b.Bytes())
+				return err
+			}
+			if err := json.Unmarshal(b.Bytes(), into); err != nil {
+				return fmt.Errorf("invalid response from %s. %v", path, err)
+			}
+			return writeOutput(os.Stdout, output, into, write)
+		}
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "get [vip]",
+		Short: "list the virtual services and real servers programmed, with those of the config",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			q := url.Values{}
+			if len(args) > 0 {
+				q.Set("vip", args[0])
+			}
+			services := []system.VirtualService{}
+			return show("/ipvs/services", q, &services, func(w io.Writer) error { return writeServices(w, services) })(cmd)
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "diff",
+		Short: "show the v4 rules the next reconfigure would add and delete",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			parity := map[string][]string{}
+			return show("/parity", nil, &parity, func(w io.Writer) error { return writeParity(w, parity) })(cmd)
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "flush-vip <vip>",
+		Short: "delete the virtual services of a VIP, which the director programs again from the config",
+		Args:  cobra.ExactArgs(1),
+		Long: `
+flush-vip deletes the virtual services of a VIP with their real servers, and
+has the director reconfigure, so that those the config wants are programmed
+again from scratch. On a shared node only the services of this instance are
+deleted. Connections through the services are dropped.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return adminOutput(NewConfig(cmd.Flags()), http.MethodPost, "/ipvs/flush", url.Values{"vip": {args[0]}}, output)
+		},
+	})
+	return cmd
+}
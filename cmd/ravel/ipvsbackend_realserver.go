@@ -2,24 +2,30 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
-	"net"
+	"sync"
 	"time"
 
-	"github.com/Comcast/Ravel/pkg/haproxy"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/role"
 	"github.com/Comcast/Ravel/pkg/watcher"
-	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/heartbeat"
 	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/observe"
+	"github.com/Comcast/Ravel/pkg/profiling"
 	"github.com/Comcast/Ravel/pkg/realserver"
 	"github.com/Comcast/Ravel/pkg/stats"
 	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
 	"github.com/Comcast/Ravel/pkg/util"
 )
 
 // IPVSBACKEND_REALSERVER creates the realserver command for kube2ipvs
-func IPVSBACKEND_REALSERVER(ctx context.Context, logger logrus.FieldLogger) *cobra.Command {
+func IPVSBACKEND_REALSERVER(ctx context.Context, logger logging.Logger) *cobra.Command {
 
 	var cmd = &cobra.Command{
 		Use:   "realserver",
@@ -34,20 +40,50 @@ to prune rules that exist, but no longer apply, and to create rules that
 are missing from the configuration.`,
 		RunE: func(cmd *cobra.Command, _ []string) error {
 			log.Debugln("Starting in REAL SERVER mode")
+			logger := logger.WithField(logging.FieldRole, role.Realserver)
 
 			config := NewConfig(cmd.Flags())
-			logger.Debugf("got config %+v", config)
+			logger.Infof("IPVSBACKEND: got config %s", config)
 
 			// validate flags
-			if err := config.Invalid(); err != nil {
+			if err := config.Validate(role.Realserver); err != nil {
+				return withExitCode(exitInvalid, err)
+			}
+
+			// record changes made to the node from here on
+			if err := initAudit(config, logger); err != nil {
+				return err
+			}
+
+			// leave the node as it is, if a dry run
+			if config.DryRun {
+				logger.Warn("IPVSBACKEND: dry-run. changes to the node are recorded, not made")
+				observe.Enable(stats.KindIpvsBackend, config.ConfigKey)
+			}
+
+			// refuse to run beside another ravel of this mode and config key
+			release, err := lockInstance(ctx, config, stats.KindIpvsBackend, logger)
+			if err != nil {
+				return err
+			}
+			defer release()
+
+			// check the environment before taking traffic
+			if err := selfTest(ctx, config, stats.KindIpvsBackend, logger); err != nil {
 				return err
 			}
 
-			// instantiate a watcher
-			watcher, err := watcher.NewWatcher(ctx, config.KubeConfigFile, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey, stats.KindIpvsBackend, config.DefaultListener.Service, config.DefaultListener.Port, logger)
+			// instantiate a watcher, which takes the cluster config and
+			// nodes from the directors when they feed them
+			newWatcher := watcher.NewWatcher
+			if len(config.Coordinator.Feed) > 0 {
+				newWatcher = watcher.NewFedWatcher
+			}
+			watcher, err := newWatcher(ctx, config.KubeConfigFile, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey, stats.KindIpvsBackend, config.DefaultListener.Service, config.DefaultListener.Port, logger)
 			if err != nil {
 				return err
 			}
+			watcher.SetStrict(config.StrictConfig)
 
 			// initialize statistics
 			s, err := stats.NewStats(ctx, stats.KindIpvsBackend, config.Stats.Interface, config.Stats.ListenAddr, config.Stats.ListenPort, config.Stats.Interval, logger)
@@ -55,15 +91,77 @@ are missing from the configuration.`,
 				return fmt.Errorf("failed to initialize metrics. %v", err)
 			}
 			if config.Stats.Enabled {
+				if err := startFlowExport(ctx, config, s, logger); err != nil {
+					return fmt.Errorf("failed to initialize flow export. %v", err)
+				}
+				s.EnableTopTalkers(config.Stats.TopTalkers)
 				if err := s.EnableBPFStats(); err != nil {
-					return fmt.Errorf("failed to initialize BPF capture. if=%v sa=%s %v", config.Stats.Interface, config.Stats.ListenAddr, err)
+					return fmt.Errorf("failed to initialize eBPF counters. if=%v sa=%s %v", config.Stats.Interface, config.Stats.ListenAddr, err)
 				}
+				s.FollowConfig(func() *types.ClusterConfig { return watcher.ClusterConfig })
 			}
 			// emit the version metric
 			emitVersionMetric(stats.KindIpvsBackend, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey)
 
+			// export the capacity of the conntrack and ipvs tables
+			if err := registerCapacity(config, stats.KindIpvsBackend, logger); err != nil {
+				return err
+			}
+
+			// push the metrics to a remote-write endpoint, if enabled
+			if err := startRemoteWrite(config, s, logger); err != nil {
+				return err
+			}
+
+			// export reconfigure traces, if enabled
+			stopTracing, err := startTracing(ctx, config, stats.KindIpvsBackend, logger)
+			if err != nil {
+				return err
+			}
+			defer stopTracing()
+
+			// serve the admin endpoint, if enabled
+			adminServer, err := startAdmin(ctx, config, s, watcher, logger)
+			if err != nil {
+				return err
+			}
+
+			// reload some settings without a restart
+			reload := newReloader(config, cmd.Flags(), logger)
+			reload.Handle(reloadStats(s))
+			if adminServer != nil {
+				adminServer.Handle("/reload", reload.handler())
+			}
+
+			// serve pprof and runtime metrics on localhost, if enabled. the
+			// port may be taken by another process on the node, which
+			// profiling isn't worth failing the mode over
+			if config.PprofPort != 0 {
+				if err := profiling.Serve(ctx, fmt.Sprintf("127.0.0.1:%d", config.PprofPort), logger); err != nil {
+					logger.Errorf("%v. continuing without profiling", err)
+				}
+			}
+
 			// listen for health
-			go util.ListenForHealth(config.Net.Interface, 10200, logger)
+			checks := health.NewRegistry()
+			checks.Register("watcher", watcher.Health)
+			go util.ListenForHealth(config.Net.Interface, 10200, checks, logger)
+			if adminServer != nil {
+				adminServer.Handle("/status", statusHandler(config, stats.KindIpvsBackend, watcher, checks))
+			}
+			if err := startStatusSocket(ctx, config, stats.KindIpvsBackend, watcher, checks, logger); err != nil {
+				return err
+			}
+			// override log levels at runtime through the admin endpoint. a
+			// realserver sets no ipvs weights, so services can't be
+			startLive(ctx, config, stats.KindIpvsBackend, false, watcher, adminServer, logger)
+
+			// follow the config feed of the directors, if enabled
+			if len(config.Coordinator.Feed) > 0 {
+				if err := followConfigFeed(ctx, config, stats.KindIpvsBackend, watcher, checks, logger); err != nil {
+					return err
+				}
+			}
 
 			// instantiate an IP helper for loopback
 			logger.Info("IPVSBACKEND: initializing loopback helper")
@@ -71,6 +169,7 @@ are missing from the configuration.`,
 			if err != nil {
 				return err
 			}
+			ipLoopback.Own(config.Ownership())
 
 			// instantiate an IP helper for primary interface
 			logger.Info("IPVSBACKEND: initializing primary helper")
@@ -78,6 +177,7 @@ are missing from the configuration.`,
 			if err != nil {
 				return err
 			}
+			ipPrimary.Own(config.Ownership())
 
 			// instantiate an iptables interface
 			logger.Info("IPVSBACKEND: initializing iptables helper")
@@ -85,6 +185,7 @@ are missing from the configuration.`,
 			if err != nil {
 				return err
 			}
+			reload.Handle(reloadMasq(ipt))
 
 			// instantiate a new IPVS manager
 			logger.Info("IPVSBACKEND: initializing ipvs helper")
@@ -92,93 +193,336 @@ are missing from the configuration.`,
 			if err != nil {
 				return err
 			}
+			if err := ipvs.Own(config.Ownership()); err != nil {
+				return err
+			}
+
+			// register with snmpd, if enabled
+			if err := startSNMP(ctx, config, stats.KindIpvsBackend, watcher, s, ipvs, nil, logger); err != nil {
+				return err
+			}
 
 			// instantiate the realserver worker.
 			logger.Info("IPVSBACKEND: initializing realserver")
-			haproxy, err := haproxy.NewHAProxySet(ctx, "/usr/sbin/haproxy", "/etc/ravel", logger)
+			haproxySet, err := startHAProxy(ctx, config, logger)
 			if err != nil {
 				return err
 			}
-			worker, err := realserver.NewRealServer(ctx, config.NodeName, config.ConfigKey, watcher, ipPrimary, ipLoopback, ipvs, ipt, config.ForcedReconfigure, haproxy, logger)
+			if adminServer != nil {
+				adminServer.Handle("/haproxy/", haproxySet.AdminHandler())
+				exportHandler(adminServer, watcher, exportSources{ipt: ipt, ip: ipLoopback})
+			}
+			worker, err := realserver.NewRealServer(ctx, config.NodeName, config.ConfigKey, watcher, ipPrimary, ipLoopback, ipvs, ipt, config.ForcedReconfigure, config.DrainWindow, haproxySet, logger)
 			if err != nil {
 				return err
 			}
+			if config.WarmStandbyInterval > 0 {
+				worker.Standby(config.WarmStandbyInterval)
+			}
 
 			logger.Infof("IPVSBACKEND: starting continuous poll to find director, using 127.0.0.1:%d", config.Coordinator.Ports[0])
 			cm := NewCoordinationMetrics(stats.KindIpvsBackend)
-			return blockForever(ctx, worker, config.Coordinator.Ports[0], config.FailoverTimeout, cm, logger)
+			checks.Register("realserver", worker.Health)
+
+			// take the node out of rotation while it can't serve, if enabled
+			if err := startSelfHealth(ctx, config, stats.KindIpvsBackend, watcher, ipt, haproxySet, checks, logger); err != nil {
+				return err
+			}
+
+			// supervise the worker loops, if enabled
+			dog, err := startWatchdog(ctx, config, stats.KindIpvsBackend, logger)
+			if err != nil {
+				return err
+			}
+
+			coordinatorTLS, err := config.Coordinator.ClientTLS()
+			if err != nil {
+				return err
+			}
+			director, err := newDirectorFollower(config.Coordinator.Ports[0], coordinatorTLS, config.NodeName, config.ConfigKey, watcher.ConfigHash, config.Coordinator.StaleAfter, cm, logger)
+			if err != nil {
+				return err
+			}
+			// follow the director to the first port in the config file
+			reload.Handle(reloadPorts(func(ports []int) error {
+				if err := director.follow(ports[0]); err != nil {
+					return fmt.Errorf("unable to follow the director on port %d. %v", ports[0], err)
+				}
+				return nil
+			}))
+			reload.start(ctx, config.ReloadInterval)
+			// hand the node back and stay stopped while it is in maintenance
+			maintenance := startMaintenance(ctx, config, stats.KindIpvsBackend, watcher, checks, logger)
+			return blockForever(ctx, worker, director, newFailoverPolicy(config.Failover), maintenance.Active, cm, dog.Stalled(), config.ShutdownGracePeriod, logger)
 
 		},
 	}
 	return cmd
 }
 
-func blockForever(ctx context.Context, worker realserver.RealServer, port, maxTries int, cm *coordinationMetrics, logger logrus.FieldLogger) error {
+func blockForever(ctx context.Context, worker realserver.RealServer, director *directorFollower, policy *failoverPolicy, maintained func() bool, cm *coordinationMetrics, stalled <-chan error, grace time.Duration, logger logging.Logger) error {
 	controlChan := make(chan bool)
-	go watchForMaster(ctx, port, controlChan)
+	pushed := make(chan struct{}, 1)
+	go director.watch(ctx, pushed)
+	go watchForMaster(ctx, director, policy, pushed, controlChan)
 
-	tries := maxTries
-	lastMasterStatus := true
 	for { // ever
 		select {
 		case masterRunning := <-controlChan:
 			cm.Check(masterRunning)
-			if masterRunning && masterRunning != lastMasterStatus {
+			var decision string
+			if maintained != nil && maintained() {
+				decision = policy.maintain()
+			} else {
+				decision = policy.decide(masterRunning, time.Now())
+			}
+			cm.Decision(decision)
+			switch decision {
+			case decisionGiveback:
 				logger.Info("got updated control message. stopping worker")
 				cm.Running(false)
 				if err := worker.Stop(); err != nil {
 					return err
 				}
-			} else if masterRunning != lastMasterStatus && tries >= maxTries {
+			case decisionTakeover:
 				cm.Running(true)
 				logger.Info("got updated control message. starting worker")
 				if err := worker.Start(); err != nil {
 					return err
 				}
-			} else if masterRunning != lastMasterStatus {
-				// increment unavailability counter
+			case decisionBackoff:
 				cm.Hazard()
-				logger.Warnf("director unavailable. %d/%d attempts before restart", tries, maxTries)
-				tries++
-				continue
+				logger.Warnf("director unavailable. holding off for %v as it has been flapping", policy.holdUntil.Sub(time.Now()).Round(time.Second))
+			case decisionWait:
+				// count towards a threshold
+				cm.Hazard()
+				if masterRunning {
+					logger.Infof("director back. %d/%d probes before handing it the node", policy.successes, policy.config.RecoveryThreshold)
+				} else {
+					logger.Warnf("director unavailable. %d/%d attempts before restart", policy.failures, policy.config.FailureThreshold)
+				}
 			}
-			lastMasterStatus = masterRunning
-			tries = 1
 		case <-ctx.Done():
 			// catching exit signals sent from the parent context
-			return worker.Stop()
+			shutdown, cancel := context.WithTimeout(context.Background(), grace)
+			defer cancel()
+			return worker.Shutdown(shutdown)
+		case err := <-stalled:
+			// the stalled worker is left as it is for its replacement
+			return err
 		}
 	}
 }
 
-func watchForMaster(ctx context.Context, port int, controlChan chan bool) {
-	// once per second, attempt to connect to the master.
-	// record connection success / failure in  boolean channel.
+func watchForMaster(ctx context.Context, d *directorFollower, policy *failoverPolicy, pushed <-chan struct{}, controlChan chan bool) {
+	// once per probe interval, or as soon as the director pushes a change,
+	// call the heartbeat of the master.
+	// record success / failure in  boolean channel.
 	// values of `true` indicate that the worker must clean up
 	// and stop.
 	for {
-		if connectToMaster(port) {
+		if d.running(ctx) {
 			controlChan <- true
 		} else {
 			controlChan <- false
 		}
-		<-time.After(1000 * time.Millisecond)
+		select {
+		case <-time.After(policy.wait()):
+		case <-pushed:
+		}
+	}
+}
+
+// skewGrace is how long the director and realserver may report different
+// configs before it counts as skew, as each publishes in its own time.
+const skewGrace = 30 * time.Second
+
+// directorFollower follows the heartbeat of the director on the node.
+type directorFollower struct {
+	tlsConfig  *tls.Config
+	hello      heartbeat.Hello
+	node       string
+	configKey  string
+	configHash func() string
+	staleAfter time.Duration
+	cm         *coordinationMetrics
+	logger     logging.Logger
+
+	mismatched bool
+	unhealthy  bool
+	skewSince  time.Time
+	skewed     bool
+	fence      uint64
+
+	director *peerVersion
+	// push is set while the director supports the push of applied configs
+	push   bool
+	pushMu sync.Mutex
+
+	// client calls the director on the port followed, which can change
+	client   *heartbeat.Client
+	clientMu sync.Mutex
+}
+
+func newDirectorFollower(port int, tlsConfig *tls.Config, node, configKey string, configHash func() string, staleAfter time.Duration, cm *coordinationMetrics, logger logging.Logger) (*directorFollower, error) {
+	hello := heartbeat.Hello{Identity: node, ConfigKey: configKey, Version: version, Capabilities: heartbeat.Capabilities}
+	d := &directorFollower{tlsConfig: tlsConfig, hello: hello, node: node, configKey: configKey, configHash: configHash, staleAfter: staleAfter, cm: cm, logger: logger, director: newPeerVersion("director", cm, logger)}
+	if err := d.follow(port); err != nil {
+		return nil, err
 	}
+	return d, nil
 }
 
-func connectToMaster(port int) bool {
-	addr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("127.0.0.1:%d", port))
-	conn, err := net.DialTCP("tcp4", nil, addr)
+// follow has the realserver call the director on port from now on. A watch
+// of the director on the previous port ends, and is taken up on the new one.
+func (d *directorFollower) follow(port int) error {
+	client, err := heartbeat.Dial(fmt.Sprintf("127.0.0.1:%d", port), d.tlsConfig, d.hello)
+	if err != nil {
+		return err
+	}
+	d.clientMu.Lock()
+	previous := d.client
+	d.client = client
+	d.clientMu.Unlock()
+	if previous != nil {
+		d.logger.Infof("following the director on 127.0.0.1:%d", port)
+		previous.Close()
+	}
+	return nil
+}
+
+func (d *directorFollower) conn() *heartbeat.Client {
+	d.clientMu.Lock()
+	defer d.clientMu.Unlock()
+	return d.client
+}
+
+func (d *directorFollower) setPush(push bool) {
+	d.pushMu.Lock()
+	d.push = push
+	d.pushMu.Unlock()
+}
+
+func (d *directorFollower) pushes() bool {
+	d.pushMu.Lock()
+	defer d.pushMu.Unlock()
+	return d.push
+}
+
+// watch follows the configs the director pushes until ctx is done, and
+// signals pushed on each one, and whenever the stream breaks, so that the
+// director is probed straight away. A director that doesn't push, or
+// predates the push, is only probed on the interval.
+func (d *directorFollower) watch(ctx context.Context, pushed chan<- struct{}) {
+	signal := func() {
+		select {
+		case pushed <- struct{}{}:
+		default:
+		}
+	}
+	for ctx.Err() == nil {
+		if !d.pushes() {
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		watching := false
+		err := d.conn().Watch(ctx, func(a heartbeat.Applied) {
+			watching = true
+			d.cm.Pushed()
+			d.logger.Debugf("the director applied generation %d with hash %s", a.Generation, a.ConfigHash)
+			signal()
+		})
+		if watching {
+			d.logger.Debugf("stopped watching the director. %v", err)
+			signal()
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// running calls the heartbeat once, and reports whether a director answered
+// and is reconciling. A director of another node or config key still holds
+// the port, so it counts as running, but is logged and counted as a
+// mismatch. One whose last reconcile failed, or that hasn't finished one in
+// staleAfter, doesn't count, as it answers without doing its job.
+func (d *directorFollower) running(ctx context.Context) bool {
+	beat, err := d.conn().Beat(ctx)
 	if err != nil {
 		return false
 	}
-	defer conn.Close()
 
-	// connection settings to kill this thing pronto
-	conn.SetLinger(0)
-	conn.SetNoDelay(true)
-	conn.SetKeepAlive(false)
+	mismatched := beat.Identity != d.node || beat.ConfigKey != d.configKey
+	if mismatched {
+		d.cm.Mismatch()
+		if !d.mismatched {
+			d.logger.Errorf("the director on the coordinator port is %s for config key %s, not %s for %s", beat.Identity, beat.ConfigKey, d.node, d.configKey)
+		}
+	} else if d.mismatched {
+		d.logger.Infof("the director on the coordinator port is %s for config key %s", beat.Identity, beat.ConfigKey)
+	}
+	d.mismatched = mismatched
 
-	return true
+	// only rely on the features the director has
+	caps := d.director.observe(beat.Version, beat.Capabilities)
+	d.setPush(heartbeat.Has(caps, heartbeat.CapabilityPush))
+	if !heartbeat.Has(caps, heartbeat.CapabilityFence) {
+		beat.Fence = d.fence
+	}
+
+	now := time.Now()
+	hash := d.configHash()
+	switch {
+	case mismatched || !heartbeat.Has(caps, heartbeat.CapabilityConfigHash) || beat.ConfigHash == "" || hash == "" || beat.ConfigHash == hash:
+		if d.skewed {
+			d.logger.Infof("director config is in step again at generation %d", beat.Generation)
+		}
+		d.skewSince, d.skewed = time.Time{}, false
+	case d.skewSince.IsZero():
+		d.skewSince = now
+	case !d.skewed && now.Sub(d.skewSince) >= skewGrace:
+		d.skewed = true
+		d.logger.Warnf("director config %s at generation %d has differed from the realserver's %s for %v", beat.ConfigHash, beat.Generation, hash, now.Sub(d.skewSince).Round(time.Second))
+	}
+	d.cm.Beat(beat.Generation, d.skewed)
 
+	// fence generations only grow, so a lower one is a director that was
+	// fenced off but still thinks it holds the VIPs
+	if beat.Fence != d.fence {
+		switch {
+		case beat.Fence == 0:
+			d.logger.Infof("the director gave up its claim on the VIPs at fence generation %d", d.fence)
+		case beat.Fence < d.fence:
+			d.logger.Warnf("the director claims the VIPs at fence generation %d, older than the %d it held before", beat.Fence, d.fence)
+		default:
+			d.logger.Infof("the director claimed the VIPs at fence generation %d", beat.Fence)
+		}
+		d.fence = beat.Fence
+	}
+
+	// a director that predates the status is taken at its word
+	if !heartbeat.Has(caps, heartbeat.CapabilityStatus) {
+		d.cm.Healthy(true)
+		return true
+	}
+	var unhealthy string
+	switch {
+	case !beat.Healthy:
+		unhealthy = fmt.Sprintf("its reconcile at %s failed", beat.Reconciled.Format(time.RFC3339))
+	case d.staleAfter > 0 && now.Sub(beat.Reconciled) > d.staleAfter:
+		unhealthy = fmt.Sprintf("it hasn't finished a reconcile since %s", beat.Reconciled.Format(time.RFC3339))
+	}
+	if unhealthy != "" && !d.unhealthy {
+		d.logger.Warnf("the director answers, but %s. taking its heartbeat as failed", unhealthy)
+	} else if unhealthy == "" && d.unhealthy {
+		d.logger.Infof("the director is reconciling again as of %s", beat.Reconciled.Format(time.RFC3339))
+	}
+	d.unhealthy = unhealthy != ""
+	d.cm.Healthy(!d.unhealthy)
+	return !d.unhealthy
 }
@@ -7,10 +7,14 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/heartbeat"
+	"github.com/Comcast/Ravel/pkg/logging"
 )
 
 type mockWorker struct {
@@ -24,7 +28,12 @@ func (m *mockWorker) Start() error {
 	}
 	return nil
 }
-func (m *mockWorker) Stop() error { return nil }
+func (m *mockWorker) Stop() error                    { return nil }
+func (m *mockWorker) Shutdown(context.Context) error { return nil }
+func (m *mockWorker) Standby(time.Duration)          {}
+func (m *mockWorker) Health(context.Context) health.Status {
+	return health.Status{Ready: true}
+}
 func (m *mockWorker) drain() {
 	for len(m.started) > 0 {
 		<-m.started
@@ -35,19 +44,25 @@ func TestBlockForever(t *testing.T) {
 	ctx, cxl := context.WithTimeout(context.Background(), 3000*time.Millisecond)
 	defer cxl()
 
-	logger := logrus.New()
+	logger := logging.New()
 	maxTries := 2
 	worker := &mockWorker{make(chan bool)}
 
-	ln, port := testListener()
-	fmt.Println("got port ", port)
+	cm := testCoordinationMetrics()
 
-	// make a new coordinationmetrics struct
-	cm := NewCoordinationMetrics("lbname")
+	stop, port := testListener(heartbeat.Beat{Identity: "node", ConfigKey: "key"})
+	fmt.Println("got port ", port)
+	follower := func(port int) *directorFollower {
+		d, err := newDirectorFollower(port, nil, "node", "key", func() string { return "" }, 0, cm, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
 
 	// base case
 	worker.drain()
-	go blockForever(ctx, worker, port, maxTries, cm, logger)
+	go blockForever(ctx, worker, follower(port), testPolicy(maxTries), nil, cm, nil, time.Second, logger)
 	select {
 	case <-ctx.Done():
 		// pass
@@ -60,7 +75,7 @@ func TestBlockForever(t *testing.T) {
 	ctx, cxl = context.WithTimeout(context.Background(), 3000*time.Millisecond)
 	defer cxl()
 	worker.drain()
-	go blockForever(ctx, worker, 0, maxTries, cm, logger)
+	go blockForever(ctx, worker, follower(0), testPolicy(maxTries), nil, cm, nil, time.Second, logger)
 	select {
 	case <-ctx.Done():
 		t.Fatal("worker didn't start before context expired")
@@ -73,11 +88,11 @@ func TestBlockForever(t *testing.T) {
 	ctx, cxl = context.WithTimeout(context.Background(), 6000*time.Millisecond)
 	defer cxl()
 	worker.drain()
-	go blockForever(ctx, worker, port, maxTries, cm, logger)
+	go blockForever(ctx, worker, follower(port), testPolicy(maxTries), nil, cm, nil, time.Second, logger)
 	select {
 	case <-time.After(500 * time.Millisecond):
 		fmt.Println("closed listener")
-		ln.Close()
+		stop()
 	case <-ctx.Done():
 		// pass
 	}
@@ -104,7 +119,154 @@ func TestBlockForever(t *testing.T) {
 
 }
 
-func testListener() (net.Listener, int) {
+func TestDirectorFollower(t *testing.T) {
+	logger := logging.New()
+	cm := testCoordinationMetrics()
+
+	beat := heartbeat.Beat{Identity: "node", ConfigKey: "key", ConfigHash: "abc", Generation: 3}
+	stop, port := testListener(beat)
+	defer stop()
+
+	hash := "abc"
+	d, err := newDirectorFollower(port, nil, "node", "key", func() string { return hash }, 0, cm, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.running(context.Background()) || d.mismatched || d.skewed {
+		t.Fatalf("expected a matching director in step. %+v", d)
+	}
+
+	// skew only counts once it outlasts the grace period
+	hash = "def"
+	d.running(context.Background())
+	if d.skewed || d.skewSince.IsZero() {
+		t.Fatalf("expected skew to be noted but not reported yet. %+v", d)
+	}
+	d.skewSince = time.Now().Add(-skewGrace)
+	d.running(context.Background())
+	if !d.skewed {
+		t.Fatal("expected skew to be reported after the grace period")
+	}
+	hash = "abc"
+	d.running(context.Background())
+	if d.skewed || !d.skewSince.IsZero() {
+		t.Fatal("expected skew to clear once the configs match")
+	}
+
+	// a director of another config key still holds the port
+	other, err := newDirectorFollower(port, nil, "node", "other", func() string { return hash }, 0, cm, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !other.running(context.Background()) || !other.mismatched {
+		t.Fatalf("expected a running, mismatched director. %+v", other)
+	}
+}
+
+func TestDirectorFollowerCompat(t *testing.T) {
+	logger := logging.New()
+	cm := testCoordinationMetrics()
+	hash := "abc"
+	follow := func(beat heartbeat.Beat) *directorFollower {
+		stop, port := testListener(beat)
+		t.Cleanup(stop)
+		d, err := newDirectorFollower(port, nil, "node", "key", func() string { return hash }, 0, cm, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !d.running(context.Background()) {
+			t.Fatal("expected the director to answer")
+		}
+		return d
+	}
+
+	// a director that predates the handshake doesn't push
+	if d := follow(heartbeat.Beat{Identity: "node", ConfigKey: "key", ConfigHash: "abc"}); d.pushes() {
+		t.Fatal("expected no watch of a director without the push")
+	}
+	if d := follow(heartbeat.Beat{Identity: "node", ConfigKey: "key", ConfigHash: "abc", Version: version, Capabilities: heartbeat.Capabilities}); !d.pushes() {
+		t.Fatal("expected to watch a director with the push")
+	}
+
+	// a config hash computed another way is never skew
+	d := follow(heartbeat.Beat{Identity: "node", ConfigKey: "key", ConfigHash: "xyz", Version: "3.0.0", Capabilities: []string{"config-hash/v2", heartbeat.CapabilityPush}})
+	d.skewSince = time.Now().Add(-skewGrace)
+	d.running(context.Background())
+	if d.skewed || !d.skewSince.IsZero() {
+		t.Fatalf("expected hashes computed differently not to be compared. %+v", d)
+	}
+}
+
+func TestDirectorFollowerStatus(t *testing.T) {
+	logger := logging.New()
+	cm := testCoordinationMetrics()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	beat := heartbeat.Beat{Identity: "node", ConfigKey: "key", Version: version, Capabilities: heartbeat.Capabilities}
+	server := heartbeat.NewServer(func(heartbeat.Hello) heartbeat.Beat { return beat }, logger)
+	go server.Serve(ctx, ln, nil)
+	port, _ := strconv.Atoi(strings.Split(ln.Addr().String(), ":")[1])
+
+	d, err := newDirectorFollower(port, nil, "node", "key", func() string { return "" }, 50*time.Millisecond, cm, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.running(ctx) {
+		t.Fatal("expected a director that just started to count as running")
+	}
+
+	// a director that answers without reconciling is stuck
+	time.Sleep(100 * time.Millisecond)
+	if d.running(ctx) || !d.unhealthy {
+		t.Fatalf("expected a stale director not to count as running. %+v", d)
+	}
+	server.Reconciled(fmt.Errorf("ipvsadm failed"))
+	if d.running(ctx) {
+		t.Fatal("expected a director whose reconcile failed not to count as running")
+	}
+	server.Reconciled(nil)
+	if !d.running(ctx) || d.unhealthy {
+		t.Fatalf("expected a director reconciling again to count as running. %+v", d)
+	}
+
+	// a director that predates the status only has to answer
+	old, port := testListener(heartbeat.Beat{Identity: "node", ConfigKey: "key", Version: "2.6.0", Capabilities: []string{heartbeat.CapabilityConfigHash, heartbeat.CapabilityFence, heartbeat.CapabilityPush}})
+	defer old()
+	legacy, err := newDirectorFollower(port, nil, "node", "key", func() string { return "" }, time.Nanosecond, cm, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if !legacy.running(ctx) {
+		t.Fatal("expected a director without the status to count as running")
+	}
+}
+
+// testPolicy probes once a second, taking over after maxTries failures and
+// handing back on the first success.
+func testPolicy(maxTries int) *failoverPolicy {
+	return newFailoverPolicy(config.FailoverConfig{Interval: time.Second, FailureThreshold: maxTries, RecoveryThreshold: 1})
+}
+
+var (
+	coordinationOnce sync.Once
+	coordination     *coordinationMetrics
+)
+
+// testCoordinationMetrics returns the coordination metrics shared by the
+// tests, as they can only be registered once.
+func testCoordinationMetrics() *coordinationMetrics {
+	coordinationOnce.Do(func() { coordination = NewCoordinationMetrics("lbname") })
+	return coordination
+}
+
+// testListener answers heartbeats with beat until stopped.
+func testListener(beat heartbeat.Beat) (func(), int) {
 	addr := fmt.Sprintf("localhost:%d", 0)
 	logger.Debugf("listening forever on %s", addr)
 
@@ -112,16 +274,8 @@ func testListener() (net.Listener, int) {
 	if err != nil {
 		os.Exit(1)
 	}
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				continue
-			}
-			<-time.After(50 * time.Millisecond)
-			conn.Close()
-		}
-	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	go heartbeat.Serve(ctx, ln, nil, func() heartbeat.Beat { return beat }, logging.New())
 	i, _ := strconv.Atoi(strings.Split(ln.Addr().String(), ":")[1])
-	return ln, i
+	return cancel, i
 }
@@ -2,23 +2,28 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 
-	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	"github.com/Comcast/Ravel/pkg/director"
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/heartbeat"
 	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/observe"
+	"github.com/Comcast/Ravel/pkg/profiling"
+	"github.com/Comcast/Ravel/pkg/role"
 	"github.com/Comcast/Ravel/pkg/stats"
 	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
 	"github.com/Comcast/Ravel/pkg/util"
 	"github.com/Comcast/Ravel/pkg/watcher"
 )
 
 // IPVSMASTER runs the ipvs IPVSMASTER - also called ipvs-master
-func IPVSMASTER(ctx context.Context, logger logrus.FieldLogger) *cobra.Command {
+func IPVSMASTER(ctx context.Context, logger logging.Logger) *cobra.Command {
 
 	var cmd = &cobra.Command{
 		Use:           "director",
@@ -36,15 +41,37 @@ are missing from the configuration.`,
 		RunE: func(cmd *cobra.Command, _ []string) error {
 
 			log.Debugln("IPVSMASTER: Starting in DIRECTOR mode")
+			logger := logger.WithField(logging.FieldRole, role.Director)
 
 			config := NewConfig(cmd.Flags())
-			logger.Debugf("IPVSMASTER: got config %+v", config)
-			b, _ := json.MarshalIndent(config, " ", " ")
-			fmt.Println(string(b))
+			logger.Infof("IPVSMASTER: got config %s", config)
 
 			// validate flags
 			logger.Info("IPVSMASTER: validating")
-			if err := config.Invalid(); err != nil {
+			if err := config.Validate(role.Director); err != nil {
+				return withExitCode(exitInvalid, err)
+			}
+
+			// record changes made to the node from here on
+			if err := initAudit(config, logger); err != nil {
+				return err
+			}
+
+			// leave the node as it is, if observe-only or a dry run
+			if config.ObserveOnly || config.DryRun {
+				logger.Warn("IPVSMASTER: observe-only or dry-run. changes to the node are recorded, not made")
+				observe.Enable(stats.KindIpvsMaster, config.ConfigKey)
+			}
+
+			// refuse to run beside another ravel of this mode and config key
+			release, err := lockInstance(ctx, config, stats.KindIpvsMaster, logger)
+			if err != nil {
+				return err
+			}
+			defer release()
+
+			// check the environment before taking traffic
+			if err := selfTest(ctx, config, stats.KindIpvsMaster, logger); err != nil {
 				return err
 			}
 
@@ -60,6 +87,7 @@ are missing from the configuration.`,
 			if err != nil {
 				return err
 			}
+			watcher.SetStrict(config.StrictConfig)
 
 			// initialize statistics
 			s, err := stats.NewStats(ctx, stats.KindIpvsMaster, config.Stats.Interface, config.Stats.ListenAddr, config.Stats.ListenPort, config.Stats.Interval, logger)
@@ -67,23 +95,68 @@ are missing from the configuration.`,
 				return fmt.Errorf("failed to initialize metrics. %v", err)
 			}
 			if config.Stats.Enabled {
+				if err := startFlowExport(ctx, config, s, logger); err != nil {
+					return fmt.Errorf("failed to initialize flow export. %v", err)
+				}
+				s.EnableTopTalkers(config.Stats.TopTalkers)
 				if err := s.EnableBPFStats(); err != nil {
-					return fmt.Errorf("failed to initialize BPF capture. if=%v sa=%s %v", config.Stats.Interface, config.Stats.ListenAddr, err)
+					return fmt.Errorf("failed to initialize eBPF counters. if=%v sa=%s %v", config.Stats.Interface, config.Stats.ListenAddr, err)
 				}
+				s.FollowConfig(func() *types.ClusterConfig { return watcher.ClusterConfig })
 			}
 			// emit the version metric
 			emitVersionMetric(stats.KindIpvsMaster, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey)
 
-			// Starting up control port.
-			logger.Infof("IPVSMASTER: starting listen controllers on %v", config.Coordinator.Ports)
-			cm := NewCoordinationMetrics(stats.KindIpvsMaster)
-			for _, port := range config.Coordinator.Ports {
-				go listenController(port, cm, logger)
+			// export the capacity of the conntrack and ipvs tables
+			if err := registerCapacity(config, stats.KindIpvsMaster, logger); err != nil {
+				return err
+			}
+
+			// push the metrics to a remote-write endpoint, if enabled
+			if err := startRemoteWrite(config, s, logger); err != nil {
+				return err
+			}
+
+			// export reconfigure traces, if enabled
+			stopTracing, err := startTracing(ctx, config, stats.KindIpvsMaster, logger)
+			if err != nil {
+				return err
+			}
+			defer stopTracing()
+
+			// serve the admin endpoint, if enabled
+			adminServer, err := startAdmin(ctx, config, s, watcher, logger)
+			if err != nil {
+				return err
+			}
+
+			// reload some settings without a restart
+			reload := newReloader(config, cmd.Flags(), logger)
+			reload.Handle(reloadStats(s))
+			if adminServer != nil {
+				adminServer.Handle("/reload", reload.handler())
+			}
+
+			// serve pprof and runtime metrics on localhost, if enabled. the
+			// port may be taken by another process on the node, which
+			// profiling isn't worth failing the mode over
+			if config.PprofPort != 0 {
+				if err := profiling.Serve(ctx, fmt.Sprintf("127.0.0.1:%d", config.PprofPort), logger); err != nil {
+					logger.Errorf("%v. continuing without profiling", err)
+				}
 			}
 
 			// listen for health
 			logger.Info("IPVSMASTER: starting health endpoint")
-			go util.ListenForHealth(config.Net.Interface, 10201, logger)
+			checks := health.NewRegistry()
+			checks.Register("watcher", watcher.Health)
+			go util.ListenForHealth(config.Net.Interface, 10201, checks, logger)
+			if adminServer != nil {
+				adminServer.Handle("/status", statusHandler(config, stats.KindIpvsMaster, watcher, checks))
+			}
+			if err := startStatusSocket(ctx, config, stats.KindIpvsMaster, watcher, checks, logger); err != nil {
+				return err
+			}
 
 			// instantiate a new IPVS manager
 			logger.Info("IPVSMASTER: initializing ipvs helper")
@@ -91,6 +164,21 @@ are missing from the configuration.`,
 			if err != nil {
 				return err
 			}
+			if err := ipvs.Own(config.Ownership()); err != nil {
+				return err
+			}
+
+			// probe the VIPs, if enabled
+			if err := startProbe(ctx, config, stats.KindIpvsMaster, watcher, logger); err != nil {
+				return err
+			}
+			// override settings at runtime through the admin endpoint
+			live := startLive(ctx, config, stats.KindIpvsMaster, true, watcher, adminServer, logger)
+
+			// register with snmpd, if enabled
+			if err := startSNMP(ctx, config, stats.KindIpvsMaster, watcher, s, ipvs, nil, logger); err != nil {
+				return err
+			}
 
 			// instantiate an IP helper for loopback and set the arp rules
 			// the loopback helper only runs once, at startup
@@ -99,6 +187,7 @@ are missing from the configuration.`,
 			if err != nil {
 				return err
 			}
+			ipLoopback.Own(config.Ownership())
 			if err := ipLoopback.SetARP(); err != nil {
 				return err
 			}
@@ -109,6 +198,7 @@ are missing from the configuration.`,
 			if err != nil {
 				return err
 			}
+			ip.Own(config.Ownership())
 
 			// instantiate an iptables interface
 			logger.Info("IPVSMASTER: initializing iptables")
@@ -116,27 +206,102 @@ are missing from the configuration.`,
 			if err != nil {
 				return err
 			}
+			reload.Handle(reloadMasq(ipt))
+
+			// float the VIPs between directors over vrrp, if enabled
+			claim, err := startFence(config, stats.KindIpvsMaster, watcher, checks, logger)
+			if err != nil {
+				return err
+			}
+			router, err := startVRRP(ctx, config, stats.KindIpvsMaster, watcher, claim, checks, logger)
+			if err != nil {
+				return err
+			}
+			if err := startIPVSSync(ctx, config, stats.KindIpvsMaster, router, logger); err != nil {
+				return err
+			}
+
+			// Starting up control port.
+			logger.Infof("IPVSMASTER: starting listen controllers on %v", config.Coordinator.Ports)
+			cm := NewCoordinationMetrics(stats.KindIpvsMaster)
+			coordinatorTLS, err := config.Coordinator.ServerTLS()
+			if err != nil {
+				return err
+			}
+			// an observer doesn't answer, so that the realserver on the node
+			// keeps following the production director
+			coordinator := newCoordinator(directorBeat(config, watcher, claim), cm, logger)
+			if !config.ObserveOnly && !config.DryRun {
+				listeners := newCoordinatorListeners(ctx, coordinatorTLS, coordinator, cm, logger)
+				if err := listeners.set(config.Coordinator.Ports); err != nil {
+					return err
+				}
+				// follow the ports in the config file
+				reload.Handle(reloadPorts(listeners.set))
+			}
+
+			// feed the cluster config and nodes to realservers, if enabled
+			if err := startConfigFeed(ctx, config, stats.KindIpvsMaster, watcher, logger); err != nil {
+				return err
+			}
 
 			// instantiate the director worker.
 			logger.Info("IPVSMASTER: initializing director")
-			worker, err := director.NewDirector(ctx, config.NodeName, config.ConfigKey, config.CleanupMaster, watcher, ipvs, ip, ipt, config.IPVS.ColocationMode, config.ForcedReconfigure)
+			worker, err := director.NewDirector(ctx, config.NodeName, config.ConfigKey, config.OnExit, watcher, ipvs, ip, ipt, config.IPVS.ColocationMode, config.ForcedReconfigure, router, nil)
 			if err != nil {
 				return err
 			}
+			// push each config applied to the realserver of the node
+			worker.OnApplied(func(generation uint64, configHash string) {
+				coordinator.Publish(heartbeat.Applied{ConfigHash: configHash, Generation: generation})
+			})
+			// and report the outcome of each reconcile in the heartbeat
+			worker.OnReconciled(coordinator.Reconciled)
+			setInterval := worker.SetForcedReconfigureInterval
+			if live != nil {
+				setInterval = live.ReconfigureInterval(setInterval)
+			}
+			setInterval(config.ForcedReconfigureInterval)
+			reload.Handle(reloadForcedInterval(setInterval))
 
 			// start the director
+			checks.Register("director", worker.Health)
+			if adminServer != nil {
+				controlHandlers(adminServer, watcher, ipvs, worker)
+				exportHandler(adminServer, watcher, exportSources{ipvs: ipvs, ipt: ipt, ip: ipLoopback})
+			}
+			// step down while the node is in maintenance
+			startMaintenance(ctx, config, stats.KindIpvsMaster, watcher, checks, logger, worker.Maintenance)
+
+			// supervise the worker loops, if enabled
+			dog, err := startWatchdog(ctx, config, stats.KindIpvsMaster, logger)
+			if err != nil {
+				return err
+			}
+
 			logger.Info("IPVSMASTER: starting worker")
 			err = worker.Start()
 			if err != nil {
 				return err
 			}
+			reload.start(ctx, config.ReloadInterval)
 			logger.Info("IPVSMASTER: started")
 			for { // ever
 				select {
 				case <-ctx.Done():
-					// catching exit signals sent from the parent context
-					// Removed in VPES-1410. When director exits, we shouldn't clean nup!
-					// return worker.Stop()
+					// catching exit signals sent from the parent context.
+					// what the director leaves behind is up to on-exit
+					shutdown, cancel := context.WithTimeout(context.Background(), config.ShutdownGracePeriod)
+					defer cancel()
+					err := worker.Shutdown(shutdown)
+					// a vrrp director hands the VIPs to a backup as well
+					if router != nil {
+						releaseVIPs(config, logger)
+						router.Withdrawn(context.Background())
+					}
+					return err
+				case err := <-dog.Stalled():
+					return err
 				}
 			}
 		},
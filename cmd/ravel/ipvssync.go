@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/ipvssync"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/vrrp"
+)
+
+// startIPVSSync replicates ipvs connections from the vrrp master to the
+// backups when --ipvs-sync is set, switching the sync daemon over whenever
+// the director's vrrp role changes.
+func startIPVSSync(ctx context.Context, config *config.Config, kind stats.LBKind, router *vrrp.Router, logger logging.Logger) error {
+	if !config.VRRP.IPVSSync || router == nil {
+		return nil
+	}
+	d, err := ipvssync.New(ctx, kind, config.Net.Interface, config.VRRP.ID, logger)
+	if err != nil {
+		return err
+	}
+	if err := prometheus.Register(d); err != nil {
+		return err
+	}
+	roles := router.Changes()
+	go func() {
+		for {
+			select {
+			case master := <-roles:
+				if err := d.SetRole(master); err != nil {
+					logger.Error(err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
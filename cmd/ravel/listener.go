@@ -1,42 +1,122 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/fence"
+	"github.com/Comcast/Ravel/pkg/heartbeat"
+	"github.com/Comcast/Ravel/pkg/logging"
 )
 
-// listenController is used by the realserver in order to determine whether it is colocated with a director.
-// The kube director will listen on this port on localhost, cleaning up connections when it's done.
-// This function will run until the program exits. it would be better served by a unix sock
-func listenController(port int, cm *coordinationMetrics, logger logrus.FieldLogger) {
-	addr := fmt.Sprintf("localhost:%d", port)
-	logger.Debugf("listening forever on %s", addr)
-
-	cm.Running(true)
-
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		// NOTE: If another program is listening on this port, this will result in a sort of infinite loop behavior as
-		// the director process dies and comes back to life.
-		//
-		// Hard error. If the director can't listen on this port, it may indicate that another director is already running.
-		// The behavior of the program is unspecified in this case, as the backend uses this port in order to determine
-		// whether to operate normally, or to suspend operations whil colocated with a director. We exit.
-		logger.Error(err)
-		os.Exit(1)
+// coordinatorListeners are used by the realserver in order to determine whether it is colocated with a director.
+// The kube director answers heartbeats on each coordinator port on localhost, with its identity and the config it
+// serves, and pushes the configs it applies to the realserver watching it. The ports can change while it runs.
+type coordinatorListeners struct {
+	ctx       context.Context
+	tlsConfig *tls.Config
+	server    *heartbeat.Server
+	cm        *coordinationMetrics
+	logger    logging.Logger
+
+	sync.Mutex
+	// ports holds the cancel of the listener on each port
+	ports map[int]context.CancelFunc
+}
+
+func newCoordinatorListeners(ctx context.Context, tlsConfig *tls.Config, server *heartbeat.Server, cm *coordinationMetrics, logger logging.Logger) *coordinatorListeners {
+	return &coordinatorListeners{ctx: ctx, tlsConfig: tlsConfig, server: server, cm: cm, logger: logger, ports: map[int]context.CancelFunc{}}
+}
+
+// set answers heartbeats on ports, until ctx is done, and stops answering on
+// any other. It returns an error for each port it couldn't listen on, and
+// keeps listening on the rest.
+func (l *coordinatorListeners) set(ports []int) error {
+	l.Lock()
+	defer l.Unlock()
+
+	wanted := map[int]bool{}
+	for _, port := range ports {
+		wanted[port] = true
+	}
+	for port, cancel := range l.ports {
+		if !wanted[port] {
+			l.logger.Infof("stopped answering heartbeats on localhost:%d", port)
+			cancel()
+			delete(l.ports, port)
+		}
 	}
-	for {
-		conn, err := ln.Accept()
+
+	errs := []string{}
+	for _, port := range ports {
+		if _, ok := l.ports[port]; ok {
+			continue
+		}
+		addr := fmt.Sprintf("localhost:%d", port)
+		ln, err := net.Listen("tcp", addr)
 		if err != nil {
-			cm.Check(false)
+			// NOTE: If the director can't listen on this port, it may indicate that another director is already
+			// running. The backend uses this port in order to determine whether to operate normally, or to suspend
+			// operations while colocated with a director, so this is a hard error at startup.
+			errs = append(errs, err.Error())
 			continue
 		}
-		<-time.After(50 * time.Millisecond)
+		l.logger.Debugf("listening forever on %s", addr)
+		ctx, cancel := context.WithCancel(l.ctx)
+		l.ports[port] = cancel
+		go func() {
+			err := l.server.Serve(ctx, ln, l.tlsConfig)
+			if err != nil && ctx.Err() == nil {
+				l.logger.Errorf("stopped answering heartbeats on %s. %v", addr, err)
+				os.Exit(1)
+			}
+		}()
+	}
+	l.cm.Running(len(l.ports) > 0)
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to answer heartbeats: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// newCoordinator returns the heartbeat server of a director, shared by each of
+// its coordinator ports. It follows the version of the realserver calling it.
+func newCoordinator(beat func() heartbeat.Beat, cm *coordinationMetrics, logger logging.Logger) *heartbeat.Server {
+	realserver := newPeerVersion("realserver", cm, logger)
+	return heartbeat.NewServer(func(hello heartbeat.Hello) heartbeat.Beat {
 		cm.Check(true)
-		conn.Close()
+		realserver.observe(hello.Version, hello.Capabilities)
+		return beat()
+	}, logger)
+}
+
+// directorBeat returns the heartbeat of a director of the config key, which
+// reports the config its watcher last published, and the generation of its
+// claim on the VIPs when it is fenced.
+func directorBeat(config *config.Config, w interface {
+	ConfigHash() string
+	Published() (uint64, time.Time)
+}, f *fence.Fence) func() heartbeat.Beat {
+	return func() heartbeat.Beat {
+		generation, _ := w.Published()
+		beat := heartbeat.Beat{
+			Identity:     config.NodeName,
+			ConfigKey:    config.ConfigKey,
+			ConfigHash:   w.ConfigHash(),
+			Generation:   generation,
+			Version:      version,
+			Capabilities: heartbeat.Capabilities,
+		}
+		if f != nil {
+			beat.Fence = uint64(f.Generation())
+		}
+		return beat
 	}
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+
+	"github.com/Comcast/Ravel/pkg/admin"
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/liveconfig"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// startLive serves the runtime overrides on /runtime of the admin endpoint,
+// and returns nil when it isn't enabled. services is whether the mode sets
+// ipvs weights, which the overrides of services change. The overrides are
+// staged last, over the config the canary staged.
+func startLive(ctx context.Context, config *config.Config, kind stats.LBKind, services bool, w *watcher.Watcher, adminServer *admin.Server, logger logging.Logger) *liveconfig.Store {
+	if adminServer == nil {
+		return nil
+	}
+	live := liveconfig.New(kind, config.ConfigKey, liveconfig.Options{
+		Services:  services,
+		Republish: w.Republish,
+		Levels:    logLevels,
+	}, logger)
+	if services {
+		w.Stage(live.Stage)
+		// stage the config already built, for the services in it to be
+		// overridden before it next changes
+		go w.Republish()
+	}
+	adminServer.Handle("/runtime", live)
+	go live.Run(ctx.Done())
+	return live
+}
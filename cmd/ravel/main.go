@@ -11,17 +11,36 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	// _ "net/http/pprof" // only needed in performance debugging
+
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/fence"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/membership"
+	"github.com/Comcast/Ravel/pkg/privsep"
+	"github.com/Comcast/Ravel/pkg/role"
+	"github.com/Comcast/Ravel/pkg/snmp"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/watchdog"
 )
 
 var (
 	flagDebug   = false // we cant use the debug flag if we are debugging the flags package now can we?
 	flagCfgFile string
 
+	// logger is the logger of the logrus backend. the other backends write
+	// to its output.
 	logger *logrus.Logger
-	log    logrus.FieldLogger
+	log    logging.Logger
 
 	logLevel logrus.Level = logrus.InfoLevel
+
+	// logLevels controls the level of every logger at runtime. it is set up
+	// once flags have been parsed.
+	logLevels *logging.Levels
+
+	// logSinks are the syslog and journald copies of the logs, flushed
+	// before exiting.
+	logSinks []logging.Sink
 )
 
 var ErrSignalCaught error = fmt.Errorf("caught signal. exiting.")
@@ -34,13 +53,16 @@ var allOfTheSignals = []os.Signal{
 	os.Signal(syscall.SIGQUIT),
 	os.Signal(syscall.SIGSTOP),
 	os.Signal(syscall.SIGTERM),
-	os.Signal(syscall.SIGUSR1),
 	os.Signal(syscall.SIGCONT),
 }
 
 func initConfig() error {
+	layerEnv(viper.GetViper())
+	if flagCfgFile == "" {
+		flagCfgFile = os.Getenv(envName("config"))
+	}
 	if flagCfgFile != "" {
-		viper.SetConfigType("yaml")
+		viper.SetConfigType(configType(flagCfgFile))
 		viper.SetConfigFile(flagCfgFile)
 		return viper.ReadInConfig()
 	}
@@ -59,25 +81,59 @@ func init() {
 	// logger.SetLevel(logrus.DebugLevel)
 	logger.Debugln("Debug logging enabled!")
 
-	log = logger.WithFields(logrus.Fields{"s": "rdei-lb"})
+	// log follows the backend chosen by --log-backend once flags are parsed
+	logging.SetBackend(logging.FromLogrus(logger))
+	log = logging.Default().WithFields(logging.Fields{"s": "rdei-lb"})
 
 	cobra.OnInitialize(func() {
-		if flagDebug {
-			logger.SetLevel(logrus.DebugLevel)
-			logger.Debugln("Debug logging enabled!")
-		}
+		// both are settings that are invalid, or a config file that can't
+		// be read
 		if err := initConfig(); err != nil {
 			log.Error(err)
-			os.Exit(1)
+			os.Exit(exitInvalid)
+		}
+		if err := initLogging(); err != nil {
+			log.Error(err)
+			os.Exit(exitInvalid)
 		}
+		if socket := viper.GetString("privileged-helper"); socket != "" {
+			if err := privsep.Use(socket); err != nil {
+				log.Error(err)
+				os.Exit(exitInvalid)
+			}
+		}
+		log.Debugln("Debug logging enabled!")
 	})
 
-	rootCmd.PersistentFlags().StringVar(&flagCfgFile, "config", "", "config file")
-	rootCmd.PersistentFlags().BoolVar(&flagDebug, "debug", false, "enable debug logging")
+	rootCmd.PersistentFlags().StringVar(&flagCfgFile, "config", "", "config file of settings by flag name, in yaml, toml or json by its extension. the RAVEL_ environment variable of a setting overrides it, and a flag overrides both. RAVEL_CONFIG if unset.")
+	rootCmd.PersistentFlags().Duration("config-reload-interval", 10*time.Second, "how often the config file is checked for changes to the settings that apply without a restart, such as the coordinator ports and log level. they are also reloaded on SIGHUP. 0 only reads it at start.")
+	rootCmd.PersistentFlags().BoolVar(&flagDebug, "debug", false, "enable debug logging. shorthand for --log-level=debug")
+	rootCmd.PersistentFlags().String("log-level", "info", "log level, optionally per package, e.g. info,bgp=debug,watcher=trace. can be changed at runtime through the admin endpoint, or toggled to debug with SIGUSR1 and reset with SIGUSR2")
+	rootCmd.PersistentFlags().String("log-format", "text", "log output format. text|json")
+	rootCmd.PersistentFlags().String("log-backend", "logrus", "library the logs are written with. logrus|slog|zap. slog and zap allocate less per entry, for busy directors. slog needs ravel built with go 1.21 or later, as the images are.")
+	rootCmd.PersistentFlags().String("log-syslog", "", "also send logs to syslog, formatted per rfc5424. local for "+logging.DefaultSyslogSocket+", or unix:<path>, tcp:<host>:<port> or tls:<host>:<port>. disabled if unset.")
+	rootCmd.PersistentFlags().String("log-syslog-facility", "daemon", "syslog facility for log-syslog")
+	rootCmd.PersistentFlags().String("log-syslog-ca", "", "ca bundle used to verify a tls syslog server. the system roots are used if unset.")
+	rootCmd.PersistentFlags().String("log-syslog-sd-id", logging.DefaultSDID, "rfc5424 structured data id carrying the node name and config key. the default uses the example enterprise number; set your own if you have one.")
+	rootCmd.PersistentFlags().Bool("log-journald", false, "also send logs to the systemd journal")
+	rootCmd.PersistentFlags().String("admin-listen", "", "host:port for the authenticated admin endpoint. disabled if unset.")
+	rootCmd.PersistentFlags().Int("pprof-port", 0, "localhost port serving net/http/pprof and go runtime metrics, e.g. 10236. disabled if 0. a port that can't be listened on is logged, and the mode runs without it.")
+	rootCmd.PersistentFlags().Bool("self-test", true, "check kernel modules, sysctls, binaries and api access at startup, and refuse to start if a required check fails. see `ravel doctor`.")
+	rootCmd.PersistentFlags().String("admin-token-file", "", "file containing the bearer token required by the admin endpoint")
+	rootCmd.PersistentFlags().String("admin-access-file", "", "yaml file granting scopes of the admin endpoint (read, drain, announce, operate) to more tokens, by their sha256, and to client certificates, by their common name. the admin-token-file token has every scope.")
+	rootCmd.PersistentFlags().String("admin-cert", "", "certificate the admin endpoint serves tls with. with admin-ca, clients may authenticate with a certificate instead of the token, and the admin commands present this one.")
+	rootCmd.PersistentFlags().String("admin-key", "", "key of admin-cert")
+	rootCmd.PersistentFlags().String("admin-ca", "", "ca bundle that admin clients' certificates are verified against, and that the admin commands verify the endpoint's against. without admin-token-file, every client must present a certificate.")
+	rootCmd.PersistentFlags().String("admin-server-name", "ravel-admin", "name the admin commands expect the admin endpoint's certificate to be for")
+	rootCmd.PersistentFlags().String("status-socket", "", "unix socket to also serve /health, /healthz, /readyz, /statusz and /status on, for sidecars on the node and `ravel status`, without a token. only the user and group of ravel may use it. disabled if unset.")
+	rootCmd.PersistentFlags().Int("audit-size", audit.DefaultSize, "number of changes to the node kept in the audit trail served at /audit on the admin endpoint")
+	rootCmd.PersistentFlags().String("audit-file", "", "also append audit events to this file as json lines")
+	rootCmd.PersistentFlags().Bool("audit-journald", false, "also send audit events to the systemd journal")
 
 	rootCmd.PersistentFlags().String("config-key", "", "The identity of the configuration key that contains the configuration for this kube2ipvs instance in Kubernetes.")
 	rootCmd.PersistentFlags().String("config-namespace", "", "The namespace containing the configmap")
 	rootCmd.PersistentFlags().String("config-name", "", "The name of the configmap")
+	rootCmd.PersistentFlags().Bool("strict-config", true, "reject a cluster config that `ravel validate` finds problems in, logging each and keeping the last valid config in effect. false applies it as it parses, working around its problems.")
 	rootCmd.PersistentFlags().String("compute-iface", "", "The name of the desired inbound configKey interface for the director.")
 	rootCmd.PersistentFlags().String("compute-iface-local", "lo", "The name of the local interface to use. Defaults to lo. Can also be dummy0")
 	rootCmd.PersistentFlags().String("gateway", "", "primary inteface gateway")
@@ -85,14 +141,29 @@ func init() {
 	rootCmd.PersistentFlags().String("kubeconfig", "", "the path to the kubeconfig file containing a crt and key.")
 	rootCmd.PersistentFlags().String("primary-ip", "", "The primary IP of the server this is running on.")
 
-	rootCmd.PersistentFlags().Bool("cleanup-master", false, "Cleanup IPVS master on shutdown")
+	rootCmd.PersistentFlags().Bool("cleanup-master", false, "Cleanup IPVS master on shutdown. the same as --on-exit=full-teardown")
+	rootCmd.PersistentFlags().String("on-exit", "", "what a director leaves on the node when it stops: preserve leaves it serving, withdraw withdraws the bgp routes and removes the VIP addresses, and full-teardown also flushes ipvs and the director's iptables chain. preserve by default, or full-teardown with --cleanup-master.")
+	rootCmd.PersistentFlags().Duration("shutdown-grace-period", 30*time.Second, "how long a mode has to shut down on exit: to finish the reconfigure in progress, drain a realserver for as much of --drain-window as fits, and withdraw and tear down per --on-exit in the last 5s. the process exits once it is over.")
 	rootCmd.PersistentFlags().String("pod-cidr-masq", "", "Pod CIDR used to exclude pod network from RDEI-MASQ rules")
 	rootCmd.PersistentFlags().Bool("forced-reconfigure", false, "Reconfigure happens every 10 minutes")
+	rootCmd.PersistentFlags().Duration("forced-reconfigure-interval", time.Minute, "how often a director applies its config without checking parity. reloaded on SIGHUP.")
+	rootCmd.PersistentFlags().Bool("observe-only", false, "run the director without changing the node. every change it would make to addresses, ipvs, iptables or bgp is logged, counted and recorded in the audit trail instead, so a candidate version can run beside production and be compared with it.")
+	rootCmd.PersistentFlags().Bool("dry-run", false, "run any mode but auto without changing the node, to rehearse a config change on it. every change to addresses, ipvs, iptables, haproxy or bgp is logged, counted and recorded in the audit trail instead, as with observe-only.")
+	rootCmd.PersistentFlags().String("privileged-helper", "", "unix socket of a `ravel helper` to make the changes to the node through, so that ravel can run without root. unset to make them itself.")
 	rootCmd.PersistentFlags().Bool("ipvs-weight-override", false, "set all IPVS wrr weights to 1 regardless")
 	rootCmd.PersistentFlags().Bool("ipvs-ignore-node-cordon", true, "ignore cordoned flag when determining whether a node is an eligible backend")
 
 	rootCmd.PersistentFlags().String("iptables-chain", "RAVEL", "The name of the iptables chain to use.")
+	rootCmd.PersistentFlags().Bool("shared-node", false, "another ravel instance, of a different config-key, runs on this node. each instance then only reconciles and removes the VIP devices, ipvs services and iptables chains tagged with its own config-key, and each needs its own iptables-chain.")
+	rootCmd.PersistentFlags().String("state-dir", "/var/lib/ravel", "directory where a director on a shared node records the ipvs services of its config-key, which ipvs can't tag, and a bgp director its bgp overrides. should outlive the container.")
 	rootCmd.PersistentFlags().Int("failover-timeout", 1, "number of seconds for the realserver to wait before reconfiguring itself")
+	rootCmd.PersistentFlags().Duration("failover-probe-interval", time.Second, "how often the realserver probes the heartbeat of the director on its node")
+	rootCmd.PersistentFlags().Int("failover-failure-threshold", 0, "number of failed probes in a row before the realserver takes over from the director. 0 uses failover-timeout.")
+	rootCmd.PersistentFlags().Int("failover-recovery-threshold", 1, "number of successful probes in a row before the realserver hands the node back to a returning director")
+	rootCmd.PersistentFlags().Float64("failover-jitter", 0, "fraction, below 1, by which each probe interval and hold off is randomly spread either way, so that realservers don't act in lockstep")
+	rootCmd.PersistentFlags().Duration("failover-backoff-max", 0, "when the director comes back within this long of the realserver taking over, hold the next takeover off, doubling each time up to this long. 0 never holds off.")
+	rootCmd.PersistentFlags().Duration("drain-window", 0, "how long the realserver keeps its rules once the director returns, sending new connections to the director while existing ones to local pods finish. 0 tears the rules down at once.")
+	rootCmd.PersistentFlags().Duration("warm-standby-interval", 0, "how often the realserver pre-builds its iptables rules and haproxy listeners while a director is active, so a takeover only applies them. 0 builds them on takeover.")
 
 	rootCmd.PersistentFlags().Int("lo-announce", 0, "arp_announce setting for loopback interface")
 	rootCmd.PersistentFlags().Int("lo-ignore", 0, "arp_ignore setting for loopback interface")
@@ -103,13 +174,79 @@ func init() {
 	rootCmd.PersistentFlags().String("calico-dir", "/etc/calico/ravel", "Directory on disk where calico IPPool configurations are written")
 	rootCmd.PersistentFlags().String("calico-bin", "/usr/local/bin/calicoctl", "path to calico binary")
 	rootCmd.PersistentFlags().String("bgp-bin", "/bin/gobgp", "path to gobgp binary")
-	rootCmd.PersistentFlags().Bool("stats-enabled", false, "toggle to enable statistics collection. statistics will be collected from the specified interface device using libpcap. may have a performance implication.")
-	rootCmd.PersistentFlags().String("stats-interface", "", "specify the network interface to pcap for stats.")
+	rootCmd.PersistentFlags().Bool("stats-enabled", false, "toggle to enable statistics collection. per-VIP traffic is counted by eBPF programs attached with tc to the specified interface device. requires bpffs mounted at /sys/fs/bpf.")
+	rootCmd.PersistentFlags().String("stats-interface", "", "specify the network interface to attach the eBPF counters to for stats.")
 	rootCmd.PersistentFlags().String("stats-listen", "0.0.0.0", "listen address for prometheus endpoint")
 	rootCmd.PersistentFlags().String("stats-port", "10234", "listen port for prometheus endpoint")
 	rootCmd.PersistentFlags().Duration("stats-interval", 1*time.Second, "sampling interval")
+	rootCmd.PersistentFlags().Int("stats-top-talkers", stats.DefaultTalkers, "number of source addresses counted across all VIPs for the /talkers admin endpoint. the least recently seen are evicted first. 0 disables it.")
+	rootCmd.PersistentFlags().String("flow-export", "", "export sampled VIP traffic to a collector. one of ipfix|sflow. requires stats-enabled.")
+	rootCmd.PersistentFlags().String("flow-collector", "", "host:port of the IPFIX or sFlow collector, over UDP")
+	rootCmd.PersistentFlags().Uint32("flow-sample-rate", 1000, "sample one in this many VIP packets for flow export")
+	rootCmd.PersistentFlags().Duration("flow-export-interval", 10*time.Second, "how often flow records are sent to the collector")
+
+	rootCmd.PersistentFlags().String("remote-write-url", "", "url of a prometheus remote-write endpoint to push metrics to, for hosts that can't be scraped. disabled if unset.")
+	rootCmd.PersistentFlags().Duration("remote-write-interval", stats.DefaultRemoteWriteInterval, "how often metrics are pushed to the remote-write endpoint")
+	rootCmd.PersistentFlags().Int("remote-write-batch-size", stats.DefaultRemoteWriteBatchSize, "most samples sent in one remote-write request")
+	rootCmd.PersistentFlags().Duration("remote-write-timeout", 10*time.Second, "timeout for a single remote-write request")
+	rootCmd.PersistentFlags().Int("remote-write-retries", stats.DefaultRemoteWriteRetries, "times a remote-write request is retried after a network error, a 5xx or a 429")
+	rootCmd.PersistentFlags().String("remote-write-username", "", "basic auth username for the remote-write endpoint")
+	rootCmd.PersistentFlags().String("remote-write-password-file", "", "file holding the basic auth password for the remote-write endpoint")
+	rootCmd.PersistentFlags().String("remote-write-bearer-token-file", "", "file holding a bearer token for the remote-write endpoint. can't be combined with basic auth.")
+	rootCmd.PersistentFlags().StringToString("remote-write-label", map[string]string{}, "label added to every pushed series, as name=value. can be passed multiple times. instance defaults to the node name.")
+
+	rootCmd.PersistentFlags().String("snmp-agentx", "", "address of the snmpd agentx master to expose VIP traffic, backend counts and bgp session state to, as unix:<path> or tcp:<host>:<port>. net-snmp listens on "+snmp.DefaultMaster+" by default. disabled if unset.")
+	rootCmd.PersistentFlags().String("snmp-oid", "", "oid to register the snmp subtree under, e.g. a branch of your organization's enterprise oid. required with snmp-agentx.")
+	rootCmd.PersistentFlags().Duration("snmp-cache-ttl", 5*time.Second, "how long a snapshot of the load balancer is served to snmp requests before a new one is taken")
+
+	rootCmd.PersistentFlags().Duration("probe-interval", 0, "how often the director connects to every VIP and TCP port to check that traffic gets through. 0 disables probing.")
+	rootCmd.PersistentFlags().Duration("probe-timeout", 2*time.Second, "timeout for a single VIP probe")
+	rootCmd.PersistentFlags().String("probe-http-path", "/", "path requested by http probes, which are used for ports named http or prefixed http-")
+	rootCmd.PersistentFlags().StringSlice("canary-vips", []string{}, "VIPs that a director applies each changed cluster config to first. the rest keep the previous config until the probes of these have passed for canary-soak, and the change is rolled back if one fails. requires probe-interval. blank applies changes to every VIP at once.")
+	rootCmd.PersistentFlags().Duration("canary-soak", 5*time.Minute, "how long the probes of the canary-vips must pass before a changed cluster config is applied to every VIP")
+	rootCmd.PersistentFlags().Float64("capacity-conntrack-threshold", 0.9, "fraction of nf_conntrack_max in use at which ravel_kernel_table_healthy for conntrack drops to 0")
+	rootCmd.PersistentFlags().Int("capacity-ipvs-threshold", 0, "number of ipvs connections at which ravel_kernel_table_healthy for ipvs drops to 0. the ipvs table has no limit of its own. 0 leaves the gauge unset.")
+	rootCmd.PersistentFlags().Duration("watchdog-deadline", watchdog.DefaultDeadline, "how long a worker loop may go without completing a cycle before the watchdog logs every goroutine's stack and counts a stall. 0 disables the watchdog.")
+	rootCmd.PersistentFlags().Bool("watchdog-restart", false, "exit when the watchdog finds a stalled worker loop, so that the container is restarted")
+	rootCmd.PersistentFlags().Duration("self-health-interval", 0, "how often the realserver checks the ipvs module, iptables, its primary interface and haproxy, and annotates its node as unhealthy while they fail, so that directors stop sending it traffic. requires permission to patch nodes. 0 disables the checks.")
+	rootCmd.PersistentFlags().Int("self-health-threshold", 3, "number of self-health checks in a row that must fail before the realserver marks its node unhealthy")
+	rootCmd.PersistentFlags().String("haproxy-template", "", "go text/template file that replaces the built-in haproxy configuration of realserver listeners")
+	rootCmd.PersistentFlags().String("haproxy-snippet-dir", "", "directory of snippets added to the listen section of realserver listeners, named <vip>-<port>.cfg or <port>.cfg")
+	rootCmd.PersistentFlags().Bool("haproxy-master-worker", true, "run realserver listeners in haproxy's master-worker mode, so that a reload hands the listening sockets to the new worker. requires haproxy 1.9 or later. not supported with --privileged-helper.")
+	rootCmd.PersistentFlags().Int("haproxy-pools", 0, "host realserver listeners as frontends of this many shared haproxy processes, run in master-worker mode, rather than a process each. 0 runs a process per listener.")
+	rootCmd.PersistentFlags().Bool("haproxy-access-log", false, "log the connections, and the requests of http listeners, of realserver listeners through the ravel logger with vip, port, backend and server fields")
+	rootCmd.PersistentFlags().Int("haproxy-access-log-sample", 1, "log one in every n connections or requests of haproxy-access-log")
+	rootCmd.PersistentFlags().String("v6-proxy", "haproxy", "what proxies realserver listeners of services that don't set v6Proxy: haproxy, or native to proxy them in ravel without the haproxy binary")
+
+	rootCmd.PersistentFlags().String("otlp-endpoint", "", "host:port of an OTLP/HTTP collector to export reconfigure traces to. tracing is disabled if unset.")
+	rootCmd.PersistentFlags().Bool("otlp-insecure", false, "send traces to the otlp endpoint over plain http instead of https")
+	rootCmd.PersistentFlags().Float64("trace-sample-ratio", 1, "fraction of reconfigure traces to sample, between 0 and 1")
 
 	rootCmd.PersistentFlags().StringSlice("coordinator-port", []string{"44444"}, "port for the director and realserver to coordinate traffic on. multiple ports supported. if the realserver sees multiple ports, only the first will be used.")
+	rootCmd.PersistentFlags().String("coordinator-cert", "", "certificate presented on the heartbeat between the director and the realserver of a node. with coordinator-key and coordinator-ca, the heartbeat uses mutual tls.")
+	rootCmd.PersistentFlags().String("coordinator-key", "", "key of coordinator-cert")
+	rootCmd.PersistentFlags().String("coordinator-ca", "", "ca bundle that both ends of the heartbeat verify each other's certificate against")
+	rootCmd.PersistentFlags().String("coordinator-server-name", "ravel-director", "name the realserver expects the director's heartbeat certificate to be for")
+	rootCmd.PersistentFlags().Duration("coordinator-stale-after", 30*time.Second, "how long since the director on the node last finished a reconcile before the realserver takes it for stuck, and its heartbeat as failed. a director that reports its last reconcile failed fails the heartbeat as well. 0 only goes by the outcome.")
+	rootCmd.PersistentFlags().Bool("active-active", false, "run every bgp director of the config key at once, each announcing the VIPs for ECMP upstream and programming its own IPVS. coordination only tracks the directors, through a lease each in config-namespace. use the mh scheduler so that flows keep their backend as directors come and go.")
+	rootCmd.PersistentFlags().Duration("membership-ttl", membership.DefaultTTL, "how long an active-active director's lease lasts without being renewed. leases are renewed three times per ttl.")
+	rootCmd.PersistentFlags().String("config-feed-listen", "", "address, as host:port, where a director feeds its cluster config and nodes to realservers over the coordinator protocol, secured as the heartbeat is. blank serves no feed.")
+	rootCmd.PersistentFlags().StringSlice("config-feed", []string{}, "config-feed-listen addresses of directors that a realserver takes its cluster config and nodes from, instead of watching the configmap and every node itself. tried in turn. blank watches the api.")
+	rootCmd.PersistentFlags().Duration("config-feed-fallback", 30*time.Second, "how long a realserver goes without the config feed before watching the configmap and nodes itself, until the feed returns. 0 waits for the feed however long it takes.")
+	rootCmd.PersistentFlags().Int("shard-replicas", 0, "with active-active, have each VIP announced by this many of the directors instead of all of them, spreading the VIPs over the directors. the shards of the cluster config assign VIPs to directors by node name. the VIPs of a director that leaves move to the others. 0 announces every VIP from every director.")
+	rootCmd.PersistentFlags().Int("vrrp-id", 0, "virtual router id, from 1 to 255, that the directors of the config key float the VIPs between over VRRP on compute-iface. only the vrrp master holds the VIPs. 0 disables vrrp, and every director holds them.")
+	rootCmd.PersistentFlags().Int("vrrp-priority", 100, "vrrp priority of the director, from 1 to 255. the highest priority is master. 255 is for the director that owns the VIPs.")
+	rootCmd.PersistentFlags().String("vrrp-priority-label", "", "node label whose value, from 1 to 255, is the vrrp priority of the director, overriding vrrp-priority. gives each standby a fixed place in line, so the next in line takes over when the master fails.")
+	rootCmd.PersistentFlags().Bool("vrrp-preempt", true, "take over from a vrrp master of lower priority instead of waiting for it to fail")
+	rootCmd.PersistentFlags().Duration("vrrp-preempt-delay", 0, "how long a director waits after starting before it preempts a vrrp master of lower priority. lets a director that comes back settle before it fails back.")
+	rootCmd.PersistentFlags().Duration("vrrp-interval", time.Second, "how often the vrrp master advertises. backups take over after three intervals without one.")
+	rootCmd.PersistentFlags().Duration("vrrp-fence-ttl", fence.DefaultTTL, "how long the vrrp master's claim on the VIPs, a lease in config-namespace, lasts without being renewed. a director only becomes master once it holds the claim, and only gives it up once it has withdrawn the VIPs. 0 disables fencing.")
+	rootCmd.PersistentFlags().String("mode", "", "the role ravel run and auto run on this node: director, bgp, colocated or realserver, overriding the ravel.comcast.com/role label of the node. candidate, or blank, goes by the label, and the election of directors for a node without one.")
+	rootCmd.PersistentFlags().Int("auto-directors", 2, "how many of the candidate nodes ravel auto elects to direct the config key. the others run the realserver.")
+	rootCmd.PersistentFlags().String("auto-director-role", role.Director, "what an elected candidate runs in ravel auto: director, bgp or colocated")
+	rootCmd.PersistentFlags().Duration("auto-slot-ttl", role.DefaultTTL, "how long the director slot of ravel auto, a lease in config-namespace, lasts without being renewed. a candidate takes the slot of a director that has been gone this long.")
+	rootCmd.PersistentFlags().Duration("auto-interval", 30*time.Second, "how often ravel auto checks the role label of its node and, on a candidate that isn't directing, looks for a free director slot")
+	rootCmd.PersistentFlags().Bool("ipvs-sync", false, "replicate ipvs connections from the vrrp master to the backups with the kernel's sync daemon, so that established flows survive a failover. requires vrrp-id, which is also the sync id.")
 	rootCmd.PersistentFlags().StringSlice("bgp-communities", []string{""}, "The community strings to advertise with BGP_DIRECTOR announcements.  Comma separated.")
 
 	rootCmd.PersistentFlags().String("auto-configure-service", "", "configure the load balancer to send traffic to this service for all vips. must be used in conjunction with auto-configure-port")
@@ -119,17 +256,105 @@ Mode "disabled" means IPVS will not account for colocated pods. Any pods running
 Mode "iptables" will result in the worker writing iptables rules to capture inbound traffic to local pods.
 Mode "ipvs" will result in pod ip addresses being added to the ipvs configuraton. iptables and ipvs modes require the conntrack flag be set.`)
 	rootCmd.PersistentFlags().Bool("iptables-masq", true, "determines whether masquerade chain is used in generated iptables rules.")
+	viper.BindPFlag("log-level", rootCmd.PersistentFlags().Lookup("log-level"))
+	viper.BindPFlag("log-format", rootCmd.PersistentFlags().Lookup("log-format"))
+	viper.BindPFlag("log-backend", rootCmd.PersistentFlags().Lookup("log-backend"))
+	viper.BindPFlag("log-syslog", rootCmd.PersistentFlags().Lookup("log-syslog"))
+	viper.BindPFlag("log-syslog-facility", rootCmd.PersistentFlags().Lookup("log-syslog-facility"))
+	viper.BindPFlag("log-syslog-ca", rootCmd.PersistentFlags().Lookup("log-syslog-ca"))
+	viper.BindPFlag("log-syslog-sd-id", rootCmd.PersistentFlags().Lookup("log-syslog-sd-id"))
+	viper.BindPFlag("log-journald", rootCmd.PersistentFlags().Lookup("log-journald"))
+	viper.BindPFlag("admin-listen", rootCmd.PersistentFlags().Lookup("admin-listen"))
+	viper.BindPFlag("admin-token-file", rootCmd.PersistentFlags().Lookup("admin-token-file"))
+	viper.BindPFlag("admin-access-file", rootCmd.PersistentFlags().Lookup("admin-access-file"))
+	viper.BindPFlag("admin-cert", rootCmd.PersistentFlags().Lookup("admin-cert"))
+	viper.BindPFlag("admin-key", rootCmd.PersistentFlags().Lookup("admin-key"))
+	viper.BindPFlag("admin-ca", rootCmd.PersistentFlags().Lookup("admin-ca"))
+	viper.BindPFlag("admin-server-name", rootCmd.PersistentFlags().Lookup("admin-server-name"))
+	viper.BindPFlag("status-socket", rootCmd.PersistentFlags().Lookup("status-socket"))
+	viper.BindPFlag("audit-size", rootCmd.PersistentFlags().Lookup("audit-size"))
+	viper.BindPFlag("audit-file", rootCmd.PersistentFlags().Lookup("audit-file"))
+	viper.BindPFlag("audit-journald", rootCmd.PersistentFlags().Lookup("audit-journald"))
+	viper.BindPFlag("pprof-port", rootCmd.PersistentFlags().Lookup("pprof-port"))
+	viper.BindPFlag("self-test", rootCmd.PersistentFlags().Lookup("self-test"))
 	viper.BindPFlag("iptables-masq", rootCmd.PersistentFlags().Lookup("iptables-masq"))
 	viper.BindPFlag("ipvs-colocation-mode", rootCmd.PersistentFlags().Lookup("ipvs-colocation-mode"))
 	viper.BindPFlag("failover-timeout", rootCmd.PersistentFlags().Lookup("failover-timeout"))
+	viper.BindPFlag("failover-probe-interval", rootCmd.PersistentFlags().Lookup("failover-probe-interval"))
+	viper.BindPFlag("failover-failure-threshold", rootCmd.PersistentFlags().Lookup("failover-failure-threshold"))
+	viper.BindPFlag("failover-recovery-threshold", rootCmd.PersistentFlags().Lookup("failover-recovery-threshold"))
+	viper.BindPFlag("failover-jitter", rootCmd.PersistentFlags().Lookup("failover-jitter"))
+	viper.BindPFlag("failover-backoff-max", rootCmd.PersistentFlags().Lookup("failover-backoff-max"))
+	viper.BindPFlag("drain-window", rootCmd.PersistentFlags().Lookup("drain-window"))
+	viper.BindPFlag("warm-standby-interval", rootCmd.PersistentFlags().Lookup("warm-standby-interval"))
 	viper.BindPFlag("auto-configure-service", rootCmd.PersistentFlags().Lookup("auto-configure-service"))
 	viper.BindPFlag("auto-configure-port", rootCmd.PersistentFlags().Lookup("auto-configure-port"))
 	viper.BindPFlag("coordinator-port", rootCmd.PersistentFlags().Lookup("coordinator-port"))
+	viper.BindPFlag("coordinator-cert", rootCmd.PersistentFlags().Lookup("coordinator-cert"))
+	viper.BindPFlag("coordinator-key", rootCmd.PersistentFlags().Lookup("coordinator-key"))
+	viper.BindPFlag("coordinator-ca", rootCmd.PersistentFlags().Lookup("coordinator-ca"))
+	viper.BindPFlag("coordinator-server-name", rootCmd.PersistentFlags().Lookup("coordinator-server-name"))
+	viper.BindPFlag("coordinator-stale-after", rootCmd.PersistentFlags().Lookup("coordinator-stale-after"))
+	viper.BindPFlag("config-reload-interval", rootCmd.PersistentFlags().Lookup("config-reload-interval"))
+	viper.BindPFlag("active-active", rootCmd.PersistentFlags().Lookup("active-active"))
+	viper.BindPFlag("membership-ttl", rootCmd.PersistentFlags().Lookup("membership-ttl"))
+	viper.BindPFlag("shard-replicas", rootCmd.PersistentFlags().Lookup("shard-replicas"))
+	viper.BindPFlag("config-feed-listen", rootCmd.PersistentFlags().Lookup("config-feed-listen"))
+	viper.BindPFlag("config-feed", rootCmd.PersistentFlags().Lookup("config-feed"))
+	viper.BindPFlag("config-feed-fallback", rootCmd.PersistentFlags().Lookup("config-feed-fallback"))
 	viper.BindPFlag("stats-enabled", rootCmd.PersistentFlags().Lookup("stats-enabled"))
 	viper.BindPFlag("stats-interface", rootCmd.PersistentFlags().Lookup("stats-interface"))
 	viper.BindPFlag("stats-listen", rootCmd.PersistentFlags().Lookup("stats-listen"))
 	viper.BindPFlag("stats-port", rootCmd.PersistentFlags().Lookup("stats-port"))
 	viper.BindPFlag("stats-interval", rootCmd.PersistentFlags().Lookup("stats-interval"))
+	viper.BindPFlag("stats-top-talkers", rootCmd.PersistentFlags().Lookup("stats-top-talkers"))
+	viper.BindPFlag("flow-export", rootCmd.PersistentFlags().Lookup("flow-export"))
+	viper.BindPFlag("flow-collector", rootCmd.PersistentFlags().Lookup("flow-collector"))
+	viper.BindPFlag("flow-sample-rate", rootCmd.PersistentFlags().Lookup("flow-sample-rate"))
+	viper.BindPFlag("flow-export-interval", rootCmd.PersistentFlags().Lookup("flow-export-interval"))
+	viper.BindPFlag("remote-write-url", rootCmd.PersistentFlags().Lookup("remote-write-url"))
+	viper.BindPFlag("remote-write-interval", rootCmd.PersistentFlags().Lookup("remote-write-interval"))
+	viper.BindPFlag("remote-write-batch-size", rootCmd.PersistentFlags().Lookup("remote-write-batch-size"))
+	viper.BindPFlag("remote-write-timeout", rootCmd.PersistentFlags().Lookup("remote-write-timeout"))
+	viper.BindPFlag("remote-write-retries", rootCmd.PersistentFlags().Lookup("remote-write-retries"))
+	viper.BindPFlag("remote-write-username", rootCmd.PersistentFlags().Lookup("remote-write-username"))
+	viper.BindPFlag("remote-write-password-file", rootCmd.PersistentFlags().Lookup("remote-write-password-file"))
+	viper.BindPFlag("remote-write-bearer-token-file", rootCmd.PersistentFlags().Lookup("remote-write-bearer-token-file"))
+	viper.BindPFlag("remote-write-label", rootCmd.PersistentFlags().Lookup("remote-write-label"))
+	viper.BindPFlag("snmp-agentx", rootCmd.PersistentFlags().Lookup("snmp-agentx"))
+	viper.BindPFlag("snmp-oid", rootCmd.PersistentFlags().Lookup("snmp-oid"))
+	viper.BindPFlag("snmp-cache-ttl", rootCmd.PersistentFlags().Lookup("snmp-cache-ttl"))
+	viper.BindPFlag("probe-interval", rootCmd.PersistentFlags().Lookup("probe-interval"))
+	viper.BindPFlag("probe-timeout", rootCmd.PersistentFlags().Lookup("probe-timeout"))
+	viper.BindPFlag("probe-http-path", rootCmd.PersistentFlags().Lookup("probe-http-path"))
+	viper.BindPFlag("canary-vips", rootCmd.PersistentFlags().Lookup("canary-vips"))
+	viper.BindPFlag("canary-soak", rootCmd.PersistentFlags().Lookup("canary-soak"))
+	viper.BindPFlag("capacity-conntrack-threshold", rootCmd.PersistentFlags().Lookup("capacity-conntrack-threshold"))
+	viper.BindPFlag("capacity-ipvs-threshold", rootCmd.PersistentFlags().Lookup("capacity-ipvs-threshold"))
+	viper.BindPFlag("watchdog-deadline", rootCmd.PersistentFlags().Lookup("watchdog-deadline"))
+	viper.BindPFlag("watchdog-restart", rootCmd.PersistentFlags().Lookup("watchdog-restart"))
+	viper.BindPFlag("self-health-interval", rootCmd.PersistentFlags().Lookup("self-health-interval"))
+	viper.BindPFlag("self-health-threshold", rootCmd.PersistentFlags().Lookup("self-health-threshold"))
+	viper.BindPFlag("vrrp-id", rootCmd.PersistentFlags().Lookup("vrrp-id"))
+	viper.BindPFlag("vrrp-priority", rootCmd.PersistentFlags().Lookup("vrrp-priority"))
+	viper.BindPFlag("vrrp-priority-label", rootCmd.PersistentFlags().Lookup("vrrp-priority-label"))
+	viper.BindPFlag("vrrp-preempt", rootCmd.PersistentFlags().Lookup("vrrp-preempt"))
+	viper.BindPFlag("vrrp-preempt-delay", rootCmd.PersistentFlags().Lookup("vrrp-preempt-delay"))
+	viper.BindPFlag("vrrp-interval", rootCmd.PersistentFlags().Lookup("vrrp-interval"))
+	viper.BindPFlag("ipvs-sync", rootCmd.PersistentFlags().Lookup("ipvs-sync"))
+	viper.BindPFlag("vrrp-fence-ttl", rootCmd.PersistentFlags().Lookup("vrrp-fence-ttl"))
+	viper.BindPFlag("mode", rootCmd.PersistentFlags().Lookup("mode"))
+	viper.BindPFlag("auto-directors", rootCmd.PersistentFlags().Lookup("auto-directors"))
+	viper.BindPFlag("auto-director-role", rootCmd.PersistentFlags().Lookup("auto-director-role"))
+	viper.BindPFlag("auto-slot-ttl", rootCmd.PersistentFlags().Lookup("auto-slot-ttl"))
+	viper.BindPFlag("auto-interval", rootCmd.PersistentFlags().Lookup("auto-interval"))
+	viper.BindPFlag("haproxy-template", rootCmd.PersistentFlags().Lookup("haproxy-template"))
+	viper.BindPFlag("haproxy-snippet-dir", rootCmd.PersistentFlags().Lookup("haproxy-snippet-dir"))
+	viper.BindPFlag("haproxy-master-worker", rootCmd.PersistentFlags().Lookup("haproxy-master-worker"))
+	viper.BindPFlag("haproxy-pools", rootCmd.PersistentFlags().Lookup("haproxy-pools"))
+	viper.BindPFlag("haproxy-access-log", rootCmd.PersistentFlags().Lookup("haproxy-access-log"))
+	viper.BindPFlag("haproxy-access-log-sample", rootCmd.PersistentFlags().Lookup("haproxy-access-log-sample"))
+	viper.BindPFlag("v6-proxy", rootCmd.PersistentFlags().Lookup("v6-proxy"))
 	viper.BindPFlag("calico-version", rootCmd.PersistentFlags().Lookup("calico-version"))
 	viper.BindPFlag("calico-dir", rootCmd.PersistentFlags().Lookup("calico-dir"))
 	viper.BindPFlag("calico-bin", rootCmd.PersistentFlags().Lookup("calico-bin"))
@@ -137,6 +362,7 @@ Mode "ipvs" will result in pod ip addresses being added to the ipvs configuraton
 	viper.BindPFlag("config-key", rootCmd.PersistentFlags().Lookup("config-key"))
 	viper.BindPFlag("config-namespace", rootCmd.PersistentFlags().Lookup("config-namespace"))
 	viper.BindPFlag("config-name", rootCmd.PersistentFlags().Lookup("config-name"))
+	viper.BindPFlag("strict-config", rootCmd.PersistentFlags().Lookup("strict-config"))
 	viper.BindPFlag("compute-iface", rootCmd.PersistentFlags().Lookup("compute-iface"))
 	viper.BindPFlag("compute-iface-local", rootCmd.PersistentFlags().Lookup("compute-iface-local"))
 	viper.BindPFlag("gateway", rootCmd.PersistentFlags().Lookup("gateway"))
@@ -144,32 +370,179 @@ Mode "ipvs" will result in pod ip addresses being added to the ipvs configuraton
 	viper.BindPFlag("kubeconfig", rootCmd.PersistentFlags().Lookup("kubeconfig"))
 	viper.BindPFlag("primary-ip", rootCmd.PersistentFlags().Lookup("primary-ip"))
 	viper.BindPFlag("iptables-chain", rootCmd.PersistentFlags().Lookup("iptables-chain"))
+	viper.BindPFlag("shared-node", rootCmd.PersistentFlags().Lookup("shared-node"))
+	viper.BindPFlag("state-dir", rootCmd.PersistentFlags().Lookup("state-dir"))
 	viper.BindPFlag("lo-announce", rootCmd.PersistentFlags().Lookup("lo-announce"))
 	viper.BindPFlag("lo-ignore", rootCmd.PersistentFlags().Lookup("lo-ignore"))
 	viper.BindPFlag("primary-announce", rootCmd.PersistentFlags().Lookup("primary-announce"))
 	viper.BindPFlag("primary-ignore", rootCmd.PersistentFlags().Lookup("primary-ignore"))
 	viper.BindPFlag("cleanup-master", rootCmd.PersistentFlags().Lookup("cleanup-master"))
+	viper.BindPFlag("on-exit", rootCmd.PersistentFlags().Lookup("on-exit"))
+	viper.BindPFlag("shutdown-grace-period", rootCmd.PersistentFlags().Lookup("shutdown-grace-period"))
 	viper.BindPFlag("pod-cidr-masq", rootCmd.PersistentFlags().Lookup("pod-cidr-masq"))
 	viper.BindPFlag("forced-reconfigure", rootCmd.PersistentFlags().Lookup("forced-reconfigure"))
+	viper.BindPFlag("forced-reconfigure-interval", rootCmd.PersistentFlags().Lookup("forced-reconfigure-interval"))
+	viper.BindPFlag("observe-only", rootCmd.PersistentFlags().Lookup("observe-only"))
+	viper.BindPFlag("dry-run", rootCmd.PersistentFlags().Lookup("dry-run"))
+	viper.BindPFlag("privileged-helper", rootCmd.PersistentFlags().Lookup("privileged-helper"))
 	viper.BindPFlag("ipvs-weight-override", rootCmd.PersistentFlags().Lookup("ipvs-weight-override"))
 	viper.BindPFlag("ipvs-ignore-node-cordon", rootCmd.PersistentFlags().Lookup("ipvs-ignore-node-cordon"))
 	viper.BindPFlag("bgp-communities", rootCmd.PersistentFlags().Lookup("bgp-communities"))
+	viper.BindPFlag("otlp-endpoint", rootCmd.PersistentFlags().Lookup("otlp-endpoint"))
+	viper.BindPFlag("otlp-insecure", rootCmd.PersistentFlags().Lookup("otlp-insecure"))
+	viper.BindPFlag("trace-sample-ratio", rootCmd.PersistentFlags().Lookup("trace-sample-ratio"))
+}
+
+// initLogging applies --log-format and --log-level to our logger and to the
+// logrus standard logger, which the libraries we use log through, adds the
+// syslog and journald sinks, and sets the backend of --log-backend with the
+// node name and config key on every entry.
+func initLogging() error {
+	formatter, err := logging.NewFormatter(viper.GetString("log-format"))
+	if err != nil {
+		return err
+	}
+	levels, err := logging.ParseLevels(logSpec(viper.GetViper()))
+	if err != nil {
+		return err
+	}
+
+	std := logrus.StandardLogger()
+	std.Out = logger.Out
+	for _, l := range []*logrus.Logger{logger, std} {
+		l.Formatter = formatter
+	}
+	levels.Attach(logger, std)
+	levels.HandleSignals(context.Background(), log)
+
+	sinks, err := newLogSinks()
+	if err != nil {
+		return err
+	}
+	for _, sink := range sinks {
+		std.AddHook(levels.Filter(sink))
+	}
+	logSinks = sinks
+
+	var backend logging.Logger
+	switch name := viper.GetString("log-backend"); name {
+	case "logrus":
+		for _, sink := range sinks {
+			logger.AddHook(levels.Filter(sink))
+		}
+		backend = logging.FromLogrus(logger)
+	case "slog", "zap":
+		hooks := make([]logrus.Hook, len(sinks))
+		for i, sink := range sinks {
+			hooks[i] = sink
+		}
+		newBackend := logging.NewSlog
+		if name == "zap" {
+			newBackend = logging.NewZap
+		}
+		if backend, err = newBackend(viper.GetString("log-format"), logger.Out, levels, hooks...); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown log backend %q. must be one of logrus|slog|zap", name)
+	}
+
+	nodeName, configKey := logIdentity()
+	fields := logging.Fields{}
+	if nodeName != "" {
+		fields[logging.FieldNode] = nodeName
+	}
+	if configKey != "" {
+		fields[logging.FieldConfigKey] = configKey
+	}
+	logging.SetBackend(backend.WithFields(fields))
+
+	logLevels = levels
+	return nil
+}
+
+// newLogSinks returns a sink for each of --log-syslog and --log-journald that
+// is set. Messages carry the node name and config key, since syslog servers
+// collect from many nodes.
+func newLogSinks() ([]logging.Sink, error) {
+	nodeName, configKey := logIdentity()
+
+	sinks := []logging.Sink{}
+	if addr := viper.GetString("log-syslog"); addr != "" {
+		h, err := logging.NewSyslogHook(logging.SyslogConfig{
+			Address:   addr,
+			CAFile:    viper.GetString("log-syslog-ca"),
+			Facility:  viper.GetString("log-syslog-facility"),
+			SDID:      viper.GetString("log-syslog-sd-id"),
+			NodeName:  nodeName,
+			ConfigKey: configKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, h)
+	}
+	if viper.GetBool("log-journald") {
+		sinks = append(sinks, logging.NewJournaldHook(nodeName, configKey))
+	}
+	return sinks, nil
+}
+
+// logIdentity returns the node name and config key that logs are sent
+// with.
+func logIdentity() (nodeName, configKey string) {
+	nodeName = viper.GetString("nodename")
+	if nodeName == "" {
+		nodeName = os.Getenv("HOSTNAME")
+	}
+	return nodeName, viper.GetString("config-key")
 }
 
 func main() {
-	log.Infoln("Starting up...")
+	// a relay stands in for a command run by the privileged helper, so it
+	// must neither log nor linger on exit as ravel does
+	if len(os.Args) > 1 && os.Args[1] == privsep.RelayArg {
+		os.Exit(privsep.Relay(os.Args[2:]))
+	}
 
 	// This is he main context that is propagated into the child apps.
 	ctx, cancelCtx := context.WithCancel(context.Background())
 	defer cancelCtx()
 
-	log.Debugln("Adding commands to rootCmd")
-	rootCmd.AddCommand(BGP_DIRECTOR(ctx, log))           // ravel-director
-	rootCmd.AddCommand(IPVSMASTER(ctx, log))             // ipvs-master
-	rootCmd.AddCommand(IPVSBACKEND_REALSERVER(ctx, log)) // ipvs-backend
-
-	rootCmd.AddCommand(Version())
-
+	modes := []*cobra.Command{
+		BGP_DIRECTOR(ctx, log),           // ravel-director
+		IPVSMASTER(ctx, log),             // ipvs-master
+		IPVSBACKEND_REALSERVER(ctx, log), // ipvs-backend
+		COLOCATED(ctx, log),              // director and realserver
+		AUTO(ctx, log),                   // any of the above, by node
+		RUN(ctx, log),                    // any of the above, switching in place
+	}
+	rootCmd.AddCommand(modes...)
+
+	rootCmd.AddCommand(Version(ctx))
+	rootCmd.AddCommand(Doctor(ctx, log))
+	rootCmd.AddCommand(HAProxy())
+	rootCmd.AddCommand(IPVSCmd())
+	rootCmd.AddCommand(Export())
+	rootCmd.AddCommand(Maintenance(ctx))
+	rootCmd.AddCommand(Validate(ctx))
+	rootCmd.AddCommand(Migrate(ctx))
+	rootCmd.AddCommand(Status())
+	rootCmd.AddCommand(Top(ctx))
+	rootCmd.AddCommand(ConfigCmd())
+	rootCmd.AddCommand(Diagnose(ctx))
+	rootCmd.AddCommand(Cleanup(ctx, log))
+	rootCmd.AddCommand(Simulate(ctx, log))
+	rootCmd.AddCommand(Bench(ctx, log))
+	rootCmd.AddCommand(Helper(ctx, log))
+	usageErrors(rootCmd)
+
+	// the other commands print their reports on stdout, for automation to
+	// parse, so they log to stderr
+	if cmd, _, err := rootCmd.Find(os.Args[1:]); err != nil || !isMode(cmd, modes) {
+		logger.Out = os.Stderr
+	}
+	log.Infoln("Starting up...")
 	log.Infoln("Command arguments:", rootCmd.Flags().Args())
 
 	// Performing a nonblocking run of the application, reading error state through a chan.
@@ -185,36 +558,67 @@ func main() {
 	signal.Notify(sig, allOfTheSignals...)
 
 	exitCode := 0
-	log.Debugln("Watching for interrupts")
-	select {
-	case s := <-sig:
-		log.Error("Caught shutdown signal:", s)
-
-		// NOTE: When this cancel functoin is called, the context that was passed
-		// into the subcommand at startup will be canceled. This will result in
-		// an internal cleanup process kicking off, which should result in the
-		// subcommand exiting. So we wait for the subcommand to exit and for
-		// its exit value to be passed into the errors chan, which will be read
-		// on the next loop iteration.  Note that additional signals may be
-		// caught prior to the error being returned. These signals can be safely
-		// ignored.
-		cancelCtx()
-
-	case err := <-errors:
+	exited := func(err error) {
 		if err != nil {
 			log.Errorln("rootCmd shutdown with error:", err)
-			exitCode = 1
+			exitCode = exitCodeOf(err)
 		}
-		// This chan is activated when the subcommand exits.
-		cancelCtx()
+	}
+	log.Debugln("Watching for interrupts")
+	for {
+		select {
+		case s := <-sig:
+			// a running daemon reloads its settings on SIGHUP
+			if s == syscall.SIGHUP && hangup() {
+				continue
+			}
+			log.Error("Caught shutdown signal:", s)
+
+			// NOTE: When this cancel functoin is called, the context that was passed
+			// into the subcommand at startup will be canceled. This will result in
+			// an internal cleanup process kicking off, which should result in the
+			// subcommand exiting. So we wait for the subcommand to exit and for
+			// its exit value to be passed into the errors chan, for as long as
+			// its shutdown grace period, and a little more for it to return.
+			// Additional signals caught in the meantime are ignored.
+			cancelCtx()
+			grace := viper.GetDuration("shutdown-grace-period") + time.Second
+			select {
+			case err := <-errors:
+				exited(err)
+			case <-time.After(grace):
+				log.Errorf("rootCmd still shutting down after %v. exiting anyway", grace)
+				exitCode = 1
+			}
+
+		case err := <-errors:
+			exited(err)
+			// This chan is activated when the subcommand exits.
+			cancelCtx()
+		}
+		break
 	}
 
 	log.Info("exiting in 1 second")
 	<-time.After(1 * time.Second)
 	log.Info("exiting with exit code", exitCode)
+	for _, sink := range logSinks {
+		sink.Flush(time.Second)
+	}
 	os.Exit(exitCode)
 }
 
+// isMode is whether cmd runs one of modes, rather than a subcommand of one,
+// such as bgp announce.
+func isMode(cmd *cobra.Command, modes []*cobra.Command) bool {
+	for _, mode := range modes {
+		if cmd == mode {
+			return true
+		}
+	}
+	return false
+}
+
 // This represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:           "kube2ipvs",
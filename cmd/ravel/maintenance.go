@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/maintenance"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// maintenanceInterval is how often a process checks whether its node is in
+// maintenance.
+const maintenanceInterval = 2 * time.Second
+
+// startMaintenance follows the maintenance annotation of the node, and
+// reports it through checks. Each handler is called with whether the node is
+// in maintenance, once the node is first found and then each time that
+// changes.
+func startMaintenance(ctx context.Context, config *config.Config, kind stats.LBKind, w *watcher.Watcher, checks *health.Registry, logger logging.Logger, handlers ...func(active bool)) *maintenance.Monitor {
+	m := maintenance.New(func() []*v1.Node { return w.Nodes }, config.NodeName, kind, config.ConfigKey, logger)
+	for _, handle := range handlers {
+		m.OnChange(handle)
+	}
+	checks.Register("maintenance", m.Health)
+	go m.Run(ctx, maintenanceInterval)
+	return m
+}
+
+// nodeMaintenance is whether a node is in maintenance, as the maintenance
+// commands print it.
+type nodeMaintenance struct {
+	Node        string `json:"node"`
+	Maintenance bool   `json:"maintenance"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// Maintenance puts a node in maintenance, and takes it out again.
+func Maintenance(ctx context.Context) *cobra.Command {
+	var output string
+
+	var cmd = &cobra.Command{
+		Use:          "maintenance",
+		Short:        "drain a node out of service, and return it",
+		SilenceUsage: true,
+		Long: `
+maintenance sets the ravel.comcast.com/maintenance annotation on a node, this
+node by default, using --kubeconfig. Directors drain the node, keeping its
+connections but sending it no new ones, and the director or realserver on
+the node steps down and refuses to take traffic until the annotation is
+removed. Requires permission to patch nodes.`,
+	}
+	outputFlag(cmd.PersistentFlags(), &output)
+
+	client := func(cmd *cobra.Command) (kubernetes.Interface, error) {
+		config, err := clientcmd.BuildConfigFromFlags("", NewConfig(cmd.Flags()).KubeConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		return kubernetes.NewForConfig(config)
+	}
+	node := func(cmd *cobra.Command, args []string) (string, error) {
+		if len(args) > 0 {
+			return args[0], nil
+		}
+		if name := NewConfig(cmd.Flags()).NodeName; name != "" {
+			return name, nil
+		}
+		return "", withExitCode(exitUsage, fmt.Errorf("no node given, and nodename isn't set"))
+	}
+	// write prints whether the node is in maintenance
+	write := func(name, reason string, active bool) error {
+		s := nodeMaintenance{Node: name, Maintenance: active, Reason: reason}
+		return writeOutput(os.Stdout, output, s, func(w io.Writer) error {
+			if active {
+				_, err := fmt.Fprintf(w, "node %s is in maintenance: %s\n", name, reason)
+				return err
+			}
+			_, err := fmt.Fprintf(w, "node %s is in service\n", name)
+			return err
+		})
+	}
+
+	var reason string
+	enter := &cobra.Command{
+		Use:   "enter [node]",
+		Short: "put a node in maintenance",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkOutput(output); err != nil {
+				return err
+			}
+			name, err := node(cmd, args)
+			if err != nil {
+				return err
+			}
+			c, err := client(cmd)
+			if err != nil {
+				return err
+			}
+			if err := maintenance.Set(ctx, c, name, reason); err != nil {
+				return err
+			}
+			return write(name, reason, true)
+		},
+	}
+	enter.Flags().StringVar(&reason, "reason", "maintenance", "why the node is in maintenance, as the annotation records it")
+	cmd.AddCommand(enter)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "exit [node]",
+		Short: "return a node to service",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkOutput(output); err != nil {
+				return err
+			}
+			name, err := node(cmd, args)
+			if err != nil {
+				return err
+			}
+			c, err := client(cmd)
+			if err != nil {
+				return err
+			}
+			if err := maintenance.Set(ctx, c, name, ""); err != nil {
+				return err
+			}
+			return write(name, "", false)
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "status [node]",
+		Short: "show whether a node is in maintenance",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkOutput(output); err != nil {
+				return err
+			}
+			name, err := node(cmd, args)
+			if err != nil {
+				return err
+			}
+			c, err := client(cmd)
+			if err != nil {
+				return err
+			}
+			reason, active, err := maintenance.Get(ctx, c, name)
+			if err != nil {
+				return err
+			}
+			return write(name, reason, active)
+		},
+	})
+	return cmd
+}
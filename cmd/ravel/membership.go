@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+
+	"github.com/Comcast/Ravel/pkg/bgp"
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/membership"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// startMembership joins the directors of the config key when --active-active
+// is set, and reports the membership through checks. The lease is given up
+// when ctx is done.
+func startMembership(ctx context.Context, config *config.Config, kind stats.LBKind, w *watcher.Watcher, checks *health.Registry, logger logging.Logger) (*membership.Membership, error) {
+	if !config.Coordinator.ActiveActive {
+		return nil, nil
+	}
+	m, err := membership.New(w.Clientset(), config.ConfigMapNamespace, config.ConfigKey, config.NodeName, config.Net.PrimaryIP, config.Coordinator.MembershipTTL, kind, logger)
+	if err != nil {
+		return nil, err
+	}
+	checks.Register("membership", m.Health)
+	go m.Run(ctx)
+	return m, nil
+}
+
+// startSharding has worker announce only its share of the VIPs, when
+// --shard-replicas is set, as the members of m divide them.
+func startSharding(config *config.Config, m *membership.Membership, worker bgp.BGPWorker, logger logging.Logger) {
+	if m == nil || config.Coordinator.ShardReplicas == 0 {
+		return
+	}
+	sharder := membership.NewSharder(config.NodeName, config.Coordinator.ShardReplicas, m.Members, stats.KindBGPDirector, config.ConfigKey, logger)
+	worker.Shard(sharder.Shard)
+}
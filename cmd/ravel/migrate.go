@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/Comcast/Ravel/pkg/migrate"
+)
+
+// Migrate converts cluster configs between a configmap and RavelConfig
+// objects.
+func Migrate(ctx context.Context) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "convert cluster configs between a configmap and RavelConfig objects",
+		Long: `
+migrate converts the cluster configs of a configmap into RavelConfig objects,
+one for each config key, and RavelConfig objects back into a configmap.
+Each config is kept as the configmap has it, with its base and defaults
+rather than with them applied, so converting it back gives the same config,
+and a config written in YAML is kept as the JSON it converts to.
+
+Every config is validated as ravel validate does on the way. A problem is
+printed to stderr as the key, the path within its JSON and what is wrong,
+and nothing is printed and migrate exits non-zero unless --force is given.
+
+crd prints the RavelConfig CustomResourceDefinition to apply before the
+objects.`,
+	}
+
+	var (
+		output string
+		force  bool
+	)
+	flags := func(c *cobra.Command) {
+		c.Flags().StringVarP(&output, "output", "o", "yaml", "manifest format. one of yaml|json")
+		c.Flags().BoolVar(&force, "force", false, "print the manifests even if the configs have problems")
+	}
+
+	crdCmd := &cobra.Command{
+		Use:           "crd",
+		Short:         "print the RavelConfig CustomResourceDefinition",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			_, err := io.WriteString(os.Stdout, migrate.CRD)
+			return err
+		},
+	}
+	cmd.AddCommand(crdCmd)
+
+	toCRDCmd := &cobra.Command{
+		Use:           "to-crd [file]",
+		Short:         "convert the cluster configs of a configmap into RavelConfig objects",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.MaximumNArgs(1),
+		Long: `
+to-crd prints a RavelConfig for each key of a configmap, named for the
+configmap and the key and in the namespace of the configmap. The configmap
+is read from file, a manifest in YAML or JSON, or - for stdin, or else from
+config-namespace and config-name using --kubeconfig. Only config-key is
+converted when it is set, and otherwise every key of the configmap.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkManifestOutput(output); err != nil {
+				return err
+			}
+			config := NewConfig(cmd.Flags())
+
+			var cm *v1.ConfigMap
+			var err error
+			if len(args) == 0 {
+				kubeConfig, err := clientcmd.BuildConfigFromFlags("", config.KubeConfigFile)
+				if err != nil {
+					return err
+				}
+				client, err := kubernetes.NewForConfig(kubeConfig)
+				if err != nil {
+					return err
+				}
+				cm, err = client.CoreV1().ConfigMaps(config.ConfigMapNamespace).Get(ctx, config.ConfigMapName, metav1.GetOptions{})
+			} else {
+				cm, err = readConfigMap(args[0])
+			}
+			if err != nil {
+				return err
+			}
+
+			keys := []string{}
+			if config.ConfigKey != "" {
+				keys = append(keys, config.ConfigKey)
+			}
+			configs, problems, err := migrate.ToRavelConfigs(cm, keys)
+			if err != nil {
+				return withExitCode(exitInvalid, err)
+			}
+			if err := checkProblems(problems, len(configs), force); err != nil {
+				return err
+			}
+			objs := make([]interface{}, len(configs))
+			for ix, c := range configs {
+				objs[ix] = c
+			}
+			return writeManifests(os.Stdout, output, objs)
+		},
+	}
+	flags(toCRDCmd)
+	cmd.AddCommand(toCRDCmd)
+
+	var name, namespace string
+	toConfigMapCmd := &cobra.Command{
+		Use:           "to-configmap file",
+		Short:         "convert RavelConfig objects into a configmap",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.ExactArgs(1),
+		Long: `
+to-configmap prints a configmap with the cluster config of each RavelConfig
+read from file, or - for stdin, as YAML or JSON documents of RavelConfigs or
+lists of them, as kubectl get ravelconfigs -o yaml prints. The configmap is
+named --name in --namespace, which default to config-name and
+config-namespace.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkManifestOutput(output); err != nil {
+				return err
+			}
+			config := NewConfig(cmd.Flags())
+			if name == "" {
+				name = config.ConfigMapName
+			}
+			if namespace == "" {
+				namespace = config.ConfigMapNamespace
+			}
+
+			var r io.Reader = os.Stdin
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+			}
+			configs, err := migrate.Read(r)
+			if err != nil {
+				return withExitCode(exitInvalid, fmt.Errorf("unable to read RavelConfigs from %s. %v", args[0], err))
+			}
+			if len(configs) == 0 {
+				return withExitCode(exitInvalid, fmt.Errorf("%s holds no RavelConfigs", args[0]))
+			}
+			cm, problems, err := migrate.ToConfigMap(configs, name, namespace)
+			if err != nil {
+				return withExitCode(exitInvalid, err)
+			}
+			if err := checkProblems(problems, len(configs), force); err != nil {
+				return err
+			}
+			return writeManifests(os.Stdout, output, []interface{}{cm})
+		},
+	}
+	flags(toConfigMapCmd)
+	toConfigMapCmd.Flags().StringVar(&name, "name", "", "name of the configmap. defaults to config-name")
+	toConfigMapCmd.Flags().StringVar(&namespace, "namespace", "", "namespace of the configmap. defaults to config-namespace")
+	cmd.AddCommand(toConfigMapCmd)
+
+	return cmd
+}
+
+// checkManifestOutput refuses an unknown manifest format.
+func checkManifestOutput(output string) error {
+	switch output {
+	case "yaml", "json":
+		return nil
+	}
+	return withExitCode(exitUsage, fmt.Errorf("output must be one of yaml|json"))
+}
+
+// checkProblems prints problems to stderr, and fails unless there are none
+// or force.
+func checkProblems(problems []migrate.Problem, configs int, force bool) error {
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p)
+	}
+	if len(problems) > 0 && !force {
+		return withExitCode(exitInvalid, fmt.Errorf("%d problems found in %d cluster configs", len(problems), configs))
+	}
+	return nil
+}
+
+// writeManifests prints objs as a stream of YAML documents, or as a JSON
+// list.
+func writeManifests(w io.Writer, output string, objs []interface{}) error {
+	if output == "json" {
+		list := map[string]interface{}{"apiVersion": "v1", "kind": "List", "items": objs}
+		return writeOutput(w, output, list, nil)
+	}
+	for _, obj := range objs {
+		if _, err := io.WriteString(w, "---\n"); err != nil {
+			return err
+		}
+		if err := writeOutput(w, output, obj, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+
+	"github.com/Comcast/Ravel/pkg/config"
+)
+
+// The CLI commands print for people by default, and with -o json or -o yaml
+// print the same as a document for automation to parse. The YAML is the JSON
+// document converted, so that fields are named alike in both.
+
+// outputFlag adds -o to flags.
+func outputFlag(flags *pflag.FlagSet, output *string) {
+	flags.StringVarP(output, "output", "o", "text", "report format. one of text|json|yaml")
+}
+
+// checkOutput refuses an unknown output format.
+func checkOutput(output string) error {
+	switch output {
+	case "text", "json", "yaml":
+		return nil
+	}
+	return withExitCode(exitUsage, fmt.Errorf("output must be one of text|json|yaml"))
+}
+
+// writeOutput prints v as output, with text for people.
+func writeOutput(w io.Writer, output string, v interface{}, text func(io.Writer) error) error {
+	switch output {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "yaml":
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		var doc interface{}
+		if err := json.Unmarshal(b, &doc); err != nil {
+			return err
+		}
+		if b, err = yaml.Marshal(doc); err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	case "text":
+		return text(w)
+	}
+	return checkOutput(output)
+}
+
+// adminOutput sends a request to the admin endpoint, as adminRequest does,
+// and prints the response as output. Text is the response as it came. A
+// response that isn't JSON, such as the result of an operation, is printed
+// as its result in json and yaml.
+func adminOutput(config *config.Config, method, path string, query url.Values, output string) error {
+	if err := checkOutput(output); err != nil {
+		return err
+	}
+	b := &bytes.Buffer{}
+	if err := adminRequest(config, method, path, query, b); err != nil {
+		return err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+		doc = map[string]string{"result": strings.TrimSpace(b.String())}
+	}
+	return writeOutput(os.Stdout, output, doc, func(w io.Writer) error {
+		_, err := w.Write(b.Bytes())
+		return err
+	})
+}
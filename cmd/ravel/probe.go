@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/Comcast/Ravel/pkg/canary"
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/probe"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// startProbe probes every VIP in the watcher's config when --probe-interval
+// is set. v4 probes are sent from the primary ip so that realservers reply to
+// the director rather than to their own loopback. With --canary-vips, each
+// changed config is applied to the canary VIPs first, and promoted once
+// their probes have passed for --canary-soak.
+func startProbe(ctx context.Context, config *config.Config, kind stats.LBKind, w *watcher.Watcher, logger logging.Logger) error {
+	if config.Probe.Interval == 0 {
+		return nil
+	}
+	p, err := probe.New(kind, probe.Config{
+		Interval: config.Probe.Interval,
+		Timeout:  config.Probe.Timeout,
+		HTTPPath: config.Probe.HTTPPath,
+		Source:   net.ParseIP(config.Net.PrimaryIP),
+	}, func() *types.ClusterConfig { return w.ClusterConfig }, logger)
+	if err != nil {
+		return err
+	}
+	go p.Run(ctx)
+
+	if len(config.Canary.VIPs) == 0 {
+		return nil
+	}
+	stager, err := canary.New(kind, config.Canary, p, logger)
+	if err != nil {
+		return err
+	}
+	w.Stage(stager.Stage)
+	go stager.Run(ctx, config.Probe.Interval, w.Republish)
+	return nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// Some settings can change without restarting the workers and disturbing
+// traffic. While Ravel runs, the --config file is read again whenever it
+// changes, on SIGHUP, and on a POST to /reload on the admin endpoint, and
+// these settings are taken from it and from the environment:
+//
+//   - the coordinator ports: a director starts and stops answering
+//     heartbeats on the ports added and removed, and a realserver probes the
+//     first of them from then on
+//   - the log level
+//   - the forced reconfigure interval of a director
+//   - the communities a bgp director announces with
+//   - the stats port
+//   - the pod cidr and masquerading of the iptables rules
+//
+// A setting given on the command line wins over the file, as it does at
+// start. Everything else only applies at start.
+
+// reloadable are the settings that apply without a restart.
+type reloadable struct {
+	CoordinatorPorts          []int
+	LogLevel                  string
+	ForcedReconfigureInterval time.Duration
+	Communities               []string
+	StatsPort                 string
+	PodCIDRMasq               string
+	IPTablesMasq              bool
+}
+
+// changed names the settings that differ between a and b.
+func (a reloadable) changed(b reloadable) []string {
+	names := []string{}
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			names = append(names, va.Type().Field(i).Name)
+		}
+	}
+	return names
+}
+
+// readReloadable reads the settings that apply without a restart from v.
+func readReloadable(v *viper.Viper) (reloadable, error) {
+	r := reloadable{
+		LogLevel:                  logSpec(v),
+		ForcedReconfigureInterval: v.GetDuration("forced-reconfigure-interval"),
+		Communities:               v.GetStringSlice("bgp-communities"),
+		StatsPort:                 v.GetString("stats-port"),
+		PodCIDRMasq:               v.GetString("pod-cidr-masq"),
+		IPTablesMasq:              v.GetBool("iptables-masq"),
+	}
+	c, err := config.NewCoordinatorConfig(v.GetStringSlice("coordinator-port"))
+	if err != nil {
+		return r, fmt.Errorf("invalid coordinator-port. %v", err)
+	}
+	r.CoordinatorPorts = c.Ports
+	if _, err := logging.ParseLevels(r.LogLevel); err != nil {
+		return r, fmt.Errorf("invalid log-level. %v", err)
+	}
+	if r.ForcedReconfigureInterval <= 0 {
+		return r, fmt.Errorf("forced-reconfigure-interval must be positive")
+	}
+	if r.PodCIDRMasq != "" {
+		if _, _, err := net.ParseCIDR(r.PodCIDRMasq); err != nil {
+			return r, fmt.Errorf("invalid pod-cidr-masq. %v", err)
+		}
+	}
+	return r, nil
+}
+
+// logSpec is the log level in v, with the --debug shorthand applied.
+func logSpec(v *viper.Viper) string {
+	spec := v.GetString("log-level")
+	if flagDebug {
+		spec += ",debug"
+	}
+	return spec
+}
+
+// hangups passes SIGHUP to the reloader, while one runs.
+var (
+	hangups   = make(chan struct{}, 1)
+	reloading int32
+)
+
+// hangup asks the running reloader to reload, and is false if none runs.
+func hangup() bool {
+	if atomic.LoadInt32(&reloading) == 0 {
+		return false
+	}
+	select {
+	case hangups <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// newReloader returns a reloader of the settings in config, which the mode
+// registers its handlers with before it starts.
+func newReloader(config *config.Config, flags *pflag.FlagSet, logger logging.Logger) *reloader {
+	r := &reloader{
+		path:  config.ConfigFile,
+		flags: flags,
+		current: reloadable{
+			CoordinatorPorts:          config.Coordinator.Ports,
+			LogLevel:                  logSpec(viper.GetViper()),
+			ForcedReconfigureInterval: config.ForcedReconfigureInterval,
+			Communities:               config.BGP.Communities,
+			StatsPort:                 config.Stats.ListenPort,
+			PodCIDRMasq:               config.PodCIDRMasq,
+			IPTablesMasq:              config.IPTablesMasq,
+		},
+		logger: logger.WithFields(logging.Fields{"module": "reload"}),
+	}
+	if r.path != "" {
+		r.last, _ = ioutil.ReadFile(r.path)
+	}
+	// the log level is the same for every mode
+	r.Handle(func(old, cur reloadable) error {
+		if old.LogLevel == cur.LogLevel || logLevels == nil {
+			return nil
+		}
+		return logLevels.Load(cur.LogLevel)
+	})
+	return r
+}
+
+// reloader applies the settings that changed to the handlers of the mode.
+type reloader struct {
+	sync.Mutex
+	path     string
+	flags    *pflag.FlagSet
+	last     []byte
+	current  reloadable
+	handlers []func(old, cur reloadable) error
+	logger   logging.Logger
+}
+
+// Handle adds h to be called with the settings before and after each
+// reload that changes them.
+func (r *reloader) Handle(h func(old, cur reloadable) error) {
+	r.Lock()
+	defer r.Unlock()
+	r.handlers = append(r.handlers, h)
+}
+
+// start reloads on SIGHUP, and reads the config file every interval if
+// there is one and the interval is set, until ctx is done.
+func (r *reloader) start(ctx context.Context, interval time.Duration) {
+	atomic.StoreInt32(&reloading, 1)
+	go func() {
+		defer atomic.StoreInt32(&reloading, 0)
+		var tick <-chan time.Time
+		if r.path != "" && interval > 0 {
+			t := time.NewTicker(interval)
+			defer t.Stop()
+			tick = t.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+				if _, err := r.reload(false); err != nil {
+					r.logger.Errorf("reload: keeping the settings in use. %v", err)
+				}
+			case <-hangups:
+				r.logger.Info("reload: caught SIGHUP")
+				if _, err := r.reload(true); err != nil {
+					r.logger.Errorf("reload: keeping the settings in use. %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// reload reads the config file, and applies the settings that changed. The
+// file is read again when force is set, even if it hasn't changed. It
+// returns the names of the settings changed.
+func (r *reloader) reload(force bool) ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	b := []byte{}
+	if r.path != "" {
+		var err error
+		if b, err = ioutil.ReadFile(r.path); err != nil {
+			return nil, err
+		}
+		if !force && bytes.Equal(b, r.last) {
+			return nil, nil
+		}
+		r.last = b
+	}
+
+	// the global viper is read by the running roles, so the file is read
+	// into one of its own
+	v := viper.New()
+	v.SetConfigType(configType(r.path))
+	layerEnv(v)
+	if err := v.BindPFlags(r.flags); err != nil {
+		return nil, err
+	}
+	if err := v.ReadConfig(bytes.NewReader(b)); err != nil {
+		return nil, fmt.Errorf("unable to read %s. %v", r.path, err)
+	}
+	cur, err := readReloadable(v)
+	if err != nil {
+		return nil, fmt.Errorf("%v in %s", err, r.path)
+	}
+
+	changed := r.current.changed(cur)
+	if len(changed) == 0 {
+		return changed, nil
+	}
+	r.logger.Infof("reload: %s changed from %+v to %+v", strings.Join(changed, ", "), r.current, cur)
+	old := r.current
+	r.current = cur
+	errs := []string{}
+	for _, h := range r.handlers {
+		if err := h(old, cur); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return changed, fmt.Errorf("unable to apply all of %s. %s", strings.Join(changed, ", "), strings.Join(errs, "; "))
+	}
+	return changed, nil
+}
+
+// handler reloads on a POST to /reload on the admin endpoint.
+func (r *reloader) handler() http.Handler {
+	return postHandler("reload", func(_ *http.Request) (string, error) {
+		changed, err := r.reload(true)
+		if len(changed) == 0 {
+			return "no settings changed", err
+		}
+		return "reloaded " + strings.Join(changed, ", "), err
+	})
+}
+
+// reloadStats moves the metrics server of s to the stats port.
+func reloadStats(s *stats.Stats) func(old, cur reloadable) error {
+	return func(old, cur reloadable) error {
+		if old.StatsPort == cur.StatsPort {
+			return nil
+		}
+		return s.SetPort(cur.StatsPort)
+	}
+}
+
+// reloadMasq changes the masquerading of the rules each of ipts generates
+// from then on.
+func reloadMasq(ipts ...*iptables.IPTables) func(old, cur reloadable) error {
+	return func(old, cur reloadable) error {
+		for _, ipt := range ipts {
+			ipt.SetMasq(cur.PodCIDRMasq, cur.IPTablesMasq)
+		}
+		return nil
+	}
+}
+
+// reloadPorts calls follow with the coordinator ports when they change.
+func reloadPorts(follow func(ports []int) error) func(old, cur reloadable) error {
+	return func(old, cur reloadable) error {
+		if reflect.DeepEqual(old.CoordinatorPorts, cur.CoordinatorPorts) {
+			return nil
+		}
+		return follow(cur.CoordinatorPorts)
+	}
+}
+
+// reloadCommunities calls announce with the bgp communities when they
+// change.
+func reloadCommunities(announce func(communities []string)) func(old, cur reloadable) error {
+	return func(old, cur reloadable) error {
+		if !reflect.DeepEqual(old.Communities, cur.Communities) {
+			announce(cur.Communities)
+		}
+		return nil
+	}
+}
+
+// reloadForcedInterval calls set with the forced reconfigure interval when
+// it changes.
+func reloadForcedInterval(set func(interval time.Duration)) func(old, cur reloadable) error {
+	return func(old, cur reloadable) error {
+		if old.ForcedReconfigureInterval != cur.ForcedReconfigureInterval {
+			set(cur.ForcedReconfigureInterval)
+		}
+		return nil
+	}
+}
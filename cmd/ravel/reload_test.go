@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/heartbeat"
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ravel.yaml")
+	ioutil.WriteFile(path, []byte("coordinator-port: [\"44444\"]\n"), 0644)
+
+	flags := pflag.NewFlagSet("ravel", pflag.ContinueOnError)
+	flags.StringSlice("coordinator-port", []string{"44444"}, "")
+	flags.String("log-level", "info", "")
+	flags.Duration("forced-reconfigure-interval", time.Minute, "")
+	flags.StringSlice("bgp-communities", []string{""}, "")
+	flags.String("stats-port", "9100", "")
+	flags.String("pod-cidr-masq", "", "")
+	flags.Bool("iptables-masq", true, "")
+
+	config := &config.Config{ConfigFile: path, ForcedReconfigureInterval: time.Minute, IPTablesMasq: true}
+	config.Coordinator.Ports = []int{44444}
+	config.Stats.ListenPort = "9100"
+	config.BGP.Communities = []string{}
+	r := newReloader(config, flags, logging.New())
+	r.current.LogLevel = "info"
+	ports := [][]int{}
+	r.Handle(reloadPorts(func(p []int) error {
+		ports = append(ports, p)
+		return nil
+	}))
+	masq := []string{}
+	r.Handle(func(old, cur reloadable) error {
+		if old.PodCIDRMasq != cur.PodCIDRMasq {
+			masq = append(masq, cur.PodCIDRMasq)
+		}
+		return nil
+	})
+
+	// a change to the file that leaves the settings alone isn't applied
+	ioutil.WriteFile(path, []byte("coordinator-port: [\"44444\"]\nnode-name: other\n"), 0644)
+	if changed, err := r.reload(false); err != nil || len(changed) != 0 || len(ports) != 0 {
+		t.Fatalf("expected nothing applied, got %v %v %v", changed, ports, err)
+	}
+
+	ioutil.WriteFile(path, []byte("coordinator-port: [\"44446\", \"44447\"]\npod-cidr-masq: 10.0.0.0/8\n"), 0644)
+	changed, err := r.reload(false)
+	if err != nil || !reflect.DeepEqual(ports, [][]int{{44446, 44447}}) || !reflect.DeepEqual(masq, []string{"10.0.0.0/8"}) {
+		t.Fatalf("expected the new settings applied, got %v %v %v", ports, masq, err)
+	}
+	if !reflect.DeepEqual(changed, []string{"CoordinatorPorts", "PodCIDRMasq"}) {
+		t.Fatalf("expected the changed settings named, got %v", changed)
+	}
+
+	// a port that isn't one keeps the settings in use
+	ioutil.WriteFile(path, []byte("coordinator-port: [\"director\"]\npod-cidr-masq: 10.1.0.0/16\n"), 0644)
+	if _, err := r.reload(false); err == nil || len(ports) != 1 || len(masq) != 1 {
+		t.Fatalf("expected an invalid port to be refused, got %v %v %v", ports, masq, err)
+	}
+	ioutil.WriteFile(path, []byte("coordinator-port: [\"44446\", \"44447\"]\nlog-level: loud\n"), 0644)
+	if _, err := r.reload(false); err == nil || r.current.LogLevel != "info" {
+		t.Fatalf("expected an invalid log level to be refused, got %+v %v", r.current, err)
+	}
+
+	// an unchanged file is read again when forced
+	ioutil.WriteFile(path, []byte("coordinator-port: [\"44446\", \"44447\"]\nstats-port: \"9101\"\n"), 0644)
+	if _, err := r.reload(false); err != nil || r.current.StatsPort != "9101" {
+		t.Fatalf("expected the stats port applied, got %+v %v", r.current, err)
+	}
+	r.current.StatsPort = "9100"
+	if _, err := r.reload(false); err != nil || r.current.StatsPort != "9100" {
+		t.Fatalf("expected an unchanged file left alone, got %+v %v", r.current, err)
+	}
+	if _, err := r.reload(true); err != nil || r.current.StatsPort != "9101" {
+		t.Fatalf("expected a forced reload to read the file, got %+v %v", r.current, err)
+	}
+
+	// the command line wins over the file
+	flags.Set("coordinator-port", "44445")
+	ioutil.WriteFile(path, []byte("coordinator-port: [\"44448\"]\n"), 0644)
+	if _, err := r.reload(false); err != nil || !reflect.DeepEqual(ports[len(ports)-1], []int{44445}) {
+		t.Fatalf("expected the port on the command line, got %v %v", ports, err)
+	}
+}
+
+func TestCoordinatorListeners(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := logging.New()
+
+	ports := []int{}
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, ln.Addr().(*net.TCPAddr).Port)
+		ln.Close()
+	}
+	server := heartbeat.NewServer(func(heartbeat.Hello) heartbeat.Beat { return heartbeat.Beat{Identity: "node"} }, logger)
+	listeners := newCoordinatorListeners(ctx, nil, server, testCoordinationMetrics(), logger)
+
+	answers := func(port int) bool {
+		client, err := heartbeat.Dial(fmt.Sprintf("127.0.0.1:%d", port), nil, heartbeat.Hello{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		_, err = client.Beat(ctx)
+		return err == nil
+	}
+
+	if err := listeners.set(ports[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if !answers(ports[0]) || answers(ports[1]) {
+		t.Fatal("expected heartbeats answered on the first port only")
+	}
+	if err := listeners.set(ports[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if answers(ports[0]) || !answers(ports[1]) {
+		t.Fatal("expected heartbeats answered on the second port only")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// startRemoteWrite pushes the metrics to a remote-write endpoint when
+// --remote-write-url is set. Pushed series get an instance label of the node
+// name, unless one is set with --remote-write-label.
+func startRemoteWrite(config *config.Config, s *stats.Stats, logger logging.Logger) error {
+	rw := config.Stats.RemoteWrite
+	if rw.URL == "" {
+		return nil
+	}
+
+	settings := rw.Settings()
+	settings.Labels = map[string]string{"instance": config.NodeName}
+	for name, value := range rw.Labels {
+		settings.Labels[name] = value
+	}
+	if rw.PasswordFile != "" {
+		b, err := ioutil.ReadFile(rw.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("unable to read remote-write password file: %v", err)
+		}
+		settings.Password = strings.TrimSpace(string(b))
+	}
+	if rw.BearerTokenFile != "" {
+		b, err := ioutil.ReadFile(rw.BearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("unable to read remote-write bearer token file: %v", err)
+		}
+		settings.BearerToken = strings.TrimSpace(string(b))
+	}
+	if err := s.EnableRemoteWrite(settings); err != nil {
+		return fmt.Errorf("failed to initialize remote-write. %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/haproxy"
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/selfhealth"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// startSelfHealth checks the realserver's node when --self-health-interval is
+// set, and annotates the node as unhealthy while the checks fail.
+func startSelfHealth(ctx context.Context, config *config.Config, kind stats.LBKind, w *watcher.Watcher, ipt *iptables.IPTables, haproxySet *haproxy.HAProxySetManager, checks *health.Registry, logger logging.Logger) error {
+	if config.SelfHealth.Interval == 0 {
+		return nil
+	}
+	// the checks would judge the node by the production process, and the
+	// annotation would take it out of service
+	if config.DryRun {
+		logger.Warn("self-health: not annotating the node on a dry run")
+		return nil
+	}
+	m, err := selfhealth.New(w.Clientset(), config.NodeName, config.ConfigKey, config.SelfHealth.Threshold, kind, logger,
+		selfhealth.IPVS(),
+		selfhealth.IPTables(ipt),
+		selfhealth.Interface(config.Net.Interface),
+		selfhealth.HAProxy(haproxySet),
+	)
+	if err != nil {
+		return err
+	}
+	checks.Register("self-health", m.Health)
+	go m.Run(ctx, config.SelfHealth.Interval)
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// Every setting can be given three ways. The --config file, in YAML, TOML or
+// JSON by its extension, holds any flag by its name. An environment variable
+// named for the flag, such as RAVEL_ADMIN_LISTEN for --admin-listen,
+// overrides the file, and a flag on the command line overrides both. The
+// file itself can be given as RAVEL_CONFIG.
+
+// envPrefix prefixes the environment variable of each setting.
+const envPrefix = "ravel"
+
+// layerEnv has v read each setting from its environment variable, over the
+// config file.
+func layerEnv(v *viper.Viper) {
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+}
+
+// envName is the environment variable of the setting key.
+func envName(key string) string {
+	return strings.ToUpper(envPrefix + "_" + strings.Replace(key, "-", "_", -1))
+}
+
+// configType is the format of the config file at path, by its extension.
+// YAML is assumed for an extension viper doesn't read.
+func configType(path string) string {
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+	for _, supported := range []string{"json", "toml", "yaml", "yml"} {
+		if ext == supported {
+			return ext
+		}
+	}
+	return "yaml"
+}
+
+// setting is a resolved setting, and where its value came from.
+type setting struct {
+	Key    string
+	Value  interface{}
+	Source string
+}
+
+// resolveSettings returns each setting of flags as v resolves it, and
+// whether it came from a flag, the environment, the config file or the
+// default. file holds the keys of the config file, and is nil without one.
+func resolveSettings(v *viper.Viper, flags *pflag.FlagSet, file map[string]bool) []setting {
+	settings := []setting{}
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		s := setting{Key: f.Name, Source: "default"}
+		// a flag viper doesn't know, like --debug, is only read from the
+		// command line
+		if v.Get(f.Name) == nil {
+			if f.Changed {
+				s.Source = "flag"
+			}
+			s.Value = f.Value.String()
+			settings = append(settings, s)
+			return
+		}
+		switch _, env := os.LookupEnv(envName(f.Name)); {
+		case f.Changed:
+			s.Source = "flag"
+		case env:
+			s.Source = "env"
+		case file[f.Name]:
+			s.Source = "file"
+		}
+		switch f.Value.Type() {
+		case "bool":
+			s.Value = v.GetBool(f.Name)
+		case "int":
+			s.Value = v.GetInt(f.Name)
+		case "duration":
+			s.Value = v.GetDuration(f.Name).String()
+		case "stringSlice":
+			s.Value = v.GetStringSlice(f.Name)
+		case "stringToString":
+			s.Value = v.GetStringMapString(f.Name)
+		default:
+			s.Value = v.GetString(f.Name)
+		}
+		settings = append(settings, s)
+	})
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Key < settings[j].Key })
+	return settings
+}
+
+// fileKeys reads the keys set in the config file at path.
+func fileKeys(path string) (map[string]bool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	v := viper.New()
+	v.SetConfigType(configType(path))
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	keys := map[string]bool{}
+	for _, key := range v.AllKeys() {
+		keys[key] = true
+	}
+	return keys, nil
+}
+
+// writeSettings prints settings as a config file in YAML or JSON, or for
+// people with the source of each value.
+func writeSettings(w io.Writer, settings []setting, output string) error {
+	values := yaml.MapSlice{}
+	for _, s := range settings {
+		values = append(values, yaml.MapItem{Key: s.Key, Value: s.Value})
+	}
+	switch output {
+	case "yaml":
+		b, err := yaml.Marshal(values)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	case "json":
+		m := map[string]interface{}{}
+		for _, s := range settings {
+			m[s.Key] = s.Value
+		}
+		b, err := json.MarshalIndent(m, "", " ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	case "text":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		for _, s := range settings {
+			fmt.Fprintf(tw, "%s\t%v\t%s\n", s.Key, s.Value, s.Source)
+		}
+		return tw.Flush()
+	}
+	return withExitCode(exitUsage, fmt.Errorf("output must be one of yaml|json|text"))
+}
+
+// ConfigCmd works with the settings of ravel.
+func ConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "work with the settings of ravel",
+	}
+
+	var output string
+	printCmd := &cobra.Command{
+		Use:           "print",
+		Short:         "show every setting as the config file, environment and flags resolve it",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		Long: `
+print shows the value of every setting of ravel, as resolved from its default,
+the --config file, the RAVEL_ environment variables and the flags given, each
+overriding the one before. The YAML it prints by default can be used as a
+config file, -o json prints the same as JSON, and -o text also shows where
+each value came from: default, file, env or flag.
+
+Settings of a mode, such as --ipvs-sysctl, aren't shown.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			file, err := fileKeys(flagCfgFile)
+			if err != nil {
+				return withExitCode(exitInvalid, err)
+			}
+			settings := resolveSettings(viper.GetViper(), cmd.Root().PersistentFlags(), file)
+			return writeSettings(os.Stdout, settings, output)
+		},
+	}
+	printCmd.Flags().StringVarP(&output, "output", "o", "yaml", "output format. one of yaml|json|text")
+	cmd.AddCommand(printCmd)
+
+	return cmd
+}
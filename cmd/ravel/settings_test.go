@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+func TestResolveSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ravel.toml")
+	ioutil.WriteFile(path, []byte("admin-listen = \"127.0.0.1:10235\"\nprobe-interval = \"3s\"\nstats-enabled = true\n"), 0644)
+
+	flags := pflag.NewFlagSet("ravel", pflag.ContinueOnError)
+	flags.String("admin-listen", "", "")
+	flags.Duration("probe-interval", 0, "")
+	flags.Bool("stats-enabled", false, "")
+	flags.StringSlice("canary-vips", nil, "")
+	flags.String("log-level", "info", "")
+
+	v := viper.New()
+	for _, name := range []string{"admin-listen", "probe-interval", "stats-enabled", "canary-vips", "log-level"} {
+		v.BindPFlag(name, flags.Lookup(name))
+	}
+	layerEnv(v)
+	v.SetConfigType(configType(path))
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("RAVEL_STATS_ENABLED", "false")
+	os.Setenv("RAVEL_CANARY_VIPS", "10.0.0.1 10.0.0.2")
+	defer os.Unsetenv("RAVEL_STATS_ENABLED")
+	defer os.Unsetenv("RAVEL_CANARY_VIPS")
+	flags.Parse([]string{"--admin-listen", "127.0.0.1:10236"})
+
+	file, err := fileKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []setting{
+		{Key: "admin-listen", Value: "127.0.0.1:10236", Source: "flag"},
+		{Key: "canary-vips", Value: []string{"10.0.0.1", "10.0.0.2"}, Source: "env"},
+		{Key: "log-level", Value: "info", Source: "default"},
+		{Key: "probe-interval", Value: (3 * time.Second).String(), Source: "file"},
+		{Key: "stats-enabled", Value: false, Source: "env"},
+	}
+	if got := resolveSettings(v, flags, file); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected\n%v\ngot\n%v", expected, got)
+	}
+}
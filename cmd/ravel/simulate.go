@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/simulate"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// listCluster takes the listing of the cluster that a watcher of config
+// would hold.
+func listCluster(ctx context.Context, config *config.Config, logger logging.Logger) (*watcher.Watcher, error) {
+	kubeConfig, err := clientcmd.BuildConfigFromFlags("", config.KubeConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	services, err := client.CoreV1().Services("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list services. %v", err)
+	}
+	endpoints, err := client.CoreV1().Endpoints("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list endpoints. %v", err)
+	}
+	pods, err := client.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pods. %v", err)
+	}
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list nodes. %v", err)
+	}
+	w := watcher.NewStaticWatcher(config.ConfigKey, config.DefaultListener.Service, config.DefaultListener.Port, services.Items, endpoints.Items, pods.Items, nodes.Items, logger)
+	w.SetStrict(config.StrictConfig)
+	return w, nil
+}
+
+// simulateHelpers returns the helpers of mode, configured as the mode
+// configures them.
+func simulateHelpers(ctx context.Context, mode string, config *config.Config, logger logging.Logger) (simulate.Helpers, error) {
+	ownership := config.Ownership()
+	ip, err := system.NewIP(ctx, config.Net.LocalInterface, config.Net.Gateway, config.Arp.LoAnnounce, config.Arp.LoIgnore, logger)
+	if err != nil {
+		return simulate.Helpers{}, err
+	}
+	ip.Own(ownership)
+	ipvs, err := system.NewIPVS(ctx, config.Net.PrimaryIP, config.IPVS.WeightOverride, config.IPVS.IgnoreCordon, logger, mode)
+	if err != nil {
+		return simulate.Helpers{}, err
+	}
+	if err := ipvs.Own(ownership); err != nil {
+		return simulate.Helpers{}, err
+	}
+	ipt, err := iptables.NewIPTables(ctx, mode, config.ConfigKey, config.PodCIDRMasq, config.IPTablesChain, config.IPTablesMasq, logger)
+	if err != nil {
+		return simulate.Helpers{}, err
+	}
+	return simulate.Helpers{IP: ip, IPVS: ipvs, IPTables: ipt}, nil
+}
+
+// Simulate shows what a candidate configmap would change on a node.
+func Simulate(ctx context.Context, logger logging.Logger) *cobra.Command {
+	var (
+		state  string
+		base   string
+		output string
+	)
+
+	var cmd = &cobra.Command{
+		Use:           "simulate <bgp|director|realserver> <file>",
+		Short:         "show what a candidate configmap would change on a node",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.ExactArgs(2),
+		Long: `
+simulate works out the changes a mode would make to a node to bring it to the
+config-key of a candidate configmap, without making any, so that the blast
+radius of a config change can be reviewed before it is merged: the ipvs rules
+it would add, update and delete, the VIP devices it would add and remove, the
+iptables chains it would restore and the bgp routes it would announce. It
+generates and merges them with the same code as a reconfigure of the mode,
+as --nodename, and with the same settings.
+
+The configmap is read from file, a manifest in YAML or JSON, or - for stdin.
+The services, endpoints, pods and nodes it is applied to are listed from the
+cluster using --kubeconfig. The state of the node is read from this node, or
+with --state from a support bundle of ravel diagnose taken on the node to
+simulate. bgp directors that shard their VIPs announce only their share,
+which isn't simulated, and no mode withdraws the routes of VIPs that are gone.
+
+With --base, the configmap the candidate replaces, such as the one in
+production, the VIPs and ports the candidate adds and removes and the
+options and settings it modifies are listed first, as changes of config.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config := NewConfig(cmd.Flags())
+			mode := args[0]
+			if simulate.Subsystems(mode) == nil {
+				return withExitCode(exitUsage, fmt.Errorf("unknown mode %s. must be one of bgp|director|realserver", mode))
+			}
+			if err := checkOutput(output); err != nil {
+				return err
+			}
+			cm, err := readConfigMap(args[1])
+			if err != nil {
+				return err
+			}
+
+			var s simulate.State
+			if state != "" {
+				f, err := os.Open(state)
+				if err != nil {
+					return err
+				}
+				s, err = simulate.ReadBundle(f)
+				f.Close()
+				if err != nil {
+					return fmt.Errorf("unable to read the state of the node from %s. %v", state, err)
+				}
+			} else if s, err = simulate.Live(ctx, mode, config.BGP.Binary); err != nil {
+				return fmt.Errorf("unable to read the state of this node. %v", err)
+			}
+
+			w, err := listCluster(ctx, config, logger)
+			if err != nil {
+				return err
+			}
+			cc, err := w.Build(cm)
+			if err != nil {
+				return withExitCode(exitInvalid, err)
+			}
+			if cc == nil {
+				return withExitCode(exitInvalid, fmt.Errorf("config key '%s' of %s is empty", config.ConfigKey, args[1]))
+			}
+			helpers, err := simulateHelpers(ctx, mode, config, logger)
+			if err != nil {
+				return err
+			}
+			changes, err := simulate.Plan(mode, config.NodeName, s, w, cc, helpers)
+			if err != nil {
+				return err
+			}
+			subsystems := simulate.Subsystems(mode)
+			if base != "" {
+				baseCM, err := readConfigMap(base)
+				if err != nil {
+					return err
+				}
+				from, err := types.NewClusterConfig(baseCM, config.ConfigKey)
+				if err != nil {
+					return withExitCode(exitInvalid, fmt.Errorf("%s: %v", base, err))
+				}
+				to, err := types.NewClusterConfig(cm, config.ConfigKey)
+				if err != nil {
+					return withExitCode(exitInvalid, fmt.Errorf("%s: %v", args[1], err))
+				}
+				changes = append(simulate.ConfigChanges(from, to), changes...)
+				subsystems = append([]string{simulate.SubsystemConfig}, subsystems...)
+			}
+
+			return writeOutput(os.Stdout, output, changes, func(w io.Writer) error {
+				counts := map[string]int{}
+				for _, change := range changes {
+					fmt.Fprintln(w, change)
+					counts[change.Subsystem]++
+				}
+				summary := []string{}
+				for _, subsystem := range subsystems {
+					summary = append(summary, fmt.Sprintf("%d %s", counts[subsystem], subsystem))
+				}
+				_, err := fmt.Fprintf(w, "%d changes: %s\n", len(changes), strings.Join(summary, ", "))
+				return err
+			})
+		},
+	}
+	cmd.Flags().StringVar(&state, "state", "", "a support bundle of ravel diagnose to read the state of the node from, instead of this node")
+	cmd.Flags().StringVar(&base, "base", "", "the configmap the candidate replaces, to list the changes of its config-key first")
+	outputFlag(cmd.Flags(), &output)
+
+	return cmd
+}
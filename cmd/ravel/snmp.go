@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/snmp"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// peerSource returns the state of each bgp peer by address. It is nil in the
+// modes that don't speak bgp.
+type peerSource func(ctx context.Context) (map[string]string, error)
+
+// startSNMP registers the load balancer with the host's snmpd when
+// --snmp-agentx is set. Traffic is only reported when stats are enabled.
+func startSNMP(ctx context.Context, config *config.Config, kind stats.LBKind, w *watcher.Watcher, s *stats.Stats, ipvs *system.IPVS, peers peerSource, logger logging.Logger) error {
+	if config.SNMP.Master == "" {
+		return nil
+	}
+	root, err := snmp.ParseOID(config.SNMP.Root)
+	if err != nil {
+		return err
+	}
+
+	source := func(ctx context.Context) (snmp.Snapshot, error) {
+		snap := snmp.Snapshot{Kind: string(kind)}
+		var errs []string
+
+		var traffic []stats.VIPTraffic
+		if config.Stats.Enabled {
+			traffic = s.Traffic()
+		}
+		backends, err := ipvs.Backends()
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		snap.VIPs = snmpVIPs(w.ClusterConfig, traffic, backends)
+
+		if peers != nil {
+			states, err := peers(ctx)
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+			for addr, state := range states {
+				snap.Peers = append(snap.Peers, snmp.Peer{Addr: net.ParseIP(addr), State: state})
+			}
+		}
+
+		// a partial snapshot is still served; the error is only logged.
+		if len(errs) > 0 {
+			return snap, fmt.Errorf("%s", strings.Join(errs, "; "))
+		}
+		return snap, nil
+	}
+
+	agent, err := snmp.New(snmp.Config{
+		Master:   config.SNMP.Master,
+		Root:     root,
+		CacheTTL: config.SNMP.CacheTTL,
+	}, source, logger)
+	if err != nil {
+		return err
+	}
+	go agent.Run(ctx)
+	return nil
+}
+
+// snmpVIPs lists a row for each VIP, port and enabled protocol in the config,
+// including the v6 addresses of VIPs, joined with their traffic and the real
+// servers configured for them in ipvs.
+func snmpVIPs(c *types.ClusterConfig, traffic []stats.VIPTraffic, backends map[string]int) []snmp.VIP {
+	if c == nil {
+		return nil
+	}
+
+	totals := map[string]stats.VIPTraffic{}
+	for _, t := range traffic {
+		totals[snmpKey(strings.ToLower(t.Protocol), t.VIP, strconv.Itoa(t.Port))] = t
+	}
+
+	vips := []snmp.VIP{}
+	add := func(ip, port string, cfg *types.ServiceDef) {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return
+		}
+		for _, proto := range []string{"tcp", "udp"} {
+			if (proto == "tcp" && !cfg.TCPEnabled) || (proto == "udp" && !cfg.UDPEnabled) {
+				continue
+			}
+			key := snmpKey(proto, ip, port)
+			t := totals[key]
+			vips = append(vips, snmp.VIP{
+				Addr:       net.ParseIP(ip),
+				Port:       p,
+				Protocol:   proto,
+				Namespace:  cfg.Namespace,
+				Service:    cfg.Service,
+				PortName:   cfg.PortName,
+				InOctets:   t.RxBytes,
+				OutOctets:  t.TxBytes,
+				InPackets:  t.RxPackets,
+				OutPackets: t.TxPackets,
+				Backends:   backends[key],
+			})
+		}
+	}
+	for ip, portMap := range c.Config {
+		ip6, has6 := c.IPV6[ip]
+		for port, cfg := range portMap {
+			add(string(ip), port, cfg)
+			if has6 {
+				add(ip6, port, cfg)
+			}
+		}
+	}
+	for ip, portMap := range c.Config6 {
+		for port, cfg := range portMap {
+			add(string(ip), port, cfg)
+		}
+	}
+	return vips
+}
+
+// snmpKey matches the keys of system.IPVS.Backends.
+func snmpKey(proto, ip, port string) string {
+	return proto + " " + net.JoinHostPort(ip, port)
+}
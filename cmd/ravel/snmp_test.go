@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+func TestSNMPVIPs(t *testing.T) {
+	c := &types.ClusterConfig{
+		IPV6: map[types.ServiceIP]string{"10.54.213.10": "2001:db8::10"},
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.10": {
+				"80": {Namespace: "ns", Service: "web", PortName: "http", TCPEnabled: true},
+				"53": {Namespace: "ns", Service: "dns", PortName: "dns", TCPEnabled: true, UDPEnabled: true},
+			},
+		},
+	}
+	traffic := []stats.VIPTraffic{{VIP: "10.54.213.10", Port: 80, Protocol: "TCP", RxBytes: 100, TxPackets: 3}}
+	backends := map[string]int{"tcp 10.54.213.10:80": 4, "udp [2001:db8::10]:53": 2}
+
+	vips := snmpVIPs(c, traffic, backends)
+	if len(vips) != 6 {
+		t.Fatalf("expected a row per address, port and enabled protocol, got %d", len(vips))
+	}
+	found := 0
+	for _, v := range vips {
+		switch {
+		case v.Addr.String() == "10.54.213.10" && v.Port == 80:
+			found++
+			if v.Protocol != "tcp" || v.InOctets != 100 || v.OutPackets != 3 || v.Backends != 4 || v.Service != "web" {
+				t.Fatalf("unexpected row %+v", v)
+			}
+		case v.Addr.String() == "2001:db8::10" && v.Port == 53 && v.Protocol == "udp":
+			found++
+			if v.Backends != 2 || v.InOctets != 0 {
+				t.Fatalf("unexpected row %+v", v)
+			}
+		}
+	}
+	if found != 2 {
+		t.Fatalf("expected to find both rows, found %d", found)
+	}
+
+	if vips := snmpVIPs(nil, nil, nil); vips != nil {
+		t.Fatalf("expected no rows without a config, got %v", vips)
+	}
+}
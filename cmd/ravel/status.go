@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/util"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// roleChecks are the health checks whose messages say what part a process
+// plays, such as whether a vrrp director is master.
+var roleChecks = []string{"vrrp", "colocation", "membership", "maintenance"}
+
+// daemonStatus is the state of a running ravel, as the status command shows
+// it.
+type daemonStatus struct {
+	Mode      string `json:"mode"`
+	Node      string `json:"node"`
+	ConfigKey string `json:"configKey"`
+	Ready     bool   `json:"ready"`
+	// Role has the message of each of the roleChecks that runs
+	Role       map[string]string `json:"role,omitempty"`
+	ConfigHash string            `json:"configHash"`
+	VIPs       int               `json:"vips"`
+	VIPs6      int               `json:"vips6"`
+	// Reconcile has the last reconcile and parity check of each worker
+	Reconcile map[string]health.ReconcileDetail `json:"reconcile,omitempty"`
+	BGPPeers  map[string]string                 `json:"bgpPeers,omitempty"`
+	// Unready has the message of each check that isn't ready
+	Unready map[string]string `json:"unready,omitempty"`
+}
+
+// statusHandler serves /status on the admin endpoint, put together from the
+// health checks of the mode and the cluster config of the watcher.
+func statusHandler(config *config.Config, kind stats.LBKind, w *watcher.Watcher, checks *health.Registry) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ready, statuses := checks.Check(req.Context())
+		out := daemonStatus{
+			Mode:       string(kind),
+			Node:       config.NodeName,
+			ConfigKey:  config.ConfigKey,
+			Ready:      ready,
+			ConfigHash: w.ConfigHash(),
+			VIPs:       w.ConfigIPCount(),
+			VIPs6:      w.ConfigIPCount6(),
+			Role:       map[string]string{},
+			Reconcile:  map[string]health.ReconcileDetail{},
+			Unready:    map[string]string{},
+		}
+		for _, name := range roleChecks {
+			if status, ok := statuses[name]; ok {
+				out.Role[name] = status.Message
+			}
+		}
+		for name, status := range statuses {
+			if detail, ok := status.Detail.(health.ReconcileDetail); ok {
+				out.Reconcile[name] = detail
+			}
+			if !status.Ready {
+				out.Unready[name] = status.Message
+			}
+		}
+		if peers, ok := statuses["bgp-peers"].Detail.(map[string]string); ok {
+			out.BGPPeers = peers
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		b, _ := json.MarshalIndent(out, "", " ")
+		rw.Write(b)
+	})
+}
+
+// startStatusSocket serves the health endpoints and /status of a mode on
+// --status-socket, if it is set.
+func startStatusSocket(ctx context.Context, config *config.Config, kind stats.LBKind, w *watcher.Watcher, checks *health.Registry, logger logging.Logger) error {
+	if config.Admin.StatusSocket == "" {
+		return nil
+	}
+	mux := util.HealthHandler(config.Net.Interface, checks, logger)
+	mux.Handle("/status", statusHandler(config, kind, w, checks))
+	return util.ListenForHealthSocket(ctx, config.Admin.StatusSocket, mux, logger)
+}
+
+// socketRequest gets path from the status socket of the ravel on this node,
+// and copies the response body to out.
+func socketRequest(socket, path string, out io.Writer) error {
+	client := &http.Client{
+		Timeout: adminTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	resp, err := client.Get("http://ravel" + path)
+	if err != nil {
+		return withExitCode(exitTransient, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return withExitCode(adminExitCode(resp.StatusCode), fmt.Errorf("GET %s: %s", path, strings.TrimSpace(string(b))))
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+// writeStatus prints a status for people.
+func writeStatus(w io.Writer, s daemonStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	ready := "yes"
+	if !s.Ready {
+		ready = "no"
+	}
+	fmt.Fprintf(tw, "mode:\t%s on node %s, config key %s\n", s.Mode, s.Node, s.ConfigKey)
+	fmt.Fprintf(tw, "ready:\t%s\n", ready)
+	for _, name := range sortedKeys(s.Role) {
+		fmt.Fprintf(tw, "%s:\t%s\n", name, s.Role[name])
+	}
+	fmt.Fprintf(tw, "config:\t%d v4 VIPs, %d v6 VIPs, hash %s\n", s.VIPs, s.VIPs6, s.ConfigHash)
+
+	for _, name := range sortedKeys(s.Reconcile) {
+		r := s.Reconcile[name]
+		last := "none yet"
+		switch {
+		case r.Error != "":
+			last = fmt.Sprintf("failed at %s: %s", r.Last, r.Error)
+		case r.Last != "":
+			last = "succeeded at " + r.Last
+		}
+		fmt.Fprintf(tw, "%s reconcile:\t%s, %d in all\n", name, last, r.Reconciles)
+		if r.Parity != nil {
+			parity := "in sync"
+			if !*r.Parity {
+				parity = "out of sync"
+			}
+			fmt.Fprintf(tw, "%s parity:\t%s at %s\n", name, parity, r.ParityChecked)
+		}
+	}
+
+	for _, peer := range sortedKeys(s.BGPPeers) {
+		fmt.Fprintf(tw, "bgp peer %s:\t%s\n", peer, s.BGPPeers[peer])
+	}
+	for _, name := range sortedKeys(s.Unready) {
+		fmt.Fprintf(tw, "unready %s:\t%s\n", name, s.Unready[name])
+	}
+	return tw.Flush()
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch m := m.(type) {
+	case map[string]string:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]health.ReconcileDetail:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Status shows the state of the ravel running on this node.
+func Status() *cobra.Command {
+	var output string
+
+	var cmd = &cobra.Command{
+		Use:           "status",
+		Short:         "show the state of the ravel running on this node",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		Long: `
+status asks the ravel on this node for its mode and role, the VIPs of its
+cluster config, the outcome of its last reconcile and parity check, the
+states of its bgp peers, and whatever isn't ready. It asks over
+--status-socket if it is set, and otherwise the admin endpoint, using
+--admin-listen and --admin-token-file. It exits non-zero if the process
+isn't ready.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if err := checkOutput(output); err != nil {
+				return err
+			}
+			config := NewConfig(cmd.Flags())
+			b := &bytes.Buffer{}
+			request := func() error { return adminRequest(config, http.MethodGet, "/status", nil, b) }
+			if config.Admin.StatusSocket != "" {
+				request = func() error { return socketRequest(config.Admin.StatusSocket, "/status", b) }
+			}
+			if err := request(); err != nil {
+				return err
+			}
+			s := daemonStatus{}
+			if err := json.Unmarshal(b.Bytes(), &s); err != nil {
+				return fmt.Errorf("invalid status. %v", err)
+			}
+
+			if err := writeOutput(os.Stdout, output, s, func(w io.Writer) error { return writeStatus(w, s) }); err != nil {
+				return err
+			}
+			if !s.Ready {
+				return withExitCode(exitUnhealthy, fmt.Errorf("ravel is not ready: %s", strings.Join(sortedKeys(s.Unready), ", ")))
+			}
+			return nil
+		},
+	}
+	outputFlag(cmd.Flags(), &output)
+
+	return cmd
+}
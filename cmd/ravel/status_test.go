@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+func TestStatus(t *testing.T) {
+	checks := health.NewRegistry()
+	var reconcile health.Reconcile
+	reconcile.Record(errors.New("ipvsadm failed"))
+	reconcile.Parity(true)
+	checks.Register("bgp", reconcile.Status)
+	checks.Register("bgp-peers", func(context.Context) health.Status {
+		return health.Status{Ready: true, Detail: map[string]string{"10.0.0.1": "Establ"}}
+	})
+	checks.Register("maintenance", func(context.Context) health.Status {
+		return health.Status{Ready: true, Message: "in service"}
+	})
+
+	config := &config.Config{NodeName: "node-1", ConfigKey: "prod"}
+	rec := httptest.NewRecorder()
+	statusHandler(config, stats.KindBGPDirector, &watcher.Watcher{}, checks).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	s := daemonStatus{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Ready || s.Mode != "bgp" || s.Role["maintenance"] != "in service" || s.BGPPeers["10.0.0.1"] != "Establ" || s.Unready["bgp"] != "last reconcile failed" {
+		t.Fatalf("unexpected status %+v", s)
+	}
+	if r := s.Reconcile["bgp"]; r.Error != "ipvsadm failed" || r.Parity == nil || !*r.Parity {
+		t.Fatalf("expected the reconcile and parity of the bgp worker, got %+v", r)
+	}
+
+	b := &bytes.Buffer{}
+	if err := writeStatus(b, s); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"ready:", "bgp reconcile:", "failed at", "bgp parity:", "in sync", "bgp peer 10.0.0.1:", "unready bgp:"} {
+		if !strings.Contains(b.String(), line) {
+			t.Fatalf("expected %q in\n%s", line, b.String())
+		}
+	}
+}
+
+func TestStatusSocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	checks := health.NewRegistry()
+	checks.Register("watcher", func(context.Context) health.Status {
+		return health.Status{Ready: false, Message: "no config yet"}
+	})
+	config := &config.Config{NodeName: "node-1", ConfigKey: "prod"}
+	config.Admin.StatusSocket = filepath.Join(t.TempDir(), "status.sock")
+	if err := startStatusSocket(ctx, config, stats.KindIpvsBackend, &watcher.Watcher{}, checks, logging.New()); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &bytes.Buffer{}
+	if err := socketRequest(config.Admin.StatusSocket, "/status", b); err != nil {
+		t.Fatal(err)
+	}
+	s := daemonStatus{}
+	if err := json.Unmarshal(b.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Mode != string(stats.KindIpvsBackend) || s.Ready || s.Unready["watcher"] != "no config yet" {
+		t.Fatalf("unexpected status %+v", s)
+	}
+	if err := socketRequest(config.Admin.StatusSocket, "/readyz", &bytes.Buffer{}); exitCodeOf(err) != exitTransient {
+		t.Fatalf("expected an unready process to be a transient failure, got %v", err)
+	}
+	if err := socketRequest(config.Admin.StatusSocket, "/healthz", &bytes.Buffer{}); err != nil {
+		t.Fatalf("expected a live process, got %v", err)
+	}
+}
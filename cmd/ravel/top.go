@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// topUpdates is the number of recent publishes top shows.
+const topUpdates = 5
+
+// topSnapshot is what top reads from the admin endpoint in one refresh.
+type topSnapshot struct {
+	Time     time.Time               `json:"time"`
+	Status   *daemonStatus           `json:"status,omitempty"`
+	Services []system.VirtualService `json:"services,omitempty"`
+	Nodes    []watcher.NodeState     `json:"nodes,omitempty"`
+	Changes  []watcher.Publication   `json:"changes,omitempty"`
+	// Errors has what couldn't be read, by endpoint
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// readTop reads a snapshot from the admin endpoint. What can't be read is
+// left out and reported in Errors, as a realserver has no ipvs services to
+// show and a director being restarted has nothing at all.
+func readTop(config *config.Config) topSnapshot {
+	s := topSnapshot{Time: time.Now(), Status: &daemonStatus{}, Errors: map[string]string{}}
+	read := func(path string, q url.Values, into interface{}) bool {
+		b := &bytes.Buffer{}
+		err := adminRequest(config, http.MethodGet, path, q, b)
+		if err == nil {
+			err = json.Unmarshal(b.Bytes(), into)
+		}
+		if err != nil {
+			s.Errors[path] = err.Error()
+		}
+		return err == nil
+	}
+	if !read("/status", nil, s.Status) {
+		s.Status = nil
+	}
+	read("/ipvs/services", nil, &s.Services)
+	read("/nodes", nil, &s.Nodes)
+	read("/changes", url.Values{"limit": {strconv.Itoa(topUpdates)}}, &s.Changes)
+	return s
+}
+
+// writeTop prints a snapshot: the status of the process, the traffic to each
+// VIP, the weight and health of each real server, and the publishes that led
+// to the recent reconfigures.
+func writeTop(w io.Writer, s topSnapshot) error {
+	fmt.Fprintf(w, "ravel top at %s\n", s.Time.Format("15:04:05"))
+	if s.Status != nil {
+		if err := writeStatus(w, *s.Status); err != nil {
+			return err
+		}
+	}
+	for _, path := range sortedKeys(s.Errors) {
+		fmt.Fprintf(w, "unable to read %s: %s\n", path, s.Errors[path])
+	}
+
+	if len(s.Services) > 0 {
+		fmt.Fprintln(w)
+		writeVIPs(w, s.Services)
+		fmt.Fprintln(w)
+		writeRealServers(w, s.Services, s.Nodes)
+	}
+
+	if len(s.Changes) > 0 {
+		fmt.Fprintln(w)
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "UPDATED\tKIND\tUPDATES\tCORRELATION ID")
+		for ix := len(s.Changes) - 1; ix >= 0; ix-- {
+			p := s.Changes[ix]
+			updates := []string{}
+			for _, u := range p.Updates {
+				name := u.Name
+				if u.Namespace != "" {
+					name = u.Namespace + "/" + u.Name
+				}
+				updates = append(updates, fmt.Sprintf("%s %s", u.Source, name))
+			}
+			if len(updates) > 3 {
+				updates = append(updates[:3], fmt.Sprintf("and %d more", len(p.Updates)-3))
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p.Time.Format("15:04:05"), p.Kind, strings.Join(updates, ", "), p.CorrelationID)
+		}
+		tw.Flush()
+	}
+	return nil
+}
+
+// writeVIPs prints the traffic to each VIP, busiest first.
+func writeVIPs(w io.Writer, services []system.VirtualService) {
+	type vip struct {
+		addr     string
+		services int
+		rate     system.Rate
+	}
+	byVIP := map[string]*vip{}
+	for _, svc := range services {
+		v, ok := byVIP[svc.VIP]
+		if !ok {
+			v = &vip{addr: svc.VIP}
+			byVIP[svc.VIP] = v
+		}
+		v.services++
+		v.rate.CPS += svc.Rate.CPS
+		v.rate.InBPS += svc.Rate.InBPS
+		v.rate.OutBPS += svc.Rate.OutBPS
+	}
+	vips := []*vip{}
+	for _, v := range byVIP {
+		vips = append(vips, v)
+	}
+	sort.Slice(vips, func(i, j int) bool {
+		if vips[i].rate.CPS != vips[j].rate.CPS {
+			return vips[i].rate.CPS > vips[j].rate.CPS
+		}
+		return vips[i].addr < vips[j].addr
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "VIP\tSERVICES\tCONN/S\tIN B/S\tOUT B/S")
+	for _, v := range vips {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", v.addr, v.services, v.rate.CPS, humanRate(v.rate.InBPS), humanRate(v.rate.OutBPS))
+	}
+	tw.Flush()
+}
+
+// writeRealServers prints the weight, health and traffic of each real server
+// across the services it is in, with the weights the config wants where they
+// differ from those programmed.
+func writeRealServers(w io.Writer, services []system.VirtualService, nodes []watcher.NodeState) {
+	type realServer struct {
+		addr   string
+		cps    int64
+		weight map[string]bool
+		wants  map[string]bool
+	}
+	byAddr := map[string]*realServer{}
+	for _, svc := range services {
+		for _, dst := range svc.Destinations {
+			addr, _, err := net.SplitHostPort(dst.Address)
+			if err != nil {
+				addr = dst.Address
+			}
+			rs, ok := byAddr[addr]
+			if !ok {
+				rs = &realServer{addr: addr, weight: map[string]bool{}, wants: map[string]bool{}}
+				byAddr[addr] = rs
+			}
+			rs.cps += dst.Rate.CPS
+			rs.weight[strconv.Itoa(dst.Weight)] = true
+			switch {
+			case !svc.Owned:
+			case dst.Want == nil:
+				rs.wants["none"] = true
+			case *dst.Want != dst.Weight:
+				rs.wants[strconv.Itoa(*dst.Want)] = true
+			}
+		}
+	}
+	addrs := []string{}
+	for addr := range byAddr {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "REAL SERVER\tNODE\tSTATE\tWEIGHT\tCONN/S")
+	for _, addr := range addrs {
+		rs := byAddr[addr]
+		name, state := nodeState(addr, nodes)
+		weight := strings.Join(setKeys(rs.weight), ",")
+		if len(rs.wants) > 0 {
+			weight += " (config wants " + strings.Join(setKeys(rs.wants), ",") + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n", addr, name, state, weight, rs.cps)
+	}
+	tw.Flush()
+}
+
+// nodeState returns the name and state of the node with addr.
+func nodeState(addr string, nodes []watcher.NodeState) (string, string) {
+	ip := net.ParseIP(addr)
+	for _, n := range nodes {
+		for _, a := range append(n.Addresses, n.IPV6) {
+			if ip == nil || !ip.Equal(net.ParseIP(a)) {
+				continue
+			}
+			switch {
+			case n.Maintenance != "":
+				return n.Name, "maintenance"
+			case n.Unhealthy != "":
+				return n.Name, "unhealthy"
+			case !n.Ready:
+				return n.Name, "not ready"
+			case n.Unschedulable:
+				return n.Name, "cordoned"
+			}
+			return n.Name, "ready"
+		}
+	}
+	return "-", "unknown"
+}
+
+func setKeys(m map[string]bool) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// humanRate prints a rate in bytes with a K, M or G suffix.
+func humanRate(n int64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.1fG", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1fM", float64(n)/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1fK", float64(n)/1e3)
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// Top shows a live view of the ravel running on this node.
+func Top(ctx context.Context) *cobra.Command {
+	var (
+		interval time.Duration
+		once     bool
+		output   string
+	)
+
+	var cmd = &cobra.Command{
+		Use:          "top",
+		Short:        "show a live view of the ravel running on this node",
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		Long: `
+top refreshes a view of the ravel on this node every --interval from its
+admin endpoint, using --admin-listen and --admin-token-file: its status, bgp
+peers and last reconcile, the connection rate and traffic to each VIP, the
+weight and health of each real server, and the updates behind the recent
+reconfigures. Press q to quit, p to pause and resume the refreshes, and r to
+refresh at once. With --once, -o json or yaml, or when not run in a terminal,
+the view is printed once.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			config := NewConfig(cmd.Flags())
+			if interval <= 0 {
+				return withExitCode(exitUsage, fmt.Errorf("interval must be greater than 0"))
+			}
+			if err := checkOutput(output); err != nil {
+				return err
+			}
+			in, out := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+			if once || output != "text" || !term.IsTerminal(in) || !term.IsTerminal(out) {
+				s := readTop(config)
+				return writeOutput(os.Stdout, output, s, func(w io.Writer) error { return writeTop(w, s) })
+			}
+
+			state, err := term.MakeRaw(in)
+			if err != nil {
+				return err
+			}
+			defer term.Restore(in, state)
+			// the alternate screen leaves the terminal as it was on quitting
+			fmt.Print("\x1b[?1049h\x1b[?25l")
+			defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+			keys := make(chan byte)
+			go func() {
+				defer close(keys)
+				b := make([]byte, 1)
+				for {
+					if _, err := os.Stdin.Read(b); err != nil {
+						return
+					}
+					keys <- b[0]
+				}
+			}()
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			var s topSnapshot
+			refresh, paused := true, false
+			for {
+				if refresh {
+					s = readTop(config)
+				}
+				help := "q quits, p pauses, r refreshes"
+				if paused {
+					help = "paused. q quits, p resumes, r refreshes"
+				}
+				b := &bytes.Buffer{}
+				writeTop(b, s)
+				fmt.Fprintln(b, help)
+				draw(os.Stdout, b.String(), out)
+
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-ticker.C:
+					refresh = !paused
+				case k, ok := <-keys:
+					if !ok {
+						return nil
+					}
+					refresh = false
+					switch k {
+					case 'q', 3: // ctrl-c doesn't signal in raw mode
+						return nil
+					case 'p':
+						paused = !paused
+						refresh = !paused
+					case 'r':
+						refresh = true
+					}
+				}
+			}
+		},
+	}
+	cmd.Flags().DurationVar(&interval, "interval", 2*time.Second, "how often to refresh the view")
+	cmd.Flags().BoolVar(&once, "once", false, "print the view once and exit")
+	outputFlag(cmd.Flags(), &output)
+
+	return cmd
+}
+
+// draw replaces the screen with view, cut to the size of the terminal fd.
+func draw(w io.Writer, view string, fd int) {
+	lines := strings.Split(strings.TrimRight(view, "\n"), "\n")
+	if width, height, err := term.GetSize(fd); err == nil {
+		if height > 1 && len(lines) > height {
+			// the help line stays in view
+			lines = append(lines[:height-1], lines[len(lines)-1])
+		}
+		for ix, line := range lines {
+			if len(line) > width {
+				lines[ix] = line[:width]
+			}
+		}
+	}
+	// raw mode doesn't return the carriage at the end of a line
+	fmt.Fprint(w, "\x1b[H\x1b[2J"+strings.Join(lines, "\r\n"))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+func TestTop(t *testing.T) {
+	want := 1
+	s := topSnapshot{
+		Time:   time.Now(),
+		Status: &daemonStatus{Mode: "bgp", Node: "lb01", ConfigKey: "prod", Ready: true, BGPPeers: map[string]string{"10.0.0.1": "Establ"}},
+		Services: []system.VirtualService{
+			{Protocol: "tcp", VIP: "10.54.213.148", Port: "80", Owned: true, Wanted: true, Rate: system.Rate{CPS: 3, InBPS: 1500}, Destinations: []system.Destination{
+				{Address: "10.131.153.76:80", Weight: 1, Want: &want, Rate: system.Rate{CPS: 3}},
+				{Address: "10.131.153.77:80", Weight: 0, Want: &want},
+			}},
+			{Protocol: "tcp", VIP: "10.54.213.149", Port: "80", Owned: true, Wanted: true, Rate: system.Rate{CPS: 40}},
+		},
+		Nodes: []watcher.NodeState{
+			{Name: "lb01", Addresses: []string{"10.131.153.76"}, Ready: true},
+			{Name: "lb02", Addresses: []string{"10.131.153.77"}, Ready: true, Maintenance: "kernel upgrade"},
+		},
+		Changes: []watcher.Publication{{Kind: "config", CorrelationID: "abc123", Updates: []watcher.Update{{Source: "endpoints", Namespace: "web", Name: "frontend"}}}},
+		Errors:  map[string]string{},
+	}
+
+	b := &bytes.Buffer{}
+	if err := writeTop(b, s); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, line := range []string{"bgp peer 10.0.0.1:", "endpoints web/frontend", "1.5K", "maintenance  0 (config wants 1)"} {
+		if !strings.Contains(out, line) {
+			t.Fatalf("expected %q in\n%s", line, out)
+		}
+	}
+	// the busiest VIP comes first
+	if strings.Index(out, "10.54.213.149") > strings.Index(out, "10.54.213.148") {
+		t.Fatalf("expected 10.54.213.149 before 10.54.213.148 in\n%s", out)
+	}
+}
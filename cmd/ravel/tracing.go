@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/tracing"
+)
+
+// startTracing sets up OTLP span export for the reconfigure pipeline when
+// --otlp-endpoint is set. The returned function flushes outstanding spans and
+// is safe to call when tracing is disabled.
+func startTracing(ctx context.Context, config *config.Config, lbKind string, logger logging.Logger) (func(), error) {
+	shutdown, err := tracing.Init(ctx, config.Tracing.Endpoint, config.Tracing.Insecure, config.Tracing.SampleRatio, lbKind, config.NodeName, logger)
+	if err != nil {
+		return func() {}, err
+	}
+	return func() {
+		// the parent context is already canceled by the time we flush
+		flushCtx, cxl := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cxl()
+		if err := shutdown(flushCtx); err != nil {
+			logger.Warnf("tracing: error flushing spans on shutdown: %v", err)
+		}
+	}, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/Comcast/Ravel/pkg/validate"
+)
+
+// validation is what validate found, as it prints it.
+type validation struct {
+	// Configs are the keys of the cluster configs checked
+	Configs  []string        `json:"configs"`
+	Problems []configProblem `json:"problems"`
+}
+
+// configProblem is a problem of the cluster config of a key.
+type configProblem struct {
+	Key     string `json:"key"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// writeValidation prints what validate found for people.
+func writeValidation(w io.Writer, v validation) error {
+	for _, p := range v.Problems {
+		fmt.Fprintf(w, "%s: %s\n", p.Key, validate.Problem{Path: p.Path, Message: p.Message})
+	}
+	if len(v.Problems) == 0 {
+		fmt.Fprintf(w, "%d cluster configs are valid\n", len(v.Configs))
+	}
+	return nil
+}
+
+// Validate checks the cluster configs of a configmap, and exits.
+func Validate(ctx context.Context) *cobra.Command {
+	var (
+		checkServices bool
+		output        string
+	)
+
+	var cmd = &cobra.Command{
+		Use:           "validate [file]",
+		Short:         "check the cluster configs of a configmap and exit",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.MaximumNArgs(1),
+		Long: `
+validate checks the cluster config JSON of a configmap as a director or
+realserver does before it applies it, which rejects a config with problems
+unless --strict-config=false: VIPs and ports that aren't addresses and port
+numbers, VIPs, ports and keys given more than once, unknown fields, and
+schedulers, flags and listener settings that would be ignored. The configmap is read from file, a manifest in YAML or JSON, or -
+for stdin, or else from config-namespace and config-name using --kubeconfig.
+Only config-key is checked when it is set, and otherwise every key of the
+configmap. With --check-services, the services the config refers to are
+looked up using --kubeconfig, and must exist and have the named ports.
+
+Each problem is printed as the key, the path within its JSON and what is
+wrong, and validate exits non-zero if there were any.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkOutput(output); err != nil {
+				return err
+			}
+			config := NewConfig(cmd.Flags())
+
+			var client kubernetes.Interface
+			if len(args) == 0 || checkServices {
+				kubeConfig, err := clientcmd.BuildConfigFromFlags("", config.KubeConfigFile)
+				if err != nil {
+					return err
+				}
+				if client, err = kubernetes.NewForConfig(kubeConfig); err != nil {
+					return err
+				}
+			}
+
+			var cm *v1.ConfigMap
+			var err error
+			if len(args) == 0 {
+				cm, err = client.CoreV1().ConfigMaps(config.ConfigMapNamespace).Get(ctx, config.ConfigMapName, metav1.GetOptions{})
+			} else {
+				cm, err = readConfigMap(args[0])
+			}
+			if err != nil {
+				return err
+			}
+
+			keys := []string{}
+			if config.ConfigKey != "" {
+				if _, ok := cm.Data[config.ConfigKey]; !ok {
+					return withExitCode(exitInvalid, fmt.Errorf("config key '%s' not found in configmap %s", config.ConfigKey, cm.Name))
+				}
+				keys = append(keys, config.ConfigKey)
+			} else {
+				for key := range cm.Data {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+			}
+
+			v := validation{Configs: keys, Problems: []configProblem{}}
+			for _, key := range keys {
+				c, problems := validate.Key(cm.Data, key)
+				if c != nil && checkServices {
+					missing, err := validate.Services(c, func(namespace, name string) (*v1.Service, error) {
+						svc, err := client.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+						if apierrors.IsNotFound(err) {
+							return nil, nil
+						}
+						return svc, err
+					})
+					if err != nil {
+						return err
+					}
+					problems = append(problems, missing...)
+				}
+				for _, p := range problems {
+					v.Problems = append(v.Problems, configProblem{Key: key, Path: p.Path, Message: p.Message})
+				}
+			}
+			if err := writeOutput(os.Stdout, output, v, func(w io.Writer) error { return writeValidation(w, v) }); err != nil {
+				return err
+			}
+			if len(v.Problems) > 0 {
+				return withExitCode(exitInvalid, fmt.Errorf("%d problems found in %d cluster configs", len(v.Problems), len(keys)))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&checkServices, "check-services", false, "look up the services the config refers to using --kubeconfig")
+	outputFlag(cmd.Flags(), &output)
+
+	return cmd
+}
+
+// readConfigMap reads a configmap manifest from path, or stdin for -.
+func readConfigMap(path string) (*v1.ConfigMap, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	cm := &v1.ConfigMap{}
+	if err := yaml.NewYAMLOrJSONDecoder(r, 4096).Decode(cm); err != nil {
+		return nil, withExitCode(exitInvalid, fmt.Errorf("unable to read configmap from %s. %v", path, err))
+	}
+	if cm.Kind != "" && cm.Kind != "ConfigMap" {
+		return nil, withExitCode(exitInvalid, fmt.Errorf("%s holds a %s, not a ConfigMap", path, cm.Kind))
+	}
+	return cm, nil
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/diagnose"
 	"github.com/Comcast/Ravel/pkg/stats"
 )
 
@@ -19,46 +26,107 @@ var (
 	arch      = runtime.GOOS + "/" + runtime.GOARCH
 )
 
+// versionInfo is the version information the version command prints.
+type versionInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"goVersion"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	Arch      string `json:"arch"`
+	// Environment is the fingerprint of the node, so that bug reports
+	// carry it
+	Environment diagnose.Environment `json:"environment"`
+}
+
+// environment fingerprints the node, with the tools and features of config.
+func environment(ctx context.Context, config *config.Config) diagnose.Environment {
+	return diagnose.DetectEnvironment(ctx, diagnose.Binaries{
+		IPTables: "iptables",
+		// gobgpd is installed beside the gobgp client ravel runs
+		GoBGPD:  filepath.Join(filepath.Dir(config.BGP.Binary), "gobgpd"),
+		HAProxy: "/usr/sbin/haproxy",
+	}, config.Features())
+}
+
+// writeVersion prints v for people.
+func writeVersion(w io.Writer, v versionInfo) error {
+	fmt.Fprintf(w, "Version:\t%s\n", v.Version)
+	fmt.Fprintf(w, "Go Version:\t%s\n", v.GoVersion)
+	fmt.Fprintf(w, "Commit:\t\t%s\n", v.Commit)
+	fmt.Fprintf(w, "Build Date:\t%s\n", v.BuildDate)
+	fmt.Fprintf(w, "OS/Arch:\t%s\n", v.Arch)
+
+	env := v.Environment
+	iptables := env.IPTables
+	if env.IPTablesMode != "" {
+		iptables = env.IPTablesMode + ", " + iptables
+	}
+	fmt.Fprintf(w, "Kernel:\t\t%s\n", orUnknown(env.Kernel, env.Errors["kernel"]))
+	fmt.Fprintf(w, "Schedulers:\t%s\n", strings.Join(env.IPVSSchedulers, " "))
+	fmt.Fprintf(w, "IPTables:\t%s\n", orUnknown(iptables, env.Errors["iptables"]))
+	fmt.Fprintf(w, "GoBGPD:\t\t%s\n", orUnknown(env.GoBGPD, env.Errors["gobgpd"]))
+	fmt.Fprintf(w, "HAProxy:\t%s\n", orUnknown(env.HAProxy, env.Errors["haproxy"]))
+	_, err := fmt.Fprintf(w, "Features:\t%s\n", strings.Join(env.Features, " "))
+	return err
+}
+
+// orUnknown is s, or why it couldn't be found out.
+func orUnknown(s, err string) string {
+	if s == "" && err != "" {
+		return "unknown (" + err + ")"
+	}
+	return s
+}
+
 // Version prints version information and exits
-func Version() *cobra.Command {
+func Version(ctx context.Context) *cobra.Command {
+	var output string
 
 	var cmd = &cobra.Command{
 		Use:           "version",
 		Short:         "print version information and exit",
 		SilenceUsage:  true,
 		SilenceErrors: true,
-		Long:          ``,
+		Long: `
+version prints the version of ravel, and the environment it runs in, for
+bug reports: the kernel version, the ip_vs scheduler modules that are loaded
+or built in, whether iptables is the legacy or nf_tables variant, the
+versions of gobgpd beside --bgp-bin and of haproxy, and the optional
+features that the settings turn on. What can't be found out is reported as
+unknown, with the reason.`,
 		RunE: func(cmd *cobra.Command, _ []string) error {
-			fmt.Printf("Version:\t%s\n", version)
-			fmt.Printf("Go Version:\t%s\n", goVersion)
-			fmt.Printf("Commit:\t\t%s\n", commit)
-			fmt.Printf("Build Date:\t%s\n", buildDate)
-			fmt.Printf("OS/Arch:\t%s\n", arch)
-			return nil
+			if err := checkOutput(output); err != nil {
+				return err
+			}
+			v := versionInfo{Version: version, GoVersion: goVersion, Commit: commit, BuildDate: buildDate, Arch: arch}
+			v.Environment = environment(ctx, NewConfig(cmd.Flags()))
+			return writeOutput(os.Stdout, output, v, func(w io.Writer) error { return writeVersion(w, v) })
 		},
 	}
+	outputFlag(cmd.Flags(), &output)
 
 	return cmd
 }
 
-func emitVersionMetric(lb, ns, name, key string) {
-	// gauge config_info
-	info := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: stats.Prefix + "info",
-		Help: "version information for rdei lb",
-	}, []string{"lb", "seczone", "configNamespace", "configName", "version", "goVersion", "commit", "buildDate", "arch", "startTime"})
-	prometheus.MustRegister(info)
+var buildInfoDef = stats.Define(stats.Definition{
+	Type:     stats.Gauge,
+	Name:     "build_info",
+	Help:     "version information for ravel",
+	Labels:   []string{"lb", "seczone", "config_namespace", "config_name", "version", "go_version", "commit", "build_date", "arch", "start_time"},
+	Replaces: "rdei_lb_info",
+})
 
-	info.With(prometheus.Labels{
-		"lb":              lb,
-		"seczone":         key,
-		"configNamespace": ns,
-		"configName":      name,
-		"version":         version,
-		"commit":          commit,
-		"goVersion":       goVersion,
-		"buildDate":       buildDate,
-		"arch":            arch,
-		"startTime":       time.Now().Format(time.RFC3339),
+func emitVersionMetric(lb, ns, name, key string) {
+	buildInfoDef.GaugeVec().With(prometheus.Labels{
+		"lb":               lb,
+		"seczone":          key,
+		"config_namespace": ns,
+		"config_name":      name,
+		"version":          version,
+		"commit":           commit,
+		"go_version":       goVersion,
+		"build_date":       buildDate,
+		"arch":             arch,
+		"start_time":       time.Now().Format(time.RFC3339),
 	}).Set(0)
 }
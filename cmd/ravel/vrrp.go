@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/fence"
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/vrrp"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// startFence returns the fence a vrrp director claims before it takes the
+// VIPs, and reports the claim through checks. It returns nil unless both
+// --vrrp-id and --vrrp-fence-ttl are set.
+func startFence(config *config.Config, kind stats.LBKind, w *watcher.Watcher, checks *health.Registry, logger logging.Logger) (*fence.Fence, error) {
+	if config.VRRP.ID == 0 || config.VRRP.FenceTTL == 0 {
+		return nil, nil
+	}
+	f, err := fence.New(w.Clientset(), config.ConfigMapNamespace, config.ConfigKey, config.NodeName, config.VRRP.FenceTTL, kind, logger)
+	if err != nil {
+		return nil, err
+	}
+	checks.Register("fence", f.Health)
+	return f, nil
+}
+
+// startVRRP joins the virtual router of the config key when --vrrp-id is set,
+// and reports the director's role through checks. It returns nil when VRRP is
+// disabled. Mastership is given up when ctx is done. With a fence, the
+// director only becomes master once it holds the claim. The priority comes
+// from the node label of --vrrp-priority-label when the node has it.
+func startVRRP(ctx context.Context, config *config.Config, kind stats.LBKind, w *watcher.Watcher, f *fence.Fence, checks *health.Registry, logger logging.Logger) (*vrrp.Router, error) {
+	if config.VRRP.ID == 0 {
+		return nil, nil
+	}
+	address := net.ParseIP(config.Net.PrimaryIP)
+	transport, err := vrrp.NewMulticast(config.Net.Interface, address)
+	if err != nil {
+		return nil, err
+	}
+	vips := func() []net.IP {
+		c := w.ClusterConfig
+		if c == nil {
+			return nil
+		}
+		ips := []net.IP{}
+		for vip := range c.Config {
+			if ip := net.ParseIP(string(vip)).To4(); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		return ips
+	}
+	settings := config.VRRP.Settings(address)
+	if config.VRRP.PriorityLabel != "" {
+		priority, err := nodePriority(ctx, w, config.NodeName, config.VRRP.PriorityLabel)
+		if err != nil {
+			transport.Close()
+			return nil, err
+		}
+		if priority == 0 {
+			logger.Infof("vrrp: node %s has no %s label, using priority %d", config.NodeName, config.VRRP.PriorityLabel, settings.Priority)
+		} else {
+			settings.Priority = priority
+		}
+	}
+	if f != nil {
+		settings.Fence = f
+	}
+	router, err := vrrp.New(settings, transport, vips, kind, config.ConfigKey, logger)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	checks.Register("vrrp", router.Health)
+	go router.Run(ctx)
+	return router, nil
+}
+
+// nodePriority reads the vrrp priority of node from its label, returning 0
+// when the node doesn't have it.
+func nodePriority(ctx context.Context, w *watcher.Watcher, node, label string) (uint8, error) {
+	n, err := w.Clientset().CoreV1().Nodes().Get(ctx, node, metav1.GetOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("vrrp: unable to read the priority label of node %s. %v", node, err)
+	}
+	value, ok := n.Labels[label]
+	if !ok {
+		return 0, nil
+	}
+	priority, err := strconv.Atoi(value)
+	if err != nil || priority < 1 || priority > 255 {
+		return 0, fmt.Errorf("vrrp: label %s of node %s must be a priority from 1 to 255, not %q", label, node, value)
+	}
+	return uint8(priority), nil
+}
+
+// releaseVIPs removes the VIPs from the primary interface of a vrrp director
+// that is stopping, so that it stops answering arp for them once a backup has
+// taken over. It runs after ctx is done, so it can't use the director's ip
+// helper.
+func releaseVIPs(config *config.Config, logger logging.Logger) {
+	ip, err := system.NewIP(context.Background(), config.Net.Interface, config.Net.Gateway, config.Arp.PrimaryAnnounce, config.Arp.PrimaryIgnore, logger)
+	if err != nil {
+		logger.Errorf("vrrp: unable to release the VIPs. %v", err)
+		return
+	}
+	configured, _, err := ip.Get()
+	if err != nil {
+		logger.Errorf("vrrp: unable to release the VIPs. %v", err)
+		return
+	}
+	for _, addr := range configured {
+		if err := ip.Del(addr); err != nil {
+			logger.Errorf("vrrp: unable to release VIP %s. %v", addr, err)
+		}
+	}
+	logger.Infof("vrrp: released %d VIPs", len(configured))
+}
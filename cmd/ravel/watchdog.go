@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+
+	"github.com/Comcast/Ravel/pkg/config"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/watchdog"
+)
+
+// startWatchdog supervises the worker loops when --watchdog-deadline is set.
+// It must run before the worker starts, so that its loops register. The
+// returned watchdog is nil when disabled, and its Stalled channel then never
+// receives.
+func startWatchdog(ctx context.Context, config *config.Config, kind stats.LBKind, logger logging.Logger) (*watchdog.Watchdog, error) {
+	if config.Watchdog.Deadline == 0 {
+		return nil, nil
+	}
+	w, err := watchdog.New(kind, config.Watchdog.Deadline, config.Watchdog.Restart, logger)
+	if err != nil {
+		return nil, err
+	}
+	watchdog.SetDefault(w)
+	go w.Run(ctx)
+	return w, nil
+}
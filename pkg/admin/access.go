@@ -0,0 +1,179 @@
+package admin
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Scope is what a caller of the admin endpoint may do.
+type Scope string
+
+const (
+	// ScopeRead allows the GET and HEAD requests of every handler.
+	ScopeRead Scope = "read"
+	// ScopeDrain allows putting the node in maintenance and taking it out.
+	ScopeDrain Scope = "drain"
+	// ScopeAnnounce allows overriding the bgp announcements of VIPs.
+	ScopeAnnounce Scope = "announce"
+	// ScopeOperate allows every other change: pausing, reconfiguring,
+	// reloading, log levels, flushing ipvs and haproxy servers.
+	ScopeOperate Scope = "operate"
+)
+
+// Scopes are every scope, those of the admin token and, without an access
+// file, of any verified client certificate.
+var Scopes = []Scope{ScopeRead, ScopeDrain, ScopeAnnounce, ScopeOperate}
+
+// scopeAll names every scope in an access file.
+const scopeAll = "all"
+
+// Access grants scopes to the callers of the admin endpoint, by the bearer
+// token they present or the common name of their client certificate. It is
+// read from a yaml file:
+//
+//	tokens:
+//	- name: oncall
+//	  sha256: <hex sha256 of the token>
+//	  scopes: [read, drain]
+//	certificates:
+//	- name: ops-bot
+//	  scopes: [read, announce]
+type Access struct {
+	Tokens       []TokenGrant       `yaml:"tokens"`
+	Certificates []CertificateGrant `yaml:"certificates"`
+}
+
+// TokenGrant grants scopes to the bearer of a token, known by its sha256
+// so that the file holds no credentials.
+type TokenGrant struct {
+	Name   string   `yaml:"name"`
+	SHA256 string   `yaml:"sha256"`
+	Scopes []string `yaml:"scopes"`
+}
+
+// CertificateGrant grants scopes to a client certificate the CA signed for
+// the common name Name.
+type CertificateGrant struct {
+	Name   string   `yaml:"name"`
+	Scopes []string `yaml:"scopes"`
+}
+
+// LoadAccess reads and checks an access file.
+func LoadAccess(path string) (*Access, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read admin access file. %v", err)
+	}
+	access := &Access{}
+	if err := yaml.UnmarshalStrict(b, access); err != nil {
+		return nil, fmt.Errorf("invalid admin access file %s. %v", path, err)
+	}
+	if err := access.validate(); err != nil {
+		return nil, fmt.Errorf("invalid admin access file %s. %v", path, err)
+	}
+	return access, nil
+}
+
+func (a *Access) validate() error {
+	names := map[string]bool{}
+	for _, t := range a.Tokens {
+		if t.Name == "" {
+			return fmt.Errorf("a token has no name")
+		}
+		if names["token:"+t.Name] {
+			return fmt.Errorf("token %s is granted twice", t.Name)
+		}
+		names["token:"+t.Name] = true
+		if sum, err := hex.DecodeString(t.SHA256); err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("token %s must have the hex sha256 of the token", t.Name)
+		}
+		if err := validScopes(t.Scopes); err != nil {
+			return fmt.Errorf("token %s: %v", t.Name, err)
+		}
+	}
+	for _, c := range a.Certificates {
+		if c.Name == "" {
+			return fmt.Errorf("a certificate has no name")
+		}
+		if names["cert:"+c.Name] {
+			return fmt.Errorf("certificate %s is granted twice", c.Name)
+		}
+		names["cert:"+c.Name] = true
+		if err := validScopes(c.Scopes); err != nil {
+			return fmt.Errorf("certificate %s: %v", c.Name, err)
+		}
+	}
+	return nil
+}
+
+func validScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("no scopes are granted")
+	}
+	for _, s := range scopes {
+		if s == scopeAll {
+			continue
+		}
+		known := false
+		for _, scope := range Scopes {
+			known = known || Scope(s) == scope
+		}
+		if !known {
+			return fmt.Errorf("unknown scope %q. must be one of %s", s, strings.Join(scopeNames(), "|"))
+		}
+	}
+	return nil
+}
+
+func scopeNames() []string {
+	names := []string{scopeAll}
+	for _, s := range Scopes {
+		names = append(names, string(s))
+	}
+	return names
+}
+
+// token returns the grant of the bearer of token, or nil.
+func (a *Access) token(token string) *TokenGrant {
+	sum := sha256.Sum256([]byte(token))
+	for i, t := range a.Tokens {
+		want, _ := hex.DecodeString(t.SHA256)
+		if subtle.ConstantTimeCompare(sum[:], want) == 1 {
+			return &a.Tokens[i]
+		}
+	}
+	return nil
+}
+
+// certificate returns the grant of the common name name, or nil.
+func (a *Access) certificate(name string) *CertificateGrant {
+	for i, c := range a.Certificates {
+		if c.Name == name {
+			return &a.Certificates[i]
+		}
+	}
+	return nil
+}
+
+// scopeSet are the scopes granted to a caller.
+type scopeSet map[Scope]bool
+
+func newScopeSet(scopes []string) scopeSet {
+	set := scopeSet{}
+	for _, s := range scopes {
+		if s == scopeAll {
+			for _, scope := range Scopes {
+				set[scope] = true
+			}
+			continue
+		}
+		set[Scope(s)] = true
+	}
+	return set
+}
@@ -0,0 +1,290 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+// Server is the admin http endpoint. It is separate from the prometheus
+// listener since the handlers mounted here can change the running process,
+// and every request must carry the bearer token or, over mutual tls, a client
+// certificate signed by the CA.
+//
+// Each caller is granted scopes: the admin token every scope, and the tokens
+// and certificates of an access file those it lists. Every request other
+// than a GET or HEAD is a control action, recorded in the audit trail with
+// its caller whether it is allowed or not.
+type Server struct {
+	addr      string
+	token     string
+	access    *Access
+	tlsConfig *tls.Config
+	mux       *http.ServeMux
+
+	// scopes are the scopes the control actions of each pattern need,
+	// where it isn't ScopeOperate.
+	scopesMu sync.Mutex
+	scopes   map[string]Scope
+
+	logger logging.Logger
+}
+
+// NewServer returns an admin server that will listen on addr once started.
+// It serves tls when tlsConfig is set, and a client certificate it verifies
+// stands in for the token. access, when set, grants scopes to more tokens
+// and to certificates by their common name.
+func NewServer(addr, token string, access *Access, tlsConfig *tls.Config, logger logging.Logger) (*Server, error) {
+	if token == "" && (access == nil || len(access.Tokens) == 0) && (tlsConfig == nil || tlsConfig.ClientCAs == nil) {
+		return nil, fmt.Errorf("admin: a token or a client ca is required")
+	}
+	return &Server{
+		addr:      addr,
+		token:     token,
+		access:    access,
+		tlsConfig: tlsConfig,
+		mux:       http.NewServeMux(),
+		scopes:    map[string]Scope{},
+		logger:    logger.WithFields(logging.Fields{"module": "admin"}),
+	}, nil
+}
+
+// ServerTLS returns the tls config of the endpoint, which presents the
+// certificate in certFile and keyFile. With caFile, clients may present a
+// certificate signed by the CA in it, and must when requireClientCert is set.
+func ServerTLS(certFile, keyFile, caFile string, requireClientCert bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load admin certificate. %v", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return config, nil
+	}
+	if config.ClientCAs, err = loadCA(caFile); err != nil {
+		return nil, err
+	}
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientTLS returns the tls config of a client of the endpoint, which
+// presents the certificate in certFile and keyFile when caFile is set, and
+// requires the endpoint's to be for serverName and signed by the CA in
+// caFile, or by a system root without it.
+func ClientTLS(certFile, keyFile, caFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return config, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load admin certificate. %v", err)
+	}
+	config.Certificates = []tls.Certificate{cert}
+	if config.RootCAs, err = loadCA(caFile); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func loadCA(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read admin ca file. %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in admin ca file %s", caFile)
+	}
+	return pool, nil
+}
+
+// Handle registers a handler for pattern. Handlers are only reached by
+// authenticated requests, and its control actions by callers with
+// ScopeOperate.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.HandleScoped(pattern, ScopeOperate, handler)
+}
+
+// HandleScoped registers a handler for pattern, whose control actions are
+// reached by callers with scope.
+func (s *Server) HandleScoped(pattern string, scope Scope, handler http.Handler) {
+	s.scopesMu.Lock()
+	s.scopes[pattern] = scope
+	s.scopesMu.Unlock()
+	s.mux.Handle(pattern, handler)
+}
+
+// Start listens on the admin address and serves until ctx is canceled.
+func (s *Server) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("admin: unable to listen on %s: %v", s.addr, err)
+	}
+	if s.tlsConfig != nil {
+		ln = tls.NewListener(ln, s.tlsConfig)
+	}
+	s.logger.Infof("admin: listening on %s", ln.Addr())
+
+	srv := &http.Server{Handler: s}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.logger.Errorf("admin: server exited with error: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	caller, scopes, ok := s.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ravel"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	control := r.Method != http.MethodGet && r.Method != http.MethodHead
+	need := ScopeRead
+	if control {
+		_, pattern := s.mux.Handler(r)
+		need = s.scope(pattern)
+	}
+	target := r.URL.Path
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	logger := s.logger.WithField("caller", caller)
+	if !scopes[need] {
+		err := fmt.Errorf("%s lacks the %s scope", caller, need)
+		if control {
+			audit.RecordCaller(caller, audit.SubsystemAdmin, "deny", target, r.Method, err)
+		}
+		logger.Warnf("admin: refused %s %s from %s. %v", r.Method, r.URL, r.RemoteAddr, err)
+		http.Error(w, "forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if !control {
+		s.mux.ServeHTTP(w, r)
+		return
+	}
+
+	logger.Infof("admin: %s %s from %s", r.Method, r.URL, r.RemoteAddr)
+	a := &action{caller: caller}
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	s.mux.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), actionKey{}, a)))
+	if a.name == "" {
+		a.name = strings.ToLower(r.Method)
+		if rec.status >= http.StatusBadRequest {
+			a.err = fmt.Errorf("%d %s", rec.status, http.StatusText(rec.status))
+		}
+	}
+	audit.RecordCaller(caller, audit.SubsystemAdmin, a.name, target, a.detail, a.err)
+}
+
+// scope returns the scope the control actions of pattern need.
+func (s *Server) scope(pattern string) Scope {
+	s.scopesMu.Lock()
+	defer s.scopesMu.Unlock()
+	if scope, ok := s.scopes[pattern]; ok {
+		return scope
+	}
+	return ScopeOperate
+}
+
+// authenticate returns who made r and the scopes they are granted, or false
+// if r carries no credential the endpoint accepts.
+func (s *Server) authenticate(r *http.Request) (string, scopeSet, bool) {
+	// the listener has verified any certificate presented against the CA
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if s.access == nil {
+			return "cert:" + name, newScopeSet([]string{scopeAll}), true
+		}
+		// a certificate the access file doesn't list is known by its name,
+		// so that its refusals are audited, but granted nothing
+		scopes := scopeSet{}
+		if grant := s.access.certificate(name); grant != nil {
+			scopes = newScopeSet(grant.Scopes)
+		}
+		return "cert:" + name, scopes, true
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", nil, false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if s.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1 {
+		return "token", newScopeSet([]string{scopeAll}), true
+	}
+	if s.access != nil {
+		if grant := s.access.token(token); grant != nil {
+			return "token:" + grant.Name, newScopeSet(grant.Scopes), true
+		}
+	}
+	return "", nil, false
+}
+
+// actionKey is the context key of the action of a control request.
+type actionKey struct{}
+
+// action is what a handler reports of a control action for the audit trail.
+type action struct {
+	caller string
+	name   string
+	detail string
+	err    error
+}
+
+// Caller returns who asked for the control action r, or "" if r wasn't
+// served by an admin server.
+func Caller(r *http.Request) string {
+	if a, ok := r.Context().Value(actionKey{}).(*action); ok {
+		return a.caller
+	}
+	return ""
+}
+
+// Record reports the outcome of the control action r asked for, which the
+// server records in the audit trail with its caller. Handlers that don't
+// report one are recorded by their method and status.
+func Record(r *http.Request, name, detail string, err error) {
+	a, ok := r.Context().Value(actionKey{}).(*action)
+	if !ok {
+		// not served by an admin server
+		audit.Record(audit.SubsystemAdmin, name, r.URL.Path, detail, err)
+		return
+	}
+	a.name, a.detail, a.err = name, detail, err
+}
+
+// statusRecorder keeps the status of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,169 @@
+package admin
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+func TestAuthorization(t *testing.T) {
+	srv, err := NewServer("127.0.0.1:0", "s3cret", nil, nil, logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Handle("/ping", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for auth, want := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Basic s3cret":  http.StatusUnauthorized,
+		"Bearer s3cret": http.StatusOK,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Fatalf("expected %d for %q. saw %d", want, auth, w.Code)
+		}
+	}
+
+	// a client certificate the listener verified stands in for the token
+	r := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a verified client certificate to be authorized. saw %d", w.Code)
+	}
+
+	if _, err := NewServer("127.0.0.1:0", "", nil, nil, logging.New()); err == nil {
+		t.Fatal("expected an error without a token")
+	}
+	if _, err := NewServer("127.0.0.1:0", "", nil, &tls.Config{ClientCAs: x509.NewCertPool()}, logging.New()); err != nil {
+		t.Fatalf("expected a client ca to stand in for the token. %v", err)
+	}
+}
+
+func TestScopes(t *testing.T) {
+	trail := audit.NewTrail(10)
+	audit.SetDefault(trail)
+	defer audit.SetDefault(audit.NewTrail(audit.DefaultSize))
+
+	sum := sha256.Sum256([]byte("oncall-token"))
+	access := &Access{
+		Tokens:       []TokenGrant{{Name: "oncall", SHA256: hex.EncodeToString(sum[:]), Scopes: []string{"read", "drain"}}},
+		Certificates: []CertificateGrant{{Name: "ops-bot", Scopes: []string{"all"}}},
+	}
+	srv, err := NewServer("127.0.0.1:0", "s3cret", access, nil, logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Handle("/pause", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.HandleScoped("/drain", ScopeDrain, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			Record(r, "drain", "node lb01 is in maintenance", nil)
+		}
+	}))
+	srv.HandleScoped("/bgp/announce", ScopeAnnounce, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Record(r, "announce", "", errors.New("10.0.0.1 is not a VIP of the cluster config"))
+		http.Error(w, "not a VIP", http.StatusInternalServerError)
+	}))
+
+	send := func(method, path, token string, cert string) int {
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		if cert != "" {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cert}}}}}
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for _, c := range []struct {
+		method, path, token, cert string
+		want                      int
+	}{
+		{http.MethodGet, "/pause", "oncall-token", "", http.StatusOK},
+		{http.MethodPost, "/drain?reason=upgrade", "oncall-token", "", http.StatusOK},
+		{http.MethodPost, "/pause", "oncall-token", "", http.StatusForbidden},
+		{http.MethodPost, "/bgp/announce?vip=10.0.0.1", "oncall-token", "", http.StatusForbidden},
+		{http.MethodPost, "/bgp/announce?vip=10.0.0.1", "", "ops-bot", http.StatusInternalServerError},
+		// a certificate the access file doesn't list is granted nothing
+		{http.MethodGet, "/pause", "", "someone", http.StatusForbidden},
+		{http.MethodPost, "/pause", "s3cret", "", http.StatusOK},
+		{http.MethodPost, "/pause", "wrong", "", http.StatusUnauthorized},
+	} {
+		if code := send(c.method, c.path, c.token, c.cert); code != c.want {
+			t.Fatalf("expected %d for %s %s as %q%q. saw %d", c.want, c.method, c.path, c.token, c.cert, code)
+		}
+	}
+
+	// every control action is audited with its caller, allowed or not
+	events := trail.Events(audit.SubsystemAdmin, "", 0)
+	want := []string{
+		"token:oncall drain /drain?reason=upgrade",
+		"token:oncall deny /pause",
+		"token:oncall deny /bgp/announce?vip=10.0.0.1",
+		"cert:ops-bot announce /bgp/announce?vip=10.0.0.1",
+		"token post /pause",
+	}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d admin events. saw %+v", len(want), events)
+	}
+	for i, e := range events {
+		if saw := e.Caller + " " + e.Action + " " + e.Target; saw != want[i] {
+			t.Fatalf("expected event %d to be %q. saw %q", i, want[i], saw)
+		}
+	}
+	if events[0].Detail != "node lb01 is in maintenance" || events[3].Error == "" || !strings.Contains(events[1].Error, "lacks the operate scope") {
+		t.Fatalf("expected the outcomes of the actions to be recorded. saw %+v", events)
+	}
+}
+
+func TestLoadAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.yaml")
+
+	sum := sha256.Sum256([]byte("oncall-token"))
+	for content, valid := range map[string]bool{
+		"tokens:\n- name: oncall\n  sha256: " + hex.EncodeToString(sum[:]) + "\n  scopes: [read, drain]\ncertificates:\n- name: ops-bot\n  scopes: [all]\n": true,
+		"tokens:\n- name: oncall\n  sha256: oncall-token\n  scopes: [read]\n":                                                                               false,
+		"tokens:\n- name: oncall\n  sha256: " + hex.EncodeToString(sum[:]) + "\n  scopes: [write]\n":                                                        false,
+		"certificates:\n- name: ops-bot\n":                  false,
+		"certificate:\n- name: ops-bot\n  scopes: [read]\n": false,
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		access, err := LoadAccess(path)
+		if valid && (err != nil || access.token("oncall-token") == nil || access.certificate("ops-bot") == nil) {
+			t.Fatalf("expected %q to be granted. %v", content, err)
+		}
+		if !valid && err == nil {
+			t.Fatalf("expected %q to be refused", content)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package audit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Comcast/Ravel/pkg/logging"
+)
+
+// The audit trail records every change ravel makes to the node: dummy
+// interfaces, ipvs rules, iptables and bgp announcements. Events are kept in
+// a bounded ring buffer that can be read back over the admin API, and are
+// optionally copied to sinks such as a file or the journal.
+//
+// Workers set the cause of the changes that follow with SetCause at the start
+// of each reconfigure. Reconfigures within a process are serialized by the
+// worker's run loop, so the cause is held once for the whole trail.
+//
+// The cause includes the correlation ID the watcher assigned to the updates
+// behind the config being applied, so the events of a reconfigure can be
+// traced back to the kubernetes changes that caused it.
+
+const (
+	SubsystemInterface = "interface"
+	SubsystemIPVS      = "ipvs"
+	SubsystemIPTables  = "iptables"
+	SubsystemBGP       = "bgp"
+	SubsystemHAProxy   = "haproxy"
+	// SubsystemAdmin is an operation requested through the admin endpoint
+	SubsystemAdmin = "admin"
+
+	// DefaultSize is the number of events kept by the default trail.
+	DefaultSize = 1000
+)
+
+// Event is a single change made to the node.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Subsystem  string    `json:"subsystem"`
+	Action     string    `json:"action"`
+	Target     string    `json:"target"`
+	Detail     string    `json:"detail,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	ConfigHash string    `json:"config_hash,omitempty"`
+	// CorrelationID identifies the updates that led to the change.
+	CorrelationID string `json:"correlation_id,omitempty"`
+	Error         string `json:"error,omitempty"`
+	// Observed is set for a change an observe-only process would have made,
+	// but didn't.
+	Observed bool `json:"observed,omitempty"`
+	// Caller is who asked for the change through the admin endpoint.
+	Caller string `json:"caller,omitempty"`
+}
+
+// Sink receives each event as it is recorded.
+type Sink interface {
+	Write(Event) error
+}
+
+// Trail is a bounded, in-memory record of events.
+type Trail struct {
+	sync.Mutex
+	events []Event
+	next   int
+	full   bool
+
+	reason, configHash, correlationID string
+
+	// sinks are written in order of recording, outside of the trail lock.
+	sinkMu sync.Mutex
+	sinks  []Sink
+}
+
+// NewTrail returns a Trail that keeps the most recent size events.
+func NewTrail(size int) *Trail {
+	if size < 1 {
+		size = 1
+	}
+	return &Trail{events: make([]Event, size)}
+}
+
+// AddSink copies every subsequent event to s.
+func (t *Trail) AddSink(s Sink) {
+	t.sinkMu.Lock()
+	defer t.sinkMu.Unlock()
+	t.sinks = append(t.sinks, s)
+}
+
+// SetCause sets the reason, cluster config hash and correlation ID attached
+// to the events recorded after it.
+func (t *Trail) SetCause(reason, configHash, correlationID string) {
+	t.Lock()
+	defer t.Unlock()
+	t.reason, t.configHash, t.correlationID = reason, configHash, correlationID
+}
+
+// Record adds an event for a change to target. err is the outcome of the
+// change, if it failed.
+func (t *Trail) Record(subsystem, action, target, detail string, err error) {
+	t.record("", subsystem, action, target, detail, err, false)
+}
+
+// RecordCaller adds an event for a change to target that caller asked for.
+func (t *Trail) RecordCaller(caller, subsystem, action, target, detail string, err error) {
+	t.record(caller, subsystem, action, target, detail, err, false)
+}
+
+// Observe adds an event for a change to target that was left unmade, as the
+// process only observes.
+func (t *Trail) Observe(subsystem, action, target, detail string) {
+	t.record("", subsystem, action, target, detail, nil, true)
+}
+
+func (t *Trail) record(caller, subsystem, action, target, detail string, err error, observed bool) {
+	t.sinkMu.Lock()
+	defer t.sinkMu.Unlock()
+
+	t.Lock()
+	e := Event{
+		Time:       time.Now(),
+		Subsystem:  subsystem,
+		Action:     action,
+		Target:     target,
+		Detail:     detail,
+		Reason:     t.reason,
+		ConfigHash: t.configHash,
+
+		CorrelationID: t.correlationID,
+		Observed:      observed,
+		Caller:        caller,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	t.events[t.next] = e
+	t.next = (t.next + 1) % len(t.events)
+	if t.next == 0 {
+		t.full = true
+	}
+	t.Unlock()
+
+	for _, s := range t.sinks {
+		if err := s.Write(e); err != nil {
+			log.Warnf("audit: unable to write event to sink: %v", err)
+		}
+	}
+}
+
+// Events returns the recorded events, oldest first. An empty subsystem or
+// correlationID matches all of them, and limit, if positive, keeps only the
+// newest.
+func (t *Trail) Events(subsystem, correlationID string, limit int) []Event {
+	t.Lock()
+	ordered := append([]Event{}, t.events[:t.next]...)
+	if t.full {
+		ordered = append(append([]Event{}, t.events[t.next:]...), ordered...)
+	}
+	t.Unlock()
+
+	out := []Event{}
+	for _, e := range ordered {
+		if (subsystem == "" || e.Subsystem == subsystem) && (correlationID == "" || e.CorrelationID == correlationID) {
+			out = append(out, e)
+		}
+	}
+	if limit > 0 && len(out) > limit {
+		out = out[len(out)-limit:]
+	}
+	return out
+}
+
+// ServeHTTP serves the recorded events as JSON. The query parameters
+// subsystem, correlation_id and limit filter the result.
+func (t *Trail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			http.Error(w, "invalid limit "+strconv.Quote(l), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	q := r.URL.Query()
+	json.NewEncoder(w).Encode(t.Events(q.Get("subsystem"), q.Get("correlation_id"), limit))
+}
+
+var std = NewTrail(DefaultSize)
+
+// SetDefault replaces the trail used by the package level functions.
+func SetDefault(t *Trail) {
+	std = t
+}
+
+// Default returns the trail used by the package level functions.
+func Default() *Trail {
+	return std
+}
+
+// SetCause sets the cause on the default trail.
+func SetCause(reason, configHash, correlationID string) {
+	std.SetCause(reason, configHash, correlationID)
+}
+
+// NewCorrelationID returns a random ID for a set of updates.
+func NewCorrelationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Record adds an event to the default trail.
+func Record(subsystem, action, target, detail string, err error) {
+	std.Record(subsystem, action, target, detail, err)
+}
+
+// RecordCaller adds an event that caller asked for to the default trail.
+func RecordCaller(caller, subsystem, action, target, detail string, err error) {
+	std.RecordCaller(caller, subsystem, action, target, detail, err)
+}
+
+// Observe adds an unmade change to the default trail.
+func Observe(subsystem, action, target, detail string) {
+	std.Observe(subsystem, action, target, detail)
+}
@@ -0,0 +1,109 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTrailWraps(t *testing.T) {
+	trail := NewTrail(3)
+	trail.SetCause("forced", "abc=", "0123456789abcdef")
+	for _, target := range []string{"a", "b", "c", "d"} {
+		trail.Record(SubsystemInterface, "add", target, "", nil)
+	}
+	trail.Record(SubsystemIPVS, "del", "e", "", errors.New("ipvsadm failed"))
+
+	events := trail.Events("", "", 0)
+	if len(events) != 3 || events[0].Target != "c" || events[2].Target != "e" {
+		t.Fatalf("expected the newest three events oldest first. saw %+v", events)
+	}
+	if events[0].Reason != "forced" || events[0].ConfigHash != "abc=" || events[0].CorrelationID != "0123456789abcdef" {
+		t.Fatalf("expected the cause to be attached. saw %+v", events[0])
+	}
+	if events[2].Error != "ipvsadm failed" {
+		t.Fatalf("expected the error to be recorded. saw %+v", events[2])
+	}
+	if events := trail.Events(SubsystemIPVS, "", 0); len(events) != 1 {
+		t.Fatalf("expected one ipvs event. saw %+v", events)
+	}
+	if events := trail.Events("", "", 1); len(events) != 1 || events[0].Target != "e" {
+		t.Fatalf("expected only the newest event. saw %+v", events)
+	}
+
+	trail.SetCause("parity check", "def=", "fedcba9876543210")
+	trail.Record(SubsystemIPVS, "add", "f", "", nil)
+	if events := trail.Events("", "fedcba9876543210", 0); len(events) != 1 || events[0].Target != "f" {
+		t.Fatalf("expected only the event with the correlation id. saw %+v", events)
+	}
+
+	trail.Observe(SubsystemIPVS, "del", "g", "")
+	if events := trail.Events("", "", 2); events[0].Observed || !events[1].Observed {
+		t.Fatalf("expected only the unmade change to be observed. saw %+v", events)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	trail := NewTrail(10)
+	trail.Record(SubsystemBGP, "announce", "10.0.0.1/32", "", nil)
+	trail.Record(SubsystemIPTables, "restore", "nat", "1 chains, 2 rules", nil)
+
+	w := httptest.NewRecorder()
+	trail.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/audit?subsystem=bgp", nil))
+	var events []Event
+	if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Target != "10.0.0.1/32" {
+		t.Fatalf("expected the bgp event. saw %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	trail.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/audit?limit=x", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected a bad request for an invalid limit. saw %d", w.Code)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trail := NewTrail(10)
+	trail.AddSink(sink)
+	trail.Record(SubsystemInterface, "add", "10_0_0_1", "10.0.0.1", nil)
+	trail.Record(SubsystemInterface, "del", "10_0_0_2", "", nil)
+	sink.Close()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("unable to parse line %q: %v", scanner.Text(), err)
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Fatalf("expected 2 lines. saw %d", lines)
+	}
+}
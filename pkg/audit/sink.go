@@ -0,0 +1,95 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+// FileSink appends events to a file as one JSON object per line.
+type FileSink struct {
+	sync.Mutex
+	f *os.File
+}
+
+// NewFileSink opens path for appending, creating it if needed.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("audit: unable to open %s: %v", path, err)
+	}
+	return &FileSink{f: f}, nil
+}
+
+func (s *FileSink) Write(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	_, err = s.f.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the underlying file.
+func (s *FileSink) Close() error {
+	return s.f.Close()
+}
+
+// JournalSocket is where journald listens for native protocol messages.
+const JournalSocket = logging.JournalSocket
+
+// JournaldSink sends events to the systemd journal using its native
+// protocol, with each event field as a RAVEL_ prefixed journal field.
+type JournaldSink struct {
+	conn *net.UnixConn
+}
+
+// NewJournaldSink connects to the journal socket.
+func NewJournaldSink() (*JournaldSink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: JournalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("audit: unable to connect to journald at %s: %v", JournalSocket, err)
+	}
+	return &JournaldSink{conn: conn}, nil
+}
+
+func (s *JournaldSink) Write(e Event) error {
+	priority := "6" // info
+	msg := fmt.Sprintf("%s %s %s", e.Subsystem, e.Action, e.Target)
+	if e.Error != "" {
+		priority = "3" // err
+		msg += ": " + e.Error
+	}
+
+	var b bytes.Buffer
+	for _, f := range [][2]string{
+		{"MESSAGE", msg},
+		{"PRIORITY", priority},
+		{"SYSLOG_IDENTIFIER", "ravel"},
+		{"RAVEL_SUBSYSTEM", e.Subsystem},
+		{"RAVEL_ACTION", e.Action},
+		{"RAVEL_TARGET", e.Target},
+		{"RAVEL_DETAIL", e.Detail},
+		{"RAVEL_REASON", e.Reason},
+		{"RAVEL_CONFIG_HASH", e.ConfigHash},
+		{"RAVEL_CORRELATION_ID", e.CorrelationID},
+		{"RAVEL_ERROR", e.Error},
+		{"RAVEL_CALLER", e.Caller},
+	} {
+		logging.WriteJournalField(&b, f[0], f[1])
+	}
+	_, err := s.conn.Write(b.Bytes())
+	return err
+}
+
+// Close closes the journal socket.
+func (s *JournaldSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,323 @@
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/simulate"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// A benchmark times the reconcile of a mode at a scale no test cluster has,
+// so that a change that slows it down is caught before it ships. It generates
+// a cluster of services, endpoints, pods and nodes, and a cluster config with
+// a VIP for each service, and runs them through the helpers that a reconcile
+// generates and merges its rules with, as ravel simulate does, against node
+// state rendered as the commands a reconcile reads it with print it. Nothing
+// is changed on the node running it. Each subsystem is timed twice: against a
+// node with nothing on it, as on the first reconcile, and against a node
+// already holding the config, as on every reconcile after.
+
+// ConfigKey is the config key of the generated cluster config.
+const ConfigKey = "bench"
+
+// Spec sizes the generated cluster.
+type Spec struct {
+	// VIPs is the number of VIPs, each for a service of its own
+	VIPs int `json:"vips"`
+	// Nodes is the number of nodes
+	Nodes int `json:"nodes"`
+	// Ports is the number of ports of each VIP
+	Ports int `json:"ports"`
+	// Endpoints is the number of endpoints of each service, spread over the
+	// nodes
+	Endpoints int `json:"endpoints"`
+}
+
+func (s Spec) valid() error {
+	switch {
+	case s.VIPs < 1 || s.VIPs > 1<<16:
+		return fmt.Errorf("vips must be between 1 and %d", 1<<16)
+	case s.Nodes < 1 || s.Nodes > 1<<16:
+		return fmt.Errorf("nodes must be between 1 and %d", 1<<16)
+	case s.Ports < 1 || s.Ports > 1000:
+		return fmt.Errorf("ports must be between 1 and 1000")
+	case s.Endpoints < 1:
+		return fmt.Errorf("endpoints must be at least 1")
+	}
+	return nil
+}
+
+// Cluster is a generated cluster, and a configmap holding its cluster config
+// under ConfigKey.
+type Cluster struct {
+	Services  []v1.Service
+	Endpoints []v1.Endpoints
+	Pods      []v1.Pod
+	Nodes     []v1.Node
+	ConfigMap *v1.ConfigMap
+}
+
+// addr returns the ix'th address of the /16 prefix.
+func addr(prefix string, ix int) string {
+	return fmt.Sprintf("%s.%d.%d", prefix, ix/256, ix%256)
+}
+
+// nodeName is the name of the ix'th node. A benchmark reconciles as node 0.
+func nodeName(ix int) string {
+	return fmt.Sprintf("node-%d", ix)
+}
+
+// Generate generates the cluster of spec.
+func Generate(spec Spec) (Cluster, error) {
+	if err := spec.valid(); err != nil {
+		return Cluster{}, err
+	}
+	c := Cluster{}
+	for ix := 0; ix < spec.Nodes; ix++ {
+		c.Nodes = append(c.Nodes, v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: nodeName(ix)},
+			Status: v1.NodeStatus{
+				Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: addr("10.128", ix)}},
+				Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+			},
+		})
+	}
+
+	config := types.ClusterConfig{Config: map[types.ServiceIP]types.PortMap{}, Config6: map[types.ServiceIP]types.PortMap{}}
+	pod := 0
+	for ix := 0; ix < spec.VIPs; ix++ {
+		name := fmt.Sprintf("svc-%d", ix)
+		svc := v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ConfigKey, Name: name},
+			Spec:       v1.ServiceSpec{ClusterIP: addr("10.96", ix)},
+		}
+		ports := types.PortMap{}
+		subset := v1.EndpointSubset{}
+		for p := 0; p < spec.Ports; p++ {
+			portName := fmt.Sprintf("port-%d", p)
+			svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Name: portName, Port: int32(8000 + p)})
+			subset.Ports = append(subset.Ports, v1.EndpointPort{Name: portName, Port: int32(8000 + p)})
+			ports[fmt.Sprint(80+p)] = &types.ServiceDef{Namespace: ConfigKey, Service: name, PortName: portName, TCPEnabled: true}
+		}
+		for e := 0; e < spec.Endpoints; e++ {
+			node := nodeName(pod % spec.Nodes)
+			ip := addr("10.244", pod%(1<<16))
+			subset.Addresses = append(subset.Addresses, v1.EndpointAddress{IP: ip, NodeName: &node})
+			c.Pods = append(c.Pods, v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: ConfigKey, Name: fmt.Sprintf("%s-%d", name, e)},
+				Spec:       v1.PodSpec{NodeName: node},
+				Status:     v1.PodStatus{PodIP: ip, Phase: v1.PodRunning},
+			})
+			pod++
+		}
+		c.Services = append(c.Services, svc)
+		c.Endpoints = append(c.Endpoints, v1.Endpoints{ObjectMeta: svc.ObjectMeta, Subsets: []v1.EndpointSubset{subset}})
+		config.Config[types.ServiceIP(addr("10.200", ix))] = ports
+	}
+
+	b, err := json.Marshal(&config)
+	if err != nil {
+		return Cluster{}, err
+	}
+	c.ConfigMap = &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ConfigKey, Name: ConfigKey},
+		Data:       map[string]string{ConfigKey: string(b)},
+	}
+	return c, nil
+}
+
+// Phase is the time and allocations of a phase of a reconcile, over the runs
+// of a benchmark.
+type Phase struct {
+	Name string        `json:"name"`
+	Runs int           `json:"runs"`
+	Mean time.Duration `json:"mean"`
+	Max  time.Duration `json:"max"`
+	// AllocBytes and Allocs are per run
+	AllocBytes uint64 `json:"allocBytes"`
+	Allocs     uint64 `json:"allocs"`
+	// Changes is the number of changes the phase planned
+	Changes int `json:"changes"`
+}
+
+// Report is the outcome of a benchmark.
+type Report struct {
+	Mode   string  `json:"mode"`
+	Spec   Spec    `json:"spec"`
+	Phases []Phase `json:"phases"`
+}
+
+// measure runs fn runs times, and returns its time and allocations.
+func measure(name string, runs int, fn func() (int, error)) (Phase, error) {
+	p := Phase{Name: name, Runs: runs}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	var total time.Duration
+	for ix := 0; ix < runs; ix++ {
+		start := time.Now()
+		changes, err := fn()
+		took := time.Since(start)
+		if err != nil {
+			return p, fmt.Errorf("%s: %v", name, err)
+		}
+		total += took
+		if took > p.Max {
+			p.Max = took
+		}
+		p.Changes = changes
+	}
+	runtime.ReadMemStats(&after)
+	p.Mean = total / time.Duration(runs)
+	p.AllocBytes = (after.TotalAlloc - before.TotalAlloc) / uint64(runs)
+	p.Allocs = (after.Mallocs - before.Mallocs) / uint64(runs)
+	return p, nil
+}
+
+// emptyNAT is the nat table of a node with nothing on it, as iptables-save
+// prints it.
+const emptyNAT = `*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+COMMIT
+`
+
+// ribHeader is the header gobgp prints above the routes of a RIB.
+const ribHeader = "   Network              Next Hop             AS_PATH              Age        Attrs\n"
+
+// Run benchmarks the reconcile of mode, one of those of ravel simulate, over
+// the cluster of spec, running each phase runs times. The helpers are those of
+// the mode, as simulate configures them.
+func Run(mode string, spec Spec, runs int, h simulate.Helpers, logger logging.Logger) (Report, error) {
+	subsystems := simulate.Subsystems(mode)
+	if subsystems == nil {
+		return Report{}, fmt.Errorf("unknown mode %s. must be one of %s|%s|%s", mode, stats.KindBGPDirector, stats.KindIpvsMaster, stats.KindIpvsBackend)
+	}
+	if runs < 1 {
+		return Report{}, fmt.Errorf("runs must be at least 1")
+	}
+	c, err := Generate(spec)
+	if err != nil {
+		return Report{}, err
+	}
+	report := Report{Mode: mode, Spec: spec}
+	add := func(name string, fn func() (int, error)) error {
+		p, err := measure(name, runs, fn)
+		if err != nil {
+			return err
+		}
+		report.Phases = append(report.Phases, p)
+		return nil
+	}
+
+	var w *watcher.Watcher
+	if err := add("watcher", func() (int, error) {
+		w = watcher.NewStaticWatcher(ConfigKey, "", 0, c.Services, c.Endpoints, c.Pods, c.Nodes, logger)
+		return 0, nil
+	}); err != nil {
+		return report, err
+	}
+	var config *types.ClusterConfig
+	if err := add("build", func() (int, error) {
+		config, err = w.Build(c.ConfigMap)
+		return 0, err
+	}); err != nil {
+		return report, err
+	}
+
+	empty := simulate.State{IPVS: []byte{}, IPTables: []byte(emptyNAT), Links: []byte{}, RIB: map[string][]byte{"ipv4": []byte(ribHeader), "ipv6": []byte(ribHeader)}}
+	converged, err := convergedState(mode, w, config, h)
+	if err != nil {
+		return report, err
+	}
+	for _, state := range []struct {
+		name  string
+		state simulate.State
+	}{{"first", empty}, {"steady", converged}} {
+		for _, subsystem := range subsystems {
+			subsystem, name, state := subsystem, state.name, state.state
+			if err := add(subsystem+" "+name, func() (int, error) {
+				changes, err := simulate.PlanSubsystem(subsystem, mode, nodeName(0), state, w, config, h)
+				return len(changes), err
+			}); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// convergedState renders the state of a node that holds config, as its
+// commands would print it, from the rules the helpers generate.
+func convergedState(mode string, w *watcher.Watcher, config *types.ClusterConfig, h simulate.Helpers) (simulate.State, error) {
+	state := simulate.State{RIB: map[string][]byte{}}
+	families := []string{"ipv4", "ipv6"}
+	if mode == stats.KindIpvsMaster {
+		families = families[:1]
+	}
+
+	links, ipvs := &strings.Builder{}, &strings.Builder{}
+	for _, family := range families {
+		vips, isV6 := config.Config, family == "ipv6"
+		if isV6 {
+			vips = config.Config6
+		}
+		rib := &strings.Builder{}
+		rib.WriteString(ribHeader)
+		ix := 100
+		for vip := range vips {
+			ix++
+			fmt.Fprintf(links, "%d: %s: <BROADCAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000\n", ix, h.IP.Device(string(vip), isV6))
+			fmt.Fprintf(links, "    link/ether 5a:b2:1e:4f:0c:11 brd ff:ff:ff:ff:ff:ff promiscuity 0\n")
+			fmt.Fprintf(links, "    dummy addrgenmode eui64 numtxqueues 1 numrxqueues 1 gso_max_size 65536 gso_max_segs 65535\n")
+			prefix := string(vip) + "/32"
+			if isV6 {
+				prefix = string(vip) + "/128"
+			}
+			fmt.Fprintf(rib, "*> %-20s 0.0.0.0                                   00:00:21   [{Origin: ?}]\n", prefix)
+		}
+		state.RIB[family] = []byte(rib.String())
+
+		if h.IPVS != nil {
+			rules, err := h.IPVS.Plan(w, config, nil, family)
+			if err != nil {
+				return state, err
+			}
+			for _, rule := range rules {
+				ipvs.WriteString(rule + "\n")
+			}
+		}
+	}
+	state.Links, state.IPVS = []byte(links.String()), []byte(ipvs.String())
+
+	state.IPTables = []byte(emptyNAT)
+	for _, subsystem := range simulate.Subsystems(mode) {
+		if subsystem != audit.SubsystemIPTables {
+			continue
+		}
+		generated, err := h.IPTables.GenerateRulesForNodeClassic(w, nodeName(0), config, mode == stats.KindIpvsMaster)
+		if err != nil {
+			return state, err
+		}
+		merged, _, err := h.IPTables.Plan([]byte(emptyNAT), generated)
+		if err != nil {
+			return state, err
+		}
+		state.IPTables = iptables.BytesFromRules(merged)
+	}
+	return state, nil
+}
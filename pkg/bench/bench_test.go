@@ -0,0 +1,57 @@
+package bench
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/simulate"
+	"github.com/Comcast/Ravel/pkg/system"
+)
+
+func TestRun(t *testing.T) {
+	logger := logging.Discard()
+	spec := Spec{VIPs: 20, Nodes: 5, Ports: 2, Endpoints: 3}
+
+	c, err := Generate(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Services) != 20 || len(c.Nodes) != 5 || len(c.Pods) != 60 {
+		t.Fatalf("unexpected cluster of %d services, %d nodes and %d pods", len(c.Services), len(c.Nodes), len(c.Pods))
+	}
+	if _, err := Generate(Spec{VIPs: 1, Nodes: 1, Ports: 1}); err == nil {
+		t.Fatal("expected a spec without endpoints to be invalid")
+	}
+
+	ip, _ := system.NewIP(context.Background(), "lo", "", 0, 0, logger)
+	for _, mode := range []string{"bgp", "director", "realserver"} {
+		ipvs, _ := system.NewIPVS(context.Background(), "10.128.0.0", false, false, logger, mode)
+		ipt, _ := iptables.NewIPTables(context.Background(), mode, ConfigKey, "", "RAVEL", false, logger)
+		report, err := Run(mode, spec, 2, simulate.Helpers{IP: ip, IPVS: ipvs, IPTables: ipt}, logger)
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		subsystems := simulate.Subsystems(mode)
+		if len(report.Phases) != 2+2*len(subsystems) {
+			t.Fatalf("%s: unexpected phases %+v", mode, report.Phases)
+		}
+		for _, p := range report.Phases {
+			if p.Runs != 2 || p.Max < p.Mean {
+				t.Fatalf("%s: unexpected phase %+v", mode, p)
+			}
+		}
+		// the first reconcile changes every subsystem, and those after change
+		// nothing
+		for ix, subsystem := range subsystems {
+			first, steady := report.Phases[2+ix], report.Phases[2+len(subsystems)+ix]
+			if first.Name != subsystem+" first" || first.Changes == 0 {
+				t.Fatalf("%s: expected the first reconcile to change %s, got %+v", mode, subsystem, first)
+			}
+			if steady.Name != subsystem+" steady" || steady.Changes != 0 {
+				t.Fatalf("%s: expected a steady reconcile to change nothing in %s, got %+v", mode, subsystem, steady)
+			}
+		}
+	}
+}
@@ -3,11 +3,17 @@ package bgp
 import (
 	"context"
 	"fmt"
+	"net"
 	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/observe"
 )
 
 // The Controller provides an interface for configuring BGP.
@@ -25,14 +31,22 @@ type Controller interface {
 	// SetV6 set, for v6.  Very similar to above function
 	SetV6(ctx context.Context, addresses []string, communities []string) error
 
+	// RIB returns the prefixes in the RIB for family ipv4 or ipv6.
+	RIB(ctx context.Context, family string) ([]string, error)
+
+	// Withdraw removes addresses of family ipv4 or ipv6 from BGP.
+	Withdraw(ctx context.Context, family string, addresses []string) error
+
 	// Teardown removes all addresses from BGP.
-	// Perhaps this will never be applied.
 	Teardown(context.Context) error
 }
 
 type GoBGPDController struct {
 	commandPath string
-	logger      logrus.FieldLogger
+	logger      logging.Logger
+
+	// v6 addresses announced by this process, for the audit trail
+	announced6 map[string]bool
 }
 
 // Get fetches a list of configured addresses in gobgp
@@ -88,6 +102,10 @@ func (g *GoBGPDController) Set(ctx context.Context, addresses, configuredAddress
 	// $PATH/gobgp global rib -a ipv4 add 10.54.213.148/32
 	for _, address := range toAdd {
 		cidr := address + "/32"
+		if observe.Enabled() {
+			observe.Would(audit.SubsystemBGP, "announce", cidr, strings.Join(communities, ","))
+			continue
+		}
 		// g.logger.Debugf("Advertising route to %s", cidr)
 		args := []string{"global", "rib", "-a", "ipv4", "add", cidr}
 		// if communities are supplied, add it here as a community
@@ -106,7 +124,9 @@ func (g *GoBGPDController) Set(ctx context.Context, addresses, configuredAddress
 		// set a timeout context for this command
 		cmdCtx, cmdCtxCancel := context.WithTimeout(ctx, time.Second*20)
 		defer cmdCtxCancel()
-		if err := exec.CommandContext(cmdCtx, g.commandPath, args...).Run(); err != nil {
+		err := exec.CommandContext(cmdCtx, g.commandPath, args...).Run()
+		audit.Record(audit.SubsystemBGP, "announce", cidr, strings.Join(communities, ","), err)
+		if err != nil {
 			return fmt.Errorf("adding route %s with %s: %s", cidr, strings.Join(append([]string{g.commandPath}, args...), " "), err)
 		}
 	}
@@ -118,6 +138,13 @@ func (g *GoBGPDController) SetV6(ctx context.Context, addresses []string, commun
 	// $PATH/gobgp global rib -a ipv6 add [2001:558:1044:1ae:10ad:ba1a:0000:0007]/128
 	for _, address := range addresses {
 		cidr := address + "/128"
+		if observe.Enabled() {
+			if !g.announced6[address] {
+				observe.Would(audit.SubsystemBGP, "announce", cidr, strings.Join(communities, ","))
+			}
+			g.announced6[address] = true
+			continue
+		}
 		// g.logger.Debugf("Advertising route to %s", cidr)
 		args := []string{"global", "rib", "-a", "ipv6", "add", cidr}
 		// if communities are supplied, add it here as a community
@@ -136,20 +163,226 @@ func (g *GoBGPDController) SetV6(ctx context.Context, addresses []string, commun
 		// set a timeout context for this command
 		cmdCtx, cmdCtxCancel := context.WithTimeout(ctx, time.Second*20)
 		defer cmdCtxCancel()
-		if err := exec.CommandContext(cmdCtx, g.commandPath, args...).Run(); err != nil {
+		err := exec.CommandContext(cmdCtx, g.commandPath, args...).Run()
+		// every v6 address is announced on each pass, so only the first
+		// announcement of an address is recorded.
+		if err != nil || !g.announced6[address] {
+			audit.Record(audit.SubsystemBGP, "announce", cidr, strings.Join(communities, ","), err)
+		}
+		g.announced6[address] = err == nil
+		if err != nil {
 			return fmt.Errorf("adding route %s with %s: %s", cidr, strings.Join(append([]string{g.commandPath}, args...), " "), err)
 		}
 	}
 	return nil
 }
 
-func (g *GoBGPDController) Teardown(context.Context) error {
-	// I suspect that we don't want to remove all addresses' routes,
-	// but rather one at a time, if any at all.
-	g.logger.Info("Tear down: Let's leave things how they are.")
+// RIB returns the prefixes in the gobgp global RIB for family ipv4 or ipv6.
+func (g *GoBGPDController) RIB(ctx context.Context, family string) ([]string, error) {
+	cmdCtx, cmdCtxCancel := context.WithTimeout(ctx, time.Second*20)
+	defer cmdCtxCancel()
+	out, err := exec.CommandContext(cmdCtx, g.commandPath, "global", "rib", "-a", family).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("could not list the %s rib from gobgp: %v", family, err)
+	}
+	return parsePrefixes(out), nil
+}
+
+// AdjOut returns the number of prefixes of family ipv4 or ipv6 advertised to
+// a peer.
+func (g *GoBGPDController) AdjOut(ctx context.Context, peer, family string) (int, error) {
+	cmdCtx, cmdCtxCancel := context.WithTimeout(ctx, time.Second*20)
+	defer cmdCtxCancel()
+	out, err := exec.CommandContext(cmdCtx, g.commandPath, "neighbor", peer, "adj-out", "-a", family).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("could not list the %s routes advertised to %s from gobgp: %v", family, peer, err)
+	}
+	return len(parsePrefixes(out)), nil
+}
+
+// parsePrefixes returns the network column of a gobgp route listing, which
+// is the first field that is a prefix. The global rib and adj-out listings
+// put different columns before it.
+//
+//	   Network              Next Hop             AS_PATH              Age        Attrs
+//	*> 10.131.153.120/32    0.0.0.0                                   00:00:21   [{Origin: ?}]
+func parsePrefixes(output []byte) []string {
+	prefixes := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		for _, field := range strings.Fields(line) {
+			if _, _, err := net.ParseCIDR(field); err == nil {
+				prefixes = append(prefixes, field)
+				break
+			}
+		}
+	}
+	return prefixes
+}
+
+// Announcements returns the prefixes Set or SetV6 would announce for addrs
+// of family ipv4 or ipv6, those missing from rib, a listing of the global
+// RIB. Neither withdraws the routes of addresses that are gone.
+func Announcements(rib []byte, family string, addrs []string) []string {
+	bits := "/32"
+	if family == addrKindIPV6 {
+		bits = "/128"
+	}
+	announced := map[string]bool{}
+	for _, prefix := range parsePrefixes(rib) {
+		announced[normalizePrefix(prefix)] = true
+	}
+	prefixes := []string{}
+	for _, addr := range addrs {
+		if prefix := normalizePrefix(addr + bits); !announced[prefix] {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// Peer is a gobgp neighbor and the prefixes it sent.
+type Peer struct {
+	Address  string
+	State    string
+	Received int
+	Accepted int
+}
+
+// Peers lists the gobgp neighbors.
+func (g *GoBGPDController) Peers(ctx context.Context) ([]Peer, error) {
+	cmdCtx, cmdCtxCancel := context.WithTimeout(ctx, time.Second*20)
+	defer cmdCtxCancel()
+	out, err := exec.CommandContext(cmdCtx, g.commandPath, "neighbor").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("could not list neighbors from gobgp: %v", err)
+	}
+	return parsePeers(out), nil
+}
+
+// Neighbors returns the session state of each gobgp peer by address.
+func (g *GoBGPDController) Neighbors(ctx context.Context) (map[string]string, error) {
+	peers, err := g.Peers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return neighborStates(peers), nil
+}
+
+// parseNeighborOutput reads the peer and state columns out of `gobgp neighbor`.
+func parseNeighborOutput(output []byte) map[string]string {
+	return neighborStates(parsePeers(output))
+}
+
+func neighborStates(peers []Peer) map[string]string {
+	states := map[string]string{}
+	for _, p := range peers {
+		states[p.Address] = p.State
+	}
+	return states
+}
+
+// parsePeers reads the peers out of `gobgp neighbor`. The Up/Down column may
+// contain spaces, so the state is taken as the last field before the
+// received/accepted columns.
+//
+//	Peer            AS  Up/Down State       |#Received  Accepted
+//	10.54.213.1  65000 3d 04:02:01 Establ   |        3         3
+func parsePeers(output []byte) []Peer {
+	peers := []Peer{}
+	lines := strings.Split(string(output), "\n")
+	// start at 1 to skip columnar format line
+	for i := 1; i < len(lines); i++ {
+		columns := strings.Split(lines[i], "|")
+		fields := strings.Fields(columns[0])
+		if len(fields) < 3 {
+			continue
+		}
+		p := Peer{Address: fields[0], State: fields[len(fields)-1]}
+		if len(columns) > 1 {
+			if counts := strings.Fields(columns[1]); len(counts) == 2 {
+				p.Received, _ = strconv.Atoi(counts[0])
+				p.Accepted, _ = strconv.Atoi(counts[1])
+			}
+		}
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Health reports ready when at least one gobgp peer is established.
+func (g *GoBGPDController) Health(ctx context.Context) health.Status {
+	peers, err := g.Neighbors(ctx)
+	if err != nil {
+		return health.Status{Message: err.Error()}
+	}
+	for _, state := range peers {
+		if state == "Establ" {
+			return health.Status{Ready: true, Detail: peers}
+		}
+	}
+	return health.Status{Message: "no bgp peers are established", Detail: peers}
+}
+
+// Teardown withdraws every prefix in the global RIB, for both families.
+func (g *GoBGPDController) Teardown(ctx context.Context) error {
+	errs := []string{}
+	for _, family := range []string{addrKindIPV4, addrKindIPV6} {
+		prefixes, err := g.RIB(ctx, family)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		for _, prefix := range prefixes {
+			if err := g.withdraw(ctx, family, prefix); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	g.logger.Info("withdrew all routes from bgp")
+	return nil
+}
+
+// Withdraw withdraws the routes to addresses of family ipv4 or ipv6.
+func (g *GoBGPDController) Withdraw(ctx context.Context, family string, addresses []string) error {
+	suffix := "/32"
+	if family == addrKindIPV6 {
+		suffix = "/128"
+	}
+	errs := []string{}
+	for _, address := range addresses {
+		if err := g.withdraw(ctx, family, address+suffix); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// withdraw deletes prefix from the global RIB of family.
+func (g *GoBGPDController) withdraw(ctx context.Context, family, prefix string) error {
+	if observe.Enabled() {
+		observe.Would(audit.SubsystemBGP, "withdraw", prefix, "")
+		delete(g.announced6, strings.TrimSuffix(prefix, "/128"))
+		return nil
+	}
+	// $PATH/gobgp global rib -a ipv4 del 10.54.213.148/32
+	cmdCtx, cmdCtxCancel := context.WithTimeout(ctx, time.Second*20)
+	defer cmdCtxCancel()
+	err := exec.CommandContext(cmdCtx, g.commandPath, "global", "rib", "-a", family, "del", prefix).Run()
+	audit.Record(audit.SubsystemBGP, "withdraw", prefix, "", err)
+	if err != nil {
+		return fmt.Errorf("withdrawing route %s: %v", prefix, err)
+	}
+	delete(g.announced6, strings.TrimSuffix(prefix, "/128"))
 	return nil
 }
 
-func NewBGPDController(executablePath string, logger logrus.FieldLogger) *GoBGPDController {
-	return &GoBGPDController{commandPath: executablePath, logger: logger}
+func NewBGPDController(executablePath string, logger logging.Logger) *GoBGPDController {
+	return &GoBGPDController{commandPath: executablePath, logger: logger, announced6: map[string]bool{}}
 }
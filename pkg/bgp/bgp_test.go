@@ -1,8 +1,18 @@
 package bgp
 
 import (
+	"context"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
 )
 
 /*
@@ -32,3 +42,127 @@ func TestParseBGPOutput(t *testing.T) {
 		t.Fatalf("outputs were not equal. expected %v, saw %v:", shouldEqual, outParsed)
 	}
 }
+
+var neighborOutput = []byte(`Peer            AS  Up/Down State       |#Received  Accepted
+10.54.213.1  65000 3d 04:02:01 Establ   |        3         3
+10.54.213.2  65000   never Active       |        0         0
+`)
+
+func TestParseNeighborOutput(t *testing.T) {
+	shouldEqual := map[string]string{
+		"10.54.213.1": "Establ",
+		"10.54.213.2": "Active",
+	}
+	outParsed := parseNeighborOutput(neighborOutput)
+
+	if !reflect.DeepEqual(shouldEqual, outParsed) {
+		t.Fatalf("outputs were not equal. expected %v, saw %v:", shouldEqual, outParsed)
+	}
+}
+
+func TestParsePeers(t *testing.T) {
+	shouldEqual := []Peer{
+		{Address: "10.54.213.1", State: "Establ", Received: 3, Accepted: 3},
+		{Address: "10.54.213.2", State: "Active"},
+	}
+	outParsed := parsePeers(neighborOutput)
+
+	if !reflect.DeepEqual(shouldEqual, outParsed) {
+		t.Fatalf("outputs were not equal. expected %v, saw %v:", shouldEqual, outParsed)
+	}
+}
+
+var adjOutOutput = []byte(`   ID  Network               Next Hop             AS_PATH              Attrs
+   1   10.131.153.120/32     10.54.213.10                              [{Origin: ?}]
+   2   2001:558:1044::7/128  ::                                        [{Origin: ?}]
+`)
+
+func TestParsePrefixes(t *testing.T) {
+	shouldEqual := []string{"10.131.153.120/32", "2001:558:1044::7/128"}
+	outParsed := parsePrefixes(adjOutOutput)
+
+	if !reflect.DeepEqual(shouldEqual, outParsed) {
+		t.Fatalf("outputs were not equal. expected %v, saw %v:", shouldEqual, outParsed)
+	}
+}
+
+type fakeRIB struct {
+	rib map[string][]string
+}
+
+func (f *fakeRIB) RIB(_ context.Context, family string) ([]string, error) {
+	return f.rib[family], nil
+}
+
+func (f *fakeRIB) Peers(context.Context) ([]Peer, error) {
+	return []Peer{{Address: "10.54.213.1", State: "Establ", Received: 3, Accepted: 2}}, nil
+}
+
+func (f *fakeRIB) AdjOut(_ context.Context, _, family string) (int, error) {
+	return len(f.rib[family]), nil
+}
+
+func TestRIBCollector(t *testing.T) {
+	rib := &fakeRIB{rib: map[string][]string{
+		addrKindIPV4: {"10.131.153.120/32", "10.131.153.121/32"},
+		addrKindIPV6: {},
+	}}
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{"10.131.153.120": nil, "10.131.153.121": nil, "10.131.153.122": nil},
+	}
+	prefixes := NewPrefixTracker()
+	prefixes.Write(audit.Event{Subsystem: audit.SubsystemBGP, Action: "announce", Target: "10.131.153.121/32"})
+	prefixes.Write(audit.Event{Subsystem: audit.SubsystemBGP, Action: "announce", Target: "10.131.153.122/32", Error: "exit status 1"})
+	prefixes.Write(audit.Event{Subsystem: audit.SubsystemBGP, Action: "announce", Target: "2001:0558:1044::0007/128"})
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewRIBCollector(stats.KindBGPDirector, rib, func() *types.ClusterConfig { return config }, prefixes, logging.New()))
+
+	expected := `
+# HELP ravel_bgp_prefix_advertised is 1 while a prefix is advertised, and 0 once its announcement failed or it went missing from the gobgp rib
+# TYPE ravel_bgp_prefix_advertised gauge
+ravel_bgp_prefix_advertised{family="v4",lb="bgp",prefix="10.131.153.120/32"} 1
+ravel_bgp_prefix_advertised{family="v4",lb="bgp",prefix="10.131.153.121/32"} 1
+ravel_bgp_prefix_advertised{family="v4",lb="bgp",prefix="10.131.153.122/32"} 0
+ravel_bgp_prefix_advertised{family="v6",lb="bgp",prefix="2001:558:1044::7/128"} 0
+# HELP ravel_bgp_prefixes_advertised is the number of prefixes in the gobgp global rib
+# TYPE ravel_bgp_prefixes_advertised gauge
+ravel_bgp_prefixes_advertised{family="v4",lb="bgp"} 2
+ravel_bgp_prefixes_advertised{family="v6",lb="bgp"} 0
+# HELP ravel_bgp_prefixes_configured is the number of VIPs in the cluster config, each of which should be advertised
+# TYPE ravel_bgp_prefixes_configured gauge
+ravel_bgp_prefixes_configured{family="v4",lb="bgp"} 3
+ravel_bgp_prefixes_configured{family="v6",lb="bgp"} 0
+# HELP ravel_bgp_peer_prefixes_advertised is the number of prefixes advertised to an established bgp peer
+# TYPE ravel_bgp_peer_prefixes_advertised gauge
+ravel_bgp_peer_prefixes_advertised{family="v4",lb="bgp",peer="10.54.213.1"} 2
+ravel_bgp_peer_prefixes_advertised{family="v6",lb="bgp",peer="10.54.213.1"} 0
+`
+	names := []string{"ravel_bgp_prefix_advertised", "ravel_bgp_prefixes_advertised", "ravel_bgp_prefixes_configured", "ravel_bgp_peer_prefixes_advertised"}
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), names...); err != nil {
+		t.Fatal(err)
+	}
+
+	// gobgpd restarted and lost 10.131.153.120, which was announced before
+	// ravel started
+	rib.rib[addrKindIPV4] = []string{"10.131.153.121/32"}
+	expected = `
+# HELP ravel_bgp_prefix_advertised is 1 while a prefix is advertised, and 0 once its announcement failed or it went missing from the gobgp rib
+# TYPE ravel_bgp_prefix_advertised gauge
+ravel_bgp_prefix_advertised{family="v4",lb="bgp",prefix="10.131.153.120/32"} 0
+ravel_bgp_prefix_advertised{family="v4",lb="bgp",prefix="10.131.153.121/32"} 1
+ravel_bgp_prefix_advertised{family="v4",lb="bgp",prefix="10.131.153.122/32"} 0
+ravel_bgp_prefix_advertised{family="v6",lb="bgp",prefix="2001:558:1044::7/128"} 0
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "ravel_bgp_prefix_advertised"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the director withdrew its routes on exit, which counts before the
+	// rib is read again
+	prefixes.Write(audit.Event{Subsystem: audit.SubsystemBGP, Action: "withdraw", Target: "10.131.153.121/32"})
+	expected = strings.Replace(expected, `prefix="10.131.153.121/32"} 1`, `prefix="10.131.153.121/32"} 0`, 1)
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "ravel_bgp_prefix_advertised"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,237 @@
+package bgp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/observe"
+)
+
+// An operator steering traffic during an incident can announce or withdraw a
+// VIP of a bgp director by hand, with `ravel bgp announce|withdraw`, and the
+// director holds it that way over every reconfigure until the override is
+// cleared. An announced VIP carries the communities of its override instead
+// of the director's, and is announced whether or not the director's shard
+// holds it. Overrides are kept in a file, so that they outlast a restart, and
+// only apply to the VIPs of the cluster config. Maintenance still withdraws
+// every route.
+
+const (
+	// OverrideAnnounce announces a VIP, with the communities of the override
+	OverrideAnnounce = "announce"
+	// OverrideWithdraw keeps the route to a VIP withdrawn
+	OverrideWithdraw = "withdraw"
+)
+
+// Override is a VIP announced or withdrawn by hand.
+type Override struct {
+	VIP         string    `json:"vip"`
+	Action      string    `json:"action"`
+	Communities []string  `json:"communities,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	Since       time.Time `json:"since"`
+}
+
+// Overrides are the overrides of a bgp director, by VIP.
+type Overrides struct {
+	sync.Mutex
+	path      string
+	overrides map[string]Override
+	// changed holds the VIPs whose override was set or cleared since the
+	// worker last applied it
+	changed map[string]bool
+}
+
+// LoadOverrides returns the overrides recorded in path, which is created
+// when one is set. With no path they are kept in memory.
+func LoadOverrides(path string) (*Overrides, error) {
+	o := newOverrides(path)
+	if path == "" {
+		return o, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the bgp overrides from %s. %v", path, err)
+	}
+	list := []Override{}
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("unable to read the bgp overrides from %s. %v", path, err)
+	}
+	for _, ov := range list {
+		if err := ov.valid(); err != nil {
+			return nil, fmt.Errorf("invalid bgp override in %s. %v", path, err)
+		}
+		vip := canonicalVIP(ov.VIP)
+		o.overrides[vip] = ov
+		// what is announced after a restart may not carry the override yet
+		o.changed[vip] = true
+	}
+	return o, nil
+}
+
+func newOverrides(path string) *Overrides {
+	return &Overrides{path: path, overrides: map[string]Override{}, changed: map[string]bool{}}
+}
+
+func (ov Override) valid() error {
+	if net.ParseIP(ov.VIP) == nil {
+		return fmt.Errorf("%q is not an ip address", ov.VIP)
+	}
+	if ov.Action != OverrideAnnounce && ov.Action != OverrideWithdraw {
+		return fmt.Errorf("unknown action %q. must be one of %s|%s", ov.Action, OverrideAnnounce, OverrideWithdraw)
+	}
+	if ov.Action == OverrideWithdraw && len(ov.Communities) > 0 {
+		return fmt.Errorf("a withdrawn VIP carries no communities")
+	}
+	for _, c := range ov.Communities {
+		if c == "" || strings.ContainsAny(c, " ,") {
+			return fmt.Errorf("invalid community %q", c)
+		}
+	}
+	return nil
+}
+
+// canonicalVIP is vip as net.IP prints it, so that the spellings of a v6
+// address match.
+func canonicalVIP(vip string) string {
+	if ip := net.ParseIP(vip); ip != nil {
+		return ip.String()
+	}
+	return vip
+}
+
+// Set records ov, replacing any override of its VIP.
+func (o *Overrides) Set(ov Override) error {
+	if err := ov.valid(); err != nil {
+		return err
+	}
+	if ov.Since.IsZero() {
+		ov.Since = time.Now()
+	}
+	o.Lock()
+	defer o.Unlock()
+	vip := canonicalVIP(ov.VIP)
+	previous, had := o.overrides[vip]
+	o.overrides[vip] = ov
+	if err := o.record(); err != nil {
+		if had {
+			o.overrides[vip] = previous
+		} else {
+			delete(o.overrides, vip)
+		}
+		return err
+	}
+	o.changed[vip] = true
+	return nil
+}
+
+// Clear removes the override of vip, and reports whether there was one.
+func (o *Overrides) Clear(vip string) (bool, error) {
+	o.Lock()
+	defer o.Unlock()
+	vip = canonicalVIP(vip)
+	previous, ok := o.overrides[vip]
+	if !ok {
+		return false, nil
+	}
+	delete(o.overrides, vip)
+	if err := o.record(); err != nil {
+		o.overrides[vip] = previous
+		return false, err
+	}
+	o.changed[vip] = true
+	return true, nil
+}
+
+// List returns the overrides, ordered by VIP.
+func (o *Overrides) List() []Override {
+	o.Lock()
+	defer o.Unlock()
+	list := []Override{}
+	for _, ov := range o.overrides {
+		list = append(list, ov)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].VIP < list[j].VIP })
+	return list
+}
+
+// split returns addrs without the VIPs that are overridden, and the overrides
+// of those VIPs.
+func (o *Overrides) split(addrs []string) ([]string, []Override) {
+	o.Lock()
+	defer o.Unlock()
+	rest := []string{}
+	overridden := []Override{}
+	for _, addr := range addrs {
+		if ov, ok := o.overrides[canonicalVIP(addr)]; ok {
+			ov.VIP = addr
+			overridden = append(overridden, ov)
+			continue
+		}
+		rest = append(rest, addr)
+	}
+	return rest, overridden
+}
+
+// take returns those of addrs whose override changed since they were last
+// taken, and forgets the change.
+func (o *Overrides) take(addrs []string) map[string]bool {
+	o.Lock()
+	defer o.Unlock()
+	changed := map[string]bool{}
+	for _, addr := range addrs {
+		if vip := canonicalVIP(addr); o.changed[vip] {
+			changed[addr] = true
+			delete(o.changed, vip)
+		}
+	}
+	return changed
+}
+
+// retry has the changes to addrs applied again, after they failed.
+func (o *Overrides) retry(addrs []string) {
+	o.Lock()
+	defer o.Unlock()
+	for _, addr := range addrs {
+		o.changed[canonicalVIP(addr)] = true
+	}
+}
+
+// record writes the overrides to their file. An observer creates nothing, so
+// records nothing. It is called with the lock held.
+func (o *Overrides) record() error {
+	if o.path == "" || observe.Enabled() {
+		return nil
+	}
+	list := []Override{}
+	for _, ov := range o.overrides {
+		list = append(list, ov)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].VIP < list[j].VIP })
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(o.path), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(o.path+".tmp", append(b, '\n'), 0644)
+	}
+	if err == nil {
+		err = os.Rename(o.path+".tmp", o.path)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to record the bgp overrides in %s. %v", o.path, err)
+	}
+	return nil
+}
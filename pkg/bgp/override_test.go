@@ -0,0 +1,127 @@
+package bgp
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+func TestOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overrides")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bgp-overrides-green")
+
+	o, err := LoadOverrides(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Set(Override{VIP: "10.54.213.148", Action: OverrideAnnounce, Communities: []string{"65000:100"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Set(Override{VIP: "2001:558:1044:1ae:0:0:0:7", Action: OverrideWithdraw, Reason: "incident"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, ov := range []Override{
+		{VIP: "lb01", Action: OverrideWithdraw},
+		{VIP: "10.54.213.149", Action: "drop"},
+		{VIP: "10.54.213.149", Action: OverrideWithdraw, Communities: []string{"65000:100"}},
+		{VIP: "10.54.213.149", Action: OverrideAnnounce, Communities: []string{"65000:100,65000:200"}},
+	} {
+		if err := o.Set(ov); err == nil {
+			t.Fatalf("expected %+v to be refused", ov)
+		}
+	}
+
+	// the overrides outlast a restart, and are applied again after it
+	o, err = LoadOverrides(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := o.List(); len(list) != 2 || list[0].VIP != "10.54.213.148" || list[1].Reason != "incident" {
+		t.Fatalf("expected both overrides read back, got %+v", list)
+	}
+	rest, overridden := o.split([]string{"10.54.213.147", "10.54.213.148"})
+	if !reflect.DeepEqual(rest, []string{"10.54.213.147"}) || len(overridden) != 1 || overridden[0].Communities[0] != "65000:100" {
+		t.Fatalf("expected 10.54.213.148 overridden, got %v %+v", rest, overridden)
+	}
+	if changed := o.take([]string{"10.54.213.148", "2001:558:1044:1ae::7"}); len(changed) != 2 {
+		t.Fatalf("expected both VIPs changed after a restart, got %v", changed)
+	}
+
+	// a v6 VIP is cleared however it is spelled
+	if ok, err := o.Clear("2001:558:1044:1ae::7"); !ok || err != nil {
+		t.Fatalf("expected the v6 override cleared, got %v %v", ok, err)
+	}
+	if ok, _ := o.Clear("10.54.213.150"); ok {
+		t.Fatal("expected no override of 10.54.213.150 to clear")
+	}
+	b, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(b), "incident") {
+		t.Fatalf("expected the cleared override gone from %s", b)
+	}
+}
+
+// fakeController records the announcements and withdrawals made.
+type fakeController struct {
+	calls []string
+}
+
+func (f *fakeController) Get(context.Context) ([]string, error) { return nil, nil }
+func (f *fakeController) Set(_ context.Context, addrs, _ []string, communities []string) error {
+	f.calls = append(f.calls, "announce "+strings.Join(addrs, ",")+" "+strings.Join(communities, ","))
+	return nil
+}
+func (f *fakeController) SetV6(_ context.Context, addrs []string, communities []string) error {
+	f.calls = append(f.calls, "announce "+strings.Join(addrs, ",")+" "+strings.Join(communities, ","))
+	return nil
+}
+func (f *fakeController) RIB(context.Context, string) ([]string, error) { return nil, nil }
+func (f *fakeController) Withdraw(_ context.Context, family string, addrs []string) error {
+	f.calls = append(f.calls, "withdraw "+strings.Join(addrs, ","))
+	return nil
+}
+func (f *fakeController) Teardown(context.Context) error { return nil }
+
+func TestApplyOverrides(t *testing.T) {
+	controller := &fakeController{}
+	b := &bgpserver{bgp: controller, overrides: newOverrides(""), logger: logging.New()}
+	b.overrides.Set(Override{VIP: "10.54.213.148", Action: OverrideAnnounce, Communities: []string{"65000:100"}})
+	b.overrides.Set(Override{VIP: "10.54.213.149", Action: OverrideWithdraw})
+
+	apply := func(addrs, rib []string) []string {
+		changed := b.overrides.take(addrs)
+		addrs, overridden := b.overrides.split(addrs)
+		return b.applyOverrides(context.Background(), addrKindIPV4, overridden, addrs, rib, changed)
+	}
+
+	// an override that is set is applied at once, whatever the RIB holds
+	apply([]string{"10.54.213.147", "10.54.213.148", "10.54.213.149"}, []string{"10.54.213.147", "10.54.213.148", "10.54.213.149"})
+	expected := []string{"announce 10.54.213.148 65000:100", "withdraw 10.54.213.149"}
+	if !reflect.DeepEqual(controller.calls, expected) {
+		t.Fatalf("expected %v, got %v", expected, controller.calls)
+	}
+
+	// then only when the RIB differs
+	controller.calls = nil
+	apply([]string{"10.54.213.147", "10.54.213.148", "10.54.213.149"}, []string{"10.54.213.147", "10.54.213.148"})
+	if len(controller.calls) != 0 {
+		t.Fatalf("expected nothing to change, got %v", controller.calls)
+	}
+
+	// a VIP whose override is cleared is announced again by the director,
+	// with its own communities
+	b.overrides.Clear("10.54.213.148")
+	again := apply([]string{"10.54.213.147", "10.54.213.148", "10.54.213.149"}, []string{"10.54.213.147", "10.54.213.148"})
+	if !reflect.DeepEqual(again, []string{"10.54.213.148"}) || len(controller.calls) != 0 {
+		t.Fatalf("expected 10.54.213.148 to be announced again by the director, got %v %v", again, controller.calls)
+	}
+}
@@ -0,0 +1,246 @@
+package bgp
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// The RIB collector exports what gobgp advertises next to the VIPs in the
+// cluster config, so that an alert can fire when the two counts diverge: a
+// VIP that isn't announced gets no traffic. The global RIB and the prefixes
+// exchanged with each peer are read from gobgp on every scrape.
+//
+// The state of each prefix over time comes from the bgp announcements in the
+// audit trail. A prefix is advertised from its first successful announcement
+// until an announcement fails, or until it goes missing from the RIB, as it
+// does when gobgpd restarts, or until it is withdrawn on exit. Prefixes
+// found in the RIB are tracked as well, so that those announced before ravel
+// restarted are reported if they are withdrawn.
+
+// collectTimeout bounds the gobgp commands run for a scrape.
+const collectTimeout = 10 * time.Second
+
+// ribFamilies maps the family label to the gobgp address family.
+var ribFamilies = map[string]string{
+	stats.FamilyV4: addrKindIPV4,
+	stats.FamilyV6: addrKindIPV6,
+}
+
+var (
+	prefixesAdvertisedDesc = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "bgp_prefixes_advertised",
+		Help:   "is the number of prefixes in the gobgp global rib",
+		Labels: []string{"lb", "family"},
+	}).Desc()
+	prefixesConfiguredDesc = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "bgp_prefixes_configured",
+		Help:   "is the number of VIPs in the cluster config, each of which should be advertised",
+		Labels: []string{"lb", "family"},
+	}).Desc()
+	peerReceivedDesc = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "bgp_peer_prefixes_received",
+		Help:   "is the number of prefixes received from a bgp peer",
+		Labels: []string{"lb", "peer"},
+	}).Desc()
+	peerAcceptedDesc = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "bgp_peer_prefixes_accepted",
+		Help:   "is the number of prefixes received from a bgp peer and accepted by import policy",
+		Labels: []string{"lb", "peer"},
+	}).Desc()
+	peerAdvertisedDesc = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "bgp_peer_prefixes_advertised",
+		Help:   "is the number of prefixes advertised to an established bgp peer",
+		Labels: []string{"lb", "peer", "family"},
+	}).Desc()
+	prefixAdvertisedDesc = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "bgp_prefix_advertised",
+		Help:   "is 1 while a prefix is advertised, and 0 once its announcement failed or it went missing from the gobgp rib",
+		Labels: []string{"lb", "family", "prefix"},
+	}).Desc()
+)
+
+// RIBReader reads the routes and peers of a bgp daemon.
+type RIBReader interface {
+	RIB(ctx context.Context, family string) ([]string, error)
+	Peers(ctx context.Context) ([]Peer, error)
+	AdjOut(ctx context.Context, peer, family string) (int, error)
+}
+
+// PrefixTracker is an audit sink that keeps the outcome of the last
+// announcement of each prefix.
+type PrefixTracker struct {
+	sync.Mutex
+	announced map[string]bool
+}
+
+// NewPrefixTracker returns an empty PrefixTracker. Add it to the audit trail
+// before the worker starts announcing.
+func NewPrefixTracker() *PrefixTracker {
+	return &PrefixTracker{announced: map[string]bool{}}
+}
+
+// Write implements audit.Sink.
+func (p *PrefixTracker) Write(e audit.Event) error {
+	if e.Subsystem != audit.SubsystemBGP || e.Observed {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+	switch e.Action {
+	case "announce":
+		p.announced[normalizePrefix(e.Target)] = e.Error == ""
+	case "withdraw":
+		if e.Error == "" {
+			p.announced[normalizePrefix(e.Target)] = false
+		}
+	}
+	return nil
+}
+
+// seen tracks prefixes found in the RIB that were never announced by this
+// process.
+func (p *PrefixTracker) seen(prefixes map[string]bool) {
+	p.Lock()
+	defer p.Unlock()
+	for prefix := range prefixes {
+		if _, ok := p.announced[prefix]; !ok {
+			p.announced[prefix] = true
+		}
+	}
+}
+
+func (p *PrefixTracker) prefixes() map[string]bool {
+	p.Lock()
+	defer p.Unlock()
+	out := make(map[string]bool, len(p.announced))
+	for prefix, ok := range p.announced {
+		out[prefix] = ok
+	}
+	return out
+}
+
+// RIBCollector exports the bgp RIB and peers.
+type RIBCollector struct {
+	kind     string
+	rib      RIBReader
+	config   func() *types.ClusterConfig
+	prefixes *PrefixTracker
+	logger   logging.Logger
+}
+
+// NewRIBCollector returns a RIBCollector reading from rib, with the VIPs of
+// the config returned by config and the announcements seen by prefixes.
+func NewRIBCollector(kind stats.LBKind, rib RIBReader, config func() *types.ClusterConfig, prefixes *PrefixTracker, logger logging.Logger) *RIBCollector {
+	return &RIBCollector{
+		kind:     string(kind),
+		rib:      rib,
+		config:   config,
+		prefixes: prefixes,
+		logger:   logger.WithFields(logging.Fields{"module": "bgp-rib"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *RIBCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{prefixesAdvertisedDesc, prefixesConfiguredDesc, peerReceivedDesc, peerAcceptedDesc, peerAdvertisedDesc, prefixAdvertisedDesc} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector. Anything gobgp fails to list is
+// left out, rather than reported as empty.
+func (c *RIBCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+	gauge := func(desc *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, append([]string{c.kind}, labels...)...)
+	}
+
+	rib := map[string]bool{}
+	read := map[string]bool{}
+	for family, gobgpFamily := range ribFamilies {
+		prefixes, err := c.rib.RIB(ctx, gobgpFamily)
+		if err != nil {
+			c.logger.Debugf("unable to read the rib. %v", err)
+			continue
+		}
+		gauge(prefixesAdvertisedDesc, float64(len(prefixes)), family)
+		for _, prefix := range prefixes {
+			rib[normalizePrefix(prefix)] = true
+		}
+		read[family] = true
+	}
+
+	if config := c.config(); config != nil {
+		gauge(prefixesConfiguredDesc, float64(len(config.Config)), stats.FamilyV4)
+		gauge(prefixesConfiguredDesc, float64(len(config.Config6)), stats.FamilyV6)
+	}
+
+	peers, err := c.rib.Peers(ctx)
+	if err != nil {
+		c.logger.Debugf("unable to read the bgp peers. %v", err)
+	}
+	for _, p := range peers {
+		gauge(peerReceivedDesc, float64(p.Received), p.Address)
+		gauge(peerAcceptedDesc, float64(p.Accepted), p.Address)
+		if p.State != "Establ" {
+			continue
+		}
+		for family, gobgpFamily := range ribFamilies {
+			n, err := c.rib.AdjOut(ctx, p.Address, gobgpFamily)
+			if err != nil {
+				c.logger.Debugf("unable to read the routes advertised to %s. %v", p.Address, err)
+				continue
+			}
+			gauge(peerAdvertisedDesc, float64(n), p.Address, family)
+		}
+	}
+
+	c.prefixes.seen(rib)
+	for prefix, announced := range c.prefixes.prefixes() {
+		family := prefixFamily(prefix)
+		if !read[family] {
+			continue
+		}
+		v := 0.0
+		if announced && rib[prefix] {
+			v = 1
+		}
+		gauge(prefixAdvertisedDesc, v, family, prefix)
+	}
+}
+
+// normalizePrefix formats a prefix the same way whether it came from the
+// config, through the audit trail, or from gobgp.
+func normalizePrefix(prefix string) string {
+	ip, network, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return prefix
+	}
+	ones, _ := network.Mask.Size()
+	return ip.String() + "/" + strconv.Itoa(ones)
+}
+
+func prefixFamily(prefix string) string {
+	ip, _, err := net.ParseCIDR(prefix)
+	if err == nil && ip.To4() == nil {
+		return stats.FamilyV6
+	}
+	return stats.FamilyV4
+}
@@ -8,12 +8,17 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/health"
+	log "github.com/Comcast/Ravel/pkg/logging"
 	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/supervisor"
 	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/tracing"
 	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watchdog"
 	"github.com/Comcast/Ravel/pkg/watcher"
-	"github.com/sirupsen/logrus"
-	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -22,17 +27,36 @@ const (
 	addrKindIPV6 = "ipv6"
 )
 
-func init() {
-	// Uncomment to enable debugging statically
-	log.SetLevel(log.DebugLevel)
-}
-
 // BGPWorker describes a BGP worker that can advertise BGP routes and communities
 type BGPWorker interface {
 	Start() error
-	Stop() error
+	// Shutdown stops the worker as the process exits, within the deadline
+	// of ctx, and withdraws and tears down per on-exit
+	Shutdown(ctx context.Context) error
+	Health(context.Context) health.Status
+	// Maintenance withdraws the routes while active, and announces them
+	// again once it is cleared
+	Maintenance(active bool)
+	// Shard has the worker announce only the VIPs that shard picks, and
+	// withdraw the others. It is called before Start.
+	Shard(shard ShardFunc)
+	// Pause stops the worker applying configs on its own while paused.
+	// Maintenance still applies.
+	Pause(paused bool)
+	// Reconfigure applies the current config now, paused or not
+	Reconfigure()
+	// SetCommunities announces the routes with communities from the next
+	// reconfigure on, which announces those already up again to carry them
+	SetCommunities(communities []string)
+	// Override has the worker hold the VIPs of overrides announced or
+	// withdrawn over the config. It is called before Start.
+	Override(overrides *Overrides)
 }
 
+// ShardFunc returns those of vips of family, v4 or v6, that this director
+// announces, given the directors that shards assigns VIPs to.
+type ShardFunc func(vips []string, shards map[types.ServiceIP][]string, family string) []string
+
 type bgpserver struct {
 	sync.Mutex
 
@@ -49,6 +73,7 @@ type bgpserver struct {
 
 	lastInboundUpdate time.Time
 	lastReconfigure   time.Time
+	reconcile         health.Reconcile
 
 	lastAppliedConfig *types.ClusterConfig
 	newConfig         bool
@@ -56,14 +81,36 @@ type bgpserver struct {
 	cxlWatch          context.CancelFunc
 
 	ctx     context.Context
-	logger  logrus.FieldLogger
+	logger  log.Logger
 	metrics *stats.WorkerStateMetrics
 
+	// communities are guarded by the mutex, and reannounce has the next
+	// reconfigure announce every v4 route again once they change
 	communities []string
+	reannounce  bool
+	// configCommunities are those of the defaults of the config, which
+	// replace communities while it has any
+	configCommunities []string
+	// what Shutdown leaves on the node, one of the types.OnExit policies
+	onExit string
+	// maintenance keeps the routes withdrawn, and maintenanceChan wakes
+	// periodic when it changes
+	maintenance     bool
+	maintenanceChan chan struct{}
+	// paused skips the periodic reconfigures, and reconfigureChan asks
+	// periodic for one
+	paused          bool
+	reconfigureChan chan struct{}
+	// shard picks the VIPs to announce, when the directors shard them, and
+	// sharded6 holds the v6 VIPs it picked last, which the RIB isn't read for
+	shard    ShardFunc
+	sharded6 map[string]bool
+	// overrides are the VIPs announced or withdrawn by hand
+	overrides *Overrides
 }
 
 // NewBGPWorker creates a new BGPWorker, which configures BGP for all VIPs
-func NewBGPWorker(ctx context.Context, configKey string, watcher *watcher.Watcher, ipDevices *system.IP, ipPrimary *system.IP, ipvs *system.IPVS, bgpController Controller, communities []string, logger logrus.FieldLogger) (BGPWorker, error) {
+func NewBGPWorker(ctx context.Context, configKey string, watcher *watcher.Watcher, ipDevices *system.IP, ipPrimary *system.IP, ipvs *system.IPVS, bgpController Controller, communities []string, onExit string, logger log.Logger) (BGPWorker, error) {
 
 	log.Debugln("bgp: Creating new BGP worker")
 
@@ -77,46 +124,71 @@ func NewBGPWorker(ctx context.Context, configKey string, watcher *watcher.Watche
 
 		services: map[string]string{},
 
-		doneChan: make(chan struct{}),
+		doneChan:        make(chan struct{}),
+		maintenanceChan: make(chan struct{}, 1),
+		reconfigureChan: make(chan struct{}, 1),
 
 		ctx:     ctx,
 		logger:  logger,
 		metrics: stats.NewWorkerStateMetrics(stats.KindBGPDirector, configKey),
 
 		communities: communities,
+		onExit:      onExit,
+		overrides:   newOverrides(""),
 	}
 
 	return r, nil
 }
 
-func (b *bgpserver) Stop() error {
+func (b *bgpserver) Shutdown(ctx context.Context) error {
 	log.Debugln("bgp: Stopping BGPServer")
+	// no new config is applied from here on
 	b.cxlWatch()
 
 	log.Infoln("bgp: blocking until periodic tasks complete")
+	draining, cxlDraining := types.Draining(ctx)
 	select {
 	case <-b.doneChan:
-	case <-time.After(5000 * time.Millisecond):
+	case <-draining.Done():
+		b.logger.Warn("bgp: periodic tasks still running at the end of the grace period. tearing down anyway")
 	}
+	cxlDraining()
 
-	ctxDestroy, cxl := context.WithTimeout(context.Background(), 5000*time.Millisecond)
+	ctxDestroy, cxl := context.WithTimeout(ctx, types.TeardownTimeout)
 	defer cxl()
 
+	if b.onExit != types.OnExitWithdraw && b.onExit != types.OnExitFullTeardown {
+		b.logger.Info("bgp: leaving the routes, VIPs and ipvs rules in place on exit")
+		return nil
+	}
 	log.Infoln("bgp: starting cleanup")
-	err := b.cleanup(ctxDestroy)
+	err := b.cleanup(ctxDestroy, b.onExit == types.OnExitFullTeardown)
 	log.Infoln("bgp: cleanup completed")
 	b.logger.Infof("cleanup complete. error=%v", err)
 	return err
 }
 
-func (b *bgpserver) cleanup(ctx context.Context) error {
+// cleanup withdraws the routes before it removes the VIPs from loopback, so
+// that no traffic arrives for addresses that are gone, and flushes the ipvs
+// rules as well with full.
+func (b *bgpserver) cleanup(ctx context.Context, full bool) error {
 	errs := []string{}
 
+	if err := b.bgp.Teardown(ctx); err != nil {
+		errs = append(errs, fmt.Sprintf("cleanup - failed to withdraw routes - %v", err))
+	}
+
 	// delete all k2i addresses from loopback
-	if err := b.ipDevices.Teardown(ctx, b.watcher.ClusterConfig.Config, b.watcher.ClusterConfig.Config6); err != nil {
+	if err := b.ipDevices.Release(ctx); err != nil {
 		errs = append(errs, fmt.Sprintf("cleanup - failed to remove ip addresses - %v", err))
 	}
 
+	if full {
+		if err := b.ipvs.Teardown(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("cleanup - failed to remove existing ipvs config - %v", err))
+		}
+	}
+
 	if len(errs) == 0 {
 		return nil
 	}
@@ -145,8 +217,8 @@ func (b *bgpserver) Start() error {
 	}
 
 	log.Debugln("bgp: starting watches and periodic checks")
-	go b.watches()
-	go b.periodic()
+	supervisor.Go(b.ctxWatch, stats.KindBGPDirector, "bgp.watches", b.logger, b.watches)
+	supervisor.Go(b.ctxWatch, stats.KindBGPDirector, "bgp.periodic", b.logger, b.periodic)
 	return nil
 }
 
@@ -193,25 +265,32 @@ func (b *bgpserver) getClusterAddr(identity string) (string, error) {
 	return ip, nil
 }
 
-func (b *bgpserver) configure() error {
+func (b *bgpserver) configure(ctx context.Context) (err error) {
 	// log.Debugln("bgp: configuring BGPServer")
 	startTime := time.Now()
 	defer func() {
 		log.Debugln("bgp: configuring BGPServer took", time.Since(startTime))
 	}()
-	// logger := b.logger.WithFields(logrus.Fields{"protocol": "ipv4"})
+	// logger := b.logger.WithFields(log.Fields{"protocol": "ipv4"})
 	// log.Debugln("bgp: Enter func (b *bgpserver) configure()")
 	// defer log.Debugln("bgp: Exit func (b *bgpserver) configure()")
 
+	ctx, span := tracing.Start(ctx, "bgp.configure", attribute.String("protocol", addrKindIPV4))
+	defer func() { tracing.End(span, err) }()
+
 	// add/remove vip addresses on the interface specified for this vip
 	// log.Debugln("bgp: Setting addresses")
-	err := b.setAddresses()
+	_, phase := tracing.Start(ctx, "bgp.setAddresses")
+	phaseStart := time.Now()
+	err = b.setAddresses()
+	b.metrics.ReconfigurePhase(ctx, stats.PhaseAddresses, stats.FamilyV4, err, time.Since(phaseStart))
+	tracing.End(phase, err)
 	if err != nil {
 		return err
 	}
 	// log.Debugln("bgp: Setting addresses complete")
 
-	configuredAddrs, err := b.bgp.Get(b.ctx)
+	configuredAddrs, err := b.bgp.Get(ctx)
 	if err != nil {
 		// we do not error the function out here because we want gobgpd to be off
 		// while ravel-director is on and creating rules.
@@ -230,17 +309,53 @@ func (b *bgpserver) configure() error {
 	// Set IPVS rules based on VIPs, pods associated with each VIP
 	// and some other settings bgpserver receives from RDEI.
 	// log.Debugln("bgp: Setting IPVS settings")
+	_, phase = tracing.Start(ctx, "bgp.setIPVS")
+	phaseStart = time.Now()
 	err = b.ipvs.SetIPVS(b.watcher, b.watcher.ClusterConfig, b.logger, addrKindIPV4)
+	b.metrics.ReconfigurePhase(ctx, stats.PhaseIPVS, stats.FamilyV4, err, time.Since(phaseStart))
+	tracing.End(phase, err)
 	if err != nil {
 		log.Errorf("bgp: unable to configure ipvs with error %v", err)
 		// return fmt.Errorf("bgp: unable to configure ipvs with error %v", err)
 	}
 
-	err = b.bgp.Set(b.ctx, addrs, configuredAddrs, b.communities)
+	if b.inMaintenance() {
+		b.lastReconfigure = time.Now()
+		return nil
+	}
+	if !b.reconcile.Warm() {
+		// routers mustn't send traffic here before ipvs is programmed
+		log.Debugln("bgp: holding the ipv4 announcements until a parity check confirms the first reconfigure")
+		b.lastReconfigure = time.Now()
+		return nil
+	}
+
+	changed := b.overrides.take(addrs)
+	addrs, overridden := b.overrides.split(addrs)
+	addrs = b.shard4(ctx, addrs, configuredAddrs)
+	again := b.applyOverrides(ctx, addrKindIPV4, overridden, addrs, configuredAddrs, changed)
+
+	_, phase = tracing.Start(ctx, "bgp.set", attribute.Int("addresses", len(addrs)))
+	phaseStart = time.Now()
+	communities, reannounce := b.announceWith()
+	announced := configuredAddrs
+	if reannounce {
+		announced = nil
+	} else if len(again) > 0 {
+		announced = without(configuredAddrs, again)
+	}
+	err = b.bgp.Set(ctx, addrs, announced, communities)
+	b.metrics.ReconfigurePhase(ctx, stats.PhaseBGP, stats.FamilyV4, err, time.Since(phaseStart))
+	tracing.End(phase, err)
 	if err != nil {
 		log.Errorf("bgp: b.bgp.Set failed - %v", err)
 		return err
 	}
+	if reannounce {
+		b.Lock()
+		b.reannounce = false
+		b.Unlock()
+	}
 
 	// log.Debugln("bgp: IPVS configured")
 	b.lastReconfigure = time.Now()
@@ -248,12 +363,18 @@ func (b *bgpserver) configure() error {
 	return nil
 }
 
-func (b *bgpserver) configure6() error {
-	// logger := b.logger.WithFields(logrus.Fields{"protocol": "ipv6"})
+func (b *bgpserver) configure6(ctx context.Context) (err error) {
+	// logger := b.logger.WithFields(log.Fields{"protocol": "ipv6"})
+	ctx, span := tracing.Start(ctx, "bgp.configure", attribute.String("protocol", addrKindIPV6))
+	defer func() { tracing.End(span, err) }()
 
 	log.Debugln("bgp: starting ipv6 configuration")
 	// add vip addresses to loopback
-	err := b.setAddresses6()
+	_, phase := tracing.Start(ctx, "bgp.setAddresses")
+	phaseStart := time.Now()
+	err = b.setAddresses6()
+	b.metrics.ReconfigurePhase(ctx, stats.PhaseAddresses, stats.FamilyV6, err, time.Since(phaseStart))
+	tracing.End(phase, err)
 	if err != nil {
 		return err
 	}
@@ -263,15 +384,32 @@ func (b *bgpserver) configure6() error {
 		addrs = append(addrs, string(ip))
 	}
 
-	// set BGP announcements
-	err = b.bgp.SetV6(b.ctx, addrs, b.communities)
-	if err != nil {
-		return err
+	// set BGP announcements, unless the node is in maintenance or hasn't
+	// confirmed its first reconfigure
+	if !b.inMaintenance() && b.reconcile.Warm() {
+		changed := b.overrides.take(addrs)
+		var overridden []Override
+		addrs, overridden = b.overrides.split(addrs)
+		addrs = b.shard6(ctx, addrs, overridden)
+		b.applyOverrides(ctx, addrKindIPV6, overridden, addrs, b.rib6(ctx, overridden), changed)
+		_, phase = tracing.Start(ctx, "bgp.set", attribute.Int("addresses", len(addrs)))
+		phaseStart = time.Now()
+		communities, _ := b.announceWith()
+		err = b.bgp.SetV6(ctx, addrs, communities)
+		b.metrics.ReconfigurePhase(ctx, stats.PhaseBGP, stats.FamilyV6, err, time.Since(phaseStart))
+		tracing.End(phase, err)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Set IPVS rules based on VIPs, pods associated with each VIP
 	// and some other settings bgpserver receives from RDEI.
+	_, phase = tracing.Start(ctx, "bgp.setIPVS")
+	phaseStart = time.Now()
 	err = b.ipvs.SetIPVS(b.watcher, b.watcher.ClusterConfig, b.logger, addrKindIPV6)
+	b.metrics.ReconfigurePhase(ctx, stats.PhaseIPVS, stats.FamilyV6, err, time.Since(phaseStart))
+	tracing.End(phase, err)
 	if err != nil {
 		return fmt.Errorf("bgp: unable to configure ipvs with error %v", err)
 	}
@@ -284,6 +422,9 @@ func (b *bgpserver) periodic() {
 	log.Debugln("bgp: Enter func (b *bgpserver) periodic()")
 	defer log.Debugln("bgp: Exit func (b *bgpserver) periodic()")
 
+	beat := watchdog.Register("bgp.periodic")
+	defer beat.Done()
+
 	// Queue Depth metric ticker
 	queueDepthTicker := time.NewTicker(60 * time.Second)
 	defer queueDepthTicker.Stop()
@@ -304,26 +445,38 @@ func (b *bgpserver) periodic() {
 	for {
 		log.Debugln("bgp: loop run duration:", time.Since(runStartTime))
 		runStartTime = time.Now() // reset the run start time
+		beat.Beat()
 
 		select {
+		case <-b.reconfigureChan:
+			b.logger.Info("bgp: reconfigure requested")
+			b.forceReconfigure()
+
 		case <-reconfigureTicker.C:
-			log.Debugf("bgp: mandatory periodic reconfigure executing after %v", reconfigureDuration)
-			start := time.Now()
-			if err := b.configure(); err != nil {
-				b.metrics.Reconfigure("critical", time.Since(start))
-				log.Errorf("bgp: unable to apply mandatory ipv4 reconfiguration. %v", err)
+			if b.isPaused() {
+				continue
 			}
+			b.logger.Debugf("bgp: mandatory periodic reconfigure executing after %v", reconfigureDuration)
+			b.forceReconfigure()
 
-			log.Debugln("bgp: time to run v4 configure:", time.Since(start))
-
-			if err := b.configure6(); err != nil {
-				b.metrics.Reconfigure("critical", time.Since(start))
-				log.Errorf("bgp: unable to apply mandatory ipv6 reconfiguration. %v", err)
+		case <-b.maintenanceChan:
+			if !b.inMaintenance() {
+				b.logger.Info("bgp: out of maintenance. announcing the routes")
+				b.forceReconfigure()
+				continue
+			}
+			b.logger.Info("bgp: in maintenance. withdrawing the routes")
+			ctx, cxl := context.WithTimeout(b.ctx, 5000*time.Millisecond)
+			audit.SetCause("bgp maintenance", b.watcher.ConfigHash(), b.watcher.CorrelationID())
+			if err := b.bgp.Teardown(ctx); err != nil {
+				b.logger.Errorf("bgp: unable to withdraw the routes for maintenance. %v", err)
 			}
-			log.Debugln("bgp: time to run v4 and v6 configure:", time.Since(start))
+			cxl()
 
-			b.metrics.Reconfigure("complete", time.Since(start))
 		case <-bgpTicker.C:
+			if b.isPaused() {
+				continue
+			}
 			// log.Debugln("bgp: BGP ticker checking parity...")
 			b.performReconfigure()
 			// log.Debugln("bgp: time to run bgp ticker reconfigure:", time.Since(start))
@@ -339,6 +492,257 @@ func (b *bgpserver) periodic() {
 	}
 }
 
+// forceReconfigure reapplies the configuration without checking parity.
+func (b *bgpserver) forceReconfigure() {
+	id := b.watcher.CorrelationID()
+	start := time.Now()
+	ctx, span := tracing.StartLinked(b.ctx, "bgp.reconfigure", b.watcher.PublishSpanContext(), attribute.Bool("force", true), attribute.String("ravel.correlation_id", id))
+	var reason string
+	reason, b.lastAppliedConfig = b.watcher.Reason("bgp reconfigure: forced", b.lastAppliedConfig)
+	audit.SetCause(reason, b.watcher.ConfigHash(), id)
+	b.metrics.ConfigSeen(b.watcher.Published())
+	err := b.configure(ctx)
+	if err != nil {
+		b.metrics.Reconfigure(ctx, "critical", time.Since(start))
+		log.Errorf("bgp: unable to apply mandatory ipv4 reconfiguration. %v", err)
+	}
+
+	log.Debugln("bgp: time to run v4 configure:", time.Since(start))
+
+	if err6 := b.configure6(ctx); err6 != nil {
+		b.metrics.Reconfigure(ctx, "critical", time.Since(start))
+		log.Errorf("bgp: unable to apply mandatory ipv6 reconfiguration. %v", err6)
+		err = err6
+	}
+	b.reconcile.Record(err)
+	span.End()
+	log.Debugln("bgp: time to run v4 and v6 configure:", time.Since(start))
+
+	b.metrics.Reconfigure(ctx, "complete", time.Since(start))
+}
+
+// Maintenance withdraws the routes while active, and announces them again
+// once it is cleared. The VIPs and ipvs rules stay, so that connections
+// already routed to the director finish.
+func (b *bgpserver) Maintenance(active bool) {
+	b.Lock()
+	b.maintenance = active
+	b.Unlock()
+	select {
+	case b.maintenanceChan <- struct{}{}:
+	default:
+	}
+}
+
+func (b *bgpserver) Pause(paused bool) {
+	b.Lock()
+	b.paused = paused
+	b.Unlock()
+}
+
+func (b *bgpserver) isPaused() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.paused
+}
+
+func (b *bgpserver) SetCommunities(communities []string) {
+	b.Lock()
+	b.communities = communities
+	b.reannounce = true
+	b.Unlock()
+	b.Reconfigure()
+}
+
+// announceWith returns the communities to announce with, and whether the
+// routes already up must be announced again to carry them.
+func (b *bgpserver) announceWith() ([]string, bool) {
+	var fromConfig []string
+	if cc := b.watcher.ClusterConfig; cc != nil && cc.Defaults != nil {
+		fromConfig = cc.Defaults.Communities
+	}
+	b.Lock()
+	defer b.Unlock()
+	// communities hold no commas
+	if strings.Join(fromConfig, ",") != strings.Join(b.configCommunities, ",") {
+		b.configCommunities = fromConfig
+		b.reannounce = true
+	}
+	if len(fromConfig) > 0 {
+		return fromConfig, b.reannounce
+	}
+	return b.communities, b.reannounce
+}
+
+func (b *bgpserver) Reconfigure() {
+	select {
+	case b.reconfigureChan <- struct{}{}:
+	default:
+	}
+}
+
+// Shard has the worker announce only the VIPs that shard picks. The VIPs it
+// doesn't pick stay on loopback and in ipvs, so that the director still
+// serves connections routed to it while the upstream routers move them.
+func (b *bgpserver) Shard(shard ShardFunc) {
+	b.shard = shard
+	b.sharded6 = map[string]bool{}
+}
+
+// shard4 returns the v4 addrs this director announces, and withdraws those of
+// addrs in configured, the RIB, that it no longer does.
+func (b *bgpserver) shard4(ctx context.Context, addrs, configured []string) []string {
+	if b.shard == nil {
+		return addrs
+	}
+	owned := b.shard(addrs, b.watcher.ClusterConfig.Shards, stats.FamilyV4)
+	announce := map[string]bool{}
+	for _, addr := range owned {
+		announce[addr] = true
+	}
+	candidates := map[string]bool{}
+	for _, addr := range addrs {
+		candidates[addr] = true
+	}
+	withdraw := []string{}
+	for _, addr := range configured {
+		if candidates[addr] && !announce[addr] {
+			withdraw = append(withdraw, addr)
+		}
+	}
+	b.withdrawShard(ctx, addrKindIPV4, withdraw)
+	return owned
+}
+
+// shard6 returns the v6 addrs this director announces, and withdraws those it
+// announced before and no longer does. The VIPs overridden are left as their
+// overrides hold them, and those announced count as announced here.
+func (b *bgpserver) shard6(ctx context.Context, addrs []string, overridden []Override) []string {
+	if b.shard == nil {
+		return addrs
+	}
+	owned := b.shard(addrs, b.watcher.ClusterConfig.Shards, stats.FamilyV6)
+	announce := map[string]bool{}
+	for _, addr := range owned {
+		announce[addr] = true
+	}
+	held := map[string]bool{}
+	for _, ov := range overridden {
+		held[ov.VIP] = true
+		if ov.Action == OverrideAnnounce {
+			announce[ov.VIP] = true
+		}
+	}
+	withdraw := []string{}
+	for addr := range b.sharded6 {
+		if !announce[addr] && !held[addr] {
+			withdraw = append(withdraw, addr)
+		}
+	}
+	b.withdrawShard(ctx, addrKindIPV6, withdraw)
+	b.sharded6 = announce
+	return owned
+}
+
+func (b *bgpserver) Override(overrides *Overrides) {
+	b.overrides = overrides
+}
+
+// applyOverrides announces and withdraws the VIPs of family overridden, given
+// rib, the addresses in the RIB, and changed, the VIPs whose override changed.
+// A VIP announced by hand is announced again when its override changes, to
+// carry the communities of the override. It returns those of addrs, the VIPs
+// the director announces itself, whose override was cleared, which must be
+// announced again to carry the director's communities.
+func (b *bgpserver) applyOverrides(ctx context.Context, family string, overridden []Override, addrs, rib []string, changed map[string]bool) []string {
+	inRIB := map[string]bool{}
+	for _, addr := range rib {
+		inRIB[canonicalVIP(addr)] = true
+	}
+	failed := []string{}
+	for _, ov := range overridden {
+		up := inRIB[canonicalVIP(ov.VIP)]
+		var err error
+		switch {
+		case ov.Action == OverrideWithdraw && up:
+			b.logger.Infof("bgp: withdrawing %s, as overridden", ov.VIP)
+			err = b.bgp.Withdraw(ctx, family, []string{ov.VIP})
+		case ov.Action == OverrideAnnounce && (!up || changed[ov.VIP]):
+			b.logger.Infof("bgp: announcing %s with communities %v, as overridden", ov.VIP, ov.Communities)
+			if family == addrKindIPV6 {
+				err = b.bgp.SetV6(ctx, []string{ov.VIP}, ov.Communities)
+			} else {
+				err = b.bgp.Set(ctx, []string{ov.VIP}, nil, ov.Communities)
+			}
+		}
+		if err != nil {
+			b.logger.Errorf("bgp: unable to %s %s as overridden. %v", ov.Action, ov.VIP, err)
+			failed = append(failed, ov.VIP)
+		}
+	}
+	b.overrides.retry(failed)
+
+	again := []string{}
+	for _, addr := range addrs {
+		if changed[addr] {
+			again = append(again, addr)
+		}
+	}
+	return again
+}
+
+// rib6 returns the v6 addresses in the RIB, which are only read when there
+// are overrides to apply.
+func (b *bgpserver) rib6(ctx context.Context, overridden []Override) []string {
+	if len(overridden) == 0 {
+		return nil
+	}
+	prefixes, err := b.bgp.RIB(ctx, addrKindIPV6)
+	if err != nil {
+		b.logger.Warnf("bgp: unable to read the v6 rib for the overrides. %v", err)
+		return nil
+	}
+	addrs := []string{}
+	for _, prefix := range prefixes {
+		addrs = append(addrs, strings.SplitN(prefix, "/", 2)[0])
+	}
+	return addrs
+}
+
+// without returns addrs without those in drop.
+func without(addrs, drop []string) []string {
+	dropped := map[string]bool{}
+	for _, addr := range drop {
+		dropped[addr] = true
+	}
+	out := []string{}
+	for _, addr := range addrs {
+		if !dropped[addr] {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// withdrawShard withdraws the routes to addrs of family that moved to other
+// directors.
+func (b *bgpserver) withdrawShard(ctx context.Context, family string, addrs []string) {
+	if len(addrs) == 0 {
+		return
+	}
+	b.logger.Infof("bgp: withdrawing %v, now announced by other directors", addrs)
+	if err := b.bgp.Withdraw(ctx, family, addrs); err != nil {
+		b.logger.Errorf("bgp: unable to withdraw the routes of other directors. %v", err)
+	}
+}
+
+// inMaintenance reports whether the routes are kept withdrawn.
+func (b *bgpserver) inMaintenance() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.maintenance
+}
+
 func (b *bgpserver) noUpdatesReady() bool {
 	return b.lastReconfigure.Sub(b.lastInboundUpdate) > 0
 }
@@ -377,16 +781,16 @@ func (b *bgpserver) setAddresses6() error {
 	removals, additions := b.ipDevices.Compare6(configuredV6, desired)
 
 	b.logger.Debugf("additions=%v removals=%v", additions, removals)
-	b.metrics.LoopbackAdditions(len(additions), addrKindIPV6)
-	b.metrics.LoopbackRemovals(len(removals), addrKindIPV6)
-	b.metrics.LoopbackTotalDesired(len(desired), addrKindIPV6)
-	b.metrics.LoopbackConfigHealthy(1, addrKindIPV6)
+	b.metrics.LoopbackAdditions(len(additions), stats.FamilyV6)
+	b.metrics.LoopbackRemovals(len(removals), stats.FamilyV6)
+	b.metrics.LoopbackTotalDesired(len(desired), stats.FamilyV6)
+	b.metrics.LoopbackConfigHealthy(1, stats.FamilyV6)
 
 	for _, device := range removals {
-		b.logger.WithFields(logrus.Fields{"device": device, "action": "deleting"}).Info()
+		b.logger.WithFields(log.Fields{"device": device, "action": "deleting"}).Info()
 		if err := b.ipDevices.Del(device); err != nil {
-			b.metrics.LoopbackRemovalErr(1, addrKindIPV6)
-			b.metrics.LoopbackConfigHealthy(0, addrKindIPV6)
+			b.metrics.LoopbackRemovalErr(1, stats.FamilyV6)
+			b.metrics.LoopbackConfigHealthy(0, stats.FamilyV6)
 			return err
 		}
 		log.Infoln("bgp: removed ipv6 adapter:", device)
@@ -395,10 +799,10 @@ func (b *bgpserver) setAddresses6() error {
 		// add the device and configure
 		addr := devToAddr[device]
 
-		b.logger.WithFields(logrus.Fields{"device": device, "addr": addr, "action": "adding"}).Info()
+		b.logger.WithFields(log.Fields{"device": device, "addr": addr, "action": "adding"}).Info()
 		if err := b.ipDevices.Add6(addr); err != nil {
-			b.metrics.LoopbackAdditionErr(1, addrKindIPV6)
-			b.metrics.LoopbackConfigHealthy(0, addrKindIPV6)
+			b.metrics.LoopbackAdditionErr(1, stats.FamilyV6)
+			b.metrics.LoopbackConfigHealthy(0, stats.FamilyV6)
 			return err
 		}
 		log.Infoln("bgp: added ipv6 adapter:", device)
@@ -451,17 +855,17 @@ func (b *bgpserver) setAddresses() error {
 	removals, additions := b.ipDevices.Compare4(configuredV4, desired)
 
 	b.logger.Debugf("bgp: ip additions_v4=%v ip removals_v4=%v", additions, removals)
-	b.metrics.LoopbackAdditions(len(additions), addrKindIPV4)
-	b.metrics.LoopbackRemovals(len(removals), addrKindIPV4)
-	b.metrics.LoopbackTotalDesired(len(desired), addrKindIPV4)
-	b.metrics.LoopbackConfigHealthy(1, addrKindIPV4)
+	b.metrics.LoopbackAdditions(len(additions), stats.FamilyV4)
+	b.metrics.LoopbackRemovals(len(removals), stats.FamilyV4)
+	b.metrics.LoopbackTotalDesired(len(desired), stats.FamilyV4)
+	b.metrics.LoopbackConfigHealthy(1, stats.FamilyV4)
 	// "removals" is in the form of a fully qualified
 	for _, device := range removals {
-		// b.logger.WithFields(logrus.Fields{"device": device, "action": "deleting"}).Info()
+		// b.logger.WithFields(log.Fields{"device": device, "action": "deleting"}).Info()
 		// remove the device
 		if err := b.ipDevices.Del(device); err != nil {
-			b.metrics.LoopbackRemovalErr(1, addrKindIPV4)
-			b.metrics.LoopbackConfigHealthy(0, addrKindIPV4)
+			b.metrics.LoopbackRemovalErr(1, stats.FamilyV4)
+			b.metrics.LoopbackConfigHealthy(0, stats.FamilyV4)
 			return err
 		}
 		log.Infoln("bgp: removed ipv4 adapter:", device)
@@ -470,10 +874,10 @@ func (b *bgpserver) setAddresses() error {
 	for _, device := range additions {
 		// add the device and configure
 		addr := devToAddr[device]
-		b.logger.WithFields(logrus.Fields{"device": device, "addr": addr, "action": "adding"}).Info()
+		b.logger.WithFields(log.Fields{"device": device, "addr": addr, "action": "adding"}).Info()
 		if err := b.ipDevices.Add(addr); err != nil {
-			b.metrics.LoopbackAdditionErr(1, addrKindIPV4)
-			b.metrics.LoopbackConfigHealthy(0, addrKindIPV4)
+			b.metrics.LoopbackAdditionErr(1, stats.FamilyV4)
+			b.metrics.LoopbackConfigHealthy(0, stats.FamilyV4)
 			return err
 		}
 		log.Infoln("bgp: added ipv4 adapter:", device)
@@ -501,7 +905,11 @@ func (b *bgpserver) watches() {
 
 	t := time.NewTicker(time.Second * 5)
 
+	beat := watchdog.Register("bgp.watches")
+	defer beat.Done()
+
 	for {
+		beat.Beat()
 		select {
 		case <-t.C:
 			if types.NodesEqual(b.watcher.Nodes, b.watcher.Nodes) {
@@ -540,18 +948,30 @@ func (b *bgpserver) performReconfigure() {
 	}()
 	// log.Debugln("bgp: running performReconfigure")
 
-	if b.noUpdatesReady() {
+	// until it is warm, parity is checked on every tick to confirm the
+	// first reconfigure
+	warm := b.reconcile.Warm()
+	if b.noUpdatesReady() && warm {
 		// log.Debugln("bgp: no updates ready")
 		// last update happened before the last reconfigure
 		return
 	}
 
+	id := b.watcher.CorrelationID()
+	ctx, span := tracing.StartLinked(b.ctx, "bgp.reconfigure", b.watcher.PublishSpanContext(), attribute.Bool("force", false), attribute.String("ravel.correlation_id", id))
+	defer span.End()
+	b.metrics.ConfigSeen(b.watcher.Published())
+	_, parity := tracing.Start(ctx, "bgp.checkConfigParity")
+	parityStart := time.Now()
+
 	// these are the VIP addresses
 	// get both the v4 and v6 to use in CheckConfigParity below
 	// log.Infoln("bgp: fetching dummy interfaces via performReconfigure")
 	addressesV4, addressesV6, err := b.ipDevices.Get()
 	if err != nil {
-		b.metrics.Reconfigure("error", time.Since(start))
+		b.metrics.ReconfigurePhase(ctx, stats.PhaseParity, stats.FamilyAll, err, time.Since(parityStart))
+		tracing.End(parity, err)
+		b.metrics.Reconfigure(ctx, "error", time.Since(start))
 		log.Errorf("bgp: unable to compare configurations with error %v\n", err)
 		return
 	}
@@ -563,28 +983,47 @@ func (b *bgpserver) performReconfigure() {
 	// log.Debugln("CheckConfigParity: bgpserver passing in these addresses:", addresses)
 	// compare configurations and apply new IPVS rules if they're different
 	same, err := b.ipvs.CheckConfigParity(b.watcher, b.watcher.ClusterConfig, addresses)
+	b.metrics.ReconfigurePhase(ctx, stats.PhaseParity, stats.FamilyAll, err, time.Since(parityStart))
+	parity.SetAttributes(attribute.Bool("parity", same))
+	tracing.End(parity, err)
 	if err != nil {
-		b.metrics.Reconfigure("error", time.Since(start))
-		log.Errorln("bgp: unable to compare configurations with error %v\n", err)
+		b.metrics.Reconfigure(ctx, "error", time.Since(start))
+		log.Errorf("bgp: unable to compare configurations with error %v", err)
 		return
 	}
+	b.reconcile.Parity(same)
 	if same {
 		b.logger.Debug("bgp: parity same")
-		b.metrics.Reconfigure("noop", time.Since(start))
+		b.metrics.Reconfigure(ctx, "noop", time.Since(start))
+		if !warm && b.reconcile.Warm() {
+			b.logger.Info("bgp: parity confirms the first reconfigure. announcing the routes")
+			b.forceReconfigure()
+		}
 		return
 	}
 
-	log.Debugln("bgp: parity different, reconfiguring")
-	if err := b.configure(); err != nil {
-		b.metrics.Reconfigure("critical", time.Since(start))
+	b.logger.WithField("correlation_id", id).Debug("bgp: parity different, reconfiguring")
+	var reason string
+	reason, b.lastAppliedConfig = b.watcher.Reason("bgp reconfigure: parity mismatch", b.lastAppliedConfig)
+	audit.SetCause(reason, b.watcher.ConfigHash(), id)
+	if err := b.configure(ctx); err != nil {
+		b.reconcile.Record(err)
+		b.metrics.Reconfigure(ctx, "critical", time.Since(start))
 		b.logger.Errorf("bgp: unable to apply ipv4 configuration. %v", err)
 		return
 	}
 
-	if err := b.configure6(); err != nil {
-		b.metrics.Reconfigure("critical", time.Since(start))
+	if err := b.configure6(ctx); err != nil {
+		b.reconcile.Record(err)
+		b.metrics.Reconfigure(ctx, "critical", time.Since(start))
 		b.logger.Errorf("bgp: unable to apply ipv6 configuration. %v", err)
 		return
 	}
-	b.metrics.Reconfigure("complete", time.Since(start))
+	b.reconcile.Record(nil)
+	b.metrics.Reconfigure(ctx, "complete", time.Since(start))
+}
+
+// Health reports the outcome of the most recent reconfigure.
+func (b *bgpserver) Health(ctx context.Context) health.Status {
+	return b.reconcile.Status(ctx)
 }
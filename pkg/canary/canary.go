@@ -0,0 +1,291 @@
+package canary
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/probe"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// A staged apply rolls a changed cluster config out to a few canary VIPs
+// before the rest. The director publishes a blend of the two: the canary VIPs
+// as the new config has them, and every other VIP, and the settings of the
+// whole config such as the VIP pool, as the stable config has them. The
+// synthetic probes of the canary VIPs must then pass for the soak time, and
+// the new config is promoted to every VIP. A failing probe rolls the canary
+// VIPs back to the stable config, which is held until the config changes
+// again.
+//
+// Probes only count once the director has had settle to apply the blend.
+
+// settle is how long the director takes to apply a config once it is
+// published, before the probes of it count.
+const settle = 5 * time.Second
+
+// Outcomes of a staged config.
+const (
+	OutcomePromoted   = "promoted"
+	OutcomeRolledBack = "rolled_back"
+)
+
+var (
+	stagedDef = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "config_canary",
+		Help:   "is 1 while a changed cluster config is applied to the canary VIPs only, and 0 otherwise",
+		Labels: []string{"lb"},
+	})
+	outcomeDef = stats.Define(stats.Definition{
+		Type:   stats.Counter,
+		Name:   "config_canary_total",
+		Help:   "is a count of the cluster configs staged on the canary VIPs, by outcome promoted|rolled_back",
+		Labels: []string{"lb", "outcome"},
+	})
+)
+
+// Config controls the staged apply.
+type Config struct {
+	// VIPs are the canary VIPs. A v4 VIP brings its v6 address with it.
+	VIPs []string
+	// Soak is how long the probes of the canary VIPs must pass.
+	Soak time.Duration
+}
+
+// prober is what the stager needs of the synthetic probes.
+type prober interface {
+	Results(vips map[string]bool, since time.Time) (passed, failed []probe.Target)
+}
+
+// Stager decides what of each cluster config built is published.
+type Stager struct {
+	vips   map[string]bool
+	soak   time.Duration
+	probes prober
+
+	sync.Mutex
+	stable     *types.ClusterConfig
+	stableHash string
+	candidate  *types.ClusterConfig
+	// candidateHash is the config on the canary VIPs since staged, and
+	// rejected the last one rolled back
+	candidateHash string
+	staged        time.Time
+	rejected      string
+	unprobed      bool
+
+	kind    string
+	gauge   prometheus.Gauge
+	outcome *prometheus.CounterVec
+	logger  logging.Logger
+}
+
+// New returns a stager of the configs that kind builds, judged by probes.
+func New(kind stats.LBKind, config Config, probes prober, logger logging.Logger) (*Stager, error) {
+	if len(config.VIPs) == 0 {
+		return nil, fmt.Errorf("there must be at least one canary VIP")
+	}
+	if config.Soak <= 0 {
+		return nil, fmt.Errorf("canary soak must be positive")
+	}
+	vips := map[string]bool{}
+	for _, vip := range config.VIPs {
+		if net.ParseIP(vip) == nil {
+			return nil, fmt.Errorf("canary VIP %q is not an ip address", vip)
+		}
+		vips[vip] = true
+	}
+	return &Stager{
+		vips:    vips,
+		soak:    config.Soak,
+		probes:  probes,
+		kind:    string(kind),
+		gauge:   stagedDef.GaugeVec().WithLabelValues(string(kind)),
+		outcome: outcomeDef.CounterVec(),
+		logger:  logger.WithFields(logging.Fields{"module": "canary"}),
+	}, nil
+}
+
+// Stage returns the config to publish for next: next itself when it is the
+// first or matches the stable config, the stable config when next was rolled
+// back, and otherwise the blend of next on the canary VIPs.
+func (s *Stager) Stage(next *types.ClusterConfig) *types.ClusterConfig {
+	hash := hashOf(next)
+	s.Lock()
+	defer s.Unlock()
+	switch {
+	case s.stable == nil || hash == s.stableHash:
+		s.stable, s.stableHash = next, hash
+		s.clear()
+		return next
+	case hash == s.rejected:
+		return s.stable
+	case hash != s.candidateHash:
+		s.candidate, s.candidateHash, s.staged, s.unprobed = next, hash, time.Now(), false
+		s.gauge.Set(1)
+		s.logger.Infof("canary: applying cluster config %s to canary VIPs %s for %v before the rest", hash, s.list(), s.soak)
+	}
+	return s.blend(next)
+}
+
+// Check promotes the staged config once its canary VIPs have passed their
+// probes for the soak time, and rolls it back as soon as one fails. It
+// reports whether the config to publish changed.
+func (s *Stager) Check(now time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.candidate == nil {
+		return false
+	}
+	passed, failed := s.probes.Results(s.vips, s.staged.Add(settle))
+	if len(failed) > 0 {
+		targets := []string{}
+		for _, t := range failed {
+			targets = append(targets, net.JoinHostPort(t.VIP, t.Port))
+		}
+		sort.Strings(targets)
+		s.logger.Errorf("canary: rolling back cluster config %s, as probes of %s failed", s.candidateHash, strings.Join(targets, ", "))
+		s.outcome.With(prometheus.Labels{"lb": s.kind, "outcome": OutcomeRolledBack}).Inc()
+		s.rejected = s.candidateHash
+		s.clear()
+		return true
+	}
+	if now.Sub(s.staged) < s.soak {
+		return false
+	}
+	if len(passed) == 0 {
+		if !s.unprobed {
+			s.logger.Warnf("canary: holding cluster config %s, as nothing on canary VIPs %s has been probed", s.candidateHash, s.list())
+			s.unprobed = true
+		}
+		return false
+	}
+	s.logger.Infof("canary: promoting cluster config %s to every VIP, as the canary VIPs passed their probes for %v", s.candidateHash, s.soak)
+	s.outcome.With(prometheus.Labels{"lb": s.kind, "outcome": OutcomePromoted}).Inc()
+	s.stable, s.stableHash = s.candidate, s.candidateHash
+	s.clear()
+	return true
+}
+
+// Run checks the staged config every interval until ctx is done, and calls
+// republish whenever the config to publish changed.
+func (s *Stager) Run(ctx context.Context, interval time.Duration, republish func()) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			if s.Check(now) {
+				republish()
+			}
+		}
+	}
+}
+
+// clear drops the staged config. It is called with the lock held.
+func (s *Stager) clear() {
+	s.candidate, s.candidateHash, s.staged = nil, "", time.Time{}
+	s.gauge.Set(0)
+}
+
+// canary reports whether vip, a key of the config, is a canary VIP, or the
+// v6 address of one.
+func (s *Stager) canary(vip types.ServiceIP, ipv6 map[types.ServiceIP]string) bool {
+	if s.vips[string(vip)] {
+		return true
+	}
+	for v4, v6 := range ipv6 {
+		if v6 == string(vip) && s.vips[string(v4)] {
+			return true
+		}
+	}
+	return false
+}
+
+// blend returns the stable config, with the canary VIPs as next has them.
+// What isn't keyed by a VIP, such as the defaults, is the stable config's
+// until next is promoted. It is called with the lock held.
+func (s *Stager) blend(next *types.ClusterConfig) *types.ClusterConfig {
+	stable := s.stable
+	out := &types.ClusterConfig{
+		VIPPool:    stable.VIPPool,
+		NodeLabels: stable.NodeLabels,
+		MTUConfig:  map[types.ServiceIP]string{},
+		MTUConfig6: map[types.ServiceIP]string{},
+		IPV6:       map[types.ServiceIP]string{},
+		Config:     map[types.ServiceIP]types.PortMap{},
+		Config6:    map[types.ServiceIP]types.PortMap{},
+		Base:       stable.Base,
+		Defaults:   stable.Defaults,
+	}
+	if stable.Shards != nil || next.Shards != nil {
+		out.Shards = map[types.ServiceIP][]string{}
+	}
+
+	// each VIP comes from one config or the other, with everything keyed by
+	// it
+	for _, from := range []*types.ClusterConfig{stable, next} {
+		canary := from == next
+		for vip, ports := range from.Config {
+			if s.canary(vip, nil) == canary {
+				out.Config[vip] = ports
+			}
+		}
+		for vip, v6 := range from.IPV6 {
+			if s.canary(vip, nil) == canary {
+				out.IPV6[vip] = v6
+			}
+		}
+		for vip, mtu := range from.MTUConfig {
+			if s.canary(vip, nil) == canary {
+				out.MTUConfig[vip] = mtu
+			}
+		}
+		for vip, nodes := range from.Shards {
+			if s.canary(vip, nil) == canary {
+				out.Shards[vip] = nodes
+			}
+		}
+		for vip, ports := range from.Config6 {
+			if s.canary(vip, from.IPV6) == canary {
+				out.Config6[vip] = ports
+			}
+		}
+		for vip, mtu := range from.MTUConfig6 {
+			if s.canary(vip, from.IPV6) == canary {
+				out.MTUConfig6[vip] = mtu
+			}
+		}
+	}
+	return out
+}
+
+func (s *Stager) list() string {
+	vips := []string{}
+	for vip := range s.vips {
+		vips = append(vips, vip)
+	}
+	sort.Strings(vips)
+	return strings.Join(vips, ", ")
+}
+
+// hashOf returns the hash of a config, as the watcher computes it.
+func hashOf(c *types.ClusterConfig) string {
+	b, _ := json.Marshal(c)
+	sha := sha1.Sum(b)
+	return base64.StdEncoding.EncodeToString(sha[:])
+}
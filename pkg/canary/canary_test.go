@@ -0,0 +1,146 @@
+package canary
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/Comcast/Ravel/pkg/liveconfig"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/probe"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+type fakeProber struct {
+	passed, failed []probe.Target
+}
+
+func (f *fakeProber) Results(vips map[string]bool, since time.Time) ([]probe.Target, []probe.Target) {
+	return f.passed, f.failed
+}
+
+func config(service string) *types.ClusterConfig {
+	def := func(s string) types.PortMap {
+		return types.PortMap{"80": &types.ServiceDef{Namespace: "default", Service: s, PortName: "http"}}
+	}
+	return &types.ClusterConfig{
+		VIPPool: []string{service},
+		IPV6:    map[types.ServiceIP]string{"10.0.0.1": "2001:db8::1"},
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.0.0.1": def(service),
+			"10.0.0.2": def(service),
+		},
+		Config6: map[types.ServiceIP]types.PortMap{
+			"2001:db8::1": def(service),
+		},
+	}
+}
+
+func TestStager(t *testing.T) {
+	probes := &fakeProber{}
+	s, err := New(stats.KindIpvsMaster, Config{VIPs: []string{"10.0.0.1"}, Soak: time.Minute}, probes, logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(stats.KindIpvsMaster, Config{VIPs: []string{"director"}, Soak: time.Minute}, probes, logging.New()); err == nil {
+		t.Fatal("expected a canary VIP that isn't an ip to be refused")
+	}
+
+	// the first config is applied everywhere
+	a := config("a")
+	if got := s.Stage(a); got != a {
+		t.Fatal("expected the first config published as it is")
+	}
+
+	// a change is applied to the canary VIP and its v6 address only
+	b := config("b")
+	got := s.Stage(b)
+	if got.Config["10.0.0.1"]["80"].Service != "b" || got.Config6["2001:db8::1"]["80"].Service != "b" {
+		t.Fatalf("expected the canary VIP to get the new config, got %+v", got.Config)
+	}
+	if got.Config["10.0.0.2"]["80"].Service != "a" || got.VIPPool[0] != "a" {
+		t.Fatalf("expected the rest to keep the stable config, got %+v", got)
+	}
+	staged := s.staged
+
+	// probes don't promote it before the soak, and nothing probed holds it
+	if s.Check(staged.Add(time.Second)) {
+		t.Fatal("expected no change before the soak")
+	}
+	if s.Check(staged.Add(2*time.Minute)) || s.candidate == nil {
+		t.Fatal("expected a config nothing probed to be held")
+	}
+
+	probes.passed = []probe.Target{{VIP: "10.0.0.1", Port: "80"}}
+	if !s.Check(staged.Add(2 * time.Minute)) {
+		t.Fatal("expected the config promoted after the soak")
+	}
+	if got := s.Stage(b); got != b {
+		t.Fatal("expected the promoted config published as it is")
+	}
+
+	// a failing probe rolls the canary VIP back, and holds it back
+	c := config("c")
+	s.Stage(c)
+	probes.failed = []probe.Target{{VIP: "10.0.0.1", Port: "80"}}
+	if !s.Check(time.Now()) {
+		t.Fatal("expected the config rolled back")
+	}
+	if got := s.Stage(c); got != b {
+		t.Fatal("expected the stable config published for a rolled back one")
+	}
+	if s.Check(time.Now()) {
+		t.Fatal("expected nothing staged after a roll back")
+	}
+}
+
+// TestStagesKeepDefaults runs a config with defaults and a base through the
+// canary and the runtime overrides, as the watcher stages it.
+func TestStagesKeepDefaults(t *testing.T) {
+	render := func(service string) *types.ClusterConfig {
+		cm := &v1.ConfigMap{Data: map[string]string{
+			"common": `{"defaults": {"communities": ["65000:100"]}, "config": {"10.0.0.2": {"80": {"namespace": "default", "service": "` + service + `", "portName": "http"}}}}`,
+			"prod":   `{"base": "common", "config": {"10.0.0.1": {"80": {"namespace": "default", "service": "` + service + `", "portName": "http"}}}}`,
+		}}
+		c, err := types.NewClusterConfig(cm, "prod")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	stager, err := New(stats.KindIpvsMaster, Config{VIPs: []string{"10.0.0.1"}, Soak: time.Minute}, &fakeProber{}, logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	levels, err := logging.ParseLevels("info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := liveconfig.New(stats.KindIpvsMaster, "test", liveconfig.Options{Services: true, Republish: func() {}, Levels: levels}, logging.Discard())
+	stage := func(c *types.ClusterConfig) *types.ClusterConfig {
+		return live.Stage(stager.Stage(c))
+	}
+
+	stage(render("a"))
+	rec := httptest.NewRecorder()
+	live.ServeHTTP(rec, httptest.NewRequest(http.MethodPatch, "/runtime", strings.NewReader(`{"services":{"10.0.0.2:80":{"weight":5}}}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200. saw %d %s", rec.Code, rec.Body)
+	}
+
+	// b is blended with a on the canary VIP, then overridden
+	got := stage(render("b"))
+	if got.Config["10.0.0.1"]["80"].Service != "b" || got.Config["10.0.0.2"]["80"].Weight == nil {
+		t.Fatalf("expected the config blended and overridden. saw %+v", got.Config)
+	}
+	if got.Base != "common" || got.Defaults == nil || !reflect.DeepEqual(got.Defaults.Communities, []string{"65000:100"}) {
+		t.Fatalf("expected the base and defaults to be kept. saw %q %+v", got.Base, got.Defaults)
+	}
+}
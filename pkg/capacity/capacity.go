@@ -0,0 +1,261 @@
+package capacity
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// The kernel drops new connections once the conntrack table is full, and the
+// IPVS connection table grows without bound until memory runs out. Either
+// shows up as VIPs dropping traffic with nothing wrong in ravel's own state,
+// so the size of both tables is read from /proc whenever metrics are
+// collected, and a health gauge flips to 0 when a table crosses its
+// threshold.
+//
+// IPVS connections are summed from the active and inactive counts of each
+// real server in /proc/net/ip_vs rather than counted from ip_vs_conn, which
+// would mean reading a line per connection on every scrape.
+
+const (
+	TableConntrack = "conntrack"
+	TableIPVS      = "ipvs"
+)
+
+// procDir is where the kernel tables are read from.
+var procDir = "/proc"
+
+// slabs maps the kernel tables to the slab caches holding their entries.
+var slabs = map[string]string{
+	TableConntrack: "nf_conntrack",
+	TableIPVS:      "ip_vs_conn",
+}
+
+var (
+	entriesDesc = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "kernel_table_entries",
+		Help:   "is the number of entries in a kernel table: tracked connections for conntrack, and active plus inactive connections to real servers for ipvs",
+		Labels: []string{"lb", "table"},
+	}).Desc()
+	maxDesc = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "kernel_table_max_entries",
+		Help:   "is the number of entries a kernel table holds before new connections are dropped. only conntrack has a limit",
+		Labels: []string{"lb", "table"},
+	}).Desc()
+	memoryDesc = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "kernel_table_memory_bytes",
+		Help:   "is the memory held by the slab cache of a kernel table's entries. missing when the kernel merged the cache with another",
+		Labels: []string{"lb", "table"},
+	}).Desc()
+	healthyDesc = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "kernel_table_healthy",
+		Help:   "is 1 while a kernel table is below its capacity threshold, and 0 once it crosses it",
+		Labels: []string{"lb", "table"},
+	}).Desc()
+	ipvsSizeDesc = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "ipvs_connection_table_size",
+		Help:   "is the number of hash buckets in the ipvs connection table, set by the ip_vs conn_tab_bits module parameter",
+		Labels: []string{"lb"},
+	}).Desc()
+)
+
+// Thresholds flip the health gauge of each table.
+type Thresholds struct {
+	// Conntrack is the fraction of nf_conntrack_max in use at which conntrack
+	// is unhealthy.
+	Conntrack float64
+	// IPVS is the number of ipvs connections at which ipvs is unhealthy. As
+	// the table has no limit, 0 leaves the ipvs health gauge unset.
+	IPVS int
+}
+
+// Validate checks the thresholds are in range.
+func (t Thresholds) Validate() error {
+	if t.Conntrack <= 0 || t.Conntrack > 1 {
+		return fmt.Errorf("conntrack threshold must be a fraction greater than 0 and at most 1")
+	}
+	if t.IPVS < 0 {
+		return fmt.Errorf("ipvs threshold must not be negative")
+	}
+	return nil
+}
+
+// Collector exports the capacity of the kernel connection tables.
+type Collector struct {
+	kind       string
+	thresholds Thresholds
+	logger     logging.Logger
+}
+
+// NewCollector returns a Collector for the thresholds.
+func NewCollector(kind stats.LBKind, thresholds Thresholds, logger logging.Logger) (*Collector, error) {
+	if err := thresholds.Validate(); err != nil {
+		return nil, err
+	}
+	return &Collector{
+		kind:       string(kind),
+		thresholds: thresholds,
+		logger:     logger.WithFields(logging.Fields{"module": "capacity"}),
+	}, nil
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{entriesDesc, maxDesc, memoryDesc, healthyDesc, ipvsSizeDesc} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector. Tables that can't be read, such as
+// conntrack before its module is loaded, are left out.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	gauge := func(desc *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, append([]string{c.kind}, labels...)...)
+	}
+	healthy := func(table string, ok bool) {
+		v := 0.0
+		if ok {
+			v = 1
+		}
+		gauge(healthyDesc, v, table)
+	}
+
+	if count, max, err := readConntrack(); err != nil {
+		c.logger.Debugf("unable to read conntrack table size. %v", err)
+	} else {
+		gauge(entriesDesc, float64(count), TableConntrack)
+		gauge(maxDesc, float64(max), TableConntrack)
+		healthy(TableConntrack, max == 0 || float64(count) < c.thresholds.Conntrack*float64(max))
+	}
+
+	if size, conns, err := readIPVS(); err != nil {
+		c.logger.Debugf("unable to read ipvs table size. %v", err)
+	} else {
+		gauge(entriesDesc, float64(conns), TableIPVS)
+		gauge(ipvsSizeDesc, float64(size))
+		if c.thresholds.IPVS > 0 {
+			healthy(TableIPVS, conns < uint64(c.thresholds.IPVS))
+		}
+	}
+
+	memory, err := readSlabs()
+	if err != nil {
+		c.logger.Debugf("unable to read slab memory. %v", err)
+	}
+	for table, slab := range slabs {
+		if b, ok := memory[slab]; ok {
+			gauge(memoryDesc, float64(b), table)
+		}
+	}
+}
+
+func readUint(path string) (uint64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// readConntrack returns the number of tracked connections and the limit.
+func readConntrack() (count, max uint64, err error) {
+	dir := filepath.Join(procDir, "sys/net/netfilter")
+	if count, err = readUint(filepath.Join(dir, "nf_conntrack_count")); err != nil {
+		return 0, 0, err
+	}
+	if max, err = readUint(filepath.Join(dir, "nf_conntrack_max")); err != nil {
+		return 0, 0, err
+	}
+	return count, max, nil
+}
+
+// readIPVS returns the size of the connection hash table from the header of
+// /proc/net/ip_vs, and the connections to every real server:
+//
+//	IP Virtual Server version 1.2.1 (size=4096)
+//	Prot LocalAddress:Port Scheduler Flags
+//	  -> RemoteAddress:Port Forward Weight ActiveConn InActConn
+//	TCP  0A36D50A:0050 wrr
+//	  -> 0A000001:0050      Route   1      3          12
+func readIPVS() (size, conns uint64, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(procDir, "net/ip_vs"))
+	if err != nil {
+		return 0, 0, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "(size="); i >= 0 {
+			end := strings.Index(line[i:], ")")
+			if end < 0 {
+				return 0, 0, fmt.Errorf("malformed ip_vs header %q", line)
+			}
+			if size, err = strconv.ParseUint(line[i+len("(size="):i+end], 10, 64); err != nil {
+				return 0, 0, fmt.Errorf("malformed ip_vs header %q", line)
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[0] != "->" || fields[1] == "RemoteAddress:Port" {
+			continue
+		}
+		for _, f := range fields[len(fields)-2:] {
+			n, err := strconv.ParseUint(f, 10, 64)
+			if err != nil {
+				return 0, 0, fmt.Errorf("malformed ip_vs real server %q", line)
+			}
+			conns += n
+		}
+	}
+	return size, conns, scanner.Err()
+}
+
+// readSlabs returns the bytes allocated to each slab cache in /proc/slabinfo,
+// which only root can read. Older kernels suffix the conntrack cache with
+// the address of its network namespace, so those are summed under the
+// prefix.
+func readSlabs() (map[string]uint64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(procDir, "slabinfo"))
+	if err != nil {
+		return nil, err
+	}
+	memory := map[string]uint64{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		// name active_objs num_objs objsize ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		objs, err1 := strconv.ParseUint(fields[2], 10, 64)
+		size, err2 := strconv.ParseUint(fields[3], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		name := fields[0]
+		if suffix := strings.TrimPrefix(name, slabs[TableConntrack]+"_"); suffix != name && isHex(suffix) {
+			name = slabs[TableConntrack]
+		}
+		memory[name] += objs * size
+	}
+	return memory, scanner.Err()
+}
+
+func isHex(s string) bool {
+	_, err := strconv.ParseUint(s, 16, 64)
+	return err == nil
+}
@@ -0,0 +1,100 @@
+package capacity
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+func TestCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capacity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	procDir = dir
+	defer func() { procDir = "/proc" }()
+
+	files := map[string]string{
+		"sys/net/netfilter/nf_conntrack_count": "900\n",
+		"sys/net/netfilter/nf_conntrack_max":   "1000\n",
+		"net/ip_vs": `IP Virtual Server version 1.2.1 (size=4096)
+Prot LocalAddress:Port Scheduler Flags
+  -> RemoteAddress:Port Forward Weight ActiveConn InActConn
+TCP  0A36D50A:0050 wrr
+  -> 0A000001:0050      Route   1      3          12
+  -> 0A000002:0050      Route   1      5          0
+TCP  [2001:0db8:0000:0000:0000:0000:0000:0010]:0050 wrr
+  -> [2001:0db8:0000:0000:0000:0000:0000:0001]:0050      Route   1      1          1
+`,
+		"slabinfo": `slabinfo - version: 2.1
+# name            <active_objs> <num_objs> <objsize> <objperslab> <pagesperslab> : tunables <limit> <batchcount> <sharedfactor> : slabdata <active_slabs> <num_slabs> <sharedavail>
+nf_conntrack_expect      0      0    224   18    1 : tunables    0    0    0 : slabdata      0      0      0
+nf_conntrack_ffff8f2a3c5a0000    900    912    256   16    1 : tunables    0    0    0 : slabdata     57     57      0
+ip_vs_conn            20     32    320   25    2 : tunables    0    0    0 : slabdata      2      2      0
+`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := NewCollector(stats.KindIpvsMaster, Thresholds{Conntrack: 0.8, IPVS: 100}, logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+
+	expected := `
+# HELP ravel_kernel_table_entries is the number of entries in a kernel table: tracked connections for conntrack, and active plus inactive connections to real servers for ipvs
+# TYPE ravel_kernel_table_entries gauge
+ravel_kernel_table_entries{lb="director",table="conntrack"} 900
+ravel_kernel_table_entries{lb="director",table="ipvs"} 22
+# HELP ravel_kernel_table_healthy is 1 while a kernel table is below its capacity threshold, and 0 once it crosses it
+# TYPE ravel_kernel_table_healthy gauge
+ravel_kernel_table_healthy{lb="director",table="conntrack"} 0
+ravel_kernel_table_healthy{lb="director",table="ipvs"} 1
+# HELP ravel_kernel_table_memory_bytes is the memory held by the slab cache of a kernel table's entries. missing when the kernel merged the cache with another
+# TYPE ravel_kernel_table_memory_bytes gauge
+ravel_kernel_table_memory_bytes{lb="director",table="conntrack"} 233472
+ravel_kernel_table_memory_bytes{lb="director",table="ipvs"} 10240
+`
+	names := []string{"ravel_kernel_table_entries", "ravel_kernel_table_healthy", "ravel_kernel_table_memory_bytes"}
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), names...); err != nil {
+		t.Fatal(err)
+	}
+
+	// without conntrack loaded, only ipvs is reported
+	os.RemoveAll(filepath.Join(dir, "sys"))
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "table" && l.GetValue() == TableConntrack && f.GetName() != "ravel_kernel_table_memory_bytes" {
+					t.Fatalf("expected no conntrack %s without the conntrack module", f.GetName())
+				}
+			}
+		}
+	}
+
+	if _, err := NewCollector(stats.KindIpvsMaster, Thresholds{Conntrack: 1.5}, logging.New()); err == nil {
+		t.Fatal("expected a conntrack threshold above 1 to be rejected")
+	}
+}
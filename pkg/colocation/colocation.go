@@ -0,0 +1,171 @@
+package colocation
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// A colocated director and realserver share a node, and both want its VIP
+// addresses and its iptables chain: the director holds the VIPs on the
+// primary interface and, in iptables colocation mode, captures VIP traffic to
+// local pods in the chain, while the realserver holds the VIPs on loopback
+// and writes the chain for the director of another node. Run as separate
+// processes they only learn of each other through the coordinator heartbeat,
+// so each can write over the other while it is late to notice.
+//
+// The Arbiter hands that state between them in one process. The director
+// owns it while it holds the VIPs, and the realserver the rest of the time,
+// so a vrrp backup still serves its local pods for the master. Ownership
+// only moves once the old owner is done: the realserver is stopped, and its
+// addresses and rules torn down, before the director takes over, and the
+// director withdraws its VIPs before the realserver starts. IPVS stays with
+// the director throughout, as the realserver doesn't touch it.
+
+// Owner is the role that owns the node's VIP addresses and iptables chain.
+type Owner string
+
+const (
+	// OwnerNone is between owners, or when a handoff failed.
+	OwnerNone       Owner = "none"
+	OwnerDirector   Owner = "director"
+	OwnerRealServer Owner = "realserver"
+)
+
+var ownerDef = stats.Define(stats.Definition{
+	Type:   stats.Gauge,
+	Name:   "colocation_owner",
+	Help:   "is 1 for the role of a colocated process that owns the node's VIP addresses and iptables chain, and 0 for the others",
+	Labels: []string{"seczone", "role"},
+})
+
+// Worker is the realserver, as the arbiter starts and stops it.
+type Worker interface {
+	Start() error
+	Stop() error
+	Shutdown(ctx context.Context) error
+}
+
+// Arbiter decides whether the director or the realserver of a colocated
+// process owns the node's VIP addresses and iptables chain.
+type Arbiter struct {
+	sync.Mutex
+	owner Owner
+	err   error
+
+	realserver Worker
+	gauge      *prometheus.GaugeVec
+	configKey  string
+	logger     logging.Logger
+}
+
+// New returns the arbiter of a colocated process of configKey. Nothing owns
+// the node until the director acquires it or releases it to realserver.
+func New(realserver Worker, configKey string, logger logging.Logger) *Arbiter {
+	a := &Arbiter{
+		owner:      OwnerNone,
+		realserver: realserver,
+		gauge:      ownerDef.GaugeVec(),
+		configKey:  configKey,
+		logger:     logger.WithFields(logging.Fields{"module": "colocation"}),
+	}
+	a.set(OwnerNone, nil)
+	return a
+}
+
+// Owner returns the role that owns the node.
+func (a *Arbiter) Owner() Owner {
+	a.Lock()
+	defer a.Unlock()
+	return a.owner
+}
+
+// Director reports whether the director owns the node.
+func (a *Arbiter) Director() bool {
+	return a.Owner() == OwnerDirector
+}
+
+// Acquire hands the node to the director, stopping the realserver first if
+// it owns it. The director owns the node afterwards even when the realserver
+// failed to clean up, as it is stopped either way; the error is returned and
+// reported by Health.
+func (a *Arbiter) Acquire() error {
+	previous := a.Owner()
+	if previous == OwnerDirector {
+		return nil
+	}
+	var err error
+	if previous == OwnerRealServer {
+		a.logger.Info("colocation: stopping the realserver for the director")
+		if err = a.realserver.Stop(); err != nil {
+			err = fmt.Errorf("colocation: the realserver failed to clean up for the director. %v", err)
+			a.logger.Error(err)
+		}
+	}
+	a.set(OwnerDirector, err)
+	a.logger.Infof("colocation: the director owns the node, from %s", previous)
+	return err
+}
+
+// Release hands the node to the realserver: the director gives it up,
+// withdraw takes the director's VIPs down, and then the realserver starts.
+// The node is left to neither when the realserver fails to start, and
+// Release may be called again to retry.
+func (a *Arbiter) Release(withdraw func()) error {
+	previous := a.Owner()
+	if previous == OwnerRealServer {
+		return nil
+	}
+	a.set(OwnerNone, nil)
+	if withdraw != nil {
+		withdraw()
+	}
+	if err := a.realserver.Start(); err != nil {
+		err = fmt.Errorf("colocation: unable to start the realserver. %v", err)
+		a.logger.Error(err)
+		a.set(OwnerNone, err)
+		return err
+	}
+	a.set(OwnerRealServer, nil)
+	a.logger.Infof("colocation: the realserver owns the node, from %s", previous)
+	return nil
+}
+
+// Shutdown stops the realserver, if it owns the node, as the process exits
+// within the deadline of ctx.
+func (a *Arbiter) Shutdown(ctx context.Context) error {
+	if a.Owner() != OwnerRealServer {
+		return nil
+	}
+	a.set(OwnerNone, nil)
+	return a.realserver.Shutdown(ctx)
+}
+
+// Health reports the owner, and fails while the last handoff did.
+func (a *Arbiter) Health(context.Context) health.Status {
+	a.Lock()
+	defer a.Unlock()
+	if a.err != nil {
+		return health.Status{Ready: false, Message: a.err.Error(), Detail: a.owner}
+	}
+	return health.Status{Ready: true, Message: "owned by " + string(a.owner), Detail: a.owner}
+}
+
+func (a *Arbiter) set(owner Owner, err error) {
+	a.Lock()
+	a.owner, a.err = owner, err
+	a.Unlock()
+	for _, o := range []Owner{OwnerNone, OwnerDirector, OwnerRealServer} {
+		v := 0.0
+		if o == owner {
+			v = 1
+		}
+		a.gauge.WithLabelValues(a.configKey, string(o)).Set(v)
+	}
+}
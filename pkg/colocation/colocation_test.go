@@ -0,0 +1,97 @@
+package colocation
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+// fakeWorker records the calls made on the realserver, and what owned the
+// node at the time.
+type fakeWorker struct {
+	a        *Arbiter
+	calls    []string
+	startErr error
+}
+
+func (f *fakeWorker) Start() error {
+	f.calls = append(f.calls, "start with "+string(f.a.Owner()))
+	return f.startErr
+}
+
+func (f *fakeWorker) Stop() error {
+	f.calls = append(f.calls, "stop with "+string(f.a.Owner()))
+	return nil
+}
+
+func (f *fakeWorker) Shutdown(context.Context) error {
+	f.calls = append(f.calls, "shutdown with "+string(f.a.Owner()))
+	return nil
+}
+
+func TestHandoff(t *testing.T) {
+	rs := &fakeWorker{}
+	a := New(rs, "green", logging.New())
+	rs.a = a
+
+	// a vrrp backup withdraws its VIPs before the realserver starts
+	withdrawn := Owner("")
+	if err := a.Release(func() { withdrawn = a.Owner() }); err != nil {
+		t.Fatal(err)
+	}
+	if withdrawn != OwnerNone || a.Owner() != OwnerRealServer || a.Director() {
+		t.Fatalf("expected the realserver to own the node once the director withdrew, withdrew with %q", withdrawn)
+	}
+
+	// on becoming master, the realserver is stopped before the director
+	// takes over
+	if err := a.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	if !a.Director() {
+		t.Fatalf("expected the director to own the node, got %s", a.Owner())
+	}
+	// acquiring again changes nothing
+	if err := a.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"start with none", "stop with realserver"}
+	if len(rs.calls) != len(expected) || rs.calls[0] != expected[0] || rs.calls[1] != expected[1] {
+		t.Fatalf("expected calls %v, got %v", expected, rs.calls)
+	}
+
+	// the director owns the node at exit, so there's no realserver to stop
+	if err := a.Shutdown(context.Background()); err != nil || len(rs.calls) != 2 {
+		t.Fatalf("expected no realserver to stop, got %v %v", err, rs.calls)
+	}
+}
+
+func TestReleaseFailure(t *testing.T) {
+	rs := &fakeWorker{startErr: errors.New("no loopback")}
+	a := New(rs, "blue", logging.New())
+	rs.a = a
+
+	if err := a.Release(nil); err == nil {
+		t.Fatal("expected the release to fail with the realserver")
+	}
+	if status := a.Health(context.Background()); status.Ready || a.Owner() != OwnerNone {
+		t.Fatalf("expected nothing to own the node, got %s %+v", a.Owner(), status)
+	}
+
+	// a retry once the realserver can start hands it the node
+	rs.startErr = nil
+	if err := a.Release(nil); err != nil {
+		t.Fatal(err)
+	}
+	if status := a.Health(context.Background()); !status.Ready || a.Owner() != OwnerRealServer {
+		t.Fatalf("expected the realserver to own the node, got %s %+v", a.Owner(), status)
+	}
+
+	// the realserver owns the node at exit, and is shut down rather than
+	// stopped for the director
+	if err := a.Shutdown(context.Background()); err != nil || rs.calls[len(rs.calls)-1] != "shutdown with none" {
+		t.Fatalf("expected the realserver shut down, got %v %v", err, rs.calls)
+	}
+}
@@ -0,0 +1,594 @@
+// Package config holds the settings of every mode of ravel: a section of
+// them for each part of a mode, the defaults that are worked out from other
+// settings, the checks of a config as a whole and for a mode, and a form of
+// it that is safe to print.
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/canary"
+	"github.com/Comcast/Ravel/pkg/capacity"
+	"github.com/Comcast/Ravel/pkg/heartbeat"
+	log "github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/observe"
+	"github.com/Comcast/Ravel/pkg/privsep"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/vrrp"
+)
+
+// Config is the settings of a mode.
+type Config struct {
+	ConfigKey          string
+	ConfigMapNamespace string
+	ConfigMapName      string
+	// StrictConfig has cluster configs that fail validation rejected rather
+	// than applied as they parse
+	StrictConfig bool
+
+	// clean up master conditionally; default true
+	CleanupMaster bool
+	// OnExit is what a director leaves on the node when it stops, one of
+	// the types.OnExit policies
+	OnExit string
+	// ShutdownGracePeriod bounds the shutdown of a mode on exit, from
+	// stopping its worker to tearing the node down per OnExit
+	ShutdownGracePeriod time.Duration
+
+	// PodCIDR omit a pod cidr from masq chain
+	PodCIDRMasq  string
+	IPTablesMasq bool
+
+	// Periodic reconfigure
+	ForcedReconfigure bool
+	// ForcedReconfigureInterval is how often a director applies its config
+	// without checking parity
+	ForcedReconfigureInterval time.Duration
+
+	// ObserveOnly has a director work out every change it would make to the
+	// node, and record it instead of making it.
+	ObserveOnly bool
+	// DryRun does the same in any mode, to rehearse a config change on a
+	// node rather than compare versions
+	DryRun bool
+	// PrivilegedHelper is the socket of the helper that changes the node
+	// for a mode that runs without root, or empty.
+	PrivilegedHelper string
+
+	// This is the IP address of the node - the node as it is known to Kubernetes
+	NodeName string
+
+	// This is the location on disk of a kubeconfig
+	KubeConfigFile string
+
+	// ConfigFile is the --config file, which is read again every
+	// ReloadInterval for the settings that can change at runtime.
+	ConfigFile     string
+	ReloadInterval time.Duration
+
+	// This is the IPTables prefix to use.
+	IPTablesChain string
+
+	// SharedNode has the instance leave alone the VIP devices, ipvs services
+	// and iptables chains of the other config keys running on the node.
+	SharedNode bool
+	// StateDir is where a director on a shared node records the ipvs
+	// services it owns, and a bgp director its bgp overrides.
+	StateDir string
+
+	// FailoverTimeout is used by the realserver to specify the
+	// number of seconds between a loss of the director and the realserver
+	// initiating its reconfiguration routine
+	FailoverTimeout int
+	Failover        FailoverConfig
+
+	// DrainWindow is how long the realserver lets connections to local pods
+	// finish once the director returns, before tearing its rules down.
+	DrainWindow time.Duration
+
+	// WarmStandbyInterval is how often a stopped realserver pre-builds its
+	// configuration for a takeover. Zero builds it on takeover.
+	WarmStandbyInterval time.Duration
+
+	Stats StatsConfig
+	IPVS  IPVSConfig
+	Net   NetConfig
+	Arp   ArpConfig
+
+	Coordinator CoordinatorConfig
+
+	DefaultListener DefaultListenerConfig
+
+	BGP BGPConfig
+
+	Tracing TracingConfig
+
+	Admin AdminConfig
+
+	Audit AuditConfig
+
+	SNMP SNMPConfig
+
+	Probe ProbeConfig
+
+	// Canary stages each changed cluster config on a few VIPs, and promotes
+	// it once their probes pass
+	Canary canary.Config
+
+	Capacity CapacityConfig
+
+	Watchdog   WatchdogConfig
+	SelfHealth SelfHealthConfig
+
+	HAProxy HAProxyConfig
+
+	VRRP VRRPConfig
+
+	Auto AutoConfig
+
+	// PprofPort is the localhost port serving pprof and runtime metrics.
+	// Zero disables it.
+	PprofPort int
+
+	// SelfTest runs the environment checks before taking traffic.
+	SelfTest bool
+}
+
+// Ownership is how the helpers tag what they create on the node, and whether
+// they leave the rest alone.
+func (c *Config) Ownership() system.Ownership {
+	return system.Ownership{ConfigKey: c.ConfigKey, Shared: c.SharedNode, StateDir: c.StateDir}
+}
+
+type DefaultListenerConfig struct {
+	Service string
+	Port    int
+}
+
+type CoordinatorConfig struct {
+	// Ports is a list of ports that the director will listen on, the first of which
+	// the realserver will populate
+	Ports []int
+
+	// CertFile, KeyFile and CAFile secure the heartbeat with mutual tls. The
+	// realserver expects the director's certificate to be for ServerName.
+	CertFile   string
+	KeyFile    string
+	CAFile     string
+	ServerName string
+
+	// StaleAfter is how long the director may go without finishing a
+	// reconcile before the realserver stops taking its heartbeat for it
+	// running. 0 never does.
+	StaleAfter time.Duration
+
+	// ActiveActive runs every bgp director of the config key at once, with
+	// coordination tracking their membership through leases that last
+	// MembershipTTL. With ShardReplicas, each VIP is announced by that many
+	// of them rather than all.
+	ActiveActive  bool
+	MembershipTTL time.Duration
+	ShardReplicas int
+
+	// FeedListen is where a director serves its cluster config and nodes to
+	// realservers, and Feed the directors a realserver takes them from
+	// instead of watching the configmap and nodes. A realserver that has
+	// had no feed for FeedFallback watches them itself until it returns.
+	FeedListen   string
+	Feed         []string
+	FeedFallback time.Duration
+}
+
+func DefaultCoordinatorConfig() CoordinatorConfig {
+	return CoordinatorConfig{Ports: []int{44444}}
+}
+
+func NewCoordinatorConfig(ports []string) (*CoordinatorConfig, error) {
+	c := &CoordinatorConfig{}
+
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no coordinator-ports provided")
+	}
+
+	var lastErr error
+	intPorts := []int{}
+	for _, p := range ports {
+		i, err := strconv.Atoi(p)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		intPorts = append(intPorts, i)
+	}
+	c.Ports = intPorts
+	return c, lastErr
+}
+
+type StatsConfig struct {
+	Enabled    bool
+	Interface  string
+	ListenAddr string
+	ListenPort string
+	Interval   time.Duration
+
+	// TopTalkers is the number of sources counted for the top talkers
+	// endpoint. 0 disables it.
+	TopTalkers int
+
+	FlowExport FlowExportConfig
+
+	RemoteWrite RemoteWriteConfig
+}
+
+// FlowExportConfig configures export of sampled VIP traffic. Export is
+// disabled when Protocol is empty.
+type FlowExportConfig struct {
+	Protocol   string // ipfix or sflow
+	Collector  string
+	SampleRate uint32
+	Interval   time.Duration
+}
+
+// RemoteWriteConfig configures pushing metrics to a Prometheus remote-write
+// endpoint. Pushing is disabled when URL is empty.
+type RemoteWriteConfig struct {
+	URL       string
+	Interval  time.Duration
+	BatchSize int
+	Timeout   time.Duration
+	Retries   int
+
+	Username        string
+	PasswordFile    string
+	BearerTokenFile string
+
+	Labels map[string]string
+}
+
+// Settings returns the remote-write settings, without the secrets held in
+// files.
+func (c RemoteWriteConfig) Settings() stats.RemoteWriteConfig {
+	return stats.RemoteWriteConfig{
+		URL:       c.URL,
+		Interval:  c.Interval,
+		BatchSize: c.BatchSize,
+		Timeout:   c.Timeout,
+		Retries:   c.Retries,
+		Username:  c.Username,
+		Labels:    c.Labels,
+	}
+}
+
+// IPVSConfig if you modify the tags or fields of this struct, or add new ones, run unit tests in config_test.go!!
+type IPVSConfig struct {
+	// ColocationMode denotes the way that the ipvs director will be configured
+	// to deal with pods that are colocated on the same node.
+	ColocationMode string
+
+	// Gets set to true by --ipvs-weight-override
+	// When true, don't calculate ipvsadm weights, set them to 1 regardless.
+	WeightOverride bool
+
+	// Gets set to true by --ipvs-ignore-node-cordon
+	// When true, do not evaluate the Cordoned criteria when determining whether a node is an eligible backend
+	IgnoreCordon bool
+
+	// Sysctl settings for IPVS.
+	SysctlSettings map[string]string
+}
+
+// NewIPVSConfig use reflect to pull out defaults we specify in tags
+// use reflect to also set the value
+// NOTE: the values specified in the systctl parameter must be in the form ipvs_tag_name=<value>
+// an error will be returned if not
+func NewIPVSConfig(sysctl []string) (*IPVSConfig, error) {
+	ipvsConfig := &IPVSConfig{}
+
+	// apply default sysctl settings
+	ipvsConfig.SysctlSettings = make(map[string]string)
+	ipvsConfig.SysctlSettings["am_droprate"] = "10"
+	ipvsConfig.SysctlSettings["amemthresh"] = "1024"
+	ipvsConfig.SysctlSettings["backup_only"] = "0"
+	ipvsConfig.SysctlSettings["cache_bypass"] = "0"
+	ipvsConfig.SysctlSettings["conn_reuse_mode"] = "1"
+	ipvsConfig.SysctlSettings["conntrack"] = "0"
+	ipvsConfig.SysctlSettings["drop_entry"] = "0"
+	ipvsConfig.SysctlSettings["drop_packet"] = "0"
+	ipvsConfig.SysctlSettings["expire_nodest_conn"] = "0"
+	ipvsConfig.SysctlSettings["expire_quiescent_template"] = "0"
+	ipvsConfig.SysctlSettings["ignore_tunneled"] = "1"
+	ipvsConfig.SysctlSettings["nat_icmp_send"] = "0"
+	ipvsConfig.SysctlSettings["pmtu_disc"] = "1"
+	ipvsConfig.SysctlSettings["schedule_icmp"] = "0"
+	ipvsConfig.SysctlSettings["secure_tcp"] = "0"
+	ipvsConfig.SysctlSettings["sloppy_sctp"] = "0"
+	ipvsConfig.SysctlSettings["sloppy_tcp"] = "1"
+	ipvsConfig.SysctlSettings["snat_reroute"] = "1"
+	ipvsConfig.SysctlSettings["sync_persist_mode"] = "0"
+	ipvsConfig.SysctlSettings["sync_ports"] = "1"
+	ipvsConfig.SysctlSettings["sync_qlen_max"] = "1028304"
+	ipvsConfig.SysctlSettings["sync_refresh_period"] = "0"
+	ipvsConfig.SysctlSettings["sync_retries"] = "0"
+	ipvsConfig.SysctlSettings["sync_sock_size"] = "0"
+	ipvsConfig.SysctlSettings["sync_threshold"] = "3	50"
+	ipvsConfig.SysctlSettings["sync_version"] = "1"
+
+	// iterate over supplied ipvs-sysctl settings and override anything already set
+	log.Debugln("Parsing specified sysctl settings into sysctl map")
+	for _, s := range sysctl {
+		spl := strings.Split(s, "=")
+		if len(spl) != 2 {
+			return ipvsConfig, fmt.Errorf("An incorrectly formatted string was passed from cli. ipvs config flags must be in format --ipvs-sysctl=ipvs_tag_name=<value>")
+		}
+		name := spl[0]
+		value := spl[1]
+		log.Debugln("Parsed sysctl setting:", name, value)
+
+		// if the cli user passed in an incorrect name or value
+		if name == "" {
+			return ipvsConfig, fmt.Errorf("Unable to validate passed sysctl setting with blank name.  The value was: %s", value)
+		}
+		if value == "" {
+			return ipvsConfig, fmt.Errorf("Unable to validate passed sysctl setting with blank value.  The name was: %s", value)
+		}
+
+		ipvsConfig.SysctlSettings[name] = value
+	}
+
+	return ipvsConfig, nil
+}
+
+// GetSysCtlSetting fetches the sysctl setting with the name supplied.  Returns an error if not found.
+func (i *IPVSConfig) GetSysCtlSetting(name string) (string, error) {
+	value, ok := i.SysctlSettings[name]
+	if !ok {
+		return "", fmt.Errorf("sysctl setting not found to be set: %s", value)
+	}
+	return value, nil
+}
+
+// WriteToNode writes sysctl settings to the actual node
+func (i *IPVSConfig) WriteToNode() error {
+	log.Debugln("Writing sysctl settings to node!")
+	for name, value := range i.SysctlSettings {
+		log.Infoln("setting sysctl value", name, "to", value)
+		err := i.SetSysctl(name, value)
+		if err != nil {
+			log.Debugln("Error when seting sysctl setting", name, value, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetSysctl sets the value of /proc/sys/net/ipv4/vs/<path> to value in config struct
+func (i *IPVSConfig) SetSysctl(setting, value string) error {
+	// guard against values produced by the struct with no tag
+	if setting == "" || value == "" {
+		return fmt.Errorf("Unable to set sysctl setting because the setting or value was empty. Setting: %s value: %s", setting, value)
+	}
+	file := "/proc/sys/net/ipv4/vs/" + setting
+	if observe.Enabled() {
+		observe.Would(audit.SubsystemIPVS, "sysctl", setting, value)
+		return nil
+	}
+	log.Debugln("Setting sysctl", file, "to value:", value)
+
+	if err := privsep.WriteSetting(file, value); err != nil {
+		return fmt.Errorf("error writing setting %s to %s at path %s: %v", setting, value, file, err)
+	}
+
+	log.Debugln("Successfully set sysctl setting", setting, value)
+	return nil
+}
+
+type NetConfig struct {
+	LocalInterface string
+	Interface      string
+	PrimaryIP      string
+	Gateway        string
+}
+
+type ArpConfig struct {
+	LoAnnounce      int
+	LoIgnore        int
+	PrimaryAnnounce int
+	PrimaryIgnore   int
+}
+
+type BGPConfig struct {
+	Binary      string
+	Communities []string
+}
+
+// TracingConfig controls export of reconfigure spans to an OTLP collector.
+// Tracing is disabled when Endpoint is blank.
+type TracingConfig struct {
+	Endpoint    string
+	Insecure    bool
+	SampleRatio float64
+}
+
+// AdminConfig controls the authenticated admin endpoint. The endpoint is
+// disabled when Listen is blank.
+type AdminConfig struct {
+	Listen    string
+	TokenFile string
+	// AccessFile grants scopes to more tokens, and to client certificates
+	// by their common name. The token of TokenFile has every scope.
+	AccessFile string
+
+	// CertFile and KeyFile serve the endpoint over tls, and CAFile verifies
+	// client certificates, which stand in for the token
+	CertFile   string
+	KeyFile    string
+	CAFile     string
+	ServerName string
+
+	// StatusSocket is the unix socket the health endpoints and the status
+	// are also served on, for sidecars and the status command on the node,
+	// or blank. Its file mode stands in for the token.
+	StatusSocket string
+}
+
+// AuditConfig controls the audit trail of changes made to the node. Events
+// are always kept in memory; File and Journald add sinks.
+type AuditConfig struct {
+	Size     int
+	File     string
+	Journald bool
+}
+
+// SNMPConfig controls the AgentX subagent. The subagent is disabled when
+// Master is blank.
+type SNMPConfig struct {
+	Master   string
+	Root     string
+	CacheTTL time.Duration
+}
+
+// ProbeConfig controls the synthetic probing of VIPs from the director. Probing
+// is disabled when Interval is zero.
+type ProbeConfig struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	HTTPPath string
+}
+
+// CapacityConfig sets the thresholds that flip the health gauges of the
+// kernel connection tables.
+type CapacityConfig struct {
+	ConntrackThreshold float64
+	IPVSThreshold      int
+}
+
+// Thresholds returns the thresholds of the collector of the kernel
+// connection tables.
+func (c CapacityConfig) Thresholds() capacity.Thresholds {
+	return capacity.Thresholds{Conntrack: c.ConntrackThreshold, IPVS: c.IPVSThreshold}
+}
+
+// WatchdogConfig controls the supervision of the worker loops. The watchdog is
+// disabled when Deadline is zero.
+type WatchdogConfig struct {
+	Deadline time.Duration
+	Restart  bool
+}
+
+// SelfHealthConfig controls the self-health checks of the realserver. They
+// are disabled when Interval is zero.
+type SelfHealthConfig struct {
+	Interval time.Duration
+	// Threshold is how many checks in a row must fail before the node is
+	// marked unhealthy.
+	Threshold int
+}
+
+// HAProxyConfig controls the haproxy listeners of the realserver.
+type HAProxyConfig struct {
+	// Template replaces the built-in configuration template, if set.
+	Template string
+	// SnippetDir holds per-listener snippets, if set.
+	SnippetDir string
+	// MasterWorker runs each listener in haproxy's master-worker mode.
+	MasterWorker bool
+	// Proxy runs the listeners of services that don't pick one: haproxy or
+	// native.
+	Proxy string
+	// Pools hosts the haproxy listeners in this many shared processes, or
+	// in a process each when 0.
+	Pools int
+	// AccessLog logs the connections of the listeners, one in every
+	// AccessLogSample of them.
+	AccessLog       bool
+	AccessLogSample int
+}
+
+// FailoverConfig controls when the realserver takes over from the director
+// on its node, and when it hands the node back.
+type FailoverConfig struct {
+	// Interval is how often the director is probed.
+	Interval time.Duration
+	// FailureThreshold is how many probes in a row must fail before the
+	// realserver takes over, and RecoveryThreshold how many must succeed
+	// before it hands the node back.
+	FailureThreshold  int
+	RecoveryThreshold int
+	// Jitter spreads each wait by up to this fraction either way.
+	Jitter float64
+	// BackoffMax is the longest a takeover is held off for after the
+	// director flapped. Zero never holds one off.
+	BackoffMax time.Duration
+}
+
+// VRRPConfig controls the VRRP mode of the director, where the VIPs float
+// between directors instead of being held by each. VRRP is disabled when ID
+// is zero.
+type VRRPConfig struct {
+	ID       int
+	Priority int
+	// PriorityLabel is the node label that, when set, overrides Priority,
+	// so that the order in which standbys take over can be kept with the
+	// nodes.
+	PriorityLabel string
+	Preempt       bool
+	// PreemptDelay is how long a director waits after starting before it
+	// takes the VIPs back from a master of lower priority.
+	PreemptDelay time.Duration
+	Interval     time.Duration
+	// IPVSSync replicates ipvs connections from the master to the backups,
+	// with the sync id of the virtual router.
+	IPVSSync bool
+	// FenceTTL is how long a master's claim on the VIPs lasts without being
+	// renewed. Zero leaves the VIPs unfenced.
+	FenceTTL time.Duration
+}
+
+// AutoConfig controls how the auto mode picks the role of its node when the
+// node's labels leave it to the election of directors.
+type AutoConfig struct {
+	// Mode pins the role, overriding the node's labels. Blank leaves it to
+	// them.
+	Mode string
+	// Directors is how many candidates are elected to direct.
+	Directors int
+	// DirectorRole is the role an elected candidate runs.
+	DirectorRole string
+	// SlotTTL is how long a director's slot lasts without being renewed.
+	SlotTTL time.Duration
+	// Interval is how often the node's labels are checked, and a candidate
+	// that isn't directing looks for a free slot.
+	Interval time.Duration
+}
+
+// Settings returns the settings of the virtual router, advertised from
+// address.
+func (c VRRPConfig) Settings(address net.IP) vrrp.Config {
+	return vrrp.Config{VRID: uint8(c.ID), Priority: uint8(c.Priority), Preempt: c.Preempt, PreemptDelay: c.PreemptDelay, Interval: c.Interval, Address: address}
+}
+
+// ServerTLS returns the tls config of the director's end of the heartbeat,
+// or nil when it is plaintext.
+func (c CoordinatorConfig) ServerTLS() (*tls.Config, error) {
+	if c.CAFile == "" {
+		return nil, nil
+	}
+	return heartbeat.ServerTLS(c.CertFile, c.KeyFile, c.CAFile)
+}
+
+// ClientTLS returns the tls config of the realserver's end of the heartbeat,
+// or nil when it is plaintext.
+func (c CoordinatorConfig) ClientTLS() (*tls.Config, error) {
+	if c.CAFile == "" {
+		return nil, nil
+	}
+	return heartbeat.ClientTLS(c.CertFile, c.KeyFile, c.CAFile, c.ServerName)
+}
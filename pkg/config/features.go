@@ -0,0 +1,39 @@
+package config
+
+// Features returns the optional features that the settings of c turn on,
+// each named by the flag that does, for bug reports and the version
+// command.
+func (c *Config) Features() []string {
+	features := []string{}
+	add := func(on bool, name string) {
+		if on {
+			features = append(features, name)
+		}
+	}
+	add(c.ObserveOnly, "observe-only")
+	add(c.DryRun, "dry-run")
+	add(c.SharedNode, "shared-node")
+	add(c.PrivilegedHelper != "", "privileged-helper")
+	add(c.Coordinator.ActiveActive, "active-active")
+	add(c.Coordinator.ShardReplicas > 0, "shard-replicas")
+	add(c.Coordinator.FeedListen != "", "config-feed-listen")
+	add(len(c.Coordinator.Feed) > 0, "config-feed")
+	add(c.VRRP.ID > 0, "vrrp-id")
+	add(c.VRRP.IPVSSync, "ipvs-sync")
+	add(c.Stats.Enabled, "stats-enabled")
+	add(c.Stats.Enabled && c.Stats.TopTalkers > 0, "stats-top-talkers")
+	add(c.Stats.FlowExport.Protocol != "", "flow-export")
+	add(c.Stats.RemoteWrite.URL != "", "remote-write-url")
+	add(c.Tracing.Endpoint != "", "otlp-endpoint")
+	add(c.SNMP.Master != "", "snmp-agentx")
+	add(c.Admin.Listen != "", "admin-listen")
+	add(c.Admin.StatusSocket != "", "status-socket")
+	add(c.Probe.Interval > 0, "probe-interval")
+	add(len(c.Canary.VIPs) > 0, "canary-vips")
+	add(c.Watchdog.Restart, "watchdog-restart")
+	add(c.HAProxy.MasterWorker, "haproxy-master-worker")
+	add(c.HAProxy.Pools > 0, "haproxy-pools")
+	add(c.HAProxy.AccessLog, "haproxy-access-log")
+	add(c.IPVS.WeightOverride, "ipvs-weight-override")
+	return features
+}
@@ -0,0 +1,206 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/flowexport"
+	"github.com/Comcast/Ravel/pkg/haproxy"
+	"github.com/Comcast/Ravel/pkg/role"
+	"github.com/Comcast/Ravel/pkg/snmp"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// Problem is a setting that is invalid, by its flag.
+type Problem struct {
+	Key     string `json:"key"`
+	Message string `json:"message"`
+}
+
+func (p Problem) Error() string {
+	return p.Key + ": " + p.Message
+}
+
+// Problems are every setting of a config that is invalid, in the order they
+// were checked.
+type Problems []Problem
+
+func (p Problems) Error() string {
+	if len(p) == 1 {
+		return p[0].Error()
+	}
+	msgs := make([]string, len(p))
+	for ix, problem := range p {
+		msgs[ix] = problem.Error()
+	}
+	return fmt.Sprintf("%d invalid settings. %s", len(p), strings.Join(msgs, "; "))
+}
+
+// Default fills in the settings whose defaults are worked out from others.
+func (c *Config) Default() {
+	if c.Failover.FailureThreshold == 0 {
+		c.Failover.FailureThreshold = c.FailoverTimeout
+	}
+	// cleanup-master predates on-exit, and stands for a full teardown
+	if c.OnExit == "" {
+		c.OnExit = types.OnExitPreserve
+		if c.CleanupMaster {
+			c.OnExit = types.OnExitFullTeardown
+		}
+	}
+	if len(c.Coordinator.Ports) == 0 {
+		c.Coordinator.Ports = DefaultCoordinatorConfig().Ports
+	}
+	// if the node name is not set, try to fetch it from the HOSTNAME env var
+	if c.NodeName == "" {
+		c.NodeName = os.Getenv("HOSTNAME")
+	}
+}
+
+// Validate checks the settings of c, and those of mode, one of the roles of
+// package role, or blank for a command that isn't one. It returns every
+// setting that is invalid as Problems, or nil.
+func (c *Config) Validate(mode string) error {
+	p := Problems{}
+	check := func(invalid bool, key, format string, args ...interface{}) {
+		if invalid {
+			p = append(p, Problem{Key: key, Message: fmt.Sprintf(format, args...)})
+		}
+	}
+
+	check(c.IPTablesChain == "", "iptables-chain", "must be set")
+	check(c.SharedNode && (c.ConfigKey == "" || c.StateDir == ""), "shared-node", "requires config-key and state-dir")
+	check(c.FailoverTimeout < 1 || c.FailoverTimeout > 120, "failover-timeout", "must be between 1 and 120s")
+	check(c.DrainWindow < 0, "drain-window", "must not be negative")
+	check(c.ShutdownGracePeriod <= 0, "shutdown-grace-period", "must be positive")
+	check(c.WarmStandbyInterval < 0, "warm-standby-interval", "must not be negative")
+	check(c.Failover.Interval < 100*time.Millisecond || c.Failover.Interval > time.Minute, "failover-probe-interval", "must be between 100ms and 1m")
+	check(c.Failover.FailureThreshold < 1, "failover-failure-threshold", "must be at least 1")
+	check(c.Failover.RecoveryThreshold < 1, "failover-recovery-threshold", "must be at least 1")
+	check(c.Failover.Jitter < 0 || c.Failover.Jitter >= 1, "failover-jitter", "must be at least 0 and less than 1")
+	check(c.Failover.BackoffMax < 0, "failover-backoff-max", "must not be negative")
+	check(c.NodeName == "", "nodename", "must be set. this is the ip address of the node, or its name in kubernetes")
+	check(c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1, "trace-sample-ratio", "must be between 0 and 1")
+	check(c.PprofPort < 0 || c.PprofPort > 65535, "pprof-port", "must be between 0 and 65535")
+
+	check(c.Admin.Listen != "" && c.Admin.TokenFile == "" && c.Admin.AccessFile == "" && c.Admin.CAFile == "", "admin-listen", "requires admin-token-file, admin-access-file or admin-ca")
+	check((c.Admin.CertFile == "") != (c.Admin.KeyFile == ""), "admin-cert", "must be set with admin-key")
+	check(c.Admin.CAFile != "" && c.Admin.CertFile == "", "admin-ca", "requires admin-cert and admin-key")
+	check(c.Admin.StatusSocket != "" && !filepath.IsAbs(c.Admin.StatusSocket), "status-socket", "must be an absolute path")
+	check(c.Audit.Size < 1, "audit-size", "must be at least 1")
+	if c.SNMP.Master != "" {
+		_, err := snmp.ParseOID(c.SNMP.Root)
+		check(err != nil, "snmp-oid", "must be a valid oid when snmp-agentx is set. %v", err)
+		check(c.SNMP.CacheTTL < 0, "snmp-cache-ttl", "must not be negative")
+	}
+	if err := c.Capacity.Thresholds().Validate(); err != nil {
+		check(true, "capacity-conntrack-threshold", "invalid with capacity-ipvs-threshold. %v", err)
+	}
+
+	co := c.Coordinator
+	check((co.CertFile == "") != (co.KeyFile == "") || (co.CertFile == "") != (co.CAFile == ""), "coordinator-cert", "must be set with coordinator-key and coordinator-ca")
+	check(co.ActiveActive && co.MembershipTTL < 3*time.Second, "membership-ttl", "must be at least 3s")
+	check(co.ShardReplicas < 0, "shard-replicas", "must not be negative")
+	check(co.ShardReplicas > 0 && !co.ActiveActive, "shard-replicas", "requires active-active")
+	check(co.StaleAfter < 0, "coordinator-stale-after", "must not be negative")
+	check(co.FeedFallback < 0, "config-feed-fallback", "must not be negative")
+	check(c.ObserveOnly && co.FeedListen != "", "observe-only", "can't be used with config-feed-listen, which would feed realservers from a candidate")
+	check(c.DryRun && co.FeedListen != "", "dry-run", "can't be used with config-feed-listen, which would feed realservers from a rehearsal")
+
+	check(c.Watchdog.Deadline < 0, "watchdog-deadline", "must not be negative")
+	check(c.Watchdog.Restart && c.Watchdog.Deadline == 0, "watchdog-restart", "requires watchdog-deadline")
+	check(c.SelfHealth.Interval < 0, "self-health-interval", "must not be negative")
+	check(c.SelfHealth.Threshold < 1, "self-health-threshold", "must be at least 1")
+
+	check(c.Probe.Interval < 0, "probe-interval", "must not be negative")
+	if c.Probe.Interval > 0 {
+		check(c.Probe.Timeout <= 0 || c.Probe.Timeout > c.Probe.Interval, "probe-timeout", "must be positive and no longer than probe-interval")
+		check(!strings.HasPrefix(c.Probe.HTTPPath, "/"), "probe-http-path", "must start with /")
+	}
+	if len(c.Canary.VIPs) > 0 {
+		check(c.Probe.Interval == 0, "canary-vips", "requires probe-interval")
+		check(c.Canary.Soak <= 0, "canary-soak", "must be positive")
+		for _, vip := range c.Canary.VIPs {
+			check(net.ParseIP(vip) == nil, "canary-vips", "must be ip addresses, not %q", vip)
+		}
+	}
+
+	check(c.VRRP.ID < 0 || c.VRRP.ID > 255, "vrrp-id", "must be between 0 and 255")
+	if c.VRRP.ID > 0 {
+		check(c.VRRP.Priority < 1 || c.VRRP.Priority > 255, "vrrp-priority", "must be between 1 and 255")
+		if err := c.VRRP.Settings(net.ParseIP(c.Net.PrimaryIP)).Validate(); err != nil {
+			check(true, "vrrp-id", "invalid vrrp settings. %v", err)
+		}
+		check(c.VRRP.FenceTTL != 0 && c.VRRP.FenceTTL < 3*time.Second, "vrrp-fence-ttl", "must be 0 or at least 3s")
+	} else {
+		check(c.VRRP.IPVSSync, "ipvs-sync", "requires vrrp-id")
+	}
+	check(c.ObserveOnly && (c.VRRP.ID > 0 || co.ActiveActive), "observe-only", "can't be used with vrrp-id or active-active, which would have it take part in electing the directors")
+	check(c.DryRun && (c.VRRP.ID > 0 || co.ActiveActive), "dry-run", "can't be used with vrrp-id or active-active, which would have it take part in electing the directors")
+
+	switch c.OnExit {
+	case types.OnExitPreserve, types.OnExitWithdraw, types.OnExitFullTeardown:
+	default:
+		check(true, "on-exit", "must be one of preserve|withdraw|full-teardown")
+	}
+	check(c.ReloadInterval < 0, "config-reload-interval", "must not be negative")
+	check(c.ForcedReconfigureInterval <= 0, "forced-reconfigure-interval", "must be positive")
+
+	switch c.Auto.Mode {
+	case "", role.Director, role.BGP, role.Colocated, role.Realserver, role.Candidate:
+	default:
+		check(true, "mode", "must be one of director|bgp|colocated|realserver|candidate")
+	}
+	check(c.Auto.Directors < 1, "auto-directors", "must be at least 1")
+	if r := c.Auto.DirectorRole; r != role.Director && r != role.BGP && r != role.Colocated {
+		check(true, "auto-director-role", "must be one of director|bgp|colocated")
+	}
+	check(c.Auto.SlotTTL < 3*time.Second, "auto-slot-ttl", "must be at least 3s")
+	check(c.Auto.Interval < time.Second, "auto-interval", "must be at least 1s")
+
+	check(c.HAProxy.Proxy != haproxy.ProxyHAProxy && c.HAProxy.Proxy != haproxy.ProxyNative, "v6-proxy", "must be one of haproxy|native")
+	check(c.HAProxy.Pools < 0, "haproxy-pools", "must not be negative")
+	check(c.HAProxy.AccessLogSample < 1, "haproxy-access-log-sample", "must be at least 1")
+
+	check(c.Stats.TopTalkers < 0, "stats-top-talkers", "must not be negative")
+	if fe := c.Stats.FlowExport; fe.Protocol != "" {
+		check(fe.Protocol != flowexport.ProtocolIPFIX && fe.Protocol != flowexport.ProtocolSFlow, "flow-export", "must be one of ipfix|sflow")
+		check(!c.Stats.Enabled, "flow-export", "requires stats-enabled")
+		check(fe.Collector == "", "flow-collector", "must be set when flow-export is set")
+		check(fe.SampleRate < 1, "flow-sample-rate", "must be at least 1")
+		check(fe.Interval <= 0, "flow-export-interval", "must be positive")
+	}
+	if rw := c.Stats.RemoteWrite; rw.URL != "" {
+		if err := rw.Settings().Validate(); err != nil {
+			check(true, "remote-write-url", "%v", err)
+		}
+		check(rw.BearerTokenFile != "" && (rw.Username != "" || rw.PasswordFile != ""), "remote-write-bearer-token-file", "can't be set with remote-write-username or remote-write-password-file")
+	}
+
+	// the settings that only some modes support
+	switch mode {
+	case role.Director:
+		check(co.ActiveActive, "active-active", "requires the bgp director. directors can't share VIPs announced over arp")
+	case role.Colocated:
+		check(c.ObserveOnly, "observe-only", "is only supported by the director and the bgp director")
+		check(c.IPVS.ColocationMode != "iptables" && c.IPVS.ColocationMode != "ipvs", "ipvs-colocation-mode", "must be iptables or ipvs in colocated mode, not %q", c.IPVS.ColocationMode)
+		check(co.ActiveActive, "active-active", "requires the bgp director. directors can't share VIPs announced over arp")
+	case role.Realserver:
+		check(c.ObserveOnly, "observe-only", "is only supported by the director and the bgp director")
+	}
+	// a haproxy master reloads its config itself, without the helper
+	// checking it
+	if (mode == role.Colocated || mode == role.Realserver) && c.PrivilegedHelper != "" {
+		check(c.HAProxy.MasterWorker, "haproxy-master-worker", "can't be used with privileged-helper. set it to false")
+		check(c.HAProxy.Pools > 0, "haproxy-pools", "can't be used with privileged-helper, as pools run in master-worker mode")
+	}
+
+	if len(p) > 0 {
+		return p
+	}
+	return nil
+}
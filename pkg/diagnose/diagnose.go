@@ -0,0 +1,171 @@
+package diagnose
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A support bundle is a gzipped tarball of what ravel and the node show
+// about an incident: the state of the running process from its admin
+// endpoint, its metrics and goroutines, the ipvs, address, route and
+// iptables state of the node, the bgp RIB, and recent logs. Each item is
+// collected on its own, so one that fails is noted in the manifest rather
+// than failing the bundle, and every item is redacted before it is written.
+
+// itemTimeout bounds the collection of each item.
+const itemTimeout = 30 * time.Second
+
+// Item is a file of the bundle.
+type Item struct {
+	// Name is the path of the file in the bundle.
+	Name    string
+	Collect func(ctx context.Context) ([]byte, error)
+}
+
+// Command is an item holding the output of a command on the node.
+func Command(name string, command string, args ...string) Item {
+	return Item{
+		Name: name,
+		Collect: func(ctx context.Context) ([]byte, error) {
+			out, err := exec.CommandContext(ctx, command, args...).CombinedOutput()
+			if err != nil {
+				return out, fmt.Errorf("%s: %v", strings.Join(append([]string{command}, args...), " "), err)
+			}
+			return out, nil
+		},
+	}
+}
+
+// Bytes is an item holding b.
+func Bytes(name string, b []byte) Item {
+	return Item{
+		Name:    name,
+		Collect: func(context.Context) ([]byte, error) { return b, nil },
+	}
+}
+
+// Entry is what the manifest says of an item.
+type Entry struct {
+	Name     string        `json:"name"`
+	Size     int           `json:"size"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Manifest lists the items of a bundle, and the errors collecting them.
+type Manifest struct {
+	Created time.Time `json:"created"`
+	Items   []Entry   `json:"items"`
+}
+
+// Failed returns the entries of the items that couldn't be collected.
+func (m Manifest) Failed() []Entry {
+	failed := []Entry{}
+	for _, e := range m.Items {
+		if e.Error != "" {
+			failed = append(failed, e)
+		}
+	}
+	return failed
+}
+
+// Write collects each of items in turn, redacts it with r, and writes it to
+// w as a gzipped tarball under dir, with manifest.json last. What an item
+// that fails returns is still written.
+func Write(ctx context.Context, w io.Writer, dir string, items []Item, r *Redactor) (Manifest, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifest := Manifest{Created: time.Now().UTC(), Items: make([]Entry, 0, len(items))}
+
+	for _, item := range items {
+		itemCtx, cancel := context.WithTimeout(ctx, itemTimeout)
+		start := time.Now()
+		b, err := item.Collect(itemCtx)
+		cancel()
+
+		b = r.Redact(b)
+		e := Entry{Name: item.Name, Size: len(b), Duration: time.Since(start)}
+		if err != nil {
+			e.Error = string(r.Redact([]byte(err.Error())))
+		}
+		manifest.Items = append(manifest.Items, e)
+		if err := writeFile(tw, dir+"/"+item.Name, b, manifest.Created); err != nil {
+			return manifest, err
+		}
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	if err := writeFile(tw, dir+"/manifest.json", append(b, '\n'), manifest.Created); err != nil {
+		return manifest, err
+	}
+	if err := tw.Close(); err != nil {
+		return manifest, err
+	}
+	return manifest, gz.Close()
+}
+
+func writeFile(tw *tar.Writer, name string, b []byte, modified time.Time) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: modified,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(b)
+	return err
+}
+
+// redacted replaces each secret in a bundle.
+const redacted = "REDACTED"
+
+// patterns match secrets by their shape. The first group of each is kept.
+var patterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(authorization:\s*(?:bearer|basic)\s+)\S+`),
+	regexp.MustCompile(`(?i)((?:password|passwd|secret|token|api[-_]?key)["']?\s*[:=]\s*["']?)[^\s"',}]+`),
+	regexp.MustCompile(`(?s)(-----BEGIN [A-Z ]*PRIVATE KEY-----).*?-----END [A-Z ]*PRIVATE KEY-----`),
+}
+
+// Redactor removes secrets from what goes in a bundle: the values of
+// anything named like a password, token or key, bearer and basic
+// credentials, private keys, and the secrets it is given.
+type Redactor struct {
+	secrets [][]byte
+}
+
+// NewRedactor returns a redactor that also removes each of secrets, such as
+// the contents of a token file. Empty secrets are ignored.
+func NewRedactor(secrets ...string) *Redactor {
+	r := &Redactor{}
+	for _, s := range secrets {
+		if s = strings.TrimSpace(s); s != "" {
+			r.secrets = append(r.secrets, []byte(s))
+		}
+	}
+	return r
+}
+
+// Redact returns b with its secrets replaced.
+func (r *Redactor) Redact(b []byte) []byte {
+	for _, s := range r.secrets {
+		b = bytes.Replace(b, s, []byte(redacted), -1)
+	}
+	for _, p := range patterns {
+		b = p.ReplaceAll(b, []byte("${1}"+redacted))
+	}
+	return b
+}
@@ -0,0 +1,133 @@
+package diagnose
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// paths read by DetectEnvironment, replaced in tests.
+var (
+	sysModuleDir = "/sys/module"
+	osRelease    = "/proc/sys/kernel/osrelease"
+)
+
+// commandTimeout bounds each command DetectEnvironment runs.
+const commandTimeout = 5 * time.Second
+
+// ipvsSchedulers are the ip_vs modules that are schedulers, rather than
+// protocol helpers such as ip_vs_ftp.
+var ipvsSchedulers = map[string]bool{
+	"rr": true, "wrr": true, "lc": true, "wlc": true, "fo": true, "ovf": true, "lblc": true, "lblcr": true,
+	"dh": true, "sh": true, "mh": true, "sed": true, "nq": true, "twos": true,
+}
+
+// Environment is the fingerprint of the node that ravel runs on, for bug
+// reports: what its kernel and tools are, and which of ravel's features are
+// turned on. What couldn't be found out is left blank, with the reason in
+// Errors.
+type Environment struct {
+	Kernel string `json:"kernel"`
+	// IPVSSchedulers are the ip_vs scheduler modules loaded or built in,
+	// such as wrr and mh
+	IPVSSchedulers []string `json:"ipvsSchedulers"`
+	// IPTablesMode is legacy or nf_tables, from IPTables, the version line
+	// of iptables
+	IPTablesMode string `json:"iptablesMode"`
+	IPTables     string `json:"iptables"`
+	GoBGPD       string `json:"gobgpd"`
+	HAProxy      string `json:"haproxy"`
+	// Features are the optional features of ravel its settings turn on
+	Features []string          `json:"features"`
+	Errors   map[string]string `json:"errors,omitempty"`
+}
+
+// Binaries are the paths of the tools whose versions are detected.
+type Binaries struct {
+	IPTables string
+	GoBGPD   string
+	HAProxy  string
+}
+
+var (
+	iptablesMode   = regexp.MustCompile(`\((legacy|nf_tables)\)`)
+	haproxyVersion = regexp.MustCompile(`(?i)haproxy version (\S+)`)
+	gobgpdVersion  = regexp.MustCompile(`version (\S+)`)
+)
+
+// DetectEnvironment fingerprints the node, running the tools of b for their
+// versions, and records features as the features that are turned on.
+func DetectEnvironment(ctx context.Context, b Binaries, features []string) Environment {
+	env := Environment{IPVSSchedulers: []string{}, Features: features, Errors: map[string]string{}}
+	if env.Features == nil {
+		env.Features = []string{}
+	}
+
+	if release, err := ioutil.ReadFile(osRelease); err != nil {
+		env.Errors["kernel"] = err.Error()
+	} else {
+		env.Kernel = strings.TrimSpace(string(release))
+	}
+
+	if modules, err := ioutil.ReadDir(sysModuleDir); err != nil {
+		env.Errors["ipvsSchedulers"] = err.Error()
+	} else {
+		for _, m := range modules {
+			if name := strings.TrimPrefix(m.Name(), "ip_vs_"); name != m.Name() && ipvsSchedulers[name] {
+				env.IPVSSchedulers = append(env.IPVSSchedulers, name)
+			}
+		}
+		sort.Strings(env.IPVSSchedulers)
+	}
+
+	if out, err := firstLine(ctx, b.IPTables, "--version"); err != nil {
+		env.Errors["iptables"] = err.Error()
+	} else {
+		env.IPTables = out
+		// iptables before 1.8 is always legacy, and doesn't say so
+		env.IPTablesMode = "legacy"
+		if m := iptablesMode.FindStringSubmatch(out); m != nil {
+			env.IPTablesMode = m[1]
+		}
+	}
+
+	if out, err := firstLine(ctx, b.GoBGPD, "--version"); err != nil {
+		env.Errors["gobgpd"] = err.Error()
+	} else if m := gobgpdVersion.FindStringSubmatch(out); m != nil {
+		env.GoBGPD = m[1]
+	} else {
+		env.GoBGPD = out
+	}
+
+	if out, err := firstLine(ctx, b.HAProxy, "-v"); err != nil {
+		env.Errors["haproxy"] = err.Error()
+	} else if m := haproxyVersion.FindStringSubmatch(out); m != nil {
+		env.HAProxy = m[1]
+	} else {
+		env.HAProxy = out
+	}
+
+	if len(env.Errors) == 0 {
+		env.Errors = nil
+	}
+	return env
+}
+
+// firstLine runs command with args and returns the first line of its output.
+func firstLine(ctx context.Context, command string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, command, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v", command, strings.Join(args, " "), err)
+	}
+	s := bufio.NewScanner(strings.NewReader(string(out)))
+	s.Scan()
+	return strings.TrimSpace(s.Text()), nil
+}
@@ -3,17 +3,25 @@ package director
 import (
 	"context"
 	"fmt"
+	"github.com/Comcast/Ravel/pkg/audit"
 	"github.com/Comcast/Ravel/pkg/bgp"
+	log "github.com/Comcast/Ravel/pkg/logging"
 	"io/ioutil"
 	"sync"
 	"time"
 
+	"github.com/Comcast/Ravel/pkg/colocation"
+	"github.com/Comcast/Ravel/pkg/health"
 	"github.com/Comcast/Ravel/pkg/iptables"
 	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/supervisor"
 	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/tracing"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/vrrp"
+	"github.com/Comcast/Ravel/pkg/watchdog"
 	"github.com/Comcast/Ravel/pkg/watcher"
-	"github.com/sirupsen/logrus"
-	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	corev1 "k8s.io/api/core/v1"
 )
 
@@ -28,7 +36,28 @@ const (
 // A director is the control flow for kube2ipvs. It can only be started once, and it can only be stopped once.
 type Director interface {
 	Start() error
-	Stop() error
+	// Shutdown stops the director as the process exits, within the
+	// deadline of ctx, and withdraws and tears down per on-exit
+	Shutdown(ctx context.Context) error
+	Health(context.Context) health.Status
+	// OnApplied sets a function called with the generation and hash of
+	// each cluster config the director applies. It must be set before
+	// Start.
+	OnApplied(func(generation uint64, configHash string))
+	// OnReconciled sets a function called with the outcome of each
+	// reconfigure, applied or not. It must be set before Start.
+	OnReconciled(func(err error))
+	// Maintenance takes the director out of service while active: a vrrp
+	// director is held backup, and any other withdraws its VIPs
+	Maintenance(active bool)
+	// Pause stops the director applying configs on its own while paused.
+	// Maintenance and vrrp changes still apply.
+	Pause(paused bool)
+	// Reconfigure applies the current config now, paused or not
+	Reconfigure()
+	// SetForcedReconfigureInterval changes how often the config is applied
+	// without checking parity
+	SetForcedReconfigureInterval(interval time.Duration)
 }
 
 type director struct {
@@ -46,12 +75,17 @@ type director struct {
 	// config   *types.ClusterConfig
 
 	// inbound data sources
-	nodeChan chan []*corev1.Node
+	nodeChan        chan []*corev1.Node
+	nodeChanMetrics *stats.ChannelMetrics
 	// configChan chan *types.ClusterConfig
 	ctxWatch context.Context
 	cxlWatch context.CancelFunc
 
 	reconfiguring bool
+	reconcile     health.Reconcile
+	// lastAppliedConfig is the cluster config of the last reconfigure, to
+	// give the changes since in the audit reason of the next
+	lastAppliedConfig *types.ClusterConfig
 	// lastInboundUpdate time.Time
 	// lastReconfigure time.Time
 
@@ -59,35 +93,68 @@ type director struct {
 	ipvs     *system.IPVS
 	ip       *system.IP
 	iptables *iptables.IPTables
-
-	// cli flag default false
-	doCleanup         bool
+	// vrrp decides whether this director holds the VIPs. without it, the
+	// director always does.
+	vrrp *vrrp.Router
+	// arbiter hands the VIPs and iptables chain between the director and
+	// the realserver of a colocated process. without it, the director owns
+	// them.
+	arbiter *colocation.Arbiter
+	// applied is told of each config applied, to push to the realserver
+	// of the node
+	applied func(generation uint64, configHash string)
+	// reconciled is told of the outcome of each reconfigure, for the
+	// realserver of the node to judge the director's health by
+	reconciled func(err error)
+	// maintenance keeps the director from holding the VIPs, and
+	// maintenanceChan wakes periodic when it changes
+	maintenance     bool
+	maintenanceChan chan struct{}
+	// paused skips the periodic reconfigures, and reconfigureChan asks
+	// periodic for one
+	paused          bool
+	reconfigureChan chan struct{}
+	// forcedInterval is how often periodic applies the config without
+	// checking parity, and intervalChan hands it a new one
+	forcedInterval time.Duration
+	intervalChan   chan time.Duration
+
+	// what Shutdown leaves on the node, one of the types.OnExit policies
+	onExit            string
 	colocationMode    string
 	forcedReconfigure bool
 	// ipvsWeightOverride bool
 
 	// boilerplate.  when this context is canceled, the director must cease all activties
 	ctx     context.Context
-	logger  logrus.FieldLogger
+	logger  log.Logger
 	metrics *stats.WorkerStateMetrics
 }
 
-func NewDirector(ctx context.Context, nodeName, configKey string, cleanup bool, watcher *watcher.Watcher, ipvs *system.IPVS, ip *system.IP, ipt *iptables.IPTables, colocationMode string, forcedReconfigure bool) (Director, error) {
+func NewDirector(ctx context.Context, nodeName, configKey string, onExit string, watcher *watcher.Watcher, ipvs *system.IPVS, ip *system.IP, ipt *iptables.IPTables, colocationMode string, forcedReconfigure bool, router *vrrp.Router, arbiter *colocation.Arbiter) (Director, error) {
 	d := &director{
 		watcher:  watcher,
 		ipvs:     ipvs,
 		ip:       ip,
+		vrrp:     router,
+		arbiter:  arbiter,
 		nodeName: nodeName,
 
 		iptables: ipt,
 
-		doneChan: make(chan struct{}),
-		nodeChan: make(chan []*corev1.Node, 1),
+		doneChan:        make(chan struct{}),
+		nodeChan:        make(chan []*corev1.Node, 1),
+		maintenanceChan: make(chan struct{}, 1),
+		reconfigureChan: make(chan struct{}, 1),
+		intervalChan:    make(chan time.Duration, 1),
+		forcedInterval:  time.Second * 60,
+
+		nodeChanMetrics: stats.NewChannelMetrics(stats.KindIpvsMaster, stats.ChannelNodes),
 		// configChan: make(chan *types.ClusterConfig, 1),
 
-		doCleanup:         cleanup,
+		onExit:            onExit,
 		ctx:               ctx,
-		logger:            logrus.StandardLogger(),
+		logger:            log.Default(),
 		metrics:           stats.NewWorkerStateMetrics(stats.KindIpvsMaster, configKey),
 		colocationMode:    colocationMode,
 		forcedReconfigure: forcedReconfigure,
@@ -126,6 +193,14 @@ func (d *director) Start() error {
 	// If director is co-located with a realserver, the realserver
 	// will deal with setting up new iptables rules
 
+	// without vrrp, a colocated director always holds the VIPs, and the
+	// realserver never runs
+	if d.arbiter != nil && d.vrrp == nil {
+		if err := d.arbiter.Acquire(); err != nil {
+			return err
+		}
+	}
+
 	// instantitate a watcher and load this watcher instance into self
 	ctxWatch, cxlWatch := context.WithCancel(d.ctx)
 	d.ctxWatch = ctxWatch
@@ -135,14 +210,15 @@ func (d *director) Start() error {
 	// d.watcher.Nodes(ctxWatch, "director-nodes", d.nodeChan)
 	// d.watcher.ConfigMap(ctxWatch, "director-configmap", d.configChan)
 
-	// perform periodic configuration activities
-	go d.periodic()
-	go d.watches()
-	go d.arps()
+	// perform periodic configuration activities, restarting any loop that
+	// panics
+	supervisor.Go(ctxWatch, stats.KindIpvsMaster, "director.periodic", d.logger, d.periodic)
+	supervisor.Go(ctxWatch, stats.KindIpvsMaster, "director.watches", d.logger, d.watches)
+	supervisor.Go(ctxWatch, stats.KindIpvsMaster, "director.arps", d.logger, d.arps)
 
 	// notify d.nodeChan and d.configChan like registering watchers
 	// with the watcher.Watcher used to do
-	go d.causePeriodicWatcherSync()
+	supervisor.Go(ctxWatch, stats.KindIpvsMaster, "director.watcherSync", d.logger, d.causePeriodicWatcherSync)
 
 	d.logger.Debugf("director: setup complete. director is running")
 	return nil
@@ -156,7 +232,14 @@ func (d *director) causePeriodicWatcherSync() {
 	defer t.Stop()
 	for {
 		log.Debugln("director: causePeriodicWatcherSync: sending", len(d.watcher.Nodes), "to d.nodeChan")
-		d.nodeChan <- d.watcher.Nodes
+		select {
+		case d.nodeChan <- d.watcher.Nodes:
+		default:
+			sendStart := time.Now()
+			d.nodeChan <- d.watcher.Nodes
+			d.nodeChanMetrics.Blocked(time.Since(sendStart))
+		}
+		d.nodeChanMetrics.Occupancy(len(d.nodeChan))
 		<-t.C
 		// log.Debugln("director: causePeriodicWatcherSync: sending", len(d.watcher.ClusterConfig.Config), "to d.configChan")
 		// // d.configChan <- d.watcher.ClusterConfig
@@ -164,6 +247,15 @@ func (d *director) causePeriodicWatcherSync() {
 	}
 }
 
+// withdraw removes the VIP addresses from the primary interface, so that the
+// node stops answering for them, and leaves the ipvs rules in place.
+func (d *director) withdraw(ctx context.Context) error {
+	if err := d.ip.Release(ctx); err != nil {
+		return fmt.Errorf("director: withdraw - failed to remove ip addresses - %v", err)
+	}
+	return nil
+}
+
 // cleanup sets the initial state of the ipvs director by removing any KUBE-IPVS rules
 // from the service chain and by clearing any arp rules that were set by a realserver
 // on the same node.
@@ -175,7 +267,7 @@ func (d *director) cleanup(ctx context.Context) error {
 		errs = append(errs, fmt.Sprintf("cleanup - failed to flush iptables - %v", err))
 	}
 
-	if err := d.ip.Teardown(ctx, d.watcher.ClusterConfig.Config, d.watcher.ClusterConfig.Config6); err != nil {
+	if err := d.ip.Release(ctx); err != nil {
 		errs = append(errs, fmt.Sprintf("cleanup - failed to remove ip addresses - %v", err))
 	}
 
@@ -189,33 +281,47 @@ func (d *director) cleanup(ctx context.Context) error {
 	return fmt.Errorf("director: %v", errs)
 }
 
-func (d *director) Stop() error {
+func (d *director) Shutdown(ctx context.Context) error {
 	if d.reconfiguring {
-		return fmt.Errorf("director: unable to Stop. reconfiguration already in progress")
+		return fmt.Errorf("director: unable to Shutdown. reconfiguration already in progress")
 	}
 	d.setReconfiguring(true)
 	defer func() { d.setReconfiguring(false) }()
 
-	// kill the watcher
+	// kill the watcher, so that no new config is applied
 	d.cxlWatch()
 	d.logger.Info("director: blocking until periodic tasks complete")
+	draining, cxlDraining := types.Draining(ctx)
 	select {
 	case <-d.doneChan:
-	case <-time.After(5000 * time.Millisecond):
+	case <-draining.Done():
+		d.logger.Warn("director: periodic tasks still running at the end of the grace period. tearing down anyway")
 	}
+	cxlDraining()
 
 	// remove config VIP addresses from the compute interface
-	ctxDestroy, cxl := context.WithTimeout(context.Background(), 5000*time.Millisecond)
+	ctxDestroy, cxl := context.WithTimeout(ctx, types.TeardownTimeout)
 	defer cxl()
 
-	if d.doCleanup {
-		err := d.cleanup(ctxDestroy)
+	// a colocated director leaves a node the realserver owns to it
+	if d.arbiter != nil && !d.arbiter.Director() {
 		d.isStarted = false
-		return err
+		return nil
 	}
 
+	var err error
+	switch d.onExit {
+	case types.OnExitWithdraw:
+		d.logger.Info("director: withdrawing the VIPs on exit")
+		err = d.withdraw(ctxDestroy)
+	case types.OnExitFullTeardown:
+		d.logger.Info("director: tearing the node down on exit")
+		err = d.cleanup(ctxDestroy)
+	default:
+		d.logger.Info("director: leaving the VIPs and ipvs rules in place on exit")
+	}
 	d.isStarted = false
-	return nil
+	return err
 }
 
 func (d *director) Err() error {
@@ -227,7 +333,11 @@ func (d *director) watches() {
 	// XXX It also needs to get all of the endpoints
 	// XXX this thing needs a nonblocking, continuous read on the nodes channel and a
 	// way to quiesce reads from this channel into actual behaviors in the app...
+	beat := watchdog.Register("director.watches")
+	defer beat.Done()
+
 	for {
+		beat.Beat()
 		select {
 
 		case nodes := <-d.nodeChan:
@@ -281,6 +391,9 @@ func (d *director) arps() {
 		case <-gratuitousArp.C:
 			// every five minutes or so, walk the whole set of VIPs and make the call to
 			// gratuitous arp.
+			if !d.holdsVIPs() {
+				continue
+			}
 			if d.watcher.ClusterConfig == nil || d.watcher.Nodes == nil {
 				d.logger.Debugf("director: configs are nil. skipping arp clear")
 				continue
@@ -314,15 +427,57 @@ func (d *director) periodic() {
 	t := time.NewTicker(checkInterval)
 	d.logger.Infof("director: starting periodic ticker. config check %v", checkInterval)
 
-	forcedReconfigureInterval := time.Second * 60
-	forceReconfigure := time.NewTicker(forcedReconfigureInterval)
+	forceReconfigure := time.NewTicker(d.forcedInterval)
 
 	defer t.Stop()
 	defer forceReconfigure.Stop()
 
+	beat := watchdog.Register("director.periodic")
+	defer beat.Done()
+
+	// a nil channel, and never ready, without vrrp
+	var roles <-chan bool
+	if d.vrrp != nil {
+		roles = d.vrrp.Changes()
+	}
+
 	for {
+		beat.Beat()
 		select {
+		case master := <-roles:
+			if master {
+				d.logger.Info("director: became vrrp master. taking the VIPs")
+			} else {
+				d.logger.Info("director: no longer vrrp master. releasing the VIPs")
+			}
+			d.follow(master)
+
+		case <-d.maintenanceChan:
+			if d.inMaintenance() {
+				d.logger.Info("director: in maintenance. withdrawing the VIPs")
+			} else {
+				d.logger.Info("director: out of maintenance. taking the VIPs")
+			}
+			if d.watcher.ClusterConfig != nil && d.watcher.Nodes != nil {
+				d.reconfigure(true)
+			}
+
+		case interval := <-d.intervalChan:
+			d.logger.Infof("director: forced reconfigure interval is now %v", interval)
+			forceReconfigure.Reset(interval)
+
+		case <-d.reconfigureChan:
+			if d.watcher.ClusterConfig == nil || d.watcher.Nodes == nil {
+				d.logger.Warn("director: reconfigure requested before a config and nodes were seen. skipping")
+				continue
+			}
+			d.logger.Info("director: reconfigure requested")
+			d.reconfigure(true)
+
 		case <-forceReconfigure.C:
+			if d.isPaused() {
+				continue
+			}
 			if d.watcher.ClusterConfig.Config == nil {
 				log.Warningln("director: Force reconfiguration skipped because d.config is nil")
 				continue
@@ -344,6 +499,9 @@ func (d *director) periodic() {
 
 			// d.metrics.QueueDepth(len(d.configChan))
 
+			if d.isPaused() {
+				continue
+			}
 			if d.watcher.ClusterConfig.Config == nil {
 				d.logger.Debugf("director: configs are nil. skipping apply")
 				continue
@@ -353,6 +511,11 @@ func (d *director) periodic() {
 				continue
 			}
 
+			// retry a colocated realserver that failed to start
+			if d.arbiter != nil && d.vrrp != nil && d.arbiter.Owner() == colocation.OwnerNone && !d.vrrp.Master() {
+				d.arbiter.Release(nil)
+			}
+
 			d.reconfigure(false)
 
 		case <-d.ctx.Done():
@@ -366,18 +529,131 @@ func (d *director) periodic() {
 	}
 }
 
+// follow reconfigures the director for a change of vrrp role. A colocated
+// director takes the node from the realserver before it takes the VIPs, and
+// only hands it back once it has withdrawn them.
+func (d *director) follow(master bool) {
+	configured := d.watcher.ClusterConfig != nil && d.watcher.Nodes != nil
+	if d.arbiter == nil {
+		if configured {
+			d.reconfigure(true)
+		}
+		return
+	}
+	if master {
+		// the director takes the node over even if the realserver failed
+		// to clean up, and the arbiter reports that
+		d.arbiter.Acquire()
+		if configured {
+			d.reconfigure(true)
+		}
+		return
+	}
+	d.arbiter.Release(func() {
+		if configured {
+			d.reconfigure(true)
+		}
+	})
+}
+
 func (d *director) reconfigure(force bool) {
 	start := time.Now()
-	d.logger.Infof("director: reconfiguring")
-	if err := d.applyConf(force); err != nil {
+	id := d.watcher.CorrelationID()
+	d.logger.WithField("correlation_id", id).Infof("director: reconfiguring")
+	ctx, span := tracing.StartLinked(d.ctx, "director.reconfigure", d.watcher.PublishSpanContext(), attribute.Bool("force", force), attribute.String("ravel.correlation_id", id))
+	generation, published := d.watcher.Published()
+	hash := d.watcher.ConfigHash()
+	d.metrics.ConfigSeen(generation, published)
+	reason := "director reconfigure: parity check"
+	if force {
+		reason = "director reconfigure: forced"
+	}
+	reason, d.lastAppliedConfig = d.watcher.Reason(reason, d.lastAppliedConfig)
+	audit.SetCause(reason, d.watcher.ConfigHash(), id)
+	err := d.applyConf(ctx, force)
+	tracing.End(span, err)
+	d.reconcile.Record(err)
+	if d.reconciled != nil {
+		d.reconciled(err)
+	}
+	if err != nil {
 		d.logger.Errorf("error applying configuration in director. %v", err)
 		return
 	}
 	d.logger.Infof("director: reconfiguration completed successfully in %v", time.Since(start))
 	// d.lastReconfigure = start
+	if d.applied != nil {
+		d.applied(generation, hash)
+	}
+}
+
+func (d *director) OnApplied(applied func(generation uint64, configHash string)) {
+	d.applied = applied
+}
+
+func (d *director) OnReconciled(reconciled func(err error)) {
+	d.reconciled = reconciled
+}
+
+// Maintenance takes the director out of service while active. A vrrp
+// director is held backup, so that another takes the VIPs, and follows the
+// change of role as usual. Any other withdraws its VIPs, and takes them back
+// once maintenance is cleared.
+func (d *director) Maintenance(active bool) {
+	d.Lock()
+	d.maintenance = active
+	d.Unlock()
+	if d.vrrp != nil {
+		d.vrrp.Hold(active)
+		return
+	}
+	select {
+	case d.maintenanceChan <- struct{}{}:
+	default:
+	}
+}
+
+func (d *director) Pause(paused bool) {
+	d.Lock()
+	d.paused = paused
+	d.Unlock()
+}
+
+func (d *director) isPaused() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.paused
 }
 
-func (d *director) applyConf(force bool) error {
+func (d *director) SetForcedReconfigureInterval(interval time.Duration) {
+	// only the latest interval matters
+	select {
+	case <-d.intervalChan:
+	default:
+	}
+	d.intervalChan <- interval
+}
+
+func (d *director) Reconfigure() {
+	select {
+	case d.reconfigureChan <- struct{}{}:
+	default:
+	}
+}
+
+// inMaintenance reports whether the director is out of service.
+func (d *director) inMaintenance() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.maintenance
+}
+
+// Health reports the outcome of the most recent reconfigure.
+func (d *director) Health(ctx context.Context) health.Status {
+	return d.reconcile.Status(ctx)
+}
+
+func (d *director) applyConf(ctx context.Context, force bool) error {
 	// TODO: this thing could have gotten a new copy of nodes by the
 	// time it did its thing. need to lock in the caller, capture
 	// the current time, deepcopy the nodes/config, and pass them into this.
@@ -388,6 +664,8 @@ func (d *director) applyConf(force bool) error {
 	if force {
 		d.logger.Info("director: configuration parity ignored")
 	} else {
+		_, span := tracing.Start(ctx, "director.checkConfigParity")
+		parityStart := time.Now()
 		addressesV4, addressesV6, err := d.ip.Get()
 		if err != nil {
 			log.Errorln("director: error creating interface:", err)
@@ -396,14 +674,23 @@ func (d *director) applyConf(force bool) error {
 		// splice together to compare against the internal state of configs
 		// addresses is sorted within the CheckConfigParity function
 		addresses := append(addressesV4, addressesV6...)
+		if !d.holdsVIPs() && len(addressesV4) == 0 {
+			// a vrrp backup is right not to hold the VIPs, so only its
+			// ipvs rules count towards parity
+			addresses = append(d.vips(), addressesV6...)
+		}
 
 		same, err := d.ipvs.CheckConfigParity(d.watcher, d.watcher.ClusterConfig, addresses)
+		d.metrics.ReconfigurePhase(ctx, stats.PhaseParity, stats.FamilyAll, err, time.Since(parityStart))
+		span.SetAttributes(attribute.Bool("parity", same))
+		tracing.End(span, err)
 		if err != nil {
-			d.metrics.Reconfigure("error", time.Since(start))
+			d.metrics.Reconfigure(ctx, "error", time.Since(start))
 			return fmt.Errorf("director: unable to compare configurations with error %v", err)
 		}
+		d.reconcile.Parity(same)
 		if same {
-			d.metrics.Reconfigure("noop", time.Since(start))
+			d.metrics.Reconfigure(ctx, "noop", time.Since(start))
 			d.logger.Info("director: configuration has parity")
 			return nil
 		}
@@ -412,9 +699,13 @@ func (d *director) applyConf(force bool) error {
 	}
 
 	// Manage VIP addresses
+	_, span := tracing.Start(ctx, "director.setAddresses")
+	phaseStart := time.Now()
 	err := d.setAddresses()
+	d.metrics.ReconfigurePhase(ctx, stats.PhaseAddresses, stats.FamilyV4, err, time.Since(phaseStart))
+	tracing.End(span, err)
 	if err != nil {
-		d.metrics.Reconfigure("error", time.Since(start))
+		d.metrics.Reconfigure(ctx, "error", time.Since(start))
 		return fmt.Errorf("director: unable to configure VIP addresses with error %v", err)
 	}
 	d.logger.Debugf("director: addresses set")
@@ -422,25 +713,35 @@ func (d *director) applyConf(force bool) error {
 	// Manage iptables configuration
 	// only execute with cli flag ipvs-colocation-mode=true
 	// this indicates the director is in a non-isolated load balancer tier
-	if d.colocationMode == colocationModeIPTables {
+	// a colocated director leaves the chain to the realserver while it
+	// doesn't own the node
+	if d.colocationMode == colocationModeIPTables && (d.arbiter == nil || d.arbiter.Director()) {
+		_, span = tracing.Start(ctx, "director.setIPTables")
+		phaseStart = time.Now()
 		err = d.setIPTables()
+		d.metrics.ReconfigurePhase(ctx, stats.PhaseIPTables, stats.FamilyV4, err, time.Since(phaseStart))
+		tracing.End(span, err)
 		if err != nil {
-			d.metrics.Reconfigure("error", time.Since(start))
+			d.metrics.Reconfigure(ctx, "error", time.Since(start))
 			return fmt.Errorf("director: unable to configure iptables with error %v", err)
 		}
 		d.logger.Debugf("director: iptables configured")
 	}
 
 	// Manage ipvsadm configuration
+	_, span = tracing.Start(ctx, "director.setIPVS")
+	phaseStart = time.Now()
 	err = d.ipvs.SetIPVS(d.watcher, d.watcher.ClusterConfig, d.logger, bgp.AddrKindIPV4)
+	d.metrics.ReconfigurePhase(ctx, stats.PhaseIPVS, stats.FamilyV4, err, time.Since(phaseStart))
+	tracing.End(span, err)
 
 	if err != nil {
-		d.metrics.Reconfigure("error", time.Since(start))
+		d.metrics.Reconfigure(ctx, "error", time.Since(start))
 		return fmt.Errorf("director: unable to configure ipvs with error %v", err)
 	}
 	d.logger.Debugf("director: ipvs configured")
 
-	d.metrics.Reconfigure("complete", time.Since(start))
+	d.metrics.Reconfigure(ctx, "complete", time.Since(start))
 	return nil
 }
 
@@ -512,24 +813,24 @@ func (d *director) setAddresses() error {
 		return err
 	}
 
-	// get desired VIP addresses
+	// get desired VIP addresses. a vrrp backup wants none
 	desired := []string{}
-	for ip := range d.watcher.ClusterConfig.Config {
-		desired = append(desired, string(ip))
+	if d.holdsVIPs() {
+		desired = d.vips()
 	}
 
 	// XXX statsd
 	removals, additions := d.ip.Compare4(configuredV4, desired)
 
 	for _, addr := range removals {
-		d.logger.WithFields(logrus.Fields{"device": "primary", "addr": addr, "action": "deleting"}).Info()
+		d.logger.WithFields(log.Fields{"device": "primary", "addr": addr, "action": "deleting"}).Info()
 		err := d.ip.Del(addr)
 		if err != nil {
 			return err
 		}
 	}
 	for _, addr := range additions {
-		d.logger.WithFields(logrus.Fields{"device": "primary", "addr": addr, "action": "adding"}).Info()
+		d.logger.WithFields(log.Fields{"device": "primary", "addr": addr, "action": "adding"}).Info()
 		if err := d.ip.Add(addr); err != nil {
 			log.Errorln("director: error adding adapter:", addr, err)
 		}
@@ -538,6 +839,11 @@ func (d *director) setAddresses() error {
 		}
 	}
 
+	// a backup only gives up its claim on the VIPs once they are gone
+	if d.vrrp != nil && !d.holdsVIPs() {
+		d.vrrp.Withdrawn(d.ctx)
+	}
+
 	// now iterate across configured and see if we have a non-standard MTU
 	// setting it where applicable
 	err = d.ip.SetMTU(d.watcher.ClusterConfig.MTUConfig, false)
@@ -548,6 +854,27 @@ func (d *director) setAddresses() error {
 	return nil
 }
 
+// holdsVIPs reports whether the VIPs belong on this director's primary
+// interface.
+func (d *director) holdsVIPs() bool {
+	if d.inMaintenance() {
+		return false
+	}
+	if d.arbiter != nil {
+		return d.arbiter.Director()
+	}
+	return d.vrrp == nil || d.vrrp.Master()
+}
+
+// vips returns the VIPs of the config.
+func (d *director) vips() []string {
+	vips := []string{}
+	for ip := range d.watcher.ClusterConfig.Config {
+		vips = append(vips, string(ip))
+	}
+	return vips
+}
+
 func (d *director) setReconfiguring(v bool) {
 	d.Lock()
 	d.reconfiguring = v
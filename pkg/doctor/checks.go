@@ -0,0 +1,206 @@
+package doctor
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Comcast/Ravel/pkg/privsep"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// paths read by the checks, replaced in tests.
+var (
+	sysModuleDir = "/sys/module"
+	libModuleDir = "/lib/modules"
+	osRelease    = "/proc/sys/kernel/osrelease"
+	netClassDir  = "/sys/class/net"
+)
+
+// KernelModule checks that a module is loaded, built in, or available to be
+// loaded on demand.
+func KernelModule(name string, required bool) Check {
+	return Check{
+		Name:     "module " + name,
+		Required: required,
+		Run: func(context.Context) (string, error) {
+			if _, err := os.Stat(filepath.Join(sysModuleDir, name)); err == nil {
+				return "loaded", nil
+			}
+			release, err := ioutil.ReadFile(osRelease)
+			if err != nil {
+				return "", fmt.Errorf("not loaded, and unable to read kernel release: %v", err)
+			}
+			dir := filepath.Join(libModuleDir, strings.TrimSpace(string(release)))
+			if found, _ := listsModule(filepath.Join(dir, "modules.builtin"), name); found {
+				return "built in", nil
+			}
+			if found, _ := listsModule(filepath.Join(dir, "modules.dep"), name); found {
+				return "available", nil
+			}
+			return "", fmt.Errorf("not loaded and not found in %s", dir)
+		},
+		Fix: fmt.Sprintf("load it with modprobe %s on the node, or install the kernel's extra modules", name),
+	}
+}
+
+// listsModule reports whether a modules.builtin or modules.dep file lists the
+// module. Each line starts with its path, e.g. kernel/net/netfilter/ipvs/ip_vs.ko.
+func listsModule(file, name string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		path := strings.SplitN(s.Text(), ":", 2)[0]
+		base := filepath.Base(path)
+		if i := strings.Index(base, ".ko"); i >= 0 {
+			base = base[:i]
+		}
+		if strings.Replace(base, "-", "_", -1) == name {
+			return true, nil
+		}
+	}
+	return false, s.Err()
+}
+
+// Sysctl checks that a sysctl file can be opened for writing.
+func Sysctl(path string, required bool) Check {
+	return Check{
+		Name:     "sysctl " + path,
+		Required: required,
+		Run: func(context.Context) (string, error) {
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				return "", err
+			}
+			defer f.Close()
+			b := make([]byte, 64)
+			n, _ := f.Read(b)
+			return "writable, currently " + strings.TrimSpace(string(b[:n])), nil
+		},
+		Fix: "run privileged, with /proc/sys mounted read-write",
+	}
+}
+
+// Binary checks that an executable is on the path, or at the given path.
+func Binary(name string, required bool) Check {
+	return Check{
+		Name:     "binary " + name,
+		Required: required,
+		Run: func(context.Context) (string, error) {
+			return exec.LookPath(name)
+		},
+		Fix: fmt.Sprintf("install %s in the image, or put it on the PATH", name),
+	}
+}
+
+// PrivilegedHelper checks that the helper a mode changes the node through
+// accepts connections.
+func PrivilegedHelper(socket string) Check {
+	return Check{
+		Name:     "privileged helper " + socket,
+		Required: true,
+		Run: func(ctx context.Context) (string, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			if err != nil {
+				return "", err
+			}
+			conn.Close()
+			return "accepting connections", nil
+		},
+		Fix: "run `ravel helper` as root, with --uid set to the user ravel runs as and --socket to privileged-helper",
+	}
+}
+
+// Interface checks that a network interface exists and is up.
+func Interface(name string, required bool) Check {
+	return Check{
+		Name:     "interface " + name,
+		Required: required,
+		Run: func(context.Context) (string, error) {
+			b, err := ioutil.ReadFile(filepath.Join(netClassDir, name, "operstate"))
+			if os.IsNotExist(err) {
+				return "", fmt.Errorf("no such interface")
+			}
+			if err != nil {
+				return "", err
+			}
+			state := strings.TrimSpace(string(b))
+			// loopback and dummy devices report unknown
+			if state != "up" && state != "unknown" {
+				return "", fmt.Errorf("interface is %s", state)
+			}
+			return state, nil
+		},
+		Fix: "set compute-iface and compute-iface-local to interfaces of the node, and run in its host network",
+	}
+}
+
+// IPTablesBackend reports whether iptables is the legacy or nf_tables
+// variant. Ravel works with either, so long as every tool on the node agrees.
+func IPTablesBackend() Check {
+	return Check{
+		Name:     "iptables backend",
+		Required: true,
+		Run: func(ctx context.Context) (string, error) {
+			out, err := privsep.CommandContext(ctx, "iptables", "--version").CombinedOutput()
+			if err != nil {
+				return "", fmt.Errorf("iptables --version: %v", err)
+			}
+			return strings.TrimSpace(string(out)), nil
+		},
+		Fix: "install iptables in the image, of the same backend as the node's",
+	}
+}
+
+// GoBGP checks that gobgpd answers through the gobgp client.
+func GoBGP(path string, required bool) Check {
+	return Check{
+		Name:     "gobgpd",
+		Required: required,
+		Run: func(ctx context.Context) (string, error) {
+			out, err := exec.CommandContext(ctx, path, "neighbor").CombinedOutput()
+			if err != nil {
+				return "", fmt.Errorf("%s neighbor: %v: %s", path, err, strings.TrimSpace(string(out)))
+			}
+			return "reachable", nil
+		},
+		Fix: "start gobgpd alongside ravel",
+	}
+}
+
+// KubeAPI checks that the kubernetes API is reachable with the given
+// kubeconfig and allows reading the cluster config map.
+func KubeAPI(kubeconfig, namespace, name string) Check {
+	return Check{
+		Name:     "kubernetes api",
+		Required: true,
+		Run: func(ctx context.Context) (string, error) {
+			config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+			if err != nil {
+				return "", fmt.Errorf("error getting configuration from kubeconfig at %s. %v", kubeconfig, err)
+			}
+			clientset, err := kubernetes.NewForConfig(config)
+			if err != nil {
+				return "", err
+			}
+			if _, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{}); err != nil {
+				return "", fmt.Errorf("unable to read configmap %s/%s: %v", namespace, name, err)
+			}
+			return fmt.Sprintf("read configmap %s/%s from %s", namespace, name, config.Host), nil
+		},
+		Fix: fmt.Sprintf("check kubeconfig, and that its user may get configmaps in %s", namespace),
+	}
+}
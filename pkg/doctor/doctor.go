@@ -0,0 +1,121 @@
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The doctor runs a list of environment checks before ravel takes traffic,
+// and on demand through `ravel doctor`. A failed required check means the
+// node can't be configured correctly; a failed optional check is reported
+// but doesn't stop startup.
+
+// checkTimeout bounds each check.
+const checkTimeout = 10 * time.Second
+
+// Check verifies a single property of the environment.
+type Check struct {
+	Name     string
+	Required bool
+	// Run returns a short description of what it found, or an error.
+	Run func(ctx context.Context) (string, error)
+	// Fix says what to do when the check fails.
+	Fix string
+}
+
+// Result is the outcome of a single check.
+type Result struct {
+	Name     string        `json:"name"`
+	Required bool          `json:"required"`
+	Passed   bool          `json:"passed"`
+	Message  string        `json:"message,omitempty"`
+	Fix      string        `json:"fix,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Report is the outcome of a pass over a list of checks.
+type Report struct {
+	Passed  bool     `json:"passed"`
+	Results []Result `json:"results"`
+}
+
+// Run runs the checks in order. The report passes when every required check
+// passed.
+func Run(ctx context.Context, checks []Check) Report {
+	report := Report{Passed: true, Results: make([]Result, 0, len(checks))}
+	for _, c := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+		start := time.Now()
+		msg, err := c.Run(checkCtx)
+		cancel()
+
+		r := Result{
+			Name:     c.Name,
+			Required: c.Required,
+			Passed:   err == nil,
+			Message:  msg,
+			Duration: time.Since(start),
+		}
+		if err != nil {
+			r.Message = err.Error()
+			r.Fix = c.Fix
+			if c.Required {
+				report.Passed = false
+			}
+		}
+		report.Results = append(report.Results, r)
+	}
+	return report
+}
+
+// Failed returns the results of the required checks that failed.
+func (r Report) Failed() []Result {
+	failed := []Result{}
+	for _, res := range r.Results {
+		if res.Required && !res.Passed {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+// Err returns an error naming the required checks that failed, if any, and
+// what to do about each.
+func (r Report) Err() error {
+	failed := r.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	names := make([]string, len(failed))
+	for i, res := range failed {
+		names[i] = res.Name
+		if res.Fix != "" {
+			names[i] += " (" + res.Fix + ")"
+		}
+	}
+	return fmt.Errorf("self-test failed: %s", strings.Join(names, ", "))
+}
+
+// WriteText writes the report as a table, one check per line.
+func (r Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, res := range r.Results {
+		status := "PASS"
+		switch {
+		case !res.Passed && res.Required:
+			status = "FAIL"
+		case !res.Passed:
+			status = "WARN"
+		}
+		msg := res.Message
+		if res.Fix != "" {
+			msg += ". fix: " + res.Fix
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", status, res.Name, msg)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,140 @@
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	pass := func(context.Context) (string, error) { return "ok", nil }
+	fail := func(context.Context) (string, error) { return "", errors.New("broken") }
+
+	report := Run(context.Background(), []Check{
+		{Name: "a", Required: true, Run: pass},
+		{Name: "b", Required: false, Run: fail},
+	})
+	if !report.Passed || report.Err() != nil {
+		t.Fatalf("optional failure failed the report: %+v", report)
+	}
+
+	report = Run(context.Background(), []Check{
+		{Name: "a", Required: true, Run: pass},
+		{Name: "b", Required: false, Run: fail},
+		{Name: "c", Required: true, Run: fail, Fix: "mend it"},
+	})
+	if report.Passed {
+		t.Fatal("required failure passed the report")
+	}
+	if failed := report.Failed(); len(failed) != 1 || failed[0].Name != "c" || failed[0].Message != "broken" || failed[0].Fix != "mend it" {
+		t.Fatalf("unexpected failures %+v", failed)
+	}
+	if err := report.Err(); err == nil || err.Error() != "self-test failed: c (mend it)" {
+		t.Fatalf("expected the failure and its fix, got %v", err)
+	}
+
+	var b bytes.Buffer
+	if err := report.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	for i, prefix := range []string{"PASS", "WARN", "FAIL"} {
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Errorf("line %d: expected %s, got %q", i, prefix, lines[i])
+		}
+	}
+}
+
+func TestInterface(t *testing.T) {
+	dir, err := ioutil.TempDir("", "net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { netClassDir = d }(netClassDir)
+	netClassDir = dir
+	for iface, state := range map[string]string{"eth0": "up", "lo": "unknown", "eth1": "down"} {
+		os.MkdirAll(filepath.Join(dir, iface), 0755)
+		ioutil.WriteFile(filepath.Join(dir, iface, "operstate"), []byte(state+"\n"), 0644)
+	}
+
+	for iface, pass := range map[string]bool{"eth0": true, "lo": true, "eth1": false, "eth2": false} {
+		msg, err := Interface(iface, true).Run(context.Background())
+		if pass != (err == nil) {
+			t.Errorf("%s: expected pass %v, got %q %v", iface, pass, msg, err)
+		}
+	}
+}
+
+func TestKernelModule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sysModuleDir = filepath.Join(dir, "sys")
+	libModuleDir = filepath.Join(dir, "lib")
+	osRelease = filepath.Join(dir, "osrelease")
+	release := filepath.Join(libModuleDir, "5.10.0")
+	for _, d := range []string{filepath.Join(sysModuleDir, "ip_vs"), release} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		osRelease: "5.10.0\n",
+		filepath.Join(release, "modules.builtin"): "kernel/net/ipv4/tcp_cubic.ko\n",
+		filepath.Join(release, "modules.dep"):     "kernel/drivers/net/dummy.ko.xz:\nkernel/net/netfilter/ipvs/ip_vs_rr.ko: kernel/net/netfilter/ipvs/ip_vs.ko\n",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for module, want := range map[string]string{
+		"ip_vs":     "loaded",
+		"tcp_cubic": "built in",
+		"dummy":     "available",
+		"ip_vs_wlc": "",
+	} {
+		msg, err := KernelModule(module, true).Run(context.Background())
+		if want == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", module, msg)
+			}
+			continue
+		}
+		if err != nil || msg != want {
+			t.Errorf("%s: expected %q, got %q %v", module, want, msg, err)
+		}
+	}
+}
+
+func TestPrivilegedHelper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "helper.sock")
+
+	if _, err := PrivilegedHelper(socket).Run(context.Background()); err == nil {
+		t.Error("expected a helper that isn't listening to fail")
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if msg, err := PrivilegedHelper(socket).Run(context.Background()); err != nil {
+		t.Errorf("expected a listening helper to pass, got %q %v", msg, err)
+	}
+}
@@ -0,0 +1,199 @@
+package export
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// Difference is a way the node differs from the config it was given.
+// Declared is what the config says, and Programmed what the node has, with
+// "" for a VIP or service one of them lacks.
+type Difference struct {
+	// Where is a VIP, or a service as vip:port
+	Where      string `json:"where"`
+	Field      string `json:"field"`
+	Declared   string `json:"declared"`
+	Programmed string `json:"programmed"`
+}
+
+func (d Difference) String() string {
+	switch {
+	case d.Declared == "":
+		return fmt.Sprintf("%s %s: %s is programmed, but not in the config", d.Where, d.Field, d.Programmed)
+	case d.Programmed == "":
+		return fmt.Sprintf("%s %s: %s is in the config, but not programmed", d.Where, d.Field, d.Declared)
+	}
+	return fmt.Sprintf("%s %s: the config has %s, the node %s", d.Where, d.Field, d.Declared, d.Programmed)
+}
+
+// Compare sets the drift of e from declared, the config the process was
+// given, comparing only what the sources of e cover. The v4 VIPs held are
+// compared when the addresses or bgp were read, and the services of a family
+// when ipvs or iptables of it were read.
+func (e *Export) Compare(declared *types.ClusterConfig) {
+	e.Drift = []Difference{}
+	if declared == nil {
+		return
+	}
+	read := map[string]bool{}
+	for _, source := range e.Sources {
+		read[source] = true
+	}
+
+	if read[SourceAddresses] || read[SourceBGP] {
+		want := map[string]bool{}
+		for vip := range declared.Config {
+			want[normalize(string(vip))] = true
+		}
+		e.Drift = append(e.Drift, setDrift("vip", want, e.held)...)
+	}
+
+	families := []struct {
+		covered            bool
+		declared, exported map[types.ServiceIP]types.PortMap
+	}{
+		{read[SourceIPVS4] || read[SourceIPTables], declared.Config, e.Config.Config},
+		{read[SourceIPVS6], declared.Config6, e.Config.Config6},
+	}
+	for _, f := range families {
+		if !f.covered {
+			continue
+		}
+		want, have := services(f.declared), services(f.exported)
+		for _, key := range sortedKeys(want, have) {
+			w, h := want[key], have[key]
+			switch {
+			case h == nil:
+				e.Drift = append(e.Drift, Difference{Where: key, Field: "service", Declared: identity(w)})
+			case w == nil:
+				e.Drift = append(e.Drift, Difference{Where: key, Field: "service", Programmed: identity(h)})
+			default:
+				e.Drift = append(e.Drift, compareService(key, w, h, read)...)
+			}
+		}
+	}
+}
+
+// compareService returns how the service h programmed differs from w, in
+// what the sources read cover.
+func compareService(key string, w, h *types.ServiceDef, read map[string]bool) []Difference {
+	out := []Difference{}
+	differ := func(field, declared, programmed string) {
+		if declared != programmed {
+			out = append(out, Difference{Where: key, Field: field, Declared: declared, Programmed: programmed})
+		}
+	}
+	differ("protocols", protocols(w), protocols(h))
+	if h.Service != "" {
+		differ("kubernetes service", identity(w), identity(h))
+	}
+	if read[SourceIPVS4] || read[SourceIPVS6] {
+		differ("scheduler", w.IPVSOptions.Scheduler(), h.IPVSOptions.Scheduler())
+		differ("flags", w.IPVSOptions.SchedulerFlags(), h.IPVSOptions.SchedulerFlags())
+		differ("persistence", persistence(w.IPVSOptions), persistence(h.IPVSOptions))
+		// a service without real servers has no forwarding to read
+		if h.IPVSOptions.RawForwardingMethod != "" {
+			differ("forwarding", w.IPVSOptions.ForwardingMethod(), h.IPVSOptions.ForwardingMethod())
+		}
+	}
+	return out
+}
+
+// setDrift returns the members of want or have the other lacks.
+func setDrift(field string, want, have map[string]bool) []Difference {
+	all := []string{}
+	for k := range want {
+		all = append(all, k)
+	}
+	for k := range have {
+		if !want[k] {
+			all = append(all, k)
+		}
+	}
+	sort.Strings(all)
+	out := []Difference{}
+	for _, k := range all {
+		switch {
+		case !have[k]:
+			out = append(out, Difference{Where: k, Field: field, Declared: k})
+		case !want[k]:
+			out = append(out, Difference{Where: k, Field: field, Programmed: k})
+		}
+	}
+	return out
+}
+
+// services keys the services of portMaps by vip:port. Those with neither
+// tcp nor udp enabled are left out, as nothing is programmed for them.
+func services(portMaps map[types.ServiceIP]types.PortMap) map[string]*types.ServiceDef {
+	out := map[string]*types.ServiceDef{}
+	for vip, ports := range portMaps {
+		for port, def := range ports {
+			if def != nil && (def.TCPEnabled || def.UDPEnabled) {
+				out[net.JoinHostPort(normalize(string(vip)), port)] = def
+			}
+		}
+	}
+	return out
+}
+
+func sortedKeys(a, b map[string]*types.ServiceDef) []string {
+	keys := []string{}
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// normalize writes vip as net.IP does, so that v6 VIPs written differently
+// compare equal.
+func normalize(vip string) string {
+	if ip := net.ParseIP(vip); ip != nil {
+		return ip.String()
+	}
+	return vip
+}
+
+func identity(def *types.ServiceDef) string {
+	if def.Service == "" {
+		return "unknown service"
+	}
+	return types.MakeIdent(def.Namespace, def.Service, def.PortName)
+}
+
+func protocols(def *types.ServiceDef) string {
+	out := []string{}
+	if def.TCPEnabled {
+		out = append(out, "tcp")
+	}
+	if def.UDPEnabled {
+		out = append(out, "udp")
+	}
+	if len(out) == 0 {
+		return "none"
+	}
+	return strings.Join(out, ",")
+}
+
+// persistence is the persistence of options as ipvsadm prints it, such as
+// 300s, or 300s per 255.255.255.0.
+func persistence(options types.IPVSOptions) string {
+	switch mask := options.PersistenceNetmask; {
+	case options.Persistence <= 0:
+		return "none"
+	case mask == "" || mask == "255.255.255.255" || mask == "128":
+		return fmt.Sprintf("%ds", options.Persistence)
+	default:
+		return fmt.Sprintf("%ds per %s", options.Persistence, mask)
+	}
+}
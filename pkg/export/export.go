@@ -0,0 +1,259 @@
+// Package export rebuilds a cluster config from what a node has programmed:
+// its ipvs services, the rules of its ravel iptables chain, the VIP devices
+// on its interfaces and the prefixes it announces over bgp. The config can
+// stand in for a configmap that was lost, and is compared with the config a
+// process was given to find where the node has drifted from it.
+//
+// Only what the node holds can be rebuilt. ipvs has the VIPs, ports,
+// protocols, schedulers, flags, forwarding and connection thresholds of the
+// services, and the comments of the iptables rules name the kubernetes
+// service of each. Settings the node keeps no trace of, such as node labels,
+// MTUs and the v6 VIP of a v4 one, are left out.
+package export
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// The parts of a node's state a config is rebuilt from.
+const (
+	SourceIPVS4     = "ipvs/v4"
+	SourceIPVS6     = "ipvs/v6"
+	SourceIPTables  = "iptables"
+	SourceAddresses = "addresses"
+	SourceBGP       = "bgp"
+)
+
+// State is what a node has programmed. A field is nil when it wasn't read,
+// and empty when it was read and had nothing.
+type State struct {
+	// IPVS4 and IPVS6 are the rules of the process's ipvs services, as
+	// ipvsadm -Sn prints them.
+	IPVS4 []string
+	IPVS6 []string
+	// Chain is the rules of the process's iptables chain, as iptables-save
+	// prints them.
+	Chain []string
+	// Addresses are the v4 VIPs of the process's VIP devices.
+	Addresses []string
+	// Prefixes are the prefixes the process announces over bgp, such as
+	// 10.0.0.1/32.
+	Prefixes []string
+}
+
+// Export is a config rebuilt from a node's state.
+type Export struct {
+	Config *types.ClusterConfig `json:"config"`
+	// Sources are the parts of the state the config was rebuilt from.
+	Sources []string `json:"sources"`
+	// Notes are what couldn't be rebuilt, such as a service whose
+	// kubernetes service is unknown.
+	Notes []string `json:"notes,omitempty"`
+	// Drift is how the node differs from the config the process was given.
+	Drift []Difference `json:"drift"`
+
+	// held are the VIPs on the node's devices or announced, which a node can
+	// lack while it has their services
+	held map[string]bool
+}
+
+// Build rebuilds a config from s.
+func Build(s State) *Export {
+	e := &Export{
+		Config: &types.ClusterConfig{
+			VIPPool: []string{},
+			Config:  map[types.ServiceIP]types.PortMap{},
+			Config6: map[types.ServiceIP]types.PortMap{},
+		},
+		Sources: []string{},
+		held:    map[string]bool{},
+	}
+
+	for _, rules := range []struct {
+		source string
+		rules  []string
+	}{{SourceIPVS4, s.IPVS4}, {SourceIPVS6, s.IPVS6}} {
+		if rules.rules == nil {
+			continue
+		}
+		e.Sources = append(e.Sources, rules.source)
+		fromIPVS(e.Config, rules.rules)
+	}
+	if s.Chain != nil {
+		e.Sources = append(e.Sources, SourceIPTables)
+		fromChain(e.Config, s.Chain)
+	}
+	if s.Addresses != nil {
+		e.Sources = append(e.Sources, SourceAddresses)
+		for _, addr := range s.Addresses {
+			if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+				e.held[ip.String()] = true
+			}
+		}
+	}
+	if s.Prefixes != nil {
+		e.Sources = append(e.Sources, SourceBGP)
+		for _, prefix := range s.Prefixes {
+			ip, _, err := net.ParseCIDR(prefix)
+			if err != nil {
+				e.Notes = append(e.Notes, fmt.Sprintf("announced prefix %s is not a cidr", prefix))
+				continue
+			}
+			if ip.To4() != nil {
+				e.held[ip.String()] = true
+				continue
+			}
+			if _, ok := e.Config.Config6[types.ServiceIP(ip.String())]; !ok {
+				e.Notes = append(e.Notes, fmt.Sprintf("v6 VIP %s is announced, but has no services to place it with", ip))
+			}
+		}
+	}
+
+	vips := map[string]bool{}
+	for vip := range e.held {
+		vips[vip] = true
+	}
+	for vip, ports := range e.Config.Config {
+		vips[string(vip)] = true
+		for port, def := range ports {
+			if def.Service == "" {
+				e.Notes = append(e.Notes, fmt.Sprintf("the kubernetes service of %s is unknown", net.JoinHostPort(string(vip), port)))
+			}
+		}
+	}
+	for vip, ports := range e.Config.Config6 {
+		for port, def := range ports {
+			if def.Service == "" {
+				e.Notes = append(e.Notes, fmt.Sprintf("the kubernetes service of %s is unknown", net.JoinHostPort(string(vip), port)))
+			}
+		}
+	}
+	for vip := range vips {
+		e.Config.VIPPool = append(e.Config.VIPPool, vip)
+	}
+	sort.Strings(e.Config.VIPPool)
+	sort.Strings(e.Notes)
+	return e
+}
+
+// serviceOf returns the service of config at vip and port, adding it if it
+// isn't there.
+func serviceOf(config *types.ClusterConfig, vip, port string) *types.ServiceDef {
+	ip := net.ParseIP(vip)
+	if ip == nil {
+		return nil
+	}
+	portMaps := config.Config
+	if ip.To4() == nil {
+		portMaps = config.Config6
+	}
+	key := types.ServiceIP(ip.String())
+	if portMaps[key] == nil {
+		portMaps[key] = types.PortMap{}
+	}
+	if portMaps[key][port] == nil {
+		portMaps[key][port] = &types.ServiceDef{}
+	}
+	return portMaps[key][port]
+}
+
+// fromIPVS adds the services of ipvs rules such as
+// "-A -t 10.0.0.1:80 -s mh -b flag-1,flag-2" and
+// "-a -t 10.0.0.1:80 -r 10.0.1.1:80 -i -w 1 -x 100 -y 50" to config. The
+// thresholds of a service are split over its real servers, so they are
+// summed back up.
+func fromIPVS(config *types.ClusterConfig, rules []string) {
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) < 3 || fields[0] != "-A" && fields[0] != "-a" {
+			continue
+		}
+		vip, port, err := net.SplitHostPort(fields[2])
+		if err != nil {
+			continue
+		}
+		def := serviceOf(config, vip, port)
+		if def == nil {
+			continue
+		}
+		switch fields[1] {
+		case "-t":
+			def.TCPEnabled = true
+		case "-u":
+			def.UDPEnabled = true
+		default:
+			continue
+		}
+		for ix, field := range fields[3:] {
+			var value string
+			if ix+4 < len(fields) {
+				value = fields[ix+4]
+			}
+			switch {
+			case fields[0] == "-A" && field == "-s":
+				def.IPVSOptions.RawScheduler = value
+			case fields[0] == "-A" && field == "-b":
+				def.IPVSOptions.Flags = value
+			case fields[0] == "-A" && field == "-p":
+				def.IPVSOptions.Persistence, _ = strconv.Atoi(value)
+			case fields[0] == "-A" && field == "-M":
+				def.IPVSOptions.PersistenceNetmask = value
+			case fields[0] == "-a" && (field == "-g" || field == "-i"):
+				def.IPVSOptions.RawForwardingMethod = strings.TrimPrefix(field, "-")
+			case fields[0] == "-a" && field == "-x":
+				x, _ := strconv.Atoi(value)
+				def.IPVSOptions.RawUThreshold += x
+			case fields[0] == "-a" && field == "-y":
+				y, _ := strconv.Atoi(value)
+				def.IPVSOptions.RawLThreshold += y
+			}
+		}
+	}
+}
+
+// fromChain names the services of config after the comments of iptables
+// rules such as
+// -A RAVEL -d 10.0.0.1/32 -p tcp -m tcp --dport 80 -m comment --comment "ns/svc:http" -j RAVEL-SVC-X
+// and adds those ipvs didn't have.
+func fromChain(config *types.ClusterConfig, rules []string) {
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		var vip, protocol, port, ident string
+		for ix := 0; ix < len(fields)-1; ix++ {
+			switch fields[ix] {
+			case "-d":
+				vip = strings.TrimSuffix(fields[ix+1], "/32")
+			case "-p":
+				protocol = fields[ix+1]
+			case "--dport":
+				port = fields[ix+1]
+			case "--comment":
+				ident = strings.Trim(fields[ix+1], `"`)
+			}
+		}
+		if vip == "" || port == "" || ident == "" {
+			continue
+		}
+		named, err := types.NewServiceDef(ident)
+		if err != nil {
+			continue
+		}
+		def := serviceOf(config, vip, port)
+		if def == nil {
+			continue
+		}
+		def.Namespace, def.Service, def.PortName = named.Namespace, named.Service, named.PortName
+		switch protocol {
+		case "tcp":
+			def.TCPEnabled = true
+		case "udp":
+			def.UDPEnabled = true
+		}
+	}
+}
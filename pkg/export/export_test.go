@@ -0,0 +1,102 @@
+package export
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+func TestBuild(t *testing.T) {
+	e := Build(State{
+		IPVS4: []string{
+			"-A -t 10.0.0.1:80 -s mh -b flag-1,flag-2",
+			"-a -t 10.0.0.1:80 -r 10.0.1.1:80 -i -w 1 -x 100 -y 50",
+			"-a -t 10.0.0.1:80 -r 10.0.1.2:80 -i -w 1 -x 100 -y 50",
+			"-A -u 10.0.0.1:53 -s wrr",
+			"-A -t 10.0.0.1:443 -s sh -b sh-port -p 300 -M 255.255.255.0",
+		},
+		IPVS6: []string{
+			"-A -t [2001:db8::1]:443 -s rr",
+		},
+		Chain: []string{
+			`-A RAVEL -m conntrack --ctstate NEW -m comment --comment "ravel drain" -j RETURN`,
+			`-A RAVEL -d 10.0.0.1/32 -p tcp -m tcp --dport 80 -m comment --comment "ns/web:http" -j RAVEL-SVC-X`,
+			`-A RAVEL -d 10.0.0.2/32 -p tcp -m tcp --dport 8080 -m comment --comment "ns/api:http"  -m statistic --mode random --probability 0.50000000000 -j RAVEL-SVC-Y`,
+		},
+		Addresses: []string{"10.0.0.3"},
+		Prefixes:  []string{"10.0.0.1/32", "2001:db8::9/128"},
+	})
+
+	web := e.Config.Config["10.0.0.1"]["80"]
+	want := types.ServiceDef{
+		Namespace: "ns", Service: "web", PortName: "http", TCPEnabled: true,
+		IPVSOptions: types.IPVSOptions{RawScheduler: "mh", Flags: "flag-1,flag-2", RawForwardingMethod: "i", RawUThreshold: 200, RawLThreshold: 100},
+	}
+	if web == nil || !reflect.DeepEqual(*web, want) {
+		t.Fatalf("expected %+v. saw %+v", want, web)
+	}
+	if tls := e.Config.Config["10.0.0.1"]["443"]; tls == nil || tls.IPVSOptions.Persistence != 300 || tls.IPVSOptions.PersistenceNetmask != "255.255.255.0" || tls.IPVSOptions.SchedulerFlags() != "flag-2" {
+		t.Fatalf("expected a persistent service from ipvs. saw %+v", tls)
+	}
+	if dns := e.Config.Config["10.0.0.1"]["53"]; dns == nil || !dns.UDPEnabled || dns.TCPEnabled || dns.IPVSOptions.RawScheduler != "wrr" {
+		t.Fatalf("expected a udp service from ipvs. saw %+v", dns)
+	}
+	if api := e.Config.Config["10.0.0.2"]["8080"]; api == nil || api.Service != "api" || !api.TCPEnabled {
+		t.Fatalf("expected a service from iptables. saw %+v", api)
+	}
+	if e.Config.Config6["2001:db8::1"]["443"] == nil {
+		t.Fatal("expected a v6 service")
+	}
+	if !reflect.DeepEqual(e.Config.VIPPool, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}) {
+		t.Fatalf("expected the v4 VIPs in the pool. saw %v", e.Config.VIPPool)
+	}
+	if !reflect.DeepEqual(e.Sources, []string{SourceIPVS4, SourceIPVS6, SourceIPTables, SourceAddresses, SourceBGP}) {
+		t.Fatalf("expected every source. saw %v", e.Sources)
+	}
+	if len(e.Notes) != 4 {
+		t.Fatalf("expected notes of three unnamed services and an unplaced v6 VIP. saw %v", e.Notes)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	declared := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.0.0.1": {
+				// mh is programmed with flag-1,flag-2 without flags
+				"80": &types.ServiceDef{Namespace: "ns", Service: "web", PortName: "http", TCPEnabled: true, IPVSOptions: types.IPVSOptions{RawScheduler: "mh"}},
+				"81": &types.ServiceDef{Namespace: "ns", Service: "web", PortName: "alt", TCPEnabled: true},
+				// nothing is programmed without a protocol
+				"82": &types.ServiceDef{Namespace: "ns", Service: "web", PortName: "off"},
+			},
+			"10.0.0.2": {
+				"80": &types.ServiceDef{Namespace: "ns", Service: "api", PortName: "http", TCPEnabled: true, IPVSOptions: types.IPVSOptions{RawForwardingMethod: "i"}},
+			},
+		},
+		Config6: map[types.ServiceIP]types.PortMap{
+			"2001:db8::1": {"443": &types.ServiceDef{TCPEnabled: true}},
+		},
+	}
+	e := Build(State{
+		IPVS4: []string{
+			"-A -t 10.0.0.1:80 -s mh -b mh-fallback,mh-port -p 60",
+			"-A -t 10.0.0.2:80 -s wrr",
+			"-a -t 10.0.0.2:80 -r 10.0.1.1:80 -g -w 1 -x 0 -y 0",
+			"-A -t 10.0.0.3:80 -s wrr",
+		},
+		Addresses: []string{"10.0.0.1", "10.0.0.3"},
+	})
+	e.Compare(declared)
+
+	want := []Difference{
+		{Where: "10.0.0.2", Field: "vip", Declared: "10.0.0.2"},
+		{Where: "10.0.0.3", Field: "vip", Programmed: "10.0.0.3"},
+		{Where: "10.0.0.1:80", Field: "persistence", Declared: "none", Programmed: "60s"},
+		{Where: "10.0.0.1:81", Field: "service", Declared: "ns/web:alt"},
+		{Where: "10.0.0.2:80", Field: "forwarding", Declared: "i", Programmed: "g"},
+		{Where: "10.0.0.3:80", Field: "service", Programmed: "unknown service"},
+	}
+	if !reflect.DeepEqual(e.Drift, want) {
+		t.Fatalf("expected drift\n%v\nsaw\n%v", want, e.Drift)
+	}
+}
@@ -0,0 +1,338 @@
+package fence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// VRRP alone can't stop two directors from holding the VIPs at once: a
+// master that is wedged but still answering ARP, or a network that drops
+// adverts between directors, leaves more than one director believing it is
+// master. The fence is a Lease in the config map's namespace, named
+// ravel-fence-<config key>, that a director must claim before it takes the
+// VIPs.
+//
+// A claim only succeeds while the lease is free, expired or already ours, and
+// each new holder bumps its generation, which is the fencing token: a
+// director whose renewal finds another holder, or a later generation, has
+// been fenced off and must step down. A director only frees the lease once it
+// has withdrawn the VIPs, so the next master can't claim them while they are
+// still up elsewhere.
+
+// DefaultTTL is how long a claim lasts without being renewed.
+const DefaultTTL = 15 * time.Second
+
+// ErrLost is returned by Renew once another director has claimed the fence.
+var ErrLost = errors.New("fence claimed by another director")
+
+// HeldError is returned by Claim while another director holds the fence.
+type HeldError struct {
+	Holder     string
+	Generation int64
+	Expires    time.Time
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("fence held by %s at generation %d until %v", e.Holder, e.Generation, e.Expires.Format(time.RFC3339))
+}
+
+var (
+	generationDef = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "director_fence_generation",
+		Help:   "is the generation of the fence the director holds the VIPs under, and 0 while it holds no claim",
+		Labels: []string{"lb", "seczone"},
+	})
+	conflictsDef = stats.Define(stats.Definition{
+		Type:   stats.Counter,
+		Name:   "director_fence_conflicts_total",
+		Help:   "is a count of the times the director found that another director had claimed the fence it believed it held",
+		Labels: []string{"lb", "seczone"},
+	})
+
+	metricsOnce sync.Once
+	generations *prometheus.GaugeVec
+	conflicts   *prometheus.CounterVec
+)
+
+func metrics() (*prometheus.GaugeVec, *prometheus.CounterVec) {
+	metricsOnce.Do(func() {
+		generations = generationDef.GaugeVec()
+		conflicts = conflictsDef.CounterVec()
+	})
+	return generations, conflicts
+}
+
+// record is the state of the fence.
+type record struct {
+	Holder     string
+	Generation int64
+	Renewed    time.Time
+	TTL        time.Duration
+	// version guards updates against concurrent ones. It is blank while the
+	// fence doesn't exist.
+	version string
+}
+
+func (r record) expires() time.Time {
+	return r.Renewed.Add(r.TTL)
+}
+
+// store keeps the fence.
+type store interface {
+	get(ctx context.Context) (record, error)
+	// put writes the fence, failing if it changed since it was read.
+	put(ctx context.Context, r record) error
+}
+
+// Fence is a director's claim on the VIPs of a config key.
+type Fence struct {
+	sync.Mutex
+	node  string
+	ttl   time.Duration
+	store store
+
+	held       bool
+	generation int64
+	renewed    time.Time
+	conflict   string
+
+	configKey string
+	gauge     prometheus.Gauge
+	conflicts prometheus.Counter
+	logger    logging.Logger
+}
+
+// New returns the fence of configKey for the director on node, kept in
+// namespace.
+func New(client kubernetes.Interface, namespace, configKey, node string, ttl time.Duration, kind stats.LBKind, logger logging.Logger) (*Fence, error) {
+	if ttl < 3*time.Second {
+		return nil, fmt.Errorf("fence ttl must be at least 3s")
+	}
+	return newFence(&leaseStore{client: client, namespace: namespace, name: leaseName(configKey)}, configKey, node, ttl, kind, logger), nil
+}
+
+func newFence(s store, configKey, node string, ttl time.Duration, kind stats.LBKind, logger logging.Logger) *Fence {
+	generations, conflicts := metrics()
+	return &Fence{
+		node:      node,
+		ttl:       ttl,
+		store:     s,
+		configKey: configKey,
+		gauge:     generations.WithLabelValues(string(kind), configKey),
+		conflicts: conflicts.WithLabelValues(string(kind), configKey),
+		logger:    logger.WithFields(logging.Fields{"module": "fence"}),
+	}
+}
+
+// Claim takes the fence, returning its generation. It fails with a HeldError
+// while another director holds it.
+func (f *Fence) Claim(ctx context.Context) (int64, error) {
+	r, err := f.store.get(ctx)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	if r.Holder != "" && r.Holder != f.node && now.Before(r.expires()) {
+		return 0, &HeldError{Holder: r.Holder, Generation: r.Generation, Expires: r.expires()}
+	}
+	if r.Holder != f.node {
+		r.Generation++
+	}
+	r.Holder, r.Renewed, r.TTL = f.node, now, f.ttl
+	if err := f.store.put(ctx, r); err != nil {
+		return 0, err
+	}
+
+	f.Lock()
+	f.held, f.generation, f.renewed, f.conflict = true, r.Generation, now, ""
+	f.Unlock()
+	f.gauge.Set(float64(r.Generation))
+	f.logger.Infof("fence: claimed config key %s at generation %d", f.configKey, r.Generation)
+	return r.Generation, nil
+}
+
+// Renew extends the claim. It fails with ErrLost, and counts a conflict, when
+// another director has claimed the fence since.
+func (f *Fence) Renew(ctx context.Context) error {
+	f.Lock()
+	held, generation := f.held, f.generation
+	f.Unlock()
+	if !held {
+		return ErrLost
+	}
+
+	r, err := f.store.get(ctx)
+	if err != nil {
+		return err
+	}
+	if r.Holder != f.node || r.Generation != generation {
+		f.Lock()
+		f.held = false
+		f.conflict = fmt.Sprintf("claimed by %s at generation %d, over our generation %d", r.Holder, r.Generation, generation)
+		f.Unlock()
+		f.gauge.Set(0)
+		f.conflicts.Inc()
+		f.logger.Errorf("fence: config key %s was %s", f.configKey, f.conflict)
+		return ErrLost
+	}
+	now := time.Now()
+	r.Renewed, r.TTL = now, f.ttl
+	if err := f.store.put(ctx, r); err != nil {
+		return err
+	}
+	f.Lock()
+	f.renewed = now
+	f.Unlock()
+	return nil
+}
+
+// Release frees the fence, if the director holds it. Only call it once the
+// VIPs are withdrawn.
+func (f *Fence) Release(ctx context.Context) error {
+	f.Lock()
+	held, generation := f.held, f.generation
+	f.held = false
+	f.Unlock()
+	if !held {
+		return nil
+	}
+	f.gauge.Set(0)
+
+	r, err := f.store.get(ctx)
+	if err != nil {
+		return err
+	}
+	if r.Holder != f.node || r.Generation != generation {
+		return nil
+	}
+	r.Holder = ""
+	if err := f.store.put(ctx, r); err != nil {
+		return err
+	}
+	f.logger.Infof("fence: released config key %s at generation %d", f.configKey, generation)
+	return nil
+}
+
+// Valid reports whether the claim was renewed recently enough that no other
+// director can have taken the fence yet.
+func (f *Fence) Valid() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.held && time.Since(f.renewed) < f.ttl*2/3
+}
+
+// RenewInterval is how often a held claim should be renewed.
+func (f *Fence) RenewInterval() time.Duration {
+	return f.ttl / 3
+}
+
+// Generation returns the generation of the claim, or 0 while the director
+// holds none.
+func (f *Fence) Generation() int64 {
+	f.Lock()
+	defer f.Unlock()
+	if !f.held {
+		return 0
+	}
+	return f.generation
+}
+
+// Health reports the claim. Directors without one are healthy, unless they
+// lost theirs to a conflict.
+func (f *Fence) Health(context.Context) health.Status {
+	f.Lock()
+	defer f.Unlock()
+	switch {
+	case f.held:
+		return health.Status{Ready: true, Message: fmt.Sprintf("holding generation %d", f.generation)}
+	case f.conflict != "":
+		return health.Status{Ready: false, Message: "stepped down: " + f.conflict}
+	}
+	return health.Status{Ready: true, Message: "not claimed"}
+}
+
+// invalidName matches what kubernetes doesn't allow in names.
+var invalidName = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// leaseName returns the name of the fence of configKey.
+func leaseName(configKey string) string {
+	name := "ravel-fence-" + invalidName.ReplaceAllString(strings.ToLower(configKey), "-")
+	if len(name) > 253 {
+		name = name[:253]
+	}
+	return strings.Trim(name, "-.")
+}
+
+// leaseStore keeps the fence as a coordination.k8s.io Lease, whose
+// transitions are the generation.
+type leaseStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func (s *leaseStore) get(ctx context.Context) (record, error) {
+	lease, err := s.client.CoordinationV1().Leases(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return record{}, nil
+	}
+	if err != nil {
+		return record{}, err
+	}
+	r := record{version: lease.ResourceVersion}
+	if lease.Spec.HolderIdentity != nil {
+		r.Holder = *lease.Spec.HolderIdentity
+	}
+	if lease.Spec.LeaseTransitions != nil {
+		r.Generation = int64(*lease.Spec.LeaseTransitions)
+	}
+	if lease.Spec.RenewTime != nil {
+		r.Renewed = lease.Spec.RenewTime.Time
+	}
+	if lease.Spec.LeaseDurationSeconds != nil {
+		r.TTL = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+	return r, nil
+}
+
+func (s *leaseStore) put(ctx context.Context, r record) error {
+	leases := s.client.CoordinationV1().Leases(s.namespace)
+	transitions := int32(r.Generation)
+	seconds := int32(r.TTL / time.Second)
+	renewed := metav1.NewMicroTime(r.Renewed)
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: s.name, Namespace: s.namespace, ResourceVersion: r.version},
+		Spec: coordinationv1.LeaseSpec{
+			LeaseDurationSeconds: &seconds,
+			RenewTime:            &renewed,
+			LeaseTransitions:     &transitions,
+		},
+	}
+	if r.Holder != "" {
+		lease.Spec.HolderIdentity = &r.Holder
+	}
+	if r.version == "" {
+		_, err := leases.Create(ctx, lease, metav1.CreateOptions{})
+		return err
+	}
+	// the resource version makes this fail if another director got there
+	// first
+	_, err := leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
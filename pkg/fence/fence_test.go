@@ -0,0 +1,102 @@
+package fence
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// fakeStore keeps the fence in memory, refusing stale writes as the api
+// server would.
+type fakeStore struct {
+	sync.Mutex
+	r       record
+	version int
+}
+
+func (s *fakeStore) get(context.Context) (record, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.r, nil
+}
+
+func (s *fakeStore) put(_ context.Context, r record) error {
+	s.Lock()
+	defer s.Unlock()
+	if r.version != s.r.version {
+		return errors.New("conflict")
+	}
+	s.version++
+	r.version = strconv.Itoa(s.version)
+	s.r = r
+	return nil
+}
+
+func TestFence(t *testing.T) {
+	ctx := context.Background()
+	s := &fakeStore{}
+	a := newFence(s, "green", "node-a", 15*time.Second, stats.KindIpvsMaster, logging.New())
+	b := newFence(s, "green", "node-b", 15*time.Second, stats.KindIpvsMaster, logging.New())
+
+	if g, err := a.Claim(ctx); err != nil || g != 1 {
+		t.Fatalf("expected the first claim at generation 1, got %d %v", g, err)
+	}
+	// reclaiming keeps the generation
+	if g, err := a.Claim(ctx); err != nil || g != 1 {
+		t.Fatalf("expected a reclaim to keep generation 1, got %d %v", g, err)
+	}
+	var held *HeldError
+	if _, err := b.Claim(ctx); !errors.As(err, &held) || held.Holder != "node-a" {
+		t.Fatalf("expected the claim of node-b to wait on node-a, got %v", err)
+	}
+
+	// once node-a withdraws, node-b claims the next generation
+	if err := a.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if g, err := b.Claim(ctx); err != nil || g != 2 {
+		t.Fatalf("expected node-b to claim generation 2, got %d %v", g, err)
+	}
+	if err := b.Renew(ctx); err != nil || !b.Valid() || b.Generation() != 2 {
+		t.Fatalf("expected node-b to keep its claim, %v", err)
+	}
+}
+
+func TestFenceConflict(t *testing.T) {
+	ctx := context.Background()
+	s := &fakeStore{}
+	a := newFence(s, "blue", "node-a", 15*time.Second, stats.KindIpvsMaster, logging.New())
+	b := newFence(s, "blue", "node-b", 15*time.Second, stats.KindIpvsMaster, logging.New())
+	if _, err := a.Claim(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// node-a goes quiet until its claim expires, and node-b takes over
+	s.Lock()
+	s.r.Renewed = time.Now().Add(-time.Minute)
+	s.Unlock()
+	if g, err := b.Claim(ctx); err != nil || g != 2 {
+		t.Fatalf("expected node-b to claim the expired fence, got %d %v", g, err)
+	}
+
+	// node-a comes back believing it holds the VIPs, and is fenced off
+	if err := a.Renew(ctx); err != ErrLost {
+		t.Fatalf("expected node-a to find its claim lost, got %v", err)
+	}
+	if status := a.Health(ctx); status.Ready || a.Generation() != 0 {
+		t.Fatalf("expected node-a to report the conflict, got %+v", status)
+	}
+	// and releasing a lost claim leaves node-b's alone
+	if err := a.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := s.get(ctx); r.Holder != "node-b" || r.Generation != 2 {
+		t.Fatalf("expected node-b to keep the fence, got %+v", r)
+	}
+}
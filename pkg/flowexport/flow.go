@@ -0,0 +1,82 @@
+package flowexport
+
+import (
+	"encoding/binary"
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// flowKey identifies a flow in one direction. IPv4 addresses occupy the
+// first four bytes of the address arrays.
+type flowKey struct {
+	src, dst         [16]byte
+	srcPort, dstPort uint16
+	proto            uint8
+	v6               bool
+	ingress          bool
+}
+
+// parseFlow reads the flow key and tcp flags from the headers of a sampled
+// frame. It returns false for anything other than tcp or udp over ip, and
+// for headers cut short by the capture length.
+func parseFlow(s Sample) (flowKey, uint8, bool) {
+	k := flowKey{ingress: s.Ingress}
+	b := s.Header
+
+	if len(b) < 14 {
+		return k, 0, false
+	}
+	etherType := binary.BigEndian.Uint16(b[12:])
+	b = b[14:]
+
+	switch etherType {
+	case etherTypeIPv4:
+		if len(b) < 20 {
+			return k, 0, false
+		}
+		ihl := int(b[0]&0x0f) * 4
+		if ihl < 20 || len(b) < ihl {
+			return k, 0, false
+		}
+		k.proto = b[9]
+		copy(k.src[:], b[12:16])
+		copy(k.dst[:], b[16:20])
+		b = b[ihl:]
+	case etherTypeIPv6:
+		// extension headers are not followed, same as the counters.
+		if len(b) < 40 {
+			return k, 0, false
+		}
+		k.v6 = true
+		k.proto = b[6]
+		copy(k.src[:], b[8:24])
+		copy(k.dst[:], b[24:40])
+		b = b[40:]
+	default:
+		return k, 0, false
+	}
+
+	var flags uint8
+	switch k.proto {
+	case protoTCP:
+		if len(b) < 14 {
+			return k, 0, false
+		}
+		flags = b[13]
+	case protoUDP:
+		if len(b) < 4 {
+			return k, 0, false
+		}
+	default:
+		return k, 0, false
+	}
+	k.srcPort = binary.BigEndian.Uint16(b[0:])
+	k.dstPort = binary.BigEndian.Uint16(b[2:])
+	return k, flags, true
+}
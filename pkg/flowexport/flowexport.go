@@ -0,0 +1,163 @@
+package flowexport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+// Flow export ships sampled VIP traffic to a collector as either sFlow v5
+// or IPFIX. Samples come from the eBPF counters in the stats package, which
+// copy the leading bytes of one in SampleRate counted packets to userspace.
+// sFlow forwards each sampled header as is and leaves scaling to the
+// collector; IPFIX aggregates the samples into flows over an interval and
+// reports counts already scaled by the sample rate.
+
+const (
+	ProtocolIPFIX = "ipfix"
+	ProtocolSFlow = "sflow"
+
+	// maxDatagram keeps exported datagrams under a typical 1500 byte MTU.
+	maxDatagram = 1400
+
+	// queueSize bounds the samples waiting to be encoded. Samples beyond
+	// this are dropped rather than holding up the perf reader.
+	queueSize = 4096
+)
+
+// Sample is a single sampled packet.
+type Sample struct {
+	Time time.Time
+	// Ingress is true for packets received on the interface, false for
+	// packets sent.
+	Ingress bool
+	// Length is the length of the whole frame.
+	Length uint32
+	// Header holds the leading bytes of the frame, starting with the
+	// ethernet header.
+	Header []byte
+}
+
+// Config describes where and how flows are exported.
+type Config struct {
+	Protocol   string        // ipfix or sflow
+	Collector  string        // host:port of the collector
+	SampleRate uint32        // one in SampleRate packets is sampled
+	Interval   time.Duration // how often pending records are sent
+	AgentIP    net.IP        // address of this node, reported by sFlow
+	IfIndex    uint32        // index of the sampled interface
+}
+
+// encoder turns samples into datagrams for a collector. add returns any
+// datagrams that are ready to send, and flush returns everything pending.
+type encoder interface {
+	add(Sample) [][]byte
+	flush(now time.Time) [][]byte
+}
+
+// Exporter encodes samples and sends them to the collector over UDP.
+type Exporter struct {
+	dropped uint64 // first for 64-bit alignment of the atomic counter
+
+	config  Config
+	conn    net.Conn
+	enc     encoder
+	samples chan Sample
+
+	logger logging.Logger
+}
+
+// New returns an Exporter that runs until ctx is canceled.
+func New(ctx context.Context, config Config, logger logging.Logger) (*Exporter, error) {
+	if config.SampleRate == 0 {
+		return nil, fmt.Errorf("flowexport: sample rate must be at least 1")
+	}
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("flowexport: export interval must be positive")
+	}
+
+	var enc encoder
+	switch config.Protocol {
+	case ProtocolIPFIX:
+		enc = newIPFIXEncoder(config)
+	case ProtocolSFlow:
+		enc = newSFlowEncoder(config, time.Now())
+	default:
+		return nil, fmt.Errorf("flowexport: unknown protocol %q. must be one of ipfix|sflow", config.Protocol)
+	}
+
+	conn, err := net.Dial("udp", config.Collector)
+	if err != nil {
+		return nil, fmt.Errorf("flowexport: unable to reach collector %s: %v", config.Collector, err)
+	}
+
+	e := &Exporter{
+		config:  config,
+		conn:    conn,
+		enc:     enc,
+		samples: make(chan Sample, queueSize),
+		logger:  logger.WithFields(logging.Fields{"module": "flowexport"}),
+	}
+	go e.run(ctx)
+	return e, nil
+}
+
+// Add queues a sample for export. It never blocks; samples are dropped when
+// the exporter falls behind.
+func (e *Exporter) Add(s Sample) {
+	select {
+	case e.samples <- s:
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+	}
+}
+
+func (e *Exporter) run(ctx context.Context) {
+	defer e.conn.Close()
+	e.logger.Infof("flowexport: sending %s to %s, sampling 1 in %d packets", e.config.Protocol, e.config.Collector, e.config.SampleRate)
+
+	t := time.NewTicker(e.config.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			e.send(e.enc.flush(time.Now()))
+			return
+		case s := <-e.samples:
+			e.send(e.enc.add(s))
+		case now := <-t.C:
+			e.send(e.enc.flush(now))
+			if dropped := atomic.SwapUint64(&e.dropped, 0); dropped > 0 {
+				e.logger.Warnf("flowexport: dropped %d samples in the last interval", dropped)
+			}
+		}
+	}
+}
+
+// send writes datagrams to the collector, giving up on the batch at the
+// first failure. Failures are logged at debug so that an unreachable
+// collector doesn't flood the log.
+func (e *Exporter) send(datagrams [][]byte) {
+	for _, d := range datagrams {
+		if _, err := e.conn.Write(d); err != nil {
+			e.logger.Debugf("flowexport: unable to send %d datagrams to %s: %v", len(datagrams), e.config.Collector, err)
+			return
+		}
+	}
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
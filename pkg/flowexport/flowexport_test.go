@@ -0,0 +1,168 @@
+package flowexport
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// frame builds an ethernet frame carrying a tcp segment with the given flags.
+func frame(src, dst net.IP, srcPort, dstPort uint16, flags uint8) []byte {
+	b := make([]byte, 14)
+	ip := make([]byte, 40)
+	if ip4 := src.To4(); ip4 != nil {
+		binary.BigEndian.PutUint16(b[12:], etherTypeIPv4)
+		ip = ip[:20]
+		ip[0] = 0x45
+		ip[9] = protoTCP
+		copy(ip[12:], ip4)
+		copy(ip[16:], dst.To4())
+	} else {
+		binary.BigEndian.PutUint16(b[12:], etherTypeIPv6)
+		ip[6] = protoTCP
+		copy(ip[8:], src.To16())
+		copy(ip[24:], dst.To16())
+	}
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	tcp[13] = flags
+	return append(append(b, ip...), tcp...)
+}
+
+func TestParseFlow(t *testing.T) {
+	src, dst := net.ParseIP("10.0.0.1"), net.ParseIP("10.54.213.10")
+	k, flags, ok := parseFlow(Sample{Ingress: true, Header: frame(src, dst, 40000, 443, 0x12)})
+	if !ok {
+		t.Fatal("expected to parse a v4 tcp frame")
+	}
+	if k.v6 || k.proto != protoTCP || k.srcPort != 40000 || k.dstPort != 443 || flags != 0x12 || !k.ingress {
+		t.Fatalf("unexpected flow %+v flags %x", k, flags)
+	}
+	if !net.IP(k.dst[:4]).Equal(dst) {
+		t.Fatalf("expected destination %s. saw %s", dst, net.IP(k.dst[:4]))
+	}
+
+	k, _, ok = parseFlow(Sample{Header: frame(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 1, 2, 0)})
+	if !ok || !k.v6 || !net.IP(k.src[:]).Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("expected to parse a v6 tcp frame. saw %+v %v", k, ok)
+	}
+
+	if _, _, ok := parseFlow(Sample{Header: frame(src, dst, 1, 2, 0)[:40]}); ok {
+		t.Fatal("expected a truncated frame to be rejected")
+	}
+}
+
+func TestSFlowDatagrams(t *testing.T) {
+	now := time.Now()
+	e := newSFlowEncoder(Config{SampleRate: 100, AgentIP: net.ParseIP("10.0.0.5"), IfIndex: 2}, now)
+	header := frame(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 1, 2, 0)
+
+	var datagrams [][]byte
+	for i := 0; i < 20; i++ {
+		datagrams = append(datagrams, e.add(Sample{Time: now, Ingress: true, Length: 1500, Header: header})...)
+	}
+	datagrams = append(datagrams, e.flush(now)...)
+
+	samples := uint32(0)
+	for _, d := range datagrams {
+		if len(d) > maxDatagram {
+			t.Fatalf("datagram of %d bytes exceeds %d", len(d), maxDatagram)
+		}
+		if v := binary.BigEndian.Uint32(d[0:]); v != sflowVersion {
+			t.Fatalf("expected version 5. saw %d", v)
+		}
+		n := binary.BigEndian.Uint32(d[24:])
+		// walk the samples to check that their lengths add up
+		off := 28
+		for i := uint32(0); i < n; i++ {
+			off += 8 + int(binary.BigEndian.Uint32(d[off+4:]))
+		}
+		if off != len(d) {
+			t.Fatalf("samples end at %d in a datagram of %d bytes", off, len(d))
+		}
+		samples += n
+	}
+	if samples != 20 {
+		t.Fatalf("expected 20 samples across %d datagrams. saw %d", len(datagrams), samples)
+	}
+	if e.pool != 2000 {
+		t.Fatalf("expected a sample pool of 2000. saw %d", e.pool)
+	}
+}
+
+func TestIPFIXMessages(t *testing.T) {
+	now := time.Now()
+	e := newIPFIXEncoder(Config{SampleRate: 10})
+	for i := 0; i < 100; i++ {
+		src := net.IPv4(10, 0, byte(i/250), byte(i%250))
+		e.add(Sample{Time: now, Ingress: true, Length: 100, Header: frame(src, net.ParseIP("10.0.0.100"), 5000, 80, 0x02)})
+		e.add(Sample{Time: now, Ingress: true, Length: 100, Header: frame(src, net.ParseIP("10.0.0.100"), 5000, 80, 0x10)})
+	}
+	e.add(Sample{Time: now, Length: 100, Header: frame(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 80, 5000, 0)})
+
+	messages := e.flush(now)
+	if len(messages) < 2 {
+		t.Fatalf("expected 101 flows to span several messages. saw %d", len(messages))
+	}
+
+	records := map[uint16]int{}
+	sequence := uint32(0)
+	for i, m := range messages {
+		if len(m) > maxDatagram {
+			t.Fatalf("message of %d bytes exceeds %d", len(m), maxDatagram)
+		}
+		if v := binary.BigEndian.Uint16(m[0:]); v != ipfixVersion {
+			t.Fatalf("expected version 10. saw %d", v)
+		}
+		if l := binary.BigEndian.Uint16(m[2:]); int(l) != len(m) {
+			t.Fatalf("message length %d does not match %d", l, len(m))
+		}
+		if s := binary.BigEndian.Uint32(m[8:]); s != sequence {
+			t.Fatalf("expected sequence %d. saw %d", sequence, s)
+		}
+
+		for off := 16; off < len(m); {
+			id, length := binary.BigEndian.Uint16(m[off:]), int(binary.BigEndian.Uint16(m[off+2:]))
+			switch id {
+			case ipfixTemplateSet:
+				if i != 0 {
+					t.Fatal("expected templates only in the first message")
+				}
+			case ipfixTemplateV4:
+				if (length-4)%48 != 0 {
+					t.Fatalf("v4 set of %d bytes is not a whole number of records", length)
+				}
+				if i == 0 && off+4 < len(m) {
+					// packets and bytes of the first record, scaled by the rate
+					if p := binary.BigEndian.Uint64(m[off+4+16:]); p != 20 {
+						t.Fatalf("expected 20 packets. saw %d", p)
+					}
+					if b := binary.BigEndian.Uint64(m[off+4+24:]); b != 2000 {
+						t.Fatalf("expected 2000 bytes. saw %d", b)
+					}
+					if f := binary.BigEndian.Uint16(m[off+4+13:]); f != 0x12 {
+						t.Fatalf("expected tcp flags 0x12. saw %x", f)
+					}
+				}
+				records[id] += (length - 4) / 48
+				sequence += uint32((length - 4) / 48)
+			case ipfixTemplateV6:
+				records[id] += (length - 4) / 72
+				sequence += uint32((length - 4) / 72)
+			default:
+				t.Fatalf("unexpected set id %d", id)
+			}
+			off += length
+		}
+	}
+	if records[ipfixTemplateV4] != 100 || records[ipfixTemplateV6] != 1 {
+		t.Fatalf("expected 100 v4 and 1 v6 records. saw %v", records)
+	}
+
+	e.add(Sample{Time: now, Header: frame(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 1, 2, 0)})
+	if m := e.flush(now.Add(time.Second)); binary.BigEndian.Uint16(m[0][16:]) == ipfixTemplateSet {
+		t.Fatal("expected templates to be sent only every 30s")
+	}
+}
@@ -0,0 +1,256 @@
+package flowexport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+// IPFIX, RFC 7011. Information element ids are from the IANA registry.
+
+const (
+	ipfixVersion = 10
+
+	ipfixTemplateSet = 2
+	ipfixTemplateV4  = 256
+	ipfixTemplateV6  = 257
+
+	// templates are resent periodically since collectors may restart and
+	// udp gives no indication that they have.
+	ipfixTemplateInterval = 30 * time.Second
+
+	// maxFlows bounds the flow cache between flushes.
+	maxFlows = 8192
+)
+
+type ipfixField struct {
+	id     uint16
+	length uint16
+}
+
+var (
+	ipfixCommonFields = []ipfixField{
+		{7, 2},   // sourceTransportPort
+		{11, 2},  // destinationTransportPort
+		{4, 1},   // protocolIdentifier
+		{6, 2},   // tcpControlBits
+		{61, 1},  // flowDirection
+		{2, 8},   // packetDeltaCount
+		{1, 8},   // octetDeltaCount
+		{152, 8}, // flowStartMilliseconds
+		{153, 8}, // flowEndMilliseconds
+	}
+	ipfixFieldsV4 = append([]ipfixField{
+		{8, 4},  // sourceIPv4Address
+		{12, 4}, // destinationIPv4Address
+	}, ipfixCommonFields...)
+	ipfixFieldsV6 = append([]ipfixField{
+		{27, 16}, // sourceIPv6Address
+		{28, 16}, // destinationIPv6Address
+	}, ipfixCommonFields...)
+)
+
+// flowRecord accumulates the samples of a flow, scaled by the sample rate.
+type flowRecord struct {
+	packets    uint64
+	bytes      uint64
+	flags      uint8
+	start, end time.Time
+}
+
+// ipfixEncoder aggregates samples into flows and exports the flows seen in
+// each interval as delta counts.
+type ipfixEncoder struct {
+	config Config
+
+	flows        map[flowKey]*flowRecord
+	sequence     uint32 // data records sent
+	lastTemplate time.Time
+}
+
+func newIPFIXEncoder(config Config) *ipfixEncoder {
+	return &ipfixEncoder{
+		config: config,
+		flows:  map[flowKey]*flowRecord{},
+	}
+}
+
+func (e *ipfixEncoder) add(s Sample) [][]byte {
+	k, flags, ok := parseFlow(s)
+	if !ok {
+		return nil
+	}
+
+	var out [][]byte
+	r, ok := e.flows[k]
+	if !ok {
+		if len(e.flows) >= maxFlows {
+			out = e.flush(s.Time)
+		}
+		r = &flowRecord{start: s.Time}
+		e.flows[k] = r
+	}
+	r.packets += uint64(e.config.SampleRate)
+	r.bytes += uint64(s.Length) * uint64(e.config.SampleRate)
+	r.flags |= flags
+	r.end = s.Time
+	return out
+}
+
+func (e *ipfixEncoder) flush(now time.Time) [][]byte {
+	if len(e.flows) == 0 {
+		return nil
+	}
+
+	// sort for stable output, v4 ahead of v6.
+	keys := make([]flowKey, 0, len(e.flows))
+	for k := range e.flows {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.v6 != b.v6 {
+			return !a.v6
+		}
+		if c := bytes.Compare(a.dst[:], b.dst[:]); c != 0 {
+			return c < 0
+		}
+		if a.dstPort != b.dstPort {
+			return a.dstPort < b.dstPort
+		}
+		if c := bytes.Compare(a.src[:], b.src[:]); c != 0 {
+			return c < 0
+		}
+		if a.srcPort != b.srcPort {
+			return a.srcPort < b.srcPort
+		}
+		if a.proto != b.proto {
+			return a.proto < b.proto
+		}
+		return a.ingress && !b.ingress
+	})
+
+	m := &ipfixMessage{enc: e, now: now}
+	if now.Sub(e.lastTemplate) >= ipfixTemplateInterval {
+		m.templates = true
+		e.lastTemplate = now
+	}
+	for _, k := range keys {
+		m.add(k, e.flows[k])
+	}
+	m.finish()
+
+	e.flows = map[flowKey]*flowRecord{}
+	return m.out
+}
+
+// ipfixMessage builds the messages for one flush, starting a new message
+// whenever the next record would not fit.
+type ipfixMessage struct {
+	enc       *ipfixEncoder
+	now       time.Time
+	templates bool
+
+	out     [][]byte
+	buf     []byte
+	set     int // offset of the open data set, zero if none
+	setID   uint16
+	records uint32
+}
+
+func (m *ipfixMessage) add(k flowKey, r *flowRecord) {
+	id, fields := uint16(ipfixTemplateV4), ipfixFieldsV4
+	if k.v6 {
+		id, fields = ipfixTemplateV6, ipfixFieldsV6
+	}
+	size := 0
+	for _, f := range fields {
+		size += int(f.length)
+	}
+
+	if m.buf != nil && len(m.buf)+4+size > maxDatagram {
+		m.finish()
+	}
+	if m.buf == nil {
+		m.start()
+	}
+	if m.set == 0 || m.setID != id {
+		m.closeSet()
+		m.set, m.setID = len(m.buf), id
+		m.buf = appendUint32(m.buf, uint32(id)<<16)
+	}
+
+	if k.v6 {
+		m.buf = append(m.buf, k.src[:]...)
+		m.buf = append(m.buf, k.dst[:]...)
+	} else {
+		m.buf = append(m.buf, k.src[:4]...)
+		m.buf = append(m.buf, k.dst[:4]...)
+	}
+	m.buf = appendUint16(m.buf, k.srcPort)
+	m.buf = appendUint16(m.buf, k.dstPort)
+	m.buf = append(m.buf, k.proto)
+	m.buf = appendUint16(m.buf, uint16(r.flags))
+	if k.ingress {
+		m.buf = append(m.buf, 0)
+	} else {
+		m.buf = append(m.buf, 1)
+	}
+	m.buf = appendUint64(m.buf, r.packets)
+	m.buf = appendUint64(m.buf, r.bytes)
+	m.buf = appendUint64(m.buf, uint64(r.start.UnixNano()/int64(time.Millisecond)))
+	m.buf = appendUint64(m.buf, uint64(r.end.UnixNano()/int64(time.Millisecond)))
+	m.records++
+}
+
+// start begins a message with its header and, if due, the template set.
+// Length and sequence number are filled in by finish.
+func (m *ipfixMessage) start() {
+	m.buf = make([]byte, 16, maxDatagram)
+	binary.BigEndian.PutUint16(m.buf[0:], ipfixVersion)
+	binary.BigEndian.PutUint32(m.buf[4:], uint32(m.now.Unix()))
+	binary.BigEndian.PutUint32(m.buf[12:], m.enc.config.IfIndex) // observation domain
+
+	if !m.templates {
+		return
+	}
+	m.templates = false
+	set := len(m.buf)
+	m.buf = appendUint32(m.buf, ipfixTemplateSet<<16)
+	for _, t := range []struct {
+		id     uint16
+		fields []ipfixField
+	}{{ipfixTemplateV4, ipfixFieldsV4}, {ipfixTemplateV6, ipfixFieldsV6}} {
+		m.buf = appendUint16(m.buf, t.id)
+		m.buf = appendUint16(m.buf, uint16(len(t.fields)))
+		for _, f := range t.fields {
+			m.buf = appendUint16(m.buf, f.id)
+			m.buf = appendUint16(m.buf, f.length)
+		}
+	}
+	binary.BigEndian.PutUint16(m.buf[set+2:], uint16(len(m.buf)-set))
+}
+
+func (m *ipfixMessage) closeSet() {
+	if m.set == 0 {
+		return
+	}
+	binary.BigEndian.PutUint16(m.buf[m.set+2:], uint16(len(m.buf)-m.set))
+	m.set = 0
+}
+
+// finish completes the current message, if any.
+func (m *ipfixMessage) finish() {
+	if m.buf == nil {
+		return
+	}
+	m.closeSet()
+	binary.BigEndian.PutUint16(m.buf[2:], uint16(len(m.buf)))
+	binary.BigEndian.PutUint32(m.buf[8:], m.enc.sequence)
+	m.enc.sequence += m.records
+
+	m.out = append(m.out, m.buf)
+	m.buf = nil
+	m.records = 0
+}
@@ -0,0 +1,129 @@
+package flowexport
+
+import (
+	"time"
+)
+
+// sFlow v5, https://sflow.org/sflow_version_5.txt
+
+const (
+	sflowVersion = 5
+
+	sflowAddressUnknown = 0
+	sflowAddressIPv4    = 1
+	sflowAddressIPv6    = 2
+
+	sflowFlowSample     = 1 // enterprise 0, format 1
+	sflowSampledHeader  = 1 // enterprise 0, format 1
+	sflowHeaderEthernet = 1 // header_protocol ETHERNET-ISO88023
+)
+
+// sflowEncoder packs each sample into a flow_sample carrying the raw
+// packet header. Samples are batched into datagrams of up to maxDatagram
+// bytes, which are sent when full or on flush.
+type sflowEncoder struct {
+	config Config
+	boot   time.Time
+
+	sequence       uint32 // datagrams sent
+	sampleSequence uint32 // flow samples sent
+	pool           uint32 // packets that could have been sampled
+
+	pending [][]byte
+	size    int
+}
+
+func newSFlowEncoder(config Config, boot time.Time) *sflowEncoder {
+	return &sflowEncoder{config: config, boot: boot}
+}
+
+func (e *sflowEncoder) add(s Sample) [][]byte {
+	e.sampleSequence++
+	e.pool += e.config.SampleRate
+	sample := e.flowSample(s)
+
+	var out [][]byte
+	if e.size+len(sample) > maxDatagram-e.headerLen() {
+		out = e.flush(s.Time)
+	}
+	e.pending = append(e.pending, sample)
+	e.size += len(sample)
+	return out
+}
+
+func (e *sflowEncoder) flush(now time.Time) [][]byte {
+	if len(e.pending) == 0 {
+		return nil
+	}
+	e.sequence++
+
+	b := make([]byte, 0, e.headerLen()+e.size)
+	b = appendUint32(b, sflowVersion)
+	if ip4 := e.config.AgentIP.To4(); ip4 != nil {
+		b = appendUint32(b, sflowAddressIPv4)
+		b = append(b, ip4...)
+	} else if ip6 := e.config.AgentIP.To16(); ip6 != nil {
+		b = appendUint32(b, sflowAddressIPv6)
+		b = append(b, ip6...)
+	} else {
+		b = appendUint32(b, sflowAddressUnknown)
+	}
+	b = appendUint32(b, 0) // sub agent id
+	b = appendUint32(b, e.sequence)
+	b = appendUint32(b, uint32(now.Sub(e.boot)/time.Millisecond))
+	b = appendUint32(b, uint32(len(e.pending)))
+	for _, sample := range e.pending {
+		b = append(b, sample...)
+	}
+
+	e.pending = nil
+	e.size = 0
+	return [][]byte{b}
+}
+
+// headerLen is the length of the datagram header for the agent address.
+func (e *sflowEncoder) headerLen() int {
+	switch {
+	case e.config.AgentIP.To4() != nil:
+		return 28
+	case e.config.AgentIP.To16() != nil:
+		return 40
+	}
+	return 24
+}
+
+// flowSample encodes a flow_sample with a single sampled_header record.
+func (e *sflowEncoder) flowSample(s Sample) []byte {
+	header := s.Header
+	padded := (len(header) + 3) &^ 3
+
+	// input and output are the ifIndex the packet arrived on or left by.
+	input, output := e.config.IfIndex, uint32(0)
+	if !s.Ingress {
+		input, output = 0, e.config.IfIndex
+	}
+
+	record := 16 + padded
+	body := 32 + 8 + record
+
+	b := make([]byte, 0, 8+body)
+	b = appendUint32(b, sflowFlowSample)
+	b = appendUint32(b, uint32(body))
+	b = appendUint32(b, e.sampleSequence)
+	b = appendUint32(b, e.config.IfIndex) // source id, type 0 is ifIndex
+	b = appendUint32(b, e.config.SampleRate)
+	b = appendUint32(b, e.pool)
+	b = appendUint32(b, 0) // drops
+	b = appendUint32(b, input)
+	b = appendUint32(b, output)
+	b = appendUint32(b, 1) // records
+
+	b = appendUint32(b, sflowSampledHeader)
+	b = appendUint32(b, uint32(record))
+	b = appendUint32(b, sflowHeaderEthernet)
+	b = appendUint32(b, s.Length)
+	b = appendUint32(b, 0) // bytes stripped
+	b = appendUint32(b, uint32(len(header)))
+	b = append(b, header...)
+	return append(b, make([]byte, padded-len(header))...)
+}
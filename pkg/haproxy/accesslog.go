@@ -0,0 +1,121 @@
+package haproxy
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+// The access logs of the listeners go through Ravel's own logger, and so to
+// the same places as its other logs. haproxy sends a line per connection, or
+// per request in http mode, to a unix datagram socket that Ravel owns, as
+// space separated key=value pairs without a syslog header:
+//
+//	client_ip=2001:db8::9 client_port=40000 vip=2001:db8::1 port=443 backend=listen6-443 server=10.0.0.1-8443 ...
+//
+// Each line is logged at info level with its pairs as fields, and the native
+// proxy logs its connections with the same fields. Logs can be sampled, in
+// which case one connection or request in every sample is logged.
+
+// accessLogFormat is the log-format of tcp listeners, and accessLogHTTP is
+// added to it for http listeners.
+const (
+	accessLogFormat = `client_ip=%ci\ client_port=%cp\ vip=%fi\ port=%fp\ backend=%b\ server=%s\ wait_ms=%Tw\ connect_ms=%Tc\ duration_ms=%Tt\ bytes_in=%U\ bytes_out=%B\ termination=%ts`
+	accessLogHTTP   = `\ method=%HM\ uri=%HU\ status=%ST`
+	// accessLogSize is the longest line haproxy sends, and Ravel reads.
+	accessLogSize = 4096
+)
+
+// AccessLog receives the access logs of the listeners of a set.
+type AccessLog struct {
+	socket string
+	sample uint64
+	count  uint64
+	logger logging.Logger
+}
+
+// NewAccessLog listens for access logs on socket until ctx is done, and
+// logs one in every sample of them to logger.
+func NewAccessLog(ctx context.Context, socket string, sample int, logger logging.Logger) (*AccessLog, error) {
+	if sample < 1 {
+		sample = 1
+	}
+	os.Remove(socket)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	// haproxy logs after dropping to its own user
+	if err := os.Chmod(socket, 0666); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	a := &AccessLog{socket: socket, sample: uint64(sample), logger: logger}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+		os.Remove(socket)
+	}()
+	go a.serve(conn)
+	return a, nil
+}
+
+func (a *AccessLog) serve(conn *net.UnixConn) {
+	buf := make([]byte, accessLogSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			a.logger.Debugf("stopped reading haproxy access logs. %v", err)
+			return
+		}
+		if fields := parseAccessLog(buf[:n]); len(fields) > 0 {
+			a.log(fields)
+		}
+	}
+}
+
+// log logs an access, unless sampling skips it.
+func (a *AccessLog) log(fields logging.Fields) {
+	if a == nil || (atomic.AddUint64(&a.count, 1)-1)%a.sample != 0 {
+		return
+	}
+	a.logger.WithFields(fields).Info("haproxy access")
+}
+
+// parseAccessLog reads the key=value pairs of a line. Pairs without a value
+// are left out.
+func parseAccessLog(b []byte) logging.Fields {
+	fields := logging.Fields{}
+	for _, pair := range strings.Fields(string(b)) {
+		i := strings.IndexByte(pair, '=')
+		if i < 1 || i == len(pair)-1 || pair[i+1:] == "-" {
+			continue
+		}
+		fields[pair[:i]] = pair[i+1:]
+	}
+	return fields
+}
+
+// accessFields are the access log fields of a connection proxied natively.
+func accessFields(client, vip net.Addr, backend, server string, start time.Time, in, out int64) logging.Fields {
+	fields := logging.Fields{
+		"backend":     backend,
+		"server":      server,
+		"duration_ms": strconv.FormatInt(time.Since(start).Milliseconds(), 10),
+		"bytes_in":    strconv.FormatInt(in, 10),
+		"bytes_out":   strconv.FormatInt(out, 10),
+	}
+	if host, port, err := net.SplitHostPort(client.String()); err == nil {
+		fields["client_ip"], fields["client_port"] = host, port
+	}
+	if host, port, err := net.SplitHostPort(vip.String()); err == nil {
+		fields[logging.FieldVIP], fields["port"] = host, port
+	}
+	return fields
+}
@@ -0,0 +1,240 @@
+package haproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Comcast/Ravel/pkg/audit"
+)
+
+// The admin API exposes the stats socket operations that operators need on a
+// node, without them having to find the socket of each listener:
+//
+//	GET  /haproxy/listeners                    the listeners and their servers
+//	GET  /haproxy/sessions?listener=vip:port   show sess on a listener
+//	POST /haproxy/server?listener=vip:port&server=s&action=disable|enable
+//	POST /haproxy/server?listener=vip:port&server=s&action=weight&weight=n
+//
+// A server is a pod IP, its server name of <pod ip>-<target port>, or
+// backend/server for the servers of a route. Changes are recorded in the
+// audit trail, and last until the listener reloads.
+
+// maxWeight is the highest weight haproxy takes.
+const maxWeight = 256
+
+// serverPattern matches the server names a request may carry, so that
+// nothing else reaches the stats socket.
+var serverPattern = regexp.MustCompile(`^([a-zA-Z0-9._:-]+/)?[a-zA-Z0-9._:-]+$`)
+
+// ListenerStatus is a listener as reported by the admin API.
+type ListenerStatus struct {
+	Listener string         `json:"listener"`
+	Proxy    string         `json:"proxy"`
+	Socket   string         `json:"socket,omitempty"`
+	Healthy  bool           `json:"healthy"`
+	Error    string         `json:"error,omitempty"`
+	Servers  []ServerStatus `json:"servers,omitempty"`
+}
+
+// ServerStatus is a server of a listener as reported by the admin API.
+type ServerStatus struct {
+	Backend  string `json:"backend"`
+	Server   string `json:"server"`
+	Status   string `json:"status"`
+	Weight   string `json:"weight"`
+	Sessions string `json:"sessions"`
+}
+
+// AdminHandler serves the admin API for the listeners of the set.
+func (h *HAProxySetManager) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/haproxy/listeners", h.serveListeners)
+	mux.HandleFunc("/haproxy/sessions", h.serveSessions)
+	mux.HandleFunc("/haproxy/server", h.serveServer)
+	return mux
+}
+
+func (h *HAProxySetManager) serveListeners(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	h.Lock()
+	keys := make([]string, 0, len(h.sources))
+	for key := range h.sources {
+		keys = append(keys, key)
+	}
+	h.Unlock()
+	sort.Strings(keys)
+
+	out := []ListenerStatus{}
+	for _, key := range keys {
+		if status, ok := h.listenerStatus(key); ok {
+			out = append(out, status)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func (h *HAProxySetManager) serveSessions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	instance, ok := h.adminListener(w, r)
+	if !ok {
+		return
+	}
+	out, err := runtimeCommand(instance.statsSocket(), "show sess")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	for _, line := range strings.Split(out, "\n") {
+		// a pool shows the sessions of every listener in it
+		if instance.pool == nil || contains(strings.Fields(line), "fe="+instance.backendName()) {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+func (h *HAProxySetManager) serveServer(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	instance, ok := h.adminListener(w, r)
+	if !ok {
+		return
+	}
+	server := r.URL.Query().Get("server")
+	if !serverPattern.MatchString(server) {
+		http.Error(w, "invalid server "+strconv.Quote(server), http.StatusBadRequest)
+		return
+	}
+	server = instance.qualifiedServer(server)
+
+	var command, detail string
+	switch action := r.URL.Query().Get("action"); action {
+	case "disable", "enable":
+		command = action + " server " + server
+	case "weight":
+		weight, err := strconv.Atoi(r.URL.Query().Get("weight"))
+		if err != nil || weight < 0 || weight > maxWeight {
+			http.Error(w, fmt.Sprintf("weight must be between 0 and %d", maxWeight), http.StatusBadRequest)
+			return
+		}
+		command = fmt.Sprintf("set weight %s %d", server, weight)
+		detail = strconv.Itoa(weight)
+	default:
+		http.Error(w, "action must be one of disable|enable|weight", http.StatusBadRequest)
+		return
+	}
+
+	err := expect(instance.statsSocket(), command, "")
+	audit.Record(audit.SubsystemHAProxy, r.URL.Query().Get("action"), r.URL.Query().Get("listener")+" "+server, detail, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	status, _ := h.listenerStatus(r.URL.Query().Get("listener"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// adminListener returns the haproxy listener a request names, or writes the
+// error and returns false.
+func (h *HAProxySetManager) adminListener(w http.ResponseWriter, r *http.Request) (*HAProxyManager, bool) {
+	key := r.URL.Query().Get("listener")
+	h.Lock()
+	source, found := h.sources[key]
+	h.Unlock()
+	if !found {
+		http.Error(w, "no listener "+strconv.Quote(key), http.StatusNotFound)
+		return nil, false
+	}
+	instance, ok := source.(*HAProxyManager)
+	if !ok {
+		http.Error(w, "listener "+key+" is proxied natively and has no stats socket", http.StatusConflict)
+		return nil, false
+	}
+	return instance, true
+}
+
+// listenerStatus reports a listener and, for haproxy listeners, its servers.
+func (h *HAProxySetManager) listenerStatus(key string) (ListenerStatus, bool) {
+	h.Lock()
+	source, found := h.sources[key]
+	h.Unlock()
+	if !found {
+		return ListenerStatus{}, false
+	}
+	status := ListenerStatus{Listener: key, Proxy: ProxyNative, Healthy: true}
+	instance, ok := source.(*HAProxyManager)
+	if !ok {
+		return status, true
+	}
+
+	status.Proxy = ProxyHAProxy
+	status.Socket = instance.statsSocket()
+	if err := instance.status.get(); err != nil {
+		status.Healthy = false
+		status.Error = err.Error()
+	}
+	rows, err := instance.stats()
+	if err != nil {
+		status.Healthy = false
+		status.Error = fmt.Sprintf("unable to query stats socket. %v", err)
+		return status, true
+	}
+	for _, row := range rows {
+		if row.proxy != "server" {
+			continue
+		}
+		status.Servers = append(status.Servers, ServerStatus{
+			Backend:  row.values["pxname"],
+			Server:   row.server,
+			Status:   row.values["status"],
+			Weight:   row.values["weight"],
+			Sessions: row.values["scur"],
+		})
+	}
+	return status, true
+}
+
+// qualifiedServer returns the backend/server name of a server of the
+// listener, which may be given as a pod IP or a server name alone.
+func (h *HAProxyManager) qualifiedServer(server string) string {
+	if ip := net.ParseIP(server); ip != nil {
+		server = h.serverName(server)
+	}
+	if serverPattern.FindStringSubmatch(server)[1] == "" {
+		server = h.backendName() + "/" + server
+	}
+	return server
+}
+
+// contains returns whether s is one of fields.
+func contains(fields []string, s string) bool {
+	for _, f := range fields {
+		if f == s {
+			return true
+		}
+	}
+	return false
+}
+
+// allowMethod writes a 405 and returns false unless r uses method.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
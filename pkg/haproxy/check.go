@@ -0,0 +1,82 @@
+package haproxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HealthCheck has haproxy check the servers of a listener itself, so that a
+// dead pod stops getting connections before its endpoint is removed. The
+// zero value checks nothing.
+type HealthCheck struct {
+	Enabled bool
+	// Interval between checks. haproxy's default of 2s when zero.
+	Interval time.Duration
+	// Rise and Fall are how many checks a server must pass to come back and
+	// fail to be taken out. haproxy's defaults of 2 and 3 when zero.
+	Rise, Fall int
+	// HTTPPath makes the check an HTTP GET of this path, and HTTPExpect is
+	// the http-check expect rule its response must match.
+	HTTPPath   string
+	HTTPExpect string
+}
+
+// expectKinds are the http-check expect matches a check may use.
+var expectKinds = []string{"status", "rstatus", "string", "rstring"}
+
+// Validate checks that the settings render into a valid configuration.
+func (c HealthCheck) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Interval < 0 || c.Interval > 0 && c.Interval < time.Millisecond {
+		return fmt.Errorf("health check interval must be at least 1ms")
+	}
+	if c.Rise < 0 || c.Fall < 0 {
+		return fmt.Errorf("health check rise and fall must not be negative")
+	}
+	if c.HTTPPath != "" && (!strings.HasPrefix(c.HTTPPath, "/") || strings.ContainsAny(c.HTTPPath, " \t\r\n")) {
+		return fmt.Errorf("health check http path must start with / and contain no whitespace")
+	}
+	if c.HTTPExpect != "" {
+		if c.HTTPPath == "" {
+			return fmt.Errorf("health check http expect requires an http path")
+		}
+		if strings.ContainsAny(c.HTTPExpect, "\r\n") {
+			return fmt.Errorf("health check http expect must be a single line")
+		}
+		// an optional ! inverts the match
+		fields := strings.Fields(c.HTTPExpect)
+		if len(fields) > 0 && fields[0] == "!" {
+			fields = fields[1:]
+		}
+		valid := false
+		for _, k := range expectKinds {
+			valid = valid || len(fields) > 1 && fields[0] == k
+		}
+		if !valid {
+			return fmt.Errorf("health check http expect must be an optional ! and one of %v followed by a pattern", expectKinds)
+		}
+	}
+	return nil
+}
+
+// serverArgs are the check arguments of each server line.
+func (c HealthCheck) serverArgs() []string {
+	if !c.Enabled {
+		return nil
+	}
+	args := []string{"check"}
+	if c.Interval > 0 {
+		args = append(args, "inter", timeout(c.Interval))
+	}
+	if c.Rise > 0 {
+		args = append(args, "rise", strconv.Itoa(c.Rise))
+	}
+	if c.Fall > 0 {
+		args = append(args, "fall", strconv.Itoa(c.Fall))
+	}
+	return args
+}
@@ -0,0 +1,113 @@
+package haproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/observe"
+	"github.com/Comcast/Ravel/pkg/privsep"
+)
+
+// procDir is where the processes of the node are listed.
+var procDir = "/proc"
+
+// Cleanup stops the haproxy process of each listener with a config in
+// configDir, and removes the config, certificate and stats socket of the
+// listener, for a node being decommissioned. Only the listeners whose
+// address owned reports are touched. It returns the listeners cleaned up.
+func Cleanup(configDir string, owned func(listenAddr string) bool) ([]string, error) {
+	configs, err := filepath.Glob(filepath.Join(configDir, "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+	processes, err := listenerProcesses(configDir)
+	if err != nil {
+		return nil, err
+	}
+
+	cleaned := []string{}
+	errs := []string{}
+	for _, config := range configs {
+		key := strings.TrimSuffix(filepath.Base(config), ".conf")
+		i := strings.LastIndex(key, "-")
+		if i < 0 || !owned(key[:i]) {
+			continue
+		}
+		if observe.Enabled() {
+			observe.Would(audit.SubsystemHAProxy, "stop", key, "cleanup")
+			cleaned = append(cleaned, key)
+			continue
+		}
+		err := cleanupListener(config, processes[config])
+		audit.Record(audit.SubsystemHAProxy, "stop", key, "cleanup", err)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+			continue
+		}
+		cleaned = append(cleaned, key)
+	}
+	if len(errs) > 0 {
+		return cleaned, fmt.Errorf("haproxy: unable to clean up %d listeners: %s", len(errs), strings.Join(errs, ", "))
+	}
+	return cleaned, nil
+}
+
+// cleanupListener stops the processes running config, and removes its
+// files.
+func cleanupListener(config string, pids []int) error {
+	for _, pid := range pids {
+		if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("unable to stop process %d. %v", pid, err)
+		}
+	}
+	base := strings.TrimSuffix(config, ".conf")
+	for _, path := range []string{config, base + ".pem", base + ".sock"} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// listenerProcesses returns the pids of the haproxy processes running each
+// config in configDir, by the config they were started with. A process the
+// privileged helper started runs its copy of the config, of the same name.
+func listenerProcesses(configDir string) (map[string][]int, error) {
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	processes := map[string][]int{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// a process that exits while it is read is skipped
+		b, err := ioutil.ReadFile(filepath.Join(procDir, entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(b), "\x00"), "\x00")
+		for ix := 0; ix < len(args)-1; ix++ {
+			if args[ix] != "-f" {
+				continue
+			}
+			if dir := filepath.Dir(args[ix+1]); dir == filepath.Clean(configDir) || dir == filepath.Clean(privsep.HAProxyCopies) {
+				config := filepath.Join(configDir, filepath.Base(args[ix+1]))
+				processes[config] = append(processes[config], pid)
+			}
+		}
+	}
+	for _, pids := range processes {
+		sort.Ints(pids)
+	}
+	return processes, nil
+}
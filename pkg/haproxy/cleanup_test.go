@@ -0,0 +1,47 @@
+package haproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ours := filepath.Join(dir, "2001:db8::1-443.conf")
+	theirs := filepath.Join(dir, "2001:db8::2-443.conf")
+	for _, path := range []string{ours, theirs, filepath.Join(dir, "2001:db8::1-443.pem")} {
+		ioutil.WriteFile(path, []byte("global\n"), 0644)
+	}
+
+	// a process started with the config stands in for haproxy
+	cmd := exec.Command("sh", "-c", "sleep 60", "-f", ours)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	cleaned, err := Cleanup(dir, func(addr string) bool { return addr == "2001:db8::1" })
+	if err != nil || !reflect.DeepEqual(cleaned, []string{"2001:db8::1-443"}) {
+		t.Fatalf("expected the owned listener cleaned up, got %v %v", cleaned, err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("expected the process of the listener stopped")
+	}
+	remaining, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if !reflect.DeepEqual(remaining, []string{theirs}) {
+		t.Fatalf("expected only the other listener's config left, got %v", remaining)
+	}
+}
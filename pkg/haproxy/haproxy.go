@@ -4,16 +4,20 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"html/template"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/observe"
+	"github.com/Comcast/Ravel/pkg/privsep"
 )
 
 // VIPConfig An HAProxy contains an IPV6 address, a set of pod IPs,
@@ -27,6 +31,49 @@ type VIPConfig struct {
 	TargetPort  string
 	ServicePort string
 	MTU         string
+
+	Options ListenerOptions
+}
+
+// ListenerOptions are the per-service settings of a listener. Unlike the
+// pods of the listener, a change to them, including to the pods of a route,
+// reloads haproxy.
+type ListenerOptions struct {
+	// SendProxy sends a PROXY protocol v2 header to the pods, so that they
+	// see the address, port and family of the client rather than haproxy's.
+	SendProxy bool
+	// AcceptProxy expects a PROXY protocol header, v1 or v2, on connections
+	// to the VIP, for listeners behind another proxy.
+	AcceptProxy bool
+	// TLSCertificate is a PEM bundle of a certificate chain and its key.
+	// When set, the listener terminates TLS and forwards plain TCP. A new
+	// certificate reloads the listener.
+	TLSCertificate string
+	// HealthCheck has haproxy check the pods.
+	HealthCheck HealthCheck
+	// Proxy is ProxyHAProxy or ProxyNative, or empty for the default of the
+	// set. Changing it replaces the listener.
+	Proxy string
+	// UDP forwards UDP as well as TCP. Only the native proxy does.
+	UDP bool
+	// L7Mode routes connections by host to Routes. Only haproxy does.
+	L7Mode string
+	Routes []Route
+	// Limits tune the connections of the listener.
+	Limits Limits
+	// LocalBackend is the pattern of the address the pods are connected to
+	// on instead of their pod IPs, or empty.
+	LocalBackend string
+}
+
+// serverArgs are the arguments of each server line, shared by the
+// configuration and servers added through the runtime API.
+func (o ListenerOptions) serverArgs() string {
+	args := o.HealthCheck.serverArgs()
+	if o.SendProxy {
+		args = append(args, "send-proxy-v2")
+	}
+	return strings.Join(args, " ")
 }
 
 // IsValid determines if the VIPConfig is valid
@@ -70,7 +117,11 @@ type HAProxySetManager struct {
 
 	sources     map[string]HAProxy
 	cancelFuncs map[string]context.CancelFunc
+	pools       map[int]*pool
 	errChan     chan HAProxyError
+	// observed holds what each listener would run, in place of sources, when
+	// the process only observes
+	observed map[string]string
 
 	binary    string
 	configDir string
@@ -81,24 +132,42 @@ type HAProxySetManager struct {
 
 	services map[string]string
 
-	logger logrus.FieldLogger
+	settings Settings
+
+	logger logging.Logger
 }
 
-// NewHAProxySet creates a new HAProxySetManager instance
-func NewHAProxySet(ctx context.Context, binary, configDir string, logger logrus.FieldLogger) (*HAProxySetManager, error) {
+// Settings are shared by every listener of a set.
+type Settings struct {
+	// Templates render the configuration of each listener. The built-in
+	// template is used when nil.
+	Templates *Templates
+	// MasterWorker runs each listener as a haproxy master process, which
+	// reloads its workers on SIGUSR2.
+	MasterWorker bool
+	// Proxy runs the listeners that don't pick a proxy themselves. It is
+	// ProxyHAProxy when empty.
+	Proxy string
+	// Pools hosts the haproxy listeners in this many shared processes, when
+	// not 0, rather than in a process each.
+	Pools int
+	// AccessLog receives the access logs of the listeners, which log no
+	// accesses when it is nil.
+	AccessLog *AccessLog
+}
 
-	c2, cxl := context.WithCancel(ctx)
-	defer cxl()
+// NewHAProxySet creates a new HAProxySetManager instance
+func NewHAProxySet(ctx context.Context, binary, configDir string, logger logging.Logger) (*HAProxySetManager, error) {
 
 	// does the binary exist?
 	// this still doesn't verify that the file is compiled correctly
-	// and is an haproxy binary
+	// and is an haproxy binary. without one, only native listeners work.
 	if !fileExists(binary) {
-		return nil, fmt.Errorf("no file found at location %s specified for haproxy binary, exiting", binary)
+		logger.Warnf("no file found at location %s specified for haproxy binary. only native listeners can be configured", binary)
 	}
 
 	// does the configDir exist? if not, make it
-	if !dirExists(configDir) {
+	if !dirExists(configDir) && !observe.Enabled() {
 		cmdContext, cmdContextCancel := context.WithTimeout(ctx, time.Second*20)
 		defer cmdContextCancel()
 		cmdOutput, err := exec.CommandContext(cmdContext, "mkdir", "-p", configDir).Output()
@@ -107,9 +176,13 @@ func NewHAProxySet(ctx context.Context, binary, configDir string, logger logrus.
 		}
 	}
 
+	// the listeners live as long as the set, until StopAll
+	c2, cxl := context.WithCancel(ctx)
 	return &HAProxySetManager{
 		sources:     map[string]HAProxy{},
 		cancelFuncs: map[string]context.CancelFunc{},
+		observed:    map[string]string{},
+		pools:       map[int]*pool{},
 		errChan:     make(chan HAProxyError, 100),
 
 		services: map[string]string{},
@@ -120,10 +193,56 @@ func NewHAProxySet(ctx context.Context, binary, configDir string, logger logrus.
 		ctx:       c2,
 		cxl:       cxl,
 
-		logger: logger.WithFields(logrus.Fields{"parent": "haproxy"}),
+		logger: logger.WithFields(logging.Fields{"parent": "haproxy"}),
 	}, nil
 }
 
+// UseTemplates renders the configuration of listeners created from here on
+// with templates.
+func (h *HAProxySetManager) UseTemplates(templates *Templates) {
+	h.Lock()
+	defer h.Unlock()
+	h.settings.Templates = templates
+}
+
+// UseMasterWorker runs listeners created from here on in master-worker mode.
+func (h *HAProxySetManager) UseMasterWorker(enabled bool) {
+	h.Lock()
+	defer h.Unlock()
+	h.settings.MasterWorker = enabled
+}
+
+// UseProxy sets the proxy of listeners that don't pick one.
+func (h *HAProxySetManager) UseProxy(proxy string) {
+	h.Lock()
+	defer h.Unlock()
+	h.settings.Proxy = proxy
+}
+
+// UsePools hosts haproxy listeners created from here on in n shared
+// processes, or in a process each when n is 0.
+func (h *HAProxySetManager) UsePools(n int) {
+	h.Lock()
+	defer h.Unlock()
+	h.settings.Pools = n
+}
+
+// UseAccessLog sends the access logs of listeners created from here on to a.
+func (h *HAProxySetManager) UseAccessLog(a *AccessLog) {
+	h.Lock()
+	defer h.Unlock()
+	h.settings.AccessLog = a
+}
+
+// native returns whether a listener with options is run by the native proxy.
+func (h *HAProxySetManager) native(options ListenerOptions) bool {
+	proxy := options.Proxy
+	if proxy == "" {
+		proxy = h.settings.Proxy
+	}
+	return proxy == ProxyNative
+}
+
 // fileExists checks if a file exists and is not a directory before we
 // try using it to prevent further errors.
 func fileExists(filename string) bool {
@@ -148,6 +267,9 @@ func (h *HAProxySetManager) GetRemovals(v6addrs []string) []string {
 	for addr := range h.sources {
 		configured = append(configured, addr)
 	}
+	for addr := range h.observed {
+		configured = append(configured, addr)
+	}
 	h.Unlock()
 
 	// iterate over the inbound set.
@@ -174,10 +296,15 @@ func (h *HAProxySetManager) StopAll() {
 	// TODO: block until all child instances are cleaned up
 	h.logger.Debugf("StopAll called")
 	h.cxl()
+	for key := range h.observed {
+		observe.Would(audit.SubsystemHAProxy, "stop", key, "")
+	}
+	h.observed = map[string]string{}
 
 	// rebuild the internal state
 	h.sources = map[string]HAProxy{}
 	h.cancelFuncs = map[string]context.CancelFunc{}
+	h.pools = map[int]*pool{}
 
 	h.ctx, h.cxl = context.WithCancel(h.parentCtx)
 }
@@ -188,12 +315,26 @@ func (h *HAProxySetManager) StopOne(listenAddrWithPort string) {
 	h.Lock()
 	defer h.Unlock()
 	h.logger.Debugf("StopOne called for %v", listenAddrWithPort)
+	h.stop(listenAddrWithPort)
+}
 
-	if cxl, ok := h.cancelFuncs[listenAddrWithPort]; ok {
-		cxl()
-		delete(h.cancelFuncs, listenAddrWithPort)
-		delete(h.sources, listenAddrWithPort)
+// stop stops a listener and takes it out of its pool, if it has one.
+func (h *HAProxySetManager) stop(instanceKey string) {
+	if _, ok := h.observed[instanceKey]; ok {
+		observe.Would(audit.SubsystemHAProxy, "stop", instanceKey, "")
+		delete(h.observed, instanceKey)
+		return
+	}
+	cxl, ok := h.cancelFuncs[instanceKey]
+	if !ok {
+		return
+	}
+	cxl()
+	if instance, ok := h.sources[instanceKey].(*HAProxyManager); ok && instance.pool != nil {
+		instance.pool.leave(instance)
 	}
+	delete(h.cancelFuncs, instanceKey)
+	delete(h.sources, instanceKey)
 }
 
 // Configure creates an haproxy config from a given v6 backend and set of pods.
@@ -209,6 +350,7 @@ func (h *HAProxySetManager) Configure(config VIPConfig) error {
 	targetPort := config.TargetPort
 	servicePort := config.ServicePort
 	mtu := config.MTU
+	options := config.Options
 
 	h.logger.Debugf("configuring s=%v d=%v tPort=%v sPort=%v", listenAddr, podIPs, targetPort, servicePort)
 	h.Lock()
@@ -216,10 +358,33 @@ func (h *HAProxySetManager) Configure(config VIPConfig) error {
 
 	instanceKey := h.createInstanceKey(listenAddr, servicePort)
 
+	if observe.Enabled() {
+		h.observe(instanceKey, config)
+		return nil
+	}
+
+	// a listener moving between haproxy and the native proxy is replaced
+	native := h.native(options)
+	if instance, found := h.sources[instanceKey]; found {
+		if _, isNative := instance.(*nativeProxy); isNative != native {
+			h.stop(instanceKey)
+		}
+	}
+
 	// create the instance if it doesn't exist
 	if _, found := h.sources[instanceKey]; !found {
 		c2, cxl := context.WithCancel(h.ctx)
-		instance, err := NewHAProxy(c2, h.binary, h.configDir, listenAddr, mtu, podIPs, targetPort, servicePort, h.errChan, h.logger)
+		var instance HAProxy
+		var err error
+		if native {
+			p := newNativeProxy(c2, listenAddr, servicePort, h.logger)
+			p.access = h.settings.AccessLog
+			instance = p
+		} else if h.settings.Pools > 0 {
+			instance, err = newHAProxy(c2, h.binary, h.configDir, listenAddr, mtu, podIPs, targetPort, servicePort, options, h.settings, h.poolFor(instanceKey), h.errChan, h.logger)
+		} else {
+			instance, err = NewHAProxy(c2, h.binary, h.configDir, listenAddr, mtu, podIPs, targetPort, servicePort, options, h.settings, h.errChan, h.logger)
+		}
 		if err != nil {
 			h.logger.Errorf("error creating new haproxy. canceling context. %v", err)
 			cxl()
@@ -230,7 +395,25 @@ func (h *HAProxySetManager) Configure(config VIPConfig) error {
 	}
 
 	// then configure it
-	return h.sources[instanceKey].Reload(podIPs, targetPort, servicePort, mtu)
+	return h.sources[instanceKey].Reload(podIPs, targetPort, servicePort, mtu, options)
+}
+
+// observe records the listener that Configure would start or reload, when
+// what it would run differs from the last time.
+func (h *HAProxySetManager) observe(instanceKey string, config VIPConfig) {
+	proxy := ProxyHAProxy
+	if h.native(config.Options) {
+		proxy = ProxyNative
+	}
+	detail := fmt.Sprintf("%s to %s port %s mtu %s", proxy, strings.Join(config.PodIPs, ","), config.TargetPort, config.MTU)
+	last, found := h.observed[instanceKey]
+	switch {
+	case !found:
+		observe.Would(audit.SubsystemHAProxy, "start", instanceKey, detail)
+	case last != detail:
+		observe.Would(audit.SubsystemHAProxy, "reload", instanceKey, detail)
+	}
+	h.observed[instanceKey] = detail
 }
 
 func (h *HAProxySetManager) createInstanceKey(listenAddr, servicePort string) string {
@@ -250,7 +433,7 @@ func (h *HAProxySetManager) run() {
 			delete(h.sources, instanceError.Source)
 			delete(h.cancelFuncs, instanceError.Source)
 			c2, cxl := context.WithCancel(h.ctx)
-			if instance, err := NewHAProxy(c2, h.binary, h.configDir, instanceError.Source, instanceError.MTU, instanceError.Dest, instanceError.TargetPort, instanceError.ServicePort, h.errChan, h.logger); err != nil {
+			if instance, err := NewHAProxy(c2, h.binary, h.configDir, instanceError.Source, instanceError.MTU, instanceError.Dest, instanceError.TargetPort, instanceError.ServicePort, instanceError.Options, h.settings, h.errChan, h.logger); err != nil {
 				h.logger.Errorf("error recreating haproxy. canceling context. %v", err)
 				cxl()
 				h.errChan <- instanceError
@@ -274,11 +457,12 @@ type HAProxyError struct {
 	TargetPort  string
 	MTU         string
 	ServicePort string
+	Options     ListenerOptions
 }
 
 // HAProxy defines what an HAProxy should be able to do
 type HAProxy interface {
-	Reload(podIPs []string, targetPort string, servicePort string, mtu string) error
+	Reload(podIPs []string, targetPort string, servicePort string, mtu string, options ListenerOptions) error
 }
 
 // HAProxyManager manages a single running HAProxy instance
@@ -291,30 +475,43 @@ type HAProxyManager struct {
 	targetPort  string
 	servicePort string
 	mtu         string
-
-	rendered []byte
-	template *template.Template
-
-	cmd     *exec.Cmd
+	options     ListenerOptions
+
+	// pods removed through the runtime API whose servers still have
+	// connections.
+	draining map[string]bool
+
+	rendered     []byte
+	templates    *Templates
+	masterWorker bool
+	// pool hosts the listener in a process shared with other listeners, or
+	// is nil when the listener runs a process of its own.
+	pool *pool
+	// access receives the access logs of the listener, if set.
+	access *AccessLog
+
+	proc    supervisor
+	status  listenerStatus
 	errChan chan HAProxyError
 
 	ctx    context.Context
-	logger logrus.FieldLogger
+	logger logging.Logger
 }
 
-type templateContext struct {
-	TargetPort  string
-	ServicePort string
-	MTU         string
-	Source      string
-	DestIPs     []string
+// NewHAProxy creates a new HAProxyManager instance
+func NewHAProxy(ctx context.Context, binary string, configDir, listenAddr, mtu string, podIPs []string, targetPort, servicePort string, options ListenerOptions, settings Settings, errChan chan HAProxyError, logger logging.Logger) (*HAProxyManager, error) {
+	return newHAProxy(ctx, binary, configDir, listenAddr, mtu, podIPs, targetPort, servicePort, options, settings, nil, errChan, logger)
 }
 
-// NewHAProxy creates a new HAProxyManager instance
-func NewHAProxy(ctx context.Context, binary string, configDir, listenAddr, mtu string, podIPs []string, targetPort, servicePort string, errChan chan HAProxyError, logger logrus.FieldLogger) (*HAProxyManager, error) {
-	t, err := template.New("conf").Parse(haproxyConfig)
-	if err != nil {
-		return nil, err
+// newHAProxy creates a listener, in a process of its own or as a frontend of
+// p when it is set.
+func newHAProxy(ctx context.Context, binary string, configDir, listenAddr, mtu string, podIPs []string, targetPort, servicePort string, options ListenerOptions, settings Settings, p *pool, errChan chan HAProxyError, logger logging.Logger) (*HAProxyManager, error) {
+	if !fileExists(binary) {
+		return nil, fmt.Errorf("no haproxy binary at %s. s=%s p=%v", binary, listenAddr, servicePort)
+	}
+	templates := settings.Templates
+	if templates == nil {
+		templates = defaultTemplates
 	}
 
 	h := &HAProxyManager{
@@ -326,126 +523,163 @@ func NewHAProxy(ctx context.Context, binary string, configDir, listenAddr, mtu s
 		targetPort:  targetPort,
 		servicePort: servicePort,
 		mtu:         mtu,
+		options:     options,
 		errChan:     errChan,
-
-		template: t,
-		ctx:      ctx,
-		logger:   logger,
+		draining:    map[string]bool{},
+
+		templates:    templates,
+		masterWorker: settings.MasterWorker,
+		pool:         p,
+		access:       settings.AccessLog,
+		ctx:          ctx,
+		logger:       logger,
 	}
 
 	// bootstrap the configuration. this is redundant with the operations in Reload()
-	if b, err := h.render(podIPs, targetPort, servicePort, mtu); err != nil {
+	if err := h.writeCertificate(options.TLSCertificate); err != nil {
+		return nil, fmt.Errorf("error writing certificate. s=%s p=%v. %v", h.listenAddr, servicePort, err)
+	}
+	if b, err := h.render(podIPs, targetPort, servicePort, mtu, options); err != nil {
 		return nil, fmt.Errorf("error rendering configuration. s=%s d=%v p=%v. %v", h.listenAddr, h.podIPs, targetPort, err)
+	} else if err := h.preflight(b); err != nil {
+		h.writeCertificate("")
+		return nil, fmt.Errorf("invalid haproxy configuration. s=%s d=%v p=%v. %v", h.listenAddr, h.podIPs, targetPort, err)
 	} else if err := h.write(b); err != nil {
 		return nil, fmt.Errorf("error writing configuration. s=%s d=%v p=%v. %v", h.listenAddr, h.podIPs, targetPort, err)
+	} else {
+		h.keep(b)
 	}
 
-	// spin up the process
-	go h.run()
+	// a pooled listener is added to the running process of its pool
+	if h.pool != nil {
+		h.pool.join(h)
+		if err := h.pool.reload(); err != nil {
+			h.pool.leave(h)
+			return nil, fmt.Errorf("unable to reload haproxy pool. s=%s p=%v. %v", h.listenAddr, servicePort, err)
+		}
+		return h, nil
+	}
+
+	// spin up the process. the configuration of a process left running by
+	// an earlier ravel is unknown, so its sockets aren't taken over.
+	go h.run(false)
 
 	return h, nil
 }
 
-func (h *HAProxyManager) run() {
-	//  fetch the pid of the parent process, if it exists
-	pid, err := h.findPIDForProcess()
-	if err != nil {
-		h.logger.Warnf("failed to execute command to find pid: %v", err)
+// run starts haproxy, taking over from the running process for this
+// listener if there is one, and its listening sockets when takeSockets is set.
+// It restarts the process if it exits without being replaced or stopped.
+func (h *HAProxyManager) run(takeSockets bool) {
+	for {
+		//  fetch the pid of the parent process, if it exists
+		pid, err := h.findPIDForProcess()
+		if err != nil {
+			h.logger.Warnf("failed to execute command to find pid: %v", err)
+		}
+
+		args := h.args(pid, takeSockets)
+		h.logger.Debugf("starting haproxy with binary %v and args %v", h.binary, args)
+		// haproxy runs until the listener is stopped, so it is bound to the
+		// listener's context rather than a timeout
+		cmd := privsep.CommandContext(h.ctx, h.binary, args...)
+		err = cmd.Start()
+		h.proc.start(cmd, time.Now())
+		if err == nil {
+			h.logger.Debugf("waiting for exit code")
+			err = cmd.Wait()
+		}
+
+		if h.ctx.Err() != nil {
+			h.logger.Infof("haproxy stopped with its listener. s=%s p=%v", h.listenAddr, h.servicePort)
+			return
+		}
+		wait, crashed := h.proc.exited(cmd, time.Now())
+		if !crashed {
+			h.logger.Infof("exited due to reload of process. s=%s p=%v. %v", h.listenAddr, h.servicePort, err)
+			return
+		}
+		h.logger.Errorf("haproxy exited unexpectedly, restarting in %v. s=%s p=%v. %v", wait, h.listenAddr, h.servicePort, err)
+
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if !h.proc.restart(cmd) {
+			return
+		}
+		// a process that died has no sockets to hand over
+		takeSockets = false
 	}
+}
 
+// args returns the arguments to start haproxy with, taking over from the
+// process with pid if it is set.
+func (h *HAProxyManager) args(pid string, takeSockets bool) []string {
 	// args for normal instantiation of a haproxy instance
 	args := []string{"-f", h.filename()}
+	if h.masterWorker {
+		args = append([]string{"-W"}, args...)
+	}
 	// did we find a running process for this filename?
 	if pid != "" {
 		// this set of arguments is proscribed by haproxy to run a zero downtime or "hitless" reload
 		// detailed in https://www.haproxy.com/blog/truly-seamless-reloads-with-haproxy-no-more-hacks/
 		// it is used to initialize the first run of an haproxy instance or a reload() interchangeably
-		args = []string{"-f", h.filename(), "-p", "/var/run/haproxy.pid", "-sf", pid}
-	}
-
-	h.logger.Debugf("starting haproxy with binary %v and args %v", h.binary, args)
-	cmdCtx, cmdContextCancel := context.WithTimeout(h.ctx, time.Second*20)
-	defer cmdContextCancel()
-	cmd := exec.CommandContext(cmdCtx, h.binary, args...)
-	h.cmd = cmd
-
-	cmdErr := make(chan error, 1)
-	go func() {
-		h.logger.Debugf("waiting for exit code")
-		cmdErr <- cmd.Run()
-		h.logger.Debugf("command exited")
-	}()
-
-	for {
-		select {
-		case <-h.ctx.Done():
-			/*
-				// Keeping this around as an example of how to gracefully shutdown when the parent context is closed.
-				// In this case, HAProxy would progress through SIGUSR1, SIGTERM, finally SIGKILL. What's missing from this
-				// is a way to communicate back to the caller that haproxy has been killed.
-				// At any rate, get rid of CommandContext and instead deal with the complexity here. Implement HAProxy.Done()
-				// or somesuch to deal with the communication factor.
-
-				// if the context completes, the process needs to be stopped gracefully
-				if err := h.cmd.Process.Signal(syscall.SIGUSR1); err != nil {
-				        h.sendError(fmt.Errorf("haproxy could not receive sigusr1. s=%s d=%s p=%v. %v", h.listenAddr, h.serviceAddrs, h.ports, err))
-				        return
-				} else {
-				        select {
-				        case <-time.After(5000 * time.Millisecond):
-				        case <-cmdErr:
-				                return
-				        }
-				}
-
-				// okay, so graceful shutdown didn't work. send SIGTERM
-				if err := h.cmd.Process.Signal(syscall.SIGTERM); err != nil {
-				        h.sendError(fmt.Errorf("haproxy could not receive sigterm. s=%s d=%s p=%v. %v", h.listenAddr, h.serviceAddrs, h.ports, err))
-				        return
-				} else {
-				        select {
-				        case <-time.After(2000 * time.Millisecond):
-				        case <-cmdErr:
-				                return
-				        }
-				}
-
-				// kill the process
-				if err := h.cmd.Process.Signal(syscall.SIGKILL); err != nil {
-				        h.sendError(fmt.Errorf("haproxy could not receive sigkill. s=%s d=%s p=%v. %v", h.listenAddr, h.serviceAddrs, h.ports, err))
-				        return
-				}
-				return
-			*/
-
-		case err := <-cmdErr:
-			if err == nil {
-				h.logger.Infof("exited without error due to reload or shutdown of process")
-				return
-			}
-			e2 := fmt.Errorf("haproxy exited with error. s=%s d=%s p=%v. %v", h.listenAddr, h.podIPs, h.targetPort, err)
-			h.logger.Errorf("wat. %v", e2)
-			// the the command errors out, we need to report the error
-			h.sendError(e2)
-			return
+		args = append(args, "-p", "/var/run/haproxy.pid", "-sf", pid)
+		// the listening sockets are taken from the old process rather than
+		// bound again, so no connection is refused in between.
+		if takeSockets {
+			args = append(args, "-x", h.statsSocket())
 		}
 	}
+	return args
 }
 
-// Reload rewrites the configuration and sends a signal to HAProxy to initiate the reload
-func (h *HAProxyManager) Reload(podIPs []string, targetPort, servicePort, mtu string) error {
-	// compare mtu, ports, and pods, and do nothing if they are the same.
-	if mtu == h.mtu && targetPort == h.targetPort && servicePort == h.servicePort && reflect.DeepEqual(podIPs, h.podIPs) {
+// Reload rewrites the configuration and applies it to HAProxy. A change to the
+// pods alone is applied through the runtime API; anything else is checked
+// with haproxy -c and reloads. A change that fails either way is rolled back.
+func (h *HAProxyManager) Reload(podIPs []string, targetPort, servicePort, mtu string, options ListenerOptions) error {
+	// compare mtu, ports, options and pods, and do nothing if they are the same.
+	if mtu == h.mtu && targetPort == h.targetPort && servicePort == h.servicePort && reflect.DeepEqual(options, h.options) && reflect.DeepEqual(podIPs, h.podIPs) {
 		return nil
 	}
 
 	// render template
-	b, err := h.render(podIPs, targetPort, servicePort, mtu)
+	b, err := h.render(podIPs, targetPort, servicePort, mtu, options)
 	if err != nil {
-		return fmt.Errorf("error rendering configuration. s=%s d=%v p=%v. %v", h.listenAddr, h.podIPs, targetPort, err)
+		err = fmt.Errorf("error rendering configuration. s=%s d=%v p=%v. %v", h.listenAddr, h.podIPs, targetPort, err)
+		h.reject(err)
+		return err
+	}
+
+	// only the pods changed, so update the running process and keep its connections
+	if mtu == h.mtu && targetPort == h.targetPort && servicePort == h.servicePort && reflect.DeepEqual(options, h.options) {
+		err := h.updateServers(podIPs)
+		if err == nil {
+			if err := h.write(b); err != nil {
+				return fmt.Errorf("error writing configuration. s=%s d=%v p=%v. %v", h.listenAddr, podIPs, targetPort, err)
+			}
+			h.logger.Debugf("updated servers of s=%s p=%v without a reload", h.listenAddr, servicePort)
+			h.keep(b)
+			h.podIPs = podIPs
+			h.applied("update")
+			return nil
+		}
+		h.logger.Warnf("unable to update servers through the runtime api, reloading. s=%s p=%v. %v", h.listenAddr, servicePort, err)
 	}
 
-	// write template
+	// write the certificate, and check the configuration against it before
+	// writing it in place of the running one
+	if err := h.writeCertificate(options.TLSCertificate); err != nil {
+		return fmt.Errorf("error writing certificate. s=%s p=%v. %v", h.listenAddr, servicePort, err)
+	}
+	if err := h.preflight(b); err != nil {
+		h.unroll()
+		h.reject(err)
+		return fmt.Errorf("invalid haproxy configuration. s=%s d=%v p=%v. %v", h.listenAddr, podIPs, targetPort, err)
+	}
 	if err := h.write(b); err != nil {
 		return fmt.Errorf("error writing configuration. s=%s d=%v p=%v. %v", h.listenAddr, h.podIPs, targetPort, err)
 	}
@@ -454,47 +688,113 @@ func (h *HAProxyManager) Reload(podIPs []string, targetPort, servicePort, mtu st
 	if err := h.reload(); err != nil {
 		// if things go wrong, unroll the write
 		h.unroll()
+		h.reject(err)
 		return fmt.Errorf("unable to reload haproxy. s=%s d=%v p=%v. %v", h.listenAddr, h.podIPs, targetPort, err)
 	}
 
-	h.rendered = b
+	h.keep(b)
 	h.targetPort = targetPort
 	h.podIPs = podIPs
 	h.servicePort = servicePort
+	h.mtu = mtu
+	h.options = options
+	// the new process starts with only the servers in the configuration
+	if h.pool == nil {
+		h.draining = map[string]bool{}
+	}
+	h.applied("reload")
 
 	return nil
 }
 
 // render accepts a list of ports and renders a valid HAProxy configuration to forward traffic from
-// h.listenAddr to h.serviceAddrs on each port.
-func (h *HAProxyManager) render(podIPs []string, targetPort, servicePort, mtu string) ([]byte, error) {
-
-	// prepare the context
-	d := []templateContext{
-		{
-			TargetPort:  targetPort,
-			ServicePort: servicePort,
-			MTU:         mtu,
-			Source:      h.listenAddr,
-			DestIPs:     podIPs,
-		},
-	}
-
-	// render the template
-	buf := &bytes.Buffer{}
-	if err := h.template.Execute(buf, d); err != nil {
+// h.listenAddr to h.serviceAddrs on each port. A pooled listener renders the
+// configuration of its pool.
+func (h *HAProxyManager) render(podIPs []string, targetPort, servicePort, mtu string, options ListenerOptions) ([]byte, error) {
+	d, err := h.templateData(podIPs, targetPort, servicePort, mtu, options)
+	if err != nil {
 		return nil, err
 	}
+	if h.pool != nil {
+		return h.pool.render(h, &d)
+	}
+	return h.templates.render(d)
+}
 
-	return buf.Bytes(), nil
+// templateData prepares the template data of the listener.
+func (h *HAProxyManager) templateData(podIPs []string, targetPort, servicePort, mtu string, options ListenerOptions) (TemplateData, error) {
+	snippet, err := h.templates.snippet(h.listenAddr, servicePort)
+	if err != nil {
+		return TemplateData{}, fmt.Errorf("unable to read haproxy snippet. %v", err)
+	}
+
+	// prepare the context
+	d := TemplateData{
+		Name:           h.backendName(),
+		TargetPort:     targetPort,
+		ServicePort:    servicePort,
+		MTU:            mtu,
+		Source:         h.listenAddr,
+		DestIPs:        podIPs,
+		ServerAddrs:    []string{},
+		StatsSocket:    h.statsSocket(),
+		StatsSocketUID: statsSocketUID(),
+		AcceptProxy:    options.AcceptProxy,
+		ServerArgs:     options.serverArgs(),
+		Snippet:        snippet,
+	}
+	for _, ip := range podIPs {
+		d.ServerAddrs = append(d.ServerAddrs, options.serverAddress(ip, targetPort))
+	}
+	if check := options.HealthCheck; check.Enabled {
+		d.HTTPCheckPath = check.HTTPPath
+		d.HTTPCheckExpect = check.HTTPExpect
+	}
+	if options.TLSCertificate != "" {
+		d.TLSCertFile = h.certFile()
+	}
+	if h.access != nil {
+		d.AccessLog = h.access.socket
+		d.AccessLogFormat = accessLogFormat
+		if options.L7Mode == L7HTTP {
+			d.AccessLogFormat += accessLogHTTP
+		}
+	}
+	if limits := options.Limits; limits != (Limits{}) {
+		d.MaxConn = limits.MaxConn
+		d.ConnectTimeout = timeout(limits.ConnectTimeout)
+		d.ClientTimeout = timeout(limits.ClientTimeout)
+		d.ServerTimeout = timeout(limits.ServerTimeout)
+		d.HTTPKeepAliveTimeout = timeout(limits.HTTPKeepAliveTimeout)
+		d.TCPKeepAlive = limits.TCPKeepAlive
+	}
+	if options.L7Mode != "" {
+		d.L7Mode = options.L7Mode
+		d.Routes = h.routeData(options)
+		d.InspectSNI = options.L7Mode == L7SNI && options.TLSCertificate == ""
+	}
+	return d, nil
 }
 
 // restart the process and overwrite the command context for this server
 // run() performs a hitless reload of the haproxy, deciding on the fly
 // whether a reload or first-run is needed
-// this ends the parent process and starts a new one as well
+// this ends the parent process and starts a new one as well, except in
+// master-worker mode, where the master stays and replaces its worker. A
+// pooled listener reloads its pool.
 func (h *HAProxyManager) reload() error {
-	go h.run()
+	if h.pool != nil {
+		return h.pool.reload()
+	}
+	// a master reloads its workers itself, handing them the listening sockets
+	if process := h.proc.process(); h.masterWorker && process != nil {
+		if err := process.Signal(syscall.SIGUSR2); err == nil {
+			return nil
+		}
+	}
+	// the old process can only hand over its sockets if its stats socket
+	// exposes them. otherwise the new process would refuse to start.
+	go h.run(bytes.Contains(h.rendered, []byte("expose-fd listeners")))
 	return nil
 }
 
@@ -510,19 +810,69 @@ func (h *HAProxyManager) write(b []byte) error {
 	return err
 }
 
-// filename returns the configuration filename, concatenating the configDir, the ipv6 address, and .conf
+// filename returns the configuration filename, concatenating the configDir, the ipv6 address, and .conf.
+// A pooled listener shares the file of its pool.
 func (h *HAProxyManager) filename() string {
+	if h.pool != nil {
+		return h.pool.current().filename()
+	}
 	return filepath.Join(h.configDir, h.listenAddr+"-"+h.servicePort+".conf")
 }
 
+// certFile returns the path of the TLS certificate bundle, alongside the configuration file.
+func (h *HAProxyManager) certFile() string {
+	return filepath.Join(h.configDir, h.listenAddr+"-"+h.servicePort+".pem")
+}
+
+// writeCertificate writes the certificate bundle readable only by its owner,
+// or removes it when TLS is off.
+func (h *HAProxyManager) writeCertificate(pem string) error {
+	if pem == "" {
+		if err := os.Remove(h.certFile()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(h.certFile(), []byte(pem), 0600)
+}
+
+// statsSocket returns the path of the stats socket, alongside the configuration file.
+func (h *HAProxyManager) statsSocket() string {
+	return filepath.Join(h.configDir, h.listenAddr+"-"+h.servicePort+".sock")
+}
+
+// statsSocketUID is the user ravel runs as when haproxy is started by the
+// privileged helper, which would otherwise leave the stats socket to root.
+func statsSocketUID() int {
+	if privsep.Enabled() {
+		return os.Getuid()
+	}
+	return 0
+}
+
 // unroll is called by Reload when an error is generated after a new config file is written.
 // It overwrites the file on disk with the former configuration.
 func (h *HAProxyManager) unroll() {
-	if err := h.write(h.rendered); err != nil {
+	rendered := h.rendered
+	if h.pool != nil {
+		rendered = h.pool.current().rendered
+	}
+	if err := h.write(rendered); err != nil {
+		h.sendError(err)
+	}
+	if err := h.writeCertificate(h.options.TLSCertificate); err != nil {
 		h.sendError(err)
 	}
 }
 
+// keep records b as the configuration the process of the listener runs.
+func (h *HAProxyManager) keep(b []byte) {
+	h.rendered = b
+	if h.pool != nil {
+		h.pool.keep(b)
+	}
+}
+
 func (h *HAProxyManager) sendError(err error) {
 	msg := HAProxyError{
 		Error:       fmt.Errorf("unable to unroll haproxy config. config on disk and config in memory may be out of sync. s=%s d=%v. %v", h.listenAddr, h.podIPs, err),
@@ -531,6 +881,7 @@ func (h *HAProxyManager) sendError(err error) {
 		TargetPort:  h.targetPort,
 		MTU:         h.mtu,
 		ServicePort: h.servicePort,
+		Options:     h.options,
 	}
 	select {
 	case h.errChan <- msg:
@@ -1,10 +1,30 @@
 package haproxy
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/logging"
 )
 
 func returnNewHAProxy() (*HAProxyManager, error) {
@@ -16,8 +36,10 @@ func returnNewHAProxy() (*HAProxyManager, error) {
 		[]string{"192.168.12.12", "192.168.12.13", "192.168.12.14"},
 		"8080",
 		"50312",
+		ListenerOptions{},
+		Settings{},
 		make(chan HAProxyError),
-		logrus.New())
+		logging.New())
 }
 
 func TestRender(t *testing.T) {
@@ -83,3 +105,1197 @@ func TestGetPID(t *testing.T) {
 		t.Fatalf("did not find appropriate pid: expected %s, saw %s", "850", pid)
 	}
 }
+
+// trimmed output of `show stat` from a realserver
+var showStat = `# pxname,svname,qcur,qmax,scur,smax,slim,stot,bin,bout,dreq,dresp,ereq,econ,eresp,wretr,wredis,status
+listen6-8080,FRONTEND,,,3,10,2000,1234,1000,2000,0,0,2,,,,,OPEN
+listen6-8080,192.168.12.12-8080,0,0,1,4,,600,500,1000,,0,,1,0,0,0,UP
+listen6-8080,BACKEND,0,0,3,10,200,1232,1000,2000,0,0,,1,0,0,0,UP
+
+`
+
+func TestParseStats(t *testing.T) {
+	rows, err := parseStats([]byte(showStat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, saw %d", len(rows))
+	}
+
+	for i, expected := range []struct {
+		proxy, server string
+		scur          float64
+		queue         bool
+	}{
+		{"frontend", "", 3, false},
+		{"server", "192.168.12.12-8080", 1, true},
+		{"backend", "", 3, true},
+	} {
+		row := rows[i]
+		if row.proxy != expected.proxy || row.server != expected.server {
+			t.Errorf("row %d: expected %s/%s, saw %s/%s", i, expected.proxy, expected.server, row.proxy, row.server)
+		}
+		if v, ok := row.value("scur"); !ok || v != expected.scur {
+			t.Errorf("row %d: expected scur %v, saw %v", i, expected.scur, v)
+		}
+		if _, ok := row.value("qcur"); ok != expected.queue {
+			t.Errorf("row %d: expected queue present %v", i, expected.queue)
+		}
+	}
+	if v, _ := rows[0].value("ereq"); v != 2 {
+		t.Errorf("expected 2 request errors on the frontend, saw %v", v)
+	}
+}
+
+func TestCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &HAProxyManager{
+		configDir:   dir,
+		listenAddr:  "2001:1eaf:bead:10ad:ba1a::1",
+		servicePort: "8080",
+		logger:      logging.New(),
+	}
+	l, err := net.Listen("unix", h.statsSocket())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			bufio.NewReader(conn).ReadString('\n')
+			io.WriteString(conn, showStat)
+			conn.Close()
+		}
+	}()
+
+	set := &HAProxySetManager{sources: map[string]HAProxy{"2001:1eaf:bead:10ad:ba1a::1:8080": h}}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewCollector(set, "realserver"))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	for _, f := range families {
+		counts[f.GetName()] = len(f.GetMetric())
+	}
+	for name, expected := range map[string]int{
+		"ravel_haproxy_up":               1,
+		"ravel_haproxy_sessions_current": 3,
+		"ravel_haproxy_sessions_total":   3,
+		"ravel_haproxy_queue_current":    2,
+		"ravel_haproxy_errors_total":     5,
+		"ravel_haproxy_crashes_total":    1,
+		"ravel_haproxy_restarts_total":   1,
+		"ravel_haproxy_listener_healthy": 1,
+	} {
+		if counts[name] != expected {
+			t.Errorf("%s: expected %d series, saw %d", name, expected, counts[name])
+		}
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	s := &supervisor{}
+	first, second := &exec.Cmd{}, &exec.Cmd{}
+	now := time.Now()
+
+	// crashes back off exponentially up to the max
+	s.start(first, now)
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		wait, crashed := s.exited(first, now)
+		if !crashed || wait != expected {
+			t.Fatalf("expected a crash and a wait of %v, saw %v %v", expected, crashed, wait)
+		}
+		if !s.restart(first) {
+			t.Fatal("expected a restart")
+		}
+	}
+	if s.crashLooping(now) {
+		t.Fatal("expected three crashes not to count as a crash loop")
+	}
+	if _, crashed := s.exited(first, now); !crashed || !s.crashLooping(now) {
+		t.Fatal("expected a fourth crash to count as a crash loop")
+	}
+	if s.crashLooping(now.Add(restartResetAfter)) {
+		t.Fatal("expected a process that stayed up not to be crash looping")
+	}
+	s.backoff = restartMaxBackoff
+	if wait, _ := s.exited(first, now); wait != restartMaxBackoff {
+		t.Fatalf("expected the backoff to stop at %v, saw %v", restartMaxBackoff, wait)
+	}
+
+	// a reload that replaces the process while it backs off wins
+	s.start(second, now)
+	if s.restart(first) {
+		t.Fatal("expected no restart of a replaced process")
+	}
+	if _, crashed := s.exited(first, now); crashed {
+		t.Fatal("expected the exit of a replaced process to be expected")
+	}
+
+	// a process that stayed up starts the backoff over
+	if wait, _ := s.exited(second, now.Add(restartResetAfter)); wait != restartMinBackoff {
+		t.Fatalf("expected the backoff to reset, saw %v", wait)
+	}
+
+	if crashes, restarts := s.counts(); crashes != 6 || restarts != 3 {
+		t.Fatalf("expected 6 crashes and 3 restarts, saw %d and %d", crashes, restarts)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a binary that passes the configuration check, then crashes every time
+	// it starts
+	runs := filepath.Join(dir, "runs")
+	binary := filepath.Join(dir, "haproxy")
+	if err := ioutil.WriteFile(binary, []byte("#!/bin/sh\n[ \"$1\" = -c ] && exit 0\necho run >> "+runs+"\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h, err := NewHAProxy(ctx, binary, dir, "2001:1eaf:bead:10ad:ba1a::1", "", []string{"10.0.0.1"}, "80", "8080", ListenerOptions{}, Settings{}, make(chan HAProxyError, 1), logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		b, _ := ioutil.ReadFile(runs)
+		if strings.Count(string(b), "run") >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected haproxy to be restarted after it crashed. saw %q", b)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if crashes, restarts := h.proc.counts(); crashes < 1 || restarts < 1 {
+		t.Fatalf("expected a crash and a restart, saw %d and %d", crashes, restarts)
+	}
+}
+
+func TestUpdateServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &HAProxyManager{
+		configDir:   dir,
+		listenAddr:  "2001:1eaf:bead:10ad:ba1a::1",
+		servicePort: "8080",
+		targetPort:  "80",
+		podIPs:      []string{"10.0.0.1", "10.0.0.2"},
+		draining:    map[string]bool{},
+		logger:      logging.New(),
+	}
+	l, err := net.Listen("unix", h.statsSocket())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the server deleted by the fake socket answers that it still has connections
+	busy := "listen6-8080/10.0.0.2-80"
+	commands := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			command, _ := bufio.NewReader(conn).ReadString('\n')
+			command = strings.TrimSpace(command)
+			commands <- command
+			switch {
+			case strings.Contains(command, "add server"):
+				io.WriteString(conn, "New server registered.\n")
+			case strings.HasSuffix(command, "del server "+busy):
+				io.WriteString(conn, "Server still has connections attached to it, cannot remove it.\n")
+			case strings.Contains(command, "del server"):
+				io.WriteString(conn, "Server deleted.\n")
+			}
+			conn.Close()
+		}
+	}()
+	sent := func() []string {
+		out := []string{}
+		for len(commands) > 0 {
+			out = append(out, <-commands)
+		}
+		return out
+	}
+
+	// 10.0.0.3 replaces 10.0.0.2, which keeps its connections
+	if err := h.updateServers([]string{"10.0.0.1", "10.0.0.3"}); err != nil {
+		t.Fatal(err)
+	}
+	h.podIPs = []string{"10.0.0.1", "10.0.0.3"}
+	expected := []string{
+		"experimental-mode on; add server listen6-8080/10.0.0.3-80 10.0.0.3:80",
+		"set server listen6-8080/10.0.0.3-80 state ready",
+		"set server listen6-8080/10.0.0.2-80 state maint",
+		"experimental-mode on; del server listen6-8080/10.0.0.2-80",
+	}
+	if saw := sent(); !reflect.DeepEqual(saw, expected) {
+		t.Fatalf("expected commands %v, saw %v", expected, saw)
+	}
+	if !h.draining["10.0.0.2"] {
+		t.Fatal("expected 10.0.0.2 to be draining")
+	}
+
+	// 10.0.0.2 comes back before its server was deleted
+	if err := h.updateServers([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"set server listen6-8080/10.0.0.2-80 state ready"}
+	if saw := sent(); !reflect.DeepEqual(saw, expected) {
+		t.Fatalf("expected commands %v, saw %v", expected, saw)
+	}
+	if len(h.draining) != 0 {
+		t.Fatalf("expected nothing draining, saw %v", h.draining)
+	}
+
+	// without a socket, the update fails so that the caller reloads
+	l.Close()
+	if err := h.updateServers([]string{"10.0.0.4"}); err == nil {
+		t.Fatal("expected an error without a runtime socket")
+	}
+}
+
+func TestRenderOptions(t *testing.T) {
+	h := &HAProxyManager{
+		configDir:   "/etc/ravel",
+		listenAddr:  "2001:1eaf:bead:10ad:ba1a::1",
+		servicePort: "8080",
+		templates:   defaultTemplates,
+	}
+
+	b, err := h.render([]string{"10.0.0.1"}, "80", "8080", "", ListenerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("-proxy")) {
+		t.Fatalf("expected no proxy protocol by default. saw\n%s", b)
+	}
+
+	b, err = h.render([]string{"10.0.0.1"}, "80", "8080", "", ListenerOptions{SendProxy: true, AcceptProxy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("10.0.0.1:80 send-proxy-v2")) {
+		t.Fatalf("expected servers to send proxy protocol v2. saw\n%s", b)
+	}
+	if !bytes.Contains(b, []byte("accept-proxy")) {
+		t.Fatalf("expected the bind to accept proxy protocol. saw\n%s", b)
+	}
+
+	b, err = h.render([]string{"10.0.0.1"}, "80", "8080", "", ListenerOptions{TLSCertificate: "pem"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("ssl crt /etc/ravel/2001:1eaf:bead:10ad:ba1a::1-8080.pem")) {
+		t.Fatalf("expected the bind to terminate tls. saw\n%s", b)
+	}
+
+	check := HealthCheck{Enabled: true, Interval: 5 * time.Second, Fall: 2, HTTPPath: "/healthz", HTTPExpect: "status 200"}
+	b, err = h.render([]string{"10.0.0.1"}, "80", "8080", "", ListenerOptions{SendProxy: true, HealthCheck: check})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"10.0.0.1:80 check inter 5000ms fall 2 send-proxy-v2", "option  httpchk GET /healthz", "http-check expect status 200"} {
+		if !bytes.Contains(b, []byte(want)) {
+			t.Fatalf("expected %q in the health checked config. saw\n%s", want, b)
+		}
+	}
+}
+
+func TestHealthCheckValidate(t *testing.T) {
+	for _, test := range []struct {
+		check HealthCheck
+		valid bool
+	}{
+		{HealthCheck{}, true},
+		{HealthCheck{Enabled: true}, true},
+		{HealthCheck{Enabled: true, Interval: time.Second, Rise: 1, Fall: 1}, true},
+		{HealthCheck{Enabled: true, HTTPPath: "/ready", HTTPExpect: "! rstring ^fail"}, true},
+		{HealthCheck{Enabled: true, HTTPPath: "/ready", HTTPExpect: "!rstring ^fail"}, false},
+		{HealthCheck{Enabled: true, Interval: time.Microsecond}, false},
+		{HealthCheck{Enabled: true, Rise: -1}, false},
+		{HealthCheck{Enabled: true, HTTPPath: "ready"}, false},
+		{HealthCheck{Enabled: true, HTTPPath: "/ready now"}, false},
+		{HealthCheck{Enabled: true, HTTPExpect: "status 200"}, false},
+		{HealthCheck{Enabled: true, HTTPPath: "/ready", HTTPExpect: "status"}, false},
+		{HealthCheck{Enabled: true, HTTPPath: "/ready", HTTPExpect: "code 200"}, false},
+		{HealthCheck{Enabled: true, HTTPPath: "/ready", HTTPExpect: "status 200\nserver x"}, false},
+	} {
+		if err := test.check.Validate(); (err == nil) != test.valid {
+			t.Errorf("%+v: expected valid %v, got %v", test.check, test.valid, err)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// snippets for the vip and port win over those for the port
+	write("8080.cfg", "        timeout client 1m\n")
+	write("2001:1eaf:bead:10ad:ba1a::1-8080.cfg", "        timeout client 1h\n")
+	templates, err := NewTemplates("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &HAProxyManager{
+		configDir:   "/etc/ravel",
+		listenAddr:  "2001:1eaf:bead:10ad:ba1a::1",
+		servicePort: "8080",
+		templates:   templates,
+	}
+	b, err := h.render([]string{"10.0.0.1"}, "80", "8080", "", ListenerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := bytes.Index(b, []byte("10.0.0.1:80"))
+	if snippet := bytes.Index(b, []byte("timeout client 1h")); server < 0 || snippet < server || bytes.Contains(b, []byte("timeout client 1m")) {
+		t.Fatalf("expected the listener's snippet after its servers. saw\n%s", b)
+	}
+
+	// an override template renders from the same data
+	override := write("override.tmpl", `global
+{{ range . }}    stats socket {{ .StatsSocket }} mode 600 level admin
+listen l
+    bind {{ .Source }}:{{ .ServicePort }}
+    balance leastconn
+{{ range .DestIPs }}    server {{ . }} {{ . }}:80
+{{ end }}{{ end }}`)
+	templates, err = NewTemplates(override, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.templates = templates
+	if b, err = h.render([]string{"10.0.0.1"}, "80", "8080", "", ListenerOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("balance leastconn")) {
+		t.Fatalf("expected the override template. saw\n%s", b)
+	}
+
+	// templates that don't render, or drop the stats socket, are rejected
+	for name, content := range map[string]string{
+		"unknown.tmpl":   `{{ range . }}{{ .Backends }}{{ end }}`,
+		"nosocket.tmpl":  `{{ range . }}listen l\n    bind {{ .Source }}:{{ .ServicePort }}{{ end }}`,
+		"malformed.tmpl": `{{ range . }`,
+	} {
+		if _, err := NewTemplates(write(name, content), ""); err == nil {
+			t.Errorf("%s: expected the template to be rejected", name)
+		}
+	}
+}
+
+func TestArgs(t *testing.T) {
+	h := &HAProxyManager{
+		configDir:   "/etc/ravel",
+		listenAddr:  "2001:1eaf:bead:10ad:ba1a::1",
+		servicePort: "8080",
+	}
+	conf := "/etc/ravel/2001:1eaf:bead:10ad:ba1a::1-8080.conf"
+	sock := "/etc/ravel/2001:1eaf:bead:10ad:ba1a::1-8080.sock"
+
+	for _, c := range []struct {
+		name         string
+		masterWorker bool
+		pid          string
+		takeSockets  bool
+		expected     []string
+	}{
+		{"first run", false, "", false, []string{"-f", conf}},
+		{"reload", false, "850", false, []string{"-f", conf, "-p", "/var/run/haproxy.pid", "-sf", "850"}},
+		{"reload with sockets", false, "850", true, []string{"-f", conf, "-p", "/var/run/haproxy.pid", "-sf", "850", "-x", sock}},
+		{"master first run", true, "", true, []string{"-W", "-f", conf}},
+		{"master takeover", true, "850", true, []string{"-W", "-f", conf, "-p", "/var/run/haproxy.pid", "-sf", "850", "-x", sock}},
+	} {
+		h.masterWorker = c.masterWorker
+		if args := h.args(c.pid, c.takeSockets); !reflect.DeepEqual(args, c.expected) {
+			t.Errorf("%s: expected %v, saw %v", c.name, c.expected, args)
+		}
+	}
+}
+
+func TestNativeProxy(t *testing.T) {
+	// a pod that answers with its name and what it read
+	pod := func(name string) (string, string) {
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				b, _ := ioutil.ReadAll(conn)
+				io.WriteString(conn, name+":"+string(b))
+				conn.Close()
+			}
+		}()
+		host, port, _ := net.SplitHostPort(l.Addr().String())
+		return host, port
+	}
+	podIP, targetPort := pod("a")
+	_, otherPort := pod("b")
+
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no ipv6 loopback. %v", err)
+	}
+	_, servicePort, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	set := &HAProxySetManager{
+		sources:     map[string]HAProxy{},
+		cancelFuncs: map[string]context.CancelFunc{},
+		ctx:         ctx,
+		settings:    Settings{Proxy: ProxyNative},
+		logger:      logging.New(),
+	}
+	config := VIPConfig{Addr6: "::1", PodIPs: []string{podIP}, TargetPort: targetPort, ServicePort: servicePort}
+	if err := set.Configure(config); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := set.sources["::1:"+servicePort].(*nativeProxy); !ok {
+		t.Fatalf("expected a native listener, saw %T", set.sources["::1:"+servicePort])
+	}
+
+	roundTrip := func(payload string) string {
+		conn, err := net.Dial("tcp6", net.JoinHostPort("::1", servicePort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, payload)
+		conn.(*net.TCPConn).CloseWrite()
+		b, err := ioutil.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	if out := roundTrip("hello"); out != "a:hello" {
+		t.Fatalf("expected the pod to echo the payload, saw %q", out)
+	}
+
+	// new pods and the proxy protocol apply without binding again
+	config.TargetPort = otherPort
+	config.Options.SendProxy = true
+	if err := set.Configure(config); err != nil {
+		t.Fatal(err)
+	}
+	out := roundTrip("hello")
+	if !strings.HasPrefix(out, "b:"+string(proxyV2Signature)) || !strings.HasSuffix(out, "hello") {
+		t.Fatalf("expected a proxy protocol header before the payload, saw %q", out)
+	}
+
+	// moving to haproxy replaces the listener
+	set.settings.Proxy = ProxyHAProxy
+	set.binary = "/nonexistent/haproxy"
+	if err := set.Configure(config); err == nil {
+		t.Fatal("expected haproxy to need its binary")
+	}
+	if _, found := set.sources["::1:"+servicePort]; found {
+		t.Fatal("expected the native listener to be removed")
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	b := proxyHeader(src, dst)
+	if len(b) != 16+36 || b[12] != 0x21 || b[13] != 0x21 || b[14] != 0 || b[15] != 36 {
+		t.Fatalf("unexpected v6 header %x", b)
+	}
+	if !net.IP(b[16:32]).Equal(src.IP) || b[48] != 0x9c || b[49] != 0x40 || b[51] != 0xbb {
+		t.Fatalf("unexpected v6 addresses %x", b[16:])
+	}
+
+	src.IP, dst.IP = net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	if b := proxyHeader(src, dst); len(b) != 16+12 || b[13] != 0x11 || !net.IP(b[16:20]).Equal(src.IP) {
+		t.Fatalf("unexpected v4 header %x", b)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	for _, test := range []struct {
+		mode   string
+		routes []Route
+		valid  bool
+	}{
+		{"", nil, true},
+		{"", []Route{{Host: "a.example.com"}}, false},
+		{"tls", nil, false},
+		{L7SNI, []Route{{Host: "a.example.com"}, {Host: "*.example.com"}}, true},
+		{L7HTTP, []Route{{Host: "a.example.com"}, {Host: "A.example.com"}}, false},
+		{L7HTTP, []Route{{Host: "a.*.com"}}, false},
+		{L7HTTP, []Route{{Host: "a.example.com }"}}, false},
+	} {
+		if err := ValidateL7(test.mode, test.routes); (err == nil) != test.valid {
+			t.Errorf("%s %+v: expected valid %v, got %v", test.mode, test.routes, test.valid, err)
+		}
+	}
+
+	h := &HAProxyManager{
+		configDir:   "/etc/ravel",
+		listenAddr:  "2001:1eaf:bead:10ad:ba1a::1",
+		servicePort: "443",
+		templates:   defaultTemplates,
+	}
+	routes := []Route{
+		{Host: "a.example.com", PodIPs: []string{"10.0.1.1", "10.0.1.2"}, TargetPort: "8443"},
+		{Host: "*.example.org", PodIPs: []string{"10.0.2.1"}, TargetPort: "9443"},
+	}
+
+	// sni is read from the client hello of connections passed through
+	b, err := h.render([]string{"10.0.0.1"}, "443", "443", "", ListenerOptions{L7Mode: L7SNI, Routes: routes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"tcp-request inspect-delay 5s",
+		"use_backend listen6-443-a.example.com if { req_ssl_sni -i a.example.com }",
+		"use_backend listen6-443-wildcard.example.org if { req_ssl_sni -i -m end .example.org }",
+		"backend listen6-443-a.example.com\n        mode    tcp\n        server  10.0.1.1-8443    10.0.1.1:8443",
+		"server  10.0.1.2-8443    10.0.1.2:8443",
+		"backend listen6-443-wildcard.example.org\n        mode    tcp\n        server  10.0.2.1-9443    10.0.2.1:9443",
+	} {
+		if !bytes.Contains(b, []byte(want)) {
+			t.Fatalf("expected %q in the sni config. saw\n%s", want, b)
+		}
+	}
+
+	// or from the handshake when the listener terminates tls
+	b, err = h.render([]string{"10.0.0.1"}, "443", "443", "", ListenerOptions{L7Mode: L7SNI, Routes: routes, TLSCertificate: "pem"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("inspect-delay")) || !bytes.Contains(b, []byte("if { ssl_fc_sni -i a.example.com }")) {
+		t.Fatalf("expected routing by the sni of terminated tls. saw\n%s", b)
+	}
+
+	// http routes each request by its host header
+	b, err = h.render([]string{"10.0.0.1"}, "443", "443", "", ListenerOptions{L7Mode: L7HTTP, Routes: routes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("mode    tcp")) || !bytes.Contains(b, []byte("if { hdr(host),field(1,:) -i a.example.com }")) {
+		t.Fatalf("expected http routing by host. saw\n%s", b)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	for _, test := range []struct {
+		limits Limits
+		valid  bool
+	}{
+		{Limits{}, true},
+		{Limits{MaxConn: 50000, ClientTimeout: time.Hour, TCPKeepAlive: true}, true},
+		{Limits{MaxConn: -1}, false},
+		{Limits{MaxConn: maxConnLimit + 1}, false},
+		{Limits{ServerTimeout: -time.Second}, false},
+		{Limits{ConnectTimeout: time.Microsecond}, false},
+	} {
+		if err := test.limits.Validate(); (err == nil) != test.valid {
+			t.Errorf("%+v: expected valid %v, got %v", test.limits, test.valid, err)
+		}
+	}
+
+	h := &HAProxyManager{
+		configDir:   "/etc/ravel",
+		listenAddr:  "2001:1eaf:bead:10ad:ba1a::1",
+		servicePort: "443",
+		templates:   defaultTemplates,
+	}
+	b, err := h.render([]string{"10.0.0.1"}, "443", "443", "", ListenerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("maxconn")) || bytes.Contains(b, []byte("tcpka")) {
+		t.Fatalf("expected no limits by default. saw\n%s", b)
+	}
+
+	limits := Limits{MaxConn: 50000, ConnectTimeout: 2 * time.Second, ClientTimeout: time.Hour, ServerTimeout: 90 * time.Second, HTTPKeepAliveTimeout: time.Second, TCPKeepAlive: true}
+	routes := []Route{{Host: "a.example.com", PodIPs: []string{"10.0.1.1"}, TargetPort: "8443"}}
+	b, err = h.render([]string{"10.0.0.1"}, "443", "443", "", ListenerOptions{Limits: limits, L7Mode: L7HTTP, Routes: routes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"maxconn 50000",
+		"timeout connect 2000ms",
+		"timeout client 3600000ms",
+		"timeout server 90000ms",
+		"timeout http-keep-alive 1000ms",
+		"option  tcpka",
+		"backend listen6-443-a.example.com\n        mode    http\n        timeout connect 2000ms\n        timeout server 90000ms\n        option  srvtcpka",
+	} {
+		if !bytes.Contains(b, []byte(want)) {
+			t.Fatalf("expected %q in the tuned config. saw\n%s", want, b)
+		}
+	}
+}
+
+func TestNativeMaxConn(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no ipv6 loopback. %v", err)
+	}
+	_, servicePort, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	// a pod that holds its connections open and reports each one
+	pod, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pod.Close()
+	accepted := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := pod.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				ioutil.ReadAll(conn)
+				conn.Close()
+			}()
+		}
+	}()
+	podIP, targetPort, _ := net.SplitHostPort(pod.Addr().String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := newNativeProxy(ctx, "::1", servicePort, logging.New())
+	if err := p.Reload([]string{podIP}, targetPort, servicePort, "", ListenerOptions{Limits: Limits{MaxConn: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp6", net.JoinHostPort("::1", servicePort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	first := dial()
+	defer first.Close()
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the first connection to be proxied")
+	}
+
+	// the second connection waits in the accept queue
+	second := dial()
+	defer second.Close()
+	select {
+	case <-accepted:
+		t.Fatal("expected the second connection to wait for the first")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// and is proxied once the first one ends
+	first.Close()
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the second connection to be proxied")
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a binary that rejects configurations with a bad line, and otherwise
+	// runs until it is stopped
+	binary := filepath.Join(dir, "haproxy")
+	script := "#!/bin/sh\nif [ \"$1\" = -c ]; then grep -q bad-line \"$3\" && echo '[ALERT] unknown keyword' && exit 1; exit 0; fi\nexec sleep 60\n"
+	if err := ioutil.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	snippets := filepath.Join(dir, "snippets")
+	if err := os.Mkdir(snippets, 0755); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := NewTemplates("", snippets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trail := audit.NewTrail(10)
+	audit.SetDefault(trail)
+	defer audit.SetDefault(audit.NewTrail(audit.DefaultSize))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h, err := NewHAProxy(ctx, binary, dir, "2001:1eaf:bead:10ad:ba1a::1", "", []string{"10.0.0.1"}, "80", "8080", ListenerOptions{}, Settings{Templates: templates}, make(chan HAProxyError, 1), logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(h.filename())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a rejected change leaves the running configuration in place
+	if err := ioutil.WriteFile(filepath.Join(snippets, "8080.cfg"), []byte("bad-line"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tuned := ListenerOptions{Limits: Limits{MaxConn: 10}}
+	if err := h.Reload([]string{"10.0.0.1"}, "80", "8080", "", tuned); err == nil || !strings.Contains(err.Error(), "unknown keyword") {
+		t.Fatalf("expected the change to be rejected, got %v", err)
+	}
+	after, _ := ioutil.ReadFile(h.filename())
+	if !bytes.Equal(before, after) || !reflect.DeepEqual(h.options, ListenerOptions{}) || h.status.get() == nil {
+		t.Fatalf("expected the previous configuration to be kept and the listener unhealthy. saw\n%s", after)
+	}
+	if events := trail.Events(audit.SubsystemHAProxy, "", 0); len(events) != 1 || events[0].Action != "reject" || events[0].Error == "" {
+		t.Fatalf("expected a reject event, saw %+v", events)
+	}
+
+	// and the listener recovers with the next change that applies
+	os.Remove(filepath.Join(snippets, "8080.cfg"))
+	if err := h.Reload([]string{"10.0.0.1"}, "80", "8080", "", tuned); err != nil {
+		t.Fatal(err)
+	}
+	if h.status.get() != nil || !reflect.DeepEqual(h.options, tuned) {
+		t.Fatalf("expected the change to apply, saw %v", h.status.get())
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &HAProxyManager{
+		configDir:   dir,
+		listenAddr:  "2001:1eaf:bead:10ad:ba1a::1",
+		servicePort: "8080",
+		targetPort:  "8080",
+		logger:      logging.New(),
+	}
+	l, err := net.Listen("unix", h.statsSocket())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	commands := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			command, _ := bufio.NewReader(conn).ReadString('\n')
+			command = strings.TrimSpace(command)
+			switch command {
+			case "show stat":
+				io.WriteString(conn, showStat)
+			case "show sess":
+				io.WriteString(conn, "0x55d1: proto=tcpv6 src=[2001:db8::9]:40000 fe=listen6-8080\n")
+			default:
+				commands <- command
+			}
+			conn.Close()
+		}
+	}()
+
+	set := &HAProxySetManager{sources: map[string]HAProxy{
+		"2001:1eaf:bead:10ad:ba1a::1:8080": h,
+		"2001:1eaf:bead:10ad:ba1a::1:53":   &nativeProxy{},
+	}}
+	handler := set.AdminHandler()
+	request := func(method, target string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(method, target, nil))
+		return rw
+	}
+
+	rw := request(http.MethodGet, "/haproxy/listeners")
+	listeners := []ListenerStatus{}
+	if err := json.NewDecoder(rw.Body).Decode(&listeners); err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 || listeners[0].Proxy != ProxyNative || listeners[1].Proxy != ProxyHAProxy || !listeners[1].Healthy {
+		t.Fatalf("unexpected listeners %+v", listeners)
+	}
+	if servers := listeners[1].Servers; len(servers) != 1 || servers[0].Server != "192.168.12.12-8080" || servers[0].Status != "UP" || servers[0].Sessions != "1" {
+		t.Fatalf("unexpected servers %+v", servers)
+	}
+
+	listener := "listener=" + url.QueryEscape("2001:1eaf:bead:10ad:ba1a::1:8080")
+	if rw := request(http.MethodGet, "/haproxy/sessions?"+listener); !strings.Contains(rw.Body.String(), "fe=listen6-8080") {
+		t.Fatalf("expected the sessions of the listener, saw %d %s", rw.Code, rw.Body)
+	}
+
+	for target, command := range map[string]string{
+		"/haproxy/server?" + listener + "&server=192.168.12.12&action=disable":                                     "disable server listen6-8080/192.168.12.12-8080",
+		"/haproxy/server?" + listener + "&server=192.168.12.12-8080&action=enable":                                 "enable server listen6-8080/192.168.12.12-8080",
+		"/haproxy/server?" + listener + "&server=listen6-8080-a.example.com/10.0.1.1-8443&action=weight&weight=50": "set weight listen6-8080-a.example.com/10.0.1.1-8443 50",
+	} {
+		if rw := request(http.MethodPost, target); rw.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, saw %d %s", target, rw.Code, rw.Body)
+		}
+		if sent := <-commands; sent != command {
+			t.Fatalf("%s: expected %q, sent %q", target, command, sent)
+		}
+	}
+
+	for target, code := range map[string]int{
+		"/haproxy/server?" + listener + "&server=" + url.QueryEscape("a; shutdown sessions") + "&action=disable":    http.StatusBadRequest,
+		"/haproxy/server?" + listener + "&server=192.168.12.12&action=drain":                                        http.StatusBadRequest,
+		"/haproxy/server?" + listener + "&server=192.168.12.12&action=weight&weight=300":                            http.StatusBadRequest,
+		"/haproxy/server?listener=missing&server=192.168.12.12&action=disable":                                      http.StatusNotFound,
+		"/haproxy/server?listener=" + url.QueryEscape("2001:1eaf:bead:10ad:ba1a::1:53") + "&server=a&action=enable": http.StatusConflict,
+	} {
+		if rw := request(http.MethodPost, target); rw.Code != code {
+			t.Fatalf("%s: expected %d, saw %d %s", target, code, rw.Code, rw.Body)
+		}
+	}
+	if rw := request(http.MethodGet, "/haproxy/server?"+listener); rw.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected changes to require a post, saw %d", rw.Code)
+	}
+	if len(commands) != 0 {
+		t.Fatalf("expected rejected requests to send nothing, saw %q", <-commands)
+	}
+}
+
+func TestPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a binary that rejects configurations with a bad line, and otherwise
+	// runs until it is stopped, noting its starts and reloads
+	runs := filepath.Join(dir, "runs")
+	binary := filepath.Join(dir, "haproxy")
+	script := "#!/bin/sh\nif [ \"$1\" = -c ]; then grep -q bad-line \"$3\" && exit 1; exit 0; fi\necho run >> " + runs + "\ntrap 'echo reload >> " + runs + "' USR2\nwhile true; do sleep 0.1; done\n"
+	if err := ioutil.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	waitFor := func(want string) {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			b, _ := ioutil.ReadFile(runs)
+			if string(b) == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected haproxy to note %q, saw %q", want, b)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	snippets := filepath.Join(dir, "snippets")
+	if err := os.Mkdir(snippets, 0755); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := NewTemplates("", snippets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	set, err := NewHAProxySet(ctx, binary, dir, logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	set.UseTemplates(templates)
+	set.UsePools(1)
+
+	// two listeners on the same port share one process
+	a := VIPConfig{Addr6: "2001:1eaf:bead:10ad:ba1a::1", PodIPs: []string{"10.0.0.1"}, TargetPort: "80", ServicePort: "8080"}
+	b := VIPConfig{Addr6: "2001:1eaf:bead:10ad:ba1a::2", PodIPs: []string{"10.0.0.2"}, TargetPort: "80", ServicePort: "8080"}
+	if err := set.Configure(a); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("run\n")
+	if err := set.Configure(b); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("run\nreload\n")
+	conf := filepath.Join(dir, "pool-0.conf")
+	shared, err := ioutil.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"stats socket " + filepath.Join(dir, "2001:1eaf:bead:10ad:ba1a::1-8080.sock"),
+		"stats socket " + filepath.Join(dir, "2001:1eaf:bead:10ad:ba1a::2-8080.sock"),
+		"listen listen6-2001:1eaf:bead:10ad:ba1a::1-8080\n",
+		"listen listen6-2001:1eaf:bead:10ad:ba1a::2-8080\n",
+	} {
+		if !bytes.Contains(shared, []byte(want)) {
+			t.Fatalf("expected %q in the pool. saw\n%s", want, shared)
+		}
+	}
+	hb := set.sources["2001:1eaf:bead:10ad:ba1a::2:8080"].(*HAProxyManager)
+	if !hb.owns("listen6-2001:1eaf:bead:10ad:ba1a::2-8080-a.example.com") || hb.owns("listen6-2001:1eaf:bead:10ad:ba1a::1-8080") {
+		t.Fatal("expected a listener to own only its frontend and routes")
+	}
+
+	// a change that haproxy rejects is rolled back for its listener alone
+	if err := ioutil.WriteFile(filepath.Join(snippets, "2001:1eaf:bead:10ad:ba1a::2-8080.cfg"), []byte("bad-line"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b.Options.Limits.MaxConn = 10
+	if err := set.Configure(b); err == nil {
+		t.Fatal("expected the change to be rejected")
+	}
+	if after, _ := ioutil.ReadFile(conf); !bytes.Equal(shared, after) || hb.status.get() == nil {
+		t.Fatalf("expected the pool to keep its configuration. saw\n%s", after)
+	}
+	os.Remove(filepath.Join(snippets, "2001:1eaf:bead:10ad:ba1a::2-8080.cfg"))
+
+	// a stopped listener leaves the pool, and the last one stops it
+	set.StopOne("2001:1eaf:bead:10ad:ba1a::1:8080")
+	waitFor("run\nreload\nreload\n")
+	if after, _ := ioutil.ReadFile(conf); bytes.Contains(after, []byte("ba1a::1-8080")) || !bytes.Contains(after, []byte("ba1a::2-8080")) {
+		t.Fatalf("expected only the remaining listener in the pool. saw\n%s", after)
+	}
+	set.StopOne("2001:1eaf:bead:10ad:ba1a::2:8080")
+	if p := set.pools[0]; p.running || len(p.members) != 0 {
+		t.Fatal("expected the pool to stop with its last listener")
+	}
+}
+
+func TestLocalBackend(t *testing.T) {
+	for pattern, valid := range map[string]bool{
+		"":                      true,
+		"/run/pods/{ip}.sock":   true,
+		"@svc-{ip}-{port}":      true,
+		"127.0.0.1:{port}":      true,
+		"[::1]:8080":            true,
+		"localhost:{port}":      false,
+		"/run/pods/{ip}.sock #": false,
+		"127.0.0.1:{ip}":        false,
+		"@":                     false,
+	} {
+		if err := ValidateLocalBackend(pattern); (err == nil) != valid {
+			t.Errorf("%q: expected valid %v, got %v", pattern, valid, err)
+		}
+	}
+
+	h := &HAProxyManager{
+		configDir:   "/etc/ravel",
+		listenAddr:  "2001:1eaf:bead:10ad:ba1a::1",
+		servicePort: "8080",
+		templates:   defaultTemplates,
+	}
+	for pattern, want := range map[string]string{
+		"":                    "server  10.0.0.1-80    10.0.0.1:80",
+		"/run/pods/{ip}.sock": "server  10.0.0.1-80    /run/pods/10.0.0.1.sock",
+		"@svc-{ip}":           "server  10.0.0.1-80    abns@svc-10.0.0.1",
+		"127.0.0.1:{port}":    "server  10.0.0.1-80    127.0.0.1:80",
+	} {
+		b, err := h.render([]string{"10.0.0.1"}, "80", "8080", "", ListenerOptions{LocalBackend: pattern})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(b, []byte(want)) {
+			t.Fatalf("%q: expected %q. saw\n%s", pattern, want, b)
+		}
+	}
+
+	// the native proxy dials the unix socket of a pod
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pod, err := net.Listen("unix", filepath.Join(dir, "10.0.0.1.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pod.Close()
+	go func() {
+		for {
+			conn, err := pod.Accept()
+			if err != nil {
+				return
+			}
+			b, _ := ioutil.ReadAll(conn)
+			io.WriteString(conn, "local:"+string(b))
+			conn.Close()
+		}
+	}()
+
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no ipv6 loopback. %v", err)
+	}
+	_, servicePort, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := newNativeProxy(ctx, "::1", servicePort, logging.New())
+	if err := p.Reload([]string{"10.0.0.1"}, "80", servicePort, "", ListenerOptions{LocalBackend: filepath.Join(dir, "{ip}.sock")}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp6", net.JoinHostPort("::1", servicePort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "ping")
+	conn.(*net.TCPConn).CloseWrite()
+	if b, _ := ioutil.ReadAll(conn); string(b) != "local:ping" {
+		t.Fatalf("expected the pod's socket to answer, saw %q", b)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	fields := parseAccessLog([]byte("client_ip=2001:db8::9 client_port=40000 vip=2001:db8::1 port=443 backend=listen6-443 server=10.0.0.1-8443 status=- uri=\n"))
+	if len(fields) != 6 || fields["client_ip"] != "2001:db8::9" || fields["server"] != "10.0.0.1-8443" {
+		t.Fatalf("unexpected fields %v", fields)
+	}
+
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger, hook := logtest.NewNullLogger()
+	socket := filepath.Join(dir, "access.sock")
+	access, err := NewAccessLog(ctx, socket, 2, logging.FromLogrus(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one line in every two is logged
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 4; i++ {
+		fmt.Fprintf(conn, "vip=2001:db8::1 port=443 backend=listen6-443 bytes_out=%d", i)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(hook.AllEntries()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	entries := hook.AllEntries()
+	if len(entries) != 2 || entries[0].Data["bytes_out"] != "0" || entries[1].Data["bytes_out"] != "2" || entries[1].Data["vip"] != "2001:db8::1" {
+		t.Fatalf("expected every other line as fields, saw %d entries", len(entries))
+	}
+
+	// listeners log to the socket in the format of their mode
+	h := &HAProxyManager{
+		configDir:   "/etc/ravel",
+		listenAddr:  "2001:1eaf:bead:10ad:ba1a::1",
+		servicePort: "8080",
+		templates:   defaultTemplates,
+		access:      access,
+	}
+	b, err := h.render([]string{"10.0.0.1"}, "80", "8080", "", ListenerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("log     "+socket+" len 4096 format raw local0 info\n        log-format client_ip=%ci\\ ")) || bytes.Contains(b, []byte("status=%ST")) {
+		t.Fatalf("expected a tcp access log. saw\n%s", b)
+	}
+	if b, err = h.render([]string{"10.0.0.1"}, "80", "8080", "", ListenerOptions{L7Mode: L7HTTP}); err != nil || !bytes.Contains(b, []byte(`\ status=%ST`)) {
+		t.Fatalf("expected an http access log. saw %v\n%s", err, b)
+	}
+
+	// and native listeners log their connections
+	hook.Reset()
+	pod, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pod.Close()
+	go func() {
+		conn, err := pod.Accept()
+		if err == nil {
+			ioutil.ReadAll(conn)
+			io.WriteString(conn, "pong")
+			conn.Close()
+		}
+	}()
+	podIP, targetPort, _ := net.SplitHostPort(pod.Addr().String())
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no ipv6 loopback. %v", err)
+	}
+	_, servicePort, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	p := newNativeProxy(ctx, "::1", servicePort, logging.New())
+	p.access = &AccessLog{sample: 1, logger: logging.FromLogrus(logger)}
+	if err := p.Reload([]string{podIP}, targetPort, servicePort, "", ListenerOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.Dial("tcp6", net.JoinHostPort("::1", servicePort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(client, "ping")
+	client.(*net.TCPConn).CloseWrite()
+	ioutil.ReadAll(client)
+	client.Close()
+	deadline = time.Now().Add(5 * time.Second)
+	for len(hook.AllEntries()) < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if entry := hook.LastEntry(); entry == nil || entry.Data["vip"] != "::1" || entry.Data["server"] != podIP+"-"+targetPort || entry.Data["bytes_in"] != "4" || entry.Data["bytes_out"] != "4" {
+		t.Fatalf("expected the native connection to be logged, saw %+v", entry)
+	}
+}
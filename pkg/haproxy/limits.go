@@ -0,0 +1,58 @@
+package haproxy
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// maxConnLimit bounds the maxconn of a listener, which haproxy allocates for
+// up front.
+const maxConnLimit = 1000000
+
+// Limits tune the connections of a listener. Zero fields keep the defaults
+// of the configuration template: no maxconn beyond haproxy's own, and 5s
+// connect, client and server timeouts.
+type Limits struct {
+	// MaxConn is how many connections the listener takes at once. Further
+	// connections wait in the kernel's accept queue.
+	MaxConn int
+	// ConnectTimeout bounds connecting to a pod, and ClientTimeout and
+	// ServerTimeout how long the client and the pod may stay silent.
+	ConnectTimeout time.Duration
+	ClientTimeout  time.Duration
+	ServerTimeout  time.Duration
+	// HTTPKeepAliveTimeout is how long an http mode listener waits for the
+	// next request on a kept-alive connection.
+	HTTPKeepAliveTimeout time.Duration
+	// TCPKeepAlive sends TCP keep-alives to the client and the pods, so that
+	// idle connections outlive the state of firewalls in between.
+	TCPKeepAlive bool
+}
+
+// Validate checks that the limits render into a valid configuration.
+func (l Limits) Validate() error {
+	if l.MaxConn < 0 || l.MaxConn > maxConnLimit {
+		return fmt.Errorf("maxconn must be between 0 and %d", maxConnLimit)
+	}
+	for name, timeout := range map[string]time.Duration{
+		"connect":         l.ConnectTimeout,
+		"client":          l.ClientTimeout,
+		"server":          l.ServerTimeout,
+		"http keep-alive": l.HTTPKeepAliveTimeout,
+	} {
+		if timeout < 0 || timeout > 0 && timeout < time.Millisecond {
+			return fmt.Errorf("%s timeout must be at least 1ms", name)
+		}
+	}
+	return nil
+}
+
+// timeout formats a timeout for the configuration, or returns an empty
+// string when it is unset.
+func timeout(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64(d/time.Millisecond), 10) + "ms"
+}
@@ -0,0 +1,71 @@
+package haproxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The pods behind a listener run on its node, so the listener can reach them
+// without going through the pod network. A local backend is the address of
+// each pod as seen from the node, given as a pattern in which {ip} stands for
+// the pod IP and {port} for the target port:
+//
+//	/run/pods/{ip}.sock   a unix socket, such as one shared over a hostPath
+//	@svc-{ip}             a socket in the abstract namespace of the node,
+//	                      for pods on the host network
+//	127.0.0.1:{port}      a port mapped onto the node's loopback
+//
+// Servers keep their <pod ip>-<target port> names, so the stats and the admin
+// API see no difference. Only the pods of the listener itself are local: the
+// pods of a route may run on any node and are reached on their pod IPs. The
+// native proxy dials local backends for TCP, and sends UDP to the pod IPs.
+
+// ValidateLocalBackend checks the pattern of a local backend.
+func ValidateLocalBackend(pattern string) error {
+	if pattern == "" {
+		return nil
+	}
+	if strings.ContainsAny(pattern, " \t\r\n#") {
+		return fmt.Errorf("local backend %q must not contain spaces or #", pattern)
+	}
+	network, address := localAddress(pattern, "192.0.2.1", "80")
+	if network == "unix" {
+		if len(address) < 2 {
+			return fmt.Errorf("local backend %q names no socket", pattern)
+		}
+		return nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) == nil {
+		return fmt.Errorf("local backend %q must be a socket path, an @abstract socket or an ip:port", pattern)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("local backend %q has an invalid port", pattern)
+	}
+	return nil
+}
+
+// localAddress expands the local backend of a pod, and returns the network
+// it is dialed on.
+func localAddress(pattern, podIP, targetPort string) (network, address string) {
+	address = strings.NewReplacer("{ip}", podIP, "{port}", targetPort).Replace(pattern)
+	if strings.HasPrefix(address, "/") || strings.HasPrefix(address, "@") {
+		return "unix", address
+	}
+	return "tcp", address
+}
+
+// serverAddress returns the address haproxy connects to a pod of the
+// listener on.
+func (o ListenerOptions) serverAddress(podIP, targetPort string) string {
+	if o.LocalBackend == "" {
+		return podIP + ":" + targetPort
+	}
+	network, address := localAddress(o.LocalBackend, podIP, targetPort)
+	if network == "unix" && strings.HasPrefix(address, "@") {
+		return "abns" + address
+	}
+	return address
+}
@@ -0,0 +1,387 @@
+package haproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+// A listener can be proxied by Ravel itself rather than by haproxy, so that
+// a deployment that only needs plain forwarding doesn't need the haproxy
+// binary. The native proxy accepts connections on the v6 VIP and forwards
+// them to the pods round robin, moving on to the next pod when one refuses
+// the connection. Between two plain TCP connections, the Go runtime copies
+// with splice(2), so the payload never passes through userspace. UDP is
+// forwarded with a socket per client address, which is closed once neither
+// side has sent anything for udpIdleTimeout.
+//
+// A change to the pods or the certificate applies to new connections and
+// leaves established ones alone. A change to the MTU or to UDP binds the
+// listener again. Of the limits, the native proxy honors maxconn, by not
+// accepting connections past it, and the connect timeout. Accepting the PROXY
+// protocol, health checks and routing by host are haproxy features that a
+// native listener ignores.
+
+// Proxies that a listener can be run by.
+const (
+	ProxyHAProxy = "haproxy"
+	ProxyNative  = "native"
+)
+
+const (
+	// nativeDialTimeout matches the connect timeout of the haproxy template,
+	// and applies when the limits of a listener don't set one.
+	nativeDialTimeout = 5 * time.Second
+	udpIdleTimeout    = 30 * time.Second
+	udpBufferSize     = 64 * 1024
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// nativeProxy proxies one listener in process.
+type nativeProxy struct {
+	sync.Mutex
+	listenAddr  string
+	servicePort string
+
+	podIPs     []string
+	targetPort string
+	mtu        string
+	options    ListenerOptions
+	cert       *tls.Certificate
+	next       uint32
+
+	// active counts the TCP connections being proxied, and slots is
+	// signaled when one ends or maxconn changes.
+	active int
+	slots  *sync.Cond
+
+	tcp net.Listener
+	udp net.PacketConn
+
+	// access receives the access logs of the listener, if set.
+	access *AccessLog
+
+	ctx    context.Context
+	logger logging.Logger
+}
+
+// newNativeProxy returns a listener that binds on its first Reload and is
+// closed with ctx.
+func newNativeProxy(ctx context.Context, listenAddr, servicePort string, logger logging.Logger) *nativeProxy {
+	p := &nativeProxy{
+		listenAddr:  listenAddr,
+		servicePort: servicePort,
+		ctx:         ctx,
+		logger:      logger,
+	}
+	p.slots = sync.NewCond(&p.Mutex)
+	go func() {
+		<-ctx.Done()
+		p.Lock()
+		defer p.Unlock()
+		p.close()
+	}()
+	return p
+}
+
+// Reload implements HAProxy.
+func (p *nativeProxy) Reload(podIPs []string, targetPort, servicePort, mtu string, options ListenerOptions) error {
+	var cert *tls.Certificate
+	if options.TLSCertificate != "" {
+		c, err := tls.X509KeyPair([]byte(options.TLSCertificate), []byte(options.TLSCertificate))
+		if err != nil {
+			return fmt.Errorf("unable to load certificate. s=%s p=%v. %v", p.listenAddr, servicePort, err)
+		}
+		cert = &c
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if (options.AcceptProxy || options.HealthCheck.Enabled || options.L7Mode != "") && (options.AcceptProxy != p.options.AcceptProxy || options.HealthCheck != p.options.HealthCheck || options.L7Mode != p.options.L7Mode) {
+		p.logger.Warnf("native proxy ignores accept-proxy, health checks and l7 routes. s=%s p=%v", p.listenAddr, servicePort)
+	}
+	if p.tcp == nil || mtu != p.mtu || options.UDP != p.options.UDP {
+		if err := p.bind(mtu, options.UDP); err != nil {
+			return fmt.Errorf("unable to bind native proxy. s=%s p=%v. %v", p.listenAddr, servicePort, err)
+		}
+	}
+	p.podIPs = podIPs
+	p.targetPort = targetPort
+	p.mtu = mtu
+	p.options = options
+	p.cert = cert
+	p.slots.Broadcast()
+	return nil
+}
+
+// bind replaces the listening sockets.
+func (p *nativeProxy) bind(mtu string, udp bool) error {
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	p.close()
+
+	address := net.JoinHostPort(p.listenAddr, p.servicePort)
+	tcp, err := listenConfig(mtu).Listen(p.ctx, "tcp6", address)
+	if err != nil {
+		return err
+	}
+	if udp {
+		if p.udp, err = net.ListenPacket("udp6", address); err != nil {
+			tcp.Close()
+			return err
+		}
+		go p.serveUDP(p.udp)
+	}
+	p.tcp = tcp
+	go p.serveTCP(tcp)
+	return nil
+}
+
+// close closes the listening sockets.
+func (p *nativeProxy) close() {
+	// wake serveTCP to find its listener closed
+	defer p.slots.Broadcast()
+	if p.tcp != nil {
+		p.tcp.Close()
+		p.tcp = nil
+	}
+	if p.udp != nil {
+		p.udp.Close()
+		p.udp = nil
+	}
+}
+
+// listenConfig sets the mss of accepted connections to mtu, like the mss
+// option of an haproxy bind.
+func listenConfig(mtu string) *net.ListenConfig {
+	return &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		if mtu == "" {
+			return nil
+		}
+		mss, err := strconv.Atoi(mtu)
+		if err != nil {
+			return fmt.Errorf("invalid mss %q", mtu)
+		}
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, mss)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}}
+}
+
+// state returns what new connections are proxied with.
+func (p *nativeProxy) state() (podIPs []string, targetPort string, options ListenerOptions, cert *tls.Certificate) {
+	p.Lock()
+	defer p.Unlock()
+	return p.podIPs, p.targetPort, p.options, p.cert
+}
+
+// dial connects to the next pod that accepts the connection, on its local
+// backend for TCP if the listener has one. It returns the connection and the
+// server name of the pod.
+func (p *nativeProxy) dial(network string, podIPs []string, targetPort string) (net.Conn, string, error) {
+	if len(podIPs) == 0 {
+		return nil, "", fmt.Errorf("no pods")
+	}
+	_, _, options, _ := p.state()
+	timeout := nativeDialTimeout
+	if options.Limits.ConnectTimeout > 0 {
+		timeout = options.Limits.ConnectTimeout
+	}
+	start := int(atomic.AddUint32(&p.next, 1))
+	var err error
+	for i := range podIPs {
+		var conn net.Conn
+		ip := podIPs[(start+i)%len(podIPs)]
+		network, address := network, net.JoinHostPort(ip, targetPort)
+		if network == "tcp" && options.LocalBackend != "" {
+			network, address = localAddress(options.LocalBackend, ip, targetPort)
+		}
+		if conn, err = net.DialTimeout(network, address, timeout); err == nil {
+			return conn, ip + "-" + targetPort, nil
+		}
+	}
+	return nil, "", err
+}
+
+func (p *nativeProxy) serveTCP(l net.Listener) {
+	for {
+		p.acquire(l)
+		conn, err := l.Accept()
+		if err != nil {
+			p.release()
+			p.logger.Debugf("native proxy stopped accepting. s=%s p=%v. %v", p.listenAddr, p.servicePort, err)
+			return
+		}
+		go func() {
+			defer p.release()
+			p.forward(conn)
+		}()
+	}
+}
+
+// acquire waits for the listener to be under its maxconn, or for l to be
+// closed.
+func (p *nativeProxy) acquire(l net.Listener) {
+	p.Lock()
+	defer p.Unlock()
+	for max := p.options.Limits.MaxConn; max > 0 && p.active >= max && p.tcp == l; max = p.options.Limits.MaxConn {
+		p.slots.Wait()
+	}
+	p.active++
+}
+
+// release ends a connection started with acquire.
+func (p *nativeProxy) release() {
+	p.Lock()
+	defer p.Unlock()
+	p.active--
+	p.slots.Signal()
+}
+
+// forward proxies a connection until both sides have closed it.
+func (p *nativeProxy) forward(client net.Conn) {
+	defer client.Close()
+	start := time.Now()
+	podIPs, targetPort, options, cert := p.state()
+	if cert != nil {
+		client = tls.Server(client, &tls.Config{Certificates: []tls.Certificate{*cert}})
+	}
+
+	server, name, err := p.dial("tcp", podIPs, targetPort)
+	if err != nil {
+		p.logger.Warnf("native proxy found no pod to connect to. s=%s p=%v. %v", p.listenAddr, p.servicePort, err)
+		return
+	}
+	defer server.Close()
+	if options.SendProxy {
+		if _, err := server.Write(proxyHeader(client.RemoteAddr(), client.LocalAddr())); err != nil {
+			return
+		}
+	}
+
+	var in int64
+	done := make(chan struct{})
+	go func() {
+		in, _ = io.Copy(server, client)
+		closeWrite(server)
+		close(done)
+	}()
+	out, _ := io.Copy(client, server)
+	closeWrite(client)
+	<-done
+	if p.access != nil {
+		p.access.log(accessFields(client.RemoteAddr(), client.LocalAddr(), "listen6-"+p.servicePort, name, start, in, out))
+	}
+}
+
+// closeWrite passes on the end of one direction of a connection.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+}
+
+// proxyHeader returns the PROXY protocol v2 header of a TCP connection from
+// src to dst.
+func proxyHeader(src, dst net.Addr) []byte {
+	s, _ := src.(*net.TCPAddr)
+	d, _ := dst.(*net.TCPAddr)
+	header := append([]byte{}, proxyV2Signature...)
+	if s == nil || d == nil {
+		// LOCAL, with no addresses
+		return append(header, 0x20, 0x00, 0x00, 0x00)
+	}
+
+	family, srcIP, dstIP := byte(0x21), s.IP.To16(), d.IP.To16()
+	if s.IP.To4() != nil && d.IP.To4() != nil {
+		family, srcIP, dstIP = 0x11, s.IP.To4(), d.IP.To4()
+	}
+	addrs := append(append([]byte{}, srcIP...), dstIP...)
+	addrs = append(addrs, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(addrs[len(addrs)-4:], uint16(s.Port))
+	binary.BigEndian.PutUint16(addrs[len(addrs)-2:], uint16(d.Port))
+
+	header = append(header, 0x21, family, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+// serveUDP forwards datagrams from each client address through a socket of
+// its own, so that the replies can be told apart.
+func (p *nativeProxy) serveUDP(l net.PacketConn) {
+	var lock sync.Mutex
+	sessions := map[string]net.Conn{}
+	defer func() {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, server := range sessions {
+			server.Close()
+		}
+	}()
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, client, err := l.ReadFrom(buf)
+		if err != nil {
+			p.logger.Debugf("native proxy stopped reading udp. s=%s p=%v. %v", p.listenAddr, p.servicePort, err)
+			return
+		}
+
+		key := client.String()
+		lock.Lock()
+		server, found := sessions[key]
+		if !found {
+			podIPs, targetPort, _, _ := p.state()
+			if server, _, err = p.dial("udp", podIPs, targetPort); err != nil {
+				lock.Unlock()
+				p.logger.Warnf("native proxy found no pod to send to. s=%s p=%v. %v", p.listenAddr, p.servicePort, err)
+				continue
+			}
+			sessions[key] = server
+			go func() {
+				p.reply(l, client, server)
+				lock.Lock()
+				delete(sessions, key)
+				lock.Unlock()
+			}()
+		}
+		lock.Unlock()
+
+		server.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		server.Write(buf[:n])
+	}
+}
+
+// reply sends the datagrams of a pod back to its client until the session
+// goes idle.
+func (p *nativeProxy) reply(l net.PacketConn, client net.Addr, server net.Conn) {
+	defer server.Close()
+	buf := make([]byte, udpBufferSize)
+	for {
+		server.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := server.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := l.WriteTo(buf[:n], client); err != nil {
+			return
+		}
+	}
+}
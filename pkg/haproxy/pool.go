@@ -0,0 +1,210 @@
+package haproxy
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+// Rather than run a process per listener, a set can host its haproxy
+// listeners in a fixed number of shared processes, or pools. A listener is a
+// frontend of the pool its VIP and port hash to, named listen6-<vip>-<port>,
+// and keeps a stats socket, certificate and status of its own. Changes stay
+// with the listener they belong to:
+//
+//   - a change to its pods goes through the runtime API and touches its
+//     frontend alone, as it would in a process of its own.
+//   - any other change renders the pool from the new settings of the listener
+//     and the applied settings of the others, so a change that haproxy
+//     rejects is rolled back for that listener alone.
+//   - the pool runs in master-worker mode, so that a reload hands the
+//     listening sockets of every frontend to the new worker.
+//
+// A reload still restarts the worker of every frontend in the pool, so more
+// pools trade memory for fewer frontends per reload.
+
+// pool is an haproxy process shared by several listeners. It is only changed
+// under the lock of its set.
+type pool struct {
+	// mu guards host, which the collector reads.
+	mu sync.Mutex
+	// host runs the process of the pool. It has no listener of its own: its
+	// address and port only name the files of the pool, pool-<index>.conf.
+	host    *HAProxyManager
+	cancel  context.CancelFunc
+	running bool
+
+	index     int
+	members   map[string]*HAProxyManager
+	templates *Templates
+
+	binary    string
+	configDir string
+	ctx       context.Context
+	logger    logging.Logger
+}
+
+func newPool(ctx context.Context, index int, binary, configDir string, settings Settings, logger logging.Logger) *pool {
+	templates := settings.Templates
+	if templates == nil {
+		templates = defaultTemplates
+	}
+	p := &pool{
+		index:     index,
+		members:   map[string]*HAProxyManager{},
+		templates: templates,
+		binary:    binary,
+		configDir: configDir,
+		ctx:       ctx,
+		logger:    logger,
+	}
+	p.host, p.cancel = p.newHost()
+	return p
+}
+
+// newHost returns the manager of a process for the pool, which is started by
+// its first reload.
+func (p *pool) newHost() (*HAProxyManager, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(p.ctx)
+	return &HAProxyManager{
+		binary:       p.binary,
+		configDir:    p.configDir,
+		listenAddr:   "pool",
+		servicePort:  strconv.Itoa(p.index),
+		draining:     map[string]bool{},
+		templates:    p.templates,
+		masterWorker: true,
+		ctx:          ctx,
+		logger:       p.logger,
+	}, cancel
+}
+
+// current returns the manager of the pool's process.
+func (p *pool) current() *HAProxyManager {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.host
+}
+
+// poolFor returns the pool that hosts a listener, creating it if needed.
+func (h *HAProxySetManager) poolFor(instanceKey string) *pool {
+	hash := fnv.New32a()
+	hash.Write([]byte(instanceKey))
+	index := int(hash.Sum32() % uint32(h.settings.Pools))
+	if h.pools[index] == nil {
+		h.pools[index] = newPool(h.ctx, index, h.binary, h.configDir, h.settings, h.logger)
+	}
+	return h.pools[index]
+}
+
+// key returns the key of a listener within its set.
+func (h *HAProxyManager) key() string {
+	return h.listenAddr + ":" + h.servicePort
+}
+
+// render renders the configuration of the pool, with the frontend of member
+// rendered from d and the other frontends from their applied settings. A nil
+// d leaves member out.
+func (p *pool) render(member *HAProxyManager, d *TemplateData) ([]byte, error) {
+	keys := []string{}
+	for key := range p.members {
+		keys = append(keys, key)
+	}
+	if _, found := p.members[member.key()]; !found && d != nil {
+		keys = append(keys, member.key())
+	}
+	sort.Strings(keys)
+
+	data := []TemplateData{}
+	for _, key := range keys {
+		if key == member.key() {
+			if d != nil {
+				data = append(data, *d)
+			}
+			continue
+		}
+		m := p.members[key]
+		md, err := m.templateData(m.podIPs, m.targetPort, m.servicePort, m.mtu, m.options)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, md)
+	}
+	return p.templates.renderAll(data)
+}
+
+// keep records b as the configuration of the pool's process.
+func (p *pool) keep(b []byte) {
+	p.current().rendered = b
+}
+
+// join adds a listener whose frontend is in the configuration on disk.
+func (p *pool) join(member *HAProxyManager) {
+	p.members[member.key()] = member
+}
+
+// reload applies the configuration on disk, starting the process if it isn't
+// running.
+func (p *pool) reload() error {
+	host := p.current()
+	if !p.running {
+		p.running = true
+		go host.run(false)
+	} else if err := host.reload(); err != nil {
+		return err
+	}
+	// the new worker starts with only the servers in the configuration
+	for _, m := range p.members {
+		m.draining = map[string]bool{}
+	}
+	return nil
+}
+
+// leave takes a stopped listener out of the pool, and stops the process once
+// it hosts no listener.
+func (p *pool) leave(member *HAProxyManager) {
+	if p.members[member.key()] != member {
+		return
+	}
+	delete(p.members, member.key())
+	if len(p.members) == 0 {
+		p.logger.Infof("stopping haproxy pool %d, which hosts no listener", p.index)
+		p.mu.Lock()
+		p.cancel()
+		p.host, p.cancel = p.newHost()
+		p.running = false
+		p.mu.Unlock()
+		return
+	}
+
+	b, err := p.render(member, nil)
+	if err == nil {
+		err = p.current().write(b)
+	}
+	if err == nil {
+		p.keep(b)
+		err = p.reload()
+	}
+	if err != nil {
+		p.logger.Errorf("unable to remove s=%s p=%v from haproxy pool %d. %v", member.listenAddr, member.servicePort, p.index, err)
+	}
+}
+
+// owns reports whether a proxy of the process belongs to the listener, which
+// in a pool is its frontend and the backends of its routes.
+func (h *HAProxyManager) owns(proxy string) bool {
+	return h.pool == nil || proxy == h.backendName() || strings.HasPrefix(proxy, h.backendName()+"-")
+}
+
+// supervised returns the supervisor of the process the listener runs in.
+func (h *HAProxyManager) supervised() *supervisor {
+	if h.pool != nil {
+		return &h.pool.current().proc
+	}
+	return &h.proc
+}
@@ -0,0 +1,80 @@
+package haproxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// Before a configuration is activated, `haproxy -c` checks a copy of it. A
+// configuration that haproxy rejects, or that fails to reload, is rolled
+// back: the previous configuration stays on disk and keeps running, the
+// listener is reported unhealthy until a later change is applied, and the
+// rejection is recorded in the audit trail.
+
+// preflightTimeout bounds haproxy -c.
+const preflightTimeout = 10 * time.Second
+
+var statsHealthy = stats.Define(stats.Definition{
+	Type:   stats.Gauge,
+	Name:   "haproxy_listener_healthy",
+	Help:   "whether the last configuration change of a v6 listener was applied, 0 while a rejected change leaves it on its previous configuration",
+	Labels: []string{"lb", "vip", "port"},
+}).Desc()
+
+// listenerStatus holds why the last change to a listener was rejected.
+type listenerStatus struct {
+	sync.Mutex
+	err error
+}
+
+func (s *listenerStatus) set(err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.err = err
+}
+
+func (s *listenerStatus) get() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.err
+}
+
+// preflight checks a rendered configuration with haproxy -c, against the
+// certificate already on disk.
+func (h *HAProxyManager) preflight(b []byte) error {
+	path := h.filename() + ".check"
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	ctx, cancel := context.WithTimeout(h.ctx, preflightTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, h.binary, "-c", "-f", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("haproxy rejected the configuration. %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// applied marks the listener healthy after a change was applied.
+func (h *HAProxyManager) applied(action string) {
+	h.status.set(nil)
+	audit.Record(audit.SubsystemHAProxy, action, h.listenAddr+":"+h.servicePort, "", nil)
+}
+
+// reject marks the listener unhealthy after a change was rolled back.
+func (h *HAProxyManager) reject(err error) {
+	h.logger.Errorf("rolled back haproxy configuration change, keeping the previous one. s=%s p=%v. %v", h.listenAddr, h.servicePort, err)
+	h.status.set(err)
+	audit.Record(audit.SubsystemHAProxy, "reject", h.listenAddr+":"+h.servicePort, "", err)
+}
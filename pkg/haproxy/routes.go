@@ -0,0 +1,101 @@
+package haproxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Several services can share one VIP and port when their listener routes by
+// host. In sni mode, haproxy reads the server name of the TLS handshake,
+// either by terminating TLS when the listener has a certificate or by
+// peeking at the client hello and passing the connection through untouched.
+// In http mode, haproxy routes by the Host header of each request, over TLS
+// when the listener has a certificate. Connections that match no route go to
+// the pods of the listener itself.
+//
+// Each route has a backend of its own. A change to the pods of a route
+// reloads haproxy, as only the servers of the listener are updated through
+// the runtime API.
+
+// L7 modes of a listener.
+const (
+	L7SNI  = "sni"
+	L7HTTP = "http"
+)
+
+// Route sends the connections of a listener for a host to pods of their own.
+type Route struct {
+	// Host is a hostname, or *.domain for any name under domain.
+	Host       string
+	PodIPs     []string
+	TargetPort string
+}
+
+// routeHost matches a hostname with an optional leading wildcard label.
+var routeHost = regexp.MustCompile(`^(\*\.)?([a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+
+// ValidateL7 checks an l7 mode and its routes.
+func ValidateL7(mode string, routes []Route) error {
+	switch mode {
+	case "":
+		if len(routes) > 0 {
+			return fmt.Errorf("routes require an l7 mode")
+		}
+		return nil
+	case L7SNI, L7HTTP:
+	default:
+		return fmt.Errorf("l7 mode must be one of %s|%s", L7SNI, L7HTTP)
+	}
+	seen := map[string]bool{}
+	for _, route := range routes {
+		if !routeHost.MatchString(route.Host) {
+			return fmt.Errorf("route host %q is not a hostname or *.domain", route.Host)
+		}
+		if seen[strings.ToLower(route.Host)] {
+			return fmt.Errorf("route host %s appears more than once", route.Host)
+		}
+		seen[strings.ToLower(route.Host)] = true
+	}
+	return nil
+}
+
+// RouteData is what a template renders the backend of a route from.
+type RouteData struct {
+	// Backend is the name of the route's backend section.
+	Backend string
+	// Condition is the haproxy condition, with its braces, that picks the
+	// route for a connection or request.
+	Condition string
+	// DestIPs are the pods of the route, and TargetPort the port they
+	// listen on.
+	DestIPs    []string
+	TargetPort string
+}
+
+// routeData prepares the routes of a listener for its template.
+func (h *HAProxyManager) routeData(options ListenerOptions) []RouteData {
+	// the fetch that yields the host of a connection or request
+	fetch := "req_ssl_sni"
+	switch {
+	case options.L7Mode == L7HTTP:
+		fetch = "hdr(host),field(1,:)"
+	case options.TLSCertificate != "":
+		fetch = "ssl_fc_sni"
+	}
+
+	routes := []RouteData{}
+	for _, route := range options.Routes {
+		match := "-i " + route.Host
+		if strings.HasPrefix(route.Host, "*.") {
+			match = "-i -m end " + route.Host[1:]
+		}
+		routes = append(routes, RouteData{
+			Backend:    h.backendName() + "-" + strings.Replace(route.Host, "*", "wildcard", 1),
+			Condition:  "{ " + fetch + " " + match + " }",
+			DestIPs:    route.PodIPs,
+			TargetPort: route.TargetPort,
+		})
+	}
+	return routes
+}
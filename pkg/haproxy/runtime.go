@@ -0,0 +1,136 @@
+package haproxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// When only the pods behind a listener change, reloading haproxy would cut
+// the long-lived connections to the pods that stay. Instead, the servers are
+// added and removed through the runtime API on the stats socket, and the
+// configuration on disk is rewritten to match without a reload, so that a
+// restarted process comes up with the same servers. Reloads are kept for
+// changes to the listener itself: its port, target port or MTU.
+//
+// A new pod is added with `add server` and then made ready, as servers added
+// at runtime start in maintenance. A pod that goes away is put in maintenance,
+// which stops new connections but keeps the ones it has, and is deleted once
+// they have closed; until then each update retries the delete. If the runtime
+// API fails, as it does on haproxy older than 2.4, the update falls back to a
+// reload.
+
+// runtimeCommand runs one command on a stats socket and returns its output.
+func runtimeCommand(socket, command string) (string, error) {
+	conn, err := net.DialTimeout("unix", socket, statsTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(statsTimeout))
+
+	if _, err := io.WriteString(conn, command+"\n"); err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// expect runs a command and fails unless it answers with want.
+func expect(socket, command, want string) error {
+	out, err := runtimeCommand(socket, command)
+	if err != nil {
+		return fmt.Errorf("%s: %v", command, err)
+	}
+	if out != want {
+		return fmt.Errorf("%s: %s", command, out)
+	}
+	return nil
+}
+
+// backendName is the name of the listen section in the configuration. In a
+// pool, where several listeners may share a port, it names the VIP as well.
+func (h *HAProxyManager) backendName() string {
+	if h.pool != nil {
+		return "listen6-" + h.listenAddr + "-" + h.servicePort
+	}
+	return "listen6-" + h.servicePort
+}
+
+// serverName is the name of a pod's server, which is also the server label
+// of the haproxy metrics.
+func (h *HAProxyManager) serverName(podIP string) string {
+	return podIP + "-" + h.targetPort
+}
+
+// updateServers moves the running process from h.podIPs to podIPs through the
+// runtime API. Pods are added before any are removed, so the listener never
+// goes without a server.
+func (h *HAProxyManager) updateServers(podIPs []string) error {
+	socket := h.statsSocket()
+	current := map[string]bool{}
+	for _, ip := range h.podIPs {
+		current[ip] = true
+	}
+	wanted := map[string]bool{}
+	for _, ip := range podIPs {
+		wanted[ip] = true
+	}
+
+	for _, ip := range podIPs {
+		if current[ip] {
+			continue
+		}
+		server := h.backendName() + "/" + h.serverName(ip)
+		// a pod that comes back before its server was deleted is made ready again
+		if !h.draining[ip] {
+			add := strings.TrimSpace(fmt.Sprintf("experimental-mode on; add server %s %s %s", server, h.options.serverAddress(ip, h.targetPort), h.options.serverArgs()))
+			if err := expect(socket, add, "New server registered."); err != nil {
+				return err
+			}
+			// checks of servers added at runtime start disabled
+			if h.options.HealthCheck.Enabled {
+				if err := expect(socket, "enable health "+server, ""); err != nil {
+					return err
+				}
+			}
+		}
+		if err := expect(socket, "set server "+server+" state ready", ""); err != nil {
+			return err
+		}
+		delete(h.draining, ip)
+	}
+
+	for _, ip := range h.podIPs {
+		if wanted[ip] {
+			continue
+		}
+		if err := expect(socket, "set server "+h.backendName()+"/"+h.serverName(ip)+" state maint", ""); err != nil {
+			return err
+		}
+		h.draining[ip] = true
+	}
+
+	h.deleteDrained()
+	return nil
+}
+
+// deleteDrained deletes the servers in maintenance that no longer have
+// connections. haproxy refuses to delete the rest, which are tried again on
+// the next update.
+func (h *HAProxyManager) deleteDrained() {
+	for ip := range h.draining {
+		server := h.backendName() + "/" + h.serverName(ip)
+		if err := expect(h.statsSocket(), "experimental-mode on; del server "+server, "Server deleted."); err != nil {
+			h.logger.Debugf("server %s is still draining. %v", server, err)
+			continue
+		}
+		delete(h.draining, ip)
+	}
+}
@@ -0,0 +1,223 @@
+package haproxy
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// statsTimeout bounds a single command on an instance's stats socket.
+const statsTimeout = 2 * time.Second
+
+var (
+	statsLabels = []string{"lb", "vip", "port", "proxy", "server"}
+
+	statsUp = stats.Define(stats.Definition{
+		Type:     stats.Gauge,
+		Name:     "haproxy_up",
+		Help:     "whether the haproxy stats socket for a v6 listener answered",
+		Labels:   []string{"lb", "vip", "port"},
+		Replaces: "rdei_lb_haproxy_up",
+	}).Desc()
+	statsCurrent = stats.Define(stats.Definition{
+		Type:     stats.Gauge,
+		Name:     "haproxy_sessions_current",
+		Help:     "current sessions on a haproxy frontend, backend or server",
+		Labels:   statsLabels,
+		Replaces: "rdei_lb_haproxy_sessions_current",
+	}).Desc()
+	statsTotal = stats.Define(stats.Definition{
+		Type:     stats.Counter,
+		Name:     "haproxy_sessions_total",
+		Help:     "sessions on a haproxy frontend, backend or server since the process started",
+		Labels:   statsLabels,
+		Replaces: "rdei_lb_haproxy_sessions_total",
+	}).Desc()
+	statsQueue = stats.Define(stats.Definition{
+		Type:     stats.Gauge,
+		Name:     "haproxy_queue_current",
+		Help:     "requests queued on a haproxy backend or server",
+		Labels:   statsLabels,
+		Replaces: "rdei_lb_haproxy_queue_current",
+	}).Desc()
+	statsErrors = stats.Define(stats.Definition{
+		Type:     stats.Counter,
+		Name:     "haproxy_errors_total",
+		Help:     "request, connection and response errors on a haproxy frontend, backend or server since the process started",
+		Labels:   append(statsLabels, "error"),
+		Replaces: "rdei_lb_haproxy_errors_total",
+	}).Desc()
+)
+
+// errorColumns maps the show stat error columns to the error label.
+var errorColumns = map[string]string{
+	"ereq":  "request",
+	"econ":  "connection",
+	"eresp": "response",
+}
+
+// statsRow is one line of `show stat`: a frontend, backend or server.
+type statsRow struct {
+	proxy, server string
+	values        map[string]string
+}
+
+// Collector exports the stats of every running haproxy instance. Each
+// instance is queried over its stats socket when metrics are collected, so
+// series for stopped instances disappear with them. Counters restart when
+// haproxy reloads.
+type Collector struct {
+	set  *HAProxySetManager
+	kind string
+}
+
+// NewCollector returns a Collector for the instances managed by set.
+func NewCollector(set *HAProxySetManager, kind stats.LBKind) *Collector {
+	return &Collector{set: set, kind: string(kind)}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{statsUp, statsCurrent, statsTotal, statsQueue, statsErrors, statsCrashes, statsRestarts, statsHealthy} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.set.Lock()
+	instances := make([]*HAProxyManager, 0, len(c.set.sources))
+	for _, source := range c.set.sources {
+		if h, ok := source.(*HAProxyManager); ok {
+			instances = append(instances, h)
+		}
+	}
+	c.set.Unlock()
+
+	var wg sync.WaitGroup
+	for _, h := range instances {
+		wg.Add(1)
+		go func(h *HAProxyManager) {
+			defer wg.Done()
+			c.collectInstance(ch, h)
+		}(h)
+	}
+	wg.Wait()
+}
+
+func (c *Collector) collectInstance(ch chan<- prometheus.Metric, h *HAProxyManager) {
+	crashes, restarts := h.supervised().counts()
+	ch <- prometheus.MustNewConstMetric(statsCrashes, prometheus.CounterValue, float64(crashes), c.kind, h.listenAddr, h.servicePort)
+	ch <- prometheus.MustNewConstMetric(statsRestarts, prometheus.CounterValue, float64(restarts), c.kind, h.listenAddr, h.servicePort)
+	healthy := 1.0
+	if h.status.get() != nil {
+		healthy = 0
+	}
+	ch <- prometheus.MustNewConstMetric(statsHealthy, prometheus.GaugeValue, healthy, c.kind, h.listenAddr, h.servicePort)
+
+	rows, err := h.stats()
+	if err != nil {
+		h.logger.Debugf("unable to query haproxy stats for %s:%s. %v", h.listenAddr, h.servicePort, err)
+		ch <- prometheus.MustNewConstMetric(statsUp, prometheus.GaugeValue, 0, c.kind, h.listenAddr, h.servicePort)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(statsUp, prometheus.GaugeValue, 1, c.kind, h.listenAddr, h.servicePort)
+
+	for _, row := range rows {
+		labels := []string{c.kind, h.listenAddr, h.servicePort, row.proxy, row.server}
+		if v, ok := row.value("scur"); ok {
+			ch <- prometheus.MustNewConstMetric(statsCurrent, prometheus.GaugeValue, v, labels...)
+		}
+		if v, ok := row.value("stot"); ok {
+			ch <- prometheus.MustNewConstMetric(statsTotal, prometheus.CounterValue, v, labels...)
+		}
+		if v, ok := row.value("qcur"); ok {
+			ch <- prometheus.MustNewConstMetric(statsQueue, prometheus.GaugeValue, v, labels...)
+		}
+		for column, kind := range errorColumns {
+			if v, ok := row.value(column); ok {
+				ch <- prometheus.MustNewConstMetric(statsErrors, prometheus.CounterValue, v, append(labels, kind)...)
+			}
+		}
+	}
+}
+
+// value returns a numeric column. Columns that don't apply to a row, such
+// as the queue of a frontend, are empty.
+func (r statsRow) value(column string) (float64, bool) {
+	s, ok := r.values[column]
+	if !ok || s == "" {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	return v, err == nil
+}
+
+// stats returns the rows of `show stat` that belong to the listener.
+func (h *HAProxyManager) stats() ([]statsRow, error) {
+	rows, err := queryStats(h.statsSocket())
+	if err != nil {
+		return nil, err
+	}
+	owned := rows[:0]
+	for _, row := range rows {
+		if h.owns(row.values["pxname"]) {
+			owned = append(owned, row)
+		}
+	}
+	return owned, nil
+}
+
+// queryStats runs `show stat` on a stats socket.
+func queryStats(socket string) ([]statsRow, error) {
+	out, err := runtimeCommand(socket, "show stat")
+	if err != nil {
+		return nil, err
+	}
+	return parseStats([]byte(out))
+}
+
+// parseStats reads the CSV output of `show stat`. The first line is the
+// header, prefixed with "# ":
+//
+//	# pxname,svname,qcur,qmax,scur,smax,slim,stot,bin,bout,dreq,dresp,ereq,econ,eresp,...
+//	listen6-8080,FRONTEND,,,3,10,2000,1234,...
+func parseStats(b []byte) ([]statsRow, error) {
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(b, []byte("# "))))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("empty response from stats socket")
+	}
+
+	header := records[0]
+	rows := []statsRow{}
+	for _, record := range records[1:] {
+		values := make(map[string]string, len(header))
+		for i, name := range header {
+			if i < len(record) {
+				values[name] = record[i]
+			}
+		}
+		row := statsRow{values: values}
+		switch sv := values["svname"]; sv {
+		case "FRONTEND", "BACKEND":
+			row.proxy = strings.ToLower(sv)
+		default:
+			row.proxy, row.server = "server", sv
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
@@ -0,0 +1,140 @@
+package haproxy
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// The haproxy process of a listener is only expected to exit when a reload
+// replaces it or the listener is stopped. Any other exit, whether a crash, an
+// OOM kill or a stray signal, leaves the VIP without a listener, so the
+// process is started again from the configuration on disk. Restarts back off
+// exponentially from restartMinBackoff to restartMaxBackoff, so that a process
+// that can't stay up doesn't spin, and the backoff starts over once a process
+// has stayed up for restartResetAfter.
+
+const (
+	restartMinBackoff = time.Second
+	restartMaxBackoff = time.Minute
+	restartResetAfter = 5 * time.Minute
+	// crashLoopBackoff is the backoff after four crashes in a row, from which
+	// on a process counts as crash looping until it stays up.
+	crashLoopBackoff = 8 * restartMinBackoff
+)
+
+var (
+	statsCrashes = stats.Define(stats.Definition{
+		Type:   stats.Counter,
+		Name:   "haproxy_crashes_total",
+		Help:   "unexpected exits of the haproxy process of a v6 listener",
+		Labels: []string{"lb", "vip", "port"},
+	}).Desc()
+	statsRestarts = stats.Define(stats.Definition{
+		Type:   stats.Counter,
+		Name:   "haproxy_restarts_total",
+		Help:   "restarts of the haproxy process of a v6 listener after it exited unexpectedly",
+		Labels: []string{"lb", "vip", "port"},
+	}).Desc()
+)
+
+// supervisor tracks the running process of a listener.
+type supervisor struct {
+	sync.Mutex
+	cmd     *exec.Cmd
+	started time.Time
+	backoff time.Duration
+
+	crashes, restarts int
+}
+
+// start records cmd as the process of the listener.
+func (s *supervisor) start(cmd *exec.Cmd, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.cmd = cmd
+	s.started = now
+}
+
+// process returns the running process, or nil before one has started.
+func (s *supervisor) process() *os.Process {
+	s.Lock()
+	defer s.Unlock()
+	if s.cmd == nil {
+		return nil
+	}
+	return s.cmd.Process
+}
+
+// exited records the exit of cmd. It returns how long to wait before
+// restarting it, or false if a newer process replaced cmd and the exit was
+// expected.
+func (s *supervisor) exited(cmd *exec.Cmd, now time.Time) (time.Duration, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if cmd != s.cmd {
+		return 0, false
+	}
+	s.crashes++
+	if s.backoff == 0 || now.Sub(s.started) >= restartResetAfter {
+		s.backoff = restartMinBackoff
+	} else if s.backoff *= 2; s.backoff > restartMaxBackoff {
+		s.backoff = restartMaxBackoff
+	}
+	return s.backoff, true
+}
+
+// restart records a restart of cmd, unless a reload started a newer process
+// while the restart backed off.
+func (s *supervisor) restart(cmd *exec.Cmd) bool {
+	s.Lock()
+	defer s.Unlock()
+	if cmd != s.cmd {
+		return false
+	}
+	s.restarts++
+	return true
+}
+
+// crashLooping reports whether the process keeps exiting soon after it
+// starts.
+func (s *supervisor) crashLooping(now time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.backoff >= crashLoopBackoff && now.Sub(s.started) < restartResetAfter
+}
+
+// CrashLooping returns the listeners, as address and port, whose haproxy
+// keeps exiting soon after it starts.
+func (h *HAProxySetManager) CrashLooping() []string {
+	h.Lock()
+	instances := make([]*HAProxyManager, 0, len(h.sources))
+	for _, source := range h.sources {
+		if instance, ok := source.(*HAProxyManager); ok {
+			instances = append(instances, instance)
+		}
+	}
+	h.Unlock()
+
+	now := time.Now()
+	looping := []string{}
+	for _, instance := range instances {
+		if instance.supervised().crashLooping(now) {
+			looping = append(looping, net.JoinHostPort(instance.listenAddr, instance.servicePort))
+		}
+	}
+	sort.Strings(looping)
+	return looping
+}
+
+// counts returns the number of crashes and restarts so far.
+func (s *supervisor) counts() (crashes, restarts int) {
+	s.Lock()
+	defer s.Unlock()
+	return s.crashes, s.restarts
+}
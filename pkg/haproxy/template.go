@@ -1,5 +1,90 @@
 package haproxy
 
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// The configuration of each listener is rendered from a Go text/template. The
+// built-in template below can be replaced by mounting a template file, which
+// is executed with the same data: a []TemplateData with one element per
+// listener of the process, which is every listener of a pool or the one
+// listener of a process of its own.
+//
+// A snippet file adds lines to the listen section of a single listener
+// without replacing the template. It is read from the snippet directory as
+// <vip>-<port>.cfg, or <port>.cfg for the port on every VIP, each time the
+// listener's configuration is rendered.
+//
+// Whatever the template, the rendered configuration must bind the listener's
+// VIP and port and keep its stats socket, which the metrics and the runtime
+// API depend on. A configuration that doesn't is never activated.
+
+// TemplateData is what a template renders a listener from.
+type TemplateData struct {
+	// Name is the name of the listener's listen section, which the runtime
+	// API and the stats find its servers under: listen6-<port>, or
+	// listen6-<vip>-<port> in a pool.
+	Name string
+	// Source is the v6 VIP the listener binds.
+	Source string
+	// ServicePort is the port the listener binds.
+	ServicePort string
+	// MTU is the mss to set on the bind, or empty.
+	MTU string
+	// DestIPs are the pod IPs on this node, and TargetPort the port they
+	// listen on. Each pod's server must be named <ip>-<targetPort>.
+	DestIPs    []string
+	TargetPort string
+	// ServerAddrs are the addresses each of DestIPs is connected to on: its
+	// <ip>:<targetPort>, or its local backend.
+	ServerAddrs []string
+	// StatsSocket is the path of the stats socket, which must be bound at
+	// level admin.
+	StatsSocket string
+	// StatsSocketUID is the user the stats socket is handed to, when ravel
+	// runs without root and haproxy is started for it by the privileged
+	// helper, or 0.
+	StatsSocketUID int
+	// AcceptProxy expects a PROXY protocol header on the bind.
+	AcceptProxy bool
+	// ServerArgs are the arguments every server line ends with, including
+	// those of the health check.
+	ServerArgs string
+	// HTTPCheckPath is the path of an HTTP health check, and HTTPCheckExpect
+	// its http-check expect rule. Both may be empty.
+	HTTPCheckPath   string
+	HTTPCheckExpect string
+	// TLSCertFile is the certificate bundle to terminate TLS with, or empty.
+	TLSCertFile string
+	// AccessLog is the socket to send access logs to, in AccessLogFormat,
+	// or empty when they are off.
+	AccessLog       string
+	AccessLogFormat string
+	// Snippet holds the lines of the listener's snippet file, if any.
+	Snippet string
+	// L7Mode is L7SNI or L7HTTP when the listener routes by host, and
+	// Routes are its routes. InspectSNI is set when the server name is read
+	// from the client hello of a connection that is passed through.
+	L7Mode     string
+	Routes     []RouteData
+	InspectSNI bool
+	// MaxConn limits the connections of the listener when not 0. The
+	// timeouts override those of the defaults section when not empty, and
+	// TCPKeepAlive turns on keep-alives to the client and the pods.
+	MaxConn              int
+	ConnectTimeout       string
+	ClientTimeout        string
+	ServerTimeout        string
+	HTTPKeepAliveTimeout string
+	TCPKeepAlive         bool
+}
+
 var haproxyConfig string = `
 # Autogenerated by Ravel. Do not change.
 
@@ -9,7 +94,8 @@ global
     log 127.0.0.1        local1 notice
     user                 haproxy
     group                haproxy
-
+{{ range $templ := . }}    stats socket {{ $templ.StatsSocket }} mode 600{{ if $templ.StatsSocketUID }} uid {{ $templ.StatsSocketUID }}{{ end }} level admin expose-fd listeners
+{{ end }}
 defaults
     timeout connect 5s
     timeout client 5s
@@ -19,10 +105,166 @@ defaults
     option                  dontlognull
 
 {{ range $templ := . }}
-listen listen6-{{ $templ.ServicePort }}
-        bind	{{ $templ.Source }}:{{ $templ.ServicePort }} {{if .MTU}} mss {{ .MTU }} {{ end }}
-        mode    tcp
-        {{ range $i, $ip := $templ.DestIPs }}server  {{ $ip }}-{{ $templ.TargetPort }}    {{ $ip }}:{{  $templ.TargetPort  }}
+listen {{ $templ.Name }}
+        bind	{{ $templ.Source }}:{{ $templ.ServicePort }} {{if .MTU}} mss {{ .MTU }} {{ end }}{{ if .AcceptProxy }} accept-proxy {{ end }}{{ if .TLSCertFile }} ssl crt {{ .TLSCertFile }} {{ end }}
+        mode    {{ if eq $templ.L7Mode "http" }}http{{ else }}tcp{{ end }}
+{{- if $templ.AccessLog }}
+        log     {{ $templ.AccessLog }} len 4096 format raw local0 info
+        log-format {{ $templ.AccessLogFormat }}
+{{- end }}
+{{- if $templ.InspectSNI }}
+        tcp-request inspect-delay 5s
+        tcp-request content accept if { req_ssl_hello_type 1 }
+{{- end }}
+{{- if $templ.MaxConn }}
+        maxconn {{ $templ.MaxConn }}
+{{- end }}
+{{- if $templ.ConnectTimeout }}
+        timeout connect {{ $templ.ConnectTimeout }}
+{{- end }}
+{{- if $templ.ClientTimeout }}
+        timeout client {{ $templ.ClientTimeout }}
+{{- end }}
+{{- if $templ.ServerTimeout }}
+        timeout server {{ $templ.ServerTimeout }}
+{{- end }}
+{{- if $templ.HTTPKeepAliveTimeout }}
+        timeout http-keep-alive {{ $templ.HTTPKeepAliveTimeout }}
+{{- end }}
+{{- if $templ.TCPKeepAlive }}
+        option  tcpka
+{{- end }}
+{{- range $route := $templ.Routes }}
+        use_backend {{ $route.Backend }} if {{ $route.Condition }}
+{{- end }}
+{{- if $templ.HTTPCheckPath }}
+        option  httpchk GET {{ $templ.HTTPCheckPath }}
+{{- if $templ.HTTPCheckExpect }}
+        http-check expect {{ $templ.HTTPCheckExpect }}
+{{- end }}
+{{- end }}
+        {{ range $i, $ip := $templ.DestIPs }}server  {{ $ip }}-{{ $templ.TargetPort }}    {{ index $templ.ServerAddrs $i }} {{ $templ.ServerArgs }}
+        {{ end }}
+{{- if $templ.Snippet }}
+{{ $templ.Snippet }}
+{{- end }}
+{{- range $route := $templ.Routes }}
+
+backend {{ $route.Backend }}
+        mode    {{ if eq $templ.L7Mode "http" }}http{{ else }}tcp{{ end }}
+{{- if $templ.ConnectTimeout }}
+        timeout connect {{ $templ.ConnectTimeout }}
+{{- end }}
+{{- if $templ.ServerTimeout }}
+        timeout server {{ $templ.ServerTimeout }}
+{{- end }}
+{{- if $templ.TCPKeepAlive }}
+        option  srvtcpka
+{{- end }}
+        {{ range $ip := $route.DestIPs }}server  {{ $ip }}-{{ $route.TargetPort }}    {{ $ip }}:{{ $route.TargetPort }} {{ $templ.ServerArgs }}
         {{ end }}
+{{- end }}
 {{ end }}
 `
+
+// Templates renders listener configurations.
+type Templates struct {
+	template   *template.Template
+	snippetDir string
+}
+
+// NewTemplates loads the template at path, or the built-in template when
+// path is empty, and the snippets in snippetDir, if set. The template is
+// tried against a sample listener, so that one that can't render fails here
+// rather than on the first reload.
+func NewTemplates(path, snippetDir string) (*Templates, error) {
+	text := haproxyConfig
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read haproxy template. %v", err)
+		}
+		text = string(b)
+	}
+	t, err := template.New("conf").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse haproxy template %s. %v", path, err)
+	}
+	templates := &Templates{template: t, snippetDir: snippetDir}
+
+	sample := TemplateData{
+		Name:        "listen6-80",
+		Source:      "2001:db8::1",
+		ServicePort: "80",
+		DestIPs:     []string{"192.0.2.1"},
+		TargetPort:  "8080",
+		ServerAddrs: []string{"192.0.2.1:8080"},
+		StatsSocket: "/etc/ravel/2001:db8::1-80.sock",
+	}
+	if _, err := templates.render(sample); err != nil {
+		return nil, fmt.Errorf("haproxy template %s does not render. %v", path, err)
+	}
+	return templates, nil
+}
+
+// defaultTemplates are used by listeners created without Templates.
+var defaultTemplates = func() *Templates {
+	t, err := NewTemplates("", "")
+	if err != nil {
+		panic(err)
+	}
+	return t
+}()
+
+// render executes the template for a listener and checks the result.
+func (t *Templates) render(d TemplateData) ([]byte, error) {
+	return t.renderAll([]TemplateData{d})
+}
+
+// renderAll executes the template for the listeners of a process and checks
+// the result for each of them.
+func (t *Templates) renderAll(data []TemplateData) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := t.template.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	for _, d := range data {
+		if err := validate(b, d); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// snippet returns the snippet of a listener, preferring one for its VIP and
+// port over one for its port.
+func (t *Templates) snippet(listenAddr, servicePort string) (string, error) {
+	if t.snippetDir == "" {
+		return "", nil
+	}
+	for _, name := range []string{listenAddr + "-" + servicePort + ".cfg", servicePort + ".cfg"} {
+		b, err := ioutil.ReadFile(filepath.Join(t.snippetDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\n"), nil
+	}
+	return "", nil
+}
+
+// validate checks that a rendered configuration binds the listener and keeps
+// its stats socket.
+func validate(b []byte, d TemplateData) error {
+	conf := string(b)
+	if !strings.Contains(conf, "stats socket "+d.StatsSocket) {
+		return fmt.Errorf("rendered configuration has no stats socket at %s", d.StatsSocket)
+	}
+	if !strings.Contains(conf, d.Source+":"+d.ServicePort) {
+		return fmt.Errorf("rendered configuration does not bind %s:%s", d.Source, d.ServicePort)
+	}
+	return nil
+}
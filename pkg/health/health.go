@@ -0,0 +1,224 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkTimeout bounds how long a single probe waits on the subsystem checks.
+const checkTimeout = 5 * time.Second
+
+// Status is the state of a single subsystem as reported by its check.
+type Status struct {
+	Ready   bool        `json:"ready"`
+	Message string      `json:"message,omitempty"`
+	Detail  interface{} `json:"detail,omitempty"`
+}
+
+// Check reports the status of a subsystem. Checks may be called concurrently
+// and should return promptly once ctx is done.
+type Check func(ctx context.Context) Status
+
+// Registry holds the checks that make up the readiness of the process.
+type Registry struct {
+	sync.Mutex
+	checks  map[string]Check
+	started time.Time
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		checks:  map[string]Check{},
+		started: time.Now(),
+	}
+}
+
+// Register adds a check for the named subsystem, replacing any previous one.
+func (r *Registry) Register(name string, check Check) {
+	r.Lock()
+	defer r.Unlock()
+	r.checks[name] = check
+}
+
+// Check runs every registered check concurrently and reports whether all of
+// them are ready, along with each status by subsystem name.
+func (r *Registry) Check(ctx context.Context) (bool, map[string]Status) {
+	r.Lock()
+	checks := make(map[string]Check, len(r.checks))
+	for name, check := range r.checks {
+		checks[name] = check
+	}
+	r.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	statuses := make(map[string]Status, len(checks))
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			status := check(ctx)
+			mu.Lock()
+			statuses[name] = status
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	ready := true
+	for _, status := range statuses {
+		ready = ready && status.Ready
+	}
+	return ready, statuses
+}
+
+// LivenessHandler serves /healthz. It only reports that the process is able
+// to serve requests; it does not run the subsystem checks, so that a stuck
+// dependency doesn't get the container restarted.
+func (r *Registry) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// ReadinessHandler serves /readyz. It responds 200 when every subsystem is
+// ready, and 503 with the subsystems that are not otherwise.
+func (r *Registry) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ready, statuses := r.Check(req.Context())
+		if ready {
+			fmt.Fprintln(w, "ok")
+			return
+		}
+
+		failing := []string{}
+		for name, status := range statuses {
+			if !status.Ready {
+				failing = append(failing, fmt.Sprintf("%s: %s", name, status.Message))
+			}
+		}
+		sort.Strings(failing)
+		http.Error(w, strings.Join(failing, "\n"), http.StatusServiceUnavailable)
+	})
+}
+
+// StatusHandler serves /statusz, the full status of every subsystem as JSON.
+// It always responds 200 so that it can be read while the process is not ready.
+func (r *Registry) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ready, statuses := r.Check(req.Context())
+		out := struct {
+			Ready      bool              `json:"ready"`
+			Uptime     string            `json:"uptime"`
+			Subsystems map[string]Status `json:"subsystems"`
+		}{
+			Ready:      ready,
+			Uptime:     time.Since(r.started).Round(time.Second).String(),
+			Subsystems: statuses,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		b, _ := json.MarshalIndent(out, "", " ")
+		w.Write(b)
+	})
+}
+
+// Reconcile tracks the outcome of the most recent reconcile of a worker. The
+// zero value is ready to use and reports not ready until the first Record.
+type Reconcile struct {
+	sync.Mutex
+	last  time.Time
+	err   error
+	count uint64
+
+	// parity is the outcome of the most recent parity check, run at checked
+	parity  bool
+	checked time.Time
+
+	// warm is set once a parity check has confirmed a successful reconcile,
+	// and stays set. configured is set by the first successful reconcile.
+	configured bool
+	warm       bool
+}
+
+// ReconcileDetail is the detail of the status of a Reconcile.
+type ReconcileDetail struct {
+	Reconciles uint64 `json:"reconciles"`
+	Last       string `json:"last,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Parity is whether the most recent parity check found the applied
+	// config matching the wanted one, at ParityChecked. Both are unset
+	// until the first check.
+	Parity        *bool  `json:"parity,omitempty"`
+	ParityChecked string `json:"parityChecked,omitempty"`
+	// Warm is whether a parity check has confirmed the rules a reconcile
+	// programmed. Until then the worker isn't ready.
+	Warm bool `json:"warm"`
+}
+
+// Record stores the outcome of a reconcile.
+func (r *Reconcile) Record(err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.last = time.Now()
+	r.err = err
+	r.count++
+	if err == nil {
+		r.configured = true
+	}
+}
+
+// Parity stores the outcome of a check of the applied config against the
+// wanted one.
+func (r *Reconcile) Parity(same bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.parity = same
+	r.checked = time.Now()
+	if same && r.configured {
+		r.warm = true
+	}
+}
+
+// Warm reports whether a parity check has confirmed the rules of a
+// successful reconcile. Routes aren't announced until it has.
+func (r *Reconcile) Warm() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.warm
+}
+
+// Status reports ready when the most recent reconcile succeeded, once a
+// parity check has confirmed the first that did.
+func (r *Reconcile) Status(context.Context) Status {
+	r.Lock()
+	defer r.Unlock()
+
+	detail := ReconcileDetail{Reconciles: r.count, Warm: r.warm}
+	if !r.checked.IsZero() {
+		parity := r.parity
+		detail.Parity = &parity
+		detail.ParityChecked = r.checked.UTC().Format(time.RFC3339)
+	}
+	if r.count == 0 {
+		return Status{Message: "no reconcile has completed yet", Detail: detail}
+	}
+	detail.Last = r.last.UTC().Format(time.RFC3339)
+	if r.err != nil {
+		detail.Error = r.err.Error()
+		return Status{Message: "last reconcile failed", Detail: detail}
+	}
+	if !r.warm {
+		return Status{Message: "waiting for a parity check to confirm the first reconcile", Detail: detail}
+	}
+	return Status{Ready: true, Detail: detail}
+}
@@ -0,0 +1,64 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	r := NewRegistry()
+	var reconcile Reconcile
+	r.Register("watcher", func(context.Context) Status { return Status{Ready: true} })
+	r.Register("worker", reconcile.Status)
+
+	probe := func(h http.Handler) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w
+	}
+
+	if w := probe(r.ReadinessHandler()); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "worker") {
+		t.Fatalf("expected worker to be not ready before a reconcile. saw %d %s", w.Code, w.Body.String())
+	}
+
+	// a parity check before any reconcile succeeded confirms nothing
+	reconcile.Parity(true)
+	reconcile.Record(nil)
+	if w := probe(r.ReadinessHandler()); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "parity check") {
+		t.Fatalf("expected worker to be not ready until parity confirms the reconcile. saw %d %s", w.Code, w.Body.String())
+	}
+	if reconcile.Warm() {
+		t.Fatal("expected the worker not to be warm before parity confirms the reconcile")
+	}
+
+	reconcile.Parity(true)
+	if w := probe(r.ReadinessHandler()); w.Code != http.StatusOK {
+		t.Fatalf("expected ready after parity confirms a successful reconcile. saw %d %s", w.Code, w.Body.String())
+	}
+	if !reconcile.Warm() {
+		t.Fatal("expected the worker to be warm once parity confirms the reconcile")
+	}
+
+	reconcile.Record(errors.New("ipvsadm failed"))
+	if w := probe(r.ReadinessHandler()); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected not ready after a failed reconcile. saw %d", w.Code)
+	}
+	if w := probe(r.StatusHandler()); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "ipvsadm failed") {
+		t.Fatalf("expected status to include the reconcile error. saw %d %s", w.Code, w.Body.String())
+	}
+	if w := probe(r.LivenessHandler()); w.Code != http.StatusOK {
+		t.Fatalf("expected liveness regardless of readiness. saw %d", w.Code)
+	}
+
+	reconcile.Parity(false)
+	if w := probe(r.StatusHandler()); !strings.Contains(w.Body.String(), `"parity": false`) {
+		t.Fatalf("expected status to include the parity check. saw %s", w.Body.String())
+	}
+	if !reconcile.Warm() {
+		t.Fatal("expected the worker to stay warm after a parity mismatch")
+	}
+}
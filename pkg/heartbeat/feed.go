@@ -0,0 +1,237 @@
+package heartbeat
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+// A director can also feed its cluster config and node list to realservers
+// across the cluster, so that they don't each watch the configmap and nodes
+// themselves. The feed is a second service of the coordinator, served on its
+// own listener so that realservers of other nodes can reach it without
+// reaching the heartbeat, which only the realserver of the director's node
+// may answer to:
+//
+//	service ConfigFeed {
+//	  rpc Follow(Hello) returns (stream Snapshot);
+//	}
+//	message Snapshot {
+//	  uint64 generation = 1;
+//	  string config_hash = 2;
+//	  bytes cluster_config = 3;
+//	  bytes nodes = 4;
+//	}
+//
+// Each snapshot is whole, and a follower that hasn't taken one yet only gets
+// the latest. The payloads are opaque to the feed.
+
+const followMethod = "/ravel.coordinator.v1.ConfigFeed/Follow"
+
+// MaxSnapshotSize bounds a snapshot a follower accepts.
+const MaxSnapshotSize = 64 << 20
+
+// feedKeepalive is how often a follower pings a quiet feed, so that it finds
+// a director that went away without closing the stream.
+const feedKeepalive = 10 * time.Second
+
+// Snapshot is the cluster config and node list of a director.
+type Snapshot struct {
+	Generation    uint64
+	ConfigHash    string
+	ClusterConfig []byte
+	Nodes         []byte
+}
+
+func (s *Snapshot) marshal() []byte {
+	var b []byte
+	if s.Generation != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, s.Generation)
+	}
+	b = appendString(b, 2, s.ConfigHash)
+	b = appendString(b, 3, string(s.ClusterConfig))
+	return appendString(b, 4, string(s.Nodes))
+}
+
+func (s *Snapshot) unmarshal(b []byte) error {
+	return consume(b, func(num protowire.Number, str string, v uint64) {
+		switch num {
+		case 1:
+			s.Generation = v
+		case 2:
+			s.ConfigHash = str
+		case 3:
+			s.ClusterConfig = []byte(str)
+		case 4:
+			s.Nodes = []byte(str)
+		}
+	})
+}
+
+// feeder is the handler type of the feed service.
+type feeder interface {
+	follow(*Hello, grpc.ServerStream) error
+}
+
+var feedDesc = grpc.ServiceDesc{
+	ServiceName: "ravel.coordinator.v1.ConfigFeed",
+	HandlerType: (*feeder)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Follow",
+		ServerStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			in := &Hello{}
+			if err := stream.RecvMsg(in); err != nil {
+				return err
+			}
+			return srv.(feeder).follow(in, stream)
+		},
+	}},
+}
+
+// Feed streams a director's snapshots to the realservers following it.
+type Feed struct {
+	logger logging.Logger
+
+	mu        sync.Mutex
+	last      *Snapshot
+	followers map[chan Snapshot]string
+}
+
+// NewFeed returns a feed with no snapshot yet.
+func NewFeed(logger logging.Logger) *Feed {
+	return &Feed{logger: logger, followers: map[chan Snapshot]string{}}
+}
+
+// Serve streams snapshots on ln until ctx is done. tlsConfig, if set, must
+// require client certificates.
+func (f *Feed) Serve(ctx context.Context, ln net.Listener, tlsConfig *tls.Config) error {
+	opts := []grpc.ServerOption{
+		grpc.ForceServerCodec(codec{}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: feedKeepalive / 2}),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	g := grpc.NewServer(opts...)
+	g.RegisterService(&feedDesc, f)
+	go func() {
+		<-ctx.Done()
+		g.Stop()
+	}()
+	return g.Serve(ln)
+}
+
+// Publish sends s to every follower, in place of any snapshot it hasn't
+// taken yet.
+func (f *Feed) Publish(s Snapshot) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.last = &s
+	for ch := range f.followers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- s
+	}
+}
+
+// Followers returns the identities of the realservers following the feed.
+func (f *Feed) Followers() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	identities := []string{}
+	for _, identity := range f.followers {
+		identities = append(identities, identity)
+	}
+	return identities
+}
+
+// follow streams the snapshots to a realserver, starting with the last one,
+// until it goes away.
+func (f *Feed) follow(in *Hello, stream grpc.ServerStream) error {
+	f.logger.Debugf("realserver %s of config key %s is following the config feed", in.Identity, in.ConfigKey)
+	ch := make(chan Snapshot, 1)
+	f.mu.Lock()
+	if f.last != nil {
+		ch <- *f.last
+	}
+	f.followers[ch] = in.Identity
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		delete(f.followers, ch)
+		f.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case s := <-ch:
+			if err := stream.SendMsg(&s); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// DialFeed returns a client of the feed of the director at addr, which
+// introduces itself with hello. tlsConfig, if set, must carry a client
+// certificate.
+func DialFeed(addr string, tlsConfig *tls.Config, hello Hello) (*Client, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	conn, err := grpc.Dial(addr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{}), grpc.MaxCallRecvMsgSize(MaxSnapshotSize)),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.Config{BaseDelay: 100 * time.Millisecond, Multiplier: 1.6, MaxDelay: time.Second},
+			MinConnectTimeout: Timeout,
+		}),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: feedKeepalive, Timeout: feedKeepalive / 2}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, hello: hello}, nil
+}
+
+// Follow calls snapshot with each snapshot the feed of the director sends,
+// until the stream breaks or ctx is done, and returns why it ended.
+func (c *Client) Follow(ctx context.Context, snapshot func(Snapshot)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.conn.NewStream(ctx, &feedDesc.Streams[0], followMethod)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&c.hello); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		s := &Snapshot{}
+		if err := stream.RecvMsg(s); err != nil {
+			return err
+		}
+		snapshot(*s)
+	}
+}
@@ -0,0 +1,601 @@
+package heartbeat
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+// A director tells the realserver on its node that it is running through a
+// heartbeat on the coordinator port. The realserver calls it once a second,
+// and stands down while it gets answers. Each answer carries the director's
+// identity and config key, so that the realserver can tell whether it is
+// following the right director, and the hash and generation of the cluster
+// config the director last published, so that config skew between the two
+// shows up.
+//
+// Answering only shows that the director's process is up. Each answer also
+// carries whether the director's latest reconcile succeeded and when it
+// finished, so that the realserver can stand in for a director that answers
+// but has stopped reconciling, as when it is deadlocked, or that keeps
+// failing to. Both ends are on the same node, so the realserver judges the
+// time against its own clock.
+//
+// The director also pushes the generation and hash of each cluster config it
+// applies to the realservers that watch it, as soon as it has applied it, so
+// that a realserver learns of a change, or of the director going away when
+// the stream breaks, without waiting for its next heartbeat. The heartbeat
+// stays the source of truth: a push only brings the next one forward.
+//
+// Each end also sends its version and the coordinator features it supports,
+// so that a director and realserver of different versions, as during a
+// rolling upgrade, only rely on the features both have. An end that sends no
+// capabilities predates the handshake, and is taken to have the Legacy ones.
+// Each end falls back on its own: a realserver only watches a director that
+// pushes, and only compares config hashes computed the same way, and a
+// director answers old and new realservers alike, as old ones skip the
+// fields they don't know.
+//
+// The heartbeat is a gRPC service, with messages encoded by hand as in
+// remote write:
+//
+//	service Coordinator {
+//	  rpc Heartbeat(Hello) returns (Beat);
+//	  rpc Watch(Hello) returns (stream Applied);
+//	}
+//	message Hello {
+//	  string identity = 1;
+//	  string config_key = 2;
+//	  string version = 3;
+//	  repeated string capabilities = 4;
+//	}
+//	message Beat {
+//	  string identity = 1;
+//	  string config_key = 2;
+//	  string config_hash = 3;
+//	  uint64 generation = 4;
+//	  uint64 fence = 5;
+//	  string version = 6;
+//	  repeated string capabilities = 7;
+//	  bool healthy = 8;
+//	  int64 reconciled_unix_nano = 9;
+//	}
+//	message Applied {
+//	  string config_hash = 1;
+//	  uint64 generation = 2;
+//	}
+//
+// With a CA, both ends present certificates signed by it, and the realserver
+// checks the director's against a server name. Without one the heartbeat is
+// plaintext, and any process on the port that answers it passes for a
+// director, as any listener on the port did before.
+//
+// The client reconnects within a second of the director coming back, so that
+// the realserver never runs alongside it for longer than a failed beat.
+
+const (
+	method      = "/ravel.coordinator.v1.Coordinator/Heartbeat"
+	watchMethod = "/ravel.coordinator.v1.Coordinator/Watch"
+)
+
+// Timeout bounds a single heartbeat.
+const Timeout = 500 * time.Millisecond
+
+// The coordinator features an end can support.
+const (
+	// CapabilityConfigHash is a beat carrying the hash and generation of
+	// the cluster config, hashed as by this version
+	CapabilityConfigHash = "config-hash/v1"
+	// CapabilityFence is a beat carrying the fence generation
+	CapabilityFence = "fence"
+	// CapabilityPush is the Watch stream of applied configs
+	CapabilityPush = "push"
+	// CapabilityStatus is a beat carrying the health of the director and
+	// when it last reconciled
+	CapabilityStatus = "status"
+)
+
+// Capabilities are the features this build supports.
+var Capabilities = []string{CapabilityConfigHash, CapabilityFence, CapabilityPush, CapabilityStatus}
+
+// Legacy are the features of an end that predates the handshake.
+var Legacy = []string{CapabilityConfigHash, CapabilityFence}
+
+// PeerCapabilities returns the features of the other end, from the
+// capabilities it sent.
+func PeerCapabilities(sent []string) []string {
+	if len(sent) == 0 {
+		return Legacy
+	}
+	return sent
+}
+
+// Missing returns the features of this build that caps lacks.
+func Missing(caps []string) []string {
+	missing := []string{}
+	for _, c := range Capabilities {
+		if !Has(caps, c) {
+			missing = append(missing, c)
+		}
+	}
+	return missing
+}
+
+// Has reports whether caps includes the feature c.
+func Has(caps []string, c string) bool {
+	for _, have := range caps {
+		if have == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Hello identifies the realserver asking for a heartbeat.
+type Hello struct {
+	Identity     string
+	ConfigKey    string
+	Version      string
+	Capabilities []string
+}
+
+// Beat is a director's answer to a heartbeat.
+type Beat struct {
+	Identity   string
+	ConfigKey  string
+	ConfigHash string
+	Generation uint64
+	// Fence is the generation of the claim the director holds the VIPs
+	// under, or 0 when it holds none.
+	Fence        uint64
+	Version      string
+	Capabilities []string
+	// Healthy is whether the director's latest reconcile succeeded, and
+	// Reconciled when it finished. Until its first reconcile, a director
+	// reports itself healthy as of when it started, so that one that never
+	// gets that far still goes stale.
+	Healthy    bool
+	Reconciled time.Time
+}
+
+// Applied is pushed by a director once it has applied a cluster config.
+type Applied struct {
+	ConfigHash string
+	Generation uint64
+}
+
+func (h *Hello) marshal() []byte {
+	b := appendString(nil, 1, h.Identity)
+	b = appendString(b, 2, h.ConfigKey)
+	b = appendString(b, 3, h.Version)
+	for _, c := range h.Capabilities {
+		b = appendString(b, 4, c)
+	}
+	return b
+}
+
+func (h *Hello) unmarshal(b []byte) error {
+	return consume(b, func(num protowire.Number, s string, _ uint64) {
+		switch num {
+		case 1:
+			h.Identity = s
+		case 2:
+			h.ConfigKey = s
+		case 3:
+			h.Version = s
+		case 4:
+			h.Capabilities = append(h.Capabilities, s)
+		}
+	})
+}
+
+func (m *Beat) marshal() []byte {
+	b := appendString(nil, 1, m.Identity)
+	b = appendString(b, 2, m.ConfigKey)
+	b = appendString(b, 3, m.ConfigHash)
+	if m.Generation != 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Generation)
+	}
+	if m.Fence != 0 {
+		b = protowire.AppendTag(b, 5, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Fence)
+	}
+	b = appendString(b, 6, m.Version)
+	for _, c := range m.Capabilities {
+		b = appendString(b, 7, c)
+	}
+	if m.Healthy {
+		b = protowire.AppendTag(b, 8, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if !m.Reconciled.IsZero() {
+		b = protowire.AppendTag(b, 9, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Reconciled.UnixNano()))
+	}
+	return b
+}
+
+func (m *Beat) unmarshal(b []byte) error {
+	return consume(b, func(num protowire.Number, s string, v uint64) {
+		switch num {
+		case 1:
+			m.Identity = s
+		case 2:
+			m.ConfigKey = s
+		case 3:
+			m.ConfigHash = s
+		case 4:
+			m.Generation = v
+		case 5:
+			m.Fence = v
+		case 6:
+			m.Version = s
+		case 7:
+			m.Capabilities = append(m.Capabilities, s)
+		case 8:
+			m.Healthy = v != 0
+		case 9:
+			m.Reconciled = time.Unix(0, int64(v))
+		}
+	})
+}
+
+func (a *Applied) marshal() []byte {
+	b := appendString(nil, 1, a.ConfigHash)
+	if a.Generation != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, a.Generation)
+	}
+	return b
+}
+
+func (a *Applied) unmarshal(b []byte) error {
+	return consume(b, func(num protowire.Number, s string, v uint64) {
+		switch num {
+		case 1:
+			a.ConfigHash = s
+		case 2:
+			a.Generation = v
+		}
+	})
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// consume reads the string and varint fields of a message, and skips any
+// other field.
+func consume(b []byte, field func(num protowire.Number, s string, v uint64)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.BytesType:
+			s, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			field(num, s, 0)
+			b = b[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			field(num, "", v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+// message is a message of the heartbeat.
+type message interface {
+	marshal() []byte
+	unmarshal([]byte) error
+}
+
+// codec puts the messages on the wire as protobuf.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(message)
+	if !ok {
+		return nil, fmt.Errorf("heartbeat: unable to marshal %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (codec) Unmarshal(b []byte, v interface{}) error {
+	m, ok := v.(message)
+	if !ok {
+		return fmt.Errorf("heartbeat: unable to unmarshal %T", v)
+	}
+	return m.unmarshal(b)
+}
+
+func (codec) Name() string { return "proto" }
+
+// coordinator is the handler type of the service.
+type coordinator interface {
+	heartbeat(context.Context, *Hello) (*Beat, error)
+	watch(*Hello, grpc.ServerStream) error
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "ravel.coordinator.v1.Coordinator",
+	HandlerType: (*coordinator)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Heartbeat",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := &Hello{}
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			return srv.(coordinator).heartbeat(ctx, in)
+		},
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Watch",
+		ServerStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			in := &Hello{}
+			if err := stream.RecvMsg(in); err != nil {
+				return err
+			}
+			return srv.(coordinator).watch(in, stream)
+		},
+	}},
+}
+
+// Server answers heartbeats on behalf of a director, and pushes the configs
+// it applies to the realservers watching it.
+type Server struct {
+	beat   func(Hello) Beat
+	logger logging.Logger
+
+	mu       sync.Mutex
+	applied  Applied
+	watchers map[chan Applied]struct{}
+
+	// the outcome of the director's latest reconcile
+	healthy    bool
+	reconciled time.Time
+}
+
+// NewServer returns a server that answers each hello with what beat returns
+// for it, and the status last recorded with Reconciled. One server may serve
+// several listeners.
+func NewServer(beat func(Hello) Beat, logger logging.Logger) *Server {
+	return &Server{beat: beat, logger: logger, watchers: map[chan Applied]struct{}{}, healthy: true, reconciled: time.Now()}
+}
+
+// Serve answers heartbeats on ln with what beat returns until ctx is done.
+// tlsConfig, if set, must require client certificates.
+func Serve(ctx context.Context, ln net.Listener, tlsConfig *tls.Config, beat func() Beat, logger logging.Logger) error {
+	return NewServer(func(Hello) Beat { return beat() }, logger).Serve(ctx, ln, tlsConfig)
+}
+
+// Serve answers heartbeats and watches on ln until ctx is done. tlsConfig, if
+// set, must require client certificates.
+func (s *Server) Serve(ctx context.Context, ln net.Listener, tlsConfig *tls.Config) error {
+	opts := []grpc.ServerOption{grpc.ForceServerCodec(codec{})}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	g := grpc.NewServer(opts...)
+	g.RegisterService(&serviceDesc, s)
+	go func() {
+		<-ctx.Done()
+		g.Stop()
+	}()
+	return g.Serve(ln)
+}
+
+// Publish pushes a config the director applied to every watcher. A watcher
+// that hasn't taken the previous push yet only gets the latest.
+func (s *Server) Publish(a Applied) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a == s.applied {
+		return
+	}
+	s.applied = a
+	for ch := range s.watchers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- a
+	}
+}
+
+// Reconciled records the outcome of a reconcile the director just finished,
+// for the beats to report.
+func (s *Server) Reconciled(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.healthy, s.reconciled = err == nil, time.Now()
+}
+
+func (s *Server) heartbeat(_ context.Context, in *Hello) (*Beat, error) {
+	s.logger.Debugf("heartbeat from realserver %s of config key %s", in.Identity, in.ConfigKey)
+	b := s.beat(*in)
+	s.mu.Lock()
+	b.Healthy, b.Reconciled = s.healthy, s.reconciled
+	s.mu.Unlock()
+	return &b, nil
+}
+
+// watch streams the applied configs to a realserver, starting with the last
+// one, until it goes away.
+func (s *Server) watch(in *Hello, stream grpc.ServerStream) error {
+	s.logger.Debugf("realserver %s of config key %s is watching for applied configs", in.Identity, in.ConfigKey)
+	ch := make(chan Applied, 1)
+	s.mu.Lock()
+	if s.applied != (Applied{}) {
+		ch <- s.applied
+	}
+	s.watchers[ch] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers, ch)
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case a := <-ch:
+			if err := stream.SendMsg(&a); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// Client calls the heartbeat of a director.
+type Client struct {
+	conn  *grpc.ClientConn
+	hello Hello
+}
+
+// Dial returns a client of the director at addr, which introduces itself with
+// hello. Connections are made as heartbeats are called. tlsConfig, if set,
+// must carry a client certificate.
+func Dial(addr string, tlsConfig *tls.Config, hello Hello) (*Client, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	conn, err := grpc.Dial(addr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.Config{BaseDelay: 100 * time.Millisecond, Multiplier: 1.6, MaxDelay: time.Second},
+			MinConnectTimeout: Timeout,
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, hello: hello}, nil
+}
+
+// Beat calls the heartbeat once.
+func (c *Client) Beat(ctx context.Context) (Beat, error) {
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+	out := &Beat{}
+	if err := c.conn.Invoke(ctx, method, &c.hello, out); err != nil {
+		return Beat{}, err
+	}
+	return *out, nil
+}
+
+// Watch calls applied with each config the director pushes, until the stream
+// breaks or ctx is done, and returns why it ended.
+func (c *Client) Watch(ctx context.Context, applied func(Applied)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.conn.NewStream(ctx, &serviceDesc.Streams[0], watchMethod)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&c.hello); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		a := &Applied{}
+		if err := stream.RecvMsg(a); err != nil {
+			return err
+		}
+		applied(*a)
+	}
+}
+
+// Close closes the connection to the director.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// ServerTLS returns the tls config of a director, which presents the
+// certificate in certFile and keyFile and requires one signed by the CA in
+// caFile.
+func ServerTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, pool, err := load(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ClientTLS returns the tls config of a realserver, which presents the
+// certificate in certFile and keyFile and requires the director's to be
+// signed by the CA in caFile for serverName.
+func ClientTLS(certFile, keyFile, caFile, serverName string) (*tls.Config, error) {
+	cert, pool, err := load(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   serverName,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func load(certFile, keyFile, caFile string) (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("unable to load coordinator certificate. %v", err)
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("unable to read coordinator ca file. %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return tls.Certificate{}, nil, fmt.Errorf("no certificates found in coordinator ca file %s", caFile)
+	}
+	return cert, pool, nil
+}
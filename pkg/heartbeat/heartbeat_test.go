@@ -0,0 +1,311 @@
+package heartbeat
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+// issue writes a key pair for name, signed by ca or self-signed when ca is
+// nil, and returns the paths of the certificate and key.
+func issue(t *testing.T, dir, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (string, string, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		parent, signer = ca, caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile, cert, key
+}
+
+func TestHeartbeat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := logging.New()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	beat := Beat{Identity: "node-a", ConfigKey: "green", ConfigHash: "abc123", Generation: 42}
+	server := NewServer(func(Hello) Beat { return beat }, logger)
+	go server.Serve(ctx, ln, nil)
+
+	client, err := Dial(ln.Addr().String(), nil, Hello{Identity: "node-a", ConfigKey: "green"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	got, err := client.Beat(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a director that has yet to reconcile is healthy as of when it started
+	started := got.Reconciled
+	if !got.Healthy || started.IsZero() {
+		t.Fatalf("expected a healthy director, got %+v", got)
+	}
+	got.Healthy, got.Reconciled = false, time.Time{}
+	if !reflect.DeepEqual(got, beat) {
+		t.Fatalf("expected %+v, got %+v", beat, got)
+	}
+
+	// a failed reconcile is reported as unhealthy
+	time.Sleep(10 * time.Millisecond)
+	server.Reconciled(fmt.Errorf("ipvsadm failed"))
+	if got, err = client.Beat(ctx); err != nil || got.Healthy || !got.Reconciled.After(started) {
+		t.Fatalf("expected an unhealthy director that reconciled after it started, got %+v %v", got, err)
+	}
+
+	// a listener that doesn't speak the heartbeat isn't a director
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	go func() {
+		for {
+			conn, err := raw.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	other, _ := Dial(raw.Addr().String(), nil, Hello{})
+	defer other.Close()
+	if _, err := other.Beat(ctx); err == nil {
+		t.Fatal("expected a bare listener to fail the heartbeat")
+	}
+}
+
+func TestHeartbeatTLS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+
+	caFile, _, ca, caKey := issue(t, dir, "ca", nil, nil)
+	serverCert, serverKey, _, _ := issue(t, dir, "ravel-director", ca, caKey)
+	clientCert, clientKey, _, _ := issue(t, dir, "ravel-realserver", ca, caKey)
+	otherCA, _, other, otherKey := issue(t, dir, "other-ca", nil, nil)
+	strayCert, strayKey, _, _ := issue(t, dir, "stray", other, otherKey)
+
+	serverTLS, err := ServerTLS(serverCert, serverKey, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go Serve(ctx, ln, serverTLS, func() Beat { return Beat{Identity: "node-a"} }, logging.New())
+
+	beat := func(certFile, keyFile, caFile, serverName string) error {
+		clientTLS, err := ClientTLS(certFile, keyFile, caFile, serverName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := Dial(ln.Addr().String(), clientTLS, Hello{Identity: "node-a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		_, err = c.Beat(ctx)
+		return err
+	}
+
+	if err := beat(clientCert, clientKey, caFile, "ravel-director"); err != nil {
+		t.Fatalf("expected the heartbeat to pass. %v", err)
+	}
+	if err := beat(clientCert, clientKey, caFile, "someone-else"); err == nil {
+		t.Fatal("expected a director with the wrong name to be refused")
+	}
+	if err := beat(strayCert, strayKey, otherCA, "ravel-director"); err == nil {
+		t.Fatal("expected a client of another ca to be refused")
+	}
+
+	if _, err := ServerTLS(serverCert, serverKey, filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("expected a missing ca file to be an error")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(func(Hello) Beat { return Beat{} }, logging.New())
+	server.Publish(Applied{ConfigHash: "abc", Generation: 1})
+	serveCtx, stop := context.WithCancel(ctx)
+	go server.Serve(serveCtx, ln, nil)
+
+	client, err := Dial(ln.Addr().String(), nil, Hello{Identity: "node-a", ConfigKey: "green"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	pushes := make(chan Applied, 8)
+	ended := make(chan error, 1)
+	go func() { ended <- client.Watch(ctx, func(a Applied) { pushes <- a }) }()
+
+	next := func() Applied {
+		select {
+		case a := <-pushes:
+			return a
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected a push")
+		}
+		return Applied{}
+	}
+	// a watcher starts with the last config applied
+	if a := next(); a != (Applied{ConfigHash: "abc", Generation: 1}) {
+		t.Fatalf("expected the last config applied, got %+v", a)
+	}
+	// the same config isn't pushed twice
+	server.Publish(Applied{ConfigHash: "abc", Generation: 1})
+	server.Publish(Applied{ConfigHash: "def", Generation: 2})
+	if a := next(); a != (Applied{ConfigHash: "def", Generation: 2}) {
+		t.Fatalf("expected generation 2, got %+v", a)
+	}
+
+	// the stream breaks when the director goes away
+	stop()
+	select {
+	case err := <-ended:
+		if err == nil {
+			t.Fatal("expected the watch to end with the director's error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the watch to end with the director")
+	}
+}
+
+func TestFeed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed := NewFeed(logging.New())
+	feed.Publish(Snapshot{Generation: 1, ConfigHash: "abc", ClusterConfig: []byte(`{"config":{}}`), Nodes: []byte(`[]`)})
+	go feed.Serve(ctx, ln, nil)
+
+	client, err := DialFeed(ln.Addr().String(), nil, Hello{Identity: "node-b", ConfigKey: "green"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	snapshots := make(chan Snapshot, 8)
+	go client.Follow(ctx, func(s Snapshot) { snapshots <- s })
+
+	next := func() Snapshot {
+		select {
+		case s := <-snapshots:
+			return s
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected a snapshot")
+		}
+		return Snapshot{}
+	}
+	// a follower starts with the last snapshot
+	if s := next(); s.Generation != 1 || s.ConfigHash != "abc" || string(s.ClusterConfig) != `{"config":{}}` || string(s.Nodes) != `[]` {
+		t.Fatalf("expected the last snapshot, got %+v", s)
+	}
+	if followers := feed.Followers(); len(followers) != 1 || followers[0] != "node-b" {
+		t.Fatalf("expected node-b to follow the feed, got %v", followers)
+	}
+	feed.Publish(Snapshot{Generation: 2, ConfigHash: "def"})
+	if s := next(); s.Generation != 2 || s.ConfigHash != "def" || len(s.ClusterConfig) != 0 {
+		t.Fatalf("expected generation 2, got %+v", s)
+	}
+
+	// the heartbeat isn't served on the feed
+	if _, err := client.Beat(ctx); err == nil {
+		t.Fatal("expected the feed not to answer heartbeats")
+	}
+}
+
+func TestMessages(t *testing.T) {
+	in := Beat{Identity: "node-a", ConfigKey: "green", ConfigHash: "abc", Generation: 7, Fence: 3, Version: "2.6.0", Capabilities: []string{CapabilityFence, CapabilityPush}, Healthy: true, Reconciled: time.Unix(0, 1600000000123456789)}
+	out := Beat{}
+	if err := out.unmarshal(in.marshal()); err != nil || !reflect.DeepEqual(out, in) {
+		t.Fatalf("expected %+v, got %+v %v", in, out, err)
+	}
+	// unknown fields are skipped
+	b := append(in.marshal(), 0x45, 1, 2, 3, 4)
+	out = Beat{}
+	if err := out.unmarshal(b); err != nil || !reflect.DeepEqual(out, in) {
+		t.Fatalf("expected %+v, got %+v %v", in, out, err)
+	}
+	hello, gotHello := Hello{Identity: "node-a", Version: "2.5.1", Capabilities: []string{CapabilityConfigHash}}, Hello{}
+	if err := gotHello.unmarshal(hello.marshal()); err != nil || !reflect.DeepEqual(gotHello, hello) {
+		t.Fatalf("expected %+v, got %+v %v", hello, gotHello, err)
+	}
+	applied, got := Applied{ConfigHash: "abc", Generation: 9}, Applied{}
+	if err := got.unmarshal(applied.marshal()); err != nil || got != applied {
+		t.Fatalf("expected %+v, got %+v %v", applied, got, err)
+	}
+	if err := out.unmarshal([]byte{0x0a, 0x05}); err == nil {
+		t.Fatal("expected a truncated message to be an error")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	// an end that predates the handshake only lacks the push and status
+	if missing := Missing(PeerCapabilities(nil)); !reflect.DeepEqual(missing, []string{CapabilityPush, CapabilityStatus}) {
+		t.Fatalf("expected a legacy end to lack the push and status, got %v", missing)
+	}
+	if missing := Missing(PeerCapabilities(Capabilities)); len(missing) != 0 {
+		t.Fatalf("expected nothing missing, got %v", missing)
+	}
+	// a config hash computed another way isn't comparable
+	other := []string{"config-hash/v2", CapabilityFence, CapabilityPush}
+	if Has(other, CapabilityConfigHash) || !Has(other, CapabilityPush) {
+		t.Fatalf("expected only the push and fence in common with %v", other)
+	}
+}
@@ -0,0 +1,114 @@
+// Package instance keeps a second ravel of the same mode and config key from
+// running on a node, where the two would fight over ipvs and iptables.
+//
+// The lock is an abstract unix socket, which the kernel releases when its
+// process exits however it exits, so there is never a stale lock to clear.
+// Abstract sockets belong to a network namespace, as ipvs and iptables do,
+// so ravels in different namespaces don't lock each other out.
+package instance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+var refusedDef = stats.Define(stats.Definition{
+	Type:   stats.Counter,
+	Name:   "instance_refused_total",
+	Help:   "is a count of the ravels of the same mode and config key that were refused, because this one holds the node",
+	Labels: []string{"lb", "seczone"},
+})
+
+// Name returns the abstract socket that locks kind and configKey.
+func Name(kind stats.LBKind, configKey string) string {
+	return fmt.Sprintf("@ravel/%s/%s", kind, configKey)
+}
+
+// HeldError is returned when another ravel holds the lock.
+type HeldError struct {
+	Kind      stats.LBKind
+	ConfigKey string
+	// PID is the process holding the lock, or 0 if it couldn't be found.
+	PID int
+}
+
+func (e *HeldError) Error() string {
+	holder := "another ravel"
+	if e.PID != 0 {
+		holder = fmt.Sprintf("another ravel, pid %d,", e.PID)
+	}
+	return fmt.Sprintf("%s already runs as %s for config key %q on this node. stop it before starting another", holder, e.Kind, e.ConfigKey)
+}
+
+// Lock is the lock of a mode and config key on a node.
+type Lock struct {
+	l    *net.UnixListener
+	once sync.Once
+}
+
+// Acquire takes the lock of kind and configKey, and holds it until Release
+// is called or ctx is done. It returns a HeldError if another process holds
+// it, which learns of the refusal in its metrics and logs.
+func Acquire(ctx context.Context, kind stats.LBKind, configKey string, logger logging.Logger) (*Lock, error) {
+	name := Name(kind, configKey)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: name, Net: "unix"})
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return nil, &HeldError{Kind: kind, ConfigKey: configKey, PID: holder(name)}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to take the instance lock %s. %v", name, err)
+	}
+
+	lock := &Lock{l: l}
+	refused := refusedDef.CounterVec().WithLabelValues(string(kind), configKey)
+	go func() {
+		// each connection is a process that was refused
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			refused.Inc()
+			logger.Warnf("instance: refused a second ravel running as %s for config key %q", kind, configKey)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		lock.Release()
+	}()
+	return lock, nil
+}
+
+// Release gives up the lock.
+func (l *Lock) Release() {
+	l.once.Do(func() { l.l.Close() })
+}
+
+// holder returns the pid of the process listening on name, or 0.
+func holder(name string) int {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: name, Net: "unix"})
+	if err != nil {
+		return 0
+	}
+	defer conn.Close()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil || credErr != nil {
+		return 0
+	}
+	return int(cred.Pid)
+}
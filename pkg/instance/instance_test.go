@@ -0,0 +1,67 @@
+package instance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+func TestAcquire(t *testing.T) {
+	// abstract sockets are shared by every process in the network namespace
+	key := fmt.Sprintf("test-%d", os.Getpid())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lock, err := Acquire(ctx, stats.KindIpvsMaster, key, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Acquire(ctx, stats.KindIpvsMaster, key, logging.Discard())
+	var held *HeldError
+	if !errors.As(err, &held) || held.PID != os.Getpid() {
+		t.Fatalf("expected the lock to be held by pid %d. saw %v", os.Getpid(), err)
+	}
+	refused := refusedDef.CounterVec().WithLabelValues(string(stats.KindIpvsMaster), key)
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(refused) != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := testutil.ToFloat64(refused); n != 1 {
+		t.Fatalf("expected the holder to count one refusal. saw %v", n)
+	}
+
+	// other modes and config keys have locks of their own
+	other, err := Acquire(ctx, stats.KindIpvsBackend, key, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Release()
+
+	lock.Release()
+	lock, err = Acquire(ctx, stats.KindIpvsMaster, key, logging.Discard())
+	if err != nil {
+		t.Fatalf("expected the lock to be free once released. %v", err)
+	}
+	cancel()
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		again, err := Acquire(context.Background(), stats.KindIpvsMaster, key, logging.Discard())
+		if err == nil {
+			again.Release()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the lock to be released with its context. %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -5,13 +5,18 @@ import (
 	"crypto/sha256"
 	"encoding/base32"
 	"fmt"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Comcast/Ravel/pkg/audit"
+	log "github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/observe"
 	"github.com/Comcast/Ravel/pkg/types"
 	"github.com/Comcast/Ravel/pkg/util"
 	"github.com/Comcast/Ravel/pkg/watcher"
-	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -27,18 +32,24 @@ type IPTables struct {
 
 	iptables *util.Runner
 
-	masq bool
+	// masqMu guards masq and podCidrMasq, which can be reloaded while rules
+	// are generated
+	masqMu sync.RWMutex
+	masq   bool
+
+	// owner tags the PREROUTING jump into chain, when there is a config key
+	owner string
 
 	// cli flag to exclude packets where the client ip is in this cidr range
 	podCidrMasq string
 
 	ctx     context.Context
-	logger  log.FieldLogger
+	logger  log.Logger
 	metrics iptablesMetrics
 }
 
 // NewIPTables creates a new IPTables struct for managing IPTables
-func NewIPTables(ctx context.Context, lbKind, configKey, podCidrMasq, chain string, masq bool, logger log.FieldLogger) (*IPTables, error) {
+func NewIPTables(ctx context.Context, lbKind, configKey, podCidrMasq, chain string, masq bool, logger log.Logger) (*IPTables, error) {
 	return &IPTables{
 		iptables: util.NewDefault(),
 
@@ -50,10 +61,67 @@ func NewIPTables(ctx context.Context, lbKind, configKey, podCidrMasq, chain stri
 		logger:      logger,
 		masq:        masq,
 		metrics:     NewMetrics(lbKind, configKey),
+		owner:       owner(configKey),
 	}, nil
 }
 
+func owner(configKey string) string {
+	if configKey == "" {
+		return ""
+	}
+	return types.Owner(configKey)
+}
+
+// jumpRule is the PREROUTING rule into the chain. It is tagged with the
+// owner of the config key, so that another instance on the node can tell
+// that the chain isn't theirs.
+func (i *IPTables) jumpRule() string {
+	if i.owner == "" {
+		return "-A PREROUTING -j " + i.chain.String()
+	}
+	return fmt.Sprintf(`-A PREROUTING -m comment --comment "%s" -j %s`, i.owner, i.chain)
+}
+
+// jumpOwner returns the owner a PREROUTING rule into the chain is tagged
+// with, and whether the rule jumps into the chain at all.
+func (i *IPTables) jumpOwner(rule string) (string, bool) {
+	if !strings.HasSuffix(rule, " -j "+i.chain.String()) {
+		return "", false
+	}
+	fields := strings.Fields(rule)
+	for ix := 0; ix < len(fields)-1; ix++ {
+		if fields[ix] == "--comment" {
+			if tag := strings.Trim(fields[ix+1], `"`); strings.HasPrefix(tag, types.Owner("")) {
+				return tag, true
+			}
+		}
+	}
+	return "", true
+}
+
+// owns reports whether chain is one of the instance's: its chain, its masq
+// chain, or a service or endpoint chain under it. The names are matched
+// exactly, so that an instance whose chain prefixes another's, as RAVEL
+// does RAVEL-BLUE, leaves the other's chains alone.
+func (i *IPTables) owns(chain string) bool {
+	base := i.chain.String()
+	if chain == base || chain == i.masqChain.String() {
+		return true
+	}
+	for _, kind := range []string{"-SVC-", "-SEP-"} {
+		if strings.HasPrefix(chain, base+kind) && len(chain) == len(base+kind)+16 {
+			return true
+		}
+	}
+	return false
+}
+
 func (i *IPTables) Flush() error {
+	if observe.Enabled() {
+		observe.Would(audit.SubsystemIPTables, "flush", string(i.table)+"/"+string(i.chain), "")
+		return nil
+	}
+
 	// Make several attempts to flush the chain.  Warn on failures.
 	var err error
 	idx, tries := 0, 5
@@ -62,6 +130,7 @@ func (i *IPTables) Flush() error {
 	start := time.Now()
 	defer func() {
 		i.metrics.IPTables("flush", idx, err, time.Since(start))
+		audit.Record(audit.SubsystemIPTables, "flush", string(i.table)+"/"+string(i.chain), "", err)
 	}()
 	for idx < tries {
 		err = i.iptables.FlushChain(i.table, i.chain)
@@ -79,6 +148,87 @@ func (i *IPTables) Flush() error {
 	return fmt.Errorf("unable to flush chain. %v", err)
 }
 
+// Drain stops the chain from capturing new connections, leaving its rules in
+// place. Connections it already sent to local pods keep their conntrack
+// entries, and new ones fall through to whatever else handles the VIPs. A
+// Flush ends the drain.
+func (i *IPTables) Drain() error {
+	if observe.Enabled() {
+		observe.Would(audit.SubsystemIPTables, "drain", string(i.table)+"/"+string(i.chain), "")
+		return nil
+	}
+	existing, err := i.Save()
+	if err != nil {
+		return err
+	}
+	if !i.drainRules(existing) {
+		return nil
+	}
+	err = i.Restore(existing)
+	audit.Record(audit.SubsystemIPTables, "drain", string(i.table)+"/"+string(i.chain), "", err)
+	return err
+}
+
+// drainRules puts a rule returning new connections at the top of the chain.
+// It reports whether the chain was there to drain.
+func (i *IPTables) drainRules(rules map[string]*RuleSet) bool {
+	set, found := rules[i.chain.String()]
+	if !found {
+		return false
+	}
+	drain := fmt.Sprintf(`-A %s -m conntrack --ctstate NEW -m comment --comment "ravel drain" -j RETURN`, i.chain)
+	if len(set.Rules) > 0 && set.Rules[0] == drain {
+		return true
+	}
+	set.Rules = append([]string{drain}, set.Rules...)
+	return true
+}
+
+// Remove deletes the chains of the instance, and the rules of other chains
+// that jump into them, for a node being decommissioned.
+func (i *IPTables) Remove() error {
+	existing, err := i.Save()
+	if err != nil {
+		return err
+	}
+	rules, removed, err := i.removeRules(existing)
+	if err != nil || removed == 0 {
+		return err
+	}
+	return i.Restore(rules)
+}
+
+// removeRules returns rules without the chains of the instance and the
+// jumps into them, and how many chains it removed. A chain that another
+// instance jumps into is refused.
+func (i *IPTables) removeRules(rules map[string]*RuleSet) (map[string]*RuleSet, int, error) {
+	if prerouting, ok := rules["PREROUTING"]; ok && i.owner != "" {
+		for _, rule := range prerouting.Rules {
+			if tag, ok := i.jumpOwner(rule); ok && tag != "" && tag != i.owner {
+				return nil, 0, fmt.Errorf("iptables: chain %s belongs to %s", i.chain, tag)
+			}
+		}
+	}
+	out := map[string]*RuleSet{}
+	removed := 0
+	for chain, set := range rules {
+		if i.owns(chain) {
+			removed++
+			continue
+		}
+		kept := &RuleSet{ChainRule: set.ChainRule, Rules: []string{}}
+		for _, rule := range set.Rules {
+			fields := strings.Fields(rule)
+			if len(fields) > 1 && fields[len(fields)-2] == "-j" && i.owns(fields[len(fields)-1]) {
+				continue
+			}
+			kept.Rules = append(kept.Rules, rule)
+		}
+		out[chain] = kept
+	}
+	return out, removed, nil
+}
+
 func (i *IPTables) Save() (map[string]*RuleSet, error) {
 	var err error
 	var b []byte
@@ -95,6 +245,11 @@ func (i *IPTables) Save() (map[string]*RuleSet, error) {
 }
 
 func (i *IPTables) Restore(rules map[string]*RuleSet) error {
+	if observe.Enabled() {
+		i.observeRestore(rules)
+		return nil
+	}
+
 	var err error
 	start := time.Now()
 	defer func() {
@@ -102,16 +257,85 @@ func (i *IPTables) Restore(rules map[string]*RuleSet) error {
 	}()
 	b := BytesFromRules(rules)
 	err = i.iptables.Restore(i.table, b, util.FlushTables, util.RestoreCounters)
+
+	count := 0
+	for _, rs := range rules {
+		count += len(rs.Rules)
+	}
+	audit.Record(audit.SubsystemIPTables, "restore", string(i.table), fmt.Sprintf("%d chains, %d rules", len(rules), count), err)
 	return err
 }
 
+// observeRestore records the chains a restore of rules would change, as the
+// whole table is restored on every reconfigure.
+func (i *IPTables) observeRestore(rules map[string]*RuleSet) {
+	existing, err := i.Save()
+	if err != nil {
+		i.logger.Warnf("iptables: unable to read the rules to compare a restore with. %v", err)
+		existing = map[string]*RuleSet{}
+	}
+	for _, chain := range changedChains(existing, rules) {
+		detail := "removed"
+		if set, ok := rules[chain]; ok {
+			detail = fmt.Sprintf("%d rules", len(set.Rules))
+		}
+		observe.Would(audit.SubsystemIPTables, "restore", string(i.table)+"/"+chain, detail)
+	}
+}
+
+// Plan merges generated with the rules of saved, the output of
+// iptables-save, as a reconfigure merges them, and returns the merged rules
+// and the chains restoring them would change.
+func (i *IPTables) Plan(saved []byte, generated map[string]*RuleSet) (map[string]*RuleSet, []string, error) {
+	existing, err := i.rulesFromBytes(saved)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := existing["PREROUTING"]; !ok {
+		return nil, nil, fmt.Errorf("iptables: no %s PREROUTING chain in the saved rules", i.table)
+	}
+	merged, _, err := i.Merge(generated, existing)
+	if err != nil {
+		return nil, nil, err
+	}
+	return merged, changedChains(existing, merged), nil
+}
+
+// changedChains returns the chains whose rules differ between existing and
+// rules, including those only in one of them, sorted.
+func changedChains(existing, rules map[string]*RuleSet) []string {
+	changed := []string{}
+	for chain, set := range rules {
+		// an empty chain is saved without rules, and merged with none
+		if old, ok := existing[chain]; !ok || len(old.Rules)+len(set.Rules) > 0 && !reflect.DeepEqual(old.Rules, set.Rules) {
+			changed = append(changed, chain)
+		}
+	}
+	for chain := range existing {
+		if _, ok := rules[chain]; !ok {
+			changed = append(changed, chain)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
 func (i *IPTables) Merge(subset map[string]*RuleSet, wholeset map[string]*RuleSet) (map[string]*RuleSet, int, error) {
 	out := map[string]*RuleSet{}
 
+	// refuse a chain that another instance on the node jumps into
+	if prerouting, ok := wholeset["PREROUTING"]; ok && i.owner != "" {
+		for _, rule := range prerouting.Rules {
+			if tag, ok := i.jumpOwner(rule); ok && tag != "" && tag != i.owner {
+				return nil, 0, fmt.Errorf("iptables: chain %s belongs to %s. each instance on a node needs its own iptables-chain", i.chain, tag)
+			}
+		}
+	}
+
 	// create a copy of the whole set, excluding the kube-ipvs chain
 	for chain, set := range wholeset {
-		// Remove any prefixed chains. We want to deal with them separately
-		if strings.HasPrefix(chain, i.chain.String()) {
+		// Remove our own chains. We want to deal with them separately
+		if i.owns(chain) {
 			continue
 		}
 		out[chain] = &RuleSet{
@@ -140,6 +364,18 @@ func (i *IPTables) Merge(subset map[string]*RuleSet, wholeset map[string]*RuleSe
 		}
 	}
 
+	// replace an untagged jump into the chain, left by an earlier version,
+	// with the tagged one
+	if jump := "-A PREROUTING -j " + i.chain.String(); i.owner != "" && out["PREROUTING"] != nil {
+		rules := []string{}
+		for _, rule := range out["PREROUTING"].Rules {
+			if rule != jump {
+				rules = append(rules, rule)
+			}
+		}
+		out["PREROUTING"].Rules = rules
+	}
+
 	// update prerouting if necessary
 	for _, subsetRule := range subset["PREROUTING"].Rules {
 		found := false
@@ -210,7 +446,7 @@ func (i *IPTables) GenerateRules(config *types.ClusterConfig) (map[string]*RuleS
 		"PREROUTING": {
 			ChainRule: ":PREROUTING ACCEPT",
 			Rules: []string{
-				"-A PREROUTING -j " + i.chain.String(),
+				i.jumpRule(),
 			},
 		},
 		i.masqChain.String(): {
@@ -259,7 +495,7 @@ func (i *IPTables) GenerateRulesForNodeClassic(w *watcher.Watcher, nodeName stri
 		"PREROUTING": {
 			ChainRule: ":PREROUTING ACCEPT",
 			Rules: []string{
-				"-A PREROUTING -j " + i.chain.String(),
+				i.jumpRule(),
 			},
 		},
 		i.masqChain.String(): {
@@ -281,10 +517,23 @@ func (i *IPTables) GenerateRulesForNodeClassic(w *watcher.Watcher, nodeName stri
 
 	// walk the service configuration and apply all rules
 	// eg: this section appears to be for pods ON on this node, but NOT on other nodes?
+	// the VIPs and ports are walked in order, so that the chain is the same
+	// on every reconfigure and a restore of an unchanged config changes nothing
+	vips := []string{}
+	for serviceIP := range config.Config {
+		vips = append(vips, string(serviceIP))
+	}
+	sort.Strings(vips)
 	rules := []string{}
-	for serviceIP, services := range config.Config {
-		dest := string(serviceIP)
-		for dport, service := range services {
+	for _, dest := range vips {
+		services := config.Config[types.ServiceIP(dest)]
+		dports := []string{}
+		for dport := range services {
+			dports = append(dports, dport)
+		}
+		sort.Strings(dports)
+		for _, dport := range dports {
+			service := services[dport]
 
 			ident := types.MakeIdent(service.Namespace, service.Service, service.PortName)
 			if !w.NodeHasServiceRunning(nodeName, service.Namespace, service.Service, service.PortName) {
@@ -295,7 +544,7 @@ func (i *IPTables) GenerateRulesForNodeClassic(w *watcher.Watcher, nodeName stri
 			for _, prot := range protocols {
 				chain := ravelServicePortChainName(ident, prot, i.chain.String())
 
-				if i.masq {
+				if i.masquerades() {
 					rules = append(rules, fmt.Sprintf(masqFmt, dest, prot, prot, dport, ident))
 				}
 				nodeProbability := w.GetLocalServiceWeight(nodeName, service.Namespace, service.Service, service.PortName)
@@ -355,11 +604,16 @@ func (i *IPTables) GenerateRulesForNodeClassic(w *watcher.Watcher, nodeName stri
 
 					serviceRules = append(serviceRules, probFmt)
 
+					// the ports of a range keep their port
+					destination := fmt.Sprintf("%s:%d", ip, portNumber)
+					if service.PortRange != "" {
+						destination = ip
+					}
 					out[sepChain] = &RuleSet{
 						ChainRule: ":" + sepChain + " - [0:0]",
 						Rules: []string{
 							fmt.Sprintf(`-A %s -d %s/32 -m comment --comment "%s" -j %s`, sepChain, ip, ident, i.masqChain),
-							fmt.Sprintf(`-A %s -p %s -m comment --comment "%s" -m %s -j DNAT --to-destination %s:%d`, sepChain, prot, ident, prot, ip, portNumber),
+							fmt.Sprintf(`-A %s -p %s -m comment --comment "%s" -m %s -j DNAT --to-destination %s`, sepChain, prot, ident, prot, destination),
 						},
 					}
 
@@ -534,9 +788,27 @@ func (i *IPTables) rulesFromBytes(b []byte) (map[string]*RuleSet, error) {
 	return GetSaveLines(i.table, b)
 }
 
+// SetMasq changes the masquerading of the rules generated from here on: the
+// cidr whose clients aren't masqueraded, and whether the classic rules
+// masquerade at all.
+func (i *IPTables) SetMasq(podCidrMasq string, masq bool) {
+	i.masqMu.Lock()
+	defer i.masqMu.Unlock()
+	i.podCidrMasq, i.masq = podCidrMasq, masq
+}
+
+func (i *IPTables) masquerades() bool {
+	i.masqMu.RLock()
+	defer i.masqMu.RUnlock()
+	return i.masq
+}
+
 func (i *IPTables) generateMasqRule() string {
-	if i.podCidrMasq != "" {
-		return fmt.Sprintf("-A %s -j MARK ! -s %s --set-xmark 0x4000/0x4000", i.masqChain.String(), i.podCidrMasq)
+	i.masqMu.RLock()
+	podCidrMasq := i.podCidrMasq
+	i.masqMu.RUnlock()
+	if podCidrMasq != "" {
+		return fmt.Sprintf("-A %s -j MARK ! -s %s --set-xmark 0x4000/0x4000", i.masqChain.String(), podCidrMasq)
 	}
 	return fmt.Sprintf("-A %s -j MARK --set-xmark 0x4000/0x4000", i.masqChain.String())
 }
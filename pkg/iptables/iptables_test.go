@@ -5,13 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"reflect"
 	"testing"
 
+	log "github.com/Comcast/Ravel/pkg/logging"
 	"github.com/Comcast/Ravel/pkg/stats"
 	"github.com/Comcast/Ravel/pkg/types"
 	"github.com/Comcast/Ravel/pkg/watcher"
 	"github.com/sirupsen/logrus"
-	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 )
 
@@ -20,9 +21,9 @@ func getTestJSON(fileDesc string) ([]byte, error) {
 }
 func TestGenerateRulesForNodeClassic(t *testing.T) {
 
-	log.SetLevel(log.DebugLevel)
+	logrus.SetLevel(logrus.DebugLevel)
 
-	l := &logrus.Logger{}
+	l := log.Discard()
 	ipTables, err := NewIPTables(context.Background(), stats.KindBGPDirector, "", "", "RAVEL", true, l)
 	if err != nil {
 		t.Fatal(err)
@@ -60,7 +61,7 @@ func TestCIDRMasq(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	l := &logrus.Logger{}
+	l := log.Discard()
 	// emulate defaults; bgp kind, empty config-key, ravel chain
 	ipTables, err := NewIPTables(context.Background(), stats.KindBGPDirector, "", "1.2.3.4", "RAVEL", true, l)
 	if err != nil {
@@ -105,7 +106,7 @@ func TestWeightEndpoints(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	l := &logrus.Logger{}
+	l := log.Discard()
 	// emulate defaults; bgp kind, empty config-key, ravel chain
 	ipTables, err := NewIPTables(context.Background(), stats.KindBGPDirector, "", "", "RAVEL", true, l)
 	if err != nil {
@@ -229,3 +230,126 @@ func _getCCForTest() *types.ClusterConfig {
 	_ = json.Unmarshal([]byte(c), out)
 	return out
 }
+
+func TestDrainRules(t *testing.T) {
+	ipTables, err := NewIPTables(context.Background(), stats.KindIpvsBackend, "", "", "RAVEL", true, log.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := map[string]*RuleSet{
+		"RAVEL": {ChainRule: ":RAVEL - [0:0]", Rules: []string{`-A RAVEL -d 10.0.0.1/32 -p tcp -m tcp --dport 80 -j RAVEL-SVC`}},
+	}
+	if !ipTables.drainRules(rules) || !ipTables.drainRules(rules) {
+		t.Fatal("expected the chain to be drained")
+	}
+	if len(rules["RAVEL"].Rules) != 2 || rules["RAVEL"].Rules[0] != `-A RAVEL -m conntrack --ctstate NEW -m comment --comment "ravel drain" -j RETURN` {
+		t.Fatalf("expected a single drain rule ahead of the service rules, got %v", rules["RAVEL"].Rules)
+	}
+	if ipTables.drainRules(map[string]*RuleSet{}) {
+		t.Fatal("expected a missing chain not to be drained")
+	}
+}
+
+func TestChangedChains(t *testing.T) {
+	existing := map[string]*RuleSet{
+		"RAVEL":     {ChainRule: ":RAVEL - [0:0]", Rules: []string{"-A RAVEL -j RAVEL-SVC-A"}},
+		"RAVEL-OLD": {ChainRule: ":RAVEL-OLD - [0:0]"},
+		"KUBE":      {ChainRule: ":KUBE - [12:720]", Rules: []string{"-A KUBE -j RETURN"}},
+	}
+	rules := map[string]*RuleSet{
+		"RAVEL":     {ChainRule: ":RAVEL - [0:0]", Rules: []string{"-A RAVEL -j RAVEL-SVC-B"}},
+		"RAVEL-NEW": {ChainRule: ":RAVEL-NEW - [0:0]"},
+		"KUBE":      {ChainRule: ":KUBE - [0:0]", Rules: []string{"-A KUBE -j RETURN"}},
+	}
+	changed := changedChains(existing, rules)
+	expected := []string{"RAVEL", "RAVEL-NEW", "RAVEL-OLD"}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Fatalf("expected %v to change, got %v", expected, changed)
+	}
+}
+
+func TestMergeOwnership(t *testing.T) {
+	ipTables, err := NewIPTables(context.Background(), stats.KindIpvsBackend, "green", "", "RAVEL", true, log.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	jump := `-A PREROUTING -m comment --comment "ravel/green" -j RAVEL`
+	subset := map[string]*RuleSet{
+		"PREROUTING":                 {ChainRule: ":PREROUTING ACCEPT", Rules: []string{jump}},
+		"RAVEL":                      {ChainRule: ":RAVEL - [0:0]", Rules: []string{"-A RAVEL -j RAVEL-SVC-BBBBBBBBBBBBBBBB"}},
+		"RAVEL-SVC-BBBBBBBBBBBBBBBB": {ChainRule: ":RAVEL-SVC-BBBBBBBBBBBBBBBB - [0:0]"},
+	}
+	wholeset := map[string]*RuleSet{
+		"PREROUTING": {ChainRule: ":PREROUTING ACCEPT", Rules: []string{
+			"-A PREROUTING -j RAVEL",
+			`-A PREROUTING -m comment --comment "ravel/blue" -j RAVEL-BLUE`,
+		}},
+		"RAVEL":                           {ChainRule: ":RAVEL - [0:0]", Rules: []string{"-A RAVEL -j RAVEL-SVC-AAAAAAAAAAAAAAAA"}},
+		"RAVEL-SVC-AAAAAAAAAAAAAAAA":      {ChainRule: ":RAVEL-SVC-AAAAAAAAAAAAAAAA - [0:0]"},
+		"RAVEL-BLUE":                      {ChainRule: ":RAVEL-BLUE - [0:0]", Rules: []string{"-A RAVEL-BLUE -j RAVEL-BLUE-SVC-AAAAAAAAAAAAAAAA"}},
+		"RAVEL-BLUE-SVC-AAAAAAAAAAAAAAAA": {ChainRule: ":RAVEL-BLUE-SVC-AAAAAAAAAAAAAAAA - [0:0]"},
+	}
+
+	// our stale chain goes, blue's chains stay, and the untagged jump is
+	// replaced with the tagged one
+	merged, _, err := ipTables.Merge(subset, wholeset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chain := range []string{"RAVEL", "RAVEL-SVC-BBBBBBBBBBBBBBBB", "RAVEL-BLUE", "RAVEL-BLUE-SVC-AAAAAAAAAAAAAAAA"} {
+		if _, ok := merged[chain]; !ok {
+			t.Fatalf("expected chain %s to be kept", chain)
+		}
+	}
+	if _, ok := merged["RAVEL-SVC-AAAAAAAAAAAAAAAA"]; ok {
+		t.Fatal("expected the stale service chain to be removed")
+	}
+	expected := []string{`-A PREROUTING -m comment --comment "ravel/blue" -j RAVEL-BLUE`, jump}
+	if !reflect.DeepEqual(merged["PREROUTING"].Rules, expected) {
+		t.Fatalf("expected PREROUTING %v, got %v", expected, merged["PREROUTING"].Rules)
+	}
+
+	// a chain another instance jumps into is refused
+	wholeset["PREROUTING"].Rules = []string{`-A PREROUTING -m comment --comment "ravel/blue" -j RAVEL`}
+	if _, _, err := ipTables.Merge(subset, wholeset); err == nil {
+		t.Fatal("expected the chain of blue to be refused")
+	}
+}
+
+func TestRemoveRules(t *testing.T) {
+	ipTables, err := NewIPTables(context.Background(), stats.KindIpvsMaster, "green", "", "RAVEL", true, log.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := map[string]*RuleSet{
+		"PREROUTING": {ChainRule: ":PREROUTING ACCEPT", Rules: []string{
+			`-A PREROUTING -m comment --comment "ravel/green" -j RAVEL`,
+			`-A PREROUTING -m comment --comment "ravel/blue" -j RAVEL-BLUE`,
+		}},
+		"POSTROUTING":                {ChainRule: ":POSTROUTING ACCEPT", Rules: []string{"-A POSTROUTING -j RAVEL-MASQ", "-A POSTROUTING -j KUBE-POSTROUTING"}},
+		"RAVEL":                      {ChainRule: ":RAVEL - [0:0]", Rules: []string{"-A RAVEL -j RAVEL-SVC-AAAAAAAAAAAAAAAA"}},
+		"RAVEL-MASQ":                 {ChainRule: ":RAVEL-MASQ - [0:0]"},
+		"RAVEL-SVC-AAAAAAAAAAAAAAAA": {ChainRule: ":RAVEL-SVC-AAAAAAAAAAAAAAAA - [0:0]"},
+		"RAVEL-BLUE":                 {ChainRule: ":RAVEL-BLUE - [0:0]"},
+	}
+
+	out, removed, err := ipTables.removeRules(rules)
+	if err != nil || removed != 3 {
+		t.Fatalf("expected the 3 chains of green removed, got %d %v", removed, err)
+	}
+	if _, ok := out["RAVEL-BLUE"]; !ok || len(out) != 3 {
+		t.Fatalf("expected PREROUTING, POSTROUTING and the chain of blue kept, got %v", out)
+	}
+	if expected := []string{`-A PREROUTING -m comment --comment "ravel/blue" -j RAVEL-BLUE`}; !reflect.DeepEqual(out["PREROUTING"].Rules, expected) {
+		t.Fatalf("expected PREROUTING %v, got %v", expected, out["PREROUTING"].Rules)
+	}
+	if expected := []string{"-A POSTROUTING -j KUBE-POSTROUTING"}; !reflect.DeepEqual(out["POSTROUTING"].Rules, expected) {
+		t.Fatalf("expected POSTROUTING %v, got %v", expected, out["POSTROUTING"].Rules)
+	}
+
+	// a chain another instance jumps into is refused
+	rules["PREROUTING"].Rules = []string{`-A PREROUTING -m comment --comment "ravel/blue" -j RAVEL`}
+	if _, _, err := ipTables.removeRules(rules); err == nil {
+		t.Fatal("expected the chain of blue to be refused")
+	}
+}
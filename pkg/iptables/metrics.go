@@ -47,7 +47,7 @@ func (m *metrics) ChainRemoved(name, rule string) {
 	// stale values.
 	m.chainRemoved.With(prometheus.Labels{"lb": m.lbKind,
 		"seczone": m.configKey,
-		"name":    name,
+		"chain":   name,
 		"rule":    rule}).Add(1)
 }
 
@@ -58,52 +58,50 @@ func (m *metrics) ChainGauge(l int, kind string) {
 	}).Set(float64(l))
 }
 
+var (
+	iptablesLabels = []string{"lb", "seczone", "operation", "attempts", "outcome"}
+
+	iptablesOperationDef = stats.Define(stats.Definition{
+		Type:     stats.Counter,
+		Name:     "iptables_operation_total",
+		Help:     "is a count of operations performed against iptables and the status",
+		Labels:   iptablesLabels,
+		Replaces: "rdei_lb_iptables_operation_count",
+	})
+	iptablesLatencyDef = stats.Define(stats.Definition{
+		Type:     stats.Histogram,
+		Name:     "iptables_latency_microseconds",
+		Help:     "is a histogram denoting the amount of time it takes to perform various iptables operations. labels for operation save|restore|flush and for outcome error|success",
+		Labels:   iptablesLabels,
+		Buckets:  stats.LatencyBuckets,
+		Replaces: "rdei_lb_iptables_latency_microseconds",
+	})
+	chainRemovalDef = stats.Define(stats.Definition{
+		Type:     stats.Counter,
+		Name:     "iptables_chain_removal_total",
+		Help:     "is a count of all of the chain/rules that have been removed from iptables. this indicates that the client has incorrectly configured their backing service",
+		Labels:   []string{"lb", "seczone", "chain", "rule"},
+		Replaces: "rdei_lb_iptables_chain_removal_count",
+	})
+	chainSizeDef = stats.Define(stats.Definition{
+		Type:     stats.Gauge,
+		Name:     "iptables_chain_size",
+		Help:     "is the number of rules in the kube and ravel chains, broken out by kind",
+		Labels:   []string{"lb", "seczone", "kind"},
+		Replaces: "rdei_lb_iptables_chain_size",
+	})
+)
+
 // NewMetrics creates a new metrics struct tha tholds metrics for iptables
 func NewMetrics(lbKind, configKey string) *metrics {
-
-	defaultLabels := []string{"lb", "seczone"}
-	iptablesLabels := append(defaultLabels, []string{"operation", "attempts", "outcome"}...)
-	chainInfoLabels := append(defaultLabels, []string{"name", "rule"}...)
-	chainGaugeLabels := append(defaultLabels, []string{"kind"}...)
-
-	// counter iptables_operation_count
-	iptablesCount := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: stats.Prefix + "iptables_operation_count",
-		Help: "is a count of operations performed against iptables and the status",
-	}, iptablesLabels)
-
-	// histogram iptables_latency
-	iptablesLatency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name:    stats.Prefix + "iptables_latency_microseconds",
-		Help:    "is a histogram denoting the amount of time it takes to perform various iptables operations. labels for operation save|restore|flush and for outcome error|success",
-		Buckets: stats.LatencyBuckets,
-	}, iptablesLabels)
-
-	// counter iptables_chain_removal_count
-	chainRemoved := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: stats.Prefix + "iptables_chain_removal_count",
-		Help: "is a count of all of the chain/rules that have been removed from iptables. this indicates that the client has incorrectly configured their backing service",
-	}, chainInfoLabels)
-
-	// guage iptables_chain_size
-	chainGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: stats.Prefix + "iptables_chain_size",
-		Help: "is twi guages, one for the inbound/calculated chain size, and one for the configured size.",
-	}, chainGaugeLabels)
-
-	prometheus.MustRegister(iptablesCount)
-	prometheus.MustRegister(iptablesLatency)
-	prometheus.MustRegister(chainRemoved)
-	prometheus.MustRegister(chainGauge)
-
 	return &metrics{
 		lbKind:    lbKind,
 		configKey: configKey,
 
-		iptablesCount:   iptablesCount,
-		iptablesLatency: iptablesLatency,
+		iptablesCount:   iptablesOperationDef.CounterVec(),
+		iptablesLatency: iptablesLatencyDef.HistogramVec(),
 
-		chainRemoved: chainRemoved,
-		chainGauge:   chainGauge,
+		chainRemoved: chainRemovalDef.CounterVec(),
+		chainGauge:   chainSizeDef.GaugeVec(),
 	}
 }
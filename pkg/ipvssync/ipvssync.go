@@ -0,0 +1,269 @@
+package ipvssync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/privsep"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// The kernel replicates IPVS connections between directors itself: the
+// active director runs a master sync daemon that multicasts the state of its
+// connections, and the standby runs a backup daemon that adds them to its own
+// table. A standby that takes over then already knows which real server each
+// established flow belongs to, and doesn't reset them.
+//
+// Daemon starts the daemon of the director's role, and stops the other, each
+// time the role changes. Its Collector reads the connections a backup has
+// learned from /proc/net/ip_vs_conn_sync on every scrape. The sync lag is the
+// age of the freshest of them: the kernel restarts the timer of a connection
+// at the established timeout each time the master syncs it, so a lag that
+// keeps growing while the master has traffic means the standby isn't hearing
+// from it.
+
+const (
+	RoleMaster = "master"
+	RoleBackup = "backup"
+)
+
+// procDir is where the connection table is read from.
+var procDir = "/proc"
+
+var (
+	daemonDesc = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "ipvs_sync_daemon",
+		Help:   "is 1 for the ipvs sync daemon the director runs, by role: master to send its connections, or backup to receive them",
+		Labels: []string{"lb", "role"},
+	}).Desc()
+	connectionsDesc = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "ipvs_sync_connections",
+		Help:   "is the number of ipvs connections the director learned from the sync daemon of another director",
+		Labels: []string{"lb"},
+	}).Desc()
+	lagDesc = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "ipvs_sync_lag_seconds",
+		Help:   "is how long ago a backup director last received the state of an established connection from the master. missing until it has received one",
+		Labels: []string{"lb"},
+	}).Desc()
+)
+
+// Daemon runs the ipvs sync daemon of a director's role.
+type Daemon struct {
+	sync.Mutex
+	iface  string
+	syncID int
+	role   string
+	// established is the timeout of established tcp connections, which the
+	// kernel restarts a synced connection's timer at
+	established time.Duration
+
+	ctx    context.Context
+	kind   string
+	logger logging.Logger
+	// ipvsadm runs ipvsadm with args
+	ipvsadm func(ctx context.Context, args ...string) ([]byte, error)
+}
+
+// New returns the sync daemon of a director, syncing over multicast on iface
+// with the directors of syncID.
+func New(ctx context.Context, kind stats.LBKind, iface string, syncID int, logger logging.Logger) (*Daemon, error) {
+	if iface == "" {
+		return nil, fmt.Errorf("ipvs sync needs an interface")
+	}
+	if syncID < 0 || syncID > 255 {
+		return nil, fmt.Errorf("ipvs sync id must be between 0 and 255")
+	}
+	return &Daemon{
+		iface:   iface,
+		syncID:  syncID,
+		ctx:     ctx,
+		kind:    string(kind),
+		logger:  logger.WithFields(logging.Fields{"module": "ipvssync"}),
+		ipvsadm: runIPVSAdm,
+	}, nil
+}
+
+func runIPVSAdm(ctx context.Context, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+	return privsep.CommandContext(ctx, "ipvsadm", args...).CombinedOutput()
+}
+
+// SetRole runs the master daemon when master is true, and the backup daemon
+// otherwise, stopping the other.
+func (d *Daemon) SetRole(master bool) error {
+	want := RoleBackup
+	if master {
+		want = RoleMaster
+	}
+
+	out, err := d.ipvsadm(d.ctx, "-L", "--daemon")
+	if err != nil {
+		return fmt.Errorf("ipvssync: unable to list sync daemons. %v %s", err, out)
+	}
+	running := parseDaemons(out)
+
+	for _, role := range []string{RoleMaster, RoleBackup} {
+		if role == want || !running[role] {
+			continue
+		}
+		out, err := d.ipvsadm(d.ctx, "--stop-daemon", role)
+		audit.Record(audit.SubsystemIPVS, "stop-daemon", role, "", err)
+		if err != nil {
+			return fmt.Errorf("ipvssync: unable to stop the %s sync daemon. %v %s", role, err, out)
+		}
+	}
+	if !running[want] {
+		args := []string{"--start-daemon", want, "--mcast-interface", d.iface, "--syncid", strconv.Itoa(d.syncID)}
+		out, err := d.ipvsadm(d.ctx, args...)
+		audit.Record(audit.SubsystemIPVS, "start-daemon", strings.Join(args[1:], " "), "", err)
+		if err != nil {
+			return fmt.Errorf("ipvssync: unable to start the %s sync daemon. %v %s", want, err, out)
+		}
+	}
+
+	var established time.Duration
+	if want == RoleBackup {
+		out, err := d.ipvsadm(d.ctx, "-L", "--timeout")
+		if err != nil {
+			return fmt.Errorf("ipvssync: unable to read the ipvs timeouts. %v %s", err, out)
+		}
+		if established, err = parseTimeout(out); err != nil {
+			return err
+		}
+	}
+
+	d.Lock()
+	d.role, d.established = want, established
+	d.Unlock()
+	d.logger.Infof("ipvssync: running the %s sync daemon on %s with sync id %d", want, d.iface, d.syncID)
+	return nil
+}
+
+// Describe implements prometheus.Collector.
+func (d *Daemon) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{daemonDesc, connectionsDesc, lagDesc} {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (d *Daemon) Collect(ch chan<- prometheus.Metric) {
+	d.Lock()
+	role, established := d.role, d.established
+	d.Unlock()
+	if role == "" {
+		return
+	}
+	for _, r := range []string{RoleMaster, RoleBackup} {
+		v := 0.0
+		if r == role {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(daemonDesc, prometheus.GaugeValue, v, d.kind, r)
+	}
+
+	synced, freshest, err := readSynced()
+	if err != nil {
+		d.logger.Debugf("unable to read synced connections. %v", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.GaugeValue, float64(synced), d.kind)
+	if role == RoleBackup && freshest >= 0 && established > 0 {
+		lag := established - freshest
+		if lag < 0 {
+			lag = 0
+		}
+		ch <- prometheus.MustNewConstMetric(lagDesc, prometheus.GaugeValue, lag.Seconds(), d.kind)
+	}
+}
+
+// parseDaemons reads the running daemons from `ipvsadm -L --daemon`:
+//
+//	master sync daemon (mcast=eth0, syncid=7)
+//	backup sync daemon (mcast=eth0, syncid=7)
+func parseDaemons(out []byte) map[string]bool {
+	running := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && fields[1] == "sync" && fields[2] == "daemon" {
+			running[fields[0]] = true
+		}
+	}
+	return running
+}
+
+// parseTimeout reads the established tcp timeout from `ipvsadm -L
+// --timeout`:
+//
+//	Timeout (tcp tcpfin udp): 900 120 300
+func parseTimeout(out []byte) (time.Duration, error) {
+	s := string(out)
+	i := strings.Index(s, "):")
+	if i < 0 {
+		return 0, fmt.Errorf("ipvssync: unexpected ipvs timeouts %q", s)
+	}
+	fields := strings.Fields(s[i+2:])
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("ipvssync: unexpected ipvs timeouts %q", s)
+	}
+	seconds, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, fmt.Errorf("ipvssync: unexpected ipvs timeouts %q", s)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// readSynced counts the connections learned from another director in
+// /proc/net/ip_vs_conn_sync, and returns the longest time left on any of them
+// that is established, or -1 when none is:
+//
+//	Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Origin Expires
+//	TCP 0A000064 D431 0A36D50A 0050 0A000001 0050 ESTABLISHED SYNC       897
+func readSynced() (synced int, freshest time.Duration, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(procDir, "net/ip_vs_conn_sync"))
+	if err != nil {
+		return 0, 0, err
+	}
+	freshest = -1
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		state, origin, expires := fields[len(fields)-3], fields[len(fields)-2], fields[len(fields)-1]
+		if origin != "SYNC" {
+			continue
+		}
+		synced++
+		if state != "ESTABLISHED" {
+			continue
+		}
+		seconds, err := strconv.Atoi(expires)
+		if err != nil {
+			continue
+		}
+		if left := time.Duration(seconds) * time.Second; left > freshest {
+			freshest = left
+		}
+	}
+	return synced, freshest, scanner.Err()
+}
@@ -0,0 +1,108 @@
+package ipvssync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// fakeIPVSAdm keeps the running daemons as ipvsadm would, and records the
+// commands that changed them.
+type fakeIPVSAdm struct {
+	running  map[string]string
+	commands []string
+}
+
+func (f *fakeIPVSAdm) run(_ context.Context, args ...string) ([]byte, error) {
+	switch {
+	case args[0] == "-L" && args[1] == "--daemon":
+		out := ""
+		for role, line := range f.running {
+			out += role + " sync daemon " + line + "\n"
+		}
+		return []byte(out), nil
+	case args[0] == "-L" && args[1] == "--timeout":
+		return []byte("Timeout (tcp tcpfin udp): 900 120 300\n"), nil
+	case args[0] == "--start-daemon":
+		f.running[args[1]] = "(mcast=" + args[3] + ", syncid=" + args[5] + ")"
+	case args[0] == "--stop-daemon":
+		delete(f.running, args[1])
+	}
+	f.commands = append(f.commands, strings.Join(args, " "))
+	return nil, nil
+}
+
+func TestDaemon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipvssync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	procDir = dir
+	defer func() { procDir = "/proc" }()
+	os.MkdirAll(filepath.Join(dir, "net"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "net/ip_vs_conn_sync"), []byte(`Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Origin Expires
+TCP 0A000064 D431 0A36D50A 0050 0A000001 0050 ESTABLISHED SYNC       890
+TCP 0A000065 D432 0A36D50A 0050 0A000002 0050 ESTABLISHED SYNC       600
+TCP 0A000066 D433 0A36D50A 0050 0A000002 0050 FIN_WAIT    SYNC        60
+TCP 0A000067 D434 0A36D50A 0050 0A000001 0050 ESTABLISHED LOCAL      899
+`), 0644)
+
+	d, err := New(context.Background(), stats.KindIpvsMaster, "eth0", 7, logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeIPVSAdm{running: map[string]string{}}
+	d.ipvsadm = fake.run
+
+	if err := d.SetRole(false); err != nil {
+		t.Fatal(err)
+	}
+	// setting the same role again changes nothing
+	if err := d.SetRole(false); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.commands) != 1 || fake.commands[0] != "--start-daemon backup --mcast-interface eth0 --syncid 7" {
+		t.Fatalf("unexpected commands %v", fake.commands)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(d)
+	expected := `
+# HELP ravel_ipvs_sync_connections is the number of ipvs connections the director learned from the sync daemon of another director
+# TYPE ravel_ipvs_sync_connections gauge
+ravel_ipvs_sync_connections{lb="director"} 3
+# HELP ravel_ipvs_sync_daemon is 1 for the ipvs sync daemon the director runs, by role: master to send its connections, or backup to receive them
+# TYPE ravel_ipvs_sync_daemon gauge
+ravel_ipvs_sync_daemon{lb="director",role="backup"} 1
+ravel_ipvs_sync_daemon{lb="director",role="master"} 0
+# HELP ravel_ipvs_sync_lag_seconds is how long ago a backup director last received the state of an established connection from the master. missing until it has received one
+# TYPE ravel_ipvs_sync_lag_seconds gauge
+ravel_ipvs_sync_lag_seconds{lb="director"} 10
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+
+	// on failover the backup daemon gives way to the master daemon, and the
+	// lag no longer applies
+	fake.commands = nil
+	if err := d.SetRole(true); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.commands) != 2 || fake.commands[0] != "--stop-daemon backup" || fake.commands[1] != "--start-daemon master --mcast-interface eth0 --syncid 7" {
+		t.Fatalf("unexpected commands %v", fake.commands)
+	}
+	if n, err := testutil.GatherAndCount(reg, "ravel_ipvs_sync_lag_seconds"); err != nil || n != 0 {
+		t.Fatalf("expected no lag on the master, got %d %v", n, err)
+	}
+}
@@ -0,0 +1,639 @@
+// Package liveconfig holds the runtime settings that callers of the admin
+// endpoint override without a restart: the weights and draining of
+// services, log levels and the forced reconfigure interval.
+//
+// Overrides are layered over what the process was configured with, and
+// each expires after its ttl, when the setting goes back to what it would be
+// without it. The weights and draining of services are set on the cluster
+// config as the watcher publishes it, so the config built from the
+// configmap is left as it is, and the config in effect shows them.
+package liveconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/admin"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+const (
+	// DefaultTTL is how long an override lasts when a patch sets no ttl.
+	DefaultTTL = time.Hour
+	// MaxTTL is the longest an override may last.
+	MaxTTL = 24 * time.Hour
+	// MinReconfigureInterval is the shortest forced reconfigure interval an
+	// override may set.
+	MinReconfigureInterval = time.Second
+	// maxWeight is the largest weight ipvs takes.
+	maxWeight = 65535
+)
+
+// The settings an override is counted by.
+const (
+	SettingWeight              = "weight"
+	SettingDrained             = "drained"
+	SettingLogLevel            = "log_level"
+	SettingReconfigureInterval = "reconfigure_interval"
+)
+
+var overridesDef = stats.Define(stats.Definition{
+	Type:   stats.Gauge,
+	Name:   "live_overrides",
+	Help:   "is the number of runtime overrides in effect, set through the admin endpoint",
+	Labels: []string{"lb", "seczone", "setting"},
+})
+
+// Options are what a process allows to be overridden.
+type Options struct {
+	// Services allows the weights and draining of services, and Republish
+	// publishes the cluster config again once they change.
+	Services  bool
+	Republish func()
+	// Levels, when set, allows log levels.
+	Levels *logging.Levels
+}
+
+// override is the value of a setting until it expires.
+type override struct {
+	value   interface{}
+	expires time.Time
+	caller  string
+	// previous is the log level of a package before the override, or "" if
+	// the package had none of its own.
+	previous string
+}
+
+// Store holds the overrides in effect.
+type Store struct {
+	sync.Mutex
+	kind      stats.LBKind
+	configKey string
+	options   Options
+	logger    logging.Logger
+
+	// services are keyed by vip:port and then setting
+	services  map[string]map[string]*override
+	logLevels map[string]*override
+	interval  *override
+
+	// baseInterval is the configured forced reconfigure interval, which
+	// setInterval applies when it isn't overridden
+	baseInterval time.Duration
+	setInterval  func(time.Duration)
+
+	// built is the last cluster config staged, which the services
+	// overridden must be in
+	built *types.ClusterConfig
+
+	now func() time.Time
+}
+
+// New returns an empty store.
+func New(kind stats.LBKind, configKey string, options Options, logger logging.Logger) *Store {
+	return &Store{
+		kind:      kind,
+		configKey: configKey,
+		options:   options,
+		logger:    logger.WithFields(logging.Fields{"module": "liveconfig"}),
+		services:  map[string]map[string]*override{},
+		logLevels: map[string]*override{},
+		now:       time.Now,
+	}
+}
+
+// ReconfigureInterval allows the forced reconfigure interval to be
+// overridden, which set applies. It returns the function that sets the
+// configured interval, applied whenever it isn't overridden.
+func (s *Store) ReconfigureInterval(set func(time.Duration)) func(time.Duration) {
+	s.Lock()
+	s.setInterval = set
+	s.Unlock()
+	return func(interval time.Duration) {
+		s.Lock()
+		s.baseInterval = interval
+		overridden := s.interval != nil
+		s.Unlock()
+		if !overridden {
+			set(interval)
+		}
+	}
+}
+
+// Stage returns cc with the weights and draining of its services
+// overridden, for the watcher to publish in place of it.
+func (s *Store) Stage(cc *types.ClusterConfig) *types.ClusterConfig {
+	s.Lock()
+	s.built = cc
+	services := map[string]map[string]interface{}{}
+	for key, settings := range s.services {
+		services[key] = map[string]interface{}{}
+		for setting, o := range settings {
+			services[key][setting] = o.value
+		}
+	}
+	s.Unlock()
+	if len(services) == 0 || cc == nil {
+		return cc
+	}
+
+	out := &types.ClusterConfig{
+		VIPPool:    cc.VIPPool,
+		MTUConfig:  cc.MTUConfig,
+		MTUConfig6: cc.MTUConfig6,
+		NodeLabels: cc.NodeLabels,
+		IPV6:       cc.IPV6,
+		Config:     map[types.ServiceIP]types.PortMap{},
+		Config6:    map[types.ServiceIP]types.PortMap{},
+		Shards:     cc.Shards,
+		Base:       cc.Base,
+		Defaults:   cc.Defaults,
+	}
+	for _, c := range []struct {
+		from, to map[types.ServiceIP]types.PortMap
+	}{{cc.Config, out.Config}, {cc.Config6, out.Config6}} {
+		for vip, ports := range c.from {
+			c.to[vip] = ports
+			copied := false
+			for port, def := range ports {
+				settings, ok := services[serviceKey(string(vip), port)]
+				if !ok || def == nil {
+					continue
+				}
+				// copy what is changed, as the built config is shared
+				if !copied {
+					c.to[vip] = types.PortMap{}
+					for p, d := range ports {
+						c.to[vip][p] = d
+					}
+					copied = true
+				}
+				changed := *def
+				if weight, ok := settings[SettingWeight]; ok {
+					w := weight.(int)
+					changed.Weight = &w
+				}
+				if drained, ok := settings[SettingDrained]; ok {
+					changed.Drained = drained.(bool)
+				}
+				c.to[vip][port] = &changed
+			}
+		}
+	}
+	return out
+}
+
+// serviceKey is the key of the service of vip and port.
+func serviceKey(vip, port string) string {
+	if ip := net.ParseIP(vip); ip != nil {
+		vip = ip.String()
+	}
+	return net.JoinHostPort(vip, port)
+}
+
+// Run expires overrides every second until done is closed.
+func (s *Store) Run(done <-chan struct{}) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.expire()
+		case <-done:
+			return
+		}
+	}
+}
+
+// expire removes the overrides whose ttl has passed, and puts back the
+// settings they overrode.
+func (s *Store) expire() {
+	s.Lock()
+	now := s.now()
+	var expired []string
+	republish := false
+	for key, settings := range s.services {
+		for setting, o := range settings {
+			if !now.Before(o.expires) {
+				delete(settings, setting)
+				expired = append(expired, "services "+key+" "+setting)
+				republish = true
+			}
+		}
+		if len(settings) == 0 {
+			delete(s.services, key)
+		}
+	}
+	var restore []func()
+	for pkg, o := range s.logLevels {
+		if !now.Before(o.expires) {
+			delete(s.logLevels, pkg)
+			expired = append(expired, "logLevels "+pkg)
+			restore = append(restore, s.restoreLevel(pkg, o))
+		}
+	}
+	if s.interval != nil && !now.Before(s.interval.expires) {
+		s.interval = nil
+		expired = append(expired, "reconfigureInterval")
+		restore = append(restore, s.restoreInterval())
+	}
+	s.count()
+	s.Unlock()
+
+	for _, r := range restore {
+		r()
+	}
+	if republish && s.options.Republish != nil {
+		s.options.Republish()
+	}
+	for _, e := range expired {
+		s.logger.Infof("liveconfig: the override of %s expired", e)
+	}
+}
+
+// restoreLevel returns what puts back the log level of pkg that o
+// overrode, unless it has been changed since.
+func (s *Store) restoreLevel(pkg string, o *override) func() {
+	levels := s.options.Levels
+	return func() {
+		if levels.Snapshot()[pkg] != o.value.(string) {
+			return
+		}
+		if o.previous == "" {
+			levels.Clear(pkg)
+			return
+		}
+		level, _ := logrus.ParseLevel(o.previous)
+		levels.Set(pkg, level)
+	}
+}
+
+// restoreInterval returns what puts back the configured forced reconfigure
+// interval. It is called with the lock held.
+func (s *Store) restoreInterval() func() {
+	set, base := s.setInterval, s.baseInterval
+	return func() {
+		if set != nil && base > 0 {
+			set(base)
+		}
+	}
+}
+
+// count updates the gauge of the overrides in effect. It is called with the
+// lock held.
+func (s *Store) count() {
+	counts := map[string]int{SettingWeight: 0, SettingDrained: 0, SettingLogLevel: len(s.logLevels), SettingReconfigureInterval: 0}
+	for _, settings := range s.services {
+		for setting := range settings {
+			counts[setting]++
+		}
+	}
+	if s.interval != nil {
+		counts[SettingReconfigureInterval] = 1
+	}
+	for setting, n := range counts {
+		overridesDef.GaugeVec().WithLabelValues(string(s.kind), s.configKey, setting).Set(float64(n))
+	}
+}
+
+// Setting is an override as the admin endpoint shows it.
+type Setting struct {
+	Value   interface{} `json:"value"`
+	Expires time.Time   `json:"expires"`
+	Caller  string      `json:"caller,omitempty"`
+}
+
+// View is the overrides in effect.
+type View struct {
+	Services            map[string]map[string]Setting `json:"services,omitempty"`
+	LogLevels           map[string]Setting            `json:"logLevels,omitempty"`
+	ReconfigureInterval *Setting                      `json:"reconfigureInterval,omitempty"`
+}
+
+// View returns the overrides in effect.
+func (s *Store) View() View {
+	s.Lock()
+	defer s.Unlock()
+	setting := func(o *override) Setting {
+		value := o.value
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		return Setting{Value: value, Expires: o.expires.UTC(), Caller: o.caller}
+	}
+	v := View{}
+	if len(s.services) > 0 {
+		v.Services = map[string]map[string]Setting{}
+		for key, settings := range s.services {
+			v.Services[key] = map[string]Setting{}
+			for name, o := range settings {
+				v.Services[key][name] = setting(o)
+			}
+		}
+	}
+	if len(s.logLevels) > 0 {
+		v.LogLevels = map[string]Setting{}
+		for pkg, o := range s.logLevels {
+			v.LogLevels[pkg] = setting(o)
+		}
+	}
+	if s.interval != nil {
+		interval := setting(s.interval)
+		v.ReconfigureInterval = &interval
+	}
+	return v
+}
+
+// Patch is a JSON merge patch of the overrides. A null removes an override,
+// and TTL, a duration such as "30m", is how long those it sets last.
+type Patch struct {
+	TTL                 string                                `json:"ttl,omitempty"`
+	Services            map[string]map[string]json.RawMessage `json:"services,omitempty"`
+	LogLevels           map[string]*string                    `json:"logLevels,omitempty"`
+	ReconfigureInterval json.RawMessage                       `json:"reconfigureInterval,omitempty"`
+}
+
+// change is one setting a patch sets, or removes when value is nil.
+type change struct {
+	service, setting, pkg string
+	value                 interface{}
+}
+
+// Apply checks p, and applies all of it or none of it for caller. It
+// returns a summary of the changes.
+func (s *Store) Apply(p Patch, caller string) (string, error) {
+	ttl := DefaultTTL
+	if p.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(p.TTL); err != nil || ttl <= 0 || ttl > MaxTTL {
+			return "", fmt.Errorf("ttl must be a duration up to %v. saw %q", MaxTTL, p.TTL)
+		}
+	}
+	changes, err := s.check(p)
+	if err != nil {
+		return "", err
+	}
+	if len(changes) == 0 {
+		return "", fmt.Errorf("the patch changes nothing")
+	}
+
+	s.Lock()
+	expires := s.now().Add(ttl)
+	var apply []func()
+	var summary []string
+	republish := false
+	for _, c := range changes {
+		o := &override{value: c.value, expires: expires, caller: caller}
+		switch {
+		case c.service != "":
+			republish = true
+			if c.value == nil {
+				delete(s.services[c.service], c.setting)
+				if len(s.services[c.service]) == 0 {
+					delete(s.services, c.service)
+				}
+				summary = append(summary, fmt.Sprintf("cleared %s of %s", c.setting, c.service))
+				continue
+			}
+			if s.services[c.service] == nil {
+				s.services[c.service] = map[string]*override{}
+			}
+			s.services[c.service][c.setting] = o
+			summary = append(summary, fmt.Sprintf("set %s of %s to %v", c.setting, c.service, c.value))
+		case c.pkg != "":
+			previous, overridden := s.logLevels[c.pkg]
+			if c.value == nil {
+				if overridden {
+					delete(s.logLevels, c.pkg)
+					apply = append(apply, s.restoreLevel(c.pkg, previous))
+				}
+				summary = append(summary, "cleared the log level of "+c.pkg)
+				continue
+			}
+			if overridden {
+				o.previous = previous.previous
+			} else {
+				o.previous = s.levelOf(c.pkg)
+			}
+			s.logLevels[c.pkg] = o
+			level, _ := logrus.ParseLevel(c.value.(string))
+			pkg, levels := c.pkg, s.options.Levels
+			apply = append(apply, func() { levels.Set(pkg, level) })
+			summary = append(summary, fmt.Sprintf("set the log level of %s to %v", c.pkg, c.value))
+		default:
+			if c.value == nil {
+				if s.interval != nil {
+					s.interval = nil
+					apply = append(apply, s.restoreInterval())
+				}
+				summary = append(summary, "cleared the reconfigure interval")
+				continue
+			}
+			s.interval = o
+			set, interval := s.setInterval, c.value.(time.Duration)
+			apply = append(apply, func() { set(interval) })
+			summary = append(summary, fmt.Sprintf("set the reconfigure interval to %v", interval))
+		}
+	}
+	s.count()
+	s.Unlock()
+
+	for _, a := range apply {
+		a()
+	}
+	if republish && s.options.Republish != nil {
+		s.options.Republish()
+	}
+	return strings.Join(summary, ", ") + fmt.Sprintf(" until %s", expires.UTC().Format(time.RFC3339)), nil
+}
+
+// levelOf returns the log level pkg has of its own, or "".
+func (s *Store) levelOf(pkg string) string {
+	return s.options.Levels.Snapshot()[pkg]
+}
+
+// check validates p and returns its changes, in a stable order.
+func (s *Store) check(p Patch) ([]change, error) {
+	var changes []change
+
+	if len(p.Services) > 0 && !s.options.Services {
+		return nil, fmt.Errorf("services can't be overridden in this mode")
+	}
+	s.Lock()
+	built := s.built
+	s.Unlock()
+	for _, key := range sortedKeys(p.Services) {
+		settings := p.Services[key]
+		host, port, err := net.SplitHostPort(key)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("services are keyed by vip:port. saw %q", key)
+		}
+		if !inConfig(built, host, port) {
+			return nil, fmt.Errorf("%s is not a service of the cluster config", key)
+		}
+		key = serviceKey(host, port)
+		for _, setting := range sortedKeys(settings) {
+			raw := settings[setting]
+			c := change{service: key, setting: setting}
+			if string(raw) == "null" {
+				changes = append(changes, c)
+				continue
+			}
+			switch setting {
+			case SettingWeight:
+				var weight int
+				if err := json.Unmarshal(raw, &weight); err != nil || weight < 0 || weight > maxWeight {
+					return nil, fmt.Errorf("the weight of %s must be from 0 to %d. saw %s", key, maxWeight, raw)
+				}
+				c.value = weight
+			case SettingDrained:
+				var drained bool
+				if err := json.Unmarshal(raw, &drained); err != nil {
+					return nil, fmt.Errorf("drained of %s must be true or false. saw %s", key, raw)
+				}
+				c.value = drained
+			default:
+				return nil, fmt.Errorf("unknown setting %q of %s. must be one of %s|%s", setting, key, SettingWeight, SettingDrained)
+			}
+			changes = append(changes, c)
+		}
+	}
+
+	if len(p.LogLevels) > 0 && s.options.Levels == nil {
+		return nil, fmt.Errorf("log levels can't be overridden in this process")
+	}
+	pkgs := []string{}
+	for pkg := range p.LogLevels {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	for _, pkg := range pkgs {
+		c := change{pkg: pkg}
+		if level := p.LogLevels[pkg]; level != nil {
+			parsed, err := logrus.ParseLevel(*level)
+			if err != nil {
+				return nil, fmt.Errorf("invalid log level %q for %s", *level, pkg)
+			}
+			// as the levels show it, to tell whether it has changed since
+			c.value = parsed.String()
+		}
+		changes = append(changes, c)
+	}
+
+	if len(p.ReconfigureInterval) > 0 {
+		s.Lock()
+		settable := s.setInterval != nil
+		s.Unlock()
+		if !settable {
+			return nil, fmt.Errorf("the reconfigure interval can't be overridden in this mode")
+		}
+		c := change{}
+		if string(p.ReconfigureInterval) != "null" {
+			var raw string
+			if err := json.Unmarshal(p.ReconfigureInterval, &raw); err != nil {
+				return nil, fmt.Errorf("the reconfigure interval must be a duration such as \"30s\". saw %s", p.ReconfigureInterval)
+			}
+			interval, err := time.ParseDuration(raw)
+			if err != nil || interval < MinReconfigureInterval {
+				return nil, fmt.Errorf("the reconfigure interval must be a duration of at least %v. saw %q", MinReconfigureInterval, raw)
+			}
+			c.value = interval
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// inConfig reports whether vip and port are a service of cc.
+func inConfig(cc *types.ClusterConfig, vip, port string) bool {
+	if cc == nil {
+		return false
+	}
+	ip := net.ParseIP(vip)
+	for _, config := range []map[types.ServiceIP]types.PortMap{cc.Config, cc.Config6} {
+		for addr, ports := range config {
+			if ip.Equal(net.ParseIP(string(addr))) && ports[port] != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch m := m.(type) {
+	case map[string]map[string]json.RawMessage:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]json.RawMessage:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Clear removes every override, and puts back what they overrode.
+func (s *Store) Clear() {
+	s.Lock()
+	for _, settings := range s.services {
+		for _, o := range settings {
+			o.expires = time.Time{}
+		}
+	}
+	for _, o := range s.logLevels {
+		o.expires = time.Time{}
+	}
+	if s.interval != nil {
+		s.interval.expires = time.Time{}
+	}
+	s.Unlock()
+	s.expire()
+}
+
+// ServeHTTP shows the overrides in effect on GET, applies a merge patch of
+// them on PATCH, and removes them all on DELETE.
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var p Patch
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&p); err != nil {
+			err = fmt.Errorf("invalid patch. %v", err)
+			admin.Record(r, "patch", "", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		summary, err := s.Apply(p, admin.Caller(r))
+		admin.Record(r, "patch", summary, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.logger.WithField("caller", admin.Caller(r)).Infof("liveconfig: %s", summary)
+	case http.MethodDelete:
+		s.Clear()
+		admin.Record(r, "clear", "every override", nil)
+	default:
+		w.Header().Set("Allow", "GET, PATCH, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.View())
+}
@@ -0,0 +1,176 @@
+package liveconfig
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+func testConfig() *types.ClusterConfig {
+	return &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.0.0.1": {
+				"80":  &types.ServiceDef{Namespace: "ns", Service: "web", PortName: "http"},
+				"443": &types.ServiceDef{Namespace: "ns", Service: "web", PortName: "https"},
+			},
+		},
+		Config6: map[types.ServiceIP]types.PortMap{
+			"2001:db8::1": {
+				"80": &types.ServiceDef{Namespace: "ns", Service: "web6", PortName: "http"},
+			},
+		},
+	}
+}
+
+func newTestStore(t *testing.T) (*Store, *logging.Levels, *int) {
+	levels, err := logging.ParseLevels("info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	republished := 0
+	s := New(stats.KindIpvsMaster, "test", Options{
+		Services:  true,
+		Republish: func() { republished++ },
+		Levels:    levels,
+	}, logging.Discard())
+	s.Stage(testConfig())
+	return s, levels, &republished
+}
+
+func patch(t *testing.T, s *Store, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPatch, "/runtime", strings.NewReader(body)))
+	return rec
+}
+
+func TestPatch(t *testing.T) {
+	s, levels, republished := newTestStore(t)
+	var interval time.Duration
+	setInterval := s.ReconfigureInterval(func(d time.Duration) { interval = d })
+	setInterval(time.Minute)
+
+	rec := patch(t, s, `{"ttl":"30m","services":{"10.0.0.1:80":{"weight":5},"[2001:db8:0::1]:80":{"drained":true}},"logLevels":{"bgp":"DEBUG"},"reconfigureInterval":"30s"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200. saw %d %s", rec.Code, rec.Body)
+	}
+	var view View
+	if err := json.Unmarshal(rec.Body.Bytes(), &view); err != nil {
+		t.Fatal(err)
+	}
+	if view.Services["10.0.0.1:80"]["weight"].Value != float64(5) || view.Services["[2001:db8::1]:80"]["drained"].Value != true {
+		t.Fatalf("expected the services to be overridden. saw %+v", view.Services)
+	}
+	if view.ReconfigureInterval == nil || view.ReconfigureInterval.Value != "30s" {
+		t.Fatalf("expected the reconfigure interval to be overridden. saw %+v", view.ReconfigureInterval)
+	}
+	if *republished != 1 {
+		t.Fatalf("expected one republish. saw %d", *republished)
+	}
+	if levels.Snapshot()["bgp"] != "debug" {
+		t.Fatalf("expected bgp at debug. saw %v", levels.Snapshot())
+	}
+	if interval != 30*time.Second {
+		t.Fatalf("expected the interval to be 30s. saw %v", interval)
+	}
+	// reloading the configured interval leaves the override in place
+	setInterval(2 * time.Minute)
+	if interval != 30*time.Second {
+		t.Fatalf("expected the override to hold over a reload. saw %v", interval)
+	}
+
+	staged := s.Stage(testConfig())
+	if w := staged.Config["10.0.0.1"]["80"].Weight; w == nil || *w != 5 {
+		t.Fatalf("expected the weight to be staged. saw %v", w)
+	}
+	if staged.Config["10.0.0.1"]["443"].Weight != nil || !staged.Config6["2001:db8::1"]["80"].Drained {
+		t.Fatal("expected only the services overridden to change")
+	}
+
+	// a null removes an override
+	rec = patch(t, s, `{"services":{"10.0.0.1:80":{"weight":null}},"logLevels":{"bgp":null},"reconfigureInterval":null}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200. saw %d %s", rec.Code, rec.Body)
+	}
+	if _, ok := levels.Snapshot()["bgp"]; ok {
+		t.Fatal("expected bgp to go back to the default level")
+	}
+	if interval != 2*time.Minute {
+		t.Fatalf("expected the configured interval back. saw %v", interval)
+	}
+	if s.Stage(testConfig()).Config["10.0.0.1"]["80"].Weight != nil {
+		t.Fatal("expected the weight override to be removed")
+	}
+}
+
+func TestPatchInvalid(t *testing.T) {
+	s, levels, republished := newTestStore(t)
+	for _, body := range []string{
+		`{"services":{"10.0.0.9:80":{"weight":5}}}`,
+		`{"services":{"web:80":{"weight":5}}}`,
+		`{"services":{"10.0.0.1:80":{"weight":70000}}}`,
+		`{"services":{"10.0.0.1:80":{"drained":"yes"}}}`,
+		`{"services":{"10.0.0.1:80":{"limit":5}}}`,
+		`{"logLevels":{"bgp":"loud"}}`,
+		`{"reconfigureInterval":"10ms"}`,
+		`{"reconfigureInterval":"30s"}`,
+		`{"ttl":"48h","logLevels":{"bgp":"debug"}}`,
+		`{"weights":{}}`,
+		`{}`,
+		// nothing is applied when any of it is invalid
+		`{"logLevels":{"bgp":"debug"},"services":{"10.0.0.1:80":{"weight":-1}}}`,
+	} {
+		if rec := patch(t, s, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be refused. saw %d", body, rec.Code)
+		}
+	}
+	if _, ok := levels.Snapshot()["bgp"]; ok || *republished != 0 || len(s.View().Services) != 0 {
+		t.Fatal("expected no overrides from invalid patches")
+	}
+
+	realserver := New(stats.KindIpvsBackend, "test", Options{}, logging.Discard())
+	if rec := patch(t, realserver, `{"services":{"10.0.0.1:80":{"weight":5}}}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected services to be refused where they can't be overridden. saw %d", rec.Code)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	s, levels, republished := newTestStore(t)
+	levels.Set("watcher", logrus.WarnLevel)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	if rec := patch(t, s, `{"ttl":"1m","services":{"10.0.0.1:80":{"drained":true}},"logLevels":{"watcher":"trace","bgp":"debug"}}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200. saw %d %s", rec.Code, rec.Body)
+	}
+	// a level changed since the override is left as it is
+	levels.Set("bgp", logrus.ErrorLevel)
+
+	s.expire()
+	if len(s.View().Services) != 1 {
+		t.Fatal("expected the overrides to last until their ttl")
+	}
+	now = now.Add(time.Minute)
+	s.expire()
+	if v := s.View(); len(v.Services) != 0 || len(v.LogLevels) != 0 {
+		t.Fatalf("expected the overrides to expire. saw %+v", v)
+	}
+	if *republished != 2 {
+		t.Fatalf("expected a republish for the patch and the expiry. saw %d", *republished)
+	}
+	snapshot := levels.Snapshot()
+	if snapshot["watcher"] != "warning" || snapshot["bgp"] != "error" {
+		t.Fatalf("expected watcher back at warning and bgp left at error. saw %v", snapshot)
+	}
+	if s.Stage(testConfig()).Config["10.0.0.1"]["80"].Drained {
+		t.Fatal("expected the service to be undrained once the override expired")
+	}
+}
@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// JournalSocket is where journald listens for native protocol messages.
+const JournalSocket = "/run/systemd/journal/socket"
+
+// JournaldHook sends log entries to the systemd journal using its native
+// protocol. Log fields are sent as RAVEL_ prefixed journal fields, alongside
+// RAVEL_NODE and RAVEL_CONFIG_KEY.
+type JournaldHook struct {
+	*asyncWriter
+	fixed []byte
+}
+
+// NewJournaldHook returns a hook sending to the journal. The socket is
+// connected when the first entry is logged.
+func NewJournaldHook(nodeName, configKey string) *JournaldHook {
+	var fixed bytes.Buffer
+	WriteJournalField(&fixed, "SYSLOG_IDENTIFIER", "ravel")
+	WriteJournalField(&fixed, "RAVEL_NODE", nodeName)
+	WriteJournalField(&fixed, "RAVEL_CONFIG_KEY", configKey)
+
+	return &JournaldHook{
+		asyncWriter: newAsyncWriter(func() (io.WriteCloser, error) {
+			return net.DialUnix("unixgram", nil, &net.UnixAddr{Name: JournalSocket, Net: "unixgram"})
+		}),
+		fixed: fixed.Bytes(),
+	}
+}
+
+func (h *JournaldHook) Levels() []logrus.Level { return allLevels }
+
+func (h *JournaldHook) Fire(entry *logrus.Entry) error {
+	h.send(h.format(entry))
+	return nil
+}
+
+func (h *JournaldHook) format(entry *logrus.Entry) []byte {
+	var b bytes.Buffer
+	WriteJournalField(&b, "MESSAGE", strings.TrimRight(entry.Message, "\n"))
+	WriteJournalField(&b, "PRIORITY", strconv.Itoa(syslogSeverity(entry.Level)))
+	b.Write(h.fixed)
+
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == FieldNode || k == FieldConfigKey {
+			continue
+		}
+		WriteJournalField(&b, "RAVEL_"+journalName(k), fmt.Sprint(entry.Data[k]))
+	}
+	return b.Bytes()
+}
+
+// journalName turns a log field name into a journal field name, which may
+// only contain upper case letters, digits and underscores.
+func journalName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// WriteJournalField encodes a field in the journal native format. Values
+// containing newlines are written with an explicit length, and empty values
+// are left out.
+func WriteJournalField(b *bytes.Buffer, key, value string) {
+	if value == "" {
+		return
+	}
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", key, value)
+		return
+	}
+	b.WriteString(key)
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
@@ -0,0 +1,309 @@
+package logging
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Ravel logs through Logger rather than through logrus itself, so that the
+// backend writing the entries can be chosen at startup: logrus, or slog or
+// zap where their allocation-free encoders are worth having on busy
+// directors.
+// Loggers handed out before the backend is chosen, such as those the
+// commands are built with, log through whichever backend is set last.
+
+// The fields every part of ravel names the same way, so that the entries of
+// a node, role, config key or VIP can be found across all of its logs.
+const (
+	FieldNode      = "node"
+	FieldRole      = "role"
+	FieldConfigKey = "configKey"
+	FieldVIP       = "vip"
+)
+
+// Fields are fields to add to the entries of a Logger.
+type Fields map[string]interface{}
+
+// Logger logs leveled entries with fields. Its methods are those of a logrus
+// FieldLogger, which it stands in for.
+type Logger interface {
+	WithField(key string, value interface{}) Logger
+	WithFields(fields Fields) Logger
+	WithError(err error) Logger
+
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Printf(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+	Panicf(format string, args ...interface{})
+
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Print(args ...interface{})
+	Warn(args ...interface{})
+	Warning(args ...interface{})
+	Error(args ...interface{})
+	Fatal(args ...interface{})
+	Panic(args ...interface{})
+
+	Debugln(args ...interface{})
+	Infoln(args ...interface{})
+	Println(args ...interface{})
+	Warnln(args ...interface{})
+	Warningln(args ...interface{})
+	Errorln(args ...interface{})
+	Fatalln(args ...interface{})
+	Panicln(args ...interface{})
+}
+
+// core is what a backend provides to a logger.
+type core interface {
+	enabled(level logrus.Level) bool
+	log(level logrus.Level, msg string)
+	with(fields Fields) core
+}
+
+// exit ends the process after a fatal entry, running the logrus exit
+// handlers as logrus does.
+var exit = logrus.Exit
+
+// logger implements Logger over a core.
+type logger struct {
+	core core
+}
+
+// FromLogrus returns a Logger writing to a logrus logger or entry.
+func FromLogrus(l logrus.FieldLogger) Logger {
+	return logger{core: logrusCore{entry: l.WithFields(nil)}}
+}
+
+// New returns a Logger of its own that writes text to stderr at info, as
+// logrus.New does.
+func New() Logger {
+	return FromLogrus(logrus.New())
+}
+
+// Discard returns a Logger that drops every entry.
+func Discard() Logger {
+	l := logrus.New()
+	l.Out = ioutil.Discard
+	l.SetLevel(logrus.PanicLevel)
+	return FromLogrus(l)
+}
+
+func (l logger) WithField(key string, value interface{}) Logger {
+	return logger{core: l.core.with(Fields{key: value})}
+}
+
+func (l logger) WithFields(fields Fields) Logger {
+	return logger{core: l.core.with(fields)}
+}
+
+func (l logger) WithError(err error) Logger {
+	return logger{core: l.core.with(Fields{logrus.ErrorKey: err})}
+}
+
+func (l logger) logf(level logrus.Level, format string, args ...interface{}) {
+	if l.core.enabled(level) || level <= logrus.FatalLevel {
+		l.write(level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l logger) logs(level logrus.Level, args ...interface{}) {
+	if l.core.enabled(level) || level <= logrus.FatalLevel {
+		l.write(level, fmt.Sprint(args...))
+	}
+}
+
+func (l logger) logln(level logrus.Level, args ...interface{}) {
+	if l.core.enabled(level) || level <= logrus.FatalLevel {
+		msg := fmt.Sprintln(args...)
+		l.write(level, msg[:len(msg)-1])
+	}
+}
+
+// write logs msg, and then ends the process or panics for the fatal and
+// panic levels whether or not the entry was logged.
+func (l logger) write(level logrus.Level, msg string) {
+	if l.core.enabled(level) {
+		l.core.log(level, msg)
+	}
+	switch level {
+	case logrus.FatalLevel:
+		exit(1)
+	case logrus.PanicLevel:
+		panic(msg)
+	}
+}
+
+func (l logger) Debugf(format string, args ...interface{}) {
+	l.logf(logrus.DebugLevel, format, args...)
+}
+
+func (l logger) Infof(format string, args ...interface{}) {
+	l.logf(logrus.InfoLevel, format, args...)
+}
+
+func (l logger) Printf(format string, args ...interface{}) {
+	l.logf(logrus.InfoLevel, format, args...)
+}
+
+func (l logger) Warnf(format string, args ...interface{}) {
+	l.logf(logrus.WarnLevel, format, args...)
+}
+
+func (l logger) Warningf(format string, args ...interface{}) {
+	l.logf(logrus.WarnLevel, format, args...)
+}
+
+func (l logger) Errorf(format string, args ...interface{}) {
+	l.logf(logrus.ErrorLevel, format, args...)
+}
+
+func (l logger) Fatalf(format string, args ...interface{}) {
+	l.logf(logrus.FatalLevel, format, args...)
+}
+
+func (l logger) Panicf(format string, args ...interface{}) {
+	l.logf(logrus.PanicLevel, format, args...)
+}
+
+func (l logger) Debug(args ...interface{})   { l.logs(logrus.DebugLevel, args...) }
+func (l logger) Info(args ...interface{})    { l.logs(logrus.InfoLevel, args...) }
+func (l logger) Print(args ...interface{})   { l.logs(logrus.InfoLevel, args...) }
+func (l logger) Warn(args ...interface{})    { l.logs(logrus.WarnLevel, args...) }
+func (l logger) Warning(args ...interface{}) { l.logs(logrus.WarnLevel, args...) }
+func (l logger) Error(args ...interface{})   { l.logs(logrus.ErrorLevel, args...) }
+func (l logger) Fatal(args ...interface{})   { l.logs(logrus.FatalLevel, args...) }
+func (l logger) Panic(args ...interface{})   { l.logs(logrus.PanicLevel, args...) }
+
+func (l logger) Debugln(args ...interface{})   { l.logln(logrus.DebugLevel, args...) }
+func (l logger) Infoln(args ...interface{})    { l.logln(logrus.InfoLevel, args...) }
+func (l logger) Println(args ...interface{})   { l.logln(logrus.InfoLevel, args...) }
+func (l logger) Warnln(args ...interface{})    { l.logln(logrus.WarnLevel, args...) }
+func (l logger) Warningln(args ...interface{}) { l.logln(logrus.WarnLevel, args...) }
+func (l logger) Errorln(args ...interface{})   { l.logln(logrus.ErrorLevel, args...) }
+func (l logger) Fatalln(args ...interface{})   { l.logln(logrus.FatalLevel, args...) }
+func (l logger) Panicln(args ...interface{})   { l.logln(logrus.PanicLevel, args...) }
+
+// logrusCore writes to a logrus entry.
+type logrusCore struct {
+	entry *logrus.Entry
+}
+
+func (c logrusCore) enabled(level logrus.Level) bool {
+	return c.entry.Logger.IsLevelEnabled(level)
+}
+
+func (c logrusCore) log(level logrus.Level, msg string) {
+	// logrus panics itself on a panic entry, which write would otherwise do
+	if level == logrus.PanicLevel {
+		defer func() { recover() }()
+	}
+	c.entry.Log(level, msg)
+}
+
+func (c logrusCore) with(fields Fields) core {
+	return logrusCore{entry: c.entry.WithFields(logrus.Fields(fields))}
+}
+
+// The backend that Default and the package level functions log through.
+var (
+	backendMu  sync.Mutex
+	backend    atomic.Value // of backendOf
+	generation uint64
+)
+
+// backendOf is a backend and when it was set, so that deferred loggers know
+// to resolve themselves again.
+type backendOf struct {
+	core       core
+	generation uint64
+}
+
+func init() {
+	backend.Store(backendOf{core: FromLogrus(logrus.StandardLogger()).(logger).core})
+}
+
+// SetBackend has Default, and every Logger derived from it, log through l
+// from now on. l must be a Logger of this package. Until it is first called
+// they log through the logrus standard logger.
+func SetBackend(l Logger) {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	generation++
+	backend.Store(backendOf{core: l.(logger).core, generation: generation})
+}
+
+// Default returns the Logger of the backend set by SetBackend, including
+// those set after it is called.
+func Default() Logger {
+	return logger{core: &deferred{}}
+}
+
+// deferred logs through the current backend with its fields added, which
+// it adds again whenever the backend changes.
+type deferred struct {
+	fields   Fields
+	resolved atomic.Value // of backendOf, with fields added
+}
+
+func (d *deferred) resolve() core {
+	b := backend.Load().(backendOf)
+	if r, ok := d.resolved.Load().(backendOf); ok && r.generation == b.generation {
+		return r.core
+	}
+	c := b.core
+	if len(d.fields) > 0 {
+		c = c.with(d.fields)
+	}
+	d.resolved.Store(backendOf{core: c, generation: b.generation})
+	return c
+}
+
+func (d *deferred) enabled(level logrus.Level) bool { return d.resolve().enabled(level) }
+
+func (d *deferred) log(level logrus.Level, msg string) { d.resolve().log(level, msg) }
+
+func (d *deferred) with(fields Fields) core {
+	merged := make(Fields, len(d.fields)+len(fields))
+	for k, v := range d.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &deferred{fields: merged}
+}
+
+// fireHooks fires entry to each of hooks that takes its level, as a logrus
+// logger would.
+func fireHooks(hooks []logrus.Hook, entry *logrus.Entry) {
+	for _, hook := range hooks {
+		for _, level := range hook.Levels() {
+			if level == entry.Level {
+				hook.Fire(entry)
+				break
+			}
+		}
+	}
+}
+
+// sortedKeys returns the keys of fields in order, so that backends add them
+// the same way every time.
+func sortedKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
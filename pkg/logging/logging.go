@@ -0,0 +1,348 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Log levels can be set per package at runtime. Every logger attached to a
+// Levels runs at the most verbose level in use, and a formatter wrapper drops
+// entries that are below the level of the package that logged them. The
+// package is that of the first caller outside of logrus and this package,
+// and is only looked up while some package has an override.
+
+// DefaultPackage is the name used for the level applied to packages without
+// an override.
+const DefaultPackage = "default"
+
+const (
+	modulePrefix  = "github.com/Comcast/Ravel/"
+	loggingPrefix = modulePrefix + "pkg/logging."
+	logrusPrefix  = "github.com/sirupsen/logrus."
+)
+
+// Levels holds the default log level and per-package overrides.
+type Levels struct {
+	sync.RWMutex
+	def      logrus.Level
+	packages map[string]logrus.Level
+
+	// the levels given at startup, restored by Reset.
+	initialDef      logrus.Level
+	initialPackages map[string]logrus.Level
+
+	loggers []*logrus.Logger
+
+	// max is the most verbose level in use, and overrides whether any
+	// package has a level of its own.
+	max       logrus.Level
+	overrides bool
+
+	// serializes updates to the attached loggers. It is taken before, and
+	// never while, holding the RWMutex, since the loggers call back into
+	// levelFor with their own lock held.
+	updates sync.Mutex
+}
+
+// ParseLevels parses a level spec like "info,bgp=debug,watcher=trace". The
+// optional bare level sets the default, which is info if omitted.
+func ParseLevels(spec string) (*Levels, error) {
+	l := &Levels{
+		def:      logrus.InfoLevel,
+		packages: map[string]logrus.Level{},
+	}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pkg, lvl := DefaultPackage, part
+		if i := strings.Index(part, "="); i >= 0 {
+			pkg, lvl = strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+		}
+		level, err := logrus.ParseLevel(lvl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level %q for %s: %v", lvl, pkg, err)
+		}
+		if pkg == DefaultPackage {
+			l.def = level
+		} else {
+			l.packages[pkg] = level
+		}
+	}
+
+	l.initialDef = l.def
+	l.initialPackages = copyLevels(l.packages)
+	l.max, l.overrides = l.computeMax()
+	return l, nil
+}
+
+// NewFormatter returns a logrus formatter for the given format, text or json.
+func NewFormatter(format string) (logrus.Formatter, error) {
+	switch format {
+	case "text", "":
+		return &logrus.TextFormatter{FullTimestamp: true}, nil
+	case "json":
+		return &logrus.JSONFormatter{}, nil
+	}
+	return nil, fmt.Errorf("unknown log format %q. must be one of text|json", format)
+}
+
+// Attach puts loggers under the control of l. Their formatters are wrapped
+// to filter by package, so they should be set before calling Attach.
+func (l *Levels) Attach(loggers ...*logrus.Logger) {
+	l.update(func() {
+		for _, logger := range loggers {
+			logger.Formatter = &filter{inner: logger.Formatter, levels: l}
+			l.loggers = append(l.loggers, logger)
+		}
+	})
+}
+
+// Set changes the level for pkg. Use DefaultPackage for the default level.
+func (l *Levels) Set(pkg string, level logrus.Level) {
+	l.update(func() {
+		if pkg == DefaultPackage || pkg == "" {
+			l.def = level
+		} else {
+			l.packages[pkg] = level
+		}
+	})
+}
+
+// Clear removes the override for pkg so that it uses the default level.
+func (l *Levels) Clear(pkg string) {
+	l.update(func() {
+		delete(l.packages, pkg)
+	})
+}
+
+// Reset restores the levels given at startup.
+func (l *Levels) Reset() {
+	l.update(func() {
+		l.def = l.initialDef
+		l.packages = copyLevels(l.initialPackages)
+	})
+}
+
+// Load replaces the levels, and those Reset restores, with those of spec.
+func (l *Levels) Load(spec string) error {
+	parsed, err := ParseLevels(spec)
+	if err != nil {
+		return err
+	}
+	l.update(func() {
+		l.def, l.packages = parsed.def, parsed.packages
+		l.initialDef, l.initialPackages = parsed.initialDef, parsed.initialPackages
+	})
+	return nil
+}
+
+// ToggleDebug switches the default level between debug and the startup level.
+func (l *Levels) ToggleDebug() {
+	l.update(func() {
+		if l.def == logrus.DebugLevel {
+			l.def = l.initialDef
+		} else {
+			l.def = logrus.DebugLevel
+		}
+	})
+}
+
+// Snapshot returns the current levels by package name, including the default.
+func (l *Levels) Snapshot() map[string]string {
+	l.RLock()
+	defer l.RUnlock()
+	out := map[string]string{DefaultPackage: l.def.String()}
+	for pkg, level := range l.packages {
+		out[pkg] = level.String()
+	}
+	return out
+}
+
+// String renders the levels in the format accepted by ParseLevels.
+func (l *Levels) String() string {
+	l.RLock()
+	defer l.RUnlock()
+	parts := []string{}
+	for pkg, level := range l.packages {
+		parts = append(parts, pkg+"="+level.String())
+	}
+	sort.Strings(parts)
+	return strings.Join(append([]string{l.def.String()}, parts...), ",")
+}
+
+// HandleSignals toggles debug logging on SIGUSR1 and restores the startup
+// levels on SIGUSR2, until ctx is canceled.
+func (l *Levels) HandleSignals(ctx context.Context, logger Logger) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		defer signal.Stop(sig)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case s := <-sig:
+				if s == syscall.SIGUSR1 {
+					l.ToggleDebug()
+				} else {
+					l.Reset()
+				}
+				logger.Warnf("logging: caught %v. log levels are now %s", s, l)
+			}
+		}
+	}()
+}
+
+// ServeHTTP reports the current levels on GET. PUT or POST with the query
+// parameters package and level sets a level; an empty level clears the
+// override for the package.
+func (l *Levels) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		pkg := r.URL.Query().Get("package")
+		if pkg == "" {
+			pkg = DefaultPackage
+		}
+		lvl := r.URL.Query().Get("level")
+		if lvl == "" && pkg != DefaultPackage {
+			l.Clear(pkg)
+			break
+		}
+		level, err := logrus.ParseLevel(lvl)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid level %q", lvl), http.StatusBadRequest)
+			return
+		}
+		l.Set(pkg, level)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.Snapshot())
+}
+
+// enabled is whether an entry at level is logged by the package calling
+// the logger.
+func (l *Levels) enabled(level logrus.Level) bool {
+	l.RLock()
+	max, overrides, def := l.max, l.overrides, l.def
+	l.RUnlock()
+	if level > max {
+		return false
+	}
+	if !overrides {
+		return level <= def
+	}
+	return level <= l.levelFor(callerPackage())
+}
+
+// levelFor returns the level in effect for pkg.
+func (l *Levels) levelFor(pkg string) logrus.Level {
+	l.RLock()
+	defer l.RUnlock()
+	if level, ok := l.packages[pkg]; ok {
+		return level
+	}
+	return l.def
+}
+
+// update applies fn to the levels and then pushes the result to the
+// attached loggers.
+func (l *Levels) update(fn func()) {
+	l.updates.Lock()
+	defer l.updates.Unlock()
+
+	l.Lock()
+	fn()
+	l.max, l.overrides = l.computeMax()
+	max := l.max
+	loggers := l.loggers
+	l.Unlock()
+
+	for _, logger := range loggers {
+		logger.SetLevel(max)
+	}
+}
+
+// computeMax returns the most verbose level in use, and whether any package
+// has an override.
+func (l *Levels) computeMax() (logrus.Level, bool) {
+	max := l.def
+	for _, level := range l.packages {
+		if level > max {
+			max = level
+		}
+	}
+	return max, len(l.packages) > 0
+}
+
+// filter drops entries below the level of the package that logged them.
+type filter struct {
+	inner  logrus.Formatter
+	levels *Levels
+}
+
+func (f *filter) Format(entry *logrus.Entry) ([]byte, error) {
+	if !f.levels.enabled(entry.Level) {
+		return nil, nil
+	}
+	return f.inner.Format(entry)
+}
+
+// packageOf returns the short package name of a caller, e.g. bgp for
+// github.com/Comcast/Ravel/pkg/bgp.(*bgpserver).configure. Commands are
+// reported as main.
+func packageOf(caller *runtime.Frame) string {
+	if caller == nil {
+		return DefaultPackage
+	}
+	fn := strings.TrimPrefix(caller.Function, modulePrefix)
+	slash := strings.LastIndex(fn, "/")
+	if dot := strings.Index(fn[slash+1:], "."); dot >= 0 {
+		fn = fn[:slash+1+dot]
+	}
+	return fn[slash+1:]
+}
+
+// callerPackage returns the short package name of the code that called the
+// logger, skipping the frames of logrus and of this package, other than
+// its tests.
+func callerPackage() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, logrusPrefix) &&
+			(!strings.HasPrefix(frame.Function, loggingPrefix) || strings.HasSuffix(frame.File, "_test.go")) {
+			return packageOf(&frame)
+		}
+		if !more {
+			return DefaultPackage
+		}
+	}
+}
+
+func copyLevels(in map[string]logrus.Level) map[string]logrus.Level {
+	out := make(map[string]logrus.Level, len(in))
+	for k, v := range in {
+		out[k] = v
+	}
+	return out
+}
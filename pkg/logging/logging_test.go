@@ -0,0 +1,240 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseLevels(t *testing.T) {
+	l, err := ParseLevels("warn, bgp=debug,watcher=trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := l.String(); s != "warning,bgp=debug,watcher=trace" {
+		t.Fatalf("unexpected levels %s", s)
+	}
+	if _, err := ParseLevels("bgp=loud"); err == nil {
+		t.Fatal("expected an error for an invalid level")
+	}
+}
+
+func TestPackageOf(t *testing.T) {
+	for fn, want := range map[string]string{
+		"github.com/Comcast/Ravel/pkg/bgp.(*bgpserver).configure": "bgp",
+		"github.com/Comcast/Ravel/pkg/watcher.NewWatcher.func1":   "watcher",
+		"main.initLogging": "main",
+	} {
+		if got := packageOf(&runtime.Frame{Function: fn}); got != want {
+			t.Fatalf("expected %s for %s. saw %s", want, fn, got)
+		}
+	}
+	if got := packageOf(nil); got != DefaultPackage {
+		t.Fatalf("expected %s without a caller. saw %s", DefaultPackage, got)
+	}
+}
+
+func TestPackageOverride(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Formatter, _ = NewFormatter("json")
+
+	l, _ := ParseLevels("info")
+	l.Attach(logger)
+
+	logger.Debug("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("expected debug to be dropped at info. saw %s", buf.String())
+	}
+
+	// this test runs in the logging package
+	l.Set("logging", logrus.DebugLevel)
+	logger.Debug("shown")
+	if !strings.Contains(buf.String(), "shown") {
+		t.Fatal("expected debug to be logged after a package override")
+	}
+	if strings.Contains(buf.String(), "func") {
+		t.Fatalf("expected caller fields to be hidden. saw %s", buf.String())
+	}
+
+	buf.Reset()
+	l.Reset()
+	logger.Debug("hidden again")
+	if buf.Len() != 0 {
+		t.Fatalf("expected debug to be dropped after a reset. saw %s", buf.String())
+	}
+
+	// loaded levels are the ones a reset restores from then on
+	if err := l.Load("warn,logging=debug"); err != nil {
+		t.Fatal(err)
+	}
+	l.Reset()
+	logger.Debug("loaded")
+	if !strings.Contains(buf.String(), "loaded") {
+		t.Fatal("expected debug to be logged after loading a package override")
+	}
+	if err := l.Load("loud"); err == nil {
+		t.Fatal("expected an invalid spec to be refused")
+	}
+}
+
+func TestJournalField(t *testing.T) {
+	var b bytes.Buffer
+	WriteJournalField(&b, "MESSAGE", "ok")
+	WriteJournalField(&b, "EMPTY", "")
+	WriteJournalField(&b, "DETAIL", "a\nb")
+	want := "MESSAGE=ok\nDETAIL\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n"
+	if b.String() != want {
+		t.Fatalf("expected %q. saw %q", want, b.String())
+	}
+}
+
+func TestJournaldFormat(t *testing.T) {
+	h := NewJournaldHook("lb01", "green")
+	entry := &logrus.Entry{
+		Level:   logrus.WarnLevel,
+		Message: "unable to set rules\n",
+		Data:    logrus.Fields{"vip": "10.0.0.1", "s": "rdei-lb"},
+	}
+	got := string(h.format(entry))
+	want := "MESSAGE=unable to set rules\nPRIORITY=4\nSYSLOG_IDENTIFIER=ravel\nRAVEL_NODE=lb01\nRAVEL_CONFIG_KEY=green\nRAVEL_S=rdei-lb\nRAVEL_VIP=10.0.0.1\n"
+	if got != want {
+		t.Fatalf("expected %q. saw %q", want, got)
+	}
+}
+
+func TestSyslogFormat(t *testing.T) {
+	h, err := NewSyslogHook(SyslogConfig{Address: "tcp:127.0.0.1:1", Facility: "daemon", NodeName: "lb01", ConfigKey: `a"b`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.hostname, h.pid = "host", "42"
+	entry := &logrus.Entry{
+		Time:    time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+		Level:   logrus.ErrorLevel,
+		Message: "unable to set rules",
+		Data:    logrus.Fields{"error": "exit status 1]", "bad name": 1},
+	}
+	got := string(h.format(entry))
+	want := `<27>1 2021-06-01T12:00:00.000000Z host ravel 42 - [ravel@32473 node="lb01" configKey="a\"b" bad_name="1" error="exit status 1\]"] unable to set rules`
+	if got != want {
+		t.Fatalf("expected %s\nsaw %s", want, got)
+	}
+
+	for _, c := range []SyslogConfig{
+		{Address: "local", Facility: "nope"},
+		{Address: "udp:127.0.0.1:514", Facility: "daemon"},
+		{Address: "tcp:nohost", Facility: "daemon"},
+		{Address: "local", Facility: "daemon", SDID: "has space@1"},
+	} {
+		if _, err := NewSyslogHook(c); err == nil {
+			t.Errorf("expected %+v to be rejected", c)
+		}
+	}
+}
+
+// TestSyslogTCP sends through a filtered hook to a tcp listener, and checks
+// the messages are framed and filtered by package level.
+func TestSyslogTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	h, err := NewSyslogHook(SyslogConfig{Address: "tcp:" + ln.Addr().String(), Facility: "local0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	l, _ := ParseLevels("info")
+	l.Attach(logger)
+	logger.AddHook(l.Filter(h))
+
+	logger.Debug("hidden")
+	logger.Info("first")
+	logger.Warn("second\nline")
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, want := range []string{"<134>1 ", "<132>1 "} {
+		length, err := r.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(length))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(msg), want) || strings.Contains(string(msg), "hidden") {
+			t.Fatalf("expected a message starting %q. saw %q", want, msg)
+		}
+	}
+	if h.Dropped() != 0 {
+		t.Fatalf("expected no drops. saw %d", h.Dropped())
+	}
+}
+
+func TestDefaultFollowsBackend(t *testing.T) {
+	defer SetBackend(FromLogrus(logrus.StandardLogger()))
+
+	// handed out before the backend is chosen, as the commands are
+	l := Default().WithField(FieldRole, "director")
+
+	var first, second bytes.Buffer
+	for _, buf := range []*bytes.Buffer{&first, &second} {
+		logger := logrus.New()
+		logger.Out = buf
+		logger.Formatter, _ = NewFormatter("json")
+		SetBackend(FromLogrus(logger).WithField(FieldNode, "lb01"))
+		l.WithField(FieldVIP, "10.0.0.1").Infof("configured %d", len(buf.String()))
+	}
+	for _, buf := range []*bytes.Buffer{&first, &second} {
+		for _, want := range []string{`"role":"director"`, `"node":"lb01"`, `"vip":"10.0.0.1"`, `"msg":"configured 0"`} {
+			if !strings.Contains(buf.String(), want) {
+				t.Fatalf("expected %s in %s", want, buf.String())
+			}
+		}
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.SetLevel(logrus.WarnLevel)
+	l := FromLogrus(logger)
+
+	l.Infoln("hidden")
+	l.Warnln("shown", 1)
+	if strings.Contains(buf.String(), "hidden") || !strings.Contains(buf.String(), `msg="shown 1"`) {
+		t.Fatalf("expected only the warning, without a trailing newline. saw %s", buf.String())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic entry to panic")
+		}
+	}()
+	l.Panic("stop")
+}
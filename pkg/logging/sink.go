@@ -0,0 +1,134 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Logs can be copied to syslog and the systemd journal, for directors whose
+// container output isn't collected. Copies are sent from a goroutine through
+// a bounded queue, so an unreachable log server drops messages rather than
+// holding up the load balancer.
+
+const (
+	// sinkQueueSize bounds the messages waiting to be sent to a sink.
+	sinkQueueSize = 1024
+
+	// redialInterval is how long a sink waits after a failed connection
+	// before trying again. Messages sent in the meantime are dropped.
+	redialInterval = 5 * time.Second
+)
+
+// Sink is a hook that sends entries from a goroutine.
+type Sink interface {
+	logrus.Hook
+	// Flush waits up to timeout for queued entries to be sent.
+	Flush(timeout time.Duration)
+	// Dropped returns the number of entries that were not delivered.
+	Dropped() uint64
+}
+
+// Filter wraps a hook so that it only fires for entries at or above the level
+// of the package that logged them, as the formatters of attached loggers do.
+func (l *Levels) Filter(h logrus.Hook) logrus.Hook {
+	return &filteredHook{inner: h, levels: l}
+}
+
+type filteredHook struct {
+	inner  logrus.Hook
+	levels *Levels
+}
+
+func (h *filteredHook) Levels() []logrus.Level { return h.inner.Levels() }
+
+func (h *filteredHook) Fire(entry *logrus.Entry) error {
+	if !h.levels.enabled(entry.Level) {
+		return nil
+	}
+	return h.inner.Fire(entry)
+}
+
+// asyncWriter writes messages to a connection from a goroutine, dialing it
+// on first use and again after a write fails.
+type asyncWriter struct {
+	dial    func() (io.WriteCloser, error)
+	queue   chan []byte
+	dropped uint64
+	pending int64 // queued or being written
+
+	// owned by run.
+	conn     io.WriteCloser
+	lastDial time.Time
+}
+
+func newAsyncWriter(dial func() (io.WriteCloser, error)) *asyncWriter {
+	w := &asyncWriter{dial: dial, queue: make(chan []byte, sinkQueueSize)}
+	go w.run()
+	return w
+}
+
+// send queues a message, dropping it if the queue is full.
+func (w *asyncWriter) send(msg []byte) {
+	atomic.AddInt64(&w.pending, 1)
+	select {
+	case w.queue <- msg:
+	default:
+		atomic.AddInt64(&w.pending, -1)
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// Dropped returns the number of messages that were not delivered.
+func (w *asyncWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Flush waits up to timeout for the queue to drain.
+func (w *asyncWriter) Flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&w.pending) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (w *asyncWriter) run() {
+	for msg := range w.queue {
+		if err := w.write(msg); err != nil {
+			atomic.AddUint64(&w.dropped, 1)
+		}
+		atomic.AddInt64(&w.pending, -1)
+	}
+}
+
+// write sends a message, connecting first if needed. It is only called from
+// run.
+func (w *asyncWriter) write(msg []byte) error {
+	if w.conn == nil {
+		if time.Since(w.lastDial) < redialInterval {
+			return fmt.Errorf("waiting to reconnect")
+		}
+		w.lastDial = time.Now()
+		conn, err := w.dial()
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+	}
+	if _, err := w.conn.Write(msg); err != nil {
+		w.conn.Close()
+		w.conn = nil
+		// reconnect on the next message, since the server may simply have
+		// closed an idle connection.
+		w.lastDial = time.Time{}
+		return err
+	}
+	return nil
+}
+
+// allLevels is used by the hooks, which leave level filtering to the logger
+// and to Levels.Filter.
+var allLevels = logrus.AllLevels
@@ -0,0 +1,131 @@
+//go:build go1.21
+// +build go1.21
+
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SlogAvailable is whether this build has the slog backend, which needs go
+// 1.21 or later.
+const SlogAvailable = true
+
+// slogLevels are the slog levels of those of logrus. slog has no fatal or
+// panic levels, so they are above error, and named by slogLevelNames.
+var slogLevels = map[logrus.Level]slog.Level{
+	logrus.PanicLevel: slog.LevelError + 8,
+	logrus.FatalLevel: slog.LevelError + 4,
+	logrus.ErrorLevel: slog.LevelError,
+	logrus.WarnLevel:  slog.LevelWarn,
+	logrus.InfoLevel:  slog.LevelInfo,
+	logrus.DebugLevel: slog.LevelDebug,
+	logrus.TraceLevel: slog.LevelDebug - 4,
+}
+
+var slogLevelNames = map[slog.Level]string{
+	slog.LevelError + 8: "PANIC",
+	slog.LevelError + 4: "FATAL",
+	slog.LevelDebug - 4: "TRACE",
+}
+
+// NewSlog returns a Logger writing to out with a slog handler for format,
+// text or json, at the levels of levels. Entries are also fired to hooks,
+// such as the syslog and journald sinks.
+func NewSlog(format string, out io.Writer, levels *Levels, hooks ...logrus.Hook) (Logger, error) {
+	opts := &slog.HandlerOptions{
+		// levels filters, by package
+		Level: slog.LevelDebug - 4,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.LevelKey {
+				if name, ok := slogLevelNames[a.Value.Any().(slog.Level)]; ok {
+					a.Value = slog.StringValue(name)
+				}
+			}
+			return a
+		},
+	}
+
+	var h slog.Handler
+	switch format {
+	case "text", "":
+		h = slog.NewTextHandler(out, opts)
+	case "json":
+		h = slog.NewJSONHandler(out, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q. must be one of text|json", format)
+	}
+	if len(hooks) > 0 {
+		h = &hookHandler{Handler: h, hooks: hooks, fields: Fields{}}
+	}
+	return logger{core: slogCore{handler: h, levels: levels}}, nil
+}
+
+// slogCore writes to a slog handler.
+type slogCore struct {
+	handler slog.Handler
+	levels  *Levels
+}
+
+func (c slogCore) enabled(level logrus.Level) bool {
+	return c.levels.enabled(level)
+}
+
+func (c slogCore) log(level logrus.Level, msg string) {
+	c.handler.Handle(context.Background(), slog.NewRecord(time.Now(), slogLevels[level], msg, 0))
+}
+
+func (c slogCore) with(fields Fields) core {
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, k := range sortedKeys(fields) {
+		attrs = append(attrs, slog.Any(k, fields[k]))
+	}
+	return slogCore{handler: c.handler.WithAttrs(attrs), levels: c.levels}
+}
+
+// hookHandler fires logrus hooks with the records of a slog handler, as a
+// logrus logger would with its entries.
+type hookHandler struct {
+	slog.Handler
+	hooks  []logrus.Hook
+	fields Fields
+}
+
+func (h *hookHandler) Handle(ctx context.Context, r slog.Record) error {
+	entry := &logrus.Entry{Time: r.Time, Message: r.Message, Data: make(logrus.Fields, len(h.fields)+r.NumAttrs())}
+	for k, v := range h.fields {
+		entry.Data[k] = v
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		entry.Data[a.Key] = a.Value.Any()
+		return true
+	})
+	for level, l := range slogLevels {
+		if l == r.Level {
+			entry.Level = level
+		}
+	}
+	fireHooks(h.hooks, entry)
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *hookHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	fields := make(Fields, len(h.fields)+len(attrs))
+	for k, v := range h.fields {
+		fields[k] = v
+	}
+	for _, a := range attrs {
+		fields[a.Key] = a.Value.Any()
+	}
+	return &hookHandler{Handler: h.Handler.WithAttrs(attrs), hooks: h.hooks, fields: fields}
+}
+
+func (h *hookHandler) WithGroup(name string) slog.Handler {
+	return &hookHandler{Handler: h.Handler.WithGroup(name), hooks: h.hooks, fields: h.fields}
+}
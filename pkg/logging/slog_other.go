@@ -0,0 +1,20 @@
+//go:build !go1.21
+// +build !go1.21
+
+package logging
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SlogAvailable is whether this build has the slog backend, which needs go
+// 1.21 or later.
+const SlogAvailable = false
+
+// NewSlog fails, since slog is not in the go ravel was built with.
+func NewSlog(format string, out io.Writer, levels *Levels, hooks ...logrus.Hook) (Logger, error) {
+	return nil, fmt.Errorf("the slog log backend needs ravel built with go 1.21 or later")
+}
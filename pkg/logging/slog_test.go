@@ -0,0 +1,49 @@
+//go:build go1.21
+// +build go1.21
+
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSlog(t *testing.T) {
+	var buf bytes.Buffer
+	levels, _ := ParseLevels("info")
+	hook := &recordHook{}
+	l, err := NewSlog("json", &buf, levels, hook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = l.WithFields(Fields{FieldNode: "lb01", FieldConfigKey: "green"})
+
+	l.Debug("hidden")
+	l.WithField(FieldVIP, "10.0.0.1").Warnf("unable to add %s", "10.0.0.1")
+	for _, want := range []string{`"level":"WARN"`, `"msg":"unable to add 10.0.0.1"`, `"node":"lb01"`, `"configKey":"green"`, `"vip":"10.0.0.1"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("expected %s in %s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "hidden") {
+		t.Fatalf("expected debug to be dropped at info. saw %s", buf.String())
+	}
+	if len(hook.entries) != 1 || hook.entries[0].Level != logrus.WarnLevel || hook.entries[0].Data[FieldVIP] != "10.0.0.1" {
+		t.Fatalf("expected the warning to be fired to the hook. saw %+v", hook.entries)
+	}
+
+	// this test runs in the logging package
+	buf.Reset()
+	levels.Set("logging", logrus.DebugLevel)
+	l.Debug("shown")
+	if !strings.Contains(buf.String(), `"level":"DEBUG"`) {
+		t.Fatalf("expected debug to be logged after a package override. saw %s", buf.String())
+	}
+
+	if _, err := NewSlog("xml", &buf, levels); err == nil {
+		t.Fatal("expected an unknown format to be refused")
+	}
+}
@@ -0,0 +1,42 @@
+package logging
+
+// The package level functions log through Default, for the packages that
+// log without a Logger of their own.
+
+var std = Default()
+
+// WithField returns the default Logger with a field added.
+func WithField(key string, value interface{}) Logger { return std.WithField(key, value) }
+
+// WithFields returns the default Logger with fields added.
+func WithFields(fields Fields) Logger { return std.WithFields(fields) }
+
+// WithError returns the default Logger with an error field added.
+func WithError(err error) Logger { return std.WithError(err) }
+
+func Debugf(format string, args ...interface{})   { std.Debugf(format, args...) }
+func Infof(format string, args ...interface{})    { std.Infof(format, args...) }
+func Printf(format string, args ...interface{})   { std.Printf(format, args...) }
+func Warnf(format string, args ...interface{})    { std.Warnf(format, args...) }
+func Warningf(format string, args ...interface{}) { std.Warningf(format, args...) }
+func Errorf(format string, args ...interface{})   { std.Errorf(format, args...) }
+func Fatalf(format string, args ...interface{})   { std.Fatalf(format, args...) }
+func Panicf(format string, args ...interface{})   { std.Panicf(format, args...) }
+
+func Debug(args ...interface{})   { std.Debug(args...) }
+func Info(args ...interface{})    { std.Info(args...) }
+func Print(args ...interface{})   { std.Print(args...) }
+func Warn(args ...interface{})    { std.Warn(args...) }
+func Warning(args ...interface{}) { std.Warning(args...) }
+func Error(args ...interface{})   { std.Error(args...) }
+func Fatal(args ...interface{})   { std.Fatal(args...) }
+func Panic(args ...interface{})   { std.Panic(args...) }
+
+func Debugln(args ...interface{})   { std.Debugln(args...) }
+func Infoln(args ...interface{})    { std.Infoln(args...) }
+func Println(args ...interface{})   { std.Println(args...) }
+func Warnln(args ...interface{})    { std.Warnln(args...) }
+func Warningln(args ...interface{}) { std.Warningln(args...) }
+func Errorln(args ...interface{})   { std.Errorln(args...) }
+func Fatalln(args ...interface{})   { std.Fatalln(args...) }
+func Panicln(args ...interface{})   { std.Panicln(args...) }
@@ -0,0 +1,249 @@
+package logging
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Syslog messages are formatted per RFC 5424. Over TCP and TLS they are
+// framed with octet counting, RFC 6587, so messages may contain newlines.
+
+const (
+	// DefaultSyslogSocket is where the local syslog daemon listens.
+	DefaultSyslogSocket = "/dev/log"
+
+	// DefaultSDID is the structured data id the node name and config key
+	// are sent under. 32473 is the enterprise number reserved for examples
+	// by RFC 5612; sites with their own should use it instead.
+	DefaultSDID = "ravel@32473"
+
+	syslogTimeout = 5 * time.Second
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// SyslogConfig describes a syslog destination.
+type SyslogConfig struct {
+	// Address is local for the local syslog daemon, or one of unix:<path>,
+	// tcp:<host>:<port> and tls:<host>:<port>.
+	Address string
+	// CAFile verifies the server for tls. The system roots are used when it
+	// is empty.
+	CAFile string
+	// Facility is a facility name such as daemon or local0.
+	Facility string
+	// SDID names the structured data element.
+	SDID string
+	// NodeName and ConfigKey are sent as structured data with every message.
+	NodeName  string
+	ConfigKey string
+}
+
+// SyslogHook sends log entries to syslog.
+type SyslogHook struct {
+	*asyncWriter
+	facility int
+	hostname string
+	pid      string
+	sd       string // the fixed part of the structured data element
+	sdid     string
+}
+
+// NewSyslogHook returns a hook sending to the destination described by c.
+// The connection is made when the first entry is logged.
+func NewSyslogHook(c SyslogConfig) (*SyslogHook, error) {
+	facility, ok := syslogFacilities[c.Facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", c.Facility)
+	}
+	if c.SDID == "" {
+		c.SDID = DefaultSDID
+	}
+	if !validSDName(c.SDID) {
+		return nil, fmt.Errorf("invalid syslog structured data id %q", c.SDID)
+	}
+	dial, err := syslogDialer(c)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	return &SyslogHook{
+		asyncWriter: newAsyncWriter(dial),
+		facility:    facility,
+		hostname:    hostname,
+		pid:         strconv.Itoa(os.Getpid()),
+		sd:          fmt.Sprintf(` node="%s" configKey="%s"`, escapeSDValue(c.NodeName), escapeSDValue(c.ConfigKey)),
+		sdid:        c.SDID,
+	}, nil
+}
+
+func (h *SyslogHook) Levels() []logrus.Level { return allLevels }
+
+func (h *SyslogHook) Fire(entry *logrus.Entry) error {
+	h.send(h.format(entry))
+	return nil
+}
+
+// format renders an entry as an RFC 5424 message:
+//
+//	<27>1 2021-06-01T12:00:00.000000Z lb01 ravel 1234 - [ravel@32473 node="lb01" configKey="green" error="x"] unable to set rules
+func (h *SyslogHook) format(entry *logrus.Entry) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s ravel %s - [%s%s",
+		h.facility*8+syslogSeverity(entry.Level),
+		entry.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		h.hostname, h.pid, h.sdid, h.sd)
+
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := sdName(k)
+		// the node name and config key are in the fixed part
+		if name == "" || k == FieldNode || k == FieldConfigKey {
+			continue
+		}
+		fmt.Fprintf(&b, ` %s="%s"`, name, escapeSDValue(fmt.Sprint(entry.Data[k])))
+	}
+	b.WriteString("] ")
+	b.WriteString(strings.TrimRight(entry.Message, "\n"))
+	return b.Bytes()
+}
+
+func syslogSeverity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel:
+		return 0 // emerg
+	case logrus.FatalLevel:
+		return 2 // crit
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	}
+	return 7 // debug
+}
+
+// syslogDialer returns a function connecting to the destination, wrapping
+// stream connections with octet-counting framing.
+func syslogDialer(c SyslogConfig) (func() (io.WriteCloser, error), error) {
+	switch {
+	case c.Address == "local":
+		return unixDialer(DefaultSyslogSocket), nil
+	case strings.HasPrefix(c.Address, "unix:"):
+		return unixDialer(strings.TrimPrefix(c.Address, "unix:")), nil
+	case strings.HasPrefix(c.Address, "tcp:"):
+		addr := strings.TrimPrefix(c.Address, "tcp:")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid syslog address %q: %v", c.Address, err)
+		}
+		return func() (io.WriteCloser, error) {
+			conn, err := net.DialTimeout("tcp", addr, syslogTimeout)
+			if err != nil {
+				return nil, err
+			}
+			return octetCounted{conn}, nil
+		}, nil
+	case strings.HasPrefix(c.Address, "tls:"):
+		addr := strings.TrimPrefix(c.Address, "tls:")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid syslog address %q: %v", c.Address, err)
+		}
+		tlsConfig := &tls.Config{ServerName: host}
+		if c.CAFile != "" {
+			pem, err := ioutil.ReadFile(c.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read syslog ca file: %v", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in syslog ca file %s", c.CAFile)
+			}
+		}
+		return func() (io.WriteCloser, error) {
+			conn, err := tls.DialWithDialer(&net.Dialer{Timeout: syslogTimeout}, "tcp", addr, tlsConfig)
+			if err != nil {
+				return nil, err
+			}
+			return octetCounted{conn}, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid syslog address %q. must be local, unix:<path>, tcp:<host>:<port> or tls:<host>:<port>", c.Address)
+}
+
+// unixDialer connects to a local syslog socket, which is a datagram socket
+// on most systems and a stream socket on some.
+func unixDialer(path string) func() (io.WriteCloser, error) {
+	return func() (io.WriteCloser, error) {
+		conn, err := net.Dial("unixgram", path)
+		if err == nil {
+			return conn, nil
+		}
+		conn, streamErr := net.Dial("unix", path)
+		if streamErr != nil {
+			return nil, err
+		}
+		return octetCounted{conn}, nil
+	}
+}
+
+// octetCounted frames each message with its length.
+type octetCounted struct {
+	net.Conn
+}
+
+func (c octetCounted) Write(msg []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	return c.Conn.Write(append([]byte(strconv.Itoa(len(msg))+" "), msg...))
+}
+
+// escapeSDValue escapes the characters RFC 5424 reserves in param values.
+func escapeSDValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
+
+// sdName turns a log field name into a valid param name, or returns "" if
+// nothing is left of it.
+func sdName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, s)
+	if len(s) > 32 {
+		s = s[:32]
+	}
+	return s
+}
+
+// validSDName reports whether s is a valid SD-NAME.
+func validSDName(s string) bool {
+	return s != "" && sdName(s) == s
+}
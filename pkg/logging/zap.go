@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// zapLevels are the zap levels of those of logrus. zap has no trace level,
+// so trace entries are logged at debug.
+var zapLevels = map[logrus.Level]zapcore.Level{
+	logrus.PanicLevel: zapcore.PanicLevel,
+	logrus.FatalLevel: zapcore.FatalLevel,
+	logrus.ErrorLevel: zapcore.ErrorLevel,
+	logrus.WarnLevel:  zapcore.WarnLevel,
+	logrus.InfoLevel:  zapcore.InfoLevel,
+	logrus.DebugLevel: zapcore.DebugLevel,
+	logrus.TraceLevel: zapcore.DebugLevel,
+}
+
+// NewZap returns a Logger writing to out with a zap encoder for format, text
+// or json, at the levels of levels. Entries are also fired to hooks, such as
+// the syslog and journald sinks.
+func NewZap(format string, out io.Writer, levels *Levels, hooks ...logrus.Hook) (Logger, error) {
+	config := zap.NewProductionEncoderConfig()
+	config.TimeKey = "time"
+	config.EncodeTime = zapcore.RFC3339TimeEncoder
+	config.EncodeLevel = zapcore.CapitalLevelEncoder
+
+	var encoder zapcore.Encoder
+	switch format {
+	case "text", "":
+		encoder = zapcore.NewConsoleEncoder(config)
+	case "json":
+		encoder = zapcore.NewJSONEncoder(config)
+	default:
+		return nil, fmt.Errorf("unknown log format %q. must be one of text|json", format)
+	}
+	// levels filters, by package
+	c := zapcore.NewCore(encoder, zapcore.AddSync(out), zapcore.DebugLevel)
+	return logger{core: zapCore{core: c, levels: levels, hooks: hooks, fields: Fields{}}}, nil
+}
+
+// zapCore writes to a zap core.
+type zapCore struct {
+	core   zapcore.Core
+	levels *Levels
+	// hooks are fired with fields, the fields of the core
+	hooks  []logrus.Hook
+	fields Fields
+}
+
+func (c zapCore) enabled(level logrus.Level) bool {
+	return c.levels.enabled(level)
+}
+
+func (c zapCore) log(level logrus.Level, msg string) {
+	now := time.Now()
+	if len(c.hooks) > 0 {
+		entry := &logrus.Entry{Time: now, Level: level, Message: msg, Data: make(logrus.Fields, len(c.fields))}
+		for k, v := range c.fields {
+			entry.Data[k] = v
+		}
+		fireHooks(c.hooks, entry)
+	}
+	c.core.Write(zapcore.Entry{Level: zapLevels[level], Time: now, Message: msg}, nil)
+}
+
+func (c zapCore) with(fields Fields) core {
+	zfields := make([]zapcore.Field, 0, len(fields))
+	for _, k := range sortedKeys(fields) {
+		zfields = append(zfields, zap.Any(k, fields[k]))
+	}
+	out := zapCore{core: c.core.With(zfields), levels: c.levels, hooks: c.hooks, fields: c.fields}
+	if len(c.hooks) > 0 {
+		out.fields = make(Fields, len(c.fields)+len(fields))
+		for k, v := range c.fields {
+			out.fields[k] = v
+		}
+		for k, v := range fields {
+			out.fields[k] = v
+		}
+	}
+	return out
+}
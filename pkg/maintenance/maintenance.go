@@ -0,0 +1,178 @@
+package maintenance
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// An operator drains a node out of service by setting the
+// types.AnnotationMaintenance annotation on it, to the reason for the
+// maintenance, with `ravel maintenance enter`. Directors keep the node as a
+// backend with a weight of 0, so that its connections finish but it gets no
+// new ones. The processes on the node follow the annotation themselves: a
+// vrrp director steps down and stays backup, any other director withdraws
+// its VIPs or routes, and a realserver hands the node back and won't take it
+// over. They take traffic again once `ravel maintenance exit` removes the
+// annotation.
+//
+// The annotation lives on the node, so it outlasts the processes on it, and a
+// process that starts on a node in maintenance stays out of service.
+
+var maintenanceDef = stats.Define(stats.Definition{
+	Type:   stats.Gauge,
+	Name:   "node_maintenance",
+	Help:   "is 1 while the node of the process is in maintenance, and 0 otherwise",
+	Labels: []string{"lb", "seczone"},
+})
+
+// Monitor follows the maintenance annotation of a node.
+type Monitor struct {
+	sync.Mutex
+	nodes func() []*v1.Node
+	node  string
+
+	synced   bool
+	active   bool
+	reason   string
+	since    time.Time
+	handlers []func(active bool)
+
+	gauge  prometheus.Gauge
+	logger logging.Logger
+}
+
+// New returns the monitor of node, which nodes lists, for the process of lb
+// kind and config key.
+func New(nodes func() []*v1.Node, node string, kind stats.LBKind, configKey string, logger logging.Logger) *Monitor {
+	return &Monitor{
+		nodes:  nodes,
+		node:   node,
+		gauge:  maintenanceDef.GaugeVec().WithLabelValues(string(kind), configKey),
+		logger: logger.WithFields(logging.Fields{"module": "maintenance"}),
+	}
+}
+
+// OnChange has handle called with whether the node is in maintenance, once
+// the node is first found and then each time that changes. Handlers are
+// called in order, from the goroutine of Run.
+func (m *Monitor) OnChange(handle func(active bool)) {
+	m.Lock()
+	defer m.Unlock()
+	m.handlers = append(m.handlers, handle)
+}
+
+// Active reports whether the node is in maintenance.
+func (m *Monitor) Active() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.active
+}
+
+// Run checks the node every interval until ctx is done.
+func (m *Monitor) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		m.evaluate()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// evaluate reads the annotation of the node, and calls the handlers when it
+// changed. A node that isn't listed yet is left as it was.
+func (m *Monitor) evaluate() {
+	var node *v1.Node
+	for _, n := range m.nodes() {
+		if n.Name == m.node {
+			node = n
+			break
+		}
+	}
+	if node == nil {
+		return
+	}
+	reason, active := types.InMaintenance(node)
+
+	m.Lock()
+	if m.synced && active == m.active {
+		m.reason = reason
+		m.Unlock()
+		return
+	}
+	m.synced, m.active, m.reason = true, active, reason
+	m.since = time.Now()
+	handlers := append([]func(bool){}, m.handlers...)
+	m.Unlock()
+
+	if active {
+		m.logger.Warnf("maintenance: node %s is in maintenance, taking it out of service: %s", m.node, reason)
+		m.gauge.Set(1)
+	} else {
+		m.logger.Infof("maintenance: node %s is out of maintenance", m.node)
+		m.gauge.Set(0)
+	}
+	for _, handle := range handlers {
+		handle(active)
+	}
+}
+
+// Health reports whether the node is in maintenance. A node in maintenance
+// is as ready as one in service.
+func (m *Monitor) Health(context.Context) health.Status {
+	m.Lock()
+	defer m.Unlock()
+	switch {
+	case !m.synced:
+		return health.Status{Ready: true, Message: "not yet checked"}
+	case m.active:
+		return health.Status{Ready: true, Message: "in maintenance since " + m.since.Format(time.RFC3339) + ": " + m.reason}
+	}
+	return health.Status{Ready: true, Message: "in service"}
+}
+
+// Set puts node in maintenance for reason, or takes it out of maintenance
+// when reason is blank.
+func Set(ctx context.Context, client kubernetes.Interface, node, reason string) error {
+	// a merge patch with a null value removes the annotation
+	var annotation interface{}
+	if reason != "" {
+		annotation = reason
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{types.AnnotationMaintenance: annotation},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().Nodes().Patch(ctx, node, k8stypes.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// Get returns the reason node is in maintenance, and whether it is.
+func Get(ctx context.Context, client kubernetes.Interface, node string) (string, bool, error) {
+	n, err := client.CoreV1().Nodes().Get(ctx, node, metav1.GetOptions{})
+	if err != nil {
+		return "", false, err
+	}
+	reason, active := types.InMaintenance(n)
+	return reason, active, nil
+}
@@ -0,0 +1,68 @@
+package maintenance
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+func TestMonitor(t *testing.T) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}
+	nodes := []*v1.Node{}
+	m := New(func() []*v1.Node { return nodes }, "node-1", stats.KindIpvsBackend, "green", logging.New())
+	changes := []bool{}
+	m.OnChange(func(active bool) { changes = append(changes, active) })
+
+	// nothing is decided until the node is listed
+	m.evaluate()
+	if len(changes) != 0 {
+		t.Fatalf("expected no change before the node is listed, got %v", changes)
+	}
+	nodes = []*v1.Node{node}
+	m.evaluate()
+	m.evaluate()
+	if len(changes) != 1 || changes[0] || m.Active() {
+		t.Fatalf("expected the node to be found in service once, got %v", changes)
+	}
+
+	node.Annotations = map[string]string{"ravel.comcast.com/maintenance": "kernel upgrade"}
+	m.evaluate()
+	if len(changes) != 2 || !changes[1] || !m.Active() {
+		t.Fatalf("expected the node to go into maintenance, got %v", changes)
+	}
+	if status := m.Health(context.Background()); !status.Ready {
+		t.Fatalf("expected a node in maintenance to be ready, got %+v", status)
+	}
+
+	node.Annotations = nil
+	m.evaluate()
+	if len(changes) != 3 || changes[2] || m.Active() {
+		t.Fatalf("expected the node to come out of maintenance, got %v", changes)
+	}
+}
+
+func TestSet(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}})
+
+	if err := Set(ctx, client, "node-1", "kernel upgrade"); err != nil {
+		t.Fatal(err)
+	}
+	reason, active, err := Get(ctx, client, "node-1")
+	if err != nil || !active || reason != "kernel upgrade" {
+		t.Fatalf("expected the node in maintenance, got %q %v %v", reason, active, err)
+	}
+
+	if err := Set(ctx, client, "node-1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, active, err := Get(ctx, client, "node-1"); err != nil || active {
+		t.Fatalf("expected the node out of maintenance, got %v %v", active, err)
+	}
+}
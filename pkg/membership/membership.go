@@ -0,0 +1,322 @@
+package membership
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// In active-active mode every director of a config key announces the VIPs
+// over BGP, so that the routers upstream spread flows across them with ECMP,
+// and programs IPVS for itself. Nothing is elected: coordination only tracks
+// which directors are up. Each director holds a Lease in the config map's
+// namespace, named ravel-<config key>-<node> and labelled with the config
+// key, and renews it three times per TTL. A director whose lease runs out is
+// no longer a member, and one that stops deletes its lease on the way out.
+//
+// The members are exported as a metric and through the health endpoint, so
+// that the loss of a director shows up without looking at the routers. Flows
+// only keep their backend across a change of members if every director
+// picks the same one, which the mh scheduler does.
+
+const (
+	// LabelConfigKey holds the config key of a director's lease.
+	LabelConfigKey = "ravel.comcast.com/config-key"
+	// AnnotationAddress holds the address a director announces the VIPs
+	// from.
+	AnnotationAddress = "ravel.comcast.com/address"
+
+	// DefaultTTL is how long a lease lasts without being renewed.
+	DefaultTTL = 15 * time.Second
+)
+
+var membersDef = stats.Define(stats.Definition{
+	Type:   stats.Gauge,
+	Name:   "director_members",
+	Help:   "is the number of directors holding an unexpired lease for the config key, including this one",
+	Labels: []string{"lb", "seczone"},
+})
+
+// invalidName matches what kubernetes doesn't allow in names and labels.
+var invalidName = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// Member is a director of the config key.
+type Member struct {
+	Node    string    `json:"node"`
+	Address string    `json:"address,omitempty"`
+	Renewed time.Time `json:"renewed"`
+	Expires time.Time `json:"expires"`
+}
+
+// store keeps the leases of the members.
+type store interface {
+	renew(ctx context.Context, m Member) error
+	list(ctx context.Context) ([]Member, error)
+	remove(ctx context.Context, node string) error
+}
+
+// Membership holds this director's lease and follows the others.
+type Membership struct {
+	sync.Mutex
+	self  Member
+	ttl   time.Duration
+	store store
+
+	members []Member
+	renewed time.Time
+	err     error
+
+	configKey string
+	gauge     prometheus.Gauge
+	logger    logging.Logger
+}
+
+// New returns the membership of a director on node, which announces the VIPs
+// of configKey from address. Leases are kept in namespace.
+func New(client kubernetes.Interface, namespace, configKey, node, address string, ttl time.Duration, kind stats.LBKind, logger logging.Logger) (*Membership, error) {
+	if ttl < 3*time.Second {
+		return nil, fmt.Errorf("membership ttl must be at least 3s")
+	}
+	leases := &leaseStore{client: client, namespace: namespace, configKey: configKey}
+	return newMembership(leases, configKey, node, address, ttl, kind, logger), nil
+}
+
+func newMembership(s store, configKey, node, address string, ttl time.Duration, kind stats.LBKind, logger logging.Logger) *Membership {
+	return &Membership{
+		self:      Member{Node: node, Address: address},
+		ttl:       ttl,
+		store:     s,
+		configKey: configKey,
+		gauge:     membersDef.GaugeVec().WithLabelValues(string(kind), configKey),
+		logger:    logger.WithFields(logging.Fields{"module": "membership"}),
+	}
+}
+
+// Run renews the lease and follows the members until ctx is done, then
+// gives the lease up.
+func (m *Membership) Run(ctx context.Context) {
+	t := time.NewTicker(m.ttl / 3)
+	defer t.Stop()
+	for {
+		m.refresh(ctx)
+		select {
+		case <-ctx.Done():
+			m.leave()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// refresh renews the lease and reads the members.
+func (m *Membership) refresh(ctx context.Context) {
+	now := time.Now()
+	self := m.self
+	self.Renewed, self.Expires = now, now.Add(m.ttl)
+	if err := m.store.renew(ctx, self); err != nil {
+		m.Lock()
+		m.err = fmt.Errorf("unable to renew lease. %v", err)
+		m.Unlock()
+		m.logger.Errorf("unable to renew membership of config key %s. %v", m.configKey, err)
+		return
+	}
+	all, err := m.store.list(ctx)
+	if err != nil {
+		m.Lock()
+		m.err = fmt.Errorf("unable to list members. %v", err)
+		m.Unlock()
+		m.logger.Errorf("unable to list the directors of config key %s. %v", m.configKey, err)
+		return
+	}
+
+	members := []Member{}
+	for _, member := range all {
+		if member.Node == self.Node || now.Before(member.Expires) {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Node < members[j].Node })
+
+	m.Lock()
+	joined, left := diff(m.members, members)
+	m.members = members
+	m.renewed = now
+	m.err = nil
+	m.Unlock()
+
+	for _, node := range joined {
+		m.logger.Infof("director %s joined config key %s", node, m.configKey)
+	}
+	for _, node := range left {
+		m.logger.Infof("director %s left config key %s", node, m.configKey)
+	}
+	m.gauge.Set(float64(len(members)))
+}
+
+// leave deletes the lease, so that the others see the director go at once.
+func (m *Membership) leave() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.store.remove(ctx, m.self.Node); err != nil {
+		m.logger.Warnf("unable to give up membership of config key %s. %v", m.configKey, err)
+	}
+	m.gauge.Set(0)
+}
+
+// Members returns the directors of the config key, including this one, by
+// node name.
+func (m *Membership) Members() []Member {
+	m.Lock()
+	defer m.Unlock()
+	return append([]Member{}, m.members...)
+}
+
+// Health reports whether the lease is being renewed. It lists the members
+// either way.
+func (m *Membership) Health(context.Context) health.Status {
+	m.Lock()
+	defer m.Unlock()
+	status := health.Status{Ready: true, Detail: append([]Member{}, m.members...)}
+	switch {
+	case m.renewed.IsZero() && m.err == nil:
+		status.Ready = false
+		status.Message = "lease not yet held"
+	case m.err != nil && time.Since(m.renewed) >= m.ttl:
+		status.Ready = false
+		status.Message = m.err.Error()
+	default:
+		status.Message = fmt.Sprintf("%d directors", len(m.members))
+	}
+	return status
+}
+
+// diff returns the nodes in b but not in a, and in a but not in b.
+func diff(a, b []Member) (added, removed []string) {
+	in := func(members []Member, node string) bool {
+		for _, m := range members {
+			if m.Node == node {
+				return true
+			}
+		}
+		return false
+	}
+	for _, m := range b {
+		if !in(a, m.Node) {
+			added = append(added, m.Node)
+		}
+	}
+	for _, m := range a {
+		if !in(b, m.Node) {
+			removed = append(removed, m.Node)
+		}
+	}
+	return added, removed
+}
+
+// leaseName returns the name of a director's lease.
+func leaseName(configKey, node string) string {
+	name := "ravel-" + invalidName.ReplaceAllString(strings.ToLower(configKey+"-"+node), "-")
+	if len(name) > 253 {
+		name = name[:253]
+	}
+	return strings.Trim(name, "-.")
+}
+
+// labelValue returns configKey as a label value.
+func labelValue(configKey string) string {
+	value := invalidName.ReplaceAllString(strings.ToLower(configKey), "-")
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return strings.Trim(value, "-.")
+}
+
+// leaseStore keeps the members as coordination.k8s.io Leases.
+type leaseStore struct {
+	client    kubernetes.Interface
+	namespace string
+	configKey string
+}
+
+func (s *leaseStore) renew(ctx context.Context, m Member) error {
+	leases := s.client.CoordinationV1().Leases(s.namespace)
+	seconds := int32(m.Expires.Sub(m.Renewed) / time.Second)
+	renewed := metav1.NewMicroTime(m.Renewed)
+
+	lease, err := leases.Get(ctx, leaseName(s.configKey, m.Node), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        leaseName(s.configKey, m.Node),
+				Namespace:   s.namespace,
+				Labels:      map[string]string{LabelConfigKey: labelValue(s.configKey)},
+				Annotations: map[string]string{AnnotationAddress: m.Address},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &m.Node,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &renewed,
+				RenewTime:            &renewed,
+			},
+		}
+		_, err = leases.Create(ctx, lease, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if lease.Annotations == nil {
+		lease.Annotations = map[string]string{}
+	}
+	lease.Annotations[AnnotationAddress] = m.Address
+	lease.Spec.HolderIdentity = &m.Node
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.RenewTime = &renewed
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+func (s *leaseStore) list(ctx context.Context) ([]Member, error) {
+	list, err := s.client.CoordinationV1().Leases(s.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: LabelConfigKey + "=" + labelValue(s.configKey),
+	})
+	if err != nil {
+		return nil, err
+	}
+	members := []Member{}
+	for _, lease := range list.Items {
+		if lease.Spec.HolderIdentity == nil || lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		renewed := lease.Spec.RenewTime.Time
+		members = append(members, Member{
+			Node:    *lease.Spec.HolderIdentity,
+			Address: lease.Annotations[AnnotationAddress],
+			Renewed: renewed,
+			Expires: renewed.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second),
+		})
+	}
+	return members, nil
+}
+
+func (s *leaseStore) remove(ctx context.Context, node string) error {
+	err := s.client.CoordinationV1().Leases(s.namespace).Delete(ctx, leaseName(s.configKey, node), metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
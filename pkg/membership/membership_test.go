@@ -0,0 +1,111 @@
+package membership
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+type fakeStore struct {
+	sync.Mutex
+	leases map[string]Member
+	err    error
+}
+
+func (s *fakeStore) renew(_ context.Context, m Member) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.leases[m.Node] = m
+	return nil
+}
+
+func (s *fakeStore) list(context.Context) ([]Member, error) {
+	s.Lock()
+	defer s.Unlock()
+	out := []Member{}
+	for _, m := range s.leases {
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+func (s *fakeStore) remove(_ context.Context, node string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.leases, node)
+	return nil
+}
+
+func nodes(members []Member) []string {
+	out := []string{}
+	for _, m := range members {
+		out = append(out, m.Node)
+	}
+	return out
+}
+
+func TestMembership(t *testing.T) {
+	now := time.Now()
+	store := &fakeStore{leases: map[string]Member{
+		"node-c":   {Node: "node-c", Renewed: now, Expires: now.Add(time.Minute)},
+		"node-old": {Node: "node-old", Renewed: now.Add(-time.Minute), Expires: now.Add(-time.Second)},
+	}}
+	m := newMembership(store, "key", "node-a", "10.0.0.1", 3*time.Second, stats.KindBGPDirector, logging.New())
+
+	if status := m.Health(context.Background()); status.Ready {
+		t.Fatalf("expected not ready before the lease is held, got %+v", status)
+	}
+
+	m.refresh(context.Background())
+	if got := nodes(m.Members()); len(got) != 2 || got[0] != "node-a" || got[1] != "node-c" {
+		t.Fatalf("expected node-a and node-c, the expired lease left out. got %v", got)
+	}
+	if lease := store.leases["node-a"]; lease.Address != "10.0.0.1" || lease.Expires.Sub(lease.Renewed) != 3*time.Second {
+		t.Fatalf("unexpected lease %+v", lease)
+	}
+	if status := m.Health(context.Background()); !status.Ready {
+		t.Fatalf("expected ready, got %+v", status)
+	}
+
+	// a failed renewal leaves the members as they were, and only turns
+	// unhealthy once the lease could have run out
+	store.err = errors.New("forbidden")
+	m.refresh(context.Background())
+	if status := m.Health(context.Background()); !status.Ready {
+		t.Fatalf("expected ready within the ttl, got %+v", status)
+	}
+	m.renewed = time.Now().Add(-4 * time.Second)
+	if status := m.Health(context.Background()); status.Ready || status.Message == "" {
+		t.Fatalf("expected not ready past the ttl, got %+v", status)
+	}
+	store.err = nil
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+	cancel()
+	<-done
+	if _, found := store.leases["node-a"]; found {
+		t.Fatalf("expected the lease to be given up on stop")
+	}
+}
+
+func TestLeaseName(t *testing.T) {
+	if got := leaseName("Haproxy_4", "10.0.0.1"); got != "ravel-haproxy-4-10.0.0.1" {
+		t.Fatalf("unexpected lease name %q", got)
+	}
+	if got := labelValue("Haproxy_4"); got != "haproxy-4" {
+		t.Fatalf("unexpected label value %q", got)
+	}
+}
@@ -0,0 +1,144 @@
+package membership
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// With sharding, the active-active directors of a config key split the VIPs
+// between them rather than each announcing all of them. A VIP the cluster
+// config assigns to directors under shards is announced by those of them
+// that are members. Any other VIP, and one whose directors are all gone, is
+// announced by the replicas members that rank highest for it by rendezvous
+// hashing of node and VIP. Every director ranks the members the same way, so
+// they agree on the owners without talking to each other. When a director
+// leaves, each of its VIPs moves to the next in rank, and the rest stay where
+// they are; when one joins, it only takes the VIPs it ranks first for.
+//
+// Until the members are known, a director announces every VIP, as it would
+// without sharding.
+
+var shardDef = stats.Define(stats.Definition{
+	Type:   stats.Gauge,
+	Name:   "director_shard_vips",
+	Help:   "is the number of VIPs of the config key this director announces while sharding",
+	Labels: []string{"lb", "seczone", "family"},
+})
+
+// Sharder decides which VIPs a director announces.
+type Sharder struct {
+	sync.Mutex
+	self     string
+	replicas int
+	members  func() []Member
+
+	owned map[string]map[string]bool
+
+	gauge   *prometheus.GaugeVec
+	lb      string
+	seczone string
+	logger  logging.Logger
+}
+
+// NewSharder returns the sharder of the director on self, which announces
+// each VIP from replicas of the members that members returns.
+func NewSharder(self string, replicas int, members func() []Member, kind stats.LBKind, configKey string, logger logging.Logger) *Sharder {
+	return &Sharder{
+		self:     self,
+		replicas: replicas,
+		members:  members,
+		owned:    map[string]map[string]bool{},
+		gauge:    shardDef.GaugeVec(),
+		lb:       string(kind),
+		seczone:  configKey,
+		logger:   logger.WithFields(logging.Fields{"module": "shard"}),
+	}
+}
+
+// Shard returns the vips of family that this director announces, with the
+// directors that shards assigns VIPs to.
+func (s *Sharder) Shard(vips []string, shards map[types.ServiceIP][]string, family string) []string {
+	nodes := []string{}
+	for _, m := range s.members() {
+		nodes = append(nodes, m.Node)
+	}
+
+	owned := []string{}
+	for _, vip := range vips {
+		if len(nodes) == 0 || owns(s.self, vip, nodes, shards[types.ServiceIP(vip)], s.replicas) {
+			owned = append(owned, vip)
+		}
+	}
+
+	s.Lock()
+	previous := s.owned[family]
+	current := map[string]bool{}
+	for _, vip := range owned {
+		current[vip] = true
+		if previous != nil && !previous[vip] {
+			s.logger.Infof("shard: now announcing %s", vip)
+		}
+	}
+	for vip := range previous {
+		if !current[vip] {
+			s.logger.Infof("shard: no longer announcing %s", vip)
+		}
+	}
+	s.owned[family] = current
+	s.Unlock()
+
+	s.gauge.WithLabelValues(s.lb, s.seczone, family).Set(float64(len(owned)))
+	return owned
+}
+
+// owns reports whether self announces vip, of the members nodes, when the
+// cluster config assigns it to assigned.
+func owns(self, vip string, nodes, assigned []string, replicas int) bool {
+	present := []string{}
+	for _, node := range assigned {
+		for _, member := range nodes {
+			if node == member {
+				present = append(present, node)
+				break
+			}
+		}
+	}
+	if len(present) == 0 {
+		present = Owners(vip, nodes, replicas)
+	}
+	for _, node := range present {
+		if node == self {
+			return true
+		}
+	}
+	return false
+}
+
+// Owners returns the replicas of nodes that rank highest for vip, highest
+// first.
+func Owners(vip string, nodes []string, replicas int) []string {
+	ranked := append([]string{}, nodes...)
+	score := func(node string) uint64 {
+		sum := sha256.Sum256([]byte(node + "\x00" + vip))
+		return binary.BigEndian.Uint64(sum[:8])
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := score(ranked[i]), score(ranked[j])
+		if a != b {
+			return a > b
+		}
+		return ranked[i] < ranked[j]
+	})
+	if replicas < len(ranked) {
+		ranked = ranked[:replicas]
+	}
+	return ranked
+}
@@ -0,0 +1,88 @@
+package membership
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+func TestShard(t *testing.T) {
+	vips := []string{}
+	for i := 1; i <= 60; i++ {
+		vips = append(vips, fmt.Sprintf("10.0.0.%d", i))
+	}
+	members := []Member{{Node: "a"}, {Node: "b"}, {Node: "c"}}
+	list := func() []Member { return members }
+	sharders := map[string]*Sharder{}
+	for _, m := range members {
+		sharders[m.Node] = NewSharder(m.Node, 1, list, stats.KindBGPDirector, "green", logging.New())
+	}
+	shard := func() map[string]string {
+		owners := map[string]string{}
+		for _, m := range members {
+			for _, vip := range sharders[m.Node].Shard(vips, nil, stats.FamilyV4) {
+				if owner, ok := owners[vip]; ok {
+					t.Fatalf("expected one owner of %s, got %s and %s", vip, owner, m.Node)
+				}
+				owners[vip] = m.Node
+			}
+		}
+		if len(owners) != len(vips) {
+			t.Fatalf("expected every VIP to be announced, got %d of %d", len(owners), len(vips))
+		}
+		return owners
+	}
+
+	// every VIP has one owner, and each director carries some
+	before := shard()
+	count := map[string]int{}
+	for _, owner := range before {
+		count[owner]++
+	}
+	if len(count) != 3 {
+		t.Fatalf("expected the VIPs spread over the directors, got %v", count)
+	}
+
+	// a director leaving only moves its own VIPs
+	members = []Member{{Node: "a"}, {Node: "c"}}
+	after := shard()
+	for vip, owner := range before {
+		if owner != "b" && after[vip] != owner {
+			t.Fatalf("expected %s to stay on %s, moved to %s", vip, owner, after[vip])
+		}
+	}
+
+	// an explicit assignment wins while its director is a member, and
+	// falls back to hashing once it isn't
+	assigned := map[types.ServiceIP][]string{"10.0.0.1": {"c"}}
+	if owned := sharders["c"].Shard([]string{"10.0.0.1"}, assigned, stats.FamilyV4); len(owned) != 1 {
+		t.Fatalf("expected the assigned director to announce the VIP, got %v", owned)
+	}
+	if owned := sharders["a"].Shard([]string{"10.0.0.1"}, assigned, stats.FamilyV4); len(owned) != 0 {
+		t.Fatalf("expected only the assigned director to announce the VIP, got %v", owned)
+	}
+	assigned = map[types.ServiceIP][]string{"10.0.0.1": {"b"}}
+	owner := Owners("10.0.0.1", []string{"a", "c"}, 1)[0]
+	if owned := sharders[owner].Shard([]string{"10.0.0.1"}, assigned, stats.FamilyV4); len(owned) != 1 {
+		t.Fatalf("expected %s to take the VIP of a missing director, got %v", owner, owned)
+	}
+
+	// without members, a director announces everything
+	members = nil
+	if owned := sharders["a"].Shard(vips, nil, stats.FamilyV4); len(owned) != len(vips) {
+		t.Fatalf("expected every VIP before the members are known, got %d", len(owned))
+	}
+}
+
+func TestOwnersReplicas(t *testing.T) {
+	owners := Owners("10.0.0.1", []string{"a", "b", "c"}, 2)
+	if len(owners) != 2 || owners[0] == owners[1] {
+		t.Fatalf("expected two distinct owners, got %v", owners)
+	}
+	if all := Owners("10.0.0.1", []string{"c", "a", "b"}, 5); len(all) != 3 || all[0] != owners[0] || all[1] != owners[1] {
+		t.Fatalf("expected the ranking not to depend on the order of the members, got %v and %v", owners, all)
+	}
+}
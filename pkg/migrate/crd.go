@@ -0,0 +1,48 @@
+package migrate
+
+// CRD is the CustomResourceDefinition of RavelConfig, for applying before
+// the RavelConfigs converted from a configmap.
+const CRD = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: ravelconfigs.` + Group + `
+spec:
+  group: ` + Group + `
+  names:
+    kind: ` + Kind + `
+    listKind: ` + Kind + `List
+    plural: ravelconfigs
+    singular: ravelconfig
+  scope: Namespaced
+  versions:
+  - name: ` + Version + `
+    served: true
+    storage: true
+    additionalPrinterColumns:
+    - name: Config-Key
+      type: string
+      jsonPath: .spec.configKey
+    - name: Age
+      type: date
+      jsonPath: .metadata.creationTimestamp
+    schema:
+      openAPIV3Schema:
+        type: object
+        required:
+        - spec
+        properties:
+          spec:
+            type: object
+            required:
+            - configKey
+            - clusterConfig
+            properties:
+              configKey:
+                description: the config key ravel is started with as --config-key, and that other configs name as their base
+                type: string
+                minLength: 1
+              clusterConfig:
+                description: the cluster config of the key, as the JSON of a configmap key
+                type: object
+                x-kubernetes-preserve-unknown-fields: true
+`
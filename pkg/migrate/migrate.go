@@ -0,0 +1,217 @@
+// Package migrate converts the cluster configs of a configmap into
+// RavelConfig objects, one for each key, and RavelConfig objects back into a
+// configmap, so that a cluster can move its configs to the CRD and back
+// without rewriting them.
+//
+// A RavelConfig holds the cluster config of a key as the configmap has it,
+// with its base and defaults kept rather than applied, so that converting it
+// back gives the same config. A config given as YAML is kept as the JSON it
+// converts to. Every config is validated as ravel validate does on the way,
+// with the other configs converted with it as its bases.
+package migrate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/validate"
+)
+
+// The group, version and kind of a RavelConfig.
+const (
+	Group      = "ravel.comcast.com"
+	Version    = "v1alpha1"
+	Kind       = "RavelConfig"
+	APIVersion = Group + "/" + Version
+)
+
+// LabelConfigMap names the configmap a RavelConfig was converted from.
+const LabelConfigMap = Group + "/configmap"
+
+// RavelConfig is the cluster config of a config key.
+type RavelConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec RavelConfigSpec `json:"spec"`
+}
+
+// RavelConfigSpec is a config key and its cluster config.
+type RavelConfigSpec struct {
+	// ConfigKey is the key of the config, which ravel is started with as
+	// --config-key, and which other configs name as their base.
+	ConfigKey string `json:"configKey"`
+	// ClusterConfig is the cluster config of the key, as the configmap has
+	// it.
+	ClusterConfig json.RawMessage `json:"clusterConfig"`
+}
+
+// Problem is a problem of the cluster config of a key.
+type Problem struct {
+	Key     string `json:"key"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	return p.Key + ": " + validate.Problem{Path: p.Path, Message: p.Message}.String()
+}
+
+// ToRavelConfigs returns a RavelConfig for each of keys of cm, or of every
+// key if there are none, in the order of the keys, and the problems of
+// their cluster configs.
+func ToRavelConfigs(cm *v1.ConfigMap, keys []string) ([]*RavelConfig, []Problem, error) {
+	if len(keys) == 0 {
+		for key := range cm.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+
+	configs := []*RavelConfig{}
+	names := map[string]string{}
+	problems := []Problem{}
+	for _, key := range keys {
+		raw, ok := cm.Data[key]
+		if !ok {
+			return nil, nil, fmt.Errorf("config key '%s' not found in configmap %s", key, cm.Name)
+		}
+		b, err := types.ConfigJSON(key, raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		compact := &bytes.Buffer{}
+		if err := json.Compact(compact, b); err != nil {
+			return nil, nil, err
+		}
+
+		name := ObjectName(cm.Name, key)
+		if other, ok := names[name]; ok {
+			return nil, nil, fmt.Errorf("config keys '%s' and '%s' would both be RavelConfig %s", other, key, name)
+		}
+		names[name] = key
+
+		configs = append(configs, &RavelConfig{
+			TypeMeta: metav1.TypeMeta{APIVersion: APIVersion, Kind: Kind},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: cm.Namespace,
+				Labels:    map[string]string{LabelConfigMap: cm.Name},
+			},
+			Spec: RavelConfigSpec{ConfigKey: key, ClusterConfig: compact.Bytes()},
+		})
+		problems = append(problems, check(cm.Data, key)...)
+	}
+	return configs, problems, nil
+}
+
+// ToConfigMap returns the configmap name in namespace with the cluster
+// config of each of configs, and the problems of the configs.
+func ToConfigMap(configs []*RavelConfig, name, namespace string) (*v1.ConfigMap, []Problem, error) {
+	data := map[string]string{}
+	for _, c := range configs {
+		if c.Kind != Kind || c.APIVersion != APIVersion {
+			return nil, nil, fmt.Errorf("%s %s is not a %s of %s", c.Kind, c.Name, Kind, APIVersion)
+		}
+		key := c.Spec.ConfigKey
+		if key == "" {
+			return nil, nil, fmt.Errorf("RavelConfig %s has no configKey", c.Name)
+		}
+		if _, ok := data[key]; ok {
+			return nil, nil, fmt.Errorf("config key '%s' is given by more than one RavelConfig", key)
+		}
+		indented := &bytes.Buffer{}
+		if err := json.Indent(indented, c.Spec.ClusterConfig, "", "    "); err != nil {
+			return nil, nil, fmt.Errorf("RavelConfig %s has an invalid clusterConfig. %v", c.Name, err)
+		}
+		data[key] = indented.String()
+	}
+
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	problems := []Problem{}
+	for _, key := range keys {
+		problems = append(problems, check(data, key)...)
+	}
+
+	cm := &v1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Data:       data,
+	}
+	return cm, problems, nil
+}
+
+// Read reads RavelConfigs from r, a stream of YAML or JSON documents, each a
+// RavelConfig or a list of them, as kubectl get -o prints.
+func Read(r io.Reader) ([]*RavelConfig, error) {
+	configs := []*RavelConfig{}
+	dec := yaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var doc json.RawMessage
+		if err := dec.Decode(&doc); err == io.EOF {
+			return configs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(doc) == 0 || string(doc) == "null" {
+			continue
+		}
+		var list struct {
+			Kind  string            `json:"kind"`
+			Items []json.RawMessage `json:"items"`
+		}
+		if err := json.Unmarshal(doc, &list); err != nil {
+			return nil, err
+		}
+		items := []json.RawMessage{doc}
+		if strings.HasSuffix(list.Kind, "List") {
+			items = list.Items
+		}
+		for _, item := range items {
+			c := &RavelConfig{}
+			if err := json.Unmarshal(item, c); err != nil {
+				return nil, err
+			}
+			configs = append(configs, c)
+		}
+	}
+}
+
+// check validates the config of key in data.
+func check(data map[string]string, key string) []Problem {
+	_, found := validate.Key(data, key)
+	problems := make([]Problem, len(found))
+	for ix, p := range found {
+		problems[ix] = Problem{Key: key, Path: p.Path, Message: p.Message}
+	}
+	return problems
+}
+
+// invalidName matches what a kubernetes object name can't have.
+var invalidName = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// ObjectName returns the name of the RavelConfig of key of the configmap
+// configMap: the two joined and lowercased, with anything a name can't have
+// replaced by -.
+func ObjectName(configMap, key string) string {
+	name := invalidName.ReplaceAllString(strings.ToLower(configMap+"-"+key), "-")
+	name = strings.Trim(name, "-")
+	if len(name) > 253 {
+		name = strings.TrimRight(name[:253], "-")
+	}
+	return name
+}
@@ -0,0 +1,185 @@
+package migrate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func configMap(data map[string]string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "ravel-config", Namespace: "platform-load-balancer"},
+		Data:       data,
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	cm := configMap(map[string]string{
+		"Base_Config": `{"vipPool": ["10.0.0.1"], "config": {"10.0.0.1": {"80": {"namespace": "ns", "service": "web", "portName": "http"}}}}`,
+		"edge.yaml": `
+base: Base_Config
+config:
+  10.0.0.2:
+    "443": {namespace: ns, service: web, portName: https}
+`,
+	})
+	configs, problems, err := ToRavelConfigs(cm, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) > 0 {
+		t.Fatalf("expected no problems, got %v", problems)
+	}
+	names := []string{}
+	for _, c := range configs {
+		if c.APIVersion != APIVersion || c.Kind != Kind || c.Namespace != cm.Namespace || c.Labels[LabelConfigMap] != cm.Name {
+			t.Fatalf("unexpected object %+v", c.ObjectMeta)
+		}
+		names = append(names, c.Name+" "+c.Spec.ConfigKey)
+	}
+	expected := []string{"ravel-config-base-config Base_Config", "ravel-config-edge-yaml edge.yaml"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %q, got %q", expected, names)
+	}
+	// the base is kept, not applied
+	if got := string(configs[1].Spec.ClusterConfig); got != `{"base":"Base_Config","config":{"10.0.0.2":{"443":{"namespace":"ns","portName":"https","service":"web"}}}}` {
+		t.Fatalf("unexpected cluster config %s", got)
+	}
+
+	back, problems, err := ToConfigMap(configs, "other", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) > 0 {
+		t.Fatalf("expected no problems, got %v", problems)
+	}
+	if back.Name != "other" || back.Namespace != "default" || len(back.Data) != 2 {
+		t.Fatalf("unexpected configmap %+v", back)
+	}
+	again, _, err := ToRavelConfigs(back, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ix := range configs {
+		if string(again[ix].Spec.ClusterConfig) != string(configs[ix].Spec.ClusterConfig) {
+			t.Fatalf("expected %s, got %s", configs[ix].Spec.ClusterConfig, again[ix].Spec.ClusterConfig)
+		}
+	}
+}
+
+func TestProblems(t *testing.T) {
+	cm := configMap(map[string]string{
+		"a": `{"vipPool": ["10.0.0.300"]}`,
+		"b": `{"base": "missing"}`,
+	})
+	configs, problems, err := ToRavelConfigs(cm, []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 1 {
+		t.Fatalf("expected one config, got %d", len(configs))
+	}
+	expected := []string{`a: vipPool[0]: "10.0.0.300" is not an ip address`}
+	got := []string{}
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+
+	// a base not converted with the config is a problem of the configmap
+	configs, _, err = ToRavelConfigs(cm, []string{"b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, problems, err = ToConfigMap(configs, "ravel-config", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Key != "b" || problems[0].Path != "base" {
+		t.Fatalf("expected a problem with the base of b, got %v", problems)
+	}
+
+	if _, _, err := ToRavelConfigs(cm, []string{"c"}); err == nil {
+		t.Fatal("expected a missing key to fail")
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	// keys that are the same name
+	cm := configMap(map[string]string{"edge_a": `{}`, "edge.a": `{}`})
+	if _, _, err := ToRavelConfigs(cm, nil); err == nil || !strings.Contains(err.Error(), "would both be RavelConfig ravel-config-edge-a") {
+		t.Fatalf("expected the names to conflict, got %v", err)
+	}
+
+	configs := []*RavelConfig{
+		{Spec: RavelConfigSpec{ConfigKey: "a", ClusterConfig: []byte(`{}`)}},
+		{Spec: RavelConfigSpec{ConfigKey: "a", ClusterConfig: []byte(`{}`)}},
+	}
+	for _, c := range configs {
+		c.APIVersion, c.Kind = APIVersion, Kind
+	}
+	if _, _, err := ToConfigMap(configs, "ravel-config", "default"); err == nil {
+		t.Fatal("expected a key given twice to fail")
+	}
+	configs[1].Spec.ConfigKey = ""
+	if _, _, err := ToConfigMap(configs, "ravel-config", "default"); err == nil {
+		t.Fatal("expected a config without a key to fail")
+	}
+	configs[1].Spec.ConfigKey, configs[1].Kind = "b", "ConfigMap"
+	if _, _, err := ToConfigMap(configs, "ravel-config", "default"); err == nil {
+		t.Fatal("expected an object of another kind to fail")
+	}
+}
+
+func TestObjectName(t *testing.T) {
+	for _, tc := range []struct{ configMap, key, expected string }{
+		{"ravel-config", "Base_Config", "ravel-config-base-config"},
+		{"ravel-config", "v6.json", "ravel-config-v6-json"},
+		{"ravel-config", "x--", "ravel-config-x"},
+		{"ravel", strings.Repeat("a", 260), "ravel-" + strings.Repeat("a", 247)},
+	} {
+		if got := ObjectName(tc.configMap, tc.key); got != tc.expected {
+			t.Errorf("%s %s: expected %s, got %s", tc.configMap, tc.key, tc.expected, got)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	stream := `---
+apiVersion: ravel.comcast.com/v1alpha1
+kind: RavelConfig
+metadata: {name: a}
+spec: {configKey: a, clusterConfig: {vipPool: [10.0.0.1]}}
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: ravel.comcast.com/v1alpha1
+  kind: RavelConfig
+  metadata: {name: b}
+  spec: {configKey: b, clusterConfig: {}}
+- apiVersion: ravel.comcast.com/v1alpha1
+  kind: RavelConfig
+  metadata: {name: c}
+  spec: {configKey: c, clusterConfig: {}}
+`
+	configs, err := Read(strings.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, c := range configs {
+		keys = append(keys, c.Spec.ConfigKey)
+	}
+	if !reflect.DeepEqual(keys, []string{"a", "b", "c"}) {
+		t.Fatalf("unexpected keys %q", keys)
+	}
+	if got := string(configs[0].Spec.ClusterConfig); got != `{"vipPool":["10.0.0.1"]}` {
+		t.Fatalf("unexpected cluster config %s", got)
+	}
+}
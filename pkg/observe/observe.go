@@ -0,0 +1,68 @@
+package observe
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Comcast/Ravel/pkg/audit"
+	log "github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// An observe-only director runs every reconfigure as usual, checking parity
+// and working out the ipvs rules, addresses, iptables and bgp announcements
+// it wants, but leaves the node as it is. Each helper that would change the
+// node logs the change, counts it and records it in the audit trail as
+// observed instead of making it. Run beside the production director of a
+// node, a candidate version then reports exactly where it would have decided
+// differently, and reports nothing while it agrees.
+//
+// A dry run uses the same mode in any process, realservers included, to
+// rehearse a config change on a node.
+//
+// The mode is set once for the whole process at startup, like the audit
+// trail it records to.
+
+var changesDef = stats.Define(stats.Definition{
+	Type:   stats.Counter,
+	Name:   "observed_changes_total",
+	Help:   "is a count of the changes to the node an observe-only process would have made",
+	Labels: []string{"lb", "seczone", "subsystem", "action"},
+})
+
+var (
+	mu        sync.Mutex
+	enabled   bool
+	kind      stats.LBKind
+	configKey string
+	changes   *prometheus.CounterVec
+)
+
+// Enable makes the process observe only, for the lb kind and config key its
+// changes are counted under.
+func Enable(lbKind stats.LBKind, key string) {
+	mu.Lock()
+	defer mu.Unlock()
+	enabled, kind, configKey = true, lbKind, key
+	changes = changesDef.CounterVec()
+}
+
+// Enabled reports whether the process only observes.
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return enabled
+}
+
+// Would records a change to target that the process would have made.
+func Would(subsystem, action, target, detail string) {
+	mu.Lock()
+	c, lbKind, key := changes, kind, configKey
+	mu.Unlock()
+	log.Infof("observe: would %s %s %s %s", action, subsystem, target, detail)
+	if c != nil {
+		c.WithLabelValues(string(lbKind), key, subsystem, action).Inc()
+	}
+	audit.Observe(subsystem, action, target, detail)
+}
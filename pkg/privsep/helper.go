@@ -0,0 +1,247 @@
+package privsep
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+// DefaultSettings are the directories of the sysctls the helper writes:
+// those of ipvs, and the rp_filter and arp settings of the interfaces, also
+// mounted at /netconf in a container.
+var DefaultSettings = []string{"/proc/sys/net/ipv4/vs", "/proc/sys/net/ipv4/conf", "/netconf"}
+
+// Helper runs the commands and settings writes of an unprivileged ravel.
+type Helper struct {
+	// UID is the user allowed to connect, besides root.
+	UID int
+	// Commands are the commands the helper runs, by name. A command is run
+	// from the helper's own PATH by the base of the name it is asked for.
+	Commands map[string]Rule
+	// Settings are the directories of the files the helper writes.
+	Settings []string
+	Logger   logging.Logger
+}
+
+// Listen listens on a unix socket at path that only uid and root may
+// connect to, replacing any socket left there.
+func Listen(path string, uid int) (*net.UnixListener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Chown(path, uid, -1); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serve runs the requests of the connections to l until ctx is done.
+func (h *Helper) Serve(ctx context.Context, l *net.UnixListener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go h.handle(conn)
+	}
+}
+
+// handle runs the request of a connection.
+func (h *Helper) handle(conn *net.UnixConn) {
+	defer conn.Close()
+	f := &frameWriter{w: conn}
+	deny := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		h.Logger.Warnf("helper: denied. %s", msg)
+		f.send(frameError, []byte(msg))
+	}
+
+	uid, err := peerUID(conn)
+	if err != nil {
+		deny("unable to tell the user of the connection: %v", err)
+		return
+	}
+	if uid != 0 && uid != h.UID {
+		deny("user %d is not allowed to connect", uid)
+		return
+	}
+
+	kind, payload, err := readFrame(conn)
+	if err != nil {
+		return
+	}
+	req := request{}
+	if kind != frameRequest || json.Unmarshal(payload, &req) != nil {
+		deny("malformed request")
+		return
+	}
+
+	if req.Write != "" {
+		if !within(req.Write, h.Settings...) {
+			deny("writing %s is not allowed", req.Write)
+			return
+		}
+		h.Logger.Debugf("helper: writing %s to %s", req.Value, req.Write)
+		if err := writeSetting(req.Write, req.Value); err != nil {
+			f.send(frameError, []byte(err.Error()))
+			return
+		}
+		f.sendCode(0)
+		return
+	}
+
+	name := filepath.Base(req.Name)
+	rule, ok := h.Commands[name]
+	if !ok {
+		deny("command %s is not allowed", req.Name)
+		return
+	}
+	if rule.Check != nil {
+		if err := rule.Check(req.Args); err != nil {
+			deny("%s %v: %v", name, req.Args, err)
+			return
+		}
+	}
+	args := req.Args
+	if rule.Args != nil {
+		var err error
+		if args, err = rule.Args(req.Args); err != nil {
+			deny("%s %v: %v", name, req.Args, err)
+			return
+		}
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		f.send(frameError, []byte(err.Error()))
+		return
+	}
+	h.Logger.Debugf("helper: running %s %v", path, args)
+	h.run(conn, f, rule, exec.Command(path, args...))
+}
+
+// run runs cmd for the relay on conn, until it exits or the relay goes away.
+func (h *Helper) run(conn *net.UnixConn, f *frameWriter, rule Rule, cmd *exec.Cmd) {
+	cmd.Stdout = stream{f: f, kind: frameStdout}
+	cmd.Stderr = stream{f: f, kind: frameStderr}
+
+	// a command whose input is checked gets it all before it starts
+	var stdin io.WriteCloser
+	if rule.Stdin != nil {
+		in, err := readStdin(conn)
+		if err != nil {
+			f.send(frameError, []byte(err.Error()))
+			return
+		}
+		if err := rule.Stdin(in); err != nil {
+			h.Logger.Warnf("helper: denied. input of %s: %v", cmd.Path, err)
+			f.send(frameError, []byte(fmt.Sprintf("input of %s: %v", filepath.Base(cmd.Path), err)))
+			return
+		}
+		cmd.Stdin = bytes.NewReader(in)
+	} else {
+		var err error
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			f.send(frameError, []byte(err.Error()))
+			return
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		f.send(frameError, []byte(err.Error()))
+		return
+	}
+
+	go func() {
+		for {
+			kind, payload, err := readFrame(conn)
+			if err != nil {
+				// the relay is gone, and its command with it
+				cmd.Process.Kill()
+				return
+			}
+			switch {
+			case kind == frameStdin && stdin != nil && len(payload) == 0:
+				stdin.Close()
+			case kind == frameStdin && stdin != nil:
+				stdin.Write(payload)
+			case kind == frameSignal && len(payload) == 1:
+				cmd.Process.Signal(syscall.Signal(payload[0]))
+			}
+		}
+	}()
+
+	cmd.Wait()
+	code := cmd.ProcessState.ExitCode()
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		code = 128 + int(status.Signal())
+	}
+	f.sendCode(code)
+}
+
+// readStdin reads the stdin frames of conn up to the empty one ending them.
+func readStdin(conn net.Conn) ([]byte, error) {
+	in := bytes.Buffer{}
+	for {
+		kind, payload, err := readFrame(conn)
+		if err != nil {
+			return nil, err
+		}
+		if kind != frameStdin {
+			continue
+		}
+		if len(payload) == 0 {
+			return in.Bytes(), nil
+		}
+		if in.Len()+len(payload) > 64*maxFrame {
+			return nil, fmt.Errorf("input over %d bytes", 64*maxFrame)
+		}
+		in.Write(payload)
+	}
+}
+
+// peerUID returns the user of the process on the other end of conn.
+func peerUID(conn *net.UnixConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return int(cred.Uid), nil
+}
@@ -0,0 +1,119 @@
+// Package privsep runs the commands and settings writes that change the node
+// through a privileged helper, so that the watchers and the logic of ravel
+// can run as a user without root.
+//
+// The helper, ravel helper, runs as root and listens on a unix socket that
+// only the user ravel runs as may connect to. It runs nothing but the
+// commands ravel changes the node with: ip, ipvsadm, the iptables commands,
+// tc, ifconfig, arping and haproxy, each with its arguments checked, and
+// writes nothing but the ipvs and interface sysctls.
+//
+// A process that uses a helper still builds an *exec.Cmd for every command,
+// so that its callers keep their output, exit codes, stdin and signals. The
+// command it builds runs a relay in its place: ravel itself, run with
+// RelayArg, which passes the command to the helper and stands in for it,
+// forwarding stdin, stdout, stderr and signals, and exiting as it exits.
+// Killing the relay, as a cancelled context does, kills the command.
+package privsep
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// RelayArg is the first argument of a relay. ravel runs Relay with the
+// rest of its arguments when it is started with it.
+const RelayArg = "privsep-relay"
+
+// DefaultSocket is where the helper listens unless told otherwise.
+const DefaultSocket = "/var/run/ravel/helper.sock"
+
+// ExitDenied is the exit code of a relay whose command the helper refused,
+// or couldn't run.
+const ExitDenied = 126
+
+var (
+	mu     sync.Mutex
+	socket string
+	relay  string
+)
+
+// Use routes the commands and settings writes of the process through the
+// helper listening on path. It is set once at startup.
+func Use(path string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find the executable to relay commands with: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	socket, relay = path, exe
+	return nil
+}
+
+// Enabled reports whether the process uses a helper.
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return socket != ""
+}
+
+// CommandContext returns the *exec.Cmd that runs name with arg, through the
+// helper if the process uses one.
+func CommandContext(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	mu.Lock()
+	path, exe := socket, relay
+	mu.Unlock()
+	if path == "" {
+		return exec.CommandContext(ctx, name, arg...)
+	}
+	return exec.CommandContext(ctx, exe, append([]string{RelayArg, path, name}, arg...)...)
+}
+
+// Command is CommandContext without a context.
+func Command(name string, arg ...string) *exec.Cmd {
+	return CommandContext(context.Background(), name, arg...)
+}
+
+// WriteSetting writes value to the sysctl at path, through the helper if
+// the process uses one.
+func WriteSetting(path, value string) error {
+	mu.Lock()
+	s := socket
+	mu.Unlock()
+	if s == "" {
+		return writeSetting(path, value)
+	}
+	return remoteWrite(s, path, value)
+}
+
+// writeSetting writes value to the existing file at path.
+func writeSetting(path, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(value)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// within is whether path is clean, absolute and under one of dirs.
+func within(path string, dirs ...string) bool {
+	if !strings.HasPrefix(path, "/") || filepath.Clean(path) != path {
+		return false
+	}
+	for _, dir := range dirs {
+		if strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
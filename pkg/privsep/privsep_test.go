@@ -0,0 +1,202 @@
+package privsep
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+// serve starts a helper allowed to run commands and write the files of dir,
+// returning its socket.
+func serve(t *testing.T, dir string, commands map[string]Rule) string {
+	socket := filepath.Join(dir, "helper.sock")
+	l, err := Listen(socket, os.Getuid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	h := &Helper{UID: os.Getuid(), Commands: commands, Settings: []string{dir}, Logger: logging.New()}
+	go h.Serve(ctx, l)
+	return socket
+}
+
+func TestRelay(t *testing.T) {
+	commands := DefaultCommands("")
+	commands["cat"] = Rule{}
+	commands["false"] = Rule{}
+	commands["sleep"] = Rule{}
+	socket := serve(t, t.TempDir(), commands)
+
+	for _, test := range []struct {
+		name   string
+		args   []string
+		stdin  string
+		signal os.Signal
+		code   int
+		stdout string
+		stderr string
+	}{
+		{name: "stdin to stdout", args: []string{"cat"}, stdin: "hello", stdout: "hello"},
+		{name: "exit code", args: []string{"false"}, code: 1},
+		{name: "signal", args: []string{"sleep", "10"}, signal: syscall.SIGTERM, code: 128 + int(syscall.SIGTERM)},
+		{name: "command not allowed", args: []string{"rm", "-rf", "/"}, code: ExitDenied, stderr: "command rm is not allowed"},
+		{name: "path of command", args: []string{"/tmp/cat"}, stdin: "hi", stdout: "hi"},
+		{name: "argument not allowed", args: []string{"ip", "netns", "exec", "x", "sh"}, code: ExitDenied, stderr: "not a command ravel runs"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sigs := make(chan os.Signal, 1)
+			if test.signal != nil {
+				go func() {
+					time.Sleep(200 * time.Millisecond)
+					sigs <- test.signal
+				}()
+			}
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			code := relayTo(append([]string{socket}, test.args...), strings.NewReader(test.stdin), stdout, stderr, sigs)
+			if code != test.code {
+				t.Errorf("expected exit code %d, got %d. stderr: %s", test.code, code, stderr)
+			}
+			if stdout.String() != test.stdout {
+				t.Errorf("expected stdout %q, got %q", test.stdout, stdout)
+			}
+			if !strings.Contains(stderr.String(), test.stderr) {
+				t.Errorf("expected stderr to contain %q, got %q", test.stderr, stderr)
+			}
+		})
+	}
+}
+
+func TestRemoteWrite(t *testing.T) {
+	dir := t.TempDir()
+	socket := serve(t, dir, nil)
+	setting := filepath.Join(dir, "rp_filter")
+	if err := ioutil.WriteFile(setting, []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := remoteWrite(socket, setting, "0"); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(setting); string(b) != "0" {
+		t.Errorf("expected the setting to be written, got %q", b)
+	}
+	for _, path := range []string{"/etc/passwd", dir + "/../passwd", "relative"} {
+		if err := remoteWrite(socket, path, "0"); err == nil || !strings.Contains(err.Error(), "is not allowed") {
+			t.Errorf("expected writing %s to be denied, got %v", path, err)
+		}
+	}
+	// settings are written, not created
+	if err := remoteWrite(socket, filepath.Join(dir, "missing"), "0"); err == nil {
+		t.Error("expected writing a missing setting to fail")
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	commands := DefaultCommands("")
+	for _, test := range []struct {
+		command string
+		args    []string
+		allowed bool
+	}{
+		{command: "ip", args: []string{"-6", "address", "add", "2001:db8::1", "dev", "2001db8__1"}, allowed: true},
+		{command: "ip", args: []string{"link", "set", "dev", "eth0", "alias", "ravel/director/green"}, allowed: true},
+		{command: "ip", args: []string{"-details", "link", "show"}, allowed: true},
+		// iproute2 takes any abbreviation of its words
+		{command: "ip", args: []string{"netns", "exec", "x", "/bin/sh"}},
+		{command: "ip", args: []string{"net", "e", "x", "/bin/sh"}},
+		{command: "ip", args: []string{"vr", "e", "x", "/bin/sh"}},
+		{command: "ip", args: []string{"-ba", "/tmp/f"}},
+		{command: "ip", args: []string{"-net", "x", "link", "show"}},
+		{command: "ip", args: []string{"link", "set", "dev", "-ba", "alias", "x"}},
+		{command: "tc", args: []string{"qdisc", "replace", "dev", "eth0", "clsact"}, allowed: true},
+		{command: "tc", args: []string{"filter", "replace", "dev", "eth0", "ingress", "pref", "49", "handle", "1", "bpf", "direct-action", "object-pinned", "/sys/fs/bpf/ravel/eth0/ingress"}, allowed: true},
+		{command: "tc", args: []string{"filter", "replace", "dev", "eth0", "ingress", "pref", "49", "handle", "1", "bpf", "direct-action", "object-pinned", "/tmp/prog"}},
+		{command: "tc", args: []string{"-ba", "/tmp/f"}},
+		{command: "tc", args: []string{"e", "bpf", "imp", "/tmp/sock"}},
+		{command: "iptables", args: []string{"-w", "-t", "nat", "-S", "RAVEL"}, allowed: true},
+		// getopt takes any abbreviation of a long option, and bundled short
+		// ones
+		{command: "iptables", args: []string{"--modprobe=/tmp/x", "-L"}},
+		{command: "iptables", args: []string{"--modp=/tmp/x", "-L"}},
+		{command: "iptables", args: []string{"--mod", "/tmp/x", "-L"}},
+		{command: "iptables", args: []string{"-nM", "/tmp/x", "-L"}},
+		{command: "ip6tables-restore", args: []string{"--mo=/tmp/x"}},
+	} {
+		if err := commands[test.command].Check(test.args); (err == nil) != test.allowed {
+			t.Errorf("%s %v: expected allowed %v, got %v", test.command, test.args, test.allowed, err)
+		}
+	}
+	if err := commands["iptables-restore"].Stdin([]byte("*nat\n-A RAVEL --modpr /tmp/x -j ACCEPT\nCOMMIT\n")); err == nil {
+		t.Error("expected an abbreviated --modprobe in the input of iptables-restore to be refused")
+	}
+}
+
+func TestHAProxyArgs(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "10.0.0.1-80.conf")
+	ioutil.WriteFile(config, []byte("global\n    user haproxy\n"), 0644)
+	external := filepath.Join(dir, "10.0.0.2-80.conf")
+	ioutil.WriteFile(external, []byte("global\n    insecure-fork-wanted\nbackend b\n    option external-check\n"), 0644)
+	link := filepath.Join(dir, "10.0.0.3-80.conf")
+	os.Symlink("/etc/passwd", link)
+
+	copies := HAProxyCopies
+	HAProxyCopies = filepath.Join(t.TempDir(), "haproxy")
+	defer func() { HAProxyCopies = copies }()
+
+	rule := DefaultCommands(dir)["haproxy"]
+	for _, test := range []struct {
+		args    []string
+		allowed bool
+	}{
+		{args: []string{"-f", config}, allowed: true},
+		{args: []string{"-f", config, "-p", haproxyPIDFile, "-sf", "123", "-x", filepath.Join(dir, "10.0.0.1-80.sock")}, allowed: true},
+		{args: []string{"-W", "-f", config}},
+		{args: []string{"-c", "-f", config}, allowed: true},
+		{args: []string{"-f", "/etc/haproxy/haproxy.cfg"}},
+		{args: []string{"-f", dir + "/../haproxy.cfg"}},
+		{args: []string{"-f", external}},
+		{args: []string{"-f", link}},
+		{args: []string{"-f", config, "-p", "/etc/shadow"}},
+		{args: []string{"-f", config, "-L", "peer"}},
+		{args: []string{"-f"}},
+	} {
+		err := rule.Check(test.args)
+		if err == nil {
+			_, err = rule.Args(test.args)
+		}
+		if (err == nil) != test.allowed {
+			t.Errorf("haproxy %v: expected allowed %v, got %v", test.args, test.allowed, err)
+		}
+	}
+
+	// haproxy runs a copy of the config, which a later write doesn't change
+	args, err := rule.Args([]string{"-f", config, "-p", haproxyPIDFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := filepath.Join(HAProxyCopies, "10.0.0.1-80.conf")
+	if args[1] != copied || args[3] != haproxyPIDFile {
+		t.Fatalf("expected the config replaced by its copy. saw %v", args)
+	}
+	ioutil.WriteFile(config, []byte("global\n    lua-load /tmp/x.lua\n"), 0644)
+	if b, _ := ioutil.ReadFile(copied); string(b) != "global\n    user haproxy\n" {
+		t.Fatalf("expected the copy to be what was checked. saw %q", b)
+	}
+	info, err := os.Stat(copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the copy to be readable by its owner only. saw %v", info.Mode())
+	}
+}
@@ -0,0 +1,120 @@
+package privsep
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// A relay and the helper talk in frames of a kind, a length and a payload.
+// The relay sends a request first, then the stdin of its command, ending it
+// with an empty stdin frame, and any signals it is sent. The helper sends the
+// output of the command as it comes, and lastly its exit code, or an error if
+// it refused or couldn't run it.
+const (
+	frameRequest byte = iota + 1
+	frameStdin
+	frameStdout
+	frameStderr
+	frameSignal
+	frameExit
+	frameError
+)
+
+// maxFrame bounds the payload of a frame.
+const maxFrame = 1 << 20
+
+// request is a command to run, or a setting to write.
+type request struct {
+	Name  string   `json:"name,omitempty"`
+	Args  []string `json:"args,omitempty"`
+	Write string   `json:"write,omitempty"`
+	Value string   `json:"value,omitempty"`
+}
+
+// frameWriter sends the frames of the goroutines that share a connection.
+type frameWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (f *frameWriter) send(kind byte, payload []byte) error {
+	header := make([]byte, 5)
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.w.Write(header); err != nil {
+		return err
+	}
+	_, err := f.w.Write(payload)
+	return err
+}
+
+func (f *frameWriter) sendCode(code int) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(code))
+	return f.send(frameExit, payload)
+}
+
+// stream writes the output of a command as frames of kind.
+type stream struct {
+	f    *frameWriter
+	kind byte
+}
+
+func (s stream) Write(b []byte) (int, error) {
+	for sent := 0; sent < len(b); sent += maxFrame {
+		end := sent + maxFrame
+		if end > len(b) {
+			end = len(b)
+		}
+		if err := s.f.send(s.kind, b[sent:end]); err != nil {
+			return sent, err
+		}
+	}
+	return len(b), nil
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > maxFrame {
+		return 0, nil, fmt.Errorf("frame of %d bytes is over the limit of %d", n, maxFrame)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// remoteWrite has the helper listening on socket write value to path.
+func remoteWrite(socket, path, value string) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return fmt.Errorf("unable to reach the privileged helper: %v", err)
+	}
+	defer conn.Close()
+	b, err := json.Marshal(request{Write: path, Value: value})
+	if err != nil {
+		return err
+	}
+	if err := (&frameWriter{w: conn}).send(frameRequest, b); err != nil {
+		return fmt.Errorf("unable to reach the privileged helper: %v", err)
+	}
+	kind, payload, err := readFrame(conn)
+	if err != nil {
+		return fmt.Errorf("privileged helper closed the connection: %v", err)
+	}
+	if kind == frameError {
+		return fmt.Errorf("privileged helper: %s", payload)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package privsep
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// relayed are the signals a relay passes on to its command.
+var relayed = []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2}
+
+// Relay runs a command through the helper, standing in for it: args are
+// the socket of the helper, the command and its arguments. It returns the
+// exit code of the command, or ExitDenied.
+func Relay(args []string) int {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, relayed...)
+	return relayTo(args, os.Stdin, os.Stdout, os.Stderr, sigs)
+}
+
+func relayTo(args []string, stdin io.Reader, stdout, stderr io.Writer, sigs <-chan os.Signal) int {
+	if len(args) < 2 {
+		fmt.Fprintln(stderr, "privsep: a relay needs the socket of the helper and a command")
+		return ExitDenied
+	}
+	conn, err := net.Dial("unix", args[0])
+	if err != nil {
+		fmt.Fprintf(stderr, "privsep: unable to reach the privileged helper: %v\n", err)
+		return ExitDenied
+	}
+	defer conn.Close()
+
+	f := &frameWriter{w: conn}
+	b, err := json.Marshal(request{Name: args[1], Args: args[2:]})
+	if err != nil {
+		fmt.Fprintf(stderr, "privsep: %v\n", err)
+		return ExitDenied
+	}
+	if err := f.send(frameRequest, b); err != nil {
+		fmt.Fprintf(stderr, "privsep: unable to reach the privileged helper: %v\n", err)
+		return ExitDenied
+	}
+
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := stdin.Read(buf)
+			if n > 0 {
+				if f.send(frameStdin, buf[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				f.send(frameStdin, nil)
+				return
+			}
+		}
+	}()
+	go func() {
+		for sig := range sigs {
+			if s, ok := sig.(syscall.Signal); ok {
+				f.send(frameSignal, []byte{byte(s)})
+			}
+		}
+	}()
+
+	for {
+		kind, payload, err := readFrame(conn)
+		if err != nil {
+			fmt.Fprintf(stderr, "privsep: privileged helper closed the connection: %v\n", err)
+			return ExitDenied
+		}
+		switch kind {
+		case frameStdout:
+			stdout.Write(payload)
+		case frameStderr:
+			stderr.Write(payload)
+		case frameExit:
+			if len(payload) != 4 {
+				return ExitDenied
+			}
+			return int(binary.BigEndian.Uint32(payload))
+		case frameError:
+			fmt.Fprintf(stderr, "privsep: %s\n", payload)
+			return ExitDenied
+		}
+	}
+}
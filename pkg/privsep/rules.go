@@ -0,0 +1,289 @@
+package privsep
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Rule allows a command to be run by the helper.
+type Rule struct {
+	// Check returns why the arguments of a run aren't allowed, or nil.
+	Check func(args []string) error
+	// Stdin, if set, is given the whole of the input of a run before the
+	// command starts, and returns why it isn't allowed, or nil.
+	Stdin func(in []byte) error
+	// Args, if set, returns the arguments the command is run with in place
+	// of those Check allowed, or why they aren't allowed.
+	Args func(args []string) ([]string, error)
+}
+
+// DefaultCommands are the commands ravel changes the node with. haproxy is
+// allowed with its configs in haproxyDir, and not at all if it is empty. It
+// runs a copy of the config in HAProxyCopies, so that what it runs is what
+// was checked.
+func DefaultCommands(haproxyDir string) map[string]Rule {
+	// ip and tc can run other commands in a namespace or vrf, or a batch of
+	// their own from a file, so only what ravel runs of them is allowed
+	ip := Rule{Check: allowForms(ipForms)}
+	tc := Rule{Check: allowForms(tcForms)}
+	// iptables loads kernel modules with the program --modprobe names
+	iptables := Rule{Check: denyModprobe}
+	restore := Rule{Check: denyModprobe, Stdin: func(in []byte) error { return denyModprobe(strings.Fields(string(in))) }}
+
+	commands := map[string]Rule{
+		"ip":                ip,
+		"tc":                tc,
+		"ipvsadm":           {},
+		"ifconfig":          {},
+		"arping":            {},
+		"iptables":          iptables,
+		"iptables-save":     iptables,
+		"iptables-restore":  restore,
+		"ip6tables":         iptables,
+		"ip6tables-save":    iptables,
+		"ip6tables-restore": restore,
+	}
+	if haproxyDir != "" {
+		commands["haproxy"] = Rule{Check: haproxyArgs(haproxyDir), Args: haproxyCopy}
+	}
+	return commands
+}
+
+// tcPinDir is where ravel pins the bpf programs tc attaches.
+const tcPinDir = "/sys/fs/bpf/ravel"
+
+// ipForms and tcForms are the commands ravel runs with ip and tc. A * is
+// any one argument that isn't an option, a word with a | is one of its
+// alternatives, and <pin> is a program pinned in tcPinDir. Every other word
+// must be given in full, as iproute2 takes any abbreviation of its words.
+var (
+	ipForms = [][]string{
+		{"addr", "show", "dev", "*"},
+		{"address", "add", "*", "dev", "*"},
+		{"-6", "address", "add", "*", "dev", "*"},
+		{"link", "add", "*", "type", "dummy"},
+		{"link", "del", "*", "type", "dummy"},
+		{"link", "set", "dev", "*", "alias", "*"},
+		{"-details", "link", "show"},
+	}
+	tcForms = [][]string{
+		{"qdisc", "replace", "dev", "*", "clsact"},
+		{"filter", "replace", "dev", "*", "ingress|egress", "pref", "*", "handle", "*", "bpf", "direct-action", "object-pinned", "<pin>"},
+		{"filter", "del", "dev", "*", "ingress|egress", "pref", "*", "handle", "*", "bpf"},
+	}
+)
+
+// allowForms returns a check that allows only the arguments of one of
+// forms.
+func allowForms(forms [][]string) func([]string) error {
+	return func(args []string) error {
+		for _, form := range forms {
+			if matchForm(form, args) {
+				return nil
+			}
+		}
+		return fmt.Errorf("not a command ravel runs")
+	}
+}
+
+// matchForm is whether args are of form.
+func matchForm(form, args []string) bool {
+	if len(form) != len(args) {
+		return false
+	}
+	for ix, word := range form {
+		arg := args[ix]
+		switch {
+		case word == "*":
+			if arg == "" || strings.HasPrefix(arg, "-") {
+				return false
+			}
+		case word == "<pin>":
+			if !within(arg, tcPinDir) {
+				return false
+			}
+		case strings.Contains(word, "|"):
+			if !contains(strings.Split(word, "|"), arg) {
+				return false
+			}
+		case arg != word:
+			return false
+		}
+	}
+	return true
+}
+
+func contains(words []string, word string) bool {
+	for _, w := range words {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+// denyModprobe refuses --modprobe, however it is abbreviated, and -M, on
+// its own or among other short options.
+func denyModprobe(args []string) error {
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--"):
+			name := strings.SplitN(arg[2:], "=", 2)[0]
+			if name != "" && strings.HasPrefix("modprobe", name) {
+				return fmt.Errorf("%s is not allowed", arg)
+			}
+		case strings.HasPrefix(arg, "-") && strings.Contains(arg[1:], "M"):
+			return fmt.Errorf("%s is not allowed", arg)
+		}
+	}
+	return nil
+}
+
+// haproxyPIDFile is the pid file ravel starts haproxy with.
+const haproxyPIDFile = "/var/run/haproxy.pid"
+
+// HAProxyCopies is where the helper keeps the configs haproxy runs, which
+// only root may write.
+var HAProxyCopies = "/var/run/ravel/haproxy"
+
+// haproxyDirectives are those of a config that would have haproxy run
+// other programs, or code that isn't its own.
+var haproxyDirectives = map[string]bool{
+	"external-check":       true,
+	"insecure-fork-wanted": true,
+	"lua-load":             true,
+	"lua-load-per-thread":  true,
+	"program":              true,
+}
+
+// haproxyArgs returns a check of the arguments ravel starts haproxy with:
+// a config in dir, with its stats socket there too, and the pid file and
+// the pids of the process it takes over from. Master-worker mode, -W, isn't
+// allowed, as the master would reload the config in dir without the helper
+// checking it.
+func haproxyArgs(dir string) func([]string) error {
+	return func(args []string) error {
+		for ix := 0; ix < len(args); ix++ {
+			switch flag := args[ix]; flag {
+			case "-D", "-q", "-c":
+			case "-f", "-x", "-p":
+				ix++
+				if ix == len(args) {
+					return fmt.Errorf("%s needs a path", flag)
+				}
+				path := args[ix]
+				if flag == "-p" && path == haproxyPIDFile {
+					continue
+				}
+				if !within(path, dir) {
+					return fmt.Errorf("%s %s is outside of %s", flag, path, dir)
+				}
+			case "-sf", "-st":
+				if ix+1 == len(args) {
+					return fmt.Errorf("%s needs a pid", flag)
+				}
+				for ix+1 < len(args) && isPIDs(args[ix+1]) {
+					ix++
+				}
+			default:
+				return fmt.Errorf("%s is not allowed", flag)
+			}
+		}
+		return nil
+	}
+}
+
+// isPIDs is whether arg is one or more pids.
+func isPIDs(arg string) bool {
+	pids := strings.Fields(arg)
+	for _, pid := range pids {
+		if _, err := strconv.Atoi(pid); err != nil {
+			return false
+		}
+	}
+	return len(pids) > 0
+}
+
+// haproxyCopy returns args with the config of -f replaced by a copy of it
+// in HAProxyCopies, once it is checked. ravel can rewrite the config in its
+// own directory at any time, but not the copy.
+func haproxyCopy(args []string) ([]string, error) {
+	out := append([]string{}, args...)
+	for ix := 0; ix < len(out)-1; ix++ {
+		if out[ix] != "-f" {
+			continue
+		}
+		ix++
+		b, err := readHAProxyConfig(out[ix])
+		if err != nil {
+			return nil, err
+		}
+		if out[ix], err = writeHAProxyCopy(filepath.Base(out[ix]), b); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// readHAProxyConfig reads the config at path, refusing one that isn't a
+// regular file, or that has any of haproxyDirectives.
+func readHAProxyConfig(path string) ([]byte, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && haproxyDirectives[fields[0]] {
+			return nil, fmt.Errorf("%s in %s is not allowed", fields[0], path)
+		}
+	}
+	return b, scanner.Err()
+}
+
+// writeHAProxyCopy replaces the copy of name in HAProxyCopies with b, and
+// returns its path.
+func writeHAProxyCopy(name string, b []byte) (string, error) {
+	if err := os.MkdirAll(HAProxyCopies, 0700); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(HAProxyCopies, "."+name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	path := filepath.Join(HAProxyCopies, name)
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,350 @@
+package probe
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// The prober connects to every VIP and port in the cluster config from the
+// director, through the same IPVS rules client traffic takes. BGP sessions
+// and IPVS rules can both look correct while traffic is blackholed, by a
+// realserver missing the VIP on its loopback for example; a failing probe
+// catches that where the rest of the metrics don't.
+//
+// Ports named http, or prefixed http-, get an HTTP GET. Everything else with
+// TCP enabled gets a TCP connect. UDP ports aren't probed, since there's no
+// response to expect from an arbitrary UDP service.
+
+const (
+	ProbeTCP  = "tcp"
+	ProbeHTTP = "http"
+
+	// concurrency bounds the probes in flight at once.
+	concurrency = 16
+)
+
+var probeLabels = []string{"lb", "vip", "port", "protocol", "port_name", "namespace", "service", "probe"}
+
+var (
+	probeTotalDef = stats.Define(stats.Definition{
+		Type:   stats.Counter,
+		Name:   "probe_total",
+		Help:   "is a count of synthetic probes of a VIP and port from the director, with labels denoting the outcome success|refused|timeout|error",
+		Labels: append(probeLabels, "outcome"),
+	})
+	probeLatencyDef = stats.Define(stats.Definition{
+		Type:    stats.Histogram,
+		Name:    "probe_latency_microseconds",
+		Help:    "is a histogram of how long successful synthetic probes of a VIP and port took to connect, or for http probes to receive the response headers",
+		Labels:  probeLabels,
+		Buckets: stats.LatencyBuckets,
+	})
+	probeSuccessDef = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "probe_success",
+		Help:   "is 1 if the last synthetic probe of a VIP and port succeeded, and 0 if it failed",
+		Labels: probeLabels,
+	})
+)
+
+// Config controls the prober.
+type Config struct {
+	// Interval is how often every target is probed.
+	Interval time.Duration
+	// Timeout bounds a single probe.
+	Timeout time.Duration
+	// HTTPPath is requested by http probes.
+	HTTPPath string
+	// Source is the local address v4 probes are sent from. It should be the
+	// director's primary address; replies to a VIP would be delivered to the
+	// realserver's own loopback.
+	Source net.IP
+}
+
+// Target is a VIP and port to probe.
+type Target struct {
+	VIP       string
+	Port      string
+	Namespace string
+	Service   string
+	PortName  string
+	Probe     string
+}
+
+func (t Target) address() string {
+	return net.JoinHostPort(t.VIP, t.Port)
+}
+
+func (t Target) labels(kind string) prometheus.Labels {
+	return prometheus.Labels{
+		"lb":        kind,
+		"vip":       t.VIP,
+		"port":      t.Port,
+		"protocol":  "TCP",
+		"port_name": t.PortName,
+		"namespace": t.Namespace,
+		"service":   t.Service,
+		"probe":     t.Probe,
+	}
+}
+
+// Targets lists a target for each TCP enabled VIP and port in the config,
+// including the v6 addresses of VIPs, sorted by address.
+func Targets(c *types.ClusterConfig) []Target {
+	if c == nil {
+		return nil
+	}
+	targets := []Target{}
+	add := func(ip, port string, cfg *types.ServiceDef) {
+		if cfg == nil || !cfg.TCPEnabled {
+			return
+		}
+		kind := ProbeTCP
+		if cfg.PortName == "http" || strings.HasPrefix(cfg.PortName, "http-") {
+			kind = ProbeHTTP
+		}
+		targets = append(targets, Target{
+			VIP:       ip,
+			Port:      port,
+			Namespace: cfg.Namespace,
+			Service:   cfg.Service,
+			PortName:  cfg.PortName,
+			Probe:     kind,
+		})
+	}
+	for ip, portMap := range c.Config {
+		ip6, has6 := c.IPV6[ip]
+		for port, cfg := range portMap {
+			add(string(ip), port, cfg)
+			if has6 {
+				add(ip6, port, cfg)
+			}
+		}
+	}
+	for ip, portMap := range c.Config6 {
+		for port, cfg := range portMap {
+			add(string(ip), port, cfg)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].VIP != targets[j].VIP {
+			return targets[i].VIP < targets[j].VIP
+		}
+		return targets[i].Port < targets[j].Port
+	})
+	return targets
+}
+
+// Prober probes the VIPs in the cluster config every interval.
+type Prober struct {
+	kind   string
+	config Config
+	source func() *types.ClusterConfig
+	logger logging.Logger
+
+	total   *prometheus.CounterVec
+	latency *prometheus.HistogramVec
+	success *prometheus.GaugeVec
+
+	// the series set by the last round, so that removed VIPs stop being
+	// reported.
+	seen map[Target]bool
+
+	// the last result of each target, for Results
+	mu   sync.Mutex
+	last map[Target]outcome
+}
+
+// outcome is when a target was last probed, and why it failed if it did.
+type outcome struct {
+	at  time.Time
+	err error
+}
+
+// New returns a prober for the configs returned by source.
+func New(kind stats.LBKind, config Config, source func() *types.ClusterConfig, logger logging.Logger) (*Prober, error) {
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("probe interval must be positive")
+	}
+	if config.Timeout <= 0 || config.Timeout > config.Interval {
+		return nil, fmt.Errorf("probe timeout must be positive and no longer than the interval")
+	}
+	if config.HTTPPath == "" {
+		config.HTTPPath = "/"
+	}
+	return &Prober{
+		kind:    string(kind),
+		config:  config,
+		source:  source,
+		logger:  logger,
+		total:   probeTotalDef.CounterVec(),
+		latency: probeLatencyDef.HistogramVec(),
+		success: probeSuccessDef.GaugeVec(),
+		seen:    map[Target]bool{},
+		last:    map[Target]outcome{},
+	}, nil
+}
+
+// Results returns the targets of vips whose last probe, made after since,
+// passed and failed. Targets not probed since are left out.
+func (p *Prober) Results(vips map[string]bool, since time.Time) (passed, failed []Target) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for t, o := range p.last {
+		if !vips[t.VIP] || o.at.Before(since) {
+			continue
+		}
+		if o.err != nil {
+			failed = append(failed, t)
+		} else {
+			passed = append(passed, t)
+		}
+	}
+	return passed, failed
+}
+
+// Run probes every interval until ctx is done.
+func (p *Prober) Run(ctx context.Context) {
+	t := time.NewTicker(p.config.Interval)
+	defer t.Stop()
+	for {
+		p.Round(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Round probes each target once.
+func (p *Prober) Round(ctx context.Context) {
+	targets := Targets(p.source())
+
+	work := make(chan Target)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range work {
+				p.record(t, p.probe(ctx, t))
+			}
+		}()
+	}
+	seen := map[Target]bool{}
+	for _, t := range targets {
+		seen[t] = true
+		work <- t
+	}
+	close(work)
+	wg.Wait()
+
+	p.mu.Lock()
+	for t := range p.seen {
+		if !seen[t] {
+			p.success.Delete(t.labels(p.kind))
+			delete(p.last, t)
+		}
+	}
+	p.mu.Unlock()
+	p.seen = seen
+}
+
+type result struct {
+	outcome string
+	latency time.Duration
+	err     error
+}
+
+func (p *Prober) record(t Target, r result) {
+	labels := t.labels(p.kind)
+	counterLabels := prometheus.Labels{"outcome": r.outcome}
+	for k, v := range labels {
+		counterLabels[k] = v
+	}
+	p.total.With(counterLabels).Add(1)
+	p.mu.Lock()
+	p.last[t] = outcome{at: time.Now(), err: r.err}
+	p.mu.Unlock()
+
+	if r.err != nil {
+		p.success.With(labels).Set(0)
+		p.logger.WithFields(logging.Fields{logging.FieldVIP: t.VIP, "port": t.Port, "probe": t.Probe, "outcome": r.outcome}).Debugf("probe failed: %v", r.err)
+		return
+	}
+	p.success.With(labels).Set(1)
+	p.latency.With(labels).Observe(float64(r.latency.Nanoseconds() / 1000))
+}
+
+func (p *Prober) probe(ctx context.Context, t Target) result {
+	ctx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+	defer cancel()
+
+	dialer := &net.Dialer{}
+	if p.config.Source != nil && p.config.Source.To4() != nil && net.ParseIP(t.VIP).To4() != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: p.config.Source}
+	}
+
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", t.address())
+	if err != nil {
+		return failure(err)
+	}
+	defer conn.Close()
+	if t.Probe == ProbeTCP {
+		return result{outcome: "success", latency: time.Since(start)}
+	}
+
+	req, err := http.NewRequest("GET", "http://"+t.address()+p.config.HTTPPath, nil)
+	if err != nil {
+		return result{outcome: "error", err: err}
+	}
+	req.Header.Set("User-Agent", "ravel-probe")
+	req.Close = true
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := req.Write(conn); err != nil {
+		return failure(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return failure(err)
+	}
+	latency := time.Since(start)
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	// any response shows the traffic got through; only a server error
+	// suggests the backends behind the VIP are broken.
+	if resp.StatusCode >= 500 {
+		return result{outcome: "error", err: fmt.Errorf("status %d", resp.StatusCode)}
+	}
+	return result{outcome: "success", latency: latency}
+}
+
+func failure(err error) result {
+	outcome := "error"
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		outcome = "timeout"
+	} else if strings.Contains(err.Error(), "connection refused") {
+		outcome = "refused"
+	}
+	return result{outcome: outcome, err: err}
+}
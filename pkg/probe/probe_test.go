@@ -0,0 +1,125 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+func TestTargets(t *testing.T) {
+	c := &types.ClusterConfig{
+		IPV6: map[types.ServiceIP]string{"10.54.213.10": "2001:db8::10"},
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.10": {
+				"80":  {Service: "web", PortName: "http", TCPEnabled: true},
+				"53":  {Service: "dns", PortName: "dns", UDPEnabled: true},
+				"443": {Service: "web", PortName: "https", TCPEnabled: true},
+			},
+		},
+	}
+	targets := Targets(c)
+	if len(targets) != 4 {
+		t.Fatalf("expected a target per address and tcp port, got %+v", targets)
+	}
+	for _, target := range targets {
+		want := ProbeTCP
+		if target.Port == "80" {
+			want = ProbeHTTP
+		}
+		if target.Probe != want {
+			t.Fatalf("expected %s:%s to get a %s probe, got %s", target.VIP, target.Port, want, target.Probe)
+		}
+	}
+	if targets[0].VIP != "10.54.213.10" || targets[0].Port != "443" {
+		t.Fatalf("expected targets to be sorted, got %+v", targets)
+	}
+}
+
+func TestProber(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer healthy.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	// a port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	port := func(url string) string {
+		_, p, _ := net.SplitHostPort(url[len("http://"):])
+		return p
+	}
+	c := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"127.0.0.1": {
+				port(healthy.URL):    {Service: "healthy", PortName: "http", TCPEnabled: true},
+				port(broken.URL):     {Service: "broken", PortName: "http-api", TCPEnabled: true},
+				strconv.Itoa(closed): {Service: "closed", PortName: "db", TCPEnabled: true},
+			},
+		},
+	}
+
+	p, err := New(stats.KindBGPDirector, Config{Interval: time.Second, Timeout: time.Second}, func() *types.ClusterConfig { return c }, logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Round(context.Background())
+
+	counts := map[string]float64{}
+	for _, target := range Targets(c) {
+		labels := target.labels(stats.KindBGPDirector)
+		counts[target.Service] = testutil.ToFloat64(p.success.With(labels))
+	}
+	if counts["healthy"] != 1 || counts["broken"] != 0 || counts["closed"] != 0 {
+		t.Fatalf("unexpected probe results %v", counts)
+	}
+
+	outcome := func(service, outcome string) float64 {
+		for _, target := range Targets(c) {
+			if target.Service == service {
+				labels := target.labels(stats.KindBGPDirector)
+				labels["outcome"] = outcome
+				return testutil.ToFloat64(p.total.With(labels))
+			}
+		}
+		return 0
+	}
+	if outcome("closed", "refused") != 1 || outcome("broken", "error") != 1 {
+		t.Fatal("expected the closed port to be refused and the 503 to be an error")
+	}
+
+	// the last results are kept for the VIPs asked for
+	vips := map[string]bool{"127.0.0.1": true}
+	passed, failed := p.Results(vips, time.Time{})
+	if len(passed) != 1 || passed[0].Service != "healthy" || len(failed) != 2 {
+		t.Fatalf("expected the healthy port passed and the others failed, got %v %v", passed, failed)
+	}
+	if passed, failed := p.Results(vips, time.Now()); len(passed)+len(failed) != 0 {
+		t.Fatalf("expected no results since now, got %v %v", passed, failed)
+	}
+
+	// removed VIPs stop being reported
+	c = &types.ClusterConfig{}
+	p.Round(context.Background())
+	if n := testutil.CollectAndCount(p.success); n != 0 {
+		t.Fatalf("expected no probe_success series after the VIPs were removed, got %d", n)
+	}
+}
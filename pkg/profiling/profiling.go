@@ -0,0 +1,56 @@
+package profiling
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+// Serve exposes net/http/pprof and Go runtime metrics on addr until ctx is
+// canceled. The handlers are mounted on a private mux, so nothing is added to
+// the default mux served by the stats endpoint. addr should be a loopback
+// address since profiles expose process internals.
+//
+//	/debug/pprof/   the standard pprof index, profile, trace and symbol handlers
+//	/metrics        goroutine, heap, gc and process metrics
+func Serve(ctx context.Context, addr string, logger logging.Logger) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGoCollector())
+	registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("profiling: unable to listen on %s: %v", addr, err)
+	}
+	logger.Infof("profiling: serving pprof and runtime metrics on %s", ln.Addr())
+
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("profiling: server exited with error: %v", err)
+		}
+	}()
+	return nil
+}
@@ -11,24 +11,36 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Comcast/Ravel/pkg/audit"
 	"github.com/Comcast/Ravel/pkg/haproxy"
+	"github.com/Comcast/Ravel/pkg/health"
 	"github.com/Comcast/Ravel/pkg/iptables"
+	log "github.com/Comcast/Ravel/pkg/logging"
 	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/supervisor"
 	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/tracing"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watchdog"
 	"github.com/Comcast/Ravel/pkg/watcher"
-	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/core/v1"
 )
 
 // RealServer describes the interface required for a realserver
 type RealServer interface {
 	Start() error
+	// Stop stops the realserver as the director takes the node back,
+	// draining it for the drain window first
 	Stop() error
-}
-
-// TODO - remove
-func init() {
-	log.SetLevel(log.DebugLevel)
+	// Shutdown stops the realserver as the process exits, draining it for
+	// as much of the drain window as the deadline of ctx allows
+	Shutdown(ctx context.Context) error
+	Health(context.Context) health.Status
+	// Standby pre-builds the node's configuration every interval while a
+	// director is active, so that Start only has to apply it
+	Standby(interval time.Duration)
 }
 
 // realserver is responsible for managing iptables
@@ -37,6 +49,8 @@ type realserver struct {
 
 	// haproxy configs
 	haproxy haproxy.HAProxySet
+	// the tls certificate applied to each v6 listener, by vip:port
+	certs map[string]string
 
 	watcher   *watcher.Watcher
 	ipPrimary *system.IP
@@ -44,7 +58,12 @@ type realserver struct {
 	ipvs      *system.IPVS
 	iptables  *iptables.IPTables
 
-	nodeName string
+	nodeName  string
+	configKey string
+
+	// lastAppliedConfig is the cluster config of the last reconfigure, to
+	// give the changes since in the audit reason of the next
+	lastAppliedConfig *types.ClusterConfig
 
 	doneChan chan struct{}
 
@@ -56,17 +75,26 @@ type realserver struct {
 	ctxWatch context.Context
 
 	reconfiguring     bool
+	running           bool
 	lastInboundUpdate time.Time
 	lastReconfigure   time.Time
+	reconcile         health.Reconcile
 	forcedReconfigure bool
+	// drain is how long Stop lets the connections to local pods finish
+	// before tearing the node down
+	drain time.Duration
+	// warm is the configuration built by Standby for the next Start, and
+	// standby is whether Standby runs
+	warm    *warmState
+	standby bool
 
 	ctx     context.Context
-	logger  log.FieldLogger
+	logger  log.Logger
 	metrics *stats.WorkerStateMetrics
 }
 
 // NewRealServer creates a new realserver
-func NewRealServer(ctx context.Context, nodeName string, configKey string, watcher *watcher.Watcher, ipPrimary *system.IP, ipDevices *system.IP, ipvs *system.IPVS, ipt *iptables.IPTables, forcedReconfigure bool, haproxy *haproxy.HAProxySetManager, logger log.FieldLogger) (RealServer, error) {
+func NewRealServer(ctx context.Context, nodeName string, configKey string, watcher *watcher.Watcher, ipPrimary *system.IP, ipDevices *system.IP, ipvs *system.IPVS, ipt *iptables.IPTables, forcedReconfigure bool, drain time.Duration, haproxy *haproxy.HAProxySetManager, logger log.Logger) (RealServer, error) {
 	return &realserver{
 		watcher:   watcher,
 		ipPrimary: ipPrimary,
@@ -74,6 +102,7 @@ func NewRealServer(ctx context.Context, nodeName string, configKey string, watch
 		ipvs:      ipvs,
 		iptables:  ipt,
 		nodeName:  nodeName,
+		configKey: configKey,
 
 		haproxy: haproxy,
 
@@ -85,12 +114,26 @@ func NewRealServer(ctx context.Context, nodeName string, configKey string, watch
 		logger:            logger,
 		metrics:           stats.NewWorkerStateMetrics(stats.KindIpvsBackend, configKey),
 		forcedReconfigure: forcedReconfigure,
+		drain:             drain,
 	}, nil
 }
 
 // Stop stops the realserver tickers that configure and true up iptables
 // TODO: IN THIS CASE STOP CAN BE CALLED WITHOUT THE CANCEL FUNCTION. . WELP DAY
 func (r *realserver) Stop() error {
+	// a shutdown while the director takes the node back cuts the drain short
+	return r.stop(r.ctx, context.Background())
+}
+
+func (r *realserver) Shutdown(ctx context.Context) error {
+	draining, cxl := types.Draining(ctx)
+	defer cxl()
+	return r.stop(draining, ctx)
+}
+
+// stop drains the realserver until the drain window is over or draining is
+// done, then tears it down within ctx.
+func (r *realserver) stop(draining, ctx context.Context) error {
 	if r.reconfiguring {
 		return fmt.Errorf("unable to stop. reconfiguration already in progress")
 	}
@@ -106,10 +149,22 @@ func (r *realserver) Stop() error {
 	r.logger.Info("blocking until periodic tasks complete")
 	select {
 	case <-r.doneChan:
-	case <-time.After(5000 * time.Millisecond):
+	case <-time.After(types.TeardownTimeout):
+	case <-draining.Done():
 	}
+
+	r.Lock()
+	running := r.running
+	r.running = false
+	r.Unlock()
+
+	// there's nothing to drain while the director holds the node
+	if running {
+		r.drainConnections(draining)
+	}
+
 	// remove config VIP addresses from the compute interface
-	ctxDestroy, cxl := context.WithTimeout(context.Background(), 5000*time.Millisecond)
+	ctxDestroy, cxl := context.WithTimeout(ctx, types.TeardownTimeout)
 	defer cxl()
 
 	r.logger.Info("starting cleanup")
@@ -118,6 +173,28 @@ func (r *realserver) Stop() error {
 	return err
 }
 
+// drainConnections stops new connections from going to local pods, so that
+// the director takes them, and waits out the drain window for the ones
+// already there to finish, or until ctx is done.
+func (r *realserver) drainConnections(ctx context.Context) {
+	if r.drain <= 0 || ctx.Err() != nil {
+		return
+	}
+	if err := r.iptables.Drain(); err != nil {
+		r.logger.Errorf("unable to drain iptables. tearing down now. %v", err)
+		return
+	}
+	r.logger.Infof("draining connections to local pods for %v", r.drain)
+	t := time.NewTimer(r.drain)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		r.logger.Info("drain window over")
+	case <-ctx.Done():
+		r.logger.Info("drain cut short by shutdown")
+	}
+}
+
 // cleanup removes all iptables deviecs and flushes rules for clean shutdown
 func (r *realserver) cleanup(ctx context.Context) error {
 	errs := []string{}
@@ -195,7 +272,21 @@ func (r *realserver) Start() error {
 		return err
 	}
 
-	go r.periodic()
+	r.Lock()
+	r.running = true
+	r.Unlock()
+
+	// a warm standby applies its configuration straight away rather than
+	// on the first tick
+	r.Lock()
+	standby := r.standby
+	r.Unlock()
+	if standby {
+		r.activate()
+	}
+
+	// restart the loop if it panics
+	supervisor.Go(r.ctxWatch, stats.KindIpvsBackend, "realserver.periodic", r.logger, func() { r.periodic() })
 	// go r.watches()
 
 	return nil
@@ -267,48 +358,19 @@ func (r *realserver) periodic() error {
 	forceReconfigure := time.NewTicker(forcedReconfigureInterval)
 	defer forceReconfigure.Stop()
 
+	beat := watchdog.Register("realserver.periodic")
+	defer beat.Done()
+
 	for {
+		beat.Beat()
 		select {
 		// if a force reconfigure happens, we do this
 		case <-forceReconfigure.C:
 			if r.forcedReconfigure {
-				/*
-					note on error fall through: configure and configure6 are similar,
-					but different configuration efforts. I don't see why we would
-					ever _not_ want to attempt a config6() call if config() fails,
-					with the reasoning that a potentially partial working state is
-					better than giving up
-
-					However, if we fail to configure6(), new haproxy calls will fail
-					with error to start haproxy. For that reason, we continue
-					in that error block
-				*/
 				start := time.Now()
 				r.logger.Info("realserver: forced reconfigure, not performing parity check")
-				if err, _ := r.configure(); err != nil {
-					r.logger.Errorf("realserver: unable to apply ipv4 configuration, %v", err)
-					r.metrics.Reconfigure("error", time.Since(start))
-				}
-
-				if err, _ := r.configure6(); err != nil {
-					r.logger.Errorf("realserver: unable to apply ipv6 configuration, %v", err)
-					r.metrics.Reconfigure("error", time.Since(start))
-					continue // new haproxies will fail if this block fails. see note above on continue statements
-				}
-
-				// configure haproxy for v6-v4 NAT gateway
-				err := r.ConfigureHAProxy()
-				if err != nil {
-					r.logger.Errorf("realserver: error applying haproxy config in realserver. %v", err)
-					r.metrics.Reconfigure("error", time.Since(start))
-					continue
-				}
-
-				now := time.Now()
-				r.logger.Infof("realserver: reconfiguration completed successfully in %v", now.Sub(start))
-				r.lastReconfigure = start
-
-				r.metrics.Reconfigure("complete", time.Since(start))
+				ctx, span := r.startReconfigureSpan("forced")
+				tracing.End(span, r.reconfigure(ctx, start))
 			}
 
 		// check config parity every time this ticks and configure haproxy for NAT gateway support
@@ -316,43 +378,24 @@ func (r *realserver) periodic() error {
 
 			start := time.Now()
 			r.logger.Infof("realserver: reconfig triggered due to periodic parity check")
-			same, err := r.checkConfigParity()
+			ctx, span := r.startReconfigureSpan("adapter")
+			same, err := r.checkConfigParity(ctx)
 			if err != nil {
 				// what is a better way to handle this scenario?
 				r.logger.Errorf("realserver: parity check failed. %v", err)
+				tracing.End(span, err)
 				continue
 			}
+			r.reconcile.Parity(same)
 			if same {
 				// noop
 				r.logger.Debugf("realserver: configuration has parity")
+				span.End()
 				continue
 			}
 			r.logger.Debugf("realserver: configuration needs updated")
 
-			if err, _ := r.configure(); err != nil {
-				r.metrics.Reconfigure("error", time.Since(start))
-				r.logger.Errorf("realserver: unable to apply ipv4 configuration, %v", err)
-			}
-
-			if err, _ := r.configure6(); err != nil {
-				r.metrics.Reconfigure("error", time.Since(start))
-				r.logger.Errorf("realserver: unable to apply ipv6 configuration, %v", err)
-				continue // new haproxies will fail if this block fails. see note above on continue statements
-			}
-
-			// configure haproxy for v6-v4 NAT gateway
-			err = r.ConfigureHAProxy()
-			if err != nil {
-				r.logger.Errorf("realserver: error applying haproxy config in realserver. %v", err)
-				r.metrics.Reconfigure("error", time.Since(start))
-				continue
-			}
-
-			now := time.Now()
-			r.logger.Infof("realserver: reconfiguration completed successfully in %v", now.Sub(start))
-			r.lastReconfigure = start
-
-			r.metrics.Reconfigure("complete", time.Since(start))
+			tracing.End(span, r.reconfigure(ctx, start))
 
 		// every time this ticks, we reconfigure all iptables rules and check config parity
 		case <-checkTicker.C:
@@ -365,7 +408,9 @@ func (r *realserver) periodic() error {
 				r.lastInboundUpdate,
 				r.lastReconfigure.Sub(r.lastInboundUpdate),
 				r.lastReconfigure.Sub(r.lastInboundUpdate) > 0)
-			if r.lastReconfigure.Sub(r.lastInboundUpdate) > 0 {
+			// until it is warm, parity is checked on every tick to confirm
+			// the first reconfigure
+			if r.lastReconfigure.Sub(r.lastInboundUpdate) > 0 && r.reconcile.Warm() {
 				// No noop metric here - we only noop if a non-impactful config change makes it through
 				r.logger.Debugf("realserver: no changes to configs since last reconfiguration completed")
 				continue
@@ -375,52 +420,33 @@ func (r *realserver) periodic() error {
 
 			if r.watcher.ClusterConfig == nil {
 				log.Warningln("realserver: can not check parity because config is nil")
-				r.metrics.Reconfigure("noop", time.Since(start))
+				r.metrics.Reconfigure(r.ctx, "noop", time.Since(start))
 				continue
 			}
 			if r.nodeName == "" {
 				log.Errorln("realserver: can not check parity because nodeName is not set")
-				r.metrics.Reconfigure("noop", time.Since(start))
+				r.metrics.Reconfigure(r.ctx, "noop", time.Since(start))
 				continue
 			}
 
 			log.Debugln("realserver: checking configuration parity")
-			same, err := r.checkConfigParity()
+			ctx, span := r.startReconfigureSpan("check")
+			same, err := r.checkConfigParity(ctx)
 			if err != nil {
 				// what is a better way to handle this scenario?
 				r.logger.Errorf("realserver: parity check failed. %v", err)
+				tracing.End(span, err)
 				continue
-			} else if same {
+			}
+			r.reconcile.Parity(same)
+			if same {
 				// noop
 				r.logger.Debugf("realserver: configuration has parity")
+				span.End()
 				continue
 			}
 
-			err, _ = r.configure()
-			if err != nil {
-				r.logger.Errorf("realserver: error applying configuration in realserver. %v", err)
-				r.metrics.Reconfigure("error", time.Since(start))
-			}
-
-			if err, _ = r.configure6(); err != nil {
-				r.metrics.Reconfigure("error", time.Since(start))
-				r.logger.Errorf("realserver: unable to apply ipv6 configuration, %v", err)
-				continue // new haproxies will fail if this block fails. see note above on continue statements
-			}
-
-			// configure haproxy for v6-v4 NAT gateway
-			err = r.ConfigureHAProxy()
-			if err != nil {
-				r.logger.Errorf("realserver: error applying haproxy config in realserver. %v", err)
-				r.metrics.Reconfigure("error", time.Since(start))
-				continue
-			}
-
-			now := time.Now()
-			r.logger.Infof("realserver: reconfiguration completed successfully in %v", now.Sub(start))
-			r.lastReconfigure = start
-
-			r.metrics.Reconfigure("complete", time.Since(start))
+			tracing.End(span, r.reconfigure(ctx, start))
 
 		case <-r.ctx.Done():
 			return nil
@@ -432,6 +458,89 @@ func (r *realserver) periodic() error {
 	}
 }
 
+// startReconfigureSpan opens the root span for one pass of the periodic loop,
+// linked to the watcher publish that most recently changed the cluster config.
+func (r *realserver) startReconfigureSpan(trigger string) (context.Context, trace.Span) {
+	id := r.watcher.CorrelationID()
+	r.logger.WithFields(log.Fields{"correlation_id": id, "trigger": trigger}).Debug("realserver: reconfiguring")
+	var reason string
+	reason, r.lastAppliedConfig = r.watcher.Reason("realserver reconfigure: "+trigger, r.lastAppliedConfig)
+	audit.SetCause(reason, r.watcher.ConfigHash(), id)
+	r.metrics.ConfigSeen(r.watcher.Published())
+	return tracing.StartLinked(r.ctx, "realserver.reconfigure", r.watcher.PublishSpanContext(), attribute.String("trigger", trigger), attribute.String("ravel.correlation_id", id))
+}
+
+// reconfigure applies the ipv4, ipv6 and haproxy configurations in order and
+// records the outcome. start is when the triggering tick began.
+func (r *realserver) reconfigure(ctx context.Context, start time.Time) (err error) {
+	return r.reconfigureWith(ctx, start, nil)
+}
+
+// reconfigureWith is reconfigure, applying the iptables rules and haproxy
+// listeners of warm rather than building them, unless warm is nil.
+func (r *realserver) reconfigureWith(ctx context.Context, start time.Time, warm *warmState) (err error) {
+	defer func() { r.reconcile.Record(err) }()
+
+	/*
+		note on error fall through: configure and configure6 are similar,
+		but different configuration efforts. I don't see why we would
+		ever _not_ want to attempt a config6() call if config() fails,
+		with the reasoning that a potentially partial working state is
+		better than giving up
+
+		However, if we fail to configure6(), new haproxy calls will fail
+		with error to start haproxy. For that reason, we return
+		in that error block
+	*/
+	err, _ = r.configure(ctx, warm)
+	if err != nil {
+		r.logger.Errorf("realserver: unable to apply ipv4 configuration, %v", err)
+		r.metrics.Reconfigure(ctx, "error", time.Since(start))
+	}
+
+	if err, _ := r.configure6(ctx); err != nil {
+		r.logger.Errorf("realserver: unable to apply ipv6 configuration, %v", err)
+		r.metrics.Reconfigure(ctx, "error", time.Since(start))
+		return err // new haproxies will fail if this block fails. see note above
+	}
+
+	// configure haproxy for v6-v4 NAT gateway
+	_, span := tracing.Start(ctx, "realserver.configureHAProxy")
+	phaseStart := time.Now()
+	var haErr error
+	if warm != nil {
+		haErr = r.applyHAProxy(warm.haproxy)
+	} else {
+		haErr = r.ConfigureHAProxy()
+	}
+	r.metrics.ReconfigurePhase(ctx, stats.PhaseHAProxy, stats.FamilyV6, haErr, time.Since(phaseStart))
+	tracing.End(span, haErr)
+	if haErr != nil {
+		r.logger.Errorf("realserver: error applying haproxy config in realserver. %v", haErr)
+		r.metrics.Reconfigure(ctx, "error", time.Since(start))
+		return haErr
+	}
+
+	now := time.Now()
+	r.logger.Infof("realserver: reconfiguration completed successfully in %v", now.Sub(start))
+	r.lastReconfigure = start
+
+	r.metrics.Reconfigure(ctx, "complete", time.Since(start))
+	return err
+}
+
+// Health reports the outcome of the most recent reconfigure. A realserver
+// that is stopped because a director owns this node is ready.
+func (r *realserver) Health(ctx context.Context) health.Status {
+	r.Lock()
+	running := r.running
+	r.Unlock()
+	if !running {
+		return health.Status{Ready: true, Message: "standing by while a director is active on this node"}
+	}
+	return r.reconcile.Status(ctx)
+}
+
 // ConfigureHAProxy uses haproxy as a bridge between a v6 address and a v4
 // pod address. This function iterates over the declared v6 configs and backends
 // for each, checks if any pods match that service selector, and creates a
@@ -439,14 +548,12 @@ func (r *realserver) periodic() error {
 // these are the pod ips, not the service IPs, to ensure traffic stays on-node
 // creates 1 config - per - ipv6addr + port pair
 func (r *realserver) ConfigureHAProxy() error {
+	return r.applyHAProxy(r.haproxyConfigs())
+}
 
-	// measure the time it took to do this operation
-	configureStartTime := time.Now()
-	defer func() {
-		configureDuration := time.Since(configureStartTime)
-		log.Println("realserver: HAProxy configuration took", configureDuration)
-	}()
-
+// haproxyConfigs builds the haproxy listener of each v6 VIP and port from
+// the cluster config.
+func (r *realserver) haproxyConfigs() []haproxy.VIPConfig {
 	configSet := []haproxy.VIPConfig{}
 	for ip, config := range r.watcher.ClusterConfig.Config6 {
 		// make a single haproxy server for each v6 VIP with all backends
@@ -503,6 +610,17 @@ func (r *realserver) ConfigureHAProxy() error {
 				}
 			}
 
+			// a listener that terminates tls is left out until its certificate can be read
+			var cert string
+			if service.TLSSecret != "" {
+				var err error
+				if cert, err = r.watcher.TLSCertificate(service.Namespace, service.TLSSecret); err != nil {
+					r.logger.Errorf("realserver: skipping haproxy config for [%s]:%s. %v", string(ip), port, err)
+					continue
+				}
+			}
+
+			l7Mode, routes := r.l7Routes(service, string(ip), port)
 			sort.Strings(ips)
 			haConfig := haproxy.VIPConfig{
 				Addr6:       string(ip),
@@ -510,6 +628,18 @@ func (r *realserver) ConfigureHAProxy() error {
 				TargetPort:  targetPortForService,
 				MTU:         mtu,
 				ServicePort: port,
+				Options: haproxy.ListenerOptions{
+					SendProxy:      service.ProxyProtocolEnabled,
+					AcceptProxy:    service.AcceptProxyProtocol,
+					TLSCertificate: cert,
+					HealthCheck:    r.healthCheck(service, string(ip), port),
+					Proxy:          r.v6Proxy(service, string(ip), port),
+					UDP:            service.UDPEnabled,
+					L7Mode:         l7Mode,
+					Routes:         routes,
+					Limits:         r.limits(service, string(ip), port),
+					LocalBackend:   r.localBackend(service, string(ip), port),
+				},
 			}
 			// guard against initializing watcher race condition and haproxy
 			// panics from 0-len lists
@@ -520,17 +650,41 @@ func (r *realserver) ConfigureHAProxy() error {
 		}
 	}
 
+	return configSet
+}
+
+// applyHAProxy configures a listener for each config, and stops the rest.
+func (r *realserver) applyHAProxy(configSet []haproxy.VIPConfig) error {
+
+	// measure the time it took to do this operation
+	configureStartTime := time.Now()
+	defer func() {
+		configureDuration := time.Since(configureStartTime)
+		log.Println("realserver: HAProxy configuration took", configureDuration)
+	}()
+
 	r.logger.Infof("realserver: got %d haproxy addresses to set", len(configSet))
 
+	// a listener whose change is rejected keeps running its previous
+	// configuration, so the rest are still configured and it isn't pruned
+	var configErr error
 	validSet := []string{}
+	certs := map[string]string{}
 	for _, cs := range configSet {
 		if err := r.haproxy.Configure(cs); err != nil {
-			return err
+			r.logger.Errorf("realserver: unable to configure haproxy for [%s]:%s. %v", cs.Addr6, cs.ServicePort, err)
+			if configErr == nil {
+				configErr = err
+			}
 		}
 
 		// create the new set of valid configurations
 		validSet = append(validSet, fmt.Sprintf("%s:%s", cs.Addr6, cs.ServicePort))
+		certs[fmt.Sprintf("%s:%s", cs.Addr6, cs.ServicePort)] = cs.Options.TLSCertificate
 	}
+	r.Lock()
+	r.certs = certs
+	r.Unlock()
 
 	// then get items to be removed
 	removalSet := r.haproxy.GetRemovals(validSet)
@@ -539,11 +693,12 @@ func (r *realserver) ConfigureHAProxy() error {
 		r.haproxy.StopOne(addr)
 	}
 
-	return nil
+	return configErr
 }
 
-// configure applies the desired realserver configuration to iptables
-func (r *realserver) configure() (error, int) {
+// configure applies the desired realserver configuration to iptables, or the
+// rules of warm, unless it is nil
+func (r *realserver) configure(ctx context.Context, warm *warmState) (error, int) {
 	if r.watcher.ClusterConfig == nil {
 		return fmt.Errorf("realserver: could not configure. cluster config is nil"), 0
 	}
@@ -567,24 +722,49 @@ func (r *realserver) configure() (error, int) {
 	removals := 0
 	r.logger.Debugf("realserver: setting addresses")
 	// add vip addresses to loopback
-	if err := r.setAddresses(); err != nil {
+	_, span := tracing.Start(ctx, "realserver.setAddresses")
+	phaseStart := time.Now()
+	err := r.setAddresses()
+	r.metrics.ReconfigurePhase(ctx, stats.PhaseAddresses, stats.FamilyV4, err, time.Since(phaseStart))
+	tracing.End(span, err)
+	if err != nil {
 		return err, removals
 	}
 
-	r.logger.Debugf("realserver: capturing existing iptables rules")
-	// generate and apply iptables rules
-	existing, err := r.iptables.Save()
-	if err != nil {
-		return err, removals
+	_, span = tracing.Start(ctx, "realserver.iptables")
+	phaseStart = time.Now()
+	if warm != nil {
+		err, removals = r.restoreIPTables(warm.rules)
+	} else {
+		err, removals = r.applyIPTables()
 	}
-	r.logger.Debugf("realserver: got %d existing rules", len(existing))
+	r.metrics.ReconfigurePhase(ctx, stats.PhaseIPTables, stats.FamilyV4, err, time.Since(phaseStart))
+	tracing.End(span, err)
+	return err, removals
+}
 
+// applyIPTables generates the iptables rules for this node, merges them with
+// the rules already present and restores the result
+func (r *realserver) applyIPTables() (error, int) {
 	// generate desired iptables configurations
 	generated, err := r.iptables.GenerateRulesForNodeClassic(r.watcher, r.nodeName, r.watcher.ClusterConfig, false)
 	if err != nil {
-		return err, removals
+		return err, 0
 	}
 	r.logger.Debugf("realserver: got %d generated rules", len(generated))
+	return r.restoreIPTables(generated)
+}
+
+// restoreIPTables merges the generated rules with the rules already present
+// and restores the result
+func (r *realserver) restoreIPTables(generated map[string]*iptables.RuleSet) (error, int) {
+	removals := 0
+	r.logger.Debugf("realserver: capturing existing iptables rules")
+	existing, err := r.iptables.Save()
+	if err != nil {
+		return err, removals
+	}
+	r.logger.Debugf("realserver: got %d existing rules", len(existing))
 
 	r.logger.Debugf("realserver: merging iptables rules")
 	merged, removals, err := r.iptables.Merge(generated, existing) // subset, all rules
@@ -616,11 +796,16 @@ func (r *realserver) configure() (error, int) {
 
 // configure6 configures the HAProxy deployment for ipv4 to ipv6 translation.
 // We omit iptables rules here, set v6 addresses on loopback
-func (r *realserver) configure6() (error, int) {
+func (r *realserver) configure6(ctx context.Context) (error, int) {
 
 	removals := 0
 	// add vip addresses to loopback
-	if err := r.setAddresses6(); err != nil {
+	_, span := tracing.Start(ctx, "realserver.setAddresses6")
+	phaseStart := time.Now()
+	err := r.setAddresses6()
+	r.metrics.ReconfigurePhase(ctx, stats.PhaseAddresses, stats.FamilyV6, err, time.Since(phaseStart))
+	tracing.End(span, err)
+	if err != nil {
 		return err, removals
 	}
 	return nil, removals
@@ -628,7 +813,14 @@ func (r *realserver) configure6() (error, int) {
 
 // checkConfigParity checks all the dummy interfaces and ensures that they are
 // properly configured and applied to iptables chains
-func (r *realserver) checkConfigParity() (bool, error) {
+func (r *realserver) checkConfigParity(ctx context.Context) (same bool, err error) {
+	_, span := tracing.Start(ctx, "realserver.checkConfigParity")
+	start := time.Now()
+	defer func() {
+		r.metrics.ReconfigurePhase(ctx, stats.PhaseParity, stats.FamilyAll, err, time.Since(start))
+		span.SetAttributes(attribute.Bool("parity", same))
+		tracing.End(span, err)
+	}()
 
 	// =======================================================
 	// == Perform check whether we're ready to start working
@@ -691,6 +883,9 @@ func (r *realserver) checkConfigParity() (bool, error) {
 	// TODO: check haproxy config parity? updates are forced on changes
 	// to the endpoints list. A v6 address on loopback is indicative of
 	// a successful config6() unless early exit
+	if r.certificatesRotated() {
+		return false, nil
+	}
 
 	// compare and return
 	if reflect.DeepEqual(vipsV4, addressesV4) &&
@@ -703,6 +898,31 @@ func (r *realserver) checkConfigParity() (bool, error) {
 	return false, nil
 }
 
+// certificatesRotated reports whether the tls secret of any v6 listener
+// holds a different certificate than the one haproxy serves.
+func (r *realserver) certificatesRotated() bool {
+	r.Lock()
+	applied := r.certs
+	r.Unlock()
+	for ip, config := range r.watcher.ClusterConfig.Config6 {
+		for port, service := range config {
+			if service == nil || service.TLSSecret == "" {
+				continue
+			}
+			key := fmt.Sprintf("%s:%s", ip, port)
+			cert, err := r.watcher.TLSCertificate(service.Namespace, service.TLSSecret)
+			if err != nil {
+				continue
+			}
+			if current, ok := applied[key]; ok && current != cert {
+				r.logger.Infof("realserver: tls secret %s of [%s]:%s has a new certificate", service.TLSSecret, string(ip), port)
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // setAddresses sets all the VIP addresses into iptables along with the proper MTUs
 func (r *realserver) setAddresses() error {
 
@@ -831,3 +1051,114 @@ func retrieveTargetPort(servicePort v1.ServicePort) string {
 		return string(servicePort.Port)
 	}
 }
+
+// v6Proxy returns the proxy a service picked for its listener, or empty for
+// the default.
+func (r *realserver) v6Proxy(service *types.ServiceDef, ip, port string) string {
+	switch service.V6Proxy {
+	case "", haproxy.ProxyHAProxy, haproxy.ProxyNative:
+		return service.V6Proxy
+	}
+	r.logger.Errorf("realserver: ignoring unknown v6 proxy %q of [%s]:%s", service.V6Proxy, ip, port)
+	return ""
+}
+
+// localBackend returns the local backend of a service, or empty if it has
+// none or it is invalid.
+func (r *realserver) localBackend(service *types.ServiceDef, ip, port string) string {
+	if err := haproxy.ValidateLocalBackend(service.LocalBackend); err != nil {
+		r.logger.Errorf("realserver: ignoring local backend of [%s]:%s. %v", ip, port, err)
+		return ""
+	}
+	return service.LocalBackend
+}
+
+// l7Routes converts the routes of a service for haproxy. A route goes to every
+// endpoint of its service, not only those on this node, as the directors send
+// the traffic of the VIP to the nodes of the listener's own service. A route
+// whose service has no endpoints is kept without pods, so that its host isn't
+// served by the listener's service instead.
+func (r *realserver) l7Routes(service *types.ServiceDef, ip, port string) (string, []haproxy.Route) {
+	if service.L7Mode == "" && len(service.Routes) == 0 {
+		return "", nil
+	}
+	routes := []haproxy.Route{}
+	for _, route := range service.Routes {
+		podIPs := []string{}
+		for _, address := range r.watcher.GetEndpointAddressesForService(route.Service, route.Namespace, route.PortName) {
+			podIPs = append(podIPs, address.IP)
+		}
+		sort.Strings(podIPs)
+		routes = append(routes, haproxy.Route{
+			Host:       route.Host,
+			PodIPs:     podIPs,
+			TargetPort: r.watcher.GetEndpointTargetPort(route.Service, route.Namespace, route.PortName),
+		})
+	}
+	if err := haproxy.ValidateL7(service.L7Mode, routes); err != nil {
+		r.logger.Errorf("realserver: ignoring l7 routes of [%s]:%s. %v", ip, port, err)
+		return "", nil
+	}
+	return service.L7Mode, routes
+}
+
+// limits converts the listener settings of a service for haproxy. A listener
+// whose settings are invalid keeps the defaults rather than being left out.
+func (r *realserver) limits(service *types.ServiceDef, ip, port string) haproxy.Limits {
+	if service.Listener == nil {
+		return haproxy.Limits{}
+	}
+	limits := haproxy.Limits{
+		MaxConn:      service.Listener.MaxConn,
+		TCPKeepAlive: service.Listener.TCPKeepAlive,
+	}
+	var err error
+	for _, timeout := range []struct {
+		value string
+		into  *time.Duration
+	}{
+		{service.Listener.ConnectTimeout, &limits.ConnectTimeout},
+		{service.Listener.ClientTimeout, &limits.ClientTimeout},
+		{service.Listener.ServerTimeout, &limits.ServerTimeout},
+		{service.Listener.HTTPKeepAliveTimeout, &limits.HTTPKeepAliveTimeout},
+	} {
+		if timeout.value != "" && err == nil {
+			*timeout.into, err = time.ParseDuration(timeout.value)
+		}
+	}
+	if err == nil {
+		err = limits.Validate()
+	}
+	if err != nil {
+		r.logger.Errorf("realserver: ignoring listener settings of [%s]:%s. %v", ip, port, err)
+		return haproxy.Limits{}
+	}
+	return limits
+}
+
+// healthCheck converts a service's health check for haproxy. A listener
+// whose check is invalid is configured without one rather than left out.
+func (r *realserver) healthCheck(service *types.ServiceDef, ip, port string) haproxy.HealthCheck {
+	if service.HealthCheck == nil {
+		return haproxy.HealthCheck{}
+	}
+	check := haproxy.HealthCheck{
+		Enabled:    true,
+		Rise:       service.HealthCheck.Rise,
+		Fall:       service.HealthCheck.Fall,
+		HTTPPath:   service.HealthCheck.HTTPPath,
+		HTTPExpect: service.HealthCheck.HTTPExpect,
+	}
+	var err error
+	if service.HealthCheck.Interval != "" {
+		check.Interval, err = time.ParseDuration(service.HealthCheck.Interval)
+	}
+	if err == nil {
+		err = check.Validate()
+	}
+	if err != nil {
+		r.logger.Errorf("realserver: ignoring health check of [%s]:%s. %v", ip, port, err)
+		return haproxy.HealthCheck{}
+	}
+	return check
+}
@@ -0,0 +1,144 @@
+package realserver
+
+import (
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/haproxy"
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/supervisor"
+	"github.com/Comcast/Ravel/pkg/tracing"
+)
+
+// A realserver stands by while a director is active on its node, and starts
+// once the director disappears. Starting from cold, it builds the iptables
+// rules and haproxy listeners of the node from the cluster config on the
+// first tick of its loop, which leaves the node's pods unserved for seconds.
+// A warm standby builds them every interval while it stands by instead, so
+// Start applies the configuration straight away, and only has to build it if
+// the cluster config was published again since. The addresses and ipv6 rules
+// are set as usual, as they depend on the node rather than on a build.
+//
+// The rules of a warm build also depend on the pods of the node, which can
+// change without a publish. The parity check of the first tick after Start
+// trues those up.
+
+// activation outcomes, as counted by outcome.
+const (
+	// activationWarm applied the configuration built while standing by
+	activationWarm = "warm"
+	// activationCold built the configuration on start
+	activationCold = "cold"
+)
+
+var activationsDef = stats.Define(stats.Definition{
+	Type:   stats.Counter,
+	Name:   "realserver_activations_total",
+	Help:   "is a count of the times a warm standby realserver started, by whether it applied a configuration built while standing by",
+	Labels: []string{"lb", "seczone", "outcome"},
+})
+
+// warmState is the configuration of the node built for one publish of the
+// cluster config.
+type warmState struct {
+	generation uint64
+	built      time.Time
+	rules      map[string]*iptables.RuleSet
+	haproxy    []haproxy.VIPConfig
+}
+
+// Standby pre-builds the configuration of the node every interval while the
+// realserver is stopped, until its context is done.
+func (r *realserver) Standby(interval time.Duration) {
+	r.Lock()
+	r.standby = true
+	r.Unlock()
+
+	// restart the loop if it panics
+	supervisor.Go(r.ctx, stats.KindIpvsBackend, "realserver.standby", r.logger, func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			r.prebuild()
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	})
+}
+
+// prebuild builds the configuration of the node for the cluster config
+// published last, unless the realserver is running.
+func (r *realserver) prebuild() {
+	r.Lock()
+	running := r.running
+	r.Unlock()
+	if running || r.watcher.ClusterConfig == nil {
+		return
+	}
+
+	generation, _ := r.watcher.Published()
+	start := time.Now()
+	rules, err := r.iptables.GenerateRulesForNodeClassic(r.watcher, r.nodeName, r.watcher.ClusterConfig, false)
+	if err != nil {
+		r.logger.Errorf("realserver: unable to pre-build iptables rules. %v", err)
+		return
+	}
+	warm := &warmState{
+		generation: generation,
+		built:      start,
+		rules:      rules,
+		haproxy:    r.haproxyConfigs(),
+	}
+	r.logger.Debugf("realserver: pre-built %d iptables chains and %d haproxy listeners for generation %d in %v", len(rules), len(warm.haproxy), generation, time.Since(start))
+
+	r.Lock()
+	r.warm = warm
+	r.Unlock()
+}
+
+// takeWarm returns the configuration built while standing by, or nil if the
+// cluster config was published since, and clears it.
+func (r *realserver) takeWarm() *warmState {
+	r.Lock()
+	warm := r.warm
+	r.warm = nil
+	r.Unlock()
+	if warm == nil {
+		return nil
+	}
+	if generation, _ := r.watcher.Published(); generation != warm.generation {
+		r.logger.Infof("realserver: discarding the configuration built for generation %d, as %d was published since", warm.generation, generation)
+		return nil
+	}
+	return warm
+}
+
+// activate applies the configuration of the node on Start, from the warm
+// state when it is current.
+func (r *realserver) activate() {
+	if r.watcher.ClusterConfig == nil {
+		return
+	}
+	start := time.Now()
+	ctx, span := r.startReconfigureSpan("activate")
+	warm := r.takeWarm()
+	outcome := activationCold
+	if warm != nil {
+		outcome = activationWarm
+	}
+	err := r.reconfigureWith(ctx, start, warm)
+	tracing.End(span, err)
+	activationsDef.CounterVec().WithLabelValues(string(stats.KindIpvsBackend), r.configKey, outcome).Inc()
+	if err != nil {
+		r.logger.Errorf("realserver: %s activation failed after %v. %v", outcome, time.Since(start), err)
+		return
+	}
+	if warm != nil {
+		r.logger.Infof("realserver: warm activation completed in %v, from a configuration built %v ago", time.Since(start), start.Sub(warm.built))
+		return
+	}
+	r.logger.Infof("realserver: cold activation completed in %v", time.Since(start))
+}
@@ -0,0 +1,289 @@
+package role
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// In auto mode, one DaemonSet runs everywhere and each process works out its
+// role from its node. The types.LabelRole label pins a node to a role. Any
+// other node is a candidate, and candidates elect the directors of the config
+// key between them: there are a fixed number of director slots, each a Lease
+// in the config map's namespace named ravel-role-<config key>-<slot>, and a
+// candidate that holds one directs while the rest run the realserver. A slot
+// whose director goes away expires and is taken by the next candidate to
+// look, so the roles move as nodes come and go.
+//
+// A process doesn't switch roles within itself. When its role changes, it
+// stops the one it runs, and either exits to be restarted in the new one, or
+// executes itself again in its place.
+
+// Roles a node can run.
+const (
+	Director   = "director"
+	BGP        = "bgp"
+	Colocated  = "colocated"
+	Realserver = "realserver"
+	// Candidate leaves the role to the election.
+	Candidate = "candidate"
+)
+
+// DefaultTTL is how long a director slot lasts without being renewed.
+const DefaultTTL = 15 * time.Second
+
+var slotDef = stats.Define(stats.Definition{
+	Type:   stats.Gauge,
+	Name:   "auto_director_slot",
+	Help:   "is the director slot an auto mode process holds, counting from 1, and 0 while it holds none",
+	Labels: []string{"seczone"},
+})
+
+// Of returns the role the labels of node pin it to, or Candidate.
+func Of(node *v1.Node) (string, error) {
+	switch value := node.Labels[types.LabelRole]; value {
+	case "":
+		return Candidate, nil
+	case Director, BGP, Colocated, Realserver, Candidate:
+		return value, nil
+	default:
+		return "", fmt.Errorf("node %s has role %q in label %s, which is not one of %s, %s, %s, %s or %s",
+			node.Name, value, types.LabelRole, Director, BGP, Colocated, Realserver, Candidate)
+	}
+}
+
+// record is the state of a slot.
+type record struct {
+	Holder  string
+	Renewed time.Time
+	TTL     time.Duration
+	// version guards updates against concurrent ones. It is blank while the
+	// slot doesn't exist.
+	version string
+}
+
+func (r record) expires() time.Time {
+	return r.Renewed.Add(r.TTL)
+}
+
+// store keeps a slot.
+type store interface {
+	get(ctx context.Context) (record, error)
+	// put writes the slot, failing if it changed since it was read.
+	put(ctx context.Context, r record) error
+}
+
+// Elector holds a director slot of a config key for a candidate.
+type Elector struct {
+	sync.Mutex
+	node  string
+	ttl   time.Duration
+	slots []store
+
+	slot    int
+	renewed time.Time
+
+	configKey string
+	gauge     prometheus.Gauge
+	logger    logging.Logger
+}
+
+// NewElector returns the elector of the candidate on node, for slots
+// directors of configKey kept in namespace.
+func NewElector(client kubernetes.Interface, namespace, configKey, node string, slots int, ttl time.Duration, logger logging.Logger) (*Elector, error) {
+	if slots < 1 {
+		return nil, fmt.Errorf("there must be at least one director slot")
+	}
+	if ttl < 3*time.Second {
+		return nil, fmt.Errorf("director slot ttl must be at least 3s")
+	}
+	stores := []store{}
+	for slot := 0; slot < slots; slot++ {
+		stores = append(stores, &leaseStore{client: client, namespace: namespace, name: leaseName(configKey, slot)})
+	}
+	return newElector(stores, configKey, node, ttl, logger), nil
+}
+
+func newElector(slots []store, configKey, node string, ttl time.Duration, logger logging.Logger) *Elector {
+	return &Elector{
+		node:      node,
+		ttl:       ttl,
+		slots:     slots,
+		slot:      -1,
+		configKey: configKey,
+		gauge:     slotDef.GaugeVec().WithLabelValues(configKey),
+		logger:    logger.WithFields(logging.Fields{"module": "role"}),
+	}
+}
+
+// Elect renews the slot the candidate holds, or claims a free one, and
+// reports whether it holds one.
+func (e *Elector) Elect(ctx context.Context) (bool, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	// a slot the candidate holds comes first, so that a restarted process
+	// takes its own back rather than a second one
+	var lastErr error
+	records := map[int]record{}
+	own, free := []int{}, []int{}
+	now := time.Now()
+	for slot := range e.slots {
+		r, err := e.slots[slot].get(ctx)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		records[slot] = r
+		switch {
+		case r.Holder == e.node:
+			own = append(own, slot)
+		case r.Holder != "" && now.Before(r.expires()):
+			if slot == e.slot {
+				e.logger.Errorf("role: director slot %d of config key %s was taken by %s", slot+1, e.configKey, r.Holder)
+				e.slot = -1
+			}
+		default:
+			free = append(free, slot)
+		}
+	}
+
+	for _, slot := range append(own, free...) {
+		r := records[slot]
+		r.Holder, r.Renewed, r.TTL = e.node, now, e.ttl
+		if err := e.slots[slot].put(ctx, r); err != nil {
+			lastErr = err
+			continue
+		}
+		if slot != e.slot {
+			e.logger.Infof("role: holding director slot %d of config key %s", slot+1, e.configKey)
+		}
+		e.slot, e.renewed = slot, now
+		e.gauge.Set(float64(slot + 1))
+		return true, nil
+	}
+
+	// a slot that couldn't be renewed is held until it expires
+	if e.slot >= 0 && time.Since(e.renewed) < e.ttl {
+		return true, lastErr
+	}
+	if e.slot >= 0 {
+		e.logger.Errorf("role: lost director slot %d of config key %s. %v", e.slot+1, e.configKey, lastErr)
+	}
+	e.slot = -1
+	e.gauge.Set(0)
+	return false, lastErr
+}
+
+// Release frees the slot the candidate holds, if it still does. Only call it
+// once the director has stopped.
+func (e *Elector) Release(ctx context.Context) error {
+	e.Lock()
+	defer e.Unlock()
+	if e.slot < 0 {
+		return nil
+	}
+	slot := e.slot
+	e.slot = -1
+	e.gauge.Set(0)
+
+	r, err := e.slots[slot].get(ctx)
+	if err != nil {
+		return err
+	}
+	if r.Holder != e.node {
+		return nil
+	}
+	r.Holder = ""
+	if err := e.slots[slot].put(ctx, r); err != nil {
+		return err
+	}
+	e.logger.Infof("role: released director slot %d of config key %s", slot+1, e.configKey)
+	return nil
+}
+
+// RenewInterval is how often a candidate holding a slot should call Elect.
+func (e *Elector) RenewInterval() time.Duration {
+	return e.ttl / 3
+}
+
+// invalidName matches what kubernetes doesn't allow in names.
+var invalidName = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// leaseName returns the name of a director slot of configKey.
+func leaseName(configKey string, slot int) string {
+	key := strings.Trim(invalidName.ReplaceAllString(strings.ToLower(configKey), "-"), "-.")
+	suffix := "-" + strconv.Itoa(slot)
+	name := "ravel-role-" + key
+	if len(name)+len(suffix) > 253 {
+		name = name[:253-len(suffix)]
+	}
+	return name + suffix
+}
+
+// leaseStore keeps a slot as a coordination.k8s.io Lease.
+type leaseStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func (s *leaseStore) get(ctx context.Context) (record, error) {
+	lease, err := s.client.CoordinationV1().Leases(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return record{}, nil
+	}
+	if err != nil {
+		return record{}, err
+	}
+	r := record{version: lease.ResourceVersion}
+	if lease.Spec.HolderIdentity != nil {
+		r.Holder = *lease.Spec.HolderIdentity
+	}
+	if lease.Spec.RenewTime != nil {
+		r.Renewed = lease.Spec.RenewTime.Time
+	}
+	if lease.Spec.LeaseDurationSeconds != nil {
+		r.TTL = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+	return r, nil
+}
+
+func (s *leaseStore) put(ctx context.Context, r record) error {
+	leases := s.client.CoordinationV1().Leases(s.namespace)
+	seconds := int32(r.TTL / time.Second)
+	renewed := metav1.NewMicroTime(r.Renewed)
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: s.name, Namespace: s.namespace, ResourceVersion: r.version},
+		Spec: coordinationv1.LeaseSpec{
+			LeaseDurationSeconds: &seconds,
+			RenewTime:            &renewed,
+		},
+	}
+	if r.Holder != "" {
+		lease.Spec.HolderIdentity = &r.Holder
+	}
+	if r.version == "" {
+		_, err := leases.Create(ctx, lease, metav1.CreateOptions{})
+		return err
+	}
+	// the resource version makes this fail if another candidate got there
+	// first
+	_, err := leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
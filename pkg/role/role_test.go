@@ -0,0 +1,101 @@
+package role
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// fakeStore keeps a slot in memory, refusing stale writes as the api server
+// would.
+type fakeStore struct {
+	sync.Mutex
+	r       record
+	version int
+}
+
+func (s *fakeStore) get(context.Context) (record, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.r, nil
+}
+
+func (s *fakeStore) put(_ context.Context, r record) error {
+	s.Lock()
+	defer s.Unlock()
+	if r.version != s.r.version {
+		return errors.New("conflict")
+	}
+	s.version++
+	r.version = strconv.Itoa(s.version)
+	s.r = r
+	return nil
+}
+
+func TestElector(t *testing.T) {
+	ctx := context.Background()
+	slots := []store{&fakeStore{}, &fakeStore{}}
+	a := newElector(slots, "green", "node-a", 15*time.Second, logging.New())
+	b := newElector(slots, "green", "node-b", 15*time.Second, logging.New())
+	c := newElector(slots, "green", "node-c", 15*time.Second, logging.New())
+
+	// two slots elect two directors, and the third candidate waits
+	for _, e := range []*Elector{a, b, a, b} {
+		if elected, err := e.Elect(ctx); !elected || err != nil {
+			t.Fatalf("expected %s to hold a slot, got %v", e.node, err)
+		}
+	}
+	if a.slot == b.slot {
+		t.Fatalf("expected node-a and node-b to hold different slots, both hold %d", a.slot)
+	}
+	if elected, _ := c.Elect(ctx); elected {
+		t.Fatal("expected node-c to wait for a slot")
+	}
+
+	// a restarted director takes its own slot back
+	restarted := newElector(slots, "green", "node-b", 15*time.Second, logging.New())
+	if elected, _ := restarted.Elect(ctx); !elected || restarted.slot != b.slot {
+		t.Fatalf("expected node-b to take slot %d back, got %d", b.slot, restarted.slot)
+	}
+
+	// a slot that is released, or expires, goes to the next candidate
+	if err := a.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elected, _ := c.Elect(ctx); !elected {
+		t.Fatal("expected node-c to take the slot of node-a")
+	}
+	s := slots[b.slot].(*fakeStore)
+	s.r.Renewed = time.Now().Add(-time.Minute)
+	d := newElector(slots, "green", "node-d", 15*time.Second, logging.New())
+	if elected, _ := d.Elect(ctx); !elected || d.slot != b.slot {
+		t.Fatal("expected node-d to take the expired slot of node-b")
+	}
+	if elected, _ := restarted.Elect(ctx); elected {
+		t.Fatal("expected node-b to have lost its slot")
+	}
+}
+
+func TestOf(t *testing.T) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "a", Labels: map[string]string{}}}
+	if r, err := Of(node); err != nil || r != Candidate {
+		t.Fatalf("expected an unlabelled node to be a candidate, got %s %v", r, err)
+	}
+	node.Labels[types.LabelRole] = BGP
+	if r, err := Of(node); err != nil || r != BGP {
+		t.Fatalf("expected the node to be pinned to bgp, got %s %v", r, err)
+	}
+	node.Labels[types.LabelRole] = "router"
+	if _, err := Of(node); err == nil {
+		t.Fatal("expected an unknown role to be refused")
+	}
+}
@@ -0,0 +1,63 @@
+package selfhealth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Comcast/Ravel/pkg/iptables"
+)
+
+// procDir is where the ipvs module is looked for.
+var procDir = "/proc"
+
+// IPVS fails while the ip_vs module isn't loaded.
+func IPVS() Check {
+	return Check{Name: "ipvs", Probe: func(context.Context) error {
+		if _, err := os.Stat(filepath.Join(procDir, "net/ip_vs")); err != nil {
+			return fmt.Errorf("the ip_vs module is not loaded. %v", err)
+		}
+		return nil
+	}}
+}
+
+// Interface fails while the interface called name is missing or down.
+func Interface(name string) Check {
+	return Check{Name: "interface", Probe: func(context.Context) error {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return err
+		}
+		if iface.Flags&net.FlagUp == 0 {
+			return fmt.Errorf("%s is down", name)
+		}
+		return nil
+	}}
+}
+
+// IPTables fails while the rules can't be read.
+func IPTables(ipt *iptables.IPTables) Check {
+	return Check{Name: "iptables", Probe: func(context.Context) error {
+		_, err := ipt.Save()
+		return err
+	}}
+}
+
+// crashLooper is the haproxy set, as it reports its crash looping listeners.
+type crashLooper interface {
+	CrashLooping() []string
+}
+
+// HAProxy fails while the haproxy of a listener keeps exiting soon after it
+// starts.
+func HAProxy(set crashLooper) Check {
+	return Check{Name: "haproxy", Probe: func(context.Context) error {
+		if looping := set.CrashLooping(); len(looping) != 0 {
+			return fmt.Errorf("haproxy is crash looping for %s", strings.Join(looping, ", "))
+		}
+		return nil
+	}}
+}
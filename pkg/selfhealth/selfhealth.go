@@ -0,0 +1,221 @@
+package selfhealth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// A node can be ready in kubernetes while its realserver can't serve the
+// traffic a director sends it: the ipvs module is missing, iptables fails,
+// the primary interface is down, or haproxy keeps crashing. The director only
+// sees the node, so the realserver checks itself, and once a check has failed
+// threshold times in a row, it sets the types.AnnotationRealServerUnhealthy
+// annotation on its node to the faults it found. Directors leave annotated
+// nodes out of their backends until the realserver removes the annotation,
+// which it does as soon as every check passes.
+//
+// The annotation is left in place when the realserver exits, as it may have
+// exited for the fault. A realserver that starts removes a stale one once it
+// finds its node healthy.
+
+var checkDef = stats.Define(stats.Definition{
+	Type:   stats.Gauge,
+	Name:   "realserver_self_health",
+	Help:   "is 1 while a self-health check of the realserver passes, and 0 while it fails",
+	Labels: []string{"lb", "seczone", "check"},
+})
+
+// Check is a self-health check of the realserver's node.
+type Check struct {
+	Name string
+	// Probe returns the fault it found, or nil.
+	Probe func(ctx context.Context) error
+}
+
+// store sets the annotation of the node.
+type store interface {
+	// annotate sets the annotation to value, or removes it when value is
+	// blank.
+	annotate(ctx context.Context, value string) error
+}
+
+// Monitor runs the self-health checks of a realserver and publishes their
+// outcome on its node.
+type Monitor struct {
+	sync.Mutex
+	checks    []Check
+	threshold int
+	store     store
+
+	failures  map[string]int
+	faults    map[string]string
+	synced    bool
+	published string
+	err       error
+
+	kind      stats.LBKind
+	configKey string
+	gauge     *prometheus.GaugeVec
+	logger    logging.Logger
+}
+
+// New returns the monitor of the realserver on node, which marks the node
+// unhealthy once a check failed threshold times in a row.
+func New(client kubernetes.Interface, node, configKey string, threshold int, kind stats.LBKind, logger logging.Logger, checks ...Check) (*Monitor, error) {
+	if threshold < 1 {
+		return nil, fmt.Errorf("self-health threshold must be at least 1")
+	}
+	return newMonitor(&nodeStore{client: client, node: node}, configKey, threshold, kind, logger, checks...), nil
+}
+
+func newMonitor(s store, configKey string, threshold int, kind stats.LBKind, logger logging.Logger, checks ...Check) *Monitor {
+	return &Monitor{
+		checks:    checks,
+		threshold: threshold,
+		store:     s,
+		failures:  map[string]int{},
+		faults:    map[string]string{},
+		kind:      kind,
+		configKey: configKey,
+		gauge:     checkDef.GaugeVec(),
+		logger:    logger.WithFields(logging.Fields{"module": "selfhealth"}),
+	}
+}
+
+// Run checks the node every interval until ctx is done.
+func (m *Monitor) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		m.evaluate(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// evaluate runs every check once, and publishes the faults when they changed.
+func (m *Monitor) evaluate(ctx context.Context) {
+	for _, c := range m.checks {
+		err := c.Probe(ctx)
+		m.Lock()
+		if err == nil {
+			if _, failing := m.faults[c.Name]; failing {
+				m.logger.Infof("selfhealth: %s recovered", c.Name)
+			}
+			delete(m.faults, c.Name)
+			m.failures[c.Name] = 0
+		} else {
+			m.failures[c.Name]++
+			if m.failures[c.Name] >= m.threshold {
+				if _, failing := m.faults[c.Name]; !failing {
+					m.logger.Errorf("selfhealth: %s failed %d times in a row. %v", c.Name, m.failures[c.Name], err)
+				}
+				m.faults[c.Name] = err.Error()
+			} else {
+				m.logger.Warnf("selfhealth: %s failed, %d/%d. %v", c.Name, m.failures[c.Name], m.threshold, err)
+			}
+		}
+		_, failing := m.faults[c.Name]
+		m.Unlock()
+
+		v := 1.0
+		if failing {
+			v = 0
+		}
+		m.gauge.WithLabelValues(string(m.kind), m.configKey, c.Name).Set(v)
+	}
+
+	m.Lock()
+	value, synced, published := m.value(), m.synced, m.published
+	m.Unlock()
+	if synced && value == published {
+		return
+	}
+	err := m.store.annotate(ctx, value)
+	m.Lock()
+	defer m.Unlock()
+	m.err = err
+	if err != nil {
+		m.logger.Errorf("selfhealth: unable to publish the health of the node. %v", err)
+		return
+	}
+	m.synced, m.published = true, value
+	if value == "" {
+		m.logger.Info("selfhealth: the node is healthy")
+	} else {
+		m.logger.Errorf("selfhealth: marked the node unhealthy: %s", value)
+	}
+}
+
+// value returns the annotation for the current faults, sorted by check, or
+// blank when there are none.
+func (m *Monitor) value() string {
+	names := make([]string, 0, len(m.faults))
+	for name := range m.faults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	faults := make([]string, 0, len(names))
+	for _, name := range names {
+		faults = append(faults, name+": "+m.faults[name])
+	}
+	return strings.Join(faults, "; ")
+}
+
+// Health reports the faults published on the node. It fails while the node
+// is marked unhealthy, or its health couldn't be published.
+func (m *Monitor) Health(context.Context) health.Status {
+	m.Lock()
+	defer m.Unlock()
+	switch {
+	case m.err != nil:
+		return health.Status{Ready: false, Message: "unable to publish the health of the node: " + m.err.Error()}
+	case m.published != "":
+		return health.Status{Ready: false, Message: "marked unhealthy: " + m.published}
+	case !m.synced:
+		return health.Status{Ready: true, Message: "not yet checked"}
+	}
+	return health.Status{Ready: true, Message: "healthy"}
+}
+
+// nodeStore keeps the annotation on the kubernetes node.
+type nodeStore struct {
+	client kubernetes.Interface
+	node   string
+}
+
+func (s *nodeStore) annotate(ctx context.Context, value string) error {
+	// a merge patch with a null value removes the annotation
+	var annotation interface{}
+	if value != "" {
+		annotation = value
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{types.AnnotationRealServerUnhealthy: annotation},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.client.CoreV1().Nodes().Patch(ctx, s.node, k8stypes.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
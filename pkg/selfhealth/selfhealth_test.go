@@ -0,0 +1,88 @@
+package selfhealth
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// fakeStore records the annotations published on the node.
+type fakeStore struct {
+	values []string
+	err    error
+}
+
+func (f *fakeStore) annotate(_ context.Context, value string) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.values = append(f.values, value)
+	return nil
+}
+
+func TestMonitor(t *testing.T) {
+	ctx := context.Background()
+	var fault error
+	s := &fakeStore{}
+	m := newMonitor(s, "green", 2, stats.KindIpvsBackend, logging.New(), Check{Name: "ipvs", Probe: func(context.Context) error { return fault }})
+
+	// a stale annotation is removed at the first check
+	m.evaluate(ctx)
+	if len(s.values) != 1 || s.values[0] != "" {
+		t.Fatalf("expected the annotation to be removed at start, saw %q", s.values)
+	}
+
+	// a fault is only published once it reached the threshold
+	fault = errors.New("not loaded")
+	m.evaluate(ctx)
+	if len(s.values) != 1 || !m.Health(ctx).Ready {
+		t.Fatalf("expected a single failure to be held back, saw %q", s.values)
+	}
+	m.evaluate(ctx)
+	m.evaluate(ctx)
+	if len(s.values) != 2 || s.values[1] != "ipvs: not loaded" || m.Health(ctx).Ready {
+		t.Fatalf("expected the fault to be published once, saw %q", s.values)
+	}
+
+	// a failed publish is retried
+	fault, s.err = nil, errors.New("forbidden")
+	m.evaluate(ctx)
+	if status := m.Health(ctx); status.Ready {
+		t.Fatalf("expected the failed publish to be reported, saw %+v", status)
+	}
+	s.err = nil
+	m.evaluate(ctx)
+	if len(s.values) != 3 || s.values[2] != "" || !m.Health(ctx).Ready {
+		t.Fatalf("expected the recovery to be published, saw %q", s.values)
+	}
+}
+
+func TestIPVS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "selfhealth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	procDir = dir
+	defer func() { procDir = "/proc" }()
+
+	check := IPVS()
+	if err := check.Probe(context.Background()); err == nil {
+		t.Fatal("expected the missing module to fail")
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "net"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "net/ip_vs"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := check.Probe(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
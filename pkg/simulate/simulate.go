@@ -0,0 +1,369 @@
+package simulate
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/bgp"
+	"github.com/Comcast/Ravel/pkg/diagnose"
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// Simulating a cluster config works out the changes a mode would make to a
+// node to bring it to the config, without making any: the same helpers that
+// generate and merge the rules of a reconfigure are run against the state of
+// the node, as the commands a reconfigure reads it with print it. The state
+// is read from the node, or from a support bundle of ravel diagnose taken on
+// it, so that a config can be checked against a node from anywhere.
+
+// State is what ravel manages on a node. A part that wasn't captured is nil.
+type State struct {
+	// IPVS is the output of ipvsadm -Sn
+	IPVS []byte
+	// IPTables is the output of iptables-save
+	IPTables []byte
+	// Links is the output of ip -details link show
+	Links []byte
+	// RIB is the output of gobgp global rib -a by family, ipv4 or ipv6
+	RIB map[string][]byte
+}
+
+// stateFiles are the files of a support bundle each part of the state is in.
+var stateFiles = map[string]string{
+	"ipvs":     "node/ipvsadm-save.txt",
+	"iptables": "node/iptables-save.txt",
+	"links":    "node/ip-link.txt",
+	"ipv4":     "bgp/rib-ipv4.txt",
+	"ipv6":     "bgp/rib-ipv6.txt",
+}
+
+// Subsystems returns the subsystems that mode reconciles, or nil for an
+// unknown mode.
+func Subsystems(mode string) []string {
+	switch mode {
+	case stats.KindIpvsMaster:
+		return []string{audit.SubsystemInterface, audit.SubsystemIPVS, audit.SubsystemIPTables}
+	case stats.KindIpvsBackend:
+		return []string{audit.SubsystemInterface, audit.SubsystemIPTables}
+	case stats.KindBGPDirector:
+		return []string{audit.SubsystemInterface, audit.SubsystemIPVS, audit.SubsystemBGP}
+	}
+	return nil
+}
+
+// Live reads the state of this node that mode reconciles, using gobgp for the
+// RIB of a bgp director.
+func Live(ctx context.Context, mode, gobgp string) (State, error) {
+	state := State{}
+	run := func(command string, args ...string) ([]byte, error) {
+		cmdCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
+		defer cancel()
+		out, err := exec.CommandContext(cmdCtx, command, args...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", strings.Join(append([]string{command}, args...), " "), err)
+		}
+		return out, nil
+	}
+
+	var err error
+	for _, subsystem := range Subsystems(mode) {
+		switch subsystem {
+		case audit.SubsystemInterface:
+			state.Links, err = run("ip", "-details", "link", "show")
+		case audit.SubsystemIPVS:
+			state.IPVS, err = run("ipvsadm", "-Sn")
+		case audit.SubsystemIPTables:
+			state.IPTables, err = run("iptables-save")
+		case audit.SubsystemBGP:
+			state.RIB = map[string][]byte{}
+			for _, family := range []string{"ipv4", "ipv6"} {
+				if state.RIB[family], err = run(gobgp, "global", "rib", "-a", family); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return State{}, err
+		}
+	}
+	return state, nil
+}
+
+// ReadBundle reads the state of a node from a support bundle of ravel
+// diagnose. The items that couldn't be collected are left out.
+func ReadBundle(r io.Reader) (State, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return State{}, fmt.Errorf("not a support bundle. %v", err)
+	}
+	defer gz.Close()
+
+	// files are keyed by their path under the directory of the bundle
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return State{}, fmt.Errorf("unable to read the support bundle. %v", err)
+		}
+		parts := strings.SplitN(hdr.Name, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return State{}, fmt.Errorf("unable to read %s from the support bundle. %v", hdr.Name, err)
+		}
+		files[parts[1]] = b
+	}
+
+	manifest := diagnose.Manifest{}
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		return State{}, fmt.Errorf("the support bundle has no valid manifest. %v", err)
+	}
+	for _, e := range manifest.Failed() {
+		delete(files, e.Name)
+	}
+
+	state := State{
+		IPVS:     files[stateFiles["ipvs"]],
+		IPTables: files[stateFiles["iptables"]],
+		Links:    files[stateFiles["links"]],
+	}
+	for _, family := range []string{"ipv4", "ipv6"} {
+		if b, ok := files[stateFiles[family]]; ok {
+			if state.RIB == nil {
+				state.RIB = map[string][]byte{}
+			}
+			state.RIB[family] = b
+		}
+	}
+	return state, nil
+}
+
+// Helpers are the helpers of a mode, configured as the mode configures them.
+type Helpers struct {
+	IP       *system.IP
+	IPVS     *system.IPVS
+	IPTables *iptables.IPTables
+}
+
+// Change is a change a mode would make to the node.
+type Change struct {
+	Subsystem string `json:"subsystem"`
+	Action    string `json:"action"`
+	Target    string `json:"target"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+func (c Change) String() string {
+	s := fmt.Sprintf("%s: %s %s", c.Subsystem, c.Action, c.Target)
+	if c.Detail != "" {
+		s += " (" + c.Detail + ")"
+	}
+	return s
+}
+
+// SubsystemConfig is the cluster config itself, for the changes of a config
+// from the one it replaces.
+const SubsystemConfig = "config"
+
+// ConfigChanges returns how config differs from base, the config it
+// replaces, as changes of SubsystemConfig.
+func ConfigChanges(base, config *types.ClusterConfig) []Change {
+	changes := []Change{}
+	for _, c := range types.Diff(base, config) {
+		change := Change{Subsystem: SubsystemConfig, Action: c.Op}
+		switch c.Kind {
+		case types.ChangeVIP:
+			change.Target = "vip " + c.VIP
+		case types.ChangePort:
+			change.Target = "port " + net.JoinHostPort(c.VIP, c.Port)
+		case types.ChangeOption:
+			change.Target = net.JoinHostPort(c.VIP, c.Port) + " " + c.Field
+		default:
+			change.Target = c.Field
+		}
+		switch {
+		case c.Kind == types.ChangeVIP || c.Kind == types.ChangePort:
+		case c.Op == types.ChangeAdded:
+			change.Detail = c.New
+		case c.Op == types.ChangeRemoved:
+			change.Detail = c.Old
+		default:
+			change.Detail = c.Old + " -> " + c.New
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// Plan returns the changes mode would make to a node in state, as nodeName,
+// to bring it to config in the cluster of w, which holds config as its
+// cluster config.
+func Plan(mode, nodeName string, state State, w *watcher.Watcher, config *types.ClusterConfig, h Helpers) ([]Change, error) {
+	subsystems := Subsystems(mode)
+	if subsystems == nil {
+		return nil, fmt.Errorf("unknown mode %s. must be one of %s|%s|%s", mode, stats.KindBGPDirector, stats.KindIpvsMaster, stats.KindIpvsBackend)
+	}
+	changes := []Change{}
+	for _, subsystem := range subsystems {
+		planned, err := PlanSubsystem(subsystem, mode, nodeName, state, w, config, h)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, planned...)
+	}
+	return changes, nil
+}
+
+// PlanSubsystem returns the changes mode would make to one of its subsystems,
+// as Plan does.
+func PlanSubsystem(subsystem, mode, nodeName string, state State, w *watcher.Watcher, config *types.ClusterConfig, h Helpers) ([]Change, error) {
+	families := []string{"ipv4", "ipv6"}
+	if mode == stats.KindIpvsMaster {
+		// a director only configures v4
+		families = families[:1]
+	}
+	var planned []Change
+	var err error
+	switch subsystem {
+	case audit.SubsystemInterface:
+		planned, err = planDevices(state, config, h.IP, families)
+	case audit.SubsystemIPVS:
+		planned, err = planIPVS(state, w, config, h.IPVS, families)
+	case audit.SubsystemIPTables:
+		// a director weights the rules of each service by its share of
+		// the endpoints, and a realserver doesn't
+		planned, err = planIPTables(state, w, nodeName, config, h.IPTables, mode == stats.KindIpvsMaster)
+	case audit.SubsystemBGP:
+		planned, err = planBGP(state, config, families)
+	default:
+		err = fmt.Errorf("unknown subsystem")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", subsystem, err)
+	}
+	return planned, nil
+}
+
+// planDevices returns the VIP devices that would be added and removed.
+func planDevices(state State, config *types.ClusterConfig, ip *system.IP, families []string) ([]Change, error) {
+	if state.Links == nil {
+		return nil, fmt.Errorf("the devices of the node weren't captured")
+	}
+	v4, v6 := ip.ParseDevices(state.Links)
+	changes := []Change{}
+	for _, family := range families {
+		configured, vips, isV6 := v4, config.Config, false
+		if family == "ipv6" {
+			configured, vips, isV6 = v6, config.Config6, true
+		}
+		desired := []string{}
+		addrs := map[string]string{}
+		for vip := range vips {
+			device := ip.Device(string(vip), isV6)
+			desired = append(desired, device)
+			addrs[device] = string(vip)
+		}
+		removals, additions := ip.Compare(configured, desired, isV6)
+		sort.Strings(removals)
+		sort.Strings(additions)
+		for _, device := range removals {
+			changes = append(changes, Change{Subsystem: audit.SubsystemInterface, Action: "del", Target: device})
+		}
+		for _, device := range additions {
+			changes = append(changes, Change{Subsystem: audit.SubsystemInterface, Action: "add", Target: device, Detail: addrs[device]})
+		}
+	}
+	return changes, nil
+}
+
+// planIPVS returns the ipvsadm rules that would be applied.
+func planIPVS(state State, w *watcher.Watcher, config *types.ClusterConfig, ipvs *system.IPVS, families []string) ([]Change, error) {
+	if state.IPVS == nil {
+		return nil, fmt.Errorf("the ipvs rules of the node weren't captured")
+	}
+	v4, v6 := system.ParseIPVS(state.IPVS)
+	changes := []Change{}
+	for _, family := range families {
+		configured := v4
+		if family == "ipv6" {
+			configured = v6
+		}
+		rules, err := ipvs.Plan(w, config, configured, family)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			action, target := system.RuleAction(rule)
+			changes = append(changes, Change{Subsystem: audit.SubsystemIPVS, Action: action, Target: target})
+		}
+	}
+	return changes, nil
+}
+
+// planIPTables returns the chains of the nat table a restore would change.
+func planIPTables(state State, w *watcher.Watcher, nodeName string, config *types.ClusterConfig, ipt *iptables.IPTables, weighted bool) ([]Change, error) {
+	if state.IPTables == nil {
+		return nil, fmt.Errorf("the iptables rules of the node weren't captured")
+	}
+	generated, err := ipt.GenerateRulesForNodeClassic(w, nodeName, config, weighted)
+	if err != nil {
+		return nil, err
+	}
+	merged, chains, err := ipt.Plan(state.IPTables, generated)
+	if err != nil {
+		return nil, err
+	}
+	changes := []Change{}
+	for _, chain := range chains {
+		detail := "removed"
+		if set, ok := merged[chain]; ok {
+			detail = fmt.Sprintf("%d rules", len(set.Rules))
+		}
+		changes = append(changes, Change{Subsystem: audit.SubsystemIPTables, Action: "restore", Target: "nat/" + chain, Detail: detail})
+	}
+	return changes, nil
+}
+
+// planBGP returns the routes that would be announced.
+func planBGP(state State, config *types.ClusterConfig, families []string) ([]Change, error) {
+	changes := []Change{}
+	for _, family := range families {
+		rib, ok := state.RIB[family]
+		if !ok {
+			return nil, fmt.Errorf("the %s RIB of the node wasn't captured", family)
+		}
+		vips := config.Config
+		if family == "ipv6" {
+			vips = config.Config6
+		}
+		addrs := []string{}
+		for vip := range vips {
+			addrs = append(addrs, string(vip))
+		}
+		for _, prefix := range bgp.Announcements(rib, family, addrs) {
+			changes = append(changes, Change{Subsystem: audit.SubsystemBGP, Action: "announce", Target: prefix})
+		}
+	}
+	return changes, nil
+}
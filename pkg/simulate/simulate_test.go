@@ -0,0 +1,130 @@
+package simulate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Comcast/Ravel/pkg/diagnose"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+const candidate = `{
+	"vipPool": [],
+	"config": {"10.54.213.150": {"443": {"namespace": "web", "service": "frontend", "portName": "https", "tcpEnabled": true, "ipvsOptions": {"scheduler": "mh"}}}},
+	"config6": {}
+}`
+
+const links = `1: lo: <LOOPBACK,UP,LOWER_UP> mtu 65536 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000
+    link/loopback 00:00:00:00:00:00 brd 00:00:00:00:00:00 promiscuity 0
+29: 10_54_213_148: <BROADCAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000
+    link/ether 5a:b2:1e:4f:0c:11 brd ff:ff:ff:ff:ff:ff promiscuity 0
+    dummy addrgenmode eui64 numtxqueues 1 numrxqueues 1 gso_max_size 65536 gso_max_segs 65535
+`
+
+const rib = `   Network              Next Hop             AS_PATH              Age        Attrs
+*> 10.54.213.148/32     0.0.0.0                                   00:00:21   [{Origin: ?}]
+`
+
+func TestPlan(t *testing.T) {
+	logger := logging.New()
+	node := "lb01"
+	services := []v1.Service{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "frontend"},
+		Spec:       v1.ServiceSpec{ClusterIP: "10.96.0.10"},
+	}}
+	endpoints := []v1.Endpoints{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "frontend"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "10.244.1.5", NodeName: &node}},
+			Ports:     []v1.EndpointPort{{Name: "https", Port: 8443}},
+		}},
+	}}
+	nodes := []v1.Node{{
+		ObjectMeta: metav1.ObjectMeta{Name: node},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.131.153.76"}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+		},
+	}}
+	w := watcher.NewStaticWatcher("prod", "", 0, services, endpoints, nil, nodes, logger)
+	config, err := w.Build(&v1.ConfigMap{Data: map[string]string{"prod": candidate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip, _ := system.NewIP(context.Background(), "lo", "", 0, 0, logger)
+	ipvs, _ := system.NewIPVS(context.Background(), "10.131.153.70", false, false, logger, "bgp")
+	state := State{IPVS: []byte{}, Links: []byte(links), RIB: map[string][]byte{"ipv4": []byte(rib), "ipv6": {}}}
+	changes, err := Plan("bgp", node, state, w, config, Helpers{IP: ip, IPVS: ipvs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Change{
+		{Subsystem: "interface", Action: "del", Target: "10.54.213.148"},
+		{Subsystem: "interface", Action: "add", Target: "10_54_213_150", Detail: "10.54.213.150"},
+		{Subsystem: "ipvs", Action: "add", Target: "-t 10.54.213.150:443 -s mh -b flag-1,flag-2"},
+		{Subsystem: "ipvs", Action: "add", Target: "-t 10.54.213.150:443 -r 10.131.153.76:443 -g -w 1"},
+		{Subsystem: "bgp", Action: "announce", Target: "10.54.213.150/32"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("expected %v, got %v", expected, changes)
+	}
+
+	if _, err := Plan("bgp", node, State{Links: []byte(links)}, w, config, Helpers{IP: ip, IPVS: ipvs}); err == nil {
+		t.Fatal("expected an error for ipvs rules that weren't captured")
+	}
+}
+
+func TestReadBundle(t *testing.T) {
+	items := []diagnose.Item{
+		diagnose.Bytes("node/ipvsadm-save.txt", []byte("-A -t 10.54.213.148:443 -s mh\n")),
+		diagnose.Bytes("node/ip-link.txt", []byte(links)),
+		{Name: "node/iptables-save.txt", Collect: func(context.Context) ([]byte, error) {
+			return []byte("partial"), errors.New("iptables-save: exit status 1")
+		}},
+		diagnose.Bytes("bgp/rib-ipv4.txt", []byte(rib)),
+	}
+	var b bytes.Buffer
+	if _, err := diagnose.Write(context.Background(), &b, "bundle", items, diagnose.NewRedactor()); err != nil {
+		t.Fatal(err)
+	}
+	state, err := ReadBundle(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(state.IPVS) != "-A -t 10.54.213.148:443 -s mh\n" || string(state.Links) != links {
+		t.Fatalf("expected the ipvs rules and links read, got %+v", state)
+	}
+	if state.IPTables != nil {
+		t.Fatalf("expected the iptables rules that failed to be collected left out, got %q", state.IPTables)
+	}
+	if _, ok := state.RIB["ipv6"]; ok || string(state.RIB["ipv4"]) != rib {
+		t.Fatalf("expected only the v4 RIB read, got %v", state.RIB)
+	}
+}
+
+func TestConfigChanges(t *testing.T) {
+	base := &types.ClusterConfig{Config: map[types.ServiceIP]types.PortMap{
+		"10.54.213.148": {"443": &types.ServiceDef{Namespace: "web", Service: "frontend", PortName: "https"}},
+		"10.54.213.150": {"443": &types.ServiceDef{Namespace: "web", Service: "frontend", PortName: "https", IPVSOptions: types.IPVSOptions{RawScheduler: "wrr"}}},
+	}}
+	config := &types.ClusterConfig{Config: map[types.ServiceIP]types.PortMap{
+		"10.54.213.150": {"443": &types.ServiceDef{Namespace: "web", Service: "frontend", PortName: "https", IPVSOptions: types.IPVSOptions{RawScheduler: "mh"}}},
+	}}
+	expected := []Change{
+		{Subsystem: SubsystemConfig, Action: "removed", Target: "vip 10.54.213.148"},
+		{Subsystem: SubsystemConfig, Action: "modified", Target: "10.54.213.150:443 ipvsOptions.scheduler", Detail: `"wrr" -> "mh"`},
+	}
+	if got := ConfigChanges(base, config); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v. saw %v", expected, got)
+	}
+}
@@ -0,0 +1,308 @@
+package snmp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+// The agent exposes load balancer state to SNMP-only monitoring as an
+// AgentX subagent of the host's snmpd. snmpd remains responsible for
+// communities, v3 users and access control; the agent registers a single
+// subtree and answers reads of it from a snapshot taken by a Source.
+
+const (
+	// DefaultMaster is where net-snmp listens for subagents by default.
+	DefaultMaster = "unix:/var/agentx/master"
+
+	// requestTimeout is the time the master waits on us before giving up on
+	// a request, in seconds.
+	requestTimeout = 5
+
+	maxReconnectDelay = 30 * time.Second
+)
+
+// Source returns the current state to expose.
+type Source func(ctx context.Context) (Snapshot, error)
+
+// Config describes the agent.
+type Config struct {
+	// Master is the address of the master agent, as unix:<path>,
+	// tcp:<host>:<port> or a bare host:port.
+	Master string
+	// Root is the OID under which the subtree is registered.
+	Root OID
+	// CacheTTL is how long a snapshot is served before a new one is taken,
+	// so that a walk doesn't query ipvs and gobgp once per row.
+	CacheTTL time.Duration
+}
+
+// Agent is an AgentX subagent.
+type Agent struct {
+	config Config
+	source Source
+	start  time.Time
+
+	mu       sync.Mutex
+	view     view
+	viewTime time.Time
+
+	logger logging.Logger
+}
+
+// New returns an agent. It does nothing until Run is called.
+func New(config Config, source Source, logger logging.Logger) (*Agent, error) {
+	if len(config.Root) == 0 {
+		return nil, fmt.Errorf("snmp: a root oid is required")
+	}
+	if _, _, err := masterAddress(config.Master); err != nil {
+		return nil, err
+	}
+	return &Agent{
+		config: config,
+		source: source,
+		start:  time.Now(),
+		logger: logger.WithField("component", "snmp"),
+	}, nil
+}
+
+// Run connects to the master and serves requests until ctx is canceled,
+// reconnecting whenever the session is lost.
+func (a *Agent) Run(ctx context.Context) {
+	delay := time.Duration(0)
+	for {
+		err := a.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// increment the reconnect delay by 1 second, up to 30 seconds max
+		if delay < maxReconnectDelay {
+			delay += time.Second
+		}
+		a.logger.Warnf("agentx session with %s ended, reconnecting in %v. %v", a.config.Master, delay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// session opens a session with the master, registers the subtree and serves
+// requests until the connection fails or ctx is canceled.
+func (a *Agent) session(ctx context.Context) error {
+	network, address, _ := masterAddress(a.config.Master)
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	s := &session{conn: conn}
+	if err := s.open(a.config.Root); err != nil {
+		return err
+	}
+	if err := s.register(a.config.Root); err != nil {
+		return err
+	}
+	a.logger.Infof("registered %s with agentx master %s", a.config.Root, a.config.Master)
+
+	// close the session when shutting down, which also unblocks the read
+	// below.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.close()
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		h, payload, err := readPDU(conn)
+		if err != nil {
+			return err
+		}
+		if err := a.handle(ctx, s, h, payload); err != nil {
+			return err
+		}
+	}
+}
+
+// handle answers a request from the master.
+func (a *Agent) handle(ctx context.Context, s *session, h header, payload []byte) error {
+	r := response{SysUpTime: a.uptime()}
+	d := newDecoder(h, payload)
+
+	switch h.Type {
+	case pduGet:
+		d.context(h)
+		ranges := d.searchRanges()
+		v := a.snapshot(ctx)
+		for _, sr := range ranges {
+			r.Varbinds = append(r.Varbinds, v.get(sr.Start))
+		}
+	case pduGetNext:
+		d.context(h)
+		ranges := d.searchRanges()
+		v := a.snapshot(ctx)
+		for _, sr := range ranges {
+			r.Varbinds = append(r.Varbinds, v.next(sr))
+		}
+	case pduGetBulk:
+		d.context(h)
+		nonRepeaters, maxRepetitions := d.uint16(), d.uint16()
+		ranges := d.searchRanges()
+		r.Varbinds = a.snapshot(ctx).bulk(ranges, int(nonRepeaters), int(maxRepetitions))
+	case pduTestSet:
+		// the subtree is read-only.
+		r.Error, r.Index = errNotWritable, 1
+	case pduCommitSet, pduUndoSet, pduCleanupSet:
+		// a refused TestSet is followed by a CleanupSet, which has no
+		// response.
+		return nil
+	case pduClose:
+		return fmt.Errorf("master closed the session")
+	case pduResponse:
+		return nil
+	default:
+		a.logger.Debugf("ignoring agentx pdu type %d", h.Type)
+		return nil
+	}
+	if d.err != nil {
+		a.logger.Warnf("unable to parse agentx pdu type %d. %v", h.Type, d.err)
+		r = response{SysUpTime: r.SysUpTime, Error: errParse}
+	}
+
+	h.Type = pduResponse
+	body, err := r.encode()
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.Write(pdu(h, body))
+	return err
+}
+
+// snapshot returns the current view, taking a new snapshot when the cached
+// one has expired. A failed snapshot serves the previous view, if any.
+func (a *Agent) snapshot(ctx context.Context) view {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.view != nil && time.Since(a.viewTime) < a.config.CacheTTL {
+		return a.view
+	}
+
+	s, err := a.source(ctx)
+	if err != nil {
+		a.logger.Warnf("unable to take snapshot for snmp. %v", err)
+		if a.view == nil {
+			a.view = newView(a.config.Root, s)
+		}
+		return a.view
+	}
+	a.view = newView(a.config.Root, s)
+	a.viewTime = time.Now()
+	return a.view
+}
+
+// uptime returns the time since the agent started in hundredths of a second.
+func (a *Agent) uptime() uint32 {
+	return uint32(time.Since(a.start) / (10 * time.Millisecond))
+}
+
+// session is the client side of an AgentX session.
+type session struct {
+	conn     net.Conn
+	id       uint32
+	packetID uint32
+}
+
+// request sends a PDU and waits for its response.
+func (s *session) request(typ, flags uint8, payload []byte) (response, error) {
+	s.packetID++
+	h := header{Type: typ, Flags: flags, SessionID: s.id, PacketID: s.packetID}
+	s.conn.SetDeadline(time.Now().Add(requestTimeout * time.Second))
+	defer s.conn.SetDeadline(time.Time{})
+
+	if _, err := s.conn.Write(pdu(h, payload)); err != nil {
+		return response{}, err
+	}
+	rh, body, err := readPDU(s.conn)
+	if err != nil {
+		return response{}, err
+	}
+	if rh.Type != pduResponse || rh.PacketID != s.packetID {
+		return response{}, fmt.Errorf("unexpected agentx pdu type %d for packet %d", rh.Type, rh.PacketID)
+	}
+	r, err := decodeResponse(rh, body)
+	if err != nil {
+		return response{}, err
+	}
+	if r.Error != errNone {
+		return r, fmt.Errorf("agentx request type %d failed with error %d", typ, r.Error)
+	}
+	if typ == pduOpen {
+		s.id = rh.SessionID
+	}
+	return r, nil
+}
+
+func (s *session) open(root OID) error {
+	e := &encoder{}
+	e.uint8(requestTimeout)
+	e.Write([]byte{0, 0, 0})
+	e.oid(root, false)
+	e.octets([]byte("ravel load balancer"))
+	_, err := s.request(pduOpen, 0, e.Bytes())
+	return err
+}
+
+func (s *session) register(root OID) error {
+	e := &encoder{}
+	e.uint8(0)   // use the session's timeout
+	e.uint8(127) // default priority
+	e.uint8(0)   // no range
+	e.uint8(0)
+	e.oid(root, false)
+	_, err := s.request(pduRegister, 0, e.Bytes())
+	return err
+}
+
+// close ends the session politely. Errors are ignored since the connection
+// is being torn down anyway.
+func (s *session) close() {
+	e := &encoder{}
+	e.uint8(closeReasonShutdown)
+	e.Write([]byte{0, 0, 0})
+	s.packetID++
+	h := header{Type: pduClose, SessionID: s.id, PacketID: s.packetID}
+	s.conn.SetDeadline(time.Now().Add(time.Second))
+	s.conn.Write(pdu(h, e.Bytes()))
+}
+
+// masterAddress splits a master address into a network and an address.
+func masterAddress(master string) (string, string, error) {
+	switch {
+	case master == "":
+		return "", "", fmt.Errorf("snmp: an agentx master address is required")
+	case strings.HasPrefix(master, "unix:"):
+		return "unix", strings.TrimPrefix(master, "unix:"), nil
+	case strings.HasPrefix(master, "tcp:"):
+		return "tcp", strings.TrimPrefix(master, "tcp:"), nil
+	case strings.HasPrefix(master, "/"):
+		return "unix", master, nil
+	}
+	if _, _, err := net.SplitHostPort(master); err != nil {
+		return "", "", fmt.Errorf("snmp: invalid agentx master address %q: %v", master, err)
+	}
+	return "tcp", master, nil
+}
@@ -0,0 +1,343 @@
+package snmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// AgentX, RFC 2741. Only the parts a read-only subagent needs are
+// implemented: opening a session, registering a subtree and answering Get,
+// GetNext and GetBulk. Sets are refused.
+
+const (
+	agentxVersion = 1
+	headerLength  = 20
+
+	pduOpen       = 1
+	pduClose      = 2
+	pduRegister   = 3
+	pduGet        = 5
+	pduGetNext    = 6
+	pduGetBulk    = 7
+	pduTestSet    = 8
+	pduCommitSet  = 9
+	pduUndoSet    = 10
+	pduCleanupSet = 11
+	pduResponse   = 18
+
+	flagNonDefaultContext = 0x08
+	flagNetworkByteOrder  = 0x10
+
+	closeReasonShutdown = 5
+
+	errNone        = 0
+	errNotWritable = 17
+	errParse       = 266
+
+	// prefix compression applies to OIDs under internet, 1.3.6.1.
+	internetPrefixLength = 4
+)
+
+// varbind types.
+const (
+	typeInteger        = 2
+	typeOctetString    = 4
+	typeNull           = 5
+	typeOID            = 6
+	typeCounter32      = 65
+	typeGauge32        = 66
+	typeTimeTicks      = 67
+	typeCounter64      = 70
+	typeNoSuchObject   = 128
+	typeNoSuchInstance = 129
+	typeEndOfMibView   = 130
+)
+
+var internetPrefix = OID{1, 3, 6, 1}
+
+// header is the fixed header that starts every PDU.
+type header struct {
+	Type          uint8
+	Flags         uint8
+	SessionID     uint32
+	TransactionID uint32
+	PacketID      uint32
+	PayloadLength uint32
+}
+
+// order returns the byte order of the PDU's payload. PDUs we send are always
+// in network byte order, but the master may answer in its own.
+func (h header) order() binary.ByteOrder {
+	if h.Flags&flagNetworkByteOrder != 0 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// searchRange is a request for the first OID from Start, up to but not
+// including End. End is empty for an unbounded range.
+type searchRange struct {
+	Start   OID
+	Include bool
+	End     OID
+}
+
+// varbind is a name and a value of one of the varbind types. Value is an
+// int32, uint32, uint64, []byte or OID depending on Type, and nil for the
+// types that carry no data.
+type varbind struct {
+	Type  uint16
+	Name  OID
+	Value interface{}
+}
+
+// encoder appends AgentX fields to a PDU payload in network byte order.
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) uint8(v uint8) { e.WriteByte(v) }
+
+func (e *encoder) uint16(v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	e.Write(b[:])
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.Write(b[:])
+}
+
+func (e *encoder) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.Write(b[:])
+}
+
+func (e *encoder) oid(o OID, include bool) {
+	prefix := uint8(0)
+	if len(o) > internetPrefixLength && o[:internetPrefixLength].Equal(internetPrefix) && o[internetPrefixLength] > 0 && o[internetPrefixLength] < 256 {
+		prefix = uint8(o[internetPrefixLength])
+		o = o[internetPrefixLength+1:]
+	}
+	e.uint8(uint8(len(o)))
+	e.uint8(prefix)
+	if include {
+		e.uint8(1)
+	} else {
+		e.uint8(0)
+	}
+	e.uint8(0)
+	for _, sub := range o {
+		e.uint32(sub)
+	}
+}
+
+func (e *encoder) octets(b []byte) {
+	e.uint32(uint32(len(b)))
+	e.Write(b)
+	if pad := len(b) % 4; pad != 0 {
+		e.Write(make([]byte, 4-pad))
+	}
+}
+
+func (e *encoder) varbind(vb varbind) error {
+	e.uint16(vb.Type)
+	e.uint16(0)
+	e.oid(vb.Name, false)
+	switch vb.Type {
+	case typeInteger:
+		v, ok := vb.Value.(int32)
+		if !ok {
+			return fmt.Errorf("value of %s is %T, not int32", vb.Name, vb.Value)
+		}
+		e.uint32(uint32(v))
+	case typeCounter32, typeGauge32, typeTimeTicks:
+		v, ok := vb.Value.(uint32)
+		if !ok {
+			return fmt.Errorf("value of %s is %T, not uint32", vb.Name, vb.Value)
+		}
+		e.uint32(v)
+	case typeCounter64:
+		v, ok := vb.Value.(uint64)
+		if !ok {
+			return fmt.Errorf("value of %s is %T, not uint64", vb.Name, vb.Value)
+		}
+		e.uint64(v)
+	case typeOctetString:
+		v, ok := vb.Value.([]byte)
+		if !ok {
+			return fmt.Errorf("value of %s is %T, not []byte", vb.Name, vb.Value)
+		}
+		e.octets(v)
+	case typeOID:
+		v, ok := vb.Value.(OID)
+		if !ok {
+			return fmt.Errorf("value of %s is %T, not OID", vb.Name, vb.Value)
+		}
+		e.oid(v, false)
+	case typeNull, typeNoSuchObject, typeNoSuchInstance, typeEndOfMibView:
+	default:
+		return fmt.Errorf("unsupported varbind type %d", vb.Type)
+	}
+	return nil
+}
+
+// pdu frames a payload with a header.
+func pdu(h header, payload []byte) []byte {
+	e := &encoder{}
+	e.uint8(agentxVersion)
+	e.uint8(h.Type)
+	e.uint8(h.Flags | flagNetworkByteOrder)
+	e.uint8(0)
+	e.uint32(h.SessionID)
+	e.uint32(h.TransactionID)
+	e.uint32(h.PacketID)
+	e.uint32(uint32(len(payload)))
+	e.Write(payload)
+	return e.Bytes()
+}
+
+// readPDU reads a single PDU.
+func readPDU(r io.Reader) (header, []byte, error) {
+	var b [headerLength]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return header{}, nil, err
+	}
+	if b[0] != agentxVersion {
+		return header{}, nil, fmt.Errorf("unsupported agentx version %d", b[0])
+	}
+	h := header{Type: b[1], Flags: b[2]}
+	order := h.order()
+	h.SessionID = order.Uint32(b[4:])
+	h.TransactionID = order.Uint32(b[8:])
+	h.PacketID = order.Uint32(b[12:])
+	h.PayloadLength = order.Uint32(b[16:])
+	if h.PayloadLength%4 != 0 || h.PayloadLength > 1<<20 {
+		return header{}, nil, fmt.Errorf("invalid agentx payload length %d", h.PayloadLength)
+	}
+
+	payload := make([]byte, h.PayloadLength)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return header{}, nil, err
+	}
+	return h, payload, nil
+}
+
+// decoder reads AgentX fields from a PDU payload.
+type decoder struct {
+	order binary.ByteOrder
+	b     []byte
+	err   error
+}
+
+func newDecoder(h header, payload []byte) *decoder {
+	return &decoder{order: h.order(), b: payload}
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.b) < n {
+		d.err = fmt.Errorf("agentx payload is short: wanted %d bytes, have %d", n, len(d.b))
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.take(2); b != nil {
+		return d.order.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.take(4); b != nil {
+		return d.order.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) oid() (OID, bool) {
+	b := d.take(4)
+	if b == nil {
+		return nil, false
+	}
+	n, prefix, include := int(b[0]), b[1], b[2] != 0
+	o := OID{}
+	if prefix != 0 {
+		o = append(o, internetPrefix...)
+		o = append(o, uint32(prefix))
+	}
+	for i := 0; i < n; i++ {
+		o = append(o, d.uint32())
+	}
+	return o, include
+}
+
+func (d *decoder) octets() []byte {
+	n := int(d.uint32())
+	if n < 0 || n > len(d.b) {
+		d.err = fmt.Errorf("agentx octet string of %d bytes overruns the payload", n)
+		return nil
+	}
+	b := d.take(n)
+	if pad := n % 4; pad != 0 {
+		d.take(4 - pad)
+	}
+	return b
+}
+
+// context skips the context of a request. Only the default context is
+// registered, so the master won't forward requests for any other.
+func (d *decoder) context(h header) {
+	if h.Flags&flagNonDefaultContext != 0 {
+		d.octets()
+	}
+}
+
+// searchRanges reads the ranges making up the rest of the payload.
+func (d *decoder) searchRanges() []searchRange {
+	ranges := []searchRange{}
+	for d.err == nil && len(d.b) > 0 {
+		start, include := d.oid()
+		end, _ := d.oid()
+		ranges = append(ranges, searchRange{Start: start, Include: include, End: end})
+	}
+	return ranges
+}
+
+// response is the payload of a Response-PDU.
+type response struct {
+	SysUpTime uint32
+	Error     uint16
+	Index     uint16
+	Varbinds  []varbind
+}
+
+func (r response) encode() ([]byte, error) {
+	e := &encoder{}
+	e.uint32(r.SysUpTime)
+	e.uint16(r.Error)
+	e.uint16(r.Index)
+	for _, vb := range r.Varbinds {
+		if err := e.varbind(vb); err != nil {
+			return nil, err
+		}
+	}
+	return e.Bytes(), nil
+}
+
+func decodeResponse(h header, payload []byte) (response, error) {
+	d := newDecoder(h, payload)
+	r := response{SysUpTime: d.uint32(), Error: d.uint16(), Index: d.uint16()}
+	return r, d.err
+}
@@ -0,0 +1,276 @@
+package snmp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The subtree registered by the agent, relative to the root OID:
+//
+//	root.1.1.0       lbKind             OCTET STRING  bgp, director, realserver or colocated
+//	root.1.2.0       vipCount           Gauge32       rows in the vip table
+//	root.1.3.0       peersEstablished   Gauge32       established bgp sessions
+//
+//	root.2.1.<col>.<index>              the vip table, one row per VIP, port and protocol
+//	    1  vipAddressType   INTEGER       1 ipv4, 2 ipv6
+//	    2  vipAddress       OCTET STRING  4 or 16 address bytes
+//	    3  vipPort          Gauge32
+//	    4  vipProtocol      INTEGER       6 tcp, 17 udp
+//	    5  vipNamespace     OCTET STRING
+//	    6  vipService       OCTET STRING
+//	    7  vipPortName      OCTET STRING
+//	    8  vipInOctets      Counter64
+//	    9  vipOutOctets     Counter64
+//	    10 vipInPackets     Counter64
+//	    11 vipOutPackets    Counter64
+//	    12 vipBackends      Gauge32       real servers configured in ipvs
+//	  index: address type, address length, address bytes, port, protocol
+//
+//	root.3.1.<col>.<index>              the bgp peer table, one row per gobgp neighbor
+//	    1  peerAddressType  INTEGER       1 ipv4, 2 ipv6
+//	    2  peerAddress      OCTET STRING
+//	    3  peerState        OCTET STRING  the state reported by gobgp, e.g. Establ
+//	    4  peerEstablished  INTEGER       1 true, 2 false
+//	  index: address type, address length, address bytes
+//
+// Rows are indexed by address rather than by position so that a row keeps
+// its index as VIPs come and go.
+
+// OID is an object identifier.
+type OID []uint32
+
+// ParseOID parses a dotted OID, such as 1.3.6.1.4.1.99999.
+func ParseOID(s string) (OID, error) {
+	s = strings.TrimPrefix(s, ".")
+	if s == "" {
+		return nil, fmt.Errorf("empty oid")
+	}
+	parts := strings.Split(s, ".")
+	o := make(OID, len(parts))
+	for i, p := range parts {
+		v, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid oid %q: %v", s, err)
+		}
+		o[i] = uint32(v)
+	}
+	return o, nil
+}
+
+func (o OID) String() string {
+	parts := make([]string, len(o))
+	for i, v := range o {
+		parts[i] = strconv.FormatUint(uint64(v), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Compare orders OIDs lexicographically, returning -1, 0 or 1.
+func (o OID) Compare(other OID) int {
+	for i := 0; i < len(o) && i < len(other); i++ {
+		switch {
+		case o[i] < other[i]:
+			return -1
+		case o[i] > other[i]:
+			return 1
+		}
+	}
+	switch {
+	case len(o) < len(other):
+		return -1
+	case len(o) > len(other):
+		return 1
+	}
+	return 0
+}
+
+func (o OID) Equal(other OID) bool { return o.Compare(other) == 0 }
+
+// HasPrefix reports whether o is within the subtree prefix.
+func (o OID) HasPrefix(prefix OID) bool {
+	return len(o) >= len(prefix) && o[:len(prefix)].Equal(prefix)
+}
+
+// append returns a new OID, leaving o untouched.
+func (o OID) append(sub ...uint32) OID {
+	out := make(OID, 0, len(o)+len(sub))
+	return append(append(out, o...), sub...)
+}
+
+// VIP is a row of the vip table.
+type VIP struct {
+	Addr      net.IP
+	Port      int
+	Protocol  string // tcp or udp
+	Namespace string
+	Service   string
+	PortName  string
+
+	InOctets, OutOctets   uint64
+	InPackets, OutPackets uint64
+	Backends              int
+}
+
+// Peer is a row of the bgp peer table.
+type Peer struct {
+	Addr  net.IP
+	State string
+}
+
+// Snapshot is the state exposed by the agent at a point in time.
+type Snapshot struct {
+	Kind  string
+	VIPs  []VIP
+	Peers []Peer
+}
+
+// view is a snapshot flattened into varbinds sorted by OID.
+type view []varbind
+
+// newView lays out a snapshot under root. VIPs and peers without a valid
+// address are left out.
+func newView(root OID, s Snapshot) view {
+	v := view{}
+	add := func(typ uint16, name OID, value interface{}) {
+		v = append(v, varbind{Type: typ, Name: name, Value: value})
+	}
+
+	established := 0
+	for _, p := range s.Peers {
+		if p.State == "Establ" {
+			established++
+		}
+	}
+
+	vips := root.append(2, 1)
+	rows := 0
+	for _, vip := range s.VIPs {
+		addrType, addr := inetAddress(vip.Addr)
+		if addr == nil {
+			continue
+		}
+		protocol := int32(17)
+		if strings.EqualFold(vip.Protocol, "tcp") {
+			protocol = 6
+		}
+		rows++
+
+		index := append(inetIndex(addrType, addr), uint32(vip.Port), uint32(protocol))
+		add(typeInteger, vips.append(1).append(index...), addrType)
+		add(typeOctetString, vips.append(2).append(index...), []byte(addr))
+		add(typeGauge32, vips.append(3).append(index...), uint32(vip.Port))
+		add(typeInteger, vips.append(4).append(index...), protocol)
+		add(typeOctetString, vips.append(5).append(index...), []byte(vip.Namespace))
+		add(typeOctetString, vips.append(6).append(index...), []byte(vip.Service))
+		add(typeOctetString, vips.append(7).append(index...), []byte(vip.PortName))
+		add(typeCounter64, vips.append(8).append(index...), vip.InOctets)
+		add(typeCounter64, vips.append(9).append(index...), vip.OutOctets)
+		add(typeCounter64, vips.append(10).append(index...), vip.InPackets)
+		add(typeCounter64, vips.append(11).append(index...), vip.OutPackets)
+		add(typeGauge32, vips.append(12).append(index...), uint32(vip.Backends))
+	}
+
+	peers := root.append(3, 1)
+	for _, p := range s.Peers {
+		addrType, addr := inetAddress(p.Addr)
+		if addr == nil {
+			continue
+		}
+		isEstablished := int32(2)
+		if p.State == "Establ" {
+			isEstablished = 1
+		}
+		index := inetIndex(addrType, addr)
+		add(typeInteger, peers.append(1).append(index...), addrType)
+		add(typeOctetString, peers.append(2).append(index...), []byte(addr))
+		add(typeOctetString, peers.append(3).append(index...), []byte(p.State))
+		add(typeInteger, peers.append(4).append(index...), isEstablished)
+	}
+
+	add(typeOctetString, root.append(1, 1, 0), []byte(s.Kind))
+	add(typeGauge32, root.append(1, 2, 0), uint32(rows))
+	add(typeGauge32, root.append(1, 3, 0), uint32(established))
+
+	// duplicate rows, such as a VIP listed twice, keep the first.
+	sort.SliceStable(v, func(i, j int) bool { return v[i].Name.Compare(v[j].Name) < 0 })
+	out := v[:0]
+	for i, vb := range v {
+		if i > 0 && vb.Name.Equal(out[len(out)-1].Name) {
+			continue
+		}
+		out = append(out, vb)
+	}
+	return out
+}
+
+// inetAddress returns the InetAddressType and the address bytes of ip.
+func inetAddress(ip net.IP) (int32, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return 1, ip4
+	}
+	if ip6 := ip.To16(); ip6 != nil {
+		return 2, ip6
+	}
+	return 0, nil
+}
+
+func inetIndex(addrType int32, addr net.IP) OID {
+	index := OID{uint32(addrType), uint32(len(addr))}
+	for _, b := range addr {
+		index = append(index, uint32(b))
+	}
+	return index
+}
+
+// get returns the varbind named o, or noSuchObject.
+func (v view) get(o OID) varbind {
+	i := sort.Search(len(v), func(i int) bool { return v[i].Name.Compare(o) >= 0 })
+	if i < len(v) && v[i].Name.Equal(o) {
+		return v[i]
+	}
+	return varbind{Type: typeNoSuchObject, Name: o}
+}
+
+// next returns the first varbind within r, or endOfMibView.
+func (v view) next(r searchRange) varbind {
+	i := sort.Search(len(v), func(i int) bool {
+		c := v[i].Name.Compare(r.Start)
+		return c > 0 || (c == 0 && r.Include)
+	})
+	if i < len(v) && (len(r.End) == 0 || v[i].Name.Compare(r.End) < 0) {
+		return v[i]
+	}
+	return varbind{Type: typeEndOfMibView, Name: r.Start}
+}
+
+// bulk answers a GetBulk: the first nonRepeaters ranges are answered once,
+// and the rest are walked up to maxRepetitions times, interleaved.
+func (v view) bulk(ranges []searchRange, nonRepeaters, maxRepetitions int) []varbind {
+	if nonRepeaters > len(ranges) {
+		nonRepeaters = len(ranges)
+	}
+	out := []varbind{}
+	for _, r := range ranges[:nonRepeaters] {
+		out = append(out, v.next(r))
+	}
+
+	repeaters := append([]searchRange{}, ranges[nonRepeaters:]...)
+	for rep := 0; rep < maxRepetitions && len(repeaters) > 0; rep++ {
+		done := true
+		for i, r := range repeaters {
+			vb := v.next(r)
+			out = append(out, vb)
+			if vb.Type != typeEndOfMibView {
+				done = false
+				repeaters[i].Start, repeaters[i].Include = vb.Name, false
+			}
+		}
+		if done {
+			break
+		}
+	}
+	return out
+}
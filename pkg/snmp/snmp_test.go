@@ -0,0 +1,274 @@
+package snmp
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+var testRoot = OID{1, 3, 6, 1, 4, 1, 99999, 1}
+
+func testSnapshot() Snapshot {
+	return Snapshot{
+		Kind: "director",
+		VIPs: []VIP{
+			{Addr: net.ParseIP("10.54.213.10"), Port: 80, Protocol: "tcp", Namespace: "ns", Service: "web", PortName: "http", InOctets: 1000, OutOctets: 2000, Backends: 3},
+			{Addr: net.ParseIP("2001:db8::10"), Port: 53, Protocol: "udp", Namespace: "ns", Service: "dns", PortName: "dns"},
+		},
+		Peers: []Peer{
+			{Addr: net.ParseIP("10.54.213.1"), State: "Establ"},
+			{Addr: net.ParseIP("10.54.213.2"), State: "Active"},
+		},
+	}
+}
+
+// readVarbind decodes a varbind, the inverse of encoder.varbind.
+func readVarbind(d *decoder) varbind {
+	vb := varbind{Type: d.uint16()}
+	d.uint16()
+	vb.Name, _ = d.oid()
+	switch vb.Type {
+	case typeInteger:
+		vb.Value = int32(d.uint32())
+	case typeCounter32, typeGauge32, typeTimeTicks:
+		vb.Value = d.uint32()
+	case typeCounter64:
+		hi, lo := d.uint32(), d.uint32()
+		vb.Value = uint64(hi)<<32 | uint64(lo)
+	case typeOctetString:
+		vb.Value = d.octets()
+	case typeOID:
+		vb.Value, _ = d.oid()
+	}
+	return vb
+}
+
+func TestParseOID(t *testing.T) {
+	o, err := ParseOID(".1.3.6.1.4.1.99999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.String() != "1.3.6.1.4.1.99999" {
+		t.Fatalf("expected 1.3.6.1.4.1.99999, got %s", o)
+	}
+	for _, bad := range []string{"", "1.3.x", "1..3", "1.3.99999999999"} {
+		if _, err := ParseOID(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestVarbindRoundTrip(t *testing.T) {
+	in := []varbind{
+		{Type: typeInteger, Name: testRoot.append(1), Value: int32(-4)},
+		{Type: typeGauge32, Name: OID{1, 2, 3}, Value: uint32(7)},
+		{Type: typeCounter64, Name: testRoot.append(2), Value: uint64(1) << 40},
+		{Type: typeOctetString, Name: testRoot.append(3), Value: []byte("hello")},
+		{Type: typeEndOfMibView, Name: testRoot.append(4)},
+	}
+	e := &encoder{}
+	for _, vb := range in {
+		if err := e.varbind(vb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e.Len()%4 != 0 {
+		t.Fatalf("expected the payload to be padded to 4 bytes, got %d", e.Len())
+	}
+
+	d := newDecoder(header{Flags: flagNetworkByteOrder}, e.Bytes())
+	for _, want := range in {
+		got := readVarbind(d)
+		if got.Type != want.Type || !got.Name.Equal(want.Name) {
+			t.Fatalf("expected %d %s, got %d %s", want.Type, want.Name, got.Type, got.Name)
+		}
+		if b, ok := want.Value.([]byte); ok {
+			if string(got.Value.([]byte)) != string(b) {
+				t.Fatalf("expected %q, got %q", b, got.Value)
+			}
+		} else if got.Value != want.Value {
+			t.Fatalf("expected %v, got %v", want.Value, got.Value)
+		}
+	}
+	if d.err != nil || len(d.b) != 0 {
+		t.Fatalf("expected to consume the payload, err=%v left=%d", d.err, len(d.b))
+	}
+}
+
+func TestView(t *testing.T) {
+	v := newView(testRoot, testSnapshot())
+
+	// scalars
+	if vb := v.get(testRoot.append(1, 2, 0)); vb.Value != uint32(2) {
+		t.Fatalf("expected 2 vips, got %v", vb.Value)
+	}
+	if vb := v.get(testRoot.append(1, 3, 0)); vb.Value != uint32(1) {
+		t.Fatalf("expected 1 established peer, got %v", vb.Value)
+	}
+	if vb := v.get(testRoot.append(1, 4, 0)); vb.Type != typeNoSuchObject {
+		t.Fatalf("expected noSuchObject, got %d", vb.Type)
+	}
+
+	// the v4 row sorts before the v6 row
+	index := OID{1, 4, 10, 54, 213, 10, 80, 6}
+	if vb := v.get(testRoot.append(2, 1, 12).append(index...)); vb.Value != uint32(3) {
+		t.Fatalf("expected 3 backends, got %v", vb.Value)
+	}
+	vb := v.next(searchRange{Start: testRoot.append(2, 1, 8)})
+	if !vb.Name.Equal(testRoot.append(2, 1, 8).append(index...)) || vb.Value != uint64(1000) {
+		t.Fatalf("expected the first in octets, got %s %v", vb.Name, vb.Value)
+	}
+
+	// ranges are bounded by their end
+	vb = v.next(searchRange{Start: testRoot.append(2), End: testRoot.append(2, 1, 1)})
+	if vb.Type != typeEndOfMibView {
+		t.Fatalf("expected endOfMibView, got %s", vb.Name)
+	}
+
+	// a walk visits every object once, in order
+	walked := 0
+	r := searchRange{Start: testRoot}
+	for {
+		vb := v.next(r)
+		if vb.Type == typeEndOfMibView {
+			break
+		}
+		if vb.Name.Compare(r.Start) <= 0 {
+			t.Fatalf("walk went backwards from %s to %s", r.Start, vb.Name)
+		}
+		r.Start = vb.Name
+		walked++
+	}
+	if want := 3 + 2*12 + 2*4; walked != want {
+		t.Fatalf("expected to walk %d objects, walked %d", want, walked)
+	}
+
+	// bulk interleaves the repeaters
+	bulk := v.bulk([]searchRange{
+		{Start: testRoot.append(1, 1, 0), Include: true},
+		{Start: testRoot.append(3, 1, 3)},
+		{Start: testRoot.append(3, 1, 4)},
+	}, 1, 3)
+	if len(bulk) != 1+2*3 {
+		t.Fatalf("expected 7 varbinds, got %d", len(bulk))
+	}
+	if string(bulk[0].Value.([]byte)) != "director" || string(bulk[1].Value.([]byte)) != "Establ" || bulk[2].Value != int32(1) || bulk[4].Value != int32(2) {
+		t.Fatalf("unexpected bulk response %v", bulk)
+	}
+	// without an end, the state column runs on into the next column, and
+	// the last column runs off the end of the view.
+	if bulk[5].Value != int32(1) || bulk[6].Type != typeEndOfMibView {
+		t.Fatalf("expected the walk to cross columns and end, got %s %s", bulk[5].Name, bulk[6].Name)
+	}
+}
+
+// TestAgent runs the agent against a fake master on a unix socket.
+func TestAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agentx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "master")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	a, err := New(Config{Master: "unix:" + path, Root: testRoot, CacheTTL: time.Minute},
+		func(context.Context) (Snapshot, error) { return testSnapshot(), nil }, logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// answer the open and the register.
+	for _, typ := range []uint8{pduOpen, pduRegister} {
+		h, payload, err := readPDU(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Type != typ {
+			t.Fatalf("expected pdu type %d, got %d", typ, h.Type)
+		}
+		if typ == pduRegister {
+			d := newDecoder(h, payload)
+			d.take(4)
+			if subtree, _ := d.oid(); !subtree.Equal(testRoot) || h.SessionID != 42 {
+				t.Fatalf("expected session 42 to register %s, got %d %s", testRoot, h.SessionID, subtree)
+			}
+		}
+		body, _ := response{}.encode()
+		conn.Write(pdu(header{Type: pduResponse, SessionID: 42, PacketID: h.PacketID}, body))
+	}
+
+	// a GetNext in little endian, as the master may send.
+	e := &encoder{}
+	e.oid(testRoot.append(1, 1), false)
+	e.oid(nil, false)
+	payload := e.Bytes()
+	req := make([]byte, headerLength)
+	req[0], req[1] = agentxVersion, pduGetNext
+	h := header{}
+	order := h.order()
+	order.PutUint32(req[4:], 42)
+	order.PutUint32(req[12:], 9)
+	order.PutUint32(req[16:], uint32(len(payload)))
+	// OIDs in the payload are big endian from the encoder, so swap each
+	// sub-identifier over to little endian.
+	for i := 4; i < len(payload); i += 4 {
+		payload[i], payload[i+1], payload[i+2], payload[i+3] = payload[i+3], payload[i+2], payload[i+1], payload[i]
+	}
+	if _, err := conn.Write(append(req, payload...)); err != nil {
+		t.Fatal(err)
+	}
+
+	rh, body, err := readPDU(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rh.Type != pduResponse || rh.PacketID != 9 || rh.SessionID != 42 {
+		t.Fatalf("unexpected response header %+v", rh)
+	}
+	d := newDecoder(rh, body)
+	d.take(8)
+	vb := readVarbind(d)
+	if !vb.Name.Equal(testRoot.append(1, 1, 0)) || string(vb.Value.([]byte)) != "director" {
+		t.Fatalf("unexpected varbind %s %v", vb.Name, vb.Value)
+	}
+
+	// sets are refused.
+	req[1] = pduTestSet
+	if _, err := conn.Write(append(req, payload...)); err != nil {
+		t.Fatal(err)
+	}
+	rh, body, err = readPDU(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := decodeResponse(rh, body); r.Error != errNotWritable {
+		t.Fatalf("expected notWritable, got %d", r.Error)
+	}
+
+	// and the session is closed on shutdown.
+	cancel()
+	if h, _, err := readPDU(conn); err != nil || h.Type != pduClose {
+		t.Fatalf("expected a close, got %d %v", h.Type, err)
+	}
+}
@@ -0,0 +1,97 @@
+package stats
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Backend states reported by the backend scoreboard.
+const (
+	// BackendActive is a node configured as a real server with a weight.
+	BackendActive = "active"
+	// BackendDraining is a node configured with a weight of 0, as it has no
+	// endpoints for the service. It keeps its connections but gets no new ones.
+	BackendDraining = "draining"
+	// BackendUnhealthy is a node left out because it isn't ready, or its
+	// realserver reported a fault.
+	BackendUnhealthy = "unhealthy"
+	// BackendCordoned is a node left out because it is cordoned.
+	BackendCordoned = "cordoned"
+	// BackendMaintenance is a node configured with a weight of 0, as it is
+	// in maintenance. It keeps its connections but gets no new ones.
+	BackendMaintenance = "maintenance"
+)
+
+// BackendState is the state of one node as a backend of a service.
+type BackendState struct {
+	VIP, Port, Protocol          string
+	Namespace, Service, PortName string
+	Node                         string
+
+	State  string
+	Weight int
+}
+
+// BackendMetrics is a scoreboard of the real servers behind each service, so
+// that dashboards can show the membership of a VIP and why a node is out of
+// it.
+type BackendMetrics struct {
+	sync.Mutex
+	kind string
+
+	state *prometheus.GaugeVec
+
+	// the series last set for each family, so that removed services and
+	// nodes, and the previous state of a node, stop being reported.
+	seen map[string]map[string]prometheus.Labels
+}
+
+// Set replaces the scoreboard of one address family.
+// gauge backend_state
+func (b *BackendMetrics) Set(family string, backends []BackendState) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	seen := map[string]prometheus.Labels{}
+	for _, be := range backends {
+		labels := prometheus.Labels{
+			"lb":        b.kind,
+			"vip":       be.VIP,
+			"port":      be.Port,
+			"protocol":  be.Protocol,
+			"port_name": be.PortName,
+			"namespace": be.Namespace,
+			"service":   be.Service,
+			"node":      be.Node,
+			"state":     be.State,
+		}
+		b.state.With(labels).Set(float64(be.Weight))
+		seen[be.Protocol+" "+be.VIP+" "+be.Port+" "+be.Node+" "+be.State] = labels
+	}
+
+	for key, labels := range b.seen[family] {
+		if _, ok := seen[key]; !ok {
+			b.state.Delete(labels)
+		}
+	}
+	b.seen[family] = seen
+}
+
+var backendStateDef = Define(Definition{
+	Type:   Gauge,
+	Name:   "backend_state",
+	Help:   "is the ipvs weight of a node as a backend of a service, with a label denoting its state active|draining|unhealthy|cordoned. only active backends have a weight above 0",
+	Labels: append(standardLabels, "node", "state"),
+})
+
+func NewBackendMetrics(kind string) *BackendMetrics {
+	return &BackendMetrics{
+		kind:  kind,
+		state: backendStateDef.GaugeVec(),
+		seen:  map[string]map[string]prometheus.Labels{},
+	}
+}
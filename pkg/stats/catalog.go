@@ -0,0 +1,232 @@
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Every metric ravel emits is declared with Define, so that the catalog served
+// at /metrics/catalog is generated from the same definitions the metrics are
+// created from. Definitions are made when packages are initialized, so the
+// catalog lists metrics whether or not the running mode emits them.
+//
+// Names are snake_case under Prefix. Counters end in _total, and durations
+// carry their unit. Labels must appear in LabelSchema, so that a label means
+// the same thing on every metric that carries it.
+
+// Metric types.
+const (
+	Counter   = "counter"
+	Gauge     = "gauge"
+	Histogram = "histogram"
+)
+
+// LabelSchema describes every label a metric may carry.
+var LabelSchema = map[string]string{
+	"lb":               "the load balancer mode: bgp, director, realserver, or colocated for what the director and realserver of a colocated process share",
+	"seczone":          "the config key the load balancer serves",
+	"vip":              "a virtual IP address",
+	"port":             "a virtual service port",
+	"protocol":         "the protocol of a virtual service, TCP or UDP",
+	"port_name":        "the name of the service port",
+	"namespace":        "the namespace of the kubernetes service",
+	"service":          "the name of the kubernetes service",
+	"state_event":      "a tcp state event: syn_ack, fin or rst",
+	"outcome":          "the result of an operation, such as complete, error, noop, success, fail, warm or cold",
+	"phase":            "a reconfigure phase: total, parity, addresses, bgp, ipvs, iptables or haproxy",
+	"family":           "an address family: v4, v6 or all",
+	"channel":          "an update channel: publish, nodes or stats_config",
+	"endpoint":         "a kubernetes watch endpoint",
+	"event":            "a cluster config build event: noop, publish, rejected or error",
+	"change":           "what a cluster config change changed: vip, port, option or setting",
+	"op":               "how a cluster config change changed it: added, removed or modified",
+	"operation":        "an iptables operation: save, restore or flush",
+	"attempts":         "the number of retries an iptables operation took",
+	"chain":            "an iptables chain",
+	"rule":             "an iptables rule",
+	"kind":             "the set of iptables chains measured",
+	"proxy":            "a haproxy frontend, backend or server",
+	"server":           "a haproxy server",
+	"error":            "a haproxy error kind: request, connection or response",
+	"probe":            "the kind of synthetic probe: tcp or http",
+	"table":            "a kernel connection table: conntrack or ipvs",
+	"node":             "a kubernetes node",
+	"state":            "the state of a backend: active, draining, maintenance, unhealthy or cordoned",
+	"loop":             "a worker loop supervised by the watchdog, such as bgp.periodic",
+	"subsystem":        "a part of the node ravel changes: interface, ipvs, iptables, bgp or haproxy",
+	"action":           "a change to the node, such as add, del, update, flush, restore or announce",
+	"check":            "a self-health check of the realserver: ipvs, iptables, interface or haproxy, or a self-test check run at startup, such as module ip_vs",
+	"decision":         "a failover decision of the realserver: hold, wait, takeover, giveback, backoff or maintenance",
+	"role":             "the role of a director in vrrp, or of its ipvs sync daemon: init, backup or master. for colocation, the owner of the node: none, director or realserver",
+	"peer":             "the address of a bgp peer",
+	"prefix":           "a prefix advertised over bgp",
+	"sha":              "a hash of the cluster config",
+	"info":             "the cluster config",
+	"date":             "the time the cluster config was applied",
+	"config_namespace": "the namespace of the load balancer's configmap",
+	"config_name":      "the name of the load balancer's configmap",
+	"version":          "the ravel version",
+	"go_version":       "the go version ravel was built with",
+	"commit":           "the commit ravel was built from",
+	"build_date":       "the time ravel was built",
+	"arch":             "the os and architecture ravel was built for",
+	"start_time":       "the time the process started",
+	"setting":          "a runtime setting overridden through the admin endpoint: weight, drained, log_level or reconfigure_interval",
+}
+
+// Definition describes a metric.
+type Definition struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Help    string    `json:"help"`
+	Labels  []string  `json:"labels"`
+	Buckets []float64 `json:"buckets,omitempty"`
+
+	// Replaces is the name the metric had before the ravel_ prefix, for
+	// migrating dashboards and alerts.
+	Replaces string `json:"replaces,omitempty"`
+
+	// collector is the metric once it is registered.
+	collector prometheus.Collector
+}
+
+var (
+	catalogLock sync.Mutex
+	catalog     = map[string]*Definition{}
+
+	validName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+)
+
+// Define adds a metric to the catalog, prefixing its name, and returns it. It
+// panics if the definition breaks the naming rules or its name is taken, as
+// prometheus.MustRegister does.
+func Define(d Definition) *Definition {
+	if err := d.validate(); err != nil {
+		panic(err)
+	}
+	d.Name = Prefix + d.Name
+
+	catalogLock.Lock()
+	defer catalogLock.Unlock()
+	if _, ok := catalog[d.Name]; ok {
+		panic(fmt.Errorf("metric %s is defined twice", d.Name))
+	}
+	catalog[d.Name] = &d
+	return &d
+}
+
+func (d Definition) validate() error {
+	if !validName.MatchString(d.Name) {
+		return fmt.Errorf("metric name %q must be snake_case", d.Name)
+	}
+	if d.Help == "" {
+		return fmt.Errorf("metric %s has no help", d.Name)
+	}
+	switch d.Type {
+	case Counter:
+		if !strings.HasSuffix(d.Name, "_total") {
+			return fmt.Errorf("counter %s must end in _total", d.Name)
+		}
+	case Gauge, Histogram:
+		if strings.HasSuffix(d.Name, "_total") {
+			return fmt.Errorf("%s %s must not end in _total", d.Type, d.Name)
+		}
+	default:
+		return fmt.Errorf("metric %s has unknown type %q", d.Name, d.Type)
+	}
+	if d.Type == Histogram && len(d.Buckets) == 0 {
+		return fmt.Errorf("histogram %s has no buckets", d.Name)
+	}
+	seen := map[string]bool{}
+	for _, l := range d.Labels {
+		if _, ok := LabelSchema[l]; !ok {
+			return fmt.Errorf("metric %s has label %q, which is not in the label schema", d.Name, l)
+		}
+		if seen[l] {
+			return fmt.Errorf("metric %s has label %q twice", d.Name, l)
+		}
+		seen[l] = true
+	}
+	return nil
+}
+
+func (d *Definition) mustBe(t string) {
+	if d.Type != t {
+		panic(fmt.Errorf("metric %s is a %s, not a %s", d.Name, d.Type, t))
+	}
+}
+
+// register registers the collector that create returns the first time it is
+// called, and returns that collector from then on, so that the director and
+// realserver of a colocated process share their metrics, told apart by lb.
+func (d *Definition) register(create func() prometheus.Collector) prometheus.Collector {
+	catalogLock.Lock()
+	defer catalogLock.Unlock()
+	if d.collector == nil {
+		c := create()
+		prometheus.MustRegister(c)
+		d.collector = c
+	}
+	return d.collector
+}
+
+// CounterVec creates and registers the counter.
+func (d *Definition) CounterVec() *prometheus.CounterVec {
+	d.mustBe(Counter)
+	return d.register(func() prometheus.Collector {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: d.Name, Help: d.Help}, d.Labels)
+	}).(*prometheus.CounterVec)
+}
+
+// GaugeVec creates and registers the gauge.
+func (d *Definition) GaugeVec() *prometheus.GaugeVec {
+	d.mustBe(Gauge)
+	return d.register(func() prometheus.Collector {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: d.Name, Help: d.Help}, d.Labels)
+	}).(*prometheus.GaugeVec)
+}
+
+// HistogramVec creates and registers the histogram.
+func (d *Definition) HistogramVec() *prometheus.HistogramVec {
+	d.mustBe(Histogram)
+	return d.register(func() prometheus.Collector {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: d.Name, Help: d.Help, Buckets: d.Buckets}, d.Labels)
+	}).(*prometheus.HistogramVec)
+}
+
+// Desc describes the metric for collectors that build const metrics.
+func (d *Definition) Desc() *prometheus.Desc {
+	return prometheus.NewDesc(d.Name, d.Help, d.Labels, nil)
+}
+
+// Catalog returns every defined metric, sorted by name.
+func Catalog() []Definition {
+	catalogLock.Lock()
+	defer catalogLock.Unlock()
+	out := make([]Definition, 0, len(catalog))
+	for _, d := range catalog {
+		out = append(out, *d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// CatalogHandler serves the catalog and the label schema as json.
+func CatalogHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			Metrics []Definition      `json:"metrics"`
+			Labels  map[string]string `json:"labels"`
+		}{Catalog(), LabelSchema})
+	})
+}
@@ -0,0 +1,115 @@
+package stats
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Channel names, used to label the channel metrics.
+const (
+	ChannelPublish     = "publish"
+	ChannelNodes       = "nodes"
+	ChannelStatsConfig = "stats_config"
+)
+
+var (
+	channelOnce      sync.Once
+	channelBlocked   *prometheus.CounterVec
+	channelWait      *prometheus.HistogramVec
+	channelCoalesced *prometheus.CounterVec
+	channelDropped   *prometheus.CounterVec
+	channelOccupancy *prometheus.GaugeVec
+
+	channelLabels     = []string{"lb", "channel"}
+	channelBlockedDef = Define(Definition{
+		Type:     Counter,
+		Name:     "channel_send_blocked_total",
+		Help:     "is a count of sends on an update channel that found it full and had to wait for the consumer",
+		Labels:   channelLabels,
+		Replaces: "rdei_lb_channel_send_blocked_count",
+	})
+	channelWaitDef = Define(Definition{
+		Type:     Histogram,
+		Name:     "channel_send_wait_microseconds",
+		Help:     "is a histogram of how long blocked sends on an update channel waited for the consumer",
+		Labels:   channelLabels,
+		Buckets:  LatencyBuckets,
+		Replaces: "rdei_lb_channel_send_wait_microseconds",
+	})
+	channelCoalescedDef = Define(Definition{
+		Type:     Counter,
+		Name:     "channel_coalesced_total",
+		Help:     "is a count of updates replaced by a newer update before they were consumed",
+		Labels:   channelLabels,
+		Replaces: "rdei_lb_channel_coalesced_count",
+	})
+	channelDroppedDef = Define(Definition{
+		Type:     Counter,
+		Name:     "channel_dropped_total",
+		Help:     "is a count of updates discarded because the update channel was full",
+		Labels:   channelLabels,
+		Replaces: "rdei_lb_channel_dropped_count",
+	})
+	channelOccupancyDef = Define(Definition{
+		Type:     Gauge,
+		Name:     "channel_occupancy",
+		Help:     "is the number of updates queued on an update channel as of the last send",
+		Labels:   channelLabels,
+		Replaces: "rdei_lb_channel_occupancy",
+	})
+)
+
+// ChannelMetrics instruments the sends on a single update channel, so that
+// a slow consumer shows up as blocked, coalesced or dropped updates rather
+// than as updates that quietly arrive late or not at all.
+type ChannelMetrics struct {
+	labels prometheus.Labels
+}
+
+// Blocked records a send that found the channel full and waited d for the
+// consumer.
+// counter channel_send_blocked_total
+// bucket channel_send_wait_microseconds
+func (c *ChannelMetrics) Blocked(d time.Duration) {
+	channelBlocked.With(c.labels).Add(1)
+	channelWait.With(c.labels).Observe(float64(d.Nanoseconds() / 1000))
+}
+
+// Coalesced records n updates that were replaced by a newer one before the
+// consumer saw them.
+// counter channel_coalesced_total
+func (c *ChannelMetrics) Coalesced(n int) {
+	channelCoalesced.With(c.labels).Add(float64(n))
+}
+
+// Dropped records an update that was discarded because the channel was full.
+// counter channel_dropped_total
+func (c *ChannelMetrics) Dropped() {
+	channelDropped.With(c.labels).Add(1)
+}
+
+// Occupancy records the number of updates queued on the channel.
+// gauge channel_occupancy
+func (c *ChannelMetrics) Occupancy(length int) {
+	channelOccupancy.With(c.labels).Set(float64(length))
+}
+
+func NewChannelMetrics(kind, channel string) *ChannelMetrics {
+	channelOnce.Do(func() {
+		channelBlocked = channelBlockedDef.CounterVec()
+		channelWait = channelWaitDef.HistogramVec()
+		channelCoalesced = channelCoalescedDef.CounterVec()
+		channelDropped = channelDroppedDef.CounterVec()
+		channelOccupancy = channelOccupancyDef.GaugeVec()
+	})
+
+	c := &ChannelMetrics{labels: prometheus.Labels{"lb": kind, "channel": channel}}
+
+	// init counters to 0
+	channelBlocked.With(c.labels)
+	channelCoalesced.With(c.labels)
+	channelDropped.With(c.labels)
+	return c
+}
@@ -16,6 +16,8 @@ func (h hash) Sum64() uint64 { return uint64(h) }
 // rdei-lb.tcp.fin              -   gauge of closed sessions.
 // rdei-lb.udp.tx               -   gauge of transmit bytes
 // rdei-lb.udp.rx               -   gauge of receive bytes
+// rdei-lb.tx-packets           -   gauge of transmit packets
+// rdei-lb.rx-packets           -   gauge of receive packets
 type counters struct {
 	IsTCP     bool
 	Namespace string
@@ -23,6 +25,8 @@ type counters struct {
 	PortName  string
 	TCP       tcpCounters
 	UDP       udpCounters
+	TxPackets uint64
+	RxPackets uint64
 }
 
 type tcpCounters struct {
@@ -67,6 +71,36 @@ func (c *counters) IncrTCPRst()       { atomic.AddUint64(&c.TCP.RST, 1) }
 func (c *counters) AddUDPRx(b uint64) { atomic.AddUint64(&c.UDP.Rx, b) }
 func (c *counters) AddUDPTx(b uint64) { atomic.AddUint64(&c.UDP.Tx, b) }
 
+// Packet Functions
+func (c *counters) AddRxPackets(n uint64) { atomic.AddUint64(&c.RxPackets, n) }
+func (c *counters) AddTxPackets(n uint64) { atomic.AddUint64(&c.TxPackets, n) }
+
+// addDelta adds the difference between two running totals read from the
+// eBPF counters map.
+func (c *counters) addDelta(rx bool, total, last vipValue) {
+	packets := total.Packets - last.Packets
+	bytes := total.Bytes - last.Bytes
+	switch {
+	case rx && c.IsTCP:
+		c.AddRxPackets(packets)
+		c.AddTCPRx(bytes)
+	case rx:
+		c.AddRxPackets(packets)
+		c.AddUDPRx(bytes)
+	case c.IsTCP:
+		c.AddTxPackets(packets)
+		c.AddTCPTx(bytes)
+	default:
+		c.AddTxPackets(packets)
+		c.AddUDPTx(bytes)
+	}
+	if c.IsTCP {
+		atomic.AddUint64(&c.TCP.SYNACK, total.SynAck-last.SynAck)
+		atomic.AddUint64(&c.TCP.FIN, total.Fin-last.Fin)
+		atomic.AddUint64(&c.TCP.RST, total.Rst-last.Rst)
+	}
+}
+
 // Getters *reset the value* of the counter that they retrieve. All of the counters
 // that we retrieve as apart of this type are window counters, meaning they are
 // keeping track of all of the data from the beginning of time
@@ -84,3 +118,7 @@ func (c *counters) GetTCPRst() uint64    { return atomic.SwapUint64(&c.TCP.RST,
 // UDP Getters
 func (c *counters) GetUDPRx() uint64 { return atomic.SwapUint64(&c.UDP.Rx, 0) }
 func (c *counters) GetUDPTx() uint64 { return atomic.SwapUint64(&c.UDP.Tx, 0) }
+
+// Packet Getters
+func (c *counters) GetRxPackets() uint64 { return atomic.SwapUint64(&c.RxPackets, 0) }
+func (c *counters) GetTxPackets() uint64 { return atomic.SwapUint64(&c.TxPackets, 0) }
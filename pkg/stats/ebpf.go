@@ -0,0 +1,618 @@
+package stats
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/flowexport"
+	"github.com/Comcast/Ravel/pkg/privsep"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+// Per-VIP traffic counters are kept in the kernel by a pair of tc programs,
+// one on ingress and one on egress of the stats interface. The programs only
+// count packets whose (addr, port, protocol, direction) tuple is already
+// present in the counters map, so userspace decides what is measured by
+// inserting and removing keys as the cluster config changes.
+//
+// When top talkers are enabled, the ingress program also counts the packets
+// of each counted tuple by source address in an LRU map, so the busiest
+// clients of a VIP can be listed without a packet capture. Sources that go
+// quiet are evicted first once the map is full.
+
+const (
+	// bpfRoot is where the map and programs are pinned so that tc can
+	// reference them. It must be a mounted bpffs.
+	bpfRoot = "/sys/fs/bpf/ravel"
+
+	// tc filter preference and handle used for our filters, so that we can
+	// replace and delete them without touching anybody else's.
+	tcFilterPref   = "49"
+	tcFilterHandle = "0x52"
+
+	// maxVIPKeys bounds the size of the counters map.
+	maxVIPKeys = 65536
+
+	dirRx uint8 = 0 // ingress, matched on destination
+	dirTx uint8 = 1 // egress, matched on source
+
+	protoTCP uint8 = 6
+	protoUDP uint8 = 17
+
+	// sampleCaplen is how many leading bytes of a sampled packet are copied
+	// out, enough for the ethernet, ip and l4 headers.
+	sampleCaplen = 128
+
+	// BPF_F_CURRENT_CPU
+	bpfFCurrentCPU = 0xffffffff
+
+	// BPF_NOEXIST
+	bpfNoExist = 1
+)
+
+// vipKey mirrors the map key the tc program builds on its stack.
+// IPv4 addresses occupy the first four bytes of Addr. Port is in
+// network byte order.
+type vipKey struct {
+	Addr      [16]byte
+	Port      [2]byte
+	Proto     uint8
+	Direction uint8
+	_         [4]byte
+}
+
+// vipValue mirrors the per-cpu map value updated by the tc program.
+type vipValue struct {
+	Packets uint64
+	Bytes   uint64
+	SynAck  uint64
+	Fin     uint64
+	Rst     uint64
+}
+
+// talkerKey mirrors the top talkers map key, which the ingress program
+// builds on its stack from the source address followed by the counters key.
+type talkerKey struct {
+	Source [16]byte
+	VIP    vipKey
+}
+
+// talkerValue mirrors the top talkers map value. It is shared by every cpu
+// and updated atomically.
+type talkerValue struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+func newVIPKey(ip net.IP, port int, proto, dir uint8) vipKey {
+	k := vipKey{Proto: proto, Direction: dir}
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(k.Addr[:], ip4)
+	} else {
+		copy(k.Addr[:], ip.To16())
+	}
+	k.Port[0] = byte(port >> 8)
+	k.Port[1] = byte(port)
+	return k
+}
+
+// sum folds the per-cpu values for a key into a single total.
+func sum(values []vipValue) vipValue {
+	var total vipValue
+	for _, v := range values {
+		total.Packets += v.Packets
+		total.Bytes += v.Bytes
+		total.SynAck += v.SynAck
+		total.Fin += v.Fin
+		total.Rst += v.Rst
+	}
+	return total
+}
+
+// vipCounters owns the counters map and the tc programs attached to a device.
+type vipCounters struct {
+	device  string
+	dir     string
+	counts  *ebpf.Map
+	samples *ebpf.Map
+	talkers *ebpf.Map
+	ingress *ebpf.Program
+	egress  *ebpf.Program
+}
+
+// newVIPCounters loads the counter programs and attaches them to the
+// ingress and egress hooks of device. A non-zero sampleRate additionally
+// copies one in sampleRate counted packets to the samples map, and a non-zero
+// talkers tracks up to that many sources in the talkers map.
+func newVIPCounters(device string, sampleRate uint32, talkers int) (*vipCounters, error) {
+	// kernels since 5.11 charge bpf memory to the cgroup and don't need
+	// this. where it is needed, creating the map fails with a hint below.
+	rlimit.RemoveMemlock()
+
+	v := &vipCounters{device: device, dir: filepath.Join(bpfRoot, device)}
+	if err := os.MkdirAll(v.dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create bpffs directory %s: %v", v.dir, err)
+	}
+
+	var err error
+	v.counts, err = ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "ravel_vips",
+		Type:       ebpf.PerCPUHash,
+		KeySize:    24,
+		ValueSize:  40,
+		MaxEntries: maxVIPKeys,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create counters map: %v", err)
+	}
+
+	if sampleRate > 0 {
+		// MaxEntries is filled in with the number of possible cpus.
+		v.samples, err = ebpf.NewMap(&ebpf.MapSpec{
+			Name: "ravel_samples",
+			Type: ebpf.PerfEventArray,
+		})
+		if err != nil {
+			v.close()
+			return nil, fmt.Errorf("unable to create samples map: %v", err)
+		}
+	}
+
+	if talkers > 0 {
+		v.talkers, err = ebpf.NewMap(&ebpf.MapSpec{
+			Name:       "ravel_talkers",
+			Type:       ebpf.LRUHash,
+			KeySize:    40,
+			ValueSize:  16,
+			MaxEntries: uint32(talkers),
+		})
+		if err != nil {
+			v.close()
+			return nil, fmt.Errorf("unable to create talkers map: %v", err)
+		}
+	}
+
+	if v.ingress, err = newCounterProgram("ravel_ingress", v.counts, dirRx, v.samples, sampleRate, v.talkers); err != nil {
+		v.close()
+		return nil, err
+	}
+	if v.egress, err = newCounterProgram("ravel_egress", v.counts, dirTx, v.samples, sampleRate, nil); err != nil {
+		v.close()
+		return nil, err
+	}
+
+	if err := v.attach(); err != nil {
+		v.close()
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *vipCounters) attach() error {
+	if out, err := privsep.Command("tc", "qdisc", "replace", "dev", v.device, "clsact").CombinedOutput(); err != nil {
+		return fmt.Errorf("unable to add clsact qdisc to %s: %v %s", v.device, err, strings.TrimSpace(string(out)))
+	}
+
+	for hook, prog := range map[string]*ebpf.Program{"ingress": v.ingress, "egress": v.egress} {
+		pin := filepath.Join(v.dir, hook)
+		os.Remove(pin)
+		if err := prog.Pin(pin); err != nil {
+			return fmt.Errorf("unable to pin %s program at %s: %v", hook, pin, err)
+		}
+		out, err := privsep.Command("tc", "filter", "replace", "dev", v.device, hook,
+			"pref", tcFilterPref, "handle", tcFilterHandle,
+			"bpf", "direct-action", "object-pinned", pin).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("unable to attach %s program to %s: %v %s", hook, v.device, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// close detaches the programs and releases the map. The clsact qdisc is
+// left in place since other tooling may have filters on it.
+func (v *vipCounters) close() {
+	for _, hook := range []string{"ingress", "egress"} {
+		privsep.Command("tc", "filter", "del", "dev", v.device, hook, "pref", tcFilterPref, "handle", tcFilterHandle, "bpf").Run()
+		os.Remove(filepath.Join(v.dir, hook))
+	}
+	if v.ingress != nil {
+		v.ingress.Close()
+	}
+	if v.egress != nil {
+		v.egress.Close()
+	}
+	if v.counts != nil {
+		v.counts.Close()
+	}
+	if v.samples != nil {
+		v.samples.Close()
+	}
+	if v.talkers != nil {
+		v.talkers.Close()
+	}
+}
+
+// sync makes the set of keys in the map match keys. Keys that are already
+// present keep their running totals.
+func (v *vipCounters) sync(keys map[vipKey]bool) error {
+	var (
+		key    vipKey
+		values []vipValue
+		stale  []vipKey
+	)
+	it := v.counts.Iterate()
+	for it.Next(&key, &values) {
+		if !keys[key] {
+			stale = append(stale, key)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return fmt.Errorf("unable to iterate counters map: %v", err)
+	}
+
+	for _, k := range stale {
+		if err := v.counts.Delete(k); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("unable to remove counters key: %v", err)
+		}
+	}
+
+	zero := []vipValue{{}}
+	for k := range keys {
+		err := v.counts.Update(k, zero, ebpf.UpdateNoExist)
+		if err != nil && !errors.Is(err, ebpf.ErrKeyExist) {
+			return fmt.Errorf("unable to add counters key: %v", err)
+		}
+	}
+	return nil
+}
+
+// read returns the running totals for key.
+func (v *vipCounters) read(key vipKey) (vipValue, error) {
+	var values []vipValue
+	if err := v.counts.Lookup(key, &values); err != nil {
+		return vipValue{}, err
+	}
+	return sum(values), nil
+}
+
+// readTalkers returns the totals of every source counted against a VIP
+// address, optionally narrowed to a port and protocol.
+func (v *vipCounters) readTalkers(addr [16]byte, port [2]byte, proto uint8) (map[[16]byte]talkerValue, error) {
+	if v.talkers == nil {
+		return nil, fmt.Errorf("top talkers are not enabled")
+	}
+	var (
+		key   talkerKey
+		value talkerValue
+	)
+	out := map[[16]byte]talkerValue{}
+	it := v.talkers.Iterate()
+	for it.Next(&key, &value) {
+		if key.VIP.Addr != addr || (proto != 0 && (key.VIP.Port != port || key.VIP.Proto != proto)) {
+			continue
+		}
+		total := out[key.Source]
+		total.Packets += value.Packets
+		total.Bytes += value.Bytes
+		out[key.Source] = total
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("unable to iterate talkers map: %v", err)
+	}
+	return out, nil
+}
+
+// exportSamples reads sampled packets from the samples map and hands them
+// to exporter until the stats context is canceled.
+func (s *Stats) exportSamples(samples *ebpf.Map, exporter *flowexport.Exporter) error {
+	rd, err := perf.NewReader(samples, 8*os.Getpagesize())
+	if err != nil {
+		return fmt.Errorf("unable to read samples map: %v", err)
+	}
+	go func() {
+		<-s.ctx.Done()
+		rd.Close()
+	}()
+
+	go func() {
+		var lost uint64
+		for {
+			rec, err := rd.Read()
+			if errors.Is(err, perf.ErrClosed) {
+				return
+			} else if err != nil {
+				s.logger.Debugf("stats: unable to read sample: %v", err)
+				continue
+			}
+			if rec.LostSamples > 0 {
+				lost += rec.LostSamples
+				s.logger.Debugf("stats: %d samples lost so far to a full perf buffer", lost)
+				continue
+			}
+			if sample, ok := parseSample(rec.RawSample, time.Now()); ok {
+				exporter.Add(sample)
+			}
+		}
+	}()
+	return nil
+}
+
+// parseSample decodes a record written by sampleInstructions. The raw sample
+// may carry trailing padding, so the packet bytes are cut to the captured
+// length.
+func parseSample(raw []byte, now time.Time) (flowexport.Sample, bool) {
+	if len(raw) < 8 {
+		return flowexport.Sample{}, false
+	}
+	length := binary.BigEndian.Uint32(raw[0:])
+	caplen := int(length)
+	if caplen > sampleCaplen {
+		caplen = sampleCaplen
+	}
+	if len(raw)-8 < caplen {
+		return flowexport.Sample{}, false
+	}
+	header := make([]byte, caplen)
+	copy(header, raw[8:])
+	return flowexport.Sample{
+		Time:    now,
+		Ingress: raw[4] == dirRx,
+		Length:  length,
+		Header:  header,
+	}, true
+}
+
+// newCounterProgram loads the tc program for one direction.
+func newCounterProgram(name string, counts *ebpf.Map, dir uint8, samples *ebpf.Map, sampleRate uint32, talkers *ebpf.Map) (*ebpf.Program, error) {
+	samplesFD, talkersFD := -1, -1
+	if samples != nil {
+		samplesFD = samples.FD()
+	}
+	if talkers != nil {
+		talkersFD = talkers.FD()
+	}
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name:         name,
+		Type:         ebpf.SchedCLS,
+		Instructions: counterInstructions(counts.FD(), dir, samplesFD, sampleRate, talkersFD),
+		License:      "GPL",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to load %s program: %v", name, err)
+	}
+	return prog, nil
+}
+
+// counterInstructions assembles the tc program for one direction. Frames are
+// assumed to carry an ethernet header, which holds for physical interfaces
+// and for lo. Anything we don't have a key for is passed through untouched.
+// When sampleRate is non-zero, one in sampleRate counted packets is also
+// written to the samples perf event array. When talkersFD is a map, counted
+// packets are also added to their source's totals; only ingress has one.
+//
+// The stack holds the counters key at fp-24, preceded by the source address
+// at fp-40 so that fp-40 is the talkers key. Below that is scratch space for
+// the sample header and a new talkers value.
+func counterInstructions(countsFD int, dir uint8, samplesFD int, sampleRate uint32, talkersFD int) asm.Instructions {
+	// offsets of the address and port we key on, relative to the start of
+	// the ip and l4 headers respectively.
+	v4Addr, v6Addr, portOff := int32(16), int32(24), int32(2)
+	if dir == dirTx {
+		v4Addr, v6Addr, portOff = 12, 8, 0
+	}
+
+	const eth = 14
+
+	insns := asm.Instructions{
+		// R6 must hold the skb for the legacy packet loads below.
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.LoadMem(asm.R9, asm.R6, 0, asm.Word), // skb->len
+
+		// zero the keys on the stack at fp-40
+		asm.StoreImm(asm.RFP, -40, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, -32, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, -24, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, -16, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, -8, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, -5, int64(dir), asm.Byte),
+
+		asm.LoadAbs(12, asm.Half), // ethertype
+		asm.JEq.Imm(asm.R0, 0x0800, "ipv4"),
+		asm.JEq.Imm(asm.R0, 0x86dd, "ipv6"),
+		asm.Ja.Label("out"),
+
+		// ipv4: l4 offset comes from the header length
+		asm.LoadAbs(eth, asm.Byte).Sym("ipv4"),
+		asm.And.Imm(asm.R0, 0x0f),
+		asm.LSh.Imm(asm.R0, 2),
+		asm.Add.Imm(asm.R0, eth),
+		asm.Mov.Reg(asm.R8, asm.R0),
+		asm.LoadAbs(eth+9, asm.Byte),
+		asm.Mov.Reg(asm.R7, asm.R0),
+		asm.LoadAbs(eth+v4Addr, asm.Word),
+		asm.HostTo(asm.BE, asm.R0, asm.Word),
+		asm.StoreMem(asm.RFP, -24, asm.R0, asm.Word),
+	}
+	if talkersFD >= 0 {
+		insns = append(insns,
+			asm.LoadAbs(eth+12, asm.Word),
+			asm.HostTo(asm.BE, asm.R0, asm.Word),
+			asm.StoreMem(asm.RFP, -40, asm.R0, asm.Word),
+		)
+	}
+	insns = append(insns,
+		asm.Ja.Label("l4"),
+
+		// ipv6: extension headers are not followed
+		asm.Mov.Imm(asm.R8, eth+40).Sym("ipv6"),
+		asm.LoadAbs(eth+6, asm.Byte),
+		asm.Mov.Reg(asm.R7, asm.R0),
+	)
+	for i := int32(0); i < 4; i++ {
+		insns = append(insns,
+			asm.LoadAbs(eth+v6Addr+4*i, asm.Word),
+			asm.HostTo(asm.BE, asm.R0, asm.Word),
+			asm.StoreMem(asm.RFP, int16(-24+4*i), asm.R0, asm.Word),
+		)
+		if talkersFD >= 0 {
+			insns = append(insns,
+				asm.LoadAbs(eth+8+4*i, asm.Word),
+				asm.HostTo(asm.BE, asm.R0, asm.Word),
+				asm.StoreMem(asm.RFP, int16(-40+4*i), asm.R0, asm.Word),
+			)
+		}
+	}
+
+	insns = append(insns,
+		asm.StoreMem(asm.RFP, -6, asm.R7, asm.Byte).Sym("l4"),
+		asm.JEq.Imm(asm.R7, int32(protoTCP), "tcp"),
+		asm.JEq.Imm(asm.R7, int32(protoUDP), "udp"),
+		asm.Ja.Label("out"),
+
+		// R7 holds the tcp flags from here on, zero for udp
+		asm.LoadInd(asm.R0, asm.R8, 13, asm.Byte).Sym("tcp"),
+		asm.Mov.Reg(asm.R7, asm.R0),
+		asm.Ja.Label("port"),
+		asm.Mov.Imm(asm.R7, 0).Sym("udp"),
+
+		asm.LoadInd(asm.R0, asm.R8, portOff, asm.Half).Sym("port"),
+		asm.HostTo(asm.BE, asm.R0, asm.Half),
+		asm.StoreMem(asm.RFP, -8, asm.R0, asm.Half),
+
+		asm.LoadMapPtr(asm.R1, countsFD),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -24),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "out"),
+	)
+
+	if sampleRate > 0 {
+		insns = append(insns, sampleInstructions(samplesFD, dir, sampleRate)...)
+	}
+	if talkersFD >= 0 {
+		insns = append(insns, talkerInstructions(talkersFD)...)
+	}
+
+	insns = append(insns,
+		asm.LoadMem(asm.R1, asm.R0, 0, asm.DWord),
+		asm.Add.Imm(asm.R1, 1),
+		asm.StoreMem(asm.R0, 0, asm.R1, asm.DWord),
+		asm.LoadMem(asm.R1, asm.R0, 8, asm.DWord),
+		asm.Add.Reg(asm.R1, asm.R9),
+		asm.StoreMem(asm.R0, 8, asm.R1, asm.DWord),
+
+		// syn+ack, fin and rst are treated as mutually exclusive
+		asm.Mov.Reg(asm.R1, asm.R7),
+		asm.And.Imm(asm.R1, 0x12),
+		asm.JNE.Imm(asm.R1, 0x12, "fin"),
+		asm.LoadMem(asm.R1, asm.R0, 16, asm.DWord),
+		asm.Add.Imm(asm.R1, 1),
+		asm.StoreMem(asm.R0, 16, asm.R1, asm.DWord),
+		asm.Ja.Label("out"),
+
+		asm.Mov.Reg(asm.R1, asm.R7).Sym("fin"),
+		asm.And.Imm(asm.R1, 0x01),
+		asm.JEq.Imm(asm.R1, 0, "rst"),
+		asm.LoadMem(asm.R1, asm.R0, 24, asm.DWord),
+		asm.Add.Imm(asm.R1, 1),
+		asm.StoreMem(asm.R0, 24, asm.R1, asm.DWord),
+		asm.Ja.Label("out"),
+
+		asm.Mov.Reg(asm.R1, asm.R7).Sym("rst"),
+		asm.And.Imm(asm.R1, 0x04),
+		asm.JEq.Imm(asm.R1, 0, "out"),
+		asm.LoadMem(asm.R1, asm.R0, 32, asm.DWord),
+		asm.Add.Imm(asm.R1, 1),
+		asm.StoreMem(asm.R0, 32, asm.R1, asm.DWord),
+
+		// TC_ACT_OK
+		asm.Mov.Imm(asm.R0, 0).Sym("out"),
+		asm.Return(),
+	)
+
+	return insns
+}
+
+// sampleInstructions picks one in rate packets and writes an 8 byte header
+// followed by the leading sampleCaplen bytes of the packet to the samples
+// perf event array. It expects the counters value in R0 and leaves it there.
+//
+//	0: u32 skb->len, network byte order
+//	4: u8  direction
+func sampleInstructions(samplesFD int, dir uint8, rate uint32) asm.Instructions {
+	return asm.Instructions{
+		// keep the counters value across the helper calls
+		asm.Mov.Reg(asm.R8, asm.R0),
+
+		asm.FnGetPrandomU32.Call(),
+		asm.Mod.Imm(asm.R0, int32(rate)),
+		asm.JNE.Imm(asm.R0, 0, "sampled"),
+
+		asm.StoreImm(asm.RFP, -48, 0, asm.DWord),
+		asm.Mov.Reg(asm.R1, asm.R9),
+		asm.HostTo(asm.BE, asm.R1, asm.Word),
+		asm.StoreMem(asm.RFP, -48, asm.R1, asm.Word),
+		asm.StoreImm(asm.RFP, -44, int64(dir), asm.Byte),
+
+		// the upper 32 bits of the flags are the number of packet bytes to
+		// append, which may not exceed the packet length.
+		asm.Mov.Reg(asm.R3, asm.R9),
+		asm.JLE.Imm(asm.R3, sampleCaplen, "caplen"),
+		asm.Mov.Imm(asm.R3, sampleCaplen),
+		asm.LSh.Imm(asm.R3, 32).Sym("caplen"),
+		asm.LoadImm(asm.R4, bpfFCurrentCPU, asm.DWord),
+		asm.Or.Reg(asm.R3, asm.R4),
+
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.LoadMapPtr(asm.R2, samplesFD),
+		asm.Mov.Reg(asm.R4, asm.RFP),
+		asm.Add.Imm(asm.R4, -48),
+		asm.Mov.Imm(asm.R5, 8),
+		asm.FnPerfEventOutput.Call(),
+
+		asm.Mov.Reg(asm.R0, asm.R8).Sym("sampled"),
+	}
+}
+
+// talkerInstructions adds the packet to its source's totals in the talkers
+// map, creating the entry if this is the source's first packet. Two cpus may
+// race to create it, in which case one packet goes uncounted. It expects the
+// counters value in R0 and leaves it there.
+func talkerInstructions(talkersFD int) asm.Instructions {
+	return asm.Instructions{
+		asm.Mov.Reg(asm.R8, asm.R0),
+
+		asm.LoadMapPtr(asm.R1, talkersFD),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -40),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "talker_new"),
+		asm.Mov.Imm(asm.R1, 1),
+		asm.StoreXAdd(asm.R0, asm.R1, asm.DWord),
+		asm.Add.Imm(asm.R0, 8),
+		asm.StoreXAdd(asm.R0, asm.R9, asm.DWord),
+		asm.Ja.Label("talker_done"),
+
+		asm.StoreImm(asm.RFP, -56, 1, asm.DWord).Sym("talker_new"),
+		asm.StoreMem(asm.RFP, -48, asm.R9, asm.DWord),
+		asm.LoadMapPtr(asm.R1, talkersFD),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -40),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, -56),
+		asm.Mov.Imm(asm.R4, bpfNoExist),
+		asm.FnMapUpdateElem.Call(),
+
+		asm.Mov.Reg(asm.R0, asm.R8).Sym("talker_done"),
+	}
+}
@@ -7,21 +7,61 @@ type LBKind string
 const KindBGPDirector = "bgp"
 const KindIpvsMaster = "director"
 const KindIpvsBackend = "realserver"
-const Prefix = "rdei_lb_"
 
-// consts for prometheus initialization
-var (
-	metricTcpState = Prefix + "tcp_state_count"
-	helpTcpState   = "A counter variable that measures protocol, port name, namespace, service, state events like rst or synack, and counts for respective event types"
+// KindColocated is a director and realserver sharing one process.
+const KindColocated = "colocated"
 
-	metricFlows = Prefix + "flows_count"
-	helpFlows   = "a counter to measure the increase in active tcp and udp connections"
+const Prefix = "ravel_"
 
-	metricTx = Prefix + "tx_bytes"
-	helpTx   = "a counter to measure the bytes transmitted"
-	metricRx = Prefix + "rx_bytes"
-	helpRx   = "a counter to measure the bytes received"
+var standardLabels = []string{"lb", "vip", "port", "protocol", "port_name", "namespace", "service"}
+var stateLabels = []string{"lb", "vip", "port", "state_event", "protocol", "port_name", "namespace", "service"}
 
+var (
+	tcpStateDef = Define(Definition{
+		Type:     Counter,
+		Name:     "tcp_state_total",
+		Help:     "A counter variable that measures protocol, port name, namespace, service, state events like rst or synack, and counts for respective event types",
+		Labels:   stateLabels,
+		Replaces: "rdei_lb_tcp_state_count",
+	})
+	flowsDef = Define(Definition{
+		Type:     Counter,
+		Name:     "flows_total",
+		Help:     "a counter to measure the increase in active tcp and udp connections",
+		Labels:   standardLabels,
+		Replaces: "rdei_lb_flows_count",
+	})
+	txDef = Define(Definition{
+		Type:     Counter,
+		Name:     "tx_bytes_total",
+		Help:     "a counter to measure the bytes transmitted",
+		Labels:   standardLabels,
+		Replaces: "rdei_lb_tx_bytes",
+	})
+	rxDef = Define(Definition{
+		Type:     Counter,
+		Name:     "rx_bytes_total",
+		Help:     "a counter to measure the bytes received",
+		Labels:   standardLabels,
+		Replaces: "rdei_lb_rx_bytes",
+	})
+	txPacketsDef = Define(Definition{
+		Type:     Counter,
+		Name:     "tx_packets_total",
+		Help:     "a counter to measure the packets transmitted",
+		Labels:   standardLabels,
+		Replaces: "rdei_lb_tx_packets",
+	})
+	rxPacketsDef = Define(Definition{
+		Type:     Counter,
+		Name:     "rx_packets_total",
+		Help:     "a counter to measure the packets received",
+		Labels:   standardLabels,
+		Replaces: "rdei_lb_rx_packets",
+	})
+)
+
+var (
 	// state events. these are not metrics, they're labels within a metric
 	stateSynAck = "syn_ack"
 	stateFin    = "fin"
@@ -30,15 +70,14 @@ var (
 	LatencyBuckets []float64 = []float64{100, 1000, 10000, 50000, 100000, 200000, 300000, 400000, 500000, 600000, 700000, 800000, 900000, 1000000, 1500000, 2000000, 3000000}
 )
 
-var standardLabels = []string{"lb", "vip", "port", "protocol", "port_name", "namespace", "service"}
-var stateLabels = []string{"lb", "vip", "port", "state_event", "protocol", "port_name", "namespace", "service"}
-
 type flowMetrics struct {
 	// counters for all state events
-	rxMetric    *prometheus.CounterVec
-	txMetric    *prometheus.CounterVec
-	stateMetric *prometheus.CounterVec
-	flowsMetric *prometheus.CounterVec
+	rxMetric        *prometheus.CounterVec
+	txMetric        *prometheus.CounterVec
+	rxPacketsMetric *prometheus.CounterVec
+	txPacketsMetric *prometheus.CounterVec
+	stateMetric     *prometheus.CounterVec
+	flowsMetric     *prometheus.CounterVec
 
 	lbKind string
 }
@@ -49,10 +88,13 @@ func newFlowMetrics(kind LBKind) *flowMetrics {
 
 		lbKind: string(kind),
 
-		txMetric:    newCounter(metricTx, helpTx, standardLabels),
-		rxMetric:    newCounter(metricRx, helpRx, standardLabels),
-		stateMetric: newCounter(metricTcpState, helpTcpState, stateLabels),
-		flowsMetric: newCounter(metricFlows, helpFlows, standardLabels),
+		txMetric:    txDef.CounterVec(),
+		rxMetric:    rxDef.CounterVec(),
+		stateMetric: tcpStateDef.CounterVec(),
+		flowsMetric: flowsDef.CounterVec(),
+
+		txPacketsMetric: txPacketsDef.CounterVec(),
+		rxPacketsMetric: rxPacketsDef.CounterVec(),
 	}
 }
 
@@ -80,6 +122,30 @@ func (p *flowMetrics) rx(vip, port, protocol, namespace, portName, service strin
 	}).Add(float64(value))
 }
 
+func (p *flowMetrics) txPackets(vip, port, protocol, namespace, portName, service string, value uint64) {
+	p.txPacketsMetric.With(prometheus.Labels{
+		"lb":        p.lbKind,
+		"vip":       vip,
+		"port":      port,
+		"namespace": namespace,
+		"service":   service,
+		"port_name": portName,
+		"protocol":  protocol,
+	}).Add(float64(value))
+}
+
+func (p *flowMetrics) rxPackets(vip, port, protocol, namespace, portName, service string, value uint64) {
+	p.rxPacketsMetric.With(prometheus.Labels{
+		"lb":        p.lbKind,
+		"vip":       vip,
+		"port":      port,
+		"namespace": namespace,
+		"service":   service,
+		"port_name": portName,
+		"protocol":  protocol,
+	}).Add(float64(value))
+}
+
 func (p *flowMetrics) flows(vip, port, protocol, namespace, portName, service string, value uint64) {
 	p.flowsMetric.With(prometheus.Labels{
 		"lb":        p.lbKind,
@@ -104,12 +170,3 @@ func (p *flowMetrics) tcpState(vip, port, stateEvent, protocol, namespace, portN
 		"protocol":    protocol,
 	}).Add(float64(value))
 }
-
-func newCounter(name, help string, labels []string) *prometheus.CounterVec {
-	newCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: name,
-		Help: help,
-	}, labels)
-	prometheus.MustRegister(newCounter)
-	return newCounter
-}
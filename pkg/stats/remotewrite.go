@@ -0,0 +1,338 @@
+package stats
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+// Some directors run in networks that Prometheus can't reach, so the
+// metrics served on /metrics can also be pushed to a Prometheus remote-write
+// endpoint. Every interval the default registry is gathered, split into
+// batches and sent as snappy-compressed WriteRequests. A batch that fails
+// with a network error, a 5xx or a 429 is retried with backoff; any other
+// response drops it, as the endpoint won't take it on a retry either.
+//
+// The WriteRequest is encoded by hand rather than through the generated
+// prompb types, which would pull the whole of prometheus into the build.
+
+const (
+	DefaultRemoteWriteInterval  = 30 * time.Second
+	DefaultRemoteWriteBatchSize = 2000
+	DefaultRemoteWriteRetries   = 5
+
+	remoteWriteMinBackoff = 500 * time.Millisecond
+	remoteWriteMaxBackoff = 30 * time.Second
+)
+
+var (
+	remoteWriteSamplesDef = Define(Definition{
+		Type:   Counter,
+		Name:   "remote_write_samples_total",
+		Help:   "is a count of samples pushed to the remote-write endpoint, with labels denoting the outcome success|error",
+		Labels: []string{"lb", "outcome"},
+	})
+	remoteWriteRetriesDef = Define(Definition{
+		Type:   Counter,
+		Name:   "remote_write_retries_total",
+		Help:   "is a count of remote-write requests retried after a network error, a 5xx or a 429",
+		Labels: []string{"lb"},
+	})
+)
+
+// RemoteWriteConfig configures pushing metrics to a remote-write endpoint.
+type RemoteWriteConfig struct {
+	URL string
+	// Interval is how often the metrics are gathered and pushed.
+	Interval time.Duration
+	// BatchSize is the most samples sent in one request.
+	BatchSize int
+	// Timeout bounds a single request.
+	Timeout time.Duration
+	// Retries is how many times a failed batch is retried.
+	Retries int
+
+	// Username and Password set basic auth, and BearerToken an
+	// Authorization header. At most one of the two may be set.
+	Username    string
+	Password    string
+	BearerToken string
+
+	// Labels are added to every series, in place of the job and instance
+	// labels a scrape would have added.
+	Labels map[string]string
+}
+
+// Validate checks the config is complete.
+func (c RemoteWriteConfig) Validate() error {
+	if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+		return fmt.Errorf("remote-write url must be http or https")
+	}
+	if c.Interval <= 0 || c.Timeout <= 0 {
+		return fmt.Errorf("remote-write interval and timeout must be positive")
+	}
+	if c.BatchSize < 1 {
+		return fmt.Errorf("remote-write batch size must be at least 1")
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("remote-write retries must not be negative")
+	}
+	if c.BearerToken != "" && (c.Username != "" || c.Password != "") {
+		return fmt.Errorf("remote-write takes either basic auth or a bearer token, not both")
+	}
+	return nil
+}
+
+// remoteWriter pushes the metrics gathered from a registry.
+type remoteWriter struct {
+	config   RemoteWriteConfig
+	gatherer prometheus.Gatherer
+	client   *http.Client
+
+	samples *prometheus.CounterVec
+	retries prometheus.Counter
+	kind    string
+}
+
+// EnableRemoteWrite pushes the metrics of the default registry to the
+// remote-write endpoint until the context the Stats were created with is done.
+func (s *Stats) EnableRemoteWrite(config RemoteWriteConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	w := &remoteWriter{
+		config:   config,
+		gatherer: prometheus.DefaultGatherer,
+		client:   &http.Client{Timeout: config.Timeout},
+		samples:  remoteWriteSamplesDef.CounterVec(),
+		retries:  remoteWriteRetriesDef.CounterVec().WithLabelValues(string(s.kind)),
+		kind:     string(s.kind),
+	}
+	s.logger.Infof("stats: pushing metrics to %s every %v", config.URL, config.Interval)
+	go w.run(s.ctx, s.logger.WithField("module", "remote-write"))
+	return nil
+}
+
+func (w *remoteWriter) run(ctx context.Context, logger logging.Logger) {
+	t := time.NewTicker(w.config.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := w.push(ctx); err != nil {
+				logger.Errorf("stats: remote-write failed. %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// push gathers the registry and sends it in batches. It returns the last
+// error, after trying every batch.
+func (w *remoteWriter) push(ctx context.Context) error {
+	families, err := w.gatherer.Gather()
+	if err != nil && len(families) == 0 {
+		return fmt.Errorf("unable to gather metrics. %v", err)
+	}
+	series := toSeries(families, w.config.Labels, time.Now())
+
+	var last error
+	for start := 0; start < len(series); start += w.config.BatchSize {
+		end := start + w.config.BatchSize
+		if end > len(series) {
+			end = len(series)
+		}
+		batch := series[start:end]
+		outcome := "success"
+		if err := w.send(ctx, encodeWriteRequest(batch)); err != nil {
+			outcome = "error"
+			last = err
+		}
+		w.samples.WithLabelValues(w.kind, outcome).Add(float64(len(batch)))
+	}
+	return last
+}
+
+// send posts one WriteRequest, retrying recoverable failures.
+func (w *remoteWriter) send(ctx context.Context, request []byte) error {
+	body := snappy.Encode(nil, request)
+	backoff := remoteWriteMinBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(ctx, body)
+		if err == nil || !retry || attempt >= w.config.Retries {
+			return err
+		}
+		w.retries.Inc()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > remoteWriteMaxBackoff {
+			backoff = remoteWriteMaxBackoff
+		}
+	}
+}
+
+// post sends body, and reports whether a failure is worth retrying.
+func (w *remoteWriter) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "ravel")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.config.Username != "" || w.config.Password != "" {
+		req.SetBasicAuth(w.config.Username, w.config.Password)
+	}
+	if w.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.config.BearerToken)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s responded %s: %s", w.config.URL, resp.Status, bytes.TrimSpace(msg))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+type label struct{ name, value string }
+
+// sample is a single series and its value at a time.
+type sample struct {
+	labels    []label
+	value     float64
+	timestamp int64
+}
+
+// toSeries flattens metric families into series the way the text exposition
+// format does: histograms and summaries become their _bucket or quantile,
+// _sum and _count series.
+func toSeries(families []*dto.MetricFamily, extra map[string]string, now time.Time) []sample {
+	ts := now.UnixNano() / int64(time.Millisecond)
+	out := []sample{}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			add := func(suffix string, value float64, more ...label) {
+				labels := []label{{"__name__", f.GetName() + suffix}}
+				for _, l := range m.GetLabel() {
+					labels = append(labels, label{l.GetName(), l.GetValue()})
+				}
+				labels = append(labels, more...)
+				for name, value := range extra {
+					if !hasLabel(labels, name) {
+						labels = append(labels, label{name, value})
+					}
+				}
+				// remote-write requires labels sorted by name
+				sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+				out = append(out, sample{labels: labels, value: value, timestamp: ts})
+			}
+			switch f.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				inf := false
+				for _, b := range h.GetBucket() {
+					add("_bucket", float64(b.GetCumulativeCount()), label{"le", formatFloat(b.GetUpperBound())})
+					inf = inf || math.IsInf(b.GetUpperBound(), 1)
+				}
+				if !inf {
+					add("_bucket", float64(h.GetSampleCount()), label{"le", "+Inf"})
+				}
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add("", q.GetValue(), label{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add("_sum", s.GetSampleSum())
+				add("_count", float64(s.GetSampleCount()))
+			}
+		}
+	}
+	return out
+}
+
+// hasLabel reports whether a series already has a label, which takes
+// precedence over the configured labels.
+func hasLabel(labels []label, name string) bool {
+	for _, l := range labels {
+		if l.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes the series as a prometheus.WriteRequest:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []sample) []byte {
+	var out []byte
+	for _, s := range series {
+		var ts []byte
+		for _, l := range s.labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.name)
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, lb)
+		}
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.value))
+		sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sb)
+
+		out = protowire.AppendTag(out, 1, protowire.BytesType)
+		out = protowire.AppendBytes(out, ts)
+	}
+	return out
+}
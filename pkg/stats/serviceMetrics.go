@@ -0,0 +1,107 @@
+package stats
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ServiceResult is the outcome of applying one service's rules during a
+// reconfigure.
+type ServiceResult struct {
+	VIP, Port, Protocol          string
+	Namespace, Service, PortName string
+
+	// Applied is set when the service's rules changed in this reconfigure.
+	// Services that were already configured are only reported as healthy.
+	Applied bool
+	Err     error
+}
+
+// ServiceMetrics tracks reconfigure outcomes per service, so that alerts can
+// target the team that owns a failing service without one bad service
+// masking the health of the rest.
+type ServiceMetrics struct {
+	sync.Mutex
+	kind string
+
+	reconfigure *prometheus.CounterVec
+	healthy     *prometheus.GaugeVec
+
+	// the healthy series last set for each family, so that services removed
+	// from the config stop being reported.
+	seen map[string]map[string]prometheus.Labels
+}
+
+// Results records the outcome of a reconfigure of one address family.
+// counter service_reconfigure_total
+// gauge service_reconfigure_healthy
+func (s *ServiceMetrics) Results(family string, results []ServiceResult) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	seen := map[string]prometheus.Labels{}
+	for _, r := range results {
+		labels := prometheus.Labels{
+			"lb":        s.kind,
+			"vip":       r.VIP,
+			"port":      r.Port,
+			"protocol":  r.Protocol,
+			"port_name": r.PortName,
+			"namespace": r.Namespace,
+			"service":   r.Service,
+		}
+		healthy := 1.0
+		outcome := "complete"
+		if r.Err != nil {
+			healthy = 0
+			outcome = "error"
+		}
+		s.healthy.With(labels).Set(healthy)
+		seen[r.Protocol+" "+r.VIP+" "+r.Port] = labels
+
+		if r.Applied || r.Err != nil {
+			counterLabels := prometheus.Labels{"outcome": outcome}
+			for k, v := range labels {
+				counterLabels[k] = v
+			}
+			s.reconfigure.With(counterLabels).Add(1)
+		}
+	}
+
+	for key, labels := range s.seen[family] {
+		if _, ok := seen[key]; !ok {
+			s.healthy.Delete(labels)
+		}
+	}
+	s.seen[family] = seen
+}
+
+var (
+	serviceReconfigureDef = Define(Definition{
+		Type:     Counter,
+		Name:     "service_reconfigure_total",
+		Help:     "is a count of reconfigurations that changed a service's rules, with labels denoting the service and the outcome complete|error",
+		Labels:   append(standardLabels, "outcome"),
+		Replaces: "rdei_lb_service_reconfigure_count",
+	})
+	serviceHealthyDef = Define(Definition{
+		Type:     Gauge,
+		Name:     "service_reconfigure_healthy",
+		Help:     "is 1 if a service's rules are configured as of the last reconfigure, and 0 if they failed to apply",
+		Labels:   standardLabels,
+		Replaces: "rdei_lb_service_reconfigure_healthy",
+	})
+)
+
+func NewServiceMetrics(kind string) *ServiceMetrics {
+	return &ServiceMetrics{
+		kind:        kind,
+		reconfigure: serviceReconfigureDef.CounterVec(),
+		healthy:     serviceHealthyDef.GaugeVec(),
+		seen:        map[string]map[string]prometheus.Labels{},
+	}
+}
@@ -10,13 +10,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Comcast/Ravel/pkg/flowexport"
+	log "github.com/Comcast/Ravel/pkg/logging"
 	"github.com/Comcast/Ravel/pkg/types"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/sirupsen/logrus"
-	log "github.com/sirupsen/logrus"
 )
 
 // Statistics collection for BGP load balancers. This would work for any load balancer VIP, really.
@@ -27,48 +25,159 @@ import (
 
 type Stats struct {
 	sync.Mutex
-	// map of IP address to port to counters.
-	counters map[gopacket.Endpoint]map[gopacket.Endpoint]*counters
+	// map of VIP, port and protocol to counters.
+	counters map[flowKey]*counters
+	// running totals last read from the kernel, used to compute deltas.
+	totals map[vipKey]vipValue
 
 	target   string // statsd service address
 	freq     float64
 	interval *time.Ticker // how often to send statistics
 
-	device string // eth device to read packets from. (probably lo)
+	device string // eth device to attach the counter programs to. (probably lo)
 	kind   LBKind // bgp, ipvs
 
-	configChan chan *types.ClusterConfig
+	configChan        chan *types.ClusterConfig
+	configChanMetrics *ChannelMetrics
+	configSource      func() *types.ClusterConfig
+	lastConfig        *types.ClusterConfig
 
-	pcap *pcap.Handle
+	bpf *vipCounters
 
+	// flow export, when enabled, is fed from samples taken by the counters.
+	sampleRate uint32
+	exporter   *flowexport.Exporter
+
+	// the number of sources tracked for top talkers. zero disables them.
+	talkers int
+
+	// serverMu serializes moves of the metrics server, which take seconds
+	serverMu           sync.Mutex
 	prometheusPort     string
+	server             *http.Server
 	flowMetrics        *flowMetrics
 	flowMetricsEnabled bool
 
 	ctx    context.Context
-	logger log.FieldLogger
+	logger log.Logger
+}
+
+// flowKey identifies a VIP, port and protocol tuple being measured.
+type flowKey struct {
+	ip    string
+	port  int
+	isTCP bool
 }
 
 // Public Interface
 // ================================================================================
 
+// EnableBPFStats loads the eBPF counter programs onto the stats device. Counts
+// are kept in the kernel and read back every interval.
 func (s *Stats) EnableBPFStats() error {
+	s.Lock()
+	sampleRate, exporter, talkers := s.sampleRate, s.exporter, s.talkers
+	s.Unlock()
 
-	// The 1600 will have to change if we go to Jumbo Frames or something.
-	if handle, err := pcap.OpenLive(s.device, 1600, false, pcap.BlockForever); err != nil {
-		return fmt.Errorf("unable to instantiate pcap on device %s: %v", s.device, err)
-	} else if err := handle.SetBPFFilter("tcp or udp"); err != nil {
-		return fmt.Errorf("unable to set pcap filters. %v", err)
-	} else {
-		s.pcap = handle
+	v, err := newVIPCounters(s.device, sampleRate, talkers)
+	if err != nil {
+		return fmt.Errorf("unable to load eBPF counters on device %s: %v", s.device, err)
+	}
+	if exporter != nil {
+		if err := s.exportSamples(v.samples, exporter); err != nil {
+			v.close()
+			return err
+		}
 	}
 
-	go s.initMetrics()
-	go s.capture()
+	s.Lock()
+	s.bpf = v
+	s.flowMetrics = newFlowMetrics(s.kind)
 	s.flowMetricsEnabled = true
+	// force the next config poll to push keys into the new map.
+	s.lastConfig = nil
+	s.Unlock()
+
+	go func() {
+		<-s.ctx.Done()
+		s.Lock()
+		defer s.Unlock()
+		s.flowMetricsEnabled = false
+		v.close()
+	}()
 	return nil
 }
 
+// EnableFlowExport samples one in rate counted packets and passes them to
+// exporter. It must be called before EnableBPFStats.
+func (s *Stats) EnableFlowExport(rate uint32, exporter *flowexport.Exporter) {
+	s.Lock()
+	defer s.Unlock()
+	s.sampleRate = rate
+	s.exporter = exporter
+}
+
+// EnableTopTalkers counts traffic by source address for up to size sources
+// across all VIPs. It must be called before EnableBPFStats.
+func (s *Stats) EnableTopTalkers(size int) {
+	s.Lock()
+	defer s.Unlock()
+	s.talkers = size
+}
+
+// FollowConfig sets a function used to fetch the current cluster config. It is
+// polled every interval, and the counted VIPs are updated whenever it returns
+// a different config.
+func (s *Stats) FollowConfig(source func() *types.ClusterConfig) {
+	s.Lock()
+	defer s.Unlock()
+	s.configSource = source
+}
+
+// VIPTraffic is the traffic counted on a VIP, port and protocol since its
+// counters were loaded.
+type VIPTraffic struct {
+	VIP       string
+	Port      int
+	Protocol  string // TCP or UDP
+	RxBytes   uint64
+	TxBytes   uint64
+	RxPackets uint64
+	TxPackets uint64
+}
+
+// Traffic returns the running totals last read from the eBPF counters. The
+// totals only move forward, unlike the windowed prometheus metrics, and
+// restart when a VIP is removed from the config and added back. It returns
+// nothing when the counters are not enabled.
+func (s *Stats) Traffic() []VIPTraffic {
+	s.Lock()
+	defer s.Unlock()
+	if !s.flowMetricsEnabled {
+		return nil
+	}
+
+	out := make([]VIPTraffic, 0, len(s.counters))
+	for flow := range s.counters {
+		t := VIPTraffic{VIP: flow.ip, Port: flow.port, Protocol: "UDP"}
+		proto := protoUDP
+		if flow.isTCP {
+			t.Protocol = "TCP"
+			proto = protoTCP
+		}
+		ip := net.ParseIP(flow.ip)
+		if ip == nil {
+			continue
+		}
+		rx := s.totals[newVIPKey(ip, flow.port, proto, dirRx)]
+		tx := s.totals[newVIPKey(ip, flow.port, proto, dirTx)]
+		t.RxBytes, t.RxPackets = rx.Bytes, rx.Packets
+		t.TxBytes, t.TxPackets = tx.Bytes, tx.Packets
+		out = append(out, t)
+	}
+	return out
+}
+
 // Private Interface
 // ================================================================================
 
@@ -82,57 +191,98 @@ func newLabel(namespace, service, name string) string {
 // captureFlowStatistics aggregates all of the data from the flow counters and transfers that data into
 // the prometheus metrics values for delivery via the prometheus endpoint.
 func (s *Stats) captureFlowStatistics() {
+	s.Lock()
+	defer s.Unlock()
 	if !s.flowMetricsEnabled {
 		return
 	}
 
+	// move the kernel counts into the window counters.
+	s.readCounters()
+
 	// get, and clear all of the counters.
-	for ip, p := range s.counters {
-		for port, stats := range p {
-			var protocol string
-			ipStr := ip.String()
-			portStr := port.String()
-			if stats.IsTCP {
-				tx := stats.GetTCPTx()
-				rx := stats.GetTCPRx()
-				sa := stats.GetTCPSynAck()
-				fin := stats.GetTCPFin()
-				rst := stats.GetTCPRst()
-				protocol = "TCP"
-
-				s.flowMetrics.tx(ipStr, portStr, protocol, stats.Namespace, stats.PortName, stats.Service, tx)
-				s.flowMetrics.rx(ipStr, portStr, protocol, stats.Namespace, stats.PortName, stats.Service, rx)
-
-				s.flowMetrics.tcpState(ipStr, portStr, stateSynAck, protocol, stats.Namespace, stats.PortName, stats.Service, sa)
-				s.flowMetrics.tcpState(ipStr, portStr, stateFin, protocol, stats.Namespace, stats.PortName, stats.Service, fin)
-				s.flowMetrics.tcpState(ipStr, portStr, stateRst, protocol, stats.Namespace, stats.PortName, stats.Service, rst)
-
-				// print
-				s.logger.Debugf("prometheus tcp scrape: ns=%s svc=%s port=%s addr=%v:%v prot=tcp tx=%d rx=%d synack=%d fin=%d rst=%d",
-					stats.Namespace, stats.Service, stats.PortName, ip, port, tx, rx, sa, fin, rst)
-			} else {
-				tx := stats.GetUDPTx()
-				rx := stats.GetUDPRx()
-				protocol = "UDP"
-
-				s.flowMetrics.tx(ipStr, portStr, protocol, stats.Namespace, stats.PortName, stats.Service, tx)
-				s.flowMetrics.rx(ipStr, portStr, protocol, stats.Namespace, stats.PortName, stats.Service, rx)
+	for flow, stats := range s.counters {
+		var protocol string
+		ipStr := flow.ip
+		portStr := strconv.Itoa(flow.port)
+		if stats.IsTCP {
+			tx := stats.GetTCPTx()
+			rx := stats.GetTCPRx()
+			txp := stats.GetTxPackets()
+			rxp := stats.GetRxPackets()
+			sa := stats.GetTCPSynAck()
+			fin := stats.GetTCPFin()
+			rst := stats.GetTCPRst()
+			protocol = "TCP"
+
+			s.flowMetrics.tx(ipStr, portStr, protocol, stats.Namespace, stats.PortName, stats.Service, tx)
+			s.flowMetrics.rx(ipStr, portStr, protocol, stats.Namespace, stats.PortName, stats.Service, rx)
+			s.flowMetrics.txPackets(ipStr, portStr, protocol, stats.Namespace, stats.PortName, stats.Service, txp)
+			s.flowMetrics.rxPackets(ipStr, portStr, protocol, stats.Namespace, stats.PortName, stats.Service, rxp)
+
+			s.flowMetrics.tcpState(ipStr, portStr, stateSynAck, protocol, stats.Namespace, stats.PortName, stats.Service, sa)
+			s.flowMetrics.tcpState(ipStr, portStr, stateFin, protocol, stats.Namespace, stats.PortName, stats.Service, fin)
+			s.flowMetrics.tcpState(ipStr, portStr, stateRst, protocol, stats.Namespace, stats.PortName, stats.Service, rst)
+
+			// print
+			s.logger.Debugf("prometheus tcp scrape: ns=%s svc=%s port=%s addr=%v:%v prot=tcp tx=%d rx=%d synack=%d fin=%d rst=%d",
+				stats.Namespace, stats.Service, stats.PortName, ipStr, portStr, tx, rx, sa, fin, rst)
+		} else {
+			tx := stats.GetUDPTx()
+			rx := stats.GetUDPRx()
+			txp := stats.GetTxPackets()
+			rxp := stats.GetRxPackets()
+			protocol = "UDP"
+
+			s.flowMetrics.tx(ipStr, portStr, protocol, stats.Namespace, stats.PortName, stats.Service, tx)
+			s.flowMetrics.rx(ipStr, portStr, protocol, stats.Namespace, stats.PortName, stats.Service, rx)
+			s.flowMetrics.txPackets(ipStr, portStr, protocol, stats.Namespace, stats.PortName, stats.Service, txp)
+			s.flowMetrics.rxPackets(ipStr, portStr, protocol, stats.Namespace, stats.PortName, stats.Service, rxp)
+		}
+	}
+}
+
+// readCounters reads the running totals for every tracked key out of the
+// eBPF map and adds the change since the last read to the window counters.
+// The caller must hold the lock.
+func (s *Stats) readCounters() {
+	for flow, stats := range s.counters {
+		proto := protoUDP
+		if flow.isTCP {
+			proto = protoTCP
+		}
+		ip := net.ParseIP(flow.ip)
+		for _, dir := range []uint8{dirRx, dirTx} {
+			key := newVIPKey(ip, flow.port, proto, dir)
+			total, err := s.bpf.read(key)
+			if err != nil {
+				// the key is (re)inserted on the next config load.
+				continue
 			}
+			last := s.totals[key]
+			s.totals[key] = total
+			if total.Packets < last.Packets {
+				// the key was removed and re-added, start over.
+				last = vipValue{}
+			}
+			stats.addDelta(dir == dirRx, total, last)
 		}
 	}
 }
 
-func NewStats(ctx context.Context, kind LBKind, device, statsHost, prometheusPort string, freq time.Duration, logger logrus.FieldLogger) (*Stats, error) {
+func NewStats(ctx context.Context, kind LBKind, device, statsHost, prometheusPort string, freq time.Duration, logger log.Logger) (*Stats, error) {
 	s := &Stats{
 		kind:   kind,
 		target: statsHost,
 		device: device,
 
-		configChan: make(chan *types.ClusterConfig),
-		freq:       freq.Seconds(),
-		interval:   time.NewTicker(freq),
+		configChan:        make(chan *types.ClusterConfig),
+		configChanMetrics: NewChannelMetrics(string(kind), ChannelStatsConfig),
+		freq:              freq.Seconds(),
+		interval:          time.NewTicker(freq),
 
-		counters: map[gopacket.Endpoint]map[gopacket.Endpoint]*counters{},
+		counters: map[flowKey]*counters{},
+		totals:   map[vipKey]vipValue{},
 
 		prometheusPort: prometheusPort,
 
@@ -152,6 +302,7 @@ func (s *Stats) UpdateConfig(c *types.ClusterConfig) error {
 	select {
 	case s.configChan <- c:
 	default:
+		s.configChanMetrics.Dropped()
 		return fmt.Errorf("stats reconfiguration channel is full")
 	}
 	return nil
@@ -165,6 +316,7 @@ func (s *Stats) run() {
 		case <-s.ctx.Done():
 			return
 		case <-s.interval.C:
+			s.followConfig()
 			s.captureFlowStatistics()
 		case newConfig := <-s.configChan:
 			// log.Debugln("new configuration inbound")
@@ -173,216 +325,144 @@ func (s *Stats) run() {
 	}
 }
 
+// followConfig loads the config from the config source, if one is set and
+// it has changed since the last load.
+func (s *Stats) followConfig() {
+	s.Lock()
+	source, last := s.configSource, s.lastConfig
+	s.Unlock()
+	if source == nil {
+		return
+	}
+	if c := source(); c != nil && c != last {
+		if err := s.loadConfiguration(c); err != nil {
+			s.logger.Errorf("stats: unable to load configuration: %v", err)
+		}
+	}
+}
+
 // loadConfiguration takes a ClusterConfig and populates a set of
-// VIP, Port tuples for use in the internal pcap capture mechanism
+// VIP, Port tuples to be counted by the eBPF programs.
 func (s *Stats) loadConfiguration(c *types.ClusterConfig) error {
 	// s.logger.Debugf("loading new configuration")
 	s.Lock()
 	defer s.Unlock()
-
-	// traverse the config and generate the counters map.
-	// IP addresses will be captured in ipset and the berkeley packet filter will
-	// be set to filter traffic to *only* traffic on the designated VIP interfaces.
-	ipset := []string{}
-	for ipRaw, portMap := range c.Config {
-		// log.Debugln("Loading configuration for VIP with IP:", ipRaw)
-		ip := layers.NewIPEndpoint(net.ParseIP(string(ipRaw)))
-
-		var ip6 gopacket.Endpoint
-		var has6 bool
-		if ip6Raw, ok := c.IPV6[ipRaw]; ok {
-			// log.Debugln("VIP with IP", ipRaw, "has IPV6 enabled")
-			has6 = true
-			ip6 = layers.NewIPEndpoint(net.ParseIP(string(ip6Raw)))
-			ipset = append(ipset, string(ip6Raw))
+	s.lastConfig = c
+
+	// traverse the config and regenerate the counters map, keeping the
+	// counters of tuples that are still present.
+	flows := map[flowKey]*counters{}
+	add := func(ip string, port int, cfg *types.ServiceDef) {
+		for _, isTCP := range []bool{true, false} {
+			k := flowKey{ip: ip, port: port, isTCP: isTCP}
+			if existing, ok := s.counters[k]; ok {
+				flows[k] = existing
+				continue
+			}
+			flows[k] = NewCounters(cfg.Namespace, cfg.Service, cfg.PortName, isTCP)
 		}
-
-		ipset = append(ipset, string(ipRaw))
-
+	}
+	for ipRaw, portMap := range c.Config {
+		ip6Raw, has6 := c.IPV6[ipRaw]
 		for portRaw, cfg := range portMap {
-			// log.Debugln("VIP with IP", ipRaw, "has port", portRaw)
 			p, _ := strconv.Atoi(portRaw)
-			tport := layers.NewTCPPortEndpoint(layers.TCPPort(p))
-			uport := layers.NewUDPPortEndpoint(layers.UDPPort(p))
-
-			if _, ok := s.counters[ip]; !ok {
-				s.counters[ip] = map[gopacket.Endpoint]*counters{}
-			}
-
-			if _, ok := s.counters[ip6]; !ok && has6 {
-				s.counters[ip6] = map[gopacket.Endpoint]*counters{}
-			}
-
-			if _, ok := s.counters[ip][tport]; !ok {
-				s.counters[ip][tport] = NewCounters(cfg.Namespace, cfg.Service, cfg.PortName, true)
-				if has6 {
-					s.counters[ip6][tport] = NewCounters(cfg.Namespace, cfg.Service, cfg.PortName, true)
-				}
-			}
-			if _, ok := s.counters[ip][uport]; !ok {
-				s.counters[ip][uport] = NewCounters(cfg.Namespace, cfg.Service, cfg.PortName, false)
-				if has6 {
-					s.counters[ip6][uport] = NewCounters(cfg.Namespace, cfg.Service, cfg.PortName, false)
-				}
+			add(string(ipRaw), p, cfg)
+			if has6 {
+				add(string(ip6Raw), p, cfg)
 			}
 		}
 	}
+	for ipRaw, portMap := range c.Config6 {
+		for portRaw, cfg := range portMap {
+			p, _ := strconv.Atoi(portRaw)
+			add(string(ipRaw), p, cfg)
+		}
+	}
+	s.counters = flows
 
-	// set the BPF filter
-	// log.Debugln("ip set: %v", ipset)
-	return s.setBPFFilter(ipset)
-}
-
-// setBPFFilter takes a list of ip addresses and sets the berkely packet filter
-// in our pcap to filter traffic to just those addresses. This prevents the pcap from
-// needing to process 100% of the tcp and udp traffic on a node.
-func (s *Stats) setBPFFilter(ips []string) error {
 	if !s.flowMetricsEnabled {
 		return nil
 	}
-	filters := strings.Join(ips, " or ")
-
-	return s.pcap.SetBPFFilter(fmt.Sprintf("(tcp or udp) and (%s)", filters))
-}
-
-func (s *Stats) capture() {
-
-	// Fast parsing approach - reuse the same layers every time.
-	var eth layers.Ethernet
-	var ip4 layers.IPv4
-	var ip6 layers.IPv6
-	var tcp layers.TCP
-	var udp layers.UDP
-	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &eth, &ip4, &ip6, &tcp, &udp)
-	decoded := []gopacket.LayerType{}
 
-	for {
-		data, ci, err := s.pcap.ReadPacketData()
-		// ReadPacketData() will give data []byte the underlying buffer
-		// that the C language PCAP library uses. The Go runtime won't know about that
-		// memory. Since var data []byte doesn't escape this for-loop, much less func capture(),
-		// it's allocated on the stack, and isn't eligible for garbage collection. I think.
-		// That means the the memory that data []byte really uses isn't garbage collected either.
-		// Since this function, func capture() is run by only one go routine, there shouldn't be
-		// an issue with race conditions for the C PCAP library buffer.
-		if err != nil {
-			// shouldn't happen but we'll quit another way.
-			continue
+	// only the keys present in the map are counted by the kernel.
+	keys := map[vipKey]bool{}
+	for flow := range flows {
+		proto := protoUDP
+		if flow.isTCP {
+			proto = protoTCP
 		}
-		parser.DecodeLayers(data, &decoded)
-		if len(decoded) != 3 {
-			// icmp messages or weird ipv6 things
+		ip := net.ParseIP(flow.ip)
+		if ip == nil {
 			continue
-
-		} else if layers.LayerTypeTCP == decoded[2] {
-			if layers.LayerTypeIPv6 == decoded[1] {
-				if stats, ok := s.getCountersAndIncrement(ci.CaptureLength, ip6.SrcIP, ip6.DstIP, tcp.SrcPort, tcp.DstPort); ok {
-					s.metricTCP(stats, tcp)
-				}
-			} else if layers.LayerTypeIPv4 == decoded[1] {
-				if stats, ok := s.getCountersAndIncrement(ci.CaptureLength, ip4.SrcIP, ip4.DstIP, tcp.SrcPort, tcp.DstPort); ok {
-					s.metricTCP(stats, tcp)
-				}
-			}
-
+		}
+		keys[newVIPKey(ip, flow.port, proto, dirRx)] = true
+		keys[newVIPKey(ip, flow.port, proto, dirTx)] = true
+	}
+	for key := range s.totals {
+		if !keys[key] {
+			delete(s.totals, key)
 		}
 	}
+	return s.bpf.sync(keys)
 }
 
-// initMetrics initialize the prometheus flowMetrics stats handlers + server
-func (s *Stats) initMetrics() error {
-	// initialize all the stats
-	s.flowMetrics = newFlowMetrics(s.kind)
+func (s *Stats) startServer() error {
+	server, err := s.serve(s.prometheusPort)
+	if err != nil {
+		return err
+	}
+	s.server = server
 	return nil
 }
 
-func (s *Stats) startServer() error {
-	s.logger.Infof("starting metrics server on: %v", s.prometheusPort)
+// SetPort moves the metrics server to port. The server on the old port is
+// closed once the new one is up, and kept if it doesn't come up.
+func (s *Stats) SetPort(port string) error {
+	s.serverMu.Lock()
+	defer s.serverMu.Unlock()
+	if port == s.prometheusPort {
+		return nil
+	}
+	server, err := s.serve(port)
+	if err != nil {
+		return err
+	}
+	if s.server != nil {
+		s.server.Close()
+	}
+	s.server, s.prometheusPort = server, port
+	return nil
+}
+
+func (s *Stats) serve(port string) (*http.Server, error) {
+	s.logger.Infof("starting metrics server on: %v", port)
 
 	// we start the server async, but add a tiem delay in the code below in order to catch errors
 	// quickly. this will help to prevent configuration errors where the stats port is invalid.
-	errs := make(chan error)
-	http.Handle("/metrics", promhttp.Handler())
+	// a private mux keeps anything registered on the default mux, like
+	// net/http/pprof, off of this public listener.
+	errs := make(chan error, 1)
+	mux := http.NewServeMux()
+	// OpenMetrics is negotiated so that scrapers asking for it get exemplars.
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+	mux.Handle("/metrics/catalog", CatalogHandler())
+	server := &http.Server{Addr: fmt.Sprintf(":%s", port), Handler: mux}
 	go func() {
-		err := http.ListenAndServe(fmt.Sprintf(":%s", s.prometheusPort), nil)
-		if err != nil {
-			s.logger.Errorf("prometheus stats server could not be initialized on port %s: %s", s.prometheusPort, err.Error())
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			s.logger.Errorf("prometheus stats server could not be initialized on port %s: %s", port, err.Error())
 		}
 		errs <- err
 	}()
 
 	select {
 	case err := <-errs:
-		return fmt.Errorf("prometheus stats server could not be initialized on port %s: %s", s.prometheusPort, err.Error())
+		return nil, fmt.Errorf("prometheus stats server could not be initialized on port %s: %s", port, err.Error())
 	case <-time.After(3 * time.Second):
 		// break out after N seconds
 	}
-	return nil
-}
-
-func (s *Stats) getCountersAndIncrement(i int, srcIP, dstIP net.IP, sp, dp interface{}) (*counters, bool) {
-	n := uint64(i)
-
-	isTCP := true
-	src := layers.NewIPEndpoint(srcIP)
-	dst := layers.NewIPEndpoint(dstIP)
-	var srcPort, dstPort gopacket.Endpoint
-	switch sp.(type) {
-	case layers.TCPPort:
-		srcPort = layers.NewTCPPortEndpoint(sp.(layers.TCPPort))
-		dstPort = layers.NewTCPPortEndpoint(dp.(layers.TCPPort))
-	case layers.UDPPort:
-		srcPort = layers.NewUDPPortEndpoint(sp.(layers.UDPPort))
-		dstPort = layers.NewUDPPortEndpoint(dp.(layers.UDPPort))
-		isTCP = false
-	default:
-		s.logger.Debugf("fallthrough on source port type detection.")
-		return nil, false
-	}
-
-	var outStats *counters
-	var found bool
-	s.Lock()
-	defer s.Unlock()
-	if pm, ok := s.counters[dst]; ok {
-		// this is receive traffic
-		if stats, ok := pm[dstPort]; ok {
-			found = true
-			outStats = stats
-			if isTCP {
-				stats.AddTCPRx(n)
-			} else {
-				stats.AddUDPRx(n)
-			}
-		}
-
-	} else if pm, ok = s.counters[src]; ok {
-		// this is transmit traffic
-		if stats, ok := pm[srcPort]; ok {
-			found = true
-			outStats = stats
-			if isTCP {
-				stats.AddTCPTx(n)
-			} else {
-				stats.AddUDPTx(n)
-			}
-		}
-	}
-	return outStats, found
-}
-
-func (s *Stats) metricTCP(stats *counters, tcp layers.TCP) {
-	// count handshake, fin, resets, and congestion window messages
-	// this is an if/elseif block because each of these messages is
-	// believed to be mutually exclusive, i.e. the tcp implemenation
-	// would not send a RST packet at the same time as a FIN packet.
-	if tcp.SYN && tcp.ACK {
-		stats.IncrTCPSynAck()
-	} else if tcp.FIN {
-		stats.IncrTCPFin()
-	} else if tcp.RST {
-		stats.IncrTCPRst()
-	}
+	return server, nil
 }
 
 func clean(ip string) string {
@@ -1,9 +1,27 @@
 package stats
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 func TestCounters(t *testing.T) {
@@ -39,3 +57,499 @@ func BenchmarkCounters(b *testing.B) {
 		c.AddTCPRx(1) // without the fn call this only takes 2ns
 	}
 }
+
+func TestVIPKey(t *testing.T) {
+	k := newVIPKey(net.ParseIP("10.54.213.148"), 8080, protoTCP, dirTx)
+	if k.Addr[0] != 10 || k.Addr[3] != 148 || k.Addr[4] != 0 {
+		t.Fatalf("expected v4 address in leading bytes. saw %v", k.Addr)
+	}
+	if k.Port != [2]byte{0x1f, 0x90} {
+		t.Fatalf("expected port in network byte order. saw %v", k.Port)
+	}
+	if n := binary.Size(k); n != 24 {
+		t.Fatalf("expected key size of 24. saw %d", n)
+	}
+	if n := binary.Size(vipValue{}); n != 40 {
+		t.Fatalf("expected value size of 40. saw %d", n)
+	}
+}
+
+func TestCounterInstructions(t *testing.T) {
+	for _, dir := range []uint8{dirRx, dirTx} {
+		var buf bytes.Buffer
+		if err := counterInstructions(3, dir, -1, 0, -1).Marshal(&buf, binary.LittleEndian); err != nil {
+			t.Fatalf("unable to assemble counter program for direction %d: %v", dir, err)
+		}
+		buf.Reset()
+		if err := counterInstructions(3, dir, 4, 100, -1).Marshal(&buf, binary.LittleEndian); err != nil {
+			t.Fatalf("unable to assemble sampling counter program for direction %d: %v", dir, err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := counterInstructions(3, dirRx, 4, 100, 5).Marshal(&buf, binary.LittleEndian); err != nil {
+		t.Fatalf("unable to assemble counter program with top talkers: %v", err)
+	}
+}
+
+func TestTopTalkers(t *testing.T) {
+	if n := binary.Size(talkerKey{}); n != 40 {
+		t.Fatalf("expected talkers key size of 40. saw %d", n)
+	}
+
+	var a, b, c [16]byte
+	copy(a[:], net.ParseIP("192.0.2.1").To4())
+	copy(b[:], net.ParseIP("192.0.2.2").To4())
+	copy(c[:], net.ParseIP("192.0.2.3").To4())
+	totals := map[[16]byte]talkerValue{
+		a: {Packets: 1, Bytes: 100},
+		b: {Packets: 9, Bytes: 9000},
+		c: {},
+	}
+	top := topTalkers(totals, true, 10)
+	if len(top) != 2 || top[0].Source != "192.0.2.2" || top[1].Bytes != 100 {
+		t.Fatalf("expected sources with traffic, busiest first. saw %+v", top)
+	}
+	if top := topTalkers(totals, true, 1); len(top) != 1 {
+		t.Fatalf("expected only the top source. saw %+v", top)
+	}
+
+	s := &Stats{}
+	for query, code := range map[string]int{
+		"":                           400,
+		"?vip=nope":                  400,
+		"?vip=192.0.2.10&port=70000": 400,
+		"?vip=192.0.2.10&window=1h":  400,
+		"?vip=192.0.2.10":            503,
+	} {
+		rec := httptest.NewRecorder()
+		s.TalkersHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/talkers"+query, nil))
+		if rec.Code != code {
+			t.Fatalf("expected %d for %q. saw %d", code, query, rec.Code)
+		}
+	}
+}
+
+func TestParseSample(t *testing.T) {
+	raw := make([]byte, 8+sampleCaplen+4)
+	binary.BigEndian.PutUint32(raw[0:], 1500)
+	raw[4] = dirTx
+	raw[8] = 0xaa
+
+	sample, ok := parseSample(raw, time.Now())
+	if !ok {
+		t.Fatal("expected sample to parse")
+	}
+	if sample.Ingress || sample.Length != 1500 || len(sample.Header) != sampleCaplen || sample.Header[0] != 0xaa {
+		t.Fatalf("unexpected sample %+v", sample)
+	}
+
+	// short packets are captured whole, ignoring the padding
+	binary.BigEndian.PutUint32(raw[0:], 60)
+	if sample, _ := parseSample(raw, time.Now()); len(sample.Header) != 60 {
+		t.Fatalf("expected 60 header bytes. saw %d", len(sample.Header))
+	}
+
+	if _, ok := parseSample(raw[:40], time.Now()); ok {
+		t.Fatal("expected a truncated sample to be rejected")
+	}
+}
+
+func TestServiceMetrics(t *testing.T) {
+	m := NewServiceMetrics(KindIpvsMaster)
+	healthy := func() map[string]float64 {
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := map[string]float64{}
+		for _, f := range families {
+			if f.GetName() != Prefix+"service_reconfigure_healthy" {
+				continue
+			}
+			for _, metric := range f.GetMetric() {
+				for _, l := range metric.GetLabel() {
+					if l.GetName() == "service" {
+						out[l.GetValue()] = metric.GetGauge().GetValue()
+					}
+				}
+			}
+		}
+		return out
+	}
+
+	m.Results("ipv4", []ServiceResult{
+		{VIP: "10.0.0.1", Port: "80", Protocol: "tcp", Service: "web"},
+		{VIP: "10.0.0.1", Port: "81", Protocol: "tcp", Service: "api", Applied: true, Err: fmt.Errorf("failed")},
+	})
+	if h := healthy(); h["web"] != 1 || h["api"] != 0 || len(h) != 2 {
+		t.Fatalf("unexpected health %v", h)
+	}
+
+	// api was removed from the config
+	m.Results("ipv4", []ServiceResult{
+		{VIP: "10.0.0.1", Port: "80", Protocol: "tcp", Service: "web"},
+	})
+	if h := healthy(); h["web"] != 1 || len(h) != 1 {
+		t.Fatalf("expected only web to be reported, saw %v", h)
+	}
+
+	// a nil ServiceMetrics is a no-op
+	var none *ServiceMetrics
+	none.Results("ipv4", nil)
+}
+
+func TestBackendMetrics(t *testing.T) {
+	m := NewBackendMetrics(KindIpvsMaster)
+	states := func() map[string]float64 {
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := map[string]float64{}
+		for _, f := range families {
+			if f.GetName() != Prefix+"backend_state" {
+				continue
+			}
+			for _, metric := range f.GetMetric() {
+				labels := map[string]string{}
+				for _, l := range metric.GetLabel() {
+					labels[l.GetName()] = l.GetValue()
+				}
+				out[labels["node"]+" "+labels["state"]] = metric.GetGauge().GetValue()
+			}
+		}
+		return out
+	}
+
+	backend := func(node, state string, weight int) BackendState {
+		return BackendState{VIP: "10.0.0.1", Port: "80", Protocol: "TCP", Service: "web", Node: node, State: state, Weight: weight}
+	}
+	m.Set(FamilyV4, []BackendState{
+		backend("node-a", BackendActive, 2),
+		backend("node-b", BackendDraining, 0),
+		backend("node-c", BackendCordoned, 0),
+	})
+	if s := states(); s["node-a active"] != 2 || s["node-b draining"] != 0 || len(s) != 3 {
+		t.Fatalf("unexpected scoreboard %v", s)
+	}
+
+	// node-b has endpoints again and node-c was removed from the cluster
+	m.Set(FamilyV4, []BackendState{
+		backend("node-a", BackendActive, 2),
+		backend("node-b", BackendActive, 1),
+	})
+	if s := states(); s["node-b active"] != 1 || len(s) != 2 {
+		t.Fatalf("expected the previous states to be removed, saw %v", s)
+	}
+
+	// a nil BackendMetrics is a no-op
+	var none *BackendMetrics
+	none.Set(FamilyV4, nil)
+}
+
+func TestConfigSeen(t *testing.T) {
+	w := NewWorkerStateMetrics(KindIpvsBackend, "test")
+	labels := prometheus.Labels{"lb": KindIpvsBackend, "seczone": "test"}
+	published := time.Now()
+
+	// the first publish seen has nothing to coalesce
+	w.ConfigSeen(1, published)
+	// publishes 2 and 3 were replaced by 4 before the next pass
+	w.ConfigSeen(4, published)
+	// no new publish
+	w.ConfigSeen(4, published)
+
+	if v := testutil.ToFloat64(w.configUpdate.With(labels)); v != 2 {
+		t.Errorf("expected 2 config updates, saw %v", v)
+	}
+	if v := testutil.ToFloat64(w.configCoalesced.With(labels)); v != 2 {
+		t.Errorf("expected 2 coalesced updates, saw %v", v)
+	}
+}
+
+func TestChannelMetrics(t *testing.T) {
+	a := NewChannelMetrics(KindIpvsMaster, ChannelNodes)
+	b := NewChannelMetrics(KindIpvsMaster, ChannelPublish)
+
+	a.Blocked(time.Millisecond)
+	a.Coalesced(3)
+	b.Dropped()
+
+	if v := testutil.ToFloat64(channelBlocked.With(a.labels)); v != 1 {
+		t.Errorf("expected 1 blocked send, saw %v", v)
+	}
+	if v := testutil.ToFloat64(channelCoalesced.With(a.labels)); v != 3 {
+		t.Errorf("expected 3 coalesced updates, saw %v", v)
+	}
+	if v := testutil.ToFloat64(channelDropped.With(a.labels)); v != 0 {
+		t.Errorf("expected no drops on %s, saw %v", ChannelNodes, v)
+	}
+	if v := testutil.ToFloat64(channelDropped.With(b.labels)); v != 1 {
+		t.Errorf("expected 1 drop on %s, saw %v", ChannelPublish, v)
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	newFlowMetrics(KindIpvsMaster)
+
+	defined := map[string]Definition{}
+	for _, d := range Catalog() {
+		defined[d.Name] = d
+	}
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if strings.HasPrefix(f.GetName(), Prefix) {
+			if _, ok := defined[f.GetName()]; !ok {
+				t.Fatalf("metric %s is registered but not in the catalog", f.GetName())
+			}
+		}
+	}
+	if d := defined[Prefix+"tx_bytes_total"]; d.Type != Counter || d.Replaces != "rdei_lb_tx_bytes" || len(d.Labels) != len(standardLabels) {
+		t.Fatalf("unexpected definition %+v", d)
+	}
+
+	for _, bad := range []Definition{
+		{Type: Counter, Name: "requests", Help: "x"},
+		{Type: Gauge, Name: "requests_total", Help: "x"},
+		{Type: Gauge, Name: "requestCount", Help: "x"},
+		{Type: Gauge, Name: "requests", Help: "x", Labels: []string{"addrKind"}},
+		{Type: Histogram, Name: "request_microseconds", Help: "x"},
+	} {
+		if bad.validate() == nil {
+			t.Fatalf("expected %+v to be rejected", bad)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	CatalogHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics/catalog", nil))
+	var body struct {
+		Metrics []Definition      `json:"metrics"`
+		Labels  map[string]string `json:"labels"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Metrics) != len(defined) || body.Labels["family"] == "" {
+		t.Fatalf("unexpected catalog %s", rec.Body.String())
+	}
+}
+
+// TestTalkersProgram runs a packet through the ingress program. It needs
+// permission to load eBPF programs and is skipped without it.
+func TestTalkersProgram(t *testing.T) {
+	counts, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.PerCPUHash, KeySize: 24, ValueSize: 40, MaxEntries: 16})
+	if err != nil {
+		t.Skipf("unable to create eBPF maps: %v", err)
+	}
+	defer counts.Close()
+	talkers, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.LRUHash, KeySize: 40, ValueSize: 16, MaxEntries: 16})
+	if err != nil {
+		t.Skipf("unable to create eBPF maps: %v", err)
+	}
+	defer talkers.Close()
+	prog, err := newCounterProgram("ravel_test", counts, dirRx, nil, 0, talkers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prog.Close()
+
+	vip := net.ParseIP("10.0.0.1")
+	key := newVIPKey(vip, 80, protoTCP, dirRx)
+	v := &vipCounters{counts: counts, talkers: talkers}
+	if err := v.sync(map[vipKey]bool{key: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// ethernet, ipv4 and tcp headers from 192.0.2.7 to the VIP on port 80
+	pkt := make([]byte, 64)
+	pkt[12] = 0x08
+	pkt[14] = 0x45
+	pkt[14+9] = protoTCP
+	copy(pkt[14+12:], net.ParseIP("192.0.2.7").To4())
+	copy(pkt[14+16:], vip.To4())
+	pkt[34+3] = 80
+	for i := 0; i < 3; i++ {
+		if _, _, err := prog.Test(pkt); err != nil {
+			t.Skipf("unable to test run eBPF programs: %v", err)
+		}
+	}
+
+	totals, err := v.readTalkers(key.Addr, key.Port, protoTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top := topTalkers(totals, true, 10)
+	if len(top) != 1 || top[0].Source != "192.0.2.7" || top[0].Packets != 3 || top[0].Bytes != 3*64 {
+		t.Fatalf("expected 3 packets from 192.0.2.7. saw %+v", top)
+	}
+}
+
+func TestExemplars(t *testing.T) {
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_latency", Help: "test", Buckets: LatencyBuckets}, []string{"phase"})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(h)
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	sampled := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+	observe(sampled, h.WithLabelValues("ipvs"), 1500)
+	observe(context.Background(), h.WithLabelValues("bgp"), 1500)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{EnableOpenMetrics: true}).ServeHTTP(w, r)
+	body := w.Body.String()
+	if strings.Count(body, `trace_id="4bf92f3577b34da6a3ce929d0e0e4736"`) != 1 {
+		t.Fatalf("expected one exemplar with the trace id. saw\n%s", body)
+	}
+}
+
+// decodeWriteRequest returns the labels and value of each series in a
+// WriteRequest.
+func decodeWriteRequest(t *testing.T, b []byte) []map[string]string {
+	fields := func(b []byte, f func(num protowire.Number, v []byte, fixed uint64)) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			b = b[n:]
+			switch typ {
+			case protowire.BytesType:
+				v, n := protowire.ConsumeBytes(b)
+				f(num, v, 0)
+				b = b[n:]
+			case protowire.Fixed64Type:
+				v, n := protowire.ConsumeFixed64(b)
+				f(num, nil, v)
+				b = b[n:]
+			default:
+				n := protowire.ConsumeFieldValue(num, typ, b)
+				if n < 0 {
+					t.Fatalf("malformed write request")
+				}
+				b = b[n:]
+			}
+		}
+	}
+	out := []map[string]string{}
+	fields(b, func(_ protowire.Number, ts []byte, _ uint64) {
+		series := map[string]string{}
+		fields(ts, func(num protowire.Number, v []byte, _ uint64) {
+			switch num {
+			case 1:
+				var name, value string
+				fields(v, func(num protowire.Number, v []byte, _ uint64) {
+					if num == 1 {
+						name = string(v)
+					} else {
+						value = string(v)
+					}
+				})
+				series[name] = value
+			case 2:
+				fields(v, func(num protowire.Number, _ []byte, fixed uint64) {
+					if num == 1 {
+						series["value"] = fmt.Sprint(math.Float64frombits(fixed))
+					}
+				})
+			}
+		})
+		out = append(out, series)
+	})
+	return out
+}
+
+func TestRemoteWrite(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total", Help: "test"}, []string{"lb"})
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_latency", Help: "test", Buckets: []float64{1, 10}})
+	reg.MustRegister(c, h)
+	c.WithLabelValues("bgp").Add(3)
+	h.Observe(5)
+
+	requests := 0
+	series := []map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if user, pass, _ := r.BasicAuth(); user != "ravel" || pass != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "snappy" {
+			http.Error(w, "expected snappy", http.StatusBadRequest)
+			return
+		}
+		// the first request fails, and is retried
+		if requests == 1 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		compressed, _ := ioutil.ReadAll(r.Body)
+		b, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		series = append(series, decodeWriteRequest(t, b)...)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	config := RemoteWriteConfig{
+		URL:       server.URL,
+		Interval:  time.Minute,
+		BatchSize: 10,
+		Timeout:   time.Second,
+		Retries:   1,
+		Username:  "ravel",
+		Password:  "secret",
+		Labels:    map[string]string{"instance": "director-1", "lb": "ignored"},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	w := &remoteWriter{
+		config:   config,
+		gatherer: reg,
+		client:   &http.Client{Timeout: config.Timeout},
+		samples:  remoteWriteSamplesDef.CounterVec(),
+		retries:  remoteWriteRetriesDef.CounterVec().WithLabelValues(string(KindBGPDirector)),
+		kind:     string(KindBGPDirector),
+	}
+	if err := w.push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Fatalf("expected the failed request to be retried once. saw %d requests", requests)
+	}
+
+	// a counter, three buckets, a sum and a count
+	if len(series) != 6 {
+		t.Fatalf("expected 6 series. saw %v", series)
+	}
+	found := false
+	for _, s := range series {
+		if s["instance"] != "director-1" {
+			t.Fatalf("expected the instance label on every series. saw %v", s)
+		}
+		if s["__name__"] == "test_total" {
+			found = s["lb"] == "bgp" && s["value"] == "3"
+		}
+	}
+	if !found {
+		t.Fatalf("expected test_total{lb=\"bgp\"} 3, keeping its own lb label. saw %v", series)
+	}
+
+	// a client error isn't retried
+	w.config.Password = "wrong"
+	requests = 0
+	if err := w.push(context.Background()); err == nil || requests != 1 {
+		t.Fatalf("expected one failed request. saw %d, %v", requests, err)
+	}
+}
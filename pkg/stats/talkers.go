@@ -0,0 +1,171 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTalkers is the default number of sources tracked for top
+	// talkers across all VIPs.
+	DefaultTalkers = 65536
+
+	defaultTopN = 10
+	maxTopN     = 1000
+
+	// maxTalkersWindow bounds how long a top talkers request may measure for.
+	maxTalkersWindow = time.Minute
+)
+
+// Talker is a source address's traffic to a VIP.
+type Talker struct {
+	Source  string `json:"source"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// TopTalkers returns the n sources that sent the most bytes to vip, busiest
+// first. A zero port counts traffic to every port and protocol of the VIP.
+// With a zero window, the totals are since each source was first seen, which
+// is reset when a source is evicted from the map. Otherwise they are the
+// traffic seen over window, which TopTalkers waits for.
+func (s *Stats) TopTalkers(ctx context.Context, vip string, port int, protocol string, n int, window time.Duration) ([]Talker, error) {
+	ip := net.ParseIP(vip)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid vip %q", vip)
+	}
+	var proto uint8
+	if port != 0 {
+		switch strings.ToLower(protocol) {
+		case "tcp", "":
+			proto = protoTCP
+		case "udp":
+			proto = protoUDP
+		default:
+			return nil, fmt.Errorf("invalid protocol %q. must be tcp or udp", protocol)
+		}
+	}
+	key := newVIPKey(ip, port, proto, dirRx)
+
+	s.Lock()
+	v := s.bpf
+	s.Unlock()
+	if v == nil {
+		return nil, fmt.Errorf("stats are not enabled")
+	}
+
+	totals, err := v.readTalkers(key.Addr, key.Port, proto)
+	if err != nil {
+		return nil, err
+	}
+	if window > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(window):
+		}
+		before := totals
+		if totals, err = v.readTalkers(key.Addr, key.Port, proto); err != nil {
+			return nil, err
+		}
+		for src, t := range totals {
+			b := before[src]
+			// a source evicted and seen again within the window restarts
+			// from zero.
+			if b.Bytes <= t.Bytes && b.Packets <= t.Packets {
+				t.Bytes -= b.Bytes
+				t.Packets -= b.Packets
+			}
+			totals[src] = t
+		}
+	}
+	return topTalkers(totals, ip.To4() != nil, n), nil
+}
+
+// topTalkers sorts sources by bytes and returns the first n with traffic.
+// Sources are v4 when the VIP is, and occupy the first four bytes.
+func topTalkers(totals map[[16]byte]talkerValue, v4 bool, n int) []Talker {
+	out := make([]Talker, 0, len(totals))
+	for src, t := range totals {
+		if t.Bytes == 0 {
+			continue
+		}
+		source := net.IP(src[:])
+		if v4 {
+			source = net.IP(src[:4])
+		}
+		out = append(out, Talker{Source: source.String(), Packets: t.Packets, Bytes: t.Bytes})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Bytes != out[j].Bytes {
+			return out[i].Bytes > out[j].Bytes
+		}
+		return out[i].Source < out[j].Source
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// TalkersHandler serves the top talkers of a VIP as json, for the admin
+// endpoint:
+//
+//	GET /talkers?vip=10.54.213.10[&port=443&protocol=tcp][&n=10][&window=10s]
+func (s *Stats) TalkersHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var (
+			port   int
+			n      = defaultTopN
+			window time.Duration
+			err    error
+		)
+		if net.ParseIP(q.Get("vip")) == nil {
+			http.Error(w, "vip must be an ip address", http.StatusBadRequest)
+			return
+		}
+		if p := strings.ToLower(q.Get("protocol")); p != "" && p != "tcp" && p != "udp" {
+			http.Error(w, "protocol must be tcp or udp", http.StatusBadRequest)
+			return
+		}
+		if v := q.Get("port"); v != "" {
+			if port, err = strconv.Atoi(v); err != nil || port < 1 || port > 65535 {
+				http.Error(w, "port must be between 1 and 65535", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("n"); v != "" {
+			if n, err = strconv.Atoi(v); err != nil || n < 1 || n > maxTopN {
+				http.Error(w, fmt.Sprintf("n must be between 1 and %d", maxTopN), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("window"); v != "" {
+			if window, err = time.ParseDuration(v); err != nil || window < 0 || window > maxTalkersWindow {
+				http.Error(w, fmt.Sprintf("window must be a duration of at most %s", maxTalkersWindow), http.StatusBadRequest)
+				return
+			}
+		}
+
+		talkers, err := s.TopTalkers(r.Context(), q.Get("vip"), port, q.Get("protocol"), n, window)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			VIP     string   `json:"vip"`
+			Port    int      `json:"port,omitempty"`
+			Window  string   `json:"window,omitempty"`
+			Talkers []Talker `json:"talkers"`
+		}{q.Get("vip"), port, q.Get("window"), talkers})
+	})
+}
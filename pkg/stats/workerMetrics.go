@@ -1,10 +1,160 @@
 package stats
 
 import (
+	"context"
 	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Reconfigure phases and address families, used to label the phase latency
+// histogram. The end-to-end reconfigure is recorded as PhaseTotal with
+// FamilyAll, as is any phase that covers both families.
+const (
+	PhaseTotal     = "total"
+	PhaseParity    = "parity"
+	PhaseAddresses = "addresses"
+	PhaseBGP       = "bgp"
+	PhaseIPVS      = "ipvs"
+	PhaseIPTables  = "iptables"
+	PhaseHAProxy   = "haproxy"
+
+	FamilyV4  = "v4"
+	FamilyV6  = "v6"
+	FamilyAll = "all"
+)
+
+var (
+	workerLabels  = []string{"lb", "seczone"}
+	outcomeLabels = []string{"lb", "seczone", "outcome"}
+	familyLabels  = []string{"lb", "seczone", "family"}
+	phaseLabels   = []string{"lb", "seczone", "phase", "family", "outcome"}
+)
+
+var (
+	reconfigureDef = Define(Definition{
+		Type:     Counter,
+		Name:     "reconfigure_total",
+		Help:     "is a count of reconfiguration events with labels denoting a success|error|noop",
+		Labels:   outcomeLabels,
+		Replaces: "rdei_lb_reconfigure_count",
+	})
+	reconfigurePhaseDef = Define(Definition{
+		Type:     Histogram,
+		Name:     "reconfigure_phase_latency_microseconds",
+		Help:     "is a histogram denoting the amount of time each phase of a reconfiguration took, split out by labels on the phase addresses|bgp|ipvs|iptables|haproxy|parity, the address family v4|v6 and the outcome. phase total with family all is the end-to-end reconfiguration.",
+		Labels:   phaseLabels,
+		Buckets:  LatencyBuckets,
+		Replaces: "rdei_lb_reconfigure_phase_latency_microseconds",
+	})
+	channelDepthDef = Define(Definition{
+		Type:     Gauge,
+		Name:     "channel_depth",
+		Help:     "is a gauge denoting the number of inbound clusterconfig objects in the configchan. a value greater than 1 indicates a potential slowdown or deadlock",
+		Labels:   workerLabels,
+		Replaces: "rdei_lb_channel_depth",
+	})
+	nodeUpdateDef = Define(Definition{
+		Type:     Counter,
+		Name:     "node_update_total",
+		Help:     "is a count of updates to the node or nodes array that are determined to be different from the current stored value",
+		Labels:   outcomeLabels,
+		Replaces: "rdei_lb_node_update_count",
+	})
+	configUpdateDef = Define(Definition{
+		Type:     Counter,
+		Name:     "config_update_total",
+		Help:     "is a count of clusterConfig updates received by the worker",
+		Labels:   workerLabels,
+		Replaces: "rdei_lb_config_update_count",
+	})
+	configUpdateCoalescedDef = Define(Definition{
+		Type:     Counter,
+		Name:     "config_update_coalesced_total",
+		Help:     "is a count of clusterConfig publishes that were replaced by a newer publish before the worker applied them",
+		Labels:   workerLabels,
+		Replaces: "rdei_lb_config_update_coalesced_count",
+	})
+	configUpdateDelayDef = Define(Definition{
+		Type:     Histogram,
+		Name:     "config_update_delay_microseconds",
+		Help:     "is a histogram of the time between a clusterConfig publish and the first reconfigure pass to read it",
+		Labels:   workerLabels,
+		Buckets:  LatencyBuckets,
+		Replaces: "rdei_lb_config_update_delay_microseconds",
+	})
+	arpingDupIPDef = Define(Definition{
+		Type:     Counter,
+		Name:     "arping_duplicate_ip_total",
+		Help:     "is a counter indicating the amount of times the linux arping command exits with exit status 1 indicating that a duplicate IP is found in the ARP cache. This has been tied to vaquero misconfigurations that result in failed MLAG bond interfaces",
+		Labels:   workerLabels,
+		Replaces: "rdei_lb_arping_duplicate_ip",
+	})
+	arpingIFDownDef = Define(Definition{
+		Type:     Counter,
+		Name:     "arping_if_down_total",
+		Help:     "is a counter indicating the amount of times the linux arping command exits with exit status 2 indicating that the target ethernet device is down",
+		Labels:   workerLabels,
+		Replaces: "rdei_lb_arping_if_down",
+	})
+	arpingUnknownDef = Define(Definition{
+		Type:     Counter,
+		Name:     "arping_fail_unknown_total",
+		Help:     "is a counter indicating the amount of times the linux arping command exits with unknown status",
+		Labels:   workerLabels,
+		Replaces: "rdei_lb_arping_fail_unknown",
+	})
+	loopbackAdditionDef = Define(Definition{
+		Type:     Counter,
+		Name:     "loopback_additions_total",
+		Help:     "is a counter indicating the amount of times an address was added to the loopback address by the BGP worker",
+		Labels:   familyLabels,
+		Replaces: "rdei_lb_loopback_addition",
+	})
+	loopbackAdditionErrDef = Define(Definition{
+		Type:     Counter,
+		Name:     "loopback_addition_errors_total",
+		Help:     "is a counter indicating the amount of times an error was seen adding an address to the loopback address by the BGP worker",
+		Labels:   familyLabels,
+		Replaces: "rdei_lb_loopback_addition_err",
+	})
+	loopbackRemovalDef = Define(Definition{
+		Type:     Counter,
+		Name:     "loopback_removals_total",
+		Help:     "is a counter indicating the amount of times an address was removed from the loopback address by the BGP worker",
+		Labels:   familyLabels,
+		Replaces: "rdei_lb_loopback_removal",
+	})
+	loopbackRemovalErrDef = Define(Definition{
+		Type:     Counter,
+		Name:     "loopback_removal_errors_total",
+		Help:     "is a counter indicating the amount of times an error was seen removing an address to the loopback address by the BGP worker",
+		Labels:   familyLabels,
+		Replaces: "rdei_lb_loopback_removal_err",
+	})
+	loopbackTotalConfiguredDef = Define(Definition{
+		Type:     Gauge,
+		Name:     "loopback_total_configured",
+		Help:     "is a gauge indicating the total quantity of addresses are added to the loopback interface by the BGP worker",
+		Labels:   familyLabels,
+		Replaces: "rdei_lb_loopback_total_configured",
+	})
+	loopbackConfigHealthyDef = Define(Definition{
+		Type:     Gauge,
+		Name:     "loopback_configuration_healthy",
+		Help:     "is a gauge indicating that there are no errors in loopback if configuration",
+		Labels:   familyLabels,
+		Replaces: "rdei_lb_loopback_configuration_healthy",
+	})
+	iptablesWriteFailureDef = Define(Definition{
+		Type:     Gauge,
+		Name:     "iptables_write_failure",
+		Help:     "is a gauge indicating if we failed to write to iptables",
+		Labels:   familyLabels,
+		Replaces: "rdei_lb_iptables_write_failure",
+	})
 )
 
 type WorkerStateMetrics struct {
@@ -28,19 +178,52 @@ type WorkerStateMetrics struct {
 	loopbackTotalConfigured *prometheus.GaugeVec
 	loopbackConfigHealthy   *prometheus.GaugeVec
 	iptablesWriteFail       *prometheus.GaugeVec
+
+	// cluster config publishes seen by the worker
+	configCoalesced *prometheus.CounterVec
+	configDelay     *prometheus.HistogramVec
+	lastPublish     uint64
 }
 
-// Reconfigure is the end-to-end reconfiguration event.
-// counter reconfigure_count
-// bucket reconfigure_latency
-func (w *WorkerStateMetrics) Reconfigure(outcome string, d time.Duration) {
-	labels := prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "outcome": outcome}
-	w.reconfigure.With(labels).Add(1)
-	w.reconfigureLatency.With(labels).Observe(float64(d.Nanoseconds() / 1000))
+// Reconfigure is the end-to-end reconfiguration event. ctx carries the span
+// of the reconfigure, whose trace is attached to the latency as an exemplar.
+// counter reconfigure_total
+// bucket reconfigure_phase_latency, phase total
+func (w *WorkerStateMetrics) Reconfigure(ctx context.Context, outcome string, d time.Duration) {
+	w.reconfigure.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "outcome": outcome}).Add(1)
+	w.observePhase(ctx, PhaseTotal, FamilyAll, outcome, d)
+}
+
+// ReconfigurePhase is a single phase of a reconfiguration, such as setting
+// addresses or applying ipvs rules for one address family.
+// bucket reconfigure_phase_latency
+func (w *WorkerStateMetrics) ReconfigurePhase(ctx context.Context, phase, family string, err error, d time.Duration) {
+	outcome := "complete"
+	if err != nil {
+		outcome = "error"
+	}
+	w.observePhase(ctx, phase, family, outcome, d)
+}
+
+func (w *WorkerStateMetrics) observePhase(ctx context.Context, phase, family, outcome string, d time.Duration) {
+	labels := prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "phase": phase, "family": family, "outcome": outcome}
+	observe(ctx, w.reconfigureLatency.With(labels), float64(d.Nanoseconds()/1000))
+}
+
+// observe records v, with the trace ID of the span in ctx as an exemplar if
+// the span was sampled. Exemplars are only exposed to scrapers that ask for
+// the OpenMetrics format, and spans are only sampled when tracing is enabled.
+func observe(ctx context.Context, o prometheus.Observer, v float64) {
+	sc := trace.SpanContextFromContext(ctx)
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && sc.IsSampled() {
+		eo.ObserveWithExemplar(v, prometheus.Labels{"trace_id": sc.TraceID().String()})
+		return
+	}
+	o.Observe(v)
 }
 
 // QueueDepth is the depth of the configuration channel
-// gauge config_chan_depth
+// gauge channel_depth
 func (w *WorkerStateMetrics) QueueDepth(depth int) {
 	w.queueDepth.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone}).Set(float64(depth))
 }
@@ -53,32 +236,53 @@ func (w *WorkerStateMetrics) ConfigUpdate() {
 	w.configUpdate.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone}).Add(1)
 }
 
-func (w *WorkerStateMetrics) LoopbackAdditions(additions int, addrKind string) {
-	w.loopbackAdditions.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "addrKind": addrKind}).Add(float64(additions))
+// ConfigSeen is called as a reconfigure pass reads the watcher's cluster
+// config, with the watcher's publish count and the time of the latest
+// publish. Publishes since the previous pass that were replaced before the
+// worker got to them are counted as coalesced, and the time the latest one
+// waited for the worker is observed. Passes must not run concurrently.
+// counter config_update_total
+// counter config_update_coalesced_total
+// bucket config_update_delay_microseconds
+func (w *WorkerStateMetrics) ConfigSeen(publishCount uint64, published time.Time) {
+	if publishCount <= w.lastPublish {
+		return
+	}
+	labels := prometheus.Labels{"lb": w.kind, "seczone": w.secZone}
+	w.configUpdate.With(labels).Add(1)
+	if w.lastPublish > 0 {
+		w.configCoalesced.With(labels).Add(float64(publishCount - w.lastPublish - 1))
+	}
+	w.configDelay.With(labels).Observe(float64(time.Since(published).Nanoseconds() / 1000))
+	w.lastPublish = publishCount
+}
+
+func (w *WorkerStateMetrics) LoopbackAdditions(additions int, family string) {
+	w.loopbackAdditions.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "family": family}).Add(float64(additions))
 }
 
-func (w *WorkerStateMetrics) LoopbackAdditionErr(errs int, addrKind string) {
-	w.loopbackAdditionErr.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "addrKind": addrKind}).Add(float64(errs))
+func (w *WorkerStateMetrics) LoopbackAdditionErr(errs int, family string) {
+	w.loopbackAdditionErr.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "family": family}).Add(float64(errs))
 }
 
-func (w *WorkerStateMetrics) LoopbackRemovals(removals int, addrKind string) {
-	w.loopbackRemovals.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "addrKind": addrKind}).Add(float64(removals))
+func (w *WorkerStateMetrics) LoopbackRemovals(removals int, family string) {
+	w.loopbackRemovals.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "family": family}).Add(float64(removals))
 }
 
-func (w *WorkerStateMetrics) LoopbackRemovalErr(errs int, addrKind string) {
-	w.loopbackRemovalErr.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "addrKind": addrKind}).Add(float64(errs))
+func (w *WorkerStateMetrics) LoopbackRemovalErr(errs int, family string) {
+	w.loopbackRemovalErr.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "family": family}).Add(float64(errs))
 }
 
-func (w *WorkerStateMetrics) LoopbackTotalDesired(totals int, addrKind string) {
-	w.loopbackTotalConfigured.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "addrKind": addrKind}).Set(float64(totals))
+func (w *WorkerStateMetrics) LoopbackTotalDesired(totals int, family string) {
+	w.loopbackTotalConfigured.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "family": family}).Set(float64(totals))
 }
 
-func (w *WorkerStateMetrics) LoopbackConfigHealthy(up int, addrKind string) {
-	w.loopbackConfigHealthy.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "addrKind": addrKind}).Set(float64(up))
+func (w *WorkerStateMetrics) LoopbackConfigHealthy(up int, family string) {
+	w.loopbackConfigHealthy.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "family": family}).Set(float64(up))
 }
 
 func (w *WorkerStateMetrics) IptablesWriteFailure(status int) {
-	w.iptablesWriteFail.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "addrKind": ""}).Set(float64(status))
+	w.iptablesWriteFail.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "family": FamilyAll}).Set(float64(status))
 }
 
 // ArpingFailure switch on what type of metric we should increment
@@ -94,138 +298,45 @@ func (w *WorkerStateMetrics) ArpingFailure(err error) {
 }
 
 // arpingDupIP is a duplicate IP fail of arping
-// counter arping_dup_ip
+// counter arping_duplicate_ip_total
 func (w *WorkerStateMetrics) arpingDupIPFail() {
 	w.arpingDupIP.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone}).Add(float64(1))
 }
 
 // arpingIFFail is a device down fail for arp
-// counter arping_if_down
+// counter arping_if_down_total
 func (w *WorkerStateMetrics) arpingIFFail() {
 	w.arpingIFDown.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone}).Add(float64(1))
 }
 
-// arpingIFFail is a device down fail for arp
-// counter arping_if_down
+// arpingUnknownFail is an arping failure with any other exit status
+// counter arping_fail_unknown_total
 func (w *WorkerStateMetrics) arpingUnknownFail() {
 	w.arpingFailUnknown.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone}).Add(float64(1))
 }
 
 func NewWorkerStateMetrics(kind, secZone string) *WorkerStateMetrics {
-
-	defaultLabels := []string{"lb", "seczone"}
-	lvsLabels := []string{"lb", "seczone", "addrKind"}
-	reconfigLabels := append(defaultLabels, []string{"outcome"}...)
-
-	// counter reconfigure_count
-	reconfig_count := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: Prefix + "reconfigure_count",
-		Help: "is a count of reconfiguration events with labels denoting a success|error|noop",
-	}, reconfigLabels)
-
-	// histogram reconfigure_bucket
-	reconfig_bucket := prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name:    Prefix + "reconfigure_latency_microseconds",
-		Help:    "is a histogram denoting the amount of time an end-to-end reconfiguration took, split out by labels on the outcome.",
-		Buckets: LatencyBuckets,
-	}, reconfigLabels)
-
-	// gauge channel_depth
-	channel_depth := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: Prefix + "channel_depth",
-		Help: "is a gauge denoting the number of inbound clusterconfig objects in the configchan. a value greater than 1 indicates a potential slowdown or deadlock",
-	}, defaultLabels)
-
-	// counter node_update_count
-	node_update_count := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: Prefix + "node_update_count",
-		Help: "is a count of updates to the node or nodes array that are determined to be different from the current stored value",
-	}, reconfigLabels)
-
-	// counter node_update_count
-	config_update_count := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: Prefix + "config_update_count",
-		Help: "is a count of clusterConfig updates received by the worker",
-	}, defaultLabels)
-
-	// arping duplicate IP
-	arping_dup_ip := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: Prefix + "arping_duplicate_ip",
-		Help: "is a counter indicating the amount of times the linux arping command exits with exit status 1 indicating that a duplicate IP is found in the ARP cache. This has been tied to vaquero misconfigurations that result in failed MLAG bond interfaces",
-	}, defaultLabels)
-
-	// arping ethernet interface down
-	arping_if_down := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: Prefix + "arping_if_down",
-		Help: "is a counter indicating the amount of times the linux arping command exits with exit status 2 indicating that the target ethernet device is down",
-	}, defaultLabels)
-
-	// arping ethernet interface down
-	arping_unknown := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: Prefix + "arping_fail_unknown",
-		Help: "is a counter indicating the amount of times the linux arping command exits with unknown status",
-	}, defaultLabels)
-
-	// addition of address to loopback
-	loopback_addition := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: Prefix + "loopback_addition",
-		Help: "is a counter indicating the amount of times an address was added to the loopback address by the BGP worker",
-	}, lvsLabels)
-
-	// loopback addition err
-	loopback_addition_err := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: Prefix + "loopback_addition_err",
-		Help: "is a counter indicating the amount of times an error was seen adding an address to the loopback address by the BGP worker",
-	}, lvsLabels)
-
-	// removal of address from loopback
-	loopback_removal := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: Prefix + "loopback_removal",
-		Help: "is a counter indicating the amount of times an address was removed from the loopback address by the BGP worker",
-	}, lvsLabels)
-
-	// loopback removal err
-	loopback_removal_err := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: Prefix + "loopback_removal_err",
-		Help: "is a counter indicating the amount of times an error was seen removing an address to the loopback address by the BGP worker",
-	}, lvsLabels)
-
-	// addition of address to loopback
-	loopback_total_configured := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: Prefix + "loopback_total_configured",
-		Help: "is a counter indicating the total quantity of addresses are added to the loopback interface by the BGP worker",
-	}, lvsLabels)
-
-	// addition of address to loopback
-	loopback_configuration_healthy := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: Prefix + "loopback_configuration_healthy",
-		Help: "is a counter indicator that there are no errors in loopback if configuration",
-	}, lvsLabels)
-
-	// failure to write to iptables
-	iptables_write_failure := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: Prefix + "iptables_write_failure",
-		Help: "is a gauge indicating if we failed to write to iptables",
-	}, lvsLabels)
-
-	prometheus.MustRegister(reconfig_count)
-	prometheus.MustRegister(channel_depth)
-	prometheus.MustRegister(reconfig_bucket)
-	prometheus.MustRegister(node_update_count)
-	prometheus.MustRegister(config_update_count)
-	prometheus.MustRegister(arping_dup_ip)
-	prometheus.MustRegister(arping_if_down)
-	prometheus.MustRegister(arping_unknown)
-	prometheus.MustRegister(loopback_addition)
-	prometheus.MustRegister(loopback_addition_err)
-	prometheus.MustRegister(loopback_removal)
-	prometheus.MustRegister(loopback_removal_err)
-	prometheus.MustRegister(loopback_total_configured)
-	prometheus.MustRegister(loopback_configuration_healthy)
-	prometheus.MustRegister(iptables_write_failure)
+	reconfig_count := reconfigureDef.CounterVec()
+	reconfig_bucket := reconfigurePhaseDef.HistogramVec()
+	channel_depth := channelDepthDef.GaugeVec()
+	node_update_count := nodeUpdateDef.CounterVec()
+	config_update_count := configUpdateDef.CounterVec()
+	config_update_coalesced := configUpdateCoalescedDef.CounterVec()
+	config_update_delay := configUpdateDelayDef.HistogramVec()
+	arping_dup_ip := arpingDupIPDef.CounterVec()
+	arping_if_down := arpingIFDownDef.CounterVec()
+	arping_unknown := arpingUnknownDef.CounterVec()
+	loopback_addition := loopbackAdditionDef.CounterVec()
+	loopback_addition_err := loopbackAdditionErrDef.CounterVec()
+	loopback_removal := loopbackRemovalDef.CounterVec()
+	loopback_removal_err := loopbackRemovalErrDef.CounterVec()
+	loopback_total_configured := loopbackTotalConfiguredDef.GaugeVec()
+	loopback_configuration_healthy := loopbackConfigHealthyDef.GaugeVec()
+	iptables_write_failure := iptablesWriteFailureDef.GaugeVec()
 
 	// init error counters to 0
 	arping_dup_ip.With(prometheus.Labels{"lb": kind, "seczone": secZone})
+	config_update_coalesced.With(prometheus.Labels{"lb": kind, "seczone": secZone})
 	arping_if_down.With(prometheus.Labels{"lb": kind, "seczone": secZone})
 	arping_unknown.With(prometheus.Labels{"lb": kind, "seczone": secZone})
 
@@ -248,5 +359,7 @@ func NewWorkerStateMetrics(kind, secZone string) *WorkerStateMetrics {
 		loopbackTotalConfigured: loopback_total_configured,
 		loopbackConfigHealthy:   loopback_configuration_healthy,
 		iptablesWriteFail:       iptables_write_failure,
+		configCoalesced:         config_update_coalesced,
+		configDelay:             config_update_delay,
 	}
 }
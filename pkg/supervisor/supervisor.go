@@ -0,0 +1,83 @@
+package supervisor
+
+import (
+	"context"
+	"runtime/debug"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// Each worker runs its loops in goroutines of their own, and a panic in one
+// of them would either take the process down or, once recovered, leave the
+// worker running without the loop and without anyone noticing. The
+// supervisor recovers a panicking loop, logs it with its stack, counts it,
+// and starts the loop again after a backoff. The backoff doubles with each
+// panic, up to MaxBackoff, and resets once the loop has run for MaxBackoff
+// without one.
+//
+// A loop holds no state across cycles that outlives it, so starting it again
+// resumes the worker where it left off. The watchdog still reports a loop
+// that gets stuck rather than panicking.
+
+var (
+	// MinBackoff is the wait before a loop is started again after its first
+	// panic.
+	MinBackoff = time.Second
+	// MaxBackoff bounds the wait between restarts.
+	MaxBackoff = time.Minute
+)
+
+var panicsDef = stats.Define(stats.Definition{
+	Type:   stats.Counter,
+	Name:   "worker_panics_total",
+	Help:   "is a count of the panics recovered in a worker loop, each of which restarts the loop",
+	Labels: []string{"lb", "loop"},
+})
+
+// Go runs loop in a goroutine until it returns or ctx is done, and restarts
+// it after each panic.
+func Go(ctx context.Context, kind stats.LBKind, name string, logger logging.Logger, loop func()) {
+	logger = logger.WithFields(logging.Fields{"module": "supervisor", "loop": name})
+	panics := panicsDef.CounterVec()
+	panics.WithLabelValues(string(kind), name)
+	go func() {
+		backoff := MinBackoff
+		for {
+			start := time.Now()
+			if !run(loop, name, logger) {
+				return
+			}
+			panics.WithLabelValues(string(kind), name).Inc()
+			if time.Since(start) >= MaxBackoff {
+				backoff = MinBackoff
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Warnf("supervisor: restarting %s in %v", name, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff *= 2
+			if backoff > MaxBackoff {
+				backoff = MaxBackoff
+			}
+		}
+	}()
+}
+
+// run calls loop, and reports whether it panicked.
+func run(loop func(), name string, logger logging.Logger) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			logger.Errorf("supervisor: %s panicked. %v\n%s", name, r, debug.Stack())
+		}
+	}()
+	loop()
+	return false
+}
@@ -0,0 +1,54 @@
+package supervisor
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+func TestGo(t *testing.T) {
+	MinBackoff, MaxBackoff = time.Millisecond, 4*time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a loop that panics twice is started again each time, and isn't once
+	// it returns
+	var runs int32
+	done := make(chan struct{})
+	Go(ctx, stats.KindIpvsMaster, "test.periodic", logging.New(), func() {
+		if atomic.AddInt32(&runs, 1) <= 2 {
+			panic("nil map")
+		}
+		close(done)
+	})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the loop to be restarted after each panic")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&runs); n != 3 {
+		t.Fatalf("expected 3 runs, got %d", n)
+	}
+	if n := testutil.ToFloat64(panicsDef.CounterVec().WithLabelValues(string(stats.KindIpvsMaster), "test.periodic")); n != 2 {
+		t.Fatalf("expected 2 panics counted, got %v", n)
+	}
+
+	// a loop isn't restarted once its worker stops
+	var stopped int32
+	cancel()
+	Go(ctx, stats.KindIpvsMaster, "test.watches", logging.New(), func() {
+		atomic.AddInt32(&stopped, 1)
+		panic("stopped")
+	})
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&stopped); n != 1 {
+		t.Fatalf("expected a single run once the worker stopped, got %d", n)
+	}
+}
@@ -0,0 +1,273 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/privsep"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// Inspecting reads the virtual services programmed in ipvs back with what
+// ravel makes of them, so that an operator can tell without ipvsadm which of
+// them this instance reconciles, which service of the cluster config each is
+// for, where the weights programmed differ from those the config wants, and
+// the traffic through each.
+
+// VirtualService is a virtual service programmed in ipvs.
+type VirtualService struct {
+	Protocol string `json:"protocol"`
+	VIP      string `json:"vip"`
+	Port     string `json:"port"`
+	// Options are the scheduler and flags of the service, e.g. -s mh -b flag-1
+	Options string `json:"options"`
+	// Owned is set when this instance reconciles the service, which on a
+	// node that isn't shared is every service
+	Owned bool `json:"owned"`
+	// Wanted is set when the cluster config has the service. An owned
+	// service that isn't wanted is removed by the next reconfigure.
+	Wanted       bool          `json:"wanted"`
+	Namespace    string        `json:"namespace,omitempty"`
+	Service      string        `json:"service,omitempty"`
+	PortName     string        `json:"portName,omitempty"`
+	Rate         Rate          `json:"rate"`
+	Destinations []Destination `json:"destinations"`
+}
+
+// Destination is a real server of a virtual service.
+type Destination struct {
+	Address string `json:"address"`
+	// Forwarding is route, tunnel or masq, as ipvsadm -L shows it
+	Forwarding string `json:"forwarding"`
+	Weight     int    `json:"weight"`
+	// Want is the weight the cluster config wants, and nil when it doesn't
+	// want the destination
+	Want *int `json:"want,omitempty"`
+	Rate Rate `json:"rate"`
+}
+
+// Rate is the traffic through a virtual service or real server per second,
+// as ipvs estimates it.
+type Rate struct {
+	CPS    int64 `json:"cps"`
+	InPPS  int64 `json:"inPPS"`
+	OutPPS int64 `json:"outPPS"`
+	InBPS  int64 `json:"inBPS"`
+	OutBPS int64 `json:"outBPS"`
+}
+
+// Inspect returns the virtual services programmed in ipvs, v4 then v6, as
+// ipvsadm -Sn orders them. A director programs no v6 services.
+func (i *IPVS) Inspect(w *watcher.Watcher, config *types.ClusterConfig) ([]VirtualService, error) {
+	if config == nil || w.Nodes == nil {
+		return nil, fmt.Errorf("ipvs: no config and nodes seen yet")
+	}
+	families := []string{addrKindIPV4, "ipv6"}
+	if i.ravelMode == stats.KindIpvsMaster {
+		families = families[:1]
+	}
+
+	rates, err := i.rates()
+	if err != nil {
+		return nil, err
+	}
+
+	out := []VirtualService{}
+	for _, ipType := range families {
+		get, generate, portMaps := i.Get, i.generateRules, config.Config
+		if ipType != addrKindIPV4 {
+			get, generate, portMaps = i.GetV6, i.generateRulesV6, config.Config6
+		}
+		configured, err := get()
+		if err != nil {
+			return nil, err
+		}
+		generated, err := generate(w, w.Nodes, config)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, i.inspect(configured, generated, portMaps, rates)...)
+	}
+	return out, nil
+}
+
+// inspect annotates the configured rules with the generated ones.
+func (i *IPVS) inspect(configured, generated []string, portMaps map[types.ServiceIP]types.PortMap, rates map[string]Rate) []VirtualService {
+	owned := servicesOf(i.ownedRules(configured, generated))
+	wanted := servicesOf(generated)
+	weights := map[ipvsService]map[string]int{}
+	for _, rule := range generated {
+		svc, ok := ipvsServiceOf(rule)
+		if !ok || !strings.HasPrefix(rule, "-a ") {
+			continue
+		}
+		dst := parseDestination(rule)
+		if weights[svc] == nil {
+			weights[svc] = map[string]int{}
+		}
+		weights[svc][dst.Address] = dst.Weight
+	}
+
+	out := []VirtualService{}
+	index := map[ipvsService]int{}
+	for _, rule := range configured {
+		svc, ok := ipvsServiceOf(rule)
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(rule, "-A ") {
+			vs := VirtualService{
+				Protocol:     svc.protocol,
+				VIP:          svc.vip,
+				Port:         svc.port,
+				Options:      strings.Join(strings.Fields(rule)[3:], " "),
+				Owned:        owned[svc],
+				Wanted:       wanted[svc],
+				Rate:         rates[svc.String()],
+				Destinations: []Destination{},
+			}
+			if def, ok := portMaps[types.ServiceIP(svc.vip)][svc.port]; ok && def != nil {
+				vs.Namespace, vs.Service, vs.PortName = def.Namespace, def.Service, def.PortName
+			}
+			index[svc] = len(out)
+			out = append(out, vs)
+			continue
+		}
+		ix, ok := index[svc]
+		if !ok {
+			continue
+		}
+		dst := parseDestination(rule)
+		if weight, ok := weights[svc][dst.Address]; ok {
+			dst.Want = &weight
+		}
+		dst.Rate = rates[svc.String()+" -> "+dst.Address]
+		out[ix].Destinations = append(out[ix].Destinations, dst)
+	}
+	return out
+}
+
+// parseDestination reads the real server of a rule such as
+// "-a -t 10.0.0.1:80 -r 10.0.1.1:80 -g -w 1".
+func parseDestination(rule string) Destination {
+	dst := Destination{}
+	fields := strings.Fields(rule)
+	for ix, field := range fields {
+		switch field {
+		case "-r":
+			if ix+1 < len(fields) {
+				dst.Address = fields[ix+1]
+			}
+		case "-w":
+			if ix+1 < len(fields) {
+				dst.Weight, _ = strconv.Atoi(fields[ix+1])
+			}
+		case "-g":
+			dst.Forwarding = "route"
+		case "-i":
+			dst.Forwarding = "tunnel"
+		case "-m":
+			dst.Forwarding = "masq"
+		}
+	}
+	return dst
+}
+
+// rates returns the rates of the virtual services and real servers, keyed as
+// "tcp 10.0.0.1:80" and "tcp 10.0.0.1:80 -> 10.0.1.1:80".
+func (i *IPVS) rates() (map[string]Rate, error) {
+	cmdCtx, cmdContextCancel := context.WithTimeout(i.ctx, time.Second*20)
+	defer cmdContextCancel()
+
+	out, err := privsep.CommandContext(cmdCtx, "ipvsadm", "-Ln", "--rate", "--exact").Output()
+	if err != nil {
+		return nil, fmt.Errorf("ipvs: ipvsadm -Ln --rate failed with %v", err)
+	}
+	return parseRates(out), nil
+}
+
+// parseRates reads the output of ipvsadm -Ln --rate --exact:
+//
+//	Prot LocalAddress:Port                 CPS    InPPS   OutPPS    InBPS   OutBPS
+//	  -> RemoteAddress:Port
+//	TCP  10.0.0.1:80                         5       40        0     3000        0
+//	  -> 10.0.1.1:80                         2       20        0     1500        0
+func parseRates(out []byte) map[string]Rate {
+	rates := map[string]Rate{}
+	service := ""
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 7 {
+			continue
+		}
+		n := make([]int64, 5)
+		valid := true
+		for ix := range n {
+			var err error
+			if n[ix], err = strconv.ParseInt(fields[ix+2], 10, 64); err != nil {
+				valid = false
+			}
+		}
+		if !valid {
+			continue
+		}
+		rate := Rate{CPS: n[0], InPPS: n[1], OutPPS: n[2], InBPS: n[3], OutBPS: n[4]}
+		switch fields[0] {
+		case "TCP", "UDP":
+			service = strings.ToLower(fields[0]) + " " + fields[1]
+			rates[service] = rate
+		case "->":
+			if service != "" {
+				rates[service+" -> "+fields[1]] = rate
+			}
+		default:
+			// firewall marks and the like aren't programmed by ravel
+			service = ""
+		}
+	}
+	return rates
+}
+
+// FlushVIP deletes the virtual services of vip that the helper reconciles,
+// with their real servers, and returns them. The next reconfigure programs
+// those the config wants again from scratch.
+func (i *IPVS) FlushVIP(vip string) ([]string, error) {
+	ip := net.ParseIP(vip)
+	if ip == nil {
+		return nil, fmt.Errorf("ipvs: %q is not an ip address", vip)
+	}
+	get := i.Get
+	if ip.To4() == nil {
+		get = i.GetV6
+	}
+	configured, err := get()
+	if err != nil {
+		return nil, err
+	}
+
+	rules, services := []string{}, []string{}
+	for _, rule := range i.ownedRules(configured, nil) {
+		svc, ok := ipvsServiceOf(rule)
+		if !ok || !strings.HasPrefix(rule, "-A ") || !ip.Equal(net.ParseIP(svc.vip)) {
+			continue
+		}
+		rules = append(rules, "-D "+svc.target())
+		services = append(services, svc.String())
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("ipvs: no services of %s to flush", vip)
+	}
+	if out, err := i.Set(rules); err != nil {
+		return nil, fmt.Errorf("ipvs: unable to flush the services of %s: %s/%v", vip, strings.TrimSpace(string(out)), err)
+	}
+	return services, nil
+}
@@ -0,0 +1,73 @@
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+func TestInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configured := []string{
+		"-A -t 10.0.0.1:80 -s mh -b flag-1,flag-2",
+		"-a -t 10.0.0.1:80 -r 10.0.1.1:80 -g -w 1",
+		"-a -t 10.0.0.1:80 -r 10.0.1.2:80 -g -w 0",
+		"-a -t 10.0.0.1:80 -r 10.0.1.3:80 -g -w 1",
+		"-A -t 10.0.0.2:80 -s wlc",
+		"-A -u 10.0.0.3:53 -s wlc",
+	}
+	generated := []string{
+		"-A -t 10.0.0.1:80 -s mh -b flag-1,flag-2",
+		"-a -t 10.0.0.1:80 -r 10.0.1.1:80 -g -w 1 -x 0 -y 0",
+		"-a -t 10.0.0.1:80 -r 10.0.1.2:80 -g -w 1 -x 0 -y 0",
+	}
+	portMaps := map[types.ServiceIP]types.PortMap{
+		"10.0.0.1": {"80": &types.ServiceDef{Namespace: "web", Service: "frontend", PortName: "http"}},
+	}
+	ioutil.WriteFile(filepath.Join(dir, "ipvs-green"), []byte("-t 10.0.0.2:80\n"), 0644)
+	i := &IPVS{logger: logging.New()}
+	if err := i.Own(Ownership{ConfigKey: "green", Shared: true, StateDir: dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	rates := parseRates([]byte(`IP Virtual Server version 1.2.1 (size=4096)
+Prot LocalAddress:Port                 CPS    InPPS   OutPPS    InBPS   OutBPS
+  -> RemoteAddress:Port
+TCP  10.0.0.1:80                         5       40        0     3000        0
+  -> 10.0.1.1:80                         2       20        0     1500        0
+  -> 10.0.1.2:80                         0        0        0        0        0
+  -> 10.0.1.3:80                         3       20        0     1500        0
+`))
+	services := i.inspect(configured, generated, portMaps, rates)
+	if len(services) != 3 {
+		t.Fatalf("expected 3 services, got %+v", services)
+	}
+	svc := services[0]
+	if !svc.Owned || !svc.Wanted || svc.Service != "frontend" || svc.Options != "-s mh -b flag-1,flag-2" || len(svc.Destinations) != 3 {
+		t.Fatalf("expected the service of web/frontend with 3 real servers, got %+v", svc)
+	}
+	if svc.Rate.CPS != 5 || svc.Destinations[2].Rate.InBPS != 1500 {
+		t.Fatalf("expected the rates of the service and its real servers, got %+v", svc)
+	}
+	for ix, want := range []int{1, 1, -1} {
+		dst := svc.Destinations[ix]
+		if dst.Forwarding != "route" || want < 0 && dst.Want != nil || want >= 0 && (dst.Want == nil || *dst.Want != want) {
+			t.Fatalf("expected %s to want weight %d, got %+v", dst.Address, want, dst)
+		}
+	}
+	if svc := services[1]; !svc.Owned || svc.Wanted {
+		t.Fatalf("expected 10.0.0.2:80 owned and no longer wanted, got %+v", svc)
+	}
+	if svc := services[2]; svc.Owned || svc.Protocol != "udp" {
+		t.Fatalf("expected udp 10.0.0.3:53 left to another instance, got %+v", svc)
+	}
+}
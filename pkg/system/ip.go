@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"os"
 	"os/exec"
 	"sort"
 	"strconv"
@@ -12,8 +11,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Comcast/Ravel/pkg/audit"
+	log "github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/observe"
+	"github.com/Comcast/Ravel/pkg/privsep"
 	"github.com/Comcast/Ravel/pkg/types"
-	log "github.com/sirupsen/logrus"
 )
 
 // IP defines a wrapper on the ip command, which can be used to interface with the ip binary
@@ -26,14 +28,17 @@ type IP struct {
 	ignore   int
 
 	ctx    context.Context
-	logger log.FieldLogger
+	logger log.Logger
 
 	// interfaceGetMu locks operations that fetch interfaces so more than one don't run at once
 	interfaceGetMu sync.Mutex
+
+	// ownership tags the devices, and on a shared node scopes them to owned
+	ownership Ownership
 }
 
 // NewIP creates a new ipManager struct for manging ip binary operations
-func NewIP(ctx context.Context, device string, gateway string, announce, ignore int, logger log.FieldLogger) (*IP, error) {
+func NewIP(ctx context.Context, device string, gateway string, announce, ignore int, logger log.Logger) (*IP, error) {
 	return &IP{
 		device:         device,
 		gateway:        gateway,
@@ -48,7 +53,7 @@ func NewIP(ctx context.Context, device string, gateway string, announce, ignore
 
 func (i *IP) Get() ([]string, []string, error) {
 	// log.Infoln("ipManager fetching dummy interfaces...")
-	return i.get()
+	return i.get(i.ctx)
 }
 
 func (i *IP) Device(addr string, isV6 bool) string {
@@ -60,6 +65,11 @@ func (i *IP) Add6(addr string) error { return i.add(i.ctx, addr, true) }
 func (i *IP) Del(device string) error { return i.del(i.ctx, device) }
 
 func (i *IP) SetMTU(config map[types.ServiceIP]string, isIP6 bool) error {
+	// the mtu is set on every reconfigure, whether or not it changed, so an
+	// observer leaves it out
+	if observe.Enabled() {
+		return nil
+	}
 	for ip, mtu := range config {
 		// guard against dated provisioner versions (bulkhead deploy), erroneous configurations
 		// otherwise, don't skip standard (1500), could be setting back from a different MTU
@@ -85,7 +95,7 @@ func (i *IP) SetMTU(config map[types.ServiceIP]string, isIP6 bool) error {
 		args := []string{dev, "mtu", mtu}
 		cmdCtx, cmdContextCancel := context.WithTimeout(i.ctx, time.Second*20)
 		defer cmdContextCancel()
-		cmd := exec.CommandContext(cmdCtx, "ifconfig", args...)
+		cmd := privsep.CommandContext(cmdCtx, "ifconfig", args...)
 		out, err := cmd.CombinedOutput()
 		if err != nil {
 			return fmt.Errorf("error setting mtu on device %s: %v. Saw output: %v", dev, err, string(out))
@@ -102,13 +112,17 @@ func (i *IP) SetMTU(config map[types.ServiceIP]string, isIP6 bool) error {
 // tricks the gateway into putting $interface's MAC address in its own ARP table
 // with the VIP as the associated IP address.
 func (i *IP) AdvertiseMacAddress(addr string) error {
+	// an observer must not draw traffic to the VIPs
+	if observe.Enabled() {
+		return nil
+	}
 	// `arping -c 1 -s $VIP_IP $gateway_ip -I $interface`
 	// use primary no matter what device we are using
 	cmdLine := "/usr/sbin/arping"
 	args := []string{"-c", "1", "-s", addr, i.gateway, "-I", i.device}
 	cmdCtx, cmdContextCancel := context.WithTimeout(i.ctx, time.Second*20)
 	defer cmdContextCancel()
-	cmd := exec.CommandContext(cmdCtx, cmdLine, args...)
+	cmd := privsep.CommandContext(cmdCtx, cmdLine, args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("ipManager: unable to advertise arp. Saw error %s with output %s. addr=%s gateway=%s device=%s command: %s", err, string(out), addr, i.gateway, i.device, cmd.String())
@@ -118,29 +132,19 @@ func (i *IP) AdvertiseMacAddress(addr string) error {
 }
 
 func (i *IP) SetRPFilter() error {
+	if observe.Enabled() {
+		observe.Would(audit.SubsystemInterface, "rp_filter", "all tunl0", "0")
+		return nil
+	}
 	log.Debugln("ipManager: setting RPFilter")
 	tunl0File := "/netconf/tunl0/rp_filter"
 	allFile := "/netconf/all/rp_filter"
 	log.Debugln("ipManager: seting rp_filter for 'all' and 'tunl0'")
 
-	fAll, err := os.OpenFile(allFile, os.O_RDWR, 0666)
-	if err != nil {
+	if err := privsep.WriteSetting(allFile, "0"); err != nil {
 		return err
 	}
-	defer fAll.Close()
-
-	fTunl, err := os.OpenFile(tunl0File, os.O_RDWR, 0666)
-	if err != nil {
-		return err
-	}
-	defer fAll.Close()
-
-	_, err = fAll.Write([]byte("0"))
-	if err != nil {
-		return err
-	}
-	_, err = fTunl.Write([]byte("0"))
-	if err != nil {
+	if err := privsep.WriteSetting(tunl0File, "0"); err != nil {
 		return err
 	}
 
@@ -149,30 +153,19 @@ func (i *IP) SetRPFilter() error {
 }
 
 func (i *IP) SetARP() error {
+	if observe.Enabled() {
+		observe.Would(audit.SubsystemInterface, "arp", i.device, fmt.Sprintf("announce %d ignore %d", i.announce, i.ignore))
+		return nil
+	}
 	announceFile := fmt.Sprintf("/netconf/%s/arp_announce", i.device)
 	ignoreFile := fmt.Sprintf("/netconf/%s/arp_ignore", i.device)
 	log.Debugf("ipManager: seting arp_announce for %s to %d\n", i.device, i.announce)
 	log.Debugf("ipManager: seting arp_ignore for %s to %d\n", i.device, i.ignore)
 
-	fAnnounce, err := os.OpenFile(announceFile, os.O_RDWR, 0666)
-	if err != nil {
-		return err
-	}
-	defer fAnnounce.Close()
-
-	fIgnore, err := os.OpenFile(ignoreFile, os.O_RDWR, 0666)
-	if err != nil {
+	if err := privsep.WriteSetting(announceFile, strconv.Itoa(i.announce)); err != nil {
 		return err
 	}
-	defer fIgnore.Close()
-
-	_, err = fAnnounce.Write([]byte(strconv.Itoa(i.announce)))
-	if err != nil {
-		return err
-	}
-
-	_, err = fIgnore.Write([]byte(strconv.Itoa(i.ignore)))
-	if err != nil {
+	if err := privsep.WriteSetting(ignoreFile, strconv.Itoa(i.ignore)); err != nil {
 		return err
 	}
 
@@ -245,8 +238,29 @@ func (i *IP) Teardown(ctx context.Context, config4 map[types.ServiceIP]types.Por
 	return nil
 }
 
-func (i *IP) get() ([]string, []string, error) {
-	iFaces, err := i.retrieveDummyIFaces()
+// Release removes every VIP device, for a director that withdraws its VIPs
+// as it exits. It runs under ctx rather than the helper's, which is done by
+// then.
+func (i *IP) Release(ctx context.Context) error {
+	v4, v6, err := i.get(ctx)
+	if err != nil {
+		return err
+	}
+	errs := []string{}
+	for _, device := range append(v4, v6...) {
+		if err := i.del(ctx, device); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("ipManager: %s", strings.Join(errs, "; "))
+	}
+	i.logger.Infof("ipManager: released %d VIP devices", len(v4)+len(v6))
+	return nil
+}
+
+func (i *IP) get(ctx context.Context) ([]string, []string, error) {
+	iFaces, err := i.retrieveDummyIFaces(ctx)
 	if err != nil {
 		// return nil, nil, fmt.Errorf("ipManager: error running shell command ip -details link show | grep -B 2 dummy: %+v", err)
 		return nil, nil, fmt.Errorf("ipManager: error running shell command ip link show | grep -B 2 dummy: %+v", err)
@@ -255,7 +269,7 @@ func (i *IP) get() ([]string, []string, error) {
 
 	// split them into v4 or v6 addresses
 	ipv4, ipv6 := i.parseAddressData(iFaces)
-	return ipv4, ipv6, nil
+	return i.owned(ipv4), i.owned(ipv6), nil
 }
 
 // generate the target name of a device. This will be used in both adds and removals
@@ -273,9 +287,28 @@ func (i *IP) generateDeviceLabel(addr string, isIP6 bool) string {
 	return strings.Replace(addr, ".", "_", -1)
 }
 
-func (i *IP) add(ctx context.Context, addr string, isIP6 bool) error {
+// DeviceAddress returns the v4 VIP of a device named as generateDeviceLabel
+// names it, or "" for a v6 device, whose name holds only part of its address.
+func DeviceAddress(device string) string {
+	if !strings.Contains(device, "_") {
+		return ""
+	}
+	return strings.Replace(device, "_", ".", -1)
+}
+
+func (i *IP) add(ctx context.Context, addr string, isIP6 bool) (err error) {
 	// log.Debugln("ipManager: adding dummy interface for addr", addr)
 	device := i.generateDeviceLabel(addr, isIP6)
+	if observe.Enabled() {
+		observe.Would(audit.SubsystemInterface, "add", device, addr)
+		return nil
+	}
+	exists := false
+	defer func() {
+		if !exists {
+			audit.Record(audit.SubsystemInterface, "add", device, addr, err)
+		}
+	}()
 	// create the device
 	args := []string{"link", "add", device, "type", "dummy"}
 	log.Debugln("ipManager: adding ip using command: ip", args)
@@ -283,19 +316,23 @@ func (i *IP) add(ctx context.Context, addr string, isIP6 bool) error {
 	cmdCtx, cmdContextCancel := context.WithTimeout(ctx, time.Second*20)
 	defer cmdContextCancel()
 
-	cmd := exec.CommandContext(cmdCtx, "ip", args...)
+	cmd := privsep.CommandContext(cmdCtx, "ip", args...)
 	out, err := cmd.CombinedOutput()
 	// if it exists, we know we have already added the iface for it, and
 	// the relevant address. Exit success from this method
 	if err != nil && strings.Contains(string(out), "File exists") {
 		// log.Debugln("ipManager: attempted to add interface, but it already exists")
-		return nil
+		exists = true
+		return i.label(ctx, device, addr, false)
 	}
 
 	// if the error _does not_ indicate the file exists, we have a real error
 	if err != nil {
 		return fmt.Errorf("ipManager: failed to create device %s for addr %s: %v. Saw output: %s", device, addr, err, string(out))
 	}
+	if err := i.label(ctx, device, addr, true); err != nil {
+		return err
+	}
 
 	// add the command to the specific interface we are using
 	// if adding a v6 addr, this must be appended to the add command
@@ -314,7 +351,7 @@ func (i *IP) add(ctx context.Context, addr string, isIP6 bool) error {
 
 	cmdCtx, cmdContextCancel = context.WithTimeout(ctx, time.Second*20)
 	defer cmdContextCancel()
-	cmd = exec.CommandContext(cmdCtx, "ip", args...)
+	cmd = privsep.CommandContext(cmdCtx, "ip", args...)
 	out, err = cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("ipManager: unable to add ip on second try address='%s' on device='%s' with args='%v'. %v. Saw output: %s", addr, device, args, err, string(out))
@@ -329,6 +366,10 @@ func (i *IP) del(ctx context.Context, device string) error {
 		// log.Warningln("Saw a del call for a device that was blank so it was ignored.")
 		return nil
 	}
+	if observe.Enabled() {
+		observe.Would(audit.SubsystemInterface, "del", device, "")
+		return nil
+	}
 	// log.Debugln("ipManager: deleting device with length", len(device), "named:", device)
 	// create the device
 	args := []string{"link", "del", device, "type", "dummy"}
@@ -337,15 +378,18 @@ func (i *IP) del(ctx context.Context, device string) error {
 	cmdCtx, cmdContextCancel := context.WithTimeout(ctx, time.Second*20)
 	defer cmdContextCancel()
 
-	cmd := exec.CommandContext(cmdCtx, "ip", args...)
+	cmd := privsep.CommandContext(cmdCtx, "ip", args...)
 	out, err := cmd.CombinedOutput()
 	// if it doesnt exist, this may be indicative of a bug in the add / remove code
 	// but if it's already gone, no problem
-	if err != nil && !strings.Contains(string(out), "Cannot find device") {
-		return fmt.Errorf("ipManager: failed to delete device %s: %v", device, err)
+	if err != nil && strings.Contains(string(out), "Cannot find device") {
+		return nil
 	}
-
-	return nil
+	if err != nil {
+		err = fmt.Errorf("ipManager: failed to delete device %s: %v", device, err)
+	}
+	audit.Record(audit.SubsystemInterface, "del", device, "", err)
+	return err
 }
 
 // parseAddressData from the set off dummy interfaces, find out which is v4, v6
@@ -404,7 +448,7 @@ func runPipeCommands(ctx context.Context, commandA []string, commandB []string)
 	// create two processes to run
 	commandAArgs := commandA[1:]
 	commandBArgs := commandB[1:]
-	c1 := exec.CommandContext(ctx, commandA[0], commandAArgs...)
+	c1 := privsep.CommandContext(ctx, commandA[0], commandAArgs...)
 	c2 := exec.CommandContext(ctx, commandB[0], commandBArgs...)
 
 	// pipe the first process to the second process
@@ -440,7 +484,7 @@ func runPipeCommands(ctx context.Context, commandA []string, commandB []string)
 }
 
 // retrieveDummyIFaces tries to greb for interfaces with 'dummy' in the output from 'ip -details link show'.
-func (i *IP) retrieveDummyIFaces() ([]string, error) {
+func (i *IP) retrieveDummyIFaces(ctx context.Context) ([]string, error) {
 
 	startTime := time.Now()
 	defer func() {
@@ -459,7 +503,7 @@ func (i *IP) retrieveDummyIFaces() ([]string, error) {
 	}()
 
 	// create a context timeout for our processes
-	ctx, ctxCancel := context.WithTimeout(i.ctx, time.Minute)
+	ctx, ctxCancel := context.WithTimeout(ctx, time.Minute)
 	defer ctxCancel()
 
 	commandA := []string{i.IPCommandPath, "-details", "link", "show"}
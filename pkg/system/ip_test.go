@@ -6,7 +6,7 @@ import (
 	"reflect"
 	"testing"
 
-	"github.com/sirupsen/logrus"
+	"github.com/Comcast/Ravel/pkg/logging"
 )
 
 func TestDiffAddressSets(t *testing.T) {
@@ -28,7 +28,7 @@ func TestGetDummyInterfaces(t *testing.T) {
 		t.Skip("This test only works with a faked 'ip' command script")
 	}
 	// make a new ip manager
-	ipManager, err := NewIP(context.Background(), "enp6s0", "172.26.223.1", 55, 0, logrus.New())
+	ipManager, err := NewIP(context.Background(), "enp6s0", "172.26.223.1", 55, 0, logging.New())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -36,7 +36,7 @@ func TestGetDummyInterfaces(t *testing.T) {
 	// use the faked binary bash script in this directory
 	ipManager.IPCommandPath = "./ip"
 
-	ifaces, err := ipManager.retrieveDummyIFaces()
+	ifaces, err := ipManager.retrieveDummyIFaces(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -76,7 +76,7 @@ func TestParseAddressData(t *testing.T) {
     `
 
 	// make a new ip manager
-	ipManager, err := NewIP(context.Background(), "enp6s0", "172.26.223.1", 55, 0, logrus.New())
+	ipManager, err := NewIP(context.Background(), "enp6s0", "172.26.223.1", 55, 0, logging.New())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -5,18 +5,22 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	log "github.com/Comcast/Ravel/pkg/logging"
 	"github.com/Comcast/Ravel/pkg/stats"
 	"io"
+	"net"
 	"os"
-	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 
+	"github.com/Comcast/Ravel/pkg/audit"
+	"github.com/Comcast/Ravel/pkg/observe"
+	"github.com/Comcast/Ravel/pkg/privsep"
 	"github.com/Comcast/Ravel/pkg/types"
 	"github.com/Comcast/Ravel/pkg/watcher"
 )
@@ -37,16 +41,26 @@ type IPVS struct {
 	weightOverride bool
 	defaultWeight  int
 	ctx            context.Context
-	logger         log.FieldLogger
+	logger         log.Logger
 	waitMs         int
 	earlylate      string
 	logrule        bool
 	skipMasterNode bool
 	ravelMode      string
+
+	// metrics are the per-service reconfigure outcomes, and backends the
+	// state of each node behind each service
+	metrics  *stats.ServiceMetrics
+	backends *stats.BackendMetrics
+
+	// ownership scopes the services reconciled on a shared node to owned
+	ownership Ownership
+	ownedMu   sync.Mutex
+	owned     map[ipvsService]bool
 }
 
 // NewIPVS creates a new IPVS struct which manages ipvsadm
-func NewIPVS(ctx context.Context, primaryIP string, weightOverride bool, ignoreCordon bool, logger log.FieldLogger, ravelMode string) (*IPVS, error) {
+func NewIPVS(ctx context.Context, primaryIP string, weightOverride bool, ignoreCordon bool, logger log.Logger, ravelMode string) (*IPVS, error) {
 	log.Debugln("ipvs: Creating new IPVS manager")
 
 	waitMs := IntGetenv("RAVEL_DELAY", 1000) // delay between batches
@@ -71,6 +85,9 @@ func NewIPVS(ctx context.Context, primaryIP string, weightOverride bool, ignoreC
 		defaultWeight:  1, // just so there's no magic numbers to hunt down
 		waitMs:         waitMs,
 		earlylate:      earlylate,
+		metrics:        stats.NewServiceMetrics(ravelMode),
+		backends:       stats.NewBackendMetrics(ravelMode),
+		owned:          map[ipvsService]bool{},
 	}, nil
 }
 
@@ -92,7 +109,7 @@ func (i *IPVS) Get() ([]string, error) {
 	cmdCtx, cmdContextCancel := context.WithTimeout(i.ctx, time.Second*20)
 	defer cmdContextCancel()
 
-	cmd := exec.CommandContext(cmdCtx, "ipvsadm", "-Sn")
+	cmd := privsep.CommandContext(cmdCtx, "ipvsadm", "-Sn")
 	stdout, err := cmd.Output()
 	if err != nil {
 		return nil, fmt.Errorf("ipvs: ipvsadm -Sn failed with %v", err)
@@ -140,7 +157,7 @@ func (i *IPVS) GetV6() ([]string, error) {
 	defer cmdContextCancel()
 
 	// run the ipvsadm command
-	cmd := exec.CommandContext(cmdCtx, "ipvsadm", "-Sn")
+	cmd := privsep.CommandContext(cmdCtx, "ipvsadm", "-Sn")
 	stdout, err := cmd.Output()
 	if err != nil {
 		return nil, fmt.Errorf("ipvs: ipvsadm -Sn failed with %v", err)
@@ -172,6 +189,15 @@ func (i *IPVS) Set(rules []string) ([]byte, error) {
 
 	log.Debugf("ipvs: setting %d ipvs rules", len(rules))
 
+	// the rules are the changes from the configured ones
+	if observe.Enabled() {
+		for _, rule := range rules {
+			action, target := ipvsAuditAction(rule)
+			observe.Would(audit.SubsystemIPVS, action, target, "")
+		}
+		return nil, nil
+	}
+
 	// output rules for debugging
 	// for _, r := range rules {
 	// 	log.Debugln("ipvs: setting rule: ipvsadm", r)
@@ -181,7 +207,7 @@ func (i *IPVS) Set(rules []string) ([]byte, error) {
 	defer cmdContextCancel()
 
 	// run the ipvsadm command
-	cmd := exec.CommandContext(cmdCtx, "ipvsadm", "-R")
+	cmd := privsep.CommandContext(cmdCtx, "ipvsadm", "-R")
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return nil, fmt.Errorf("ipvs: ipvsadm -R failed with %v", err)
@@ -201,17 +227,77 @@ func (i *IPVS) Set(rules []string) ([]byte, error) {
 	io.WriteString(stdin, input)
 	stdin.Close()
 	// log.Debugln("ipvs: done inputting ipvsadm rules")
-	return b.Bytes(), cmd.Wait()
+	err = cmd.Wait()
+
+	// ipvsadm -R stops at the first rule it fails on, without saying which,
+	// so the error is attached to every rule in the batch.
+	for _, rule := range rules {
+		action, target := ipvsAuditAction(rule)
+		audit.Record(audit.SubsystemIPVS, action, target, "", err)
+	}
+	return b.Bytes(), err
+}
+
+// ipvsAuditAction splits an ipvsadm rule into the action it takes and the
+// rest of the rule, e.g. "-a -t 10.0.0.1:80 -r 10.0.1.1:80 -g -w 1" is an
+// add of "-t 10.0.0.1:80 -r 10.0.1.1:80 -g -w 1".
+func ipvsAuditAction(rule string) (string, string) {
+	fields := strings.Fields(rule)
+	if len(fields) == 0 {
+		return "", ""
+	}
+	target := strings.Join(fields[1:], " ")
+	switch fields[0] {
+	case "-A", "-a":
+		return "add", target
+	case "-E", "-e":
+		return "update", target
+	case "-D", "-d":
+		return "del", target
+	case "-C":
+		return "clear", target
+	}
+	return fields[0], target
 }
 
 func (i *IPVS) Teardown(ctx context.Context) error {
+	if i.ownership.Shared {
+		log.Debugln("ipvs: Teardown: deleting the services of", i.ownership.owner())
+		return i.teardownOwned(ctx)
+	}
 	log.Debugln("ipvs: Teardown: Running ipvsadm -C")
+	if observe.Enabled() {
+		observe.Would(audit.SubsystemIPVS, "clear", "", "teardown")
+		return nil
+	}
 
 	cmdCtx, cmdContextCancel := context.WithTimeout(ctx, time.Second*20)
 	defer cmdContextCancel()
 
-	cmd := exec.CommandContext(cmdCtx, "ipvsadm", "-C")
-	return cmd.Run()
+	cmd := privsep.CommandContext(cmdCtx, "ipvsadm", "-C")
+	err := cmd.Run()
+	audit.Record(audit.SubsystemIPVS, "clear", "", "teardown", err)
+	return err
+}
+
+// serviceOptions returns the flags and persistence of a virtual service as
+// ipvsadm -Sn prints them, for the rules generated to match those applied.
+// ipvsadm leaves out the netmask of persistence when it is a single client.
+func serviceOptions(o types.IPVSOptions, v6 bool) string {
+	out := ""
+	if flags := o.SchedulerFlags(); flags != "" {
+		out += " -b " + flags
+	}
+	if o.Persistence <= 0 {
+		return out
+	}
+	out += fmt.Sprintf(" -p %d", o.Persistence)
+	switch mask := o.PersistenceNetmask; {
+	case mask == "", !v6 && mask == "255.255.255.255", v6 && mask == "128":
+	default:
+		out += " -M " + mask
+	}
+	return out
 }
 
 func pickFirstInternalIP(node *v1.Node) (string, error) {
@@ -246,13 +332,6 @@ func (i *IPVS) generateRules(w *watcher.Watcher, nodes []*v1.Node, config *types
 			// log.Debugln("ipvs: The scheduler for service", serviceConfig.Service, serviceConfig.PortName, "is set to", serviceConfig.IPVSOptions.Scheduler())
 			// log.Debugln("ipvs: The raw scheduler for service", serviceConfig.Service, serviceConfig.PortName, "is set to", serviceConfig.IPVSOptions.RawScheduler)
 
-			// If we have the scheduler set to `mh`, and flags are blank, then set flag-1,flag-2.
-			// This prevents dropped packets when maglev is used.
-			if serviceConfig.IPVSOptions.Scheduler() == "mh" && serviceConfig.IPVSOptions.Flags == "" {
-				log.Infoln("ipvs: Assuming flag-1,flag-2 for mh scheduler without flags.  Name:", serviceConfig.Service)
-				serviceConfig.IPVSOptions.Flags = "flag-1,flag-2"
-			}
-
 			// log.Debugln("ipvs: generating ipvs rule for", port, serviceConfig)
 			// set rules for tcp / udp
 			if serviceConfig.TCPEnabled {
@@ -263,10 +342,8 @@ func (i *IPVS) generateRules(w *watcher.Watcher, nodes []*v1.Node, config *types
 					serviceConfig.IPVSOptions.Scheduler(),
 				)
 
-				// flags default empty; only append if we have arguments
-				if serviceConfig.IPVSOptions.Flags != "" {
-					rule = fmt.Sprintf("%s -b %s", rule, serviceConfig.IPVSOptions.Flags)
-				}
+				// flags and persistence default empty; only append if we have arguments
+				rule += serviceOptions(serviceConfig.IPVSOptions, false)
 
 				rules = append(rules, rule)
 			}
@@ -280,10 +357,8 @@ func (i *IPVS) generateRules(w *watcher.Watcher, nodes []*v1.Node, config *types
 					serviceConfig.IPVSOptions.Scheduler(),
 				)
 
-				// flags default empty; only append if we have arguments
-				if serviceConfig.IPVSOptions.Flags != "" {
-					rule = fmt.Sprintf("%s -b %s", rule, serviceConfig.IPVSOptions.Flags)
-				}
+				// flags and persistence default empty; only append if we have arguments
+				rule += serviceOptions(serviceConfig.IPVSOptions, false)
 
 				// log.Debugln("ipvs: Generated IPVS rule:", rule)
 				rules = append(rules, rule)
@@ -296,14 +371,19 @@ func (i *IPVS) generateRules(w *watcher.Watcher, nodes []*v1.Node, config *types
 	// outer scope, but if nodes are to be filtered on the basis of endpoints,
 	// this functionality may need to move to the inner loop.
 	eligibleNodes := []*v1.Node{}
+	ineligible := map[*v1.Node]string{}
 	for _, node := range nodes {
 		eligible, _ := types.IsEligibleBackendV4(node, config.NodeLabels, i.nodeIP, i.ignoreCordon, i.skipMasterNode)
 		if !eligible {
 			// log.Debugf("ipvs: node %s deemed ineligible. %v", node.Name, reason)
+			if state := i.ineligibleState(node); state != "" {
+				ineligible[node] = state
+			}
 			continue
 		}
 		eligibleNodes = append(eligibleNodes, node)
 	}
+	backends := []stats.BackendState{}
 
 	// Next, we iterate over vips, ports, _and_ nodes to create the backend definitions
 	for vip, ports := range config.Config {
@@ -314,6 +394,7 @@ func (i *IPVS) generateRules(w *watcher.Watcher, nodes []*v1.Node, config *types
 		for port, serviceConfig := range ports {
 			// log.Debugln("ipvs: generating ipvs rule for", port)
 			nodeSettings := getNodeWeightsAndLimits(eligibleNodes, w, serviceConfig, i.weightOverride, i.defaultWeight)
+			backends = append(backends, backendStates(string(vip), port, serviceConfig, eligibleNodes, ineligible, nodeSettings)...)
 			for _, n := range eligibleNodes {
 				nodeAddress, err := pickFirstInternalIP(n)
 				if err != nil {
@@ -356,6 +437,8 @@ func (i *IPVS) generateRules(w *watcher.Watcher, nodes []*v1.Node, config *types
 		}
 	}
 
+	i.backends.Set(stats.FamilyV4, backends)
+
 	sort.Sort(ipvsRules(rules))
 	return rules, nil
 }
@@ -379,13 +462,6 @@ func (i *IPVS) generateRulesV6(w *watcher.Watcher, nodes []*v1.Node, config *typ
 		// Add rules for Frontend ipvsadm as tcp / udp
 		for port, serviceConfig := range ports {
 
-			// If we have the scheduler set to `mh`, and flags are blank, then set flag-1,flag-2.
-			// This prevents dropped packets when maglev is used.
-			if serviceConfig.IPVSOptions.Scheduler() == "mh" && serviceConfig.IPVSOptions.Flags == "" {
-				serviceConfig.IPVSOptions.Flags = "flag-1,flag-2"
-				// log.Debugln("v6 ipvs: The scheduler for service", serviceConfig.Service, serviceConfig.PortName, "is set to", serviceConfig.IPVSOptions.Scheduler())
-				// log.Debugln("v6 ipvs: The raw scheduler for service", serviceConfig.Service, serviceConfig.PortName, "is set to", serviceConfig.IPVSOptions.RawScheduler)
-			}
 
 			// set rules for tcp / udp
 			if serviceConfig.TCPEnabled {
@@ -396,10 +472,8 @@ func (i *IPVS) generateRulesV6(w *watcher.Watcher, nodes []*v1.Node, config *typ
 					serviceConfig.IPVSOptions.Scheduler(),
 				)
 
-				// flags default empty; only append if we have arguments
-				if serviceConfig.IPVSOptions.Flags != "" {
-					rule = fmt.Sprintf("%s -b %s", rule, serviceConfig.IPVSOptions.Flags)
-				}
+				// flags and persistence default empty; only append if we have arguments
+				rule += serviceOptions(serviceConfig.IPVSOptions, true)
 
 				rules = append(rules, rule)
 			}
@@ -412,10 +486,8 @@ func (i *IPVS) generateRulesV6(w *watcher.Watcher, nodes []*v1.Node, config *typ
 					serviceConfig.IPVSOptions.Scheduler(),
 				)
 
-				// flags default empty; only append if we have arguments
-				if serviceConfig.IPVSOptions.Flags != "" {
-					rule = fmt.Sprintf("%s -b %s", rule, serviceConfig.IPVSOptions.Flags)
-				}
+				// flags and persistence default empty; only append if we have arguments
+				rule += serviceOptions(serviceConfig.IPVSOptions, true)
 
 				// log.Debugln("ipvs: Generated IPVS V6 rule:", rule, "for vip", vip)
 				rules = append(rules, rule)
@@ -427,14 +499,19 @@ func (i *IPVS) generateRulesV6(w *watcher.Watcher, nodes []*v1.Node, config *typ
 	// outer scope, but if nodes are to be filtered on the basis of endpoints,
 	// this functionality may need to move to the inner loop.
 	eligibleNodes := []*v1.Node{}
+	ineligible := map[*v1.Node]string{}
 	for _, node := range nodes {
 		eligible, _ := types.IsEligibleBackendV6(node, config.NodeLabels, i.nodeIP, i.ignoreCordon, i.skipMasterNode)
 		if !eligible {
 			// log.Debugf("ipvs: node %s deemed ineligible as ipv6 backend. %v", types.IPV6(node)+" ("+types.IPV4(node)+")", reason)
+			if state := i.ineligibleState(node); state != "" {
+				ineligible[node] = state
+			}
 			continue
 		}
 		eligibleNodes = append(eligibleNodes, node)
 	}
+	backends := []stats.BackendState{}
 
 	// Next, we iterate over vips, ports, _and_ nodes to create the backend definitions
 	for vip, ports := range config.Config6 {
@@ -442,6 +519,7 @@ func (i *IPVS) generateRulesV6(w *watcher.Watcher, nodes []*v1.Node, config *typ
 		// service writing ipvsadm rules for each element of the full set
 		for port, serviceConfig := range ports {
 			nodeSettings := getNodeWeightsAndLimits(eligibleNodes, w, serviceConfig, i.weightOverride, i.defaultWeight)
+			backends = append(backends, backendStates(string(vip), port, serviceConfig, eligibleNodes, ineligible, nodeSettings)...)
 			for _, n := range eligibleNodes {
 				nodeAddress, err := pickFirstInternalIP(n)
 				if err != nil {
@@ -478,10 +556,74 @@ func (i *IPVS) generateRulesV6(w *watcher.Watcher, nodes []*v1.Node, config *typ
 			}
 		}
 	}
+	i.backends.Set(stats.FamilyV6, backends)
+
 	sort.Sort(ipvsRules(rules))
 	return rules, nil
 }
 
+// ineligibleState returns the scoreboard state of a node that isn't a
+// backend, or "" for nodes that are never backends, such as those without
+// the node labels the config requires.
+func (i *IPVS) ineligibleState(n *v1.Node) string {
+	if len(n.Status.Addresses) == 0 {
+		return ""
+	}
+	if types.IsUnschedulable(n) && !i.ignoreCordon {
+		return stats.BackendCordoned
+	}
+	if _, unhealthy := types.RealServerUnhealthy(n); unhealthy || !types.IsInReadyState(n) {
+		return stats.BackendUnhealthy
+	}
+	return ""
+}
+
+// backendStates lists the scoreboard of a service: the weight of each
+// eligible node, and the state of each node left out.
+func backendStates(vip, port string, serviceConfig *types.ServiceDef, eligible []*v1.Node, ineligible map[*v1.Node]string, nodeSettings map[string]nodeConfig) []stats.BackendState {
+	protocols := []string{}
+	if serviceConfig.TCPEnabled {
+		protocols = append(protocols, "TCP")
+	}
+	if serviceConfig.UDPEnabled {
+		protocols = append(protocols, "UDP")
+	}
+
+	out := []stats.BackendState{}
+	add := func(n *v1.Node, state string, weight int) {
+		for _, protocol := range protocols {
+			out = append(out, stats.BackendState{
+				VIP:       vip,
+				Port:      port,
+				Protocol:  protocol,
+				Namespace: serviceConfig.Namespace,
+				Service:   serviceConfig.Service,
+				PortName:  serviceConfig.PortName,
+				Node:      n.Name,
+				State:     state,
+				Weight:    weight,
+			})
+		}
+	}
+	for _, n := range eligible {
+		nodeAddress, err := pickFirstInternalIP(n)
+		if err != nil {
+			continue
+		}
+		if _, maintenance := types.InMaintenance(n); maintenance {
+			add(n, stats.BackendMaintenance, 0)
+		} else if weight := nodeSettings[nodeAddress].weight; weight > 0 {
+			add(n, stats.BackendActive, weight)
+		} else {
+			add(n, stats.BackendDraining, 0)
+		}
+	}
+	for n, state := range ineligible {
+		add(n, state, 0)
+	}
+	return out
+}
+
 func (i *IPVS) WaitAWhile() {
 
 	select {
@@ -517,7 +659,7 @@ func (i *IPVS) logRules(name string, rules []string, ts string) {
 	}
 }
 
-func (i *IPVS) SetIPVS(w *watcher.Watcher, config *types.ClusterConfig, logger log.FieldLogger, ipType string) error {
+func (i *IPVS) SetIPVS(w *watcher.Watcher, config *types.ClusterConfig, logger log.Logger, ipType string) error {
 
 	var err error
 	if i.earlylate == "Y" {
@@ -531,7 +673,7 @@ func (i *IPVS) SetIPVS(w *watcher.Watcher, config *types.ClusterConfig, logger l
 
 // SetIPVSEarlyLate - generate 2 sets of rules (early, late) to
 // allow more time for the node workers.
-func (i *IPVS) SetIPVSEarlyLate(w *watcher.Watcher, config *types.ClusterConfig, logger log.FieldLogger, ipType string) error {
+func (i *IPVS) SetIPVSEarlyLate(w *watcher.Watcher, config *types.ClusterConfig, logger log.Logger, ipType string) error {
 
 	startTime := time.Now()
 	ts := time.Now().Format("20060102150405")
@@ -565,6 +707,8 @@ func (i *IPVS) SetIPVSEarlyLate(w *watcher.Watcher, config *types.ClusterConfig,
 		return err
 	}
 	log.Debugln("ipvs: done generating rules after", time.Since(startTime))
+	i.claim(ipvsGenerated)
+	ipvsConfigured = i.ownedRules(ipvsConfigured, ipvsGenerated)
 
 	// generate a set of deletions + creations
 	log.Debugln("ipvs: start merging rules after", time.Since(startTime))
@@ -584,6 +728,7 @@ func (i *IPVS) SetIPVSEarlyLate(w *watcher.Watcher, config *types.ClusterConfig,
 		}
 	}
 
+	failed := map[ipvsService]error{}
 	if len(rulesEarly) > 0 {
 		log.Debugln("ipvs: setting", len(rulesEarly), "ipvsadm rulesEarly")
 		setBytes, err := i.Set(rulesEarly)
@@ -592,7 +737,11 @@ func (i *IPVS) SetIPVSEarlyLate(w *watcher.Watcher, config *types.ClusterConfig,
 			for _, rule := range rulesEarly {
 				log.Errorf("ipvs: rule failed to apply: ipvsadm %s", rule)
 			}
-			return err
+			if failed, err = i.applyByService(ipvsGenerated, ipType); err != nil {
+				return err
+			}
+			// the late rules were applied along with the rest
+			rulesLate = nil
 		}
 		log.Debugln("ipvs: done applying rules after", time.Since(startTime))
 	}
@@ -608,18 +757,21 @@ func (i *IPVS) SetIPVSEarlyLate(w *watcher.Watcher, config *types.ClusterConfig,
 			for _, rule := range rulesLate {
 				log.Errorf("ipvs: rule failed to apply: ipvsadm %s", rule)
 			}
-			return err
+			if failed, err = i.applyByService(ipvsGenerated, ipType); err != nil {
+				return err
+			}
 		}
 		log.Debugln("ipvs: done applying rules after", time.Since(startTime))
 	}
 
 	log.Debugln("ipvs: done merging and applying rules after", time.Since(startTime))
 	// log.Debugln("ipvs: done merging and applying rules")
-	return nil
+	i.settle(ipType, ipvsGenerated, failed)
+	return i.recordServices(config, ipType, ipvsGenerated, append(rulesEarly, rulesLate...), failed)
 }
 
 // generate one set of rules
-func (i *IPVS) SetIPVSRules(w *watcher.Watcher, config *types.ClusterConfig, logger log.FieldLogger, ipType string) error {
+func (i *IPVS) SetIPVSRules(w *watcher.Watcher, config *types.ClusterConfig, logger log.Logger, ipType string) error {
 
 	startTime := time.Now()
 	ts := time.Now().Format("20060102150405")
@@ -654,6 +806,8 @@ func (i *IPVS) SetIPVSRules(w *watcher.Watcher, config *types.ClusterConfig, log
 		return err
 	}
 	log.Debugln("ipvs: done generating rules after", time.Since(startTime))
+	i.claim(ipvsGenerated)
+	ipvsConfigured = i.ownedRules(ipvsConfigured, ipvsGenerated)
 
 	// generate a set of deletions + creations
 	log.Debugln("ipvs: start merging rules after", time.Since(startTime))
@@ -670,6 +824,7 @@ func (i *IPVS) SetIPVSRules(w *watcher.Watcher, config *types.ClusterConfig, log
 
 	}
 
+	failed := map[ipvsService]error{}
 	if len(rules) > 0 {
 		log.Debugln("ipvs: setting", len(rules), "ipvsadm rules")
 		setBytes, err := i.Set(rules)
@@ -678,20 +833,171 @@ func (i *IPVS) SetIPVSRules(w *watcher.Watcher, config *types.ClusterConfig, log
 			for _, rule := range rules {
 				log.Errorf("ipvs: rule failed to apply: ipvsadm %s", rule)
 			}
-			return err
+			if failed, err = i.applyByService(ipvsGenerated, ipType); err != nil {
+				return err
+			}
 		}
 		log.Debugln("ipvs: done applying rules after", time.Since(startTime))
 	}
 
 	log.Debugln("ipvs: done merging and applying rules after", time.Since(startTime))
 	// log.Debugln("ipvs: done merging and applying rules")
+	i.settle(ipType, ipvsGenerated, failed)
+	return i.recordServices(config, ipType, ipvsGenerated, rules, failed)
+}
+
+// ipvsService identifies the virtual service an ipvsadm rule belongs to.
+type ipvsService struct {
+	protocol, vip, port string
+}
+
+func (s ipvsService) String() string {
+	return fmt.Sprintf("%s %s", s.protocol, net.JoinHostPort(s.vip, s.port))
+}
+
+// ipvsServiceOf returns the virtual service of a rule, e.g. tcp 10.0.0.1 80
+// for "-a -t 10.0.0.1:80 -r 10.0.1.1:80 -g -w 1". v6 addresses are returned
+// without brackets, as they appear in the cluster config.
+func ipvsServiceOf(rule string) (ipvsService, bool) {
+	fields := strings.Fields(rule)
+	for ix := 0; ix < len(fields)-1; ix++ {
+		var protocol string
+		switch fields[ix] {
+		case "-t":
+			protocol = "tcp"
+		case "-u":
+			protocol = "udp"
+		default:
+			continue
+		}
+		host, port, err := net.SplitHostPort(fields[ix+1])
+		if err != nil {
+			return ipvsService{}, false
+		}
+		return ipvsService{protocol: protocol, vip: host, port: port}, true
+	}
+	return ipvsService{}, false
+}
+
+// Backends returns the number of real servers configured on each virtual
+// service, keyed as "tcp 10.0.0.1:80" or "udp [2001:db8::1]:53".
+func (i *IPVS) Backends() (map[string]int, error) {
+	rules, err := i.Get()
+	if err != nil {
+		return nil, err
+	}
+	rules6, err := i.GetV6()
+	if err != nil {
+		return nil, err
+	}
+
+	backends := map[string]int{}
+	for _, rule := range append(rules, rules6...) {
+		if !strings.HasPrefix(rule, "-a ") {
+			continue
+		}
+		if svc, ok := ipvsServiceOf(rule); ok {
+			backends[svc.String()]++
+		}
+	}
+	return backends, nil
+}
+
+// applyByService is the fallback when a batch of rules fails to apply.
+// ipvsadm -R stops at the first rule that fails without saying which, having
+// applied the rules before it, so the configured rules are read again, merged
+// with the generated ones and applied one virtual service at a time. The
+// services whose rules still fail are returned; the rest are left configured.
+func (i *IPVS) applyByService(generated []string, ipType string) (map[ipvsService]error, error) {
+	var configured []string
+	var err error
+	if ipType == addrKindIPV4 {
+		configured, err = i.Get()
+	} else {
+		configured, err = i.GetV6()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// group the merged rules by service, keeping their order within each
+	order := []ipvsService{}
+	groups := map[ipvsService][]string{}
+	for _, rule := range i.merge(i.ownedRules(configured, generated), generated) {
+		svc, _ := ipvsServiceOf(rule)
+		if _, ok := groups[svc]; !ok {
+			order = append(order, svc)
+		}
+		groups[svc] = append(groups[svc], rule)
+	}
+
+	failed := map[ipvsService]error{}
+	for _, svc := range order {
+		if out, err := i.Set(groups[svc]); err != nil {
+			log.Errorf("ipvs: rules for %s failed to apply: %v/%v", svc, strings.TrimSpace(string(out)), err)
+			failed[svc] = err
+		}
+	}
+	log.Warnf("ipvs: applied rules for %d services one at a time after a batch failure. %d failed", len(order), len(failed))
+	return failed, nil
+}
+
+// recordServices reports the outcome of a reconfigure for each service in
+// the generated rules, and for any removed service whose rules failed to
+// delete. It returns an error naming the failed services, if any.
+func (i *IPVS) recordServices(config *types.ClusterConfig, ipType string, generated, applied []string, failed map[ipvsService]error) error {
+	portMaps := config.Config
+	if ipType != addrKindIPV4 {
+		portMaps = config.Config6
+	}
+
+	changed := map[ipvsService]bool{}
+	for _, rule := range applied {
+		if svc, ok := ipvsServiceOf(rule); ok {
+			changed[svc] = true
+		}
+	}
+	services := map[ipvsService]bool{}
+	for _, rule := range generated {
+		if svc, ok := ipvsServiceOf(rule); ok {
+			services[svc] = true
+		}
+	}
+	for svc := range failed {
+		services[svc] = true
+	}
+
+	results := make([]stats.ServiceResult, 0, len(services))
+	names := []string{}
+	for svc := range services {
+		r := stats.ServiceResult{
+			VIP:      svc.vip,
+			Port:     svc.port,
+			Protocol: svc.protocol,
+			Applied:  changed[svc],
+			Err:      failed[svc],
+		}
+		if def, ok := portMaps[types.ServiceIP(svc.vip)][svc.port]; ok && def != nil {
+			r.Namespace, r.Service, r.PortName = def.Namespace, def.Service, def.PortName
+		}
+		if r.Err != nil {
+			names = append(names, fmt.Sprintf("%s (%s/%s:%s)", svc, r.Namespace, r.Service, r.PortName))
+		}
+		results = append(results, r)
+	}
+	i.metrics.Results(ipType, results)
+
+	if len(names) > 0 {
+		sort.Strings(names)
+		return fmt.Errorf("ipvs: rules failed to apply for %d services: %s", len(names), strings.Join(names, ", "))
+	}
 	return nil
 }
 
 
 
 
-func (i *IPVS) SetIPVS6_NU(w *watcher.Watcher, config *types.ClusterConfig, logger log.FieldLogger) error {
+func (i *IPVS) SetIPVS6_NU(w *watcher.Watcher, config *types.ClusterConfig, logger log.Logger) error {
 
 	startTime := time.Now()
 	defer func() {
@@ -760,6 +1066,16 @@ func getNodeWeightsAndLimits(eligibleNodes []*v1.Node, w *watcher.Watcher, servi
 		if !weightOverride {
 			weight = getNodeWeightForService(w, node.Name, serviceConfig)
 		}
+		// runtime overrides of the service
+		if serviceConfig.Drained {
+			weight = 0
+		} else if serviceConfig.Weight != nil && weight > 0 {
+			weight = *serviceConfig.Weight
+		}
+		// a node in maintenance keeps its connections but gets no new ones
+		if _, maintenance := types.InMaintenance(node); maintenance {
+			weight = 0
+		}
 
 		cfg := nodeConfig{
 			forwardingMethod: serviceConfig.IPVSOptions.ForwardingMethod(),
@@ -840,38 +1156,32 @@ func (i *IPVS) merge(existingRules []string, newRules []string) []string {
 	// log.Debugln("duration for second stage:", time.Since(startTime))
 
 	// finally, if we have a rule that is a delete rule and a rule that is an add rule for the same
-	// VIP, but only with different weights, then we delete them both and change it to an edit rule
-	for mergedRuleA := range mergedRulesMap {
+	// VIP, but only with different weights, then we delete them both and change it to an edit rule.
+	// the rules are grouped by what comes before their weight in one pass, as comparing every rule
+	// with every other took minutes with a thousand VIPs
+	weighted := map[string][]string{}
+	for mergedRule := range mergedRulesMap {
 		// don't compare delete rules or edit rules because we're only looking to change the
 		// situation where rules have been both added and deleted
-		if strings.Contains(mergedRuleA, "-d") {
+		if strings.Contains(mergedRule, "-d") || strings.Contains(mergedRule, "-e") {
 			continue
 		}
-		if strings.Contains(mergedRuleA, "-e") {
+		ruleChunks := strings.Split(mergedRule, "-w ")
+		if len(ruleChunks) != 2 {
 			continue
 		}
-		ruleAChunks := strings.Split(mergedRuleA, "-w ")
-		for mergedRuleB := range mergedRulesMap {
-			// we don't want to consider edit rules because we're only looking for situations
-			// where a rule has been added and deleted
-			if strings.Contains(mergedRuleA, "-e") {
-				continue
-			}
-			// skip ourselves
-			if mergedRuleA == mergedRuleB {
-				continue
-			}
-			ruleBChunks := strings.Split(mergedRuleB, "-w ")
-			if len(ruleAChunks) == 2 && len(ruleBChunks) == 2 {
-				if ruleAChunks[0] == ruleBChunks[0] && ruleAChunks[1] != ruleBChunks[1] {
-					// this rule exists in our mergedRules twice, so we delete them both
-					// and replace with a single edit rule
-					delete(mergedRulesMap, mergedRuleA)
-					delete(mergedRulesMap, mergedRuleB)
-					mergedRulesMap[strings.Replace(mergedRuleA, "-a", "-e", 1)] = struct{}{}
-				}
-			}
+		weighted[ruleChunks[0]] = append(weighted[ruleChunks[0]], mergedRule)
+	}
+	for _, rules := range weighted {
+		if len(rules) < 2 {
+			continue
 		}
+		// this rule exists in our mergedRules more than once, so we delete them all
+		// and replace with a single edit rule
+		for _, rule := range rules {
+			delete(mergedRulesMap, rule)
+		}
+		mergedRulesMap[strings.Replace(rules[0], "-a", "-e", 1)] = struct{}{}
 	}
 
 	// for mergedRule := range mergedRulesMap {
@@ -1081,7 +1391,7 @@ func (i *IPVS) mergeEarlyLate(existingRules []string, newRules []string) ([]stri
 //  ipvsadm -a -t 10.131.153.120:8889 -s mh -b flag-1,flag-2
 // and turns it into a delete rule like this:
 //  ipvsadm -d -t 10.131.153.120:8889
-func (i IPVS) createDeleteRuleFromAddRule(addRule string) string {
+func (i *IPVS) createDeleteRuleFromAddRule(addRule string) string {
 
 	addRule = strings.Replace(addRule, "-A", "-D", 1)
 	addRule = strings.Replace(addRule, "-a", "-d", 1)
@@ -1167,7 +1477,26 @@ func (i *IPVS) sanitizeIPVSRule(rule string) string {
 	rule = strings.TrimSuffix(rule, "--tun-type ipip")
 	rule = strings.Replace(rule, "mh-fallback", "flag-1", -1)
 	rule = strings.Replace(rule, "mh-port", "flag-2", -1)
+	rule = strings.Replace(rule, "sh-fallback", "flag-1", -1)
+	rule = strings.Replace(rule, "sh-port", "flag-2", -1)
 	rule = strings.TrimSpace(rule)
+
+	// the options of a virtual service are put in the order serviceOptions
+	// gives them, whatever order ipvsadm prints them in
+	fields := strings.Fields(rule)
+	if len(fields) > 5 && fields[0] == "-A" && fields[3] == "-s" {
+		options := map[string]string{}
+		for ix := 5; ix+1 < len(fields); ix += 2 {
+			options[fields[ix]] = fields[ix+1]
+		}
+		ordered := fields[:5]
+		for _, option := range []string{"-b", "-p", "-M"} {
+			if value, ok := options[option]; ok {
+				ordered = append(ordered, option, value)
+			}
+		}
+		rule = strings.Join(ordered, " ")
+	}
 	return rule
 }
 
@@ -1251,7 +1580,7 @@ func (i *IPVS) CheckConfigParity(w *watcher.Watcher, config *types.ClusterConfig
 		return false, nil
 	}
 
-	isEqual := i.ipvsEquality(ipvsConfigured, ipvsGenerated)
+	isEqual := i.ipvsEquality(i.ownedRules(ipvsConfigured, ipvsGenerated), ipvsGenerated)
 	if !isEqual {
 		log.Debugln("ipvs: CheckConfigParity: ipvsEquality returned NOT equal")
 	} else {
@@ -1376,6 +1705,41 @@ func (i *IPVS) ipvsEquality(existingRules []string, newRules []string) bool {
 
 }
 
+// ParityDiff returns the v4 rules that config wants and aren't applied, and
+// those applied that it doesn't want, compared as CheckConfigParity does.
+func (i *IPVS) ParityDiff(w *watcher.Watcher, config *types.ClusterConfig) (missing []string, extra []string, err error) {
+	if config == nil || w.Nodes == nil {
+		return nil, nil, fmt.Errorf("ipvs: no config and nodes seen yet")
+	}
+	configured, err := i.Get()
+	if err != nil {
+		return nil, nil, err
+	}
+	generated, err := i.generateRules(w, w.Nodes, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	configured = i.ownedRules(configured, generated)
+
+	have := map[string]bool{}
+	for _, rule := range configured {
+		have[i.sanitizeIPVSRule(rule)] = true
+	}
+	want := map[string]bool{}
+	for _, rule := range generated {
+		want[i.sanitizeIPVSRule(rule)] = true
+		if !have[i.sanitizeIPVSRule(rule)] {
+			missing = append(missing, rule)
+		}
+	}
+	for _, rule := range configured {
+		if !want[i.sanitizeIPVSRule(rule)] {
+			extra = append(extra, rule)
+		}
+	}
+	return missing, extra, nil
+}
+
 // ipvsRules is a sortable string array comprised of the output of an ipvsadm -Sn command
 // strings within this sortable are expected to match the followinf structure:
 //
@@ -11,10 +11,10 @@ import (
 	"testing"
 	"time"
 
+	log "github.com/Comcast/Ravel/pkg/logging"
 	"github.com/Comcast/Ravel/pkg/types"
 	"github.com/Comcast/Ravel/pkg/watcher"
 	"github.com/sirupsen/logrus"
-	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 )
 
@@ -52,7 +52,7 @@ func saveRules (file string, rules []string, suffix string) {
 
 func CCTest2(t *testing.T, dir string, iter int) {
 
-	log.SetLevel(log.DebugLevel)
+	logrus.SetLevel(logrus.DebugLevel)
 	prefix := fmt.Sprintf("%s/%-4.4d-", dir, iter)
 
     if !fileExist(prefix + "configured") {
@@ -92,7 +92,7 @@ func CCTest2(t *testing.T, dir string, iter int) {
 func CCTest(t *testing.T, dir string) {
 
 
-	log.SetLevel(log.DebugLevel)
+	logrus.SetLevel(logrus.DebugLevel)
 
 	existing := loadFile(dir + "/01-configured")
 
@@ -144,7 +144,7 @@ func TestCCNewMerge(t *testing.T) {
 
 func TestMergeRules(t *testing.T) {
 
-	log.SetLevel(log.DebugLevel)
+	logrus.SetLevel(logrus.DebugLevel)
 
 	// load existing rules
 	b, err := ioutil.ReadFile("existingRules.json")
@@ -173,6 +173,132 @@ func TestMergeRules(t *testing.T) {
 	}
 }
 
+// mergePairwise is merge as it paired edits before rules were grouped by what
+// comes before their weight, comparing every rule with every other.
+func mergePairwise(i *IPVS, existingRules []string, newRules []string) []string {
+	existingRulesMap := map[string]struct{}{}
+	for _, v := range existingRules {
+		existingRulesMap[i.sanitizeIPVSRule(v)] = struct{}{}
+	}
+	newRulesMap := map[string]struct{}{}
+	for _, v := range newRules {
+		newRulesMap[i.sanitizeIPVSRule(v)] = struct{}{}
+	}
+	mergedRulesMap := map[string]struct{}{}
+	for existingRule := range existingRulesMap {
+		if _, ok := newRulesMap[existingRule]; !ok {
+			mergedRulesMap[i.createDeleteRuleFromAddRule(existingRule)] = struct{}{}
+		}
+	}
+	for newRule := range newRulesMap {
+		if _, ok := existingRulesMap[newRule]; !ok {
+			mergedRulesMap[newRule] = struct{}{}
+		}
+	}
+	for mergedRuleA := range mergedRulesMap {
+		if strings.Contains(mergedRuleA, "-d") || strings.Contains(mergedRuleA, "-e") {
+			continue
+		}
+		ruleAChunks := strings.Split(mergedRuleA, "-w ")
+		for mergedRuleB := range mergedRulesMap {
+			if mergedRuleA == mergedRuleB {
+				continue
+			}
+			ruleBChunks := strings.Split(mergedRuleB, "-w ")
+			if len(ruleAChunks) == 2 && len(ruleBChunks) == 2 {
+				if ruleAChunks[0] == ruleBChunks[0] && ruleAChunks[1] != ruleBChunks[1] {
+					delete(mergedRulesMap, mergedRuleA)
+					delete(mergedRulesMap, mergedRuleB)
+					mergedRulesMap[strings.Replace(mergedRuleA, "-a", "-e", 1)] = struct{}{}
+				}
+			}
+		}
+	}
+	merged := []string{}
+	for r := range mergedRulesMap {
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// pairedRules sorts rules, without the weight of edits, which either way is
+// that of whichever of the rules paired came first in map order.
+func pairedRules(rules []string) []string {
+	out := make([]string, 0, len(rules))
+	for _, r := range rules {
+		if strings.HasPrefix(r, "-e ") {
+			r = strings.Split(r, "-w ")[0]
+		}
+		out = append(out, r)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestMergeEditPairing(t *testing.T) {
+	readRules := func(file string) []string {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules := []string{}
+		if err := json.Unmarshal(b, &rules); err != nil {
+			t.Fatal(err)
+		}
+		return rules
+	}
+	// enough of the fixtures for pairing every rule with every other to be quick
+	existing, generated := readRules("existingRules.json")[:2000], readRules("newRules.json")[:2000]
+
+	// the same rules with every weight flipped
+	flipped := []string{}
+	for _, r := range existing {
+		switch {
+		case strings.Contains(r, "-w 0"):
+			r = strings.Replace(r, "-w 0", "-w 1", 1)
+		case strings.Contains(r, "-w 1"):
+			r = strings.Replace(r, "-w 1", "-w 0", 1)
+		}
+		flipped = append(flipped, r)
+	}
+
+	for _, c := range []struct {
+		name              string
+		existing, desired []string
+	}{
+		{"fixtures", existing, generated},
+		{"fixtures reversed", generated, existing},
+		{"weights flipped", existing, flipped},
+		{"nothing applied", nil, generated},
+		{"everything removed", existing, nil},
+		{
+			"weights given more than once",
+			[]string{
+				"-A -t 10.0.0.1:80 -s wrr",
+				"-a -t 10.0.0.1:80 -r 10.1.0.1:80 -g -w 1",
+				"-a -t 10.0.0.1:80 -r 10.1.0.2:80 -m -w 1",
+				"-a -t 10.0.0.1:80 -r 10.1.0.3:80 -i -w 1 --tun-type ipip",
+			},
+			[]string{
+				"-A -t 10.0.0.1:80 -s wrr",
+				"-a -t 10.0.0.1:80 -r 10.1.0.1:80 -g -w 0",
+				"-a -t 10.0.0.1:80 -r 10.1.0.1:80 -g -w 2",
+				"-a -t 10.0.0.1:80 -r 10.1.0.2:80 -m -w 0",
+				"-a -t 10.0.0.1:80 -r 10.1.0.3:80 -i -w 0 --tun-type ipip",
+				"-a -t 10.0.0.1:80 -r 10.1.0.3:80 -i -w 2 --tun-type ipip",
+				"-a -t 10.0.0.1:80 -r 10.1.0.3:80 -i -w 3 --tun-type ipip",
+				"-a -t 10.0.0.1:80 -r 10.1.0.4:80 -g -w 1",
+			},
+		},
+	} {
+		i := &IPVS{}
+		expected := pairedRules(mergePairwise(i, c.existing, c.desired))
+		if got := pairedRules(i.merge(c.existing, c.desired)); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected\n%q\ngot\n%q", c.name, expected, got)
+		}
+	}
+}
+
 func TestGenerateRules(t *testing.T) {
 	// nodes []types.Node, config *types.ClusterConfig)
 
@@ -367,10 +493,30 @@ func TestGetNodeWeightsAndLimits(t *testing.T) {
 
 }
 
+func TestMaintenanceWeight(t *testing.T) {
+	nodes := []*v1.Node{
+		{Status: v1.NodeStatus{Addresses: []v1.NodeAddress{{Address: "10.11.12.13"}}}},
+		{Status: v1.NodeStatus{Addresses: []v1.NodeAddress{{Address: "10.11.12.12"}}}},
+	}
+	watcher := &watcher.Watcher{
+		Nodes: nodes,
+	}
+
+	// a node in maintenance drains, whatever its weight would be
+	nodes[0].Annotations = map[string]string{types.AnnotationMaintenance: "kernel upgrade"}
+	out := getNodeWeightsAndLimits(nodes, watcher, &types.ServiceDef{}, true, 1)
+	if weight := out[types.IPV4(nodes[0])].weight; weight != 0 {
+		t.Errorf("expected the node in maintenance to have a weight of 0, got %d", weight)
+	}
+	if weight := out[types.IPV4(nodes[1])].weight; weight != 1 {
+		t.Errorf("expected the other nodes to keep their weight, got %d", weight)
+	}
+}
+
 func TestCreateDeleteRule(t *testing.T) {
 
 	ipvsManager := IPVS{
-		logger: logrus.New(),
+		logger: log.New(),
 	}
 
 	tests := []struct {
@@ -395,6 +541,71 @@ func TestCreateDeleteRule(t *testing.T) {
 	}
 }
 
+func TestIPVSAuditAction(t *testing.T) {
+	tests := []struct {
+		rule, action, target string
+	}{
+		{"-A -t 10.131.153.125:71 -s wrr", "add", "-t 10.131.153.125:71 -s wrr"},
+		{"-e -t 10.131.153.125:71 -r 10.131.153.81:71 -g -w 1", "update", "-t 10.131.153.125:71 -r 10.131.153.81:71 -g -w 1"},
+		{"-d -t 10.131.153.125:71 -r 10.131.153.81:71", "del", "-t 10.131.153.125:71 -r 10.131.153.81:71"},
+	}
+	for _, test := range tests {
+		action, target := ipvsAuditAction(test.rule)
+		if action != test.action || target != test.target {
+			t.Fatalf("expected %s %q from %q. saw %s %q", test.action, test.target, test.rule, action, target)
+		}
+	}
+}
+
+func TestIPVSServiceOf(t *testing.T) {
+	tests := []struct {
+		rule string
+		svc  ipvsService
+		ok   bool
+	}{
+		{"-A -t 10.131.153.125:71 -s wrr", ipvsService{"tcp", "10.131.153.125", "71"}, true},
+		{"-a -u 10.131.153.125:53 -r 10.131.153.81:53 -g -w 1", ipvsService{"udp", "10.131.153.125", "53"}, true},
+		{"-D -t [2001:558:1044:1f3:10ad:ba1a:a36:d593]:8080", ipvsService{"tcp", "2001:558:1044:1f3:10ad:ba1a:a36:d593", "8080"}, true},
+		{"-C", ipvsService{}, false},
+	}
+	for _, test := range tests {
+		svc, ok := ipvsServiceOf(test.rule)
+		if svc != test.svc || ok != test.ok {
+			t.Fatalf("expected %v %v from %q. saw %v %v", test.svc, test.ok, test.rule, svc, ok)
+		}
+	}
+}
+
+func TestRecordServices(t *testing.T) {
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.131.153.125": {
+				"71": &types.ServiceDef{Namespace: "team-a", Service: "web", PortName: "http"},
+				"72": &types.ServiceDef{Namespace: "team-b", Service: "api", PortName: "http"},
+			},
+		},
+	}
+	generated := []string{
+		"-A -t 10.131.153.125:71 -s wrr",
+		"-a -t 10.131.153.125:71 -r 10.131.153.81:71 -g -w 1",
+		"-A -t 10.131.153.125:72 -s bogus",
+	}
+	ipvs := IPVS{}
+
+	if err := ipvs.recordServices(config, addrKindIPV4, generated, generated, nil); err != nil {
+		t.Fatalf("expected no error without failures, saw %v", err)
+	}
+
+	failed := map[ipvsService]error{{"tcp", "10.131.153.125", "72"}: fmt.Errorf("exit status 2")}
+	err := ipvs.recordServices(config, addrKindIPV4, generated, generated, failed)
+	if err == nil || !strings.Contains(err.Error(), "1 services") || !strings.Contains(err.Error(), "team-b/api:http") {
+		t.Fatalf("expected the failed service to be named, saw %v", err)
+	}
+	if strings.Contains(err.Error(), "team-a") {
+		t.Fatalf("expected only the failed service to be named, saw %v", err)
+	}
+}
+
 // TestIPVSMerge tests the merging of generated and existing rules into a simplest-form ipvsadm ruleset
 func TestIPVSMerge(t *testing.T) {
 
@@ -587,7 +798,7 @@ func TestIPVSMerge(t *testing.T) {
 	}
 
 	ipvsManager := IPVS{
-		logger: logrus.New(),
+		logger: log.New(),
 	}
 	rules := ipvsManager.merge(ipvsConfigured, generatedRules)
 	t.Log("Final rules:")
@@ -601,7 +812,7 @@ func TestIPVSMerge(t *testing.T) {
 func TestIPVSEquality(t *testing.T) {
 
 	ipvsManager := IPVS{
-		logger: logrus.New(),
+		logger: log.New(),
 	}
 
 	ipvsConfigured := []string{
@@ -796,3 +1007,31 @@ func TestIPVSEquality(t *testing.T) {
 	t.Log("Equality:", equal)
 
 }
+
+func TestServiceOptions(t *testing.T) {
+	for _, c := range []struct {
+		options types.IPVSOptions
+		v6      bool
+		want    string
+	}{
+		{types.IPVSOptions{RawScheduler: "wrr"}, false, ""},
+		{types.IPVSOptions{RawScheduler: "mh"}, false, " -b flag-1,flag-2"},
+		{types.IPVSOptions{RawScheduler: "mh", MHPort: true}, false, " -b flag-2"},
+		{types.IPVSOptions{RawScheduler: "sh", Flags: "sh-port", SHFallback: true}, false, " -b flag-1,flag-2"},
+		{types.IPVSOptions{RawScheduler: "wlc", Persistence: 300, PersistenceNetmask: "255.255.255.255"}, false, " -p 300"},
+		{types.IPVSOptions{RawScheduler: "sh", SHPort: true, Persistence: 300, PersistenceNetmask: "255.255.255.0"}, false, " -b flag-2 -p 300 -M 255.255.255.0"},
+		{types.IPVSOptions{RawScheduler: "wlc", Persistence: 60, PersistenceNetmask: "64"}, true, " -p 60 -M 64"},
+	} {
+		if got := serviceOptions(c.options, c.v6); got != c.want {
+			t.Errorf("expected %+v to give %q. saw %q", c.options, c.want, got)
+		}
+	}
+
+	// ipvsadm names the flags of sh, and may print persistence first
+	i := IPVS{}
+	applied := i.sanitizeIPVSRule("-A -t 10.0.0.1:80 -s sh -p 300 -M 255.255.255.0 -b sh-fallback,sh-port")
+	generated := i.sanitizeIPVSRule("-A -t 10.0.0.1:80 -s sh -b flag-1,flag-2 -p 300 -M 255.255.255.0")
+	if applied != generated {
+		t.Errorf("expected the rules to match. saw %q and %q", applied, generated)
+	}
+}
@@ -0,0 +1,300 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/audit"
+	log "github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/observe"
+	"github.com/Comcast/Ravel/pkg/privsep"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// Ravel instances of different config keys can share a node. Each tags what
+// it creates with the owner of its config key: a VIP device carries it as
+// its alias, and the ipvs services, which can't carry a tag, are recorded in
+// a file under the state directory. On a shared node an instance only
+// reconciles and removes what it owns. A device or service left untagged by
+// an earlier version is adopted once the config wants it, and otherwise left
+// alone. On a node that isn't shared, every dummy device and ipvs service is
+// still treated as the instance's own.
+
+// Ownership is how a helper tags what it creates, and whether it leaves
+// everything else alone.
+type Ownership struct {
+	ConfigKey string
+	// Shared scopes reconciliation and removal to what ConfigKey owns
+	Shared bool
+	// StateDir is where the ipvs services of ConfigKey are recorded
+	StateDir string
+}
+
+func (o Ownership) owner() string {
+	if o.ConfigKey == "" {
+		return ""
+	}
+	return types.Owner(o.ConfigKey)
+}
+
+// netClassDir is where the kernel lists the network devices.
+var netClassDir = "/sys/class/net"
+
+// Own has the helper tag the VIP devices it creates as o's, and on a shared
+// node manage only those.
+func (i *IP) Own(o Ownership) {
+	i.ownership = o
+}
+
+// deviceOwner returns the owner a device is tagged with, or "" for none.
+func deviceOwner(device string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(netClassDir, device, "ifalias"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// owned returns the devices of the helper's owner on a shared node, and all
+// of them otherwise.
+func (i *IP) owned(devices []string) []string {
+	if !i.ownership.Shared {
+		return devices
+	}
+	owner := i.ownership.owner()
+	out := []string{}
+	for _, device := range devices {
+		current, err := deviceOwner(device)
+		if err != nil {
+			i.logger.Warnf("ipManager: unable to read the owner of device %s. %v", device, err)
+			continue
+		}
+		if current == owner {
+			out = append(out, device)
+		}
+	}
+	return out
+}
+
+// label tags device with the helper's owner. A device that already existed
+// is adopted if it is untagged, and refused if it belongs to another owner
+// on a shared node.
+func (i *IP) label(ctx context.Context, device, addr string, created bool) error {
+	owner := i.ownership.owner()
+	if owner == "" {
+		return nil
+	}
+	if !created {
+		current, err := deviceOwner(device)
+		if err != nil {
+			return fmt.Errorf("ipManager: unable to read the owner of device %s for addr %s: %v", device, addr, err)
+		}
+		if current == owner {
+			return nil
+		}
+		if current != "" && i.ownership.Shared {
+			return fmt.Errorf("ipManager: device %s for addr %s belongs to %s", device, addr, current)
+		}
+	}
+
+	cmdCtx, cmdContextCancel := context.WithTimeout(ctx, time.Second*20)
+	defer cmdContextCancel()
+	out, err := privsep.CommandContext(cmdCtx, "ip", "link", "set", "dev", device, "alias", owner).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("ipManager: failed to tag device %s as %s: %v. Saw output: %s", device, owner, err, string(out))
+	}
+	if !created {
+		audit.Record(audit.SubsystemInterface, "label", device, owner, err)
+	}
+	return err
+}
+
+// target is the service as ipvsadm takes it, e.g. -t 10.0.0.1:80.
+func (s ipvsService) target() string {
+	flag := "-t"
+	if s.protocol == "udp" {
+		flag = "-u"
+	}
+	return flag + " " + net.JoinHostPort(s.vip, s.port)
+}
+
+func (s ipvsService) family() string {
+	if strings.Contains(s.vip, ":") {
+		return "ipv6"
+	}
+	return addrKindIPV4
+}
+
+// Own has the helper record the ipvs services it creates as o's, and on a
+// shared node reconcile and tear down only those. The services recorded by
+// an earlier run are loaded.
+func (i *IPVS) Own(o Ownership) error {
+	i.ownedMu.Lock()
+	defer i.ownedMu.Unlock()
+	i.ownership = o
+	i.owned = map[ipvsService]bool{}
+	if !o.Shared {
+		return nil
+	}
+	b, err := ioutil.ReadFile(i.ledger())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("ipvs: unable to read the services of %s. %v", o.owner(), err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if svc, ok := ipvsServiceOf(line); ok {
+			i.owned[svc] = true
+		}
+	}
+	i.logger.Infof("ipvs: %s owns %d services from an earlier run", o.owner(), len(i.owned))
+	return nil
+}
+
+// ledger is the file that records the services of the owner.
+func (i *IPVS) ledger() string {
+	return filepath.Join(i.ownership.StateDir, "ipvs-"+i.ownership.ConfigKey)
+}
+
+// ownedRules returns the configured rules of the services the helper owns or
+// is about to configure on a shared node, and all of them otherwise.
+func (i *IPVS) ownedRules(configured, generated []string) []string {
+	if !i.ownership.Shared {
+		return configured
+	}
+	wanted := servicesOf(generated)
+	i.ownedMu.Lock()
+	defer i.ownedMu.Unlock()
+	out := []string{}
+	for _, rule := range configured {
+		if svc, ok := ipvsServiceOf(rule); ok && (i.owned[svc] || wanted[svc]) {
+			out = append(out, rule)
+		}
+	}
+	return out
+}
+
+// Owned returns the rules of the services the helper owns, or all of them on
+// a node that isn't shared.
+func (i *IPVS) Owned(rules []string) []string {
+	return i.ownedRules(rules, nil)
+}
+
+// claim records the generated services as owned before they are applied.
+func (i *IPVS) claim(generated []string) {
+	if !i.ownership.Shared {
+		return
+	}
+	i.ownedMu.Lock()
+	defer i.ownedMu.Unlock()
+	changed := false
+	for svc := range servicesOf(generated) {
+		if !i.owned[svc] {
+			i.owned[svc] = true
+			changed = true
+		}
+	}
+	if changed {
+		i.record()
+	}
+}
+
+// settle gives up the services of ipType that are no longer generated once
+// they are removed, keeping those whose rules failed to apply.
+func (i *IPVS) settle(ipType string, generated []string, failed map[ipvsService]error) {
+	if !i.ownership.Shared {
+		return
+	}
+	wanted := servicesOf(generated)
+	i.ownedMu.Lock()
+	defer i.ownedMu.Unlock()
+	changed := false
+	for svc := range i.owned {
+		if svc.family() != ipType || wanted[svc] || failed[svc] != nil {
+			continue
+		}
+		delete(i.owned, svc)
+		changed = true
+	}
+	if changed {
+		i.record()
+	}
+}
+
+// record writes the owned services to the ledger. An observer creates
+// nothing, so records nothing. It is called with ownedMu held.
+func (i *IPVS) record() {
+	if observe.Enabled() {
+		return
+	}
+	lines := []string{}
+	for svc := range i.owned {
+		lines = append(lines, svc.target())
+	}
+	sort.Strings(lines)
+
+	path := i.ledger()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(path+".tmp", []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		log.Warnf("ipvs: unable to record the services of %s in %s. %v", i.ownership.owner(), path, err)
+	}
+}
+
+// teardownOwned deletes the services the helper owns, leaving those of
+// other instances on the node.
+func (i *IPVS) teardownOwned(ctx context.Context) error {
+	i.ownedMu.Lock()
+	defer i.ownedMu.Unlock()
+	errs := []string{}
+	for svc := range i.owned {
+		rule := "-D " + svc.target()
+		action, target := ipvsAuditAction(rule)
+		if observe.Enabled() {
+			observe.Would(audit.SubsystemIPVS, action, target, "teardown")
+			continue
+		}
+		cmdCtx, cmdContextCancel := context.WithTimeout(ctx, time.Second*20)
+		out, err := privsep.CommandContext(cmdCtx, "ipvsadm", strings.Fields(rule)...).CombinedOutput()
+		cmdContextCancel()
+		if err != nil && strings.Contains(string(out), "No such service") {
+			err = nil
+		}
+		audit.Record(audit.SubsystemIPVS, action, target, "teardown", err)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", svc, err))
+			continue
+		}
+		delete(i.owned, svc)
+	}
+	i.record()
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("ipvs: unable to delete %d services: %s", len(errs), strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// servicesOf returns the services of rules.
+func servicesOf(rules []string) map[ipvsService]bool {
+	services := map[ipvsService]bool{}
+	for _, rule := range rules {
+		if svc, ok := ipvsServiceOf(rule); ok {
+			services[svc] = true
+		}
+	}
+	return services
+}
@@ -0,0 +1,97 @@
+package system
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+)
+
+func TestOwnedDevices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { netClassDir = d }(netClassDir)
+	netClassDir = dir
+	for device, alias := range map[string]string{"10_0_0_1": "ravel/green", "10_0_0_2": "ravel/blue", "10_0_0_3": ""} {
+		os.MkdirAll(filepath.Join(dir, device), 0755)
+		ioutil.WriteFile(filepath.Join(dir, device, "ifalias"), []byte(alias+"\n"), 0644)
+	}
+	devices := []string{"10_0_0_1", "10_0_0_2", "10_0_0_3"}
+
+	ip := &IP{logger: logging.New()}
+	ip.Own(Ownership{ConfigKey: "green"})
+	if owned := ip.owned(devices); !reflect.DeepEqual(owned, devices) {
+		t.Fatalf("expected every device on a node that isn't shared, got %v", owned)
+	}
+
+	ip.Own(Ownership{ConfigKey: "green", Shared: true})
+	if owned := ip.owned(devices); !reflect.DeepEqual(owned, []string{"10_0_0_1"}) {
+		t.Fatalf("expected only the devices of green, got %v", owned)
+	}
+
+	// a device of another owner is refused before anything is run
+	if err := ip.label(context.Background(), "10_0_0_2", "10.0.0.2", false); err == nil {
+		t.Fatal("expected the device of blue to be refused")
+	}
+	if err := ip.label(context.Background(), "10_0_0_1", "10.0.0.1", false); err != nil {
+		t.Fatalf("expected the device of green to be kept, got %v", err)
+	}
+}
+
+func TestOwnedRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "ipvs-green"), []byte("-t 10.0.0.1:80\n-u [2001:db8::1]:53\n"), 0644)
+
+	i := &IPVS{logger: logging.New()}
+	if err := i.Own(Ownership{ConfigKey: "green", Shared: true, StateDir: dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	configured := []string{
+		"-A -t 10.0.0.1:80 -s wrr",
+		"-a -t 10.0.0.1:80 -r 10.0.1.1:80 -g -w 1",
+		"-A -t 10.0.0.2:80 -s wrr",
+		"-A -t 10.0.0.3:80 -s wrr",
+		"-A -u [2001:db8::1]:53 -s wrr",
+	}
+	generated := []string{
+		"-A -t 10.0.0.3:80 -s wrr",
+		"-a -t 10.0.0.3:80 -r 10.0.1.1:80 -g -w 1",
+	}
+
+	// the recorded services and the generated one are green's, 10.0.0.2 is
+	// another instance's
+	want := []string{configured[0], configured[1], configured[3], configured[4]}
+	if owned := i.ownedRules(configured, generated); !reflect.DeepEqual(owned, want) {
+		t.Fatalf("expected the rules of green, got %v", owned)
+	}
+
+	// once applied, the v4 services that are no longer generated are given
+	// up, and the v6 one is left to its own reconcile
+	i.claim(generated)
+	i.settle(addrKindIPV4, generated, nil)
+	b, err := ioutil.ReadFile(filepath.Join(dir, "ipvs-green"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "-t 10.0.0.3:80\n-u [2001:db8::1]:53\n" {
+		t.Fatalf("expected the ledger to hold the services of green, got %q", b)
+	}
+
+	// a node that isn't shared is all the instance's
+	i.Own(Ownership{ConfigKey: "green"})
+	if owned := i.ownedRules(configured, generated); !reflect.DeepEqual(owned, configured) {
+		t.Fatalf("expected every rule on a node that isn't shared, got %v", owned)
+	}
+}
@@ -0,0 +1,87 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// Planning works out what the helpers would change on a node from the output
+// of the commands they read it with, rather than by running them, so that the
+// changes of a cluster config can be shown before it is applied: to a node
+// read live, or as captured in a support bundle.
+
+// ParseIPVS splits the output of ipvsadm -Sn into its v4 and v6 rules, as Get
+// and GetV6 read them.
+func ParseIPVS(out []byte) ([]string, []string) {
+	v4, v6 := []string{}, []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		rule := scanner.Text()
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		// v6 services are the ones in brackets, see Get
+		if strings.Contains(rule, "[") && strings.Contains(rule, "]") {
+			v6 = append(v6, rule)
+			continue
+		}
+		v4 = append(v4, rule)
+	}
+	return v4, v6
+}
+
+// Plan returns the ipvsadm rules SetIPVS would apply to bring configured, the
+// v4 or v6 rules of the node by ipType, to those config wants for the nodes
+// of w.
+func (i *IPVS) Plan(w *watcher.Watcher, config *types.ClusterConfig, configured []string, ipType string) ([]string, error) {
+	generate := i.generateRulesV6
+	if ipType == addrKindIPV4 {
+		generate = i.generateRules
+	}
+	generated, err := generate(w, w.Nodes, config)
+	if err != nil {
+		return nil, err
+	}
+	configured = i.ownedRules(configured, generated)
+	if i.earlylate == "Y" {
+		early, late := i.mergeEarlyLate(configured, generated)
+		return append(early, late...), nil
+	}
+	// merge leaves the rules in no order, which ipvsadm doesn't mind, but
+	// a plan is read
+	rules := i.merge(configured, generated)
+	sort.Sort(ipvsRules(rules))
+	return rules, nil
+}
+
+// RuleAction splits an ipvsadm rule into the action it takes and its target,
+// as the audit trail records them.
+func RuleAction(rule string) (string, string) {
+	return ipvsAuditAction(rule)
+}
+
+// ParseDevices returns the v4 and v6 VIP devices in the output of
+// ip -details link show, as Get reads them.
+func (i *IP) ParseDevices(out []byte) ([]string, []string) {
+	devices := []string{}
+	device := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		// each device starts with its index and name, then its details are
+		// indented below it
+		if fields := strings.Fields(line); len(fields) >= 2 && !strings.HasPrefix(line, " ") && strings.Contains(line, "mtu") {
+			device = strings.SplitN(strings.TrimSuffix(fields[1], ":"), "@", 2)[0]
+			continue
+		}
+		if device != "" && strings.HasPrefix(strings.TrimSpace(line), "dummy") {
+			devices = append(devices, device)
+			device = ""
+		}
+	}
+	v4, v6 := i.parseAddressData(devices)
+	return i.owned(v4), i.owned(v6)
+}
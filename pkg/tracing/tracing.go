@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+
+	log "github.com/Comcast/Ravel/pkg/logging"
+)
+
+// tracerName is the instrumentation name attached to every span ravel emits
+const tracerName = "github.com/Comcast/Ravel"
+
+// Init installs a global tracer provider that exports spans over OTLP/HTTP to
+// endpoint (host:port). If endpoint is blank, tracing is left disabled and all
+// spans created through this package are no-ops. The returned function flushes
+// any buffered spans and must be called on shutdown.
+func Init(ctx context.Context, endpoint string, insecure bool, sampleRatio float64, lbKind, nodeName string, logger log.Logger) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+	if endpoint == "" {
+		logger.Debugln("tracing: no otlp endpoint configured. tracing disabled")
+		return noop, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return noop, fmt.Errorf("tracing: unable to create otlp exporter for %s: %v", endpoint, err)
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceNameKey.String("ravel"),
+		semconv.HostNameKey.String(nodeName),
+		attribute.String("ravel.lb", lbKind),
+	)
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Warnf("tracing: %v", err)
+	}))
+
+	logger.Infof("tracing: exporting spans to %s with sample ratio %v", endpoint, sampleRatio)
+	return provider.Shutdown, nil
+}
+
+// Start begins a new span as a child of any span already present in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartLinked begins a new root span that is linked to the span that caused it,
+// such as the watcher publish that made a reconfigure necessary. Reconfigures run
+// on their own timers, so the triggering span is a link rather than a parent.
+func StartLinked(ctx context.Context, name string, cause trace.SpanContext, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{trace.WithNewRoot(), trace.WithAttributes(attrs...)}
+	if cause.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: cause}))
+	}
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// End records err on the span, if set, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
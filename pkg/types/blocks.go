@@ -0,0 +1,189 @@
+package types
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// A VIP of the config, config6, mtuConfig, mtuConfig6 or vipPool can be given
+// as a CIDR block, such
+// as 10.54.0.0/28, for a team that owns the whole block. The services of a
+// block apply to every address in it, and are expanded into a VIP of each
+// address when the config is loaded. A VIP given on its own as well keeps
+// the block's services, with its own added and replacing those of the same
+// port, and of blocks that overlap the narrower one applies.
+
+// MaxBlockAddresses is the most VIPs a block may expand into, a /24 of ipv4
+// or a /120 of ipv6.
+const MaxBlockAddresses = 256
+
+// IsBlock returns whether vip is given as a CIDR block.
+func IsBlock(vip string) bool {
+	return strings.Contains(vip, "/")
+}
+
+// ExpandBlock returns the VIPs of block, in order.
+func ExpandBlock(block string) ([]ServiceIP, error) {
+	ip, network, err := net.ParseCIDR(block)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a CIDR block", block)
+	}
+	if !ip.Equal(network.IP) {
+		return nil, fmt.Errorf("%q has host bits set. the block is %s", block, network)
+	}
+	ones, bits := network.Mask.Size()
+	if bits-ones > 8 {
+		return nil, fmt.Errorf("%q has more than %d addresses", block, MaxBlockAddresses)
+	}
+
+	// a block of at most 256 addresses only differs in its last byte
+	size := 1 << uint(bits-ones)
+	vips := make([]ServiceIP, 0, size)
+	for i := 0; i < size; i++ {
+		addr := make(net.IP, len(network.IP))
+		copy(addr, network.IP)
+		addr[len(addr)-1] += byte(i)
+		vips = append(vips, ServiceIP(addr.String()))
+	}
+	return vips, nil
+}
+
+// ExpandBlocks replaces the blocks of the config, config6, mtuConfig,
+// mtuConfig6 and vipPool of c with the VIPs they expand into.
+func (c *ClusterConfig) ExpandBlocks() error {
+	var err error
+	if c.Config, err = expandPortMaps(c.Config); err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	if c.Config6, err = expandPortMaps(c.Config6); err != nil {
+		return fmt.Errorf("config6: %v", err)
+	}
+	if c.MTUConfig, err = expandMTUs(c.MTUConfig); err != nil {
+		return fmt.Errorf("mtuConfig: %v", err)
+	}
+	if c.MTUConfig6, err = expandMTUs(c.MTUConfig6); err != nil {
+		return fmt.Errorf("mtuConfig6: %v", err)
+	}
+
+	pool := make([]string, 0, len(c.VIPPool))
+	for _, vip := range c.VIPPool {
+		if !IsBlock(vip) {
+			pool = append(pool, vip)
+			continue
+		}
+		vips, err := ExpandBlock(vip)
+		if err != nil {
+			return fmt.Errorf("vipPool: %v", err)
+		}
+		for _, v := range vips {
+			pool = append(pool, string(v))
+		}
+	}
+	c.VIPPool = pool
+	return nil
+}
+
+// expandMTUs returns mtus with its blocks expanded. The mtu of a VIP given on
+// its own, or of the narrowest block it is in, applies.
+func expandMTUs(mtus map[ServiceIP]string) (map[ServiceIP]string, error) {
+	widest := map[ServiceIP]int{}
+	out := make(map[ServiceIP]string, len(mtus))
+	for key, mtu := range mtus {
+		if !IsBlock(string(key)) {
+			continue
+		}
+		vips, err := ExpandBlock(string(key))
+		if err != nil {
+			return nil, err
+		}
+		for _, vip := range vips {
+			if size, ok := widest[vip]; ok && (size < len(vips) || size == len(vips) && out[vip] < mtu) {
+				continue
+			}
+			widest[vip] = len(vips)
+			out[vip] = mtu
+		}
+	}
+	if len(widest) == 0 {
+		return mtus, nil
+	}
+	for vip, mtu := range mtus {
+		if IsBlock(string(vip)) {
+			continue
+		}
+		if ip := net.ParseIP(string(vip)); ip != nil {
+			delete(out, ServiceIP(ip.String()))
+		}
+		out[vip] = mtu
+	}
+	return out, nil
+}
+
+// expandPortMaps returns portMaps with its blocks expanded, applying the
+// widest blocks first and VIPs given on their own last. Each VIP has its own
+// copy of the services of a block.
+func expandPortMaps(portMaps map[ServiceIP]PortMap) (map[ServiceIP]PortMap, error) {
+	type block struct {
+		key  ServiceIP
+		size int
+		vips []ServiceIP
+	}
+	blocks := []block{}
+	for key := range portMaps {
+		if !IsBlock(string(key)) {
+			continue
+		}
+		vips, err := ExpandBlock(string(key))
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block{key, len(vips), vips})
+	}
+	if len(blocks) == 0 {
+		return portMaps, nil
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].size != blocks[j].size {
+			return blocks[i].size > blocks[j].size
+		}
+		return blocks[i].key < blocks[j].key
+	})
+
+	out := make(map[ServiceIP]PortMap, len(portMaps))
+	set := func(vip ServiceIP, ports PortMap) {
+		if out[vip] == nil {
+			out[vip] = PortMap{}
+		}
+		for port, def := range ports {
+			if def == nil {
+				out[vip][port] = nil
+				continue
+			}
+			copied := *def
+			out[vip][port] = &copied
+		}
+	}
+	for _, b := range blocks {
+		for _, vip := range b.vips {
+			set(vip, portMaps[b.key])
+		}
+	}
+	for vip, ports := range portMaps {
+		if IsBlock(string(vip)) {
+			continue
+		}
+		// the address may be written other than the block writes it
+		if ip := net.ParseIP(string(vip)); ip != nil {
+			if expanded := ServiceIP(ip.String()); expanded != vip {
+				if _, ok := out[expanded]; ok {
+					out[vip] = out[expanded]
+					delete(out, expanded)
+				}
+			}
+		}
+		set(vip, ports)
+	}
+	return out, nil
+}
@@ -3,11 +3,13 @@ package types
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 
-	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
+
+	log "github.com/Comcast/Ravel/pkg/logging"
 )
 
 // ClusterConfig is a representation of an input configuration
@@ -30,6 +32,17 @@ type ClusterConfig struct {
 	IPV6       map[ServiceIP]string  `json:"ipv6"`
 	Config     map[ServiceIP]PortMap `json:"config"`
 	Config6    map[ServiceIP]PortMap `json:"config6"`
+
+	// Shards assigns VIPs to the nodes of the bgp directors that announce
+	// them, when the directors shard the VIPs. VIPs left out are spread over
+	// the directors by hashing.
+	Shards map[ServiceIP][]string `json:"shards,omitempty"`
+
+	// Base is another key of the configmap this config is an overlay of,
+	// and Defaults what its services and VIPs have unless they say
+	// otherwise. Both are applied as the config is loaded.
+	Base     string    `json:"base,omitempty"`
+	Defaults *Defaults `json:"defaults,omitempty"`
 }
 
 func NewClusterConfig(config *v1.ConfigMap, configKey string) (*ClusterConfig, error) {
@@ -47,7 +60,11 @@ func NewClusterConfig(config *v1.ConfigMap, configKey string) (*ClusterConfig, e
 		return nil, fmt.Errorf("config key '%s' not found in configmap. have '%v'", configKey, keys)
 	}
 
-	err := json.Unmarshal([]byte(config.Data[configKey]), &clusterConfig)
+	rendered, err := RenderConfig(config.Data, configKey)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(rendered, &clusterConfig)
 	if err != nil {
 		return nil, fmt.Errorf("json unmarshal error. %v", err)
 	}
@@ -58,6 +75,14 @@ func NewClusterConfig(config *v1.ConfigMap, configKey string) (*ClusterConfig, e
 	}
 	log.Debugln("NewClusterConfig: loaded configmap configKey", configKey, "from configmap", config.Name, "with", len(clusterConfig.Config), "IPv4 config entries")
 
+	if err := clusterConfig.ExpandBlocks(); err != nil {
+		return nil, fmt.Errorf("invalid VIP block. %v", err)
+	}
+	clusterConfig.applyDefaultMTU()
+	if err := clusterConfig.ExpandPortRanges(); err != nil {
+		return nil, fmt.Errorf("invalid port range. %v", err)
+	}
+
 	// TODO: validate the cluster config in depth
 	if err := clusterConfig.Validate(); err != nil {
 		return nil, fmt.Errorf("validation error. %v", err)
@@ -93,6 +118,98 @@ type ServiceDef struct {
 	TCPEnabled           bool `json:"tcpEnabled"`
 	UDPEnabled           bool `json:"udpEnabled"`
 	ProxyProtocolEnabled bool `json:"proxyProtocolEnabled"`
+
+	// AcceptProxyProtocol expects connections to a v6 VIP to start with a
+	// PROXY protocol header, as sent by a proxy in front of ravel.
+	AcceptProxyProtocol bool `json:"acceptProxyProtocol"`
+
+	// TLSSecret names a kubernetes.io/tls secret, in the namespace of the
+	// service or as namespace/name. When set, the v6 listener terminates TLS
+	// with its certificate and forwards plain TCP to the pods.
+	TLSSecret string `json:"tlsSecret,omitempty"`
+
+	// HealthCheck has haproxy check the pods behind a v6 listener, and stop
+	// sending them connections when they fail, ahead of their endpoints
+	// being updated.
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+
+	// V6Proxy picks what proxies the v6 listener to the pods: haproxy, or
+	// native to have ravel proxy it without haproxy. The --v6-proxy flag
+	// applies when empty.
+	V6Proxy string `json:"v6Proxy,omitempty"`
+
+	// L7Mode lets several services share the v6 VIP and port of this one.
+	// Connections are routed by the SNI of their TLS handshake ("sni") or
+	// their HTTP Host header ("http") to the services in Routes, and those
+	// that match no route go to this service.
+	L7Mode string  `json:"l7Mode,omitempty"`
+	Routes []Route `json:"routes,omitempty"`
+
+	// Listener tunes the connection limits and timeouts of the v6 listener.
+	Listener *ListenerSettings `json:"listener,omitempty"`
+
+	// LocalBackend has the v6 listener connect to its pods, which run on
+	// the same node, over a unix socket such as "/run/pods/{ip}.sock", an
+	// abstract socket such as "@svc-{ip}", or a port on the node's loopback
+	// such as "127.0.0.1:{port}", rather than over the pod network. {ip} is
+	// the pod IP and {port} the target port.
+	LocalBackend string `json:"localBackend,omitempty"`
+
+	// Weight and Drained are runtime overrides set through the admin
+	// endpoint, layered over the configmap. Weight is the ipvs weight of
+	// each real server with endpoints of the service, and Drained gives them
+	// all weight 0, so that they keep their connections but get no new ones.
+	Weight  *int `json:"weight,omitempty"`
+	Drained bool `json:"drained,omitempty"`
+
+	// PortRange is the range of ports, such as 30000-30100, that the service
+	// was given for, set as the range is expanded. The realservers forward
+	// each port of a range to the same port of the pods, rather than to the
+	// target port of PortName.
+	PortRange string `json:"portRange,omitempty"`
+}
+
+// ListenerSettings tune the connections of a v6 listener. Unset fields keep
+// the defaults: no connection limit and 5s timeouts.
+type ListenerSettings struct {
+	// MaxConn is how many connections the listener takes at once.
+	MaxConn int `json:"maxConn,omitempty"`
+	// ConnectTimeout bounds connecting to a pod, and ClientTimeout and
+	// ServerTimeout how long either side may stay silent, as durations
+	// such as "30s".
+	ConnectTimeout string `json:"connectTimeout,omitempty"`
+	ClientTimeout  string `json:"clientTimeout,omitempty"`
+	ServerTimeout  string `json:"serverTimeout,omitempty"`
+	// HTTPKeepAliveTimeout is how long a listener in http mode waits for the
+	// next request on a kept-alive connection.
+	HTTPKeepAliveTimeout string `json:"httpKeepAliveTimeout,omitempty"`
+	// TCPKeepAlive sends TCP keep-alives to the clients and the pods.
+	TCPKeepAlive bool `json:"tcpKeepAlive,omitempty"`
+}
+
+// Route sends the connections for a host to another service.
+type Route struct {
+	// Host is a hostname, or *.domain for any name under domain.
+	Host      string `json:"host"`
+	Namespace string `json:"namespace"`
+	Service   string `json:"service"`
+	PortName  string `json:"portName"`
+}
+
+// HealthCheck configures the haproxy checks of the pods behind a listener.
+// Unset fields take haproxy's defaults.
+type HealthCheck struct {
+	// Interval between checks of a pod, as a duration such as "2s".
+	Interval string `json:"interval,omitempty"`
+	// Rise is how many checks a pod must pass to be used again, and Fall
+	// how many it must fail to be taken out.
+	Rise int `json:"rise,omitempty"`
+	Fall int `json:"fall,omitempty"`
+	// HTTPPath makes the check a GET of this path rather than a connect.
+	HTTPPath string `json:"httpPath,omitempty"`
+	// HTTPExpect is the http-check expect rule, such as "status 200" or
+	// "rstatus ^2". Without it, any 2xx or 3xx response passes.
+	HTTPExpect string `json:"httpExpect,omitempty"`
 }
 
 // IPVSOptions contains per-service options for the IPVS configuration.
@@ -137,6 +254,67 @@ type IPVSOptions struct {
 	// Flags are optional args for a new virtual server
 	// if flags: -b <flag-1>,<flag-2>,... (default empty)
 	Flags string `json:"flags"`
+
+	// SHFallback and MHFallback have the sh and mh schedulers pick another
+	// realserver when the one a client hashes to is unavailable, and SHPort
+	// and MHPort have them hash the client's port as well as its address.
+	// They are added to Flags as flag-1 and flag-2.
+	// -b sh-fallback,sh-port
+	SHFallback bool `json:"shFallback,omitempty"`
+	SHPort     bool `json:"shPort,omitempty"`
+	MHFallback bool `json:"mhFallback,omitempty"`
+	MHPort     bool `json:"mhPort,omitempty"`
+
+	// Persistence is how many seconds the connections of a client keep to
+	// the realserver it was first sent to, or 0 for none, and
+	// PersistenceNetmask the clients that share a realserver, a mask such as
+	// 255.255.255.0 for ipv4 or a prefix length for ipv6.
+	// -p 300 -M 255.255.255.0
+	Persistence        int    `json:"persistence,omitempty"`
+	PersistenceNetmask string `json:"persistenceNetmask,omitempty"`
+}
+
+// schedulerFlagBits are the flags of virtual services by name, as the bits
+// ipvsadm -b sets. The sh and mh flags are other names of flag-1 and flag-2.
+var schedulerFlagBits = map[string]string{
+	"flag-1":      "flag-1",
+	"flag-2":      "flag-2",
+	"flag-3":      "flag-3",
+	"sh-fallback": "flag-1",
+	"sh-port":     "flag-2",
+	"mh-fallback": "flag-1",
+	"mh-port":     "flag-2",
+}
+
+// SchedulerFlags returns the flags of Flags and the typed flags as ipvsadm -b
+// takes them, in order, such as flag-1,flag-2. The mh scheduler has
+// flag-1,flag-2 when no flag is given, which keeps maglev from dropping
+// packets. Flags that aren't known are kept as they are.
+func (i *IPVSOptions) SchedulerFlags() string {
+	set := map[string]bool{}
+	for _, flag := range strings.Split(i.Flags, ",") {
+		flag = strings.TrimSpace(flag)
+		if bit, ok := schedulerFlagBits[flag]; ok {
+			flag = bit
+		}
+		if flag != "" {
+			set[flag] = true
+		}
+	}
+	set["flag-1"] = set["flag-1"] || i.SHFallback || i.MHFallback
+	set["flag-2"] = set["flag-2"] || i.SHPort || i.MHPort
+
+	flags := []string{}
+	for flag, ok := range set {
+		if ok {
+			flags = append(flags, flag)
+		}
+	}
+	if len(flags) == 0 && i.Scheduler() == "mh" {
+		return "flag-1,flag-2"
+	}
+	sort.Strings(flags)
+	return strings.Join(flags, ",")
 }
 
 // Scheduler returns a scheduler
@@ -0,0 +1,282 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// What a change of a cluster config changes.
+const (
+	ChangeVIP     = "vip"
+	ChangePort    = "port"
+	ChangeOption  = "option"
+	ChangeSetting = "setting"
+)
+
+// How a change of a cluster config changes it.
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// ConfigChange is a difference between two cluster configs: a VIP or port
+// added or removed, an option of the service of a port modified, or a setting
+// of the config such as a node label or an MTU.
+type ConfigChange struct {
+	// Kind is ChangeVIP, ChangePort, ChangeOption or ChangeSetting
+	Kind string `json:"kind"`
+	// Op is ChangeAdded, ChangeRemoved or ChangeModified
+	Op string `json:"op"`
+	// Family is ipv4 or ipv6, for a VIP, port or option
+	Family string `json:"family,omitempty"`
+	VIP    string `json:"vip,omitempty"`
+	Port   string `json:"port,omitempty"`
+	// Field is the JSON path of an option within the service, such as
+	// ipvsOptions.scheduler, or of a setting within the config, such as
+	// labels.zone.
+	Field string `json:"field,omitempty"`
+	// Old and New are the JSON of an option or setting before and after.
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+func (c ConfigChange) String() string {
+	target := c.Field
+	switch c.Kind {
+	case ChangeVIP:
+		target = "vip " + c.VIP
+	case ChangePort:
+		target = "port " + net.JoinHostPort(c.VIP, c.Port)
+	case ChangeOption:
+		target = net.JoinHostPort(c.VIP, c.Port) + " " + c.Field
+	}
+	switch {
+	case c.Kind == ChangeVIP || c.Kind == ChangePort:
+		return c.Op + " " + target
+	case c.Op == ChangeAdded:
+		return fmt.Sprintf("%s %s: %s", c.Op, target, c.New)
+	case c.Op == ChangeRemoved:
+		return fmt.Sprintf("%s %s: %s", c.Op, target, c.Old)
+	}
+	return fmt.Sprintf("%s %s: %s -> %s", c.Op, target, c.Old, c.New)
+}
+
+// Diff returns how new differs from old, in the order of family, VIP, port
+// and field. The ports of a VIP added or removed are left out, as are the
+// options of a port added or removed. A nil config has nothing in it.
+func Diff(old, new *ClusterConfig) []ConfigChange {
+	if old == nil {
+		old = &ClusterConfig{}
+	}
+	if new == nil {
+		new = &ClusterConfig{}
+	}
+	changes := []ConfigChange{}
+	changes = append(changes, diffPortMaps("ipv4", old.Config, new.Config)...)
+	changes = append(changes, diffPortMaps("ipv6", old.Config6, new.Config6)...)
+
+	settings := func(c *ClusterConfig) map[string]interface{} {
+		// the other defaults show in the services and mtus they apply to
+		var communities []string
+		if c.Defaults != nil {
+			communities = c.Defaults.Communities
+		}
+		return map[string]interface{}{
+			"defaults":   map[string][]string{"communities": communities},
+			"vipPool":    c.VIPPool,
+			"labels":     c.NodeLabels,
+			"mtuConfig":  c.MTUConfig,
+			"mtuConfig6": c.MTUConfig6,
+			"ipv6":       c.IPV6,
+			"shards":     c.Shards,
+		}
+	}
+	oldSettings, newSettings := flatten(settings(old)), flatten(settings(new))
+	for _, field := range unionKeys(oldSettings, newSettings) {
+		if change, ok := diffValue(oldSettings, newSettings, field); ok {
+			change.Kind, change.Field = ChangeSetting, field
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+func diffPortMaps(family string, old, new map[ServiceIP]PortMap) []ConfigChange {
+	vips := map[string]bool{}
+	for vip := range old {
+		vips[string(vip)] = true
+	}
+	for vip := range new {
+		vips[string(vip)] = true
+	}
+	sorted := make([]string, 0, len(vips))
+	for vip := range vips {
+		sorted = append(sorted, vip)
+	}
+	sort.Strings(sorted)
+
+	changes := []ConfigChange{}
+	for _, vip := range sorted {
+		oldPorts, inOld := old[ServiceIP(vip)]
+		newPorts, inNew := new[ServiceIP(vip)]
+		switch {
+		case !inOld:
+			changes = append(changes, ConfigChange{Kind: ChangeVIP, Op: ChangeAdded, Family: family, VIP: vip})
+			continue
+		case !inNew:
+			changes = append(changes, ConfigChange{Kind: ChangeVIP, Op: ChangeRemoved, Family: family, VIP: vip})
+			continue
+		}
+
+		ports := []string{}
+		for port := range oldPorts {
+			ports = append(ports, port)
+		}
+		for port := range newPorts {
+			if _, ok := oldPorts[port]; !ok {
+				ports = append(ports, port)
+			}
+		}
+		sort.Slice(ports, func(i, j int) bool {
+			if len(ports[i]) != len(ports[j]) {
+				return len(ports[i]) < len(ports[j])
+			}
+			return ports[i] < ports[j]
+		})
+		for _, port := range ports {
+			oldDef, inOld := oldPorts[port]
+			newDef, inNew := newPorts[port]
+			switch {
+			case !inOld:
+				changes = append(changes, ConfigChange{Kind: ChangePort, Op: ChangeAdded, Family: family, VIP: vip, Port: port})
+				continue
+			case !inNew:
+				changes = append(changes, ConfigChange{Kind: ChangePort, Op: ChangeRemoved, Family: family, VIP: vip, Port: port})
+				continue
+			}
+			oldFields, newFields := flatten(oldDef), flatten(newDef)
+			for _, field := range unionKeys(oldFields, newFields) {
+				if change, ok := diffValue(oldFields, newFields, field); ok {
+					change.Kind, change.Family, change.VIP, change.Port, change.Field = ChangeOption, family, vip, port, field
+					changes = append(changes, change)
+				}
+			}
+		}
+	}
+	return changes
+}
+
+// diffValue returns the change of field between old and new, if it changed.
+func diffValue(old, new map[string]string, field string) (ConfigChange, bool) {
+	o, inOld := old[field]
+	n, inNew := new[field]
+	switch {
+	case !inOld:
+		return ConfigChange{Op: ChangeAdded, New: n}, true
+	case !inNew:
+		return ConfigChange{Op: ChangeRemoved, Old: o}, true
+	case o != n:
+		return ConfigChange{Op: ChangeModified, Old: o, New: n}, true
+	}
+	return ConfigChange{}, false
+}
+
+// flatten returns the JSON values of v by their path, such as
+// ipvsOptions.scheduler. Objects are flattened, and arrays are kept whole.
+// Empty values are left out, so that a field omitted and a field given
+// empty are the same.
+func flatten(v interface{}) map[string]string {
+	out := map[string]string{}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return out
+	}
+	var raw interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return out
+	}
+	var walk func(path string, v interface{})
+	walk = func(path string, v interface{}) {
+		switch value := v.(type) {
+		case map[string]interface{}:
+			for k, child := range value {
+				walk(fieldPath(path, k), child)
+			}
+		case []interface{}:
+			if len(value) == 0 {
+				return
+			}
+			b, _ := json.Marshal(value)
+			out[path] = string(b)
+		default:
+			if value == nil || value == false || value == "" || value == float64(0) {
+				return
+			}
+			b, _ := json.Marshal(value)
+			out[path] = string(b)
+		}
+	}
+	walk("", raw)
+	return out
+}
+
+// fieldPath returns the path of key within the object at path, as
+// labels.zone, or as mtuConfig["10.0.0.1"] for a key that isn't a name.
+func fieldPath(path, key string) string {
+	name := key != ""
+	for i, r := range key {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			name = false
+		}
+	}
+	switch {
+	case !name:
+		return fmt.Sprintf("%s[%q]", path, key)
+	case path == "":
+		return key
+	}
+	return path + "." + key
+}
+
+func unionKeys(a, b map[string]string) []string {
+	keys := make([]string, 0, len(a))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SummarizeChanges counts changes by kind and op, such as
+// "1 vip added, 2 options modified", or returns "" when there are none.
+func SummarizeChanges(changes []ConfigChange) string {
+	type key struct{ kind, op string }
+	counts := map[key]int{}
+	for _, c := range changes {
+		counts[key{c.Kind, c.Op}]++
+	}
+	summary := []string{}
+	for _, kind := range []string{ChangeVIP, ChangePort, ChangeOption, ChangeSetting} {
+		for _, op := range []string{ChangeAdded, ChangeRemoved, ChangeModified} {
+			n := counts[key{kind, op}]
+			if n == 0 {
+				continue
+			}
+			noun := kind
+			if n != 1 {
+				noun += "s"
+			}
+			summary = append(summary, fmt.Sprintf("%d %s %s", n, noun, op))
+		}
+	}
+	return strings.Join(summary, ", ")
+}
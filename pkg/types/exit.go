@@ -0,0 +1,41 @@
+package types
+
+import (
+	"context"
+	"time"
+)
+
+// The on-exit policies decide what a director leaves behind when it stops. A
+// director that is only restarting should leave the node serving, while one
+// that is being decommissioned should take its VIPs with it.
+const (
+	// OnExitPreserve leaves the VIPs, routes and ipvs rules in place
+	OnExitPreserve = "preserve"
+	// OnExitWithdraw withdraws the BGP routes and removes the VIP
+	// addresses, so that traffic stops arriving, but keeps the ipvs rules
+	OnExitWithdraw = "withdraw"
+	// OnExitFullTeardown withdraws, and flushes the ipvs rules and the
+	// director's iptables chain as well
+	OnExitFullTeardown = "full-teardown"
+)
+
+// A worker shuts down in stages within the grace period of the process: it
+// stops applying new configs and waits for the one in progress, drains per
+// its policy, then withdraws and tears down per on-exit. The stages before
+// the teardown leave it the last TeardownTimeout of the grace period, so a
+// slow reconfigure or a long drain window doesn't leave the node half torn
+// down when the process is killed.
+
+// TeardownTimeout bounds the teardown of a worker that stops, and is the part
+// of the shutdown grace period kept for it.
+const TeardownTimeout = 5 * time.Second
+
+// Draining returns a context of a shutdown by ctx for the stages before the
+// teardown, which is done TeardownTimeout before ctx's deadline.
+func Draining(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline.Add(-TeardownTimeout))
+}
@@ -0,0 +1,27 @@
+package types
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDraining(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	draining, cxl := Draining(ctx)
+	defer cxl()
+	deadline, _ := ctx.Deadline()
+	if d, ok := draining.Deadline(); !ok || !d.Equal(deadline.Add(-TeardownTimeout)) {
+		t.Fatalf("expected draining to end %v before %v, got %v", TeardownTimeout, deadline, d)
+	}
+
+	// a grace period shorter than the teardown leaves nothing to drain
+	short, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	draining, cxl = Draining(short)
+	defer cxl()
+	if draining.Err() == nil {
+		t.Fatal("expected no time to drain within a second")
+	}
+}
@@ -0,0 +1,100 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// A key of the configmap may hold its cluster config as YAML, which can have
+// comments and is forgiving of trailing commas, rather than JSON. A key whose
+// first character other than a space is { is JSON, and any other is YAML,
+// converted to the same JSON as the config is loaded.
+
+// ParseError is a key of the configmap that isn't valid JSON or YAML.
+type ParseError struct {
+	Key string
+	// Format is json or yaml
+	Format string
+	// Line and Column are where the error was found, counting from 1, or 0
+	// if unknown. YAML errors have no column.
+	Line, Column int
+	Message      string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("config key '%s' has %s", e.Key, e.Problem())
+}
+
+// Problem describes the error without the key, such as "invalid json at
+// line 3, column 14. invalid character '}' looking for beginning of object
+// key string".
+func (e *ParseError) Problem() string {
+	at := ""
+	switch {
+	case e.Line > 0 && e.Column > 0:
+		at = fmt.Sprintf(" at line %d, column %d", e.Line, e.Column)
+	case e.Line > 0:
+		at = fmt.Sprintf(" at line %d", e.Line)
+	}
+	return fmt.Sprintf("invalid %s%s. %s", e.Format, at, e.Message)
+}
+
+// IsJSON returns whether raw, the config of a key, is given as JSON rather
+// than YAML.
+func IsJSON(raw string) bool {
+	trimmed := bytes.TrimLeft([]byte(raw), " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+// yamlError matches the line of an error from the YAML parser.
+var yamlError = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// ConfigJSON returns the JSON of raw, the config of key, which may be JSON
+// or YAML. It returns a *ParseError if raw doesn't parse.
+func ConfigJSON(key, raw string) ([]byte, error) {
+	if IsJSON(raw) {
+		var v interface{}
+		err := json.Unmarshal([]byte(raw), &v)
+		if syntax, ok := err.(*json.SyntaxError); ok {
+			line, column := position(raw, syntax.Offset)
+			return nil, &ParseError{Key: key, Format: "json", Line: line, Column: column, Message: syntax.Error()}
+		}
+		if err != nil {
+			return nil, &ParseError{Key: key, Format: "json", Message: err.Error()}
+		}
+		return []byte(raw), nil
+	}
+
+	b, err := yaml.ToJSON([]byte(raw))
+	if err != nil {
+		e := &ParseError{Key: key, Format: "yaml", Message: err.Error()}
+		if m := yamlError.FindStringSubmatch(err.Error()); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			e.Message = m[2]
+		}
+		return nil, e
+	}
+	return b, nil
+}
+
+// position returns the line and column of the byte at offset of s, counting
+// from 1. The offset of a JSON syntax error is just past the byte at fault.
+func position(s string, offset int64) (int, int) {
+	if offset > 0 {
+		offset--
+	}
+	line, column := 1, 1
+	for i := 0; i < len(s) && int64(i) < offset; i++ {
+		if s[i] == '\n' {
+			line, column = line+1, 1
+			continue
+		}
+		column++
+	}
+	return line, column
+}
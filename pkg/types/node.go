@@ -11,6 +11,19 @@ import (
 
 const (
 	v6AddrLabelKey = "rdei.io/node-addr-v6"
+
+	// AnnotationRealServerUnhealthy is set by the realserver on its node, to
+	// the faults it found in its own checks, while it can't serve traffic.
+	AnnotationRealServerUnhealthy = "ravel.comcast.com/realserver-unhealthy"
+
+	// AnnotationMaintenance is set by an operator on a node, to the reason
+	// for its maintenance, to drain it out of service.
+	AnnotationMaintenance = "ravel.comcast.com/maintenance"
+
+	// LabelRole pins the role a ravel in auto mode runs on a node, one of
+	// director, bgp, colocated or realserver, or leaves it to the election
+	// of directors when unset or candidate.
+	LabelRole = "ravel.comcast.com/role"
 )
 
 // NodesEqual returns a boolean value indicating whether the contents of the
@@ -112,6 +125,10 @@ func IsEligibleBackend(n *v1.Node, labels map[string]string, ip string, ignoreCo
 		return false, fmt.Sprintf("node %s is not in a ready state.", n.Name)
 	}
 
+	if faults, unhealthy := RealServerUnhealthy(n); unhealthy {
+		return false, fmt.Sprintf("node %s has an unhealthy realserver: %s", n.Name, faults)
+	}
+
 	if !hasLabels(n, labels) {
 		return false, fmt.Sprintf("node %s missing required labels: want: '%v'. saw: '%v'", n.Name, labels, n.Labels)
 	}
@@ -143,6 +160,20 @@ func IsUnschedulable(n *v1.Node) bool {
 	return false
 }
 
+// RealServerUnhealthy returns the faults the realserver of the node reported
+// in its own checks, and whether it reported any.
+func RealServerUnhealthy(n *v1.Node) (string, bool) {
+	faults, ok := n.Annotations[AnnotationRealServerUnhealthy]
+	return faults, ok
+}
+
+// InMaintenance returns the reason an operator put the node in maintenance,
+// and whether it is in maintenance.
+func InMaintenance(n *v1.Node) (string, bool) {
+	reason, ok := n.Annotations[AnnotationMaintenance]
+	return reason, ok
+}
+
 func IsInReadyState(n *v1.Node) bool {
 	isReady := false
 	for _, c := range n.Status.Conditions {
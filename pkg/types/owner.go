@@ -0,0 +1,8 @@
+package types
+
+// Owner is the tag that marks the VIP devices, ipvs services and iptables
+// chains of the Ravel instance serving configKey, so that instances of
+// different config keys can share a node without removing each other's.
+func Owner(configKey string) string {
+	return "ravel/" + configKey
+}
@@ -0,0 +1,121 @@
+package types
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A port of the config can be given as a range, such as 30000-30100, for
+// protocols such as SIP and RTP that need a block of contiguous ports. The
+// service of a range applies to every port in it, and is expanded into a
+// service of each port when the config is loaded, with PortRange set. A
+// port given on its own as well replaces the range's service of it, and of
+// ranges that overlap the narrower one applies. Ranges are only supported in
+// config, as the v6 listeners forward to the port of the service's PortName.
+
+// MaxPortRange is the most ports a range may expand into.
+const MaxPortRange = 1024
+
+// IsPortRange returns whether port is given as a range.
+func IsPortRange(port string) bool {
+	return strings.Contains(port, "-")
+}
+
+// ExpandPortRange returns the ports of r, in order.
+func ExpandPortRange(r string) ([]string, error) {
+	parts := strings.SplitN(r, "-", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%q is not a range of ports", r)
+	}
+	first, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	last, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+	switch {
+	case err1 != nil || err2 != nil || first < 1 || last > 65535:
+		return nil, fmt.Errorf("%q is not a range of ports from 1 to 65535", r)
+	case first >= last:
+		return nil, fmt.Errorf("%q does not end after it starts", r)
+	case last-first+1 > MaxPortRange:
+		return nil, fmt.Errorf("%q has more than %d ports", r, MaxPortRange)
+	}
+	ports := make([]string, 0, last-first+1)
+	for port := first; port <= last; port++ {
+		ports = append(ports, strconv.Itoa(port))
+	}
+	return ports, nil
+}
+
+// ExpandPortRanges replaces the port ranges of the config of c with the
+// ports they expand into.
+func (c *ClusterConfig) ExpandPortRanges() error {
+	for vip, ports := range c.Config6 {
+		for port := range ports {
+			if IsPortRange(port) {
+				return fmt.Errorf("config6: %s has port range %s. port ranges are only supported in config", vip, port)
+			}
+		}
+	}
+	for vip, ports := range c.Config {
+		expanded, err := expandPorts(ports)
+		if err != nil {
+			return fmt.Errorf("config: %s: %v", vip, err)
+		}
+		c.Config[vip] = expanded
+	}
+	return nil
+}
+
+// expandPorts returns ports with its ranges expanded, applying the widest
+// ranges first and ports given on their own last.
+func expandPorts(ports PortMap) (PortMap, error) {
+	type portRange struct {
+		key   string
+		ports []string
+	}
+	ranges := []portRange{}
+	for key := range ports {
+		if !IsPortRange(key) {
+			continue
+		}
+		expanded, err := ExpandPortRange(key)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, portRange{key, expanded})
+	}
+	if len(ranges) == 0 {
+		return ports, nil
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		if len(ranges[i].ports) != len(ranges[j].ports) {
+			return len(ranges[i].ports) > len(ranges[j].ports)
+		}
+		return ranges[i].key < ranges[j].key
+	})
+
+	out := make(PortMap, len(ports))
+	for _, r := range ranges {
+		def := ports[r.key]
+		for _, port := range r.ports {
+			if def == nil {
+				out[port] = nil
+				continue
+			}
+			copied := *def
+			copied.PortRange = r.key
+			out[port] = &copied
+		}
+	}
+	for port, def := range ports {
+		if IsPortRange(port) {
+			continue
+		}
+		// the port may be written other than the range writes it
+		if n, err := strconv.Atoi(port); err == nil && strconv.Itoa(n) != port {
+			delete(out, strconv.Itoa(n))
+		}
+		out[port] = def
+	}
+	return out, nil
+}
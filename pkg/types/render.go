@@ -0,0 +1,234 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// A cluster config can be written as an overlay of another key of its
+// configmap, such as one key per environment over a key they share, and
+// can give the options its services have in common once, as defaults:
+//
+//	"prod": {
+//	    "base": "common",
+//	    "defaults": {"service": {"tcpEnabled": true, "ipvsOptions": {"scheduler": "mh"}}, "mtu": "9000"},
+//	    "config": {"10.54.0.1": {"443": {"namespace": "web", "service": "web", "portName": "https"}}}
+//	}
+//
+// The config of a key is merged over the config of its base, itself merged
+// over its own base, as a JSON merge patch: objects are merged, other values
+// replace those of the base, and null removes them. The service of defaults
+// is then merged under the service of every port of config and config6, so
+// that a port sets only what differs from it and null clears a default, even
+// from an overlay. The mtu of defaults applies to the VIPs without one in
+// mtuConfig or mtuConfig6 once blocks are expanded, so that the VIPs of a
+// block with an mtu have the block's.
+
+// maxBases bounds the chain of bases of a config.
+const maxBases = 8
+
+// Defaults are what the services and VIPs of a config have unless they
+// say otherwise.
+type Defaults struct {
+	// Service is merged under the service of every port.
+	Service *ServiceDef `json:"service,omitempty"`
+	// MTU is the mtu of the VIPs without one in mtuConfig or mtuConfig6,
+	// of their own or of their block.
+	MTU string `json:"mtu,omitempty"`
+	// Communities are what bgp directors announce the VIPs with, in place
+	// of --bgp-communities.
+	Communities []string `json:"communities,omitempty"`
+}
+
+// RenderConfig returns the JSON of the cluster config of key in data, the
+// data of a configmap, merged over its bases and with its defaults applied.
+func RenderConfig(data map[string]string, key string) ([]byte, error) {
+	doc, err := resolveBase(data, key, []string{})
+	if err != nil {
+		return nil, err
+	}
+	applyDefaults(doc)
+	return json.Marshal(doc)
+}
+
+// resolveBase returns the config of key merged over its bases. chain is the
+// keys that have key as their base, to find a cycle.
+func resolveBase(data map[string]string, key string, chain []string) (map[string]interface{}, error) {
+	raw, ok := data[key]
+	switch {
+	case !ok && len(chain) == 0:
+		return nil, fmt.Errorf("config key '%s' not found in configmap", key)
+	case !ok:
+		return nil, fmt.Errorf("base '%s' of '%s' is not a key of the configmap", key, chain[len(chain)-1])
+	}
+	b, err := ConfigJSON(key, raw)
+	if err != nil {
+		return nil, err
+	}
+	doc := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("config key '%s' is not an object. %v", key, err)
+	}
+	base, ok := doc["base"].(string)
+	if !ok || base == "" {
+		return doc, nil
+	}
+	chain = append(chain, key)
+	for _, k := range chain {
+		if k == base {
+			return nil, fmt.Errorf("base '%s' of '%s' has it as a base in turn", base, key)
+		}
+	}
+	if len(chain) > maxBases {
+		return nil, fmt.Errorf("'%s' has more than %d bases", chain[0], maxBases)
+	}
+	under, err := resolveBase(data, base, chain)
+	if err != nil {
+		return nil, err
+	}
+	return mergeConfig(under, doc), nil
+}
+
+// mergeConfig merges the config over under as mergePatch does, except that
+// the nulls of the services of its ports are kept, to clear defaults once
+// they are applied.
+func mergeConfig(under, over map[string]interface{}) map[string]interface{} {
+	for k, v := range over {
+		vips, ok := v.(map[string]interface{})
+		if !ok || k != "config" && k != "config6" {
+			if v == nil {
+				delete(under, k)
+				continue
+			}
+			under[k] = mergePatch(under[k], v, false)
+			continue
+		}
+		base, ok := under[k].(map[string]interface{})
+		if !ok {
+			base = map[string]interface{}{}
+		}
+		for vip, v := range vips {
+			ports, ok := v.(map[string]interface{})
+			if !ok {
+				if v == nil {
+					delete(base, vip)
+				} else {
+					base[vip] = v
+				}
+				continue
+			}
+			basePorts, ok := base[vip].(map[string]interface{})
+			if !ok {
+				basePorts = map[string]interface{}{}
+			}
+			for port, def := range ports {
+				if def == nil {
+					delete(basePorts, port)
+					continue
+				}
+				basePorts[port] = mergePatch(basePorts[port], def, true)
+			}
+			base[vip] = basePorts
+		}
+		under[k] = base
+	}
+	return under
+}
+
+// applyDefaults merges the service of the defaults of doc, a config, under
+// its services.
+func applyDefaults(doc map[string]interface{}) {
+	defaults, ok := doc["defaults"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	service, ok := defaults["service"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	for _, section := range []string{"config", "config6"} {
+		vips, _ := doc[section].(map[string]interface{})
+		for _, v := range vips {
+			ports, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for port, def := range ports {
+				if def, ok := def.(map[string]interface{}); ok {
+					ports[port] = mergePatch(copyJSON(service), def, false)
+				}
+			}
+		}
+	}
+}
+
+// applyDefaultMTU gives the VIPs of c without an mtu the mtu of its
+// defaults. It is called once blocks are expanded.
+func (c *ClusterConfig) applyDefaultMTU() {
+	if c.Defaults == nil || c.Defaults.MTU == "" {
+		return
+	}
+	for _, section := range []struct {
+		config map[ServiceIP]PortMap
+		mtus   *map[ServiceIP]string
+	}{{c.Config, &c.MTUConfig}, {c.Config6, &c.MTUConfig6}} {
+		if len(section.config) == 0 {
+			continue
+		}
+		if *section.mtus == nil {
+			*section.mtus = map[ServiceIP]string{}
+		}
+		for vip := range section.config {
+			if _, ok := (*section.mtus)[vip]; !ok {
+				(*section.mtus)[vip] = c.Defaults.MTU
+			}
+		}
+	}
+}
+
+// mergePatch applies patch to target as a JSON merge patch, RFC 7386, and
+// returns the result. target may be changed. keepNulls sets the fields patch
+// has as null to null, rather than removing them.
+func mergePatch(target, patch interface{}, keepNulls bool) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		switch {
+		case v == nil && keepNulls:
+			t[k] = nil
+		case v == nil:
+			delete(t, k)
+		default:
+			t[k] = mergePatch(t[k], v, keepNulls)
+		}
+	}
+	return t
+}
+
+// copyJSON returns a deep copy of v, decoded JSON.
+func copyJSON(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(value))
+		for k, child := range value {
+			out[k] = copyJSON(child)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(value))
+		for i, child := range value {
+			out[i] = copyJSON(child)
+		}
+		return out
+	}
+	return v
+}
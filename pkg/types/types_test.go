@@ -2,6 +2,7 @@ package types
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 
 	"k8s.io/api/core/v1"
@@ -26,3 +27,243 @@ func TestConfigDataConvert(t *testing.T) {
 
 	fmt.Printf("clusterConfig: %v", clusterConfig)
 }
+
+func TestExpandBlocks(t *testing.T) {
+	config := &v1.ConfigMap{Data: map[string]string{"green": `{
+		"vipPool": ["10.54.0.0/30", "10.54.1.1"],
+		"config": {
+			"10.54.0.0/30": {
+				"80": {"namespace": "web", "service": "web", "portName": "http"},
+				"443": {"namespace": "web", "service": "web", "portName": "https"}
+			},
+			"10.54.0.2/31": {"80": {"namespace": "web", "service": "api", "portName": "http"}},
+			"10.54.0.3": {"443": {"namespace": "web", "service": "admin", "portName": "https"}}
+		},
+		"config6": {"2001:db8::/126": {"80": {"namespace": "web", "service": "web", "portName": "http"}}}
+	}`}}
+	c, err := NewClusterConfig(config, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(c.VIPPool) != "[10.54.0.0 10.54.0.1 10.54.0.2 10.54.0.3 10.54.1.1]" {
+		t.Fatalf("expected the pool expanded. saw %v", c.VIPPool)
+	}
+	if len(c.Config) != 4 || len(c.Config6) != 4 {
+		t.Fatalf("expected 4 VIPs of each family. saw %d and %d", len(c.Config), len(c.Config6))
+	}
+	for vip, want := range map[ServiceIP][2]string{
+		"10.54.0.0": {"web", "web"},
+		"10.54.0.2": {"api", "web"},
+		// a VIP given on its own replaces the services of its ports
+		"10.54.0.3": {"api", "admin"},
+	} {
+		if got := [2]string{c.Config[vip]["80"].Service, c.Config[vip]["443"].Service}; got != want {
+			t.Errorf("expected %s to have %v. saw %v", vip, want, got)
+		}
+	}
+	if c.Config["10.54.0.0"]["80"] == c.Config["10.54.0.1"]["80"] {
+		t.Fatal("expected each VIP to have its own services")
+	}
+
+	// the default mtu and that of a block apply to each of its VIPs, even
+	// those given on their own
+	config.Data["green"] = `{
+		"defaults": {"mtu": "9000"},
+		"mtuConfig": {"10.54.1.0/30": "1500", "10.54.1.1": "4000"},
+		"config": {
+			"10.54.0.0/30": {"80": {"namespace": "web", "service": "web", "portName": "http"}},
+			"10.54.1.0/30": {"80": {"namespace": "web", "service": "api", "portName": "http"}},
+			"10.54.1.2": {"443": {"namespace": "web", "service": "api", "portName": "https"}}
+		}
+	}`
+	if c, err = NewClusterConfig(config, "green"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[ServiceIP]string{
+		"10.54.0.0": "9000", "10.54.0.1": "9000", "10.54.0.2": "9000", "10.54.0.3": "9000",
+		"10.54.1.0": "1500", "10.54.1.1": "4000", "10.54.1.2": "1500", "10.54.1.3": "1500",
+	}
+	if !reflect.DeepEqual(c.MTUConfig, want) {
+		t.Fatalf("expected the mtus of the blocks expanded. saw %v", c.MTUConfig)
+	}
+
+	for _, block := range []string{"10.54.0.1/30", "10.54.0.0/23", "10.54.0.0", "2001:db8::/64"} {
+		if _, err := ExpandBlock(block); err == nil {
+			t.Errorf("expected %s to be refused", block)
+		}
+	}
+}
+
+func TestExpandPortRanges(t *testing.T) {
+	config := &v1.ConfigMap{Data: map[string]string{"green": `{
+		"config": {
+			"10.54.0.1": {
+				"30000-30009": {"namespace": "voice", "service": "rtp", "portName": "rtp", "udpEnabled": true},
+				"30004-30005": {"namespace": "voice", "service": "rtp2", "portName": "rtp", "udpEnabled": true},
+				"30009": {"namespace": "voice", "service": "sip", "portName": "sip", "tcpEnabled": true}
+			}
+		}
+	}`}}
+	c, err := NewClusterConfig(config, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports := c.Config["10.54.0.1"]
+	if len(ports) != 10 {
+		t.Fatalf("expected 10 ports. saw %d", len(ports))
+	}
+	for port, want := range map[string][2]string{
+		"30000": {"rtp", "30000-30009"},
+		"30005": {"rtp2", "30004-30005"},
+		"30009": {"sip", ""},
+	} {
+		if got := [2]string{ports[port].Service, ports[port].PortRange}; got != want {
+			t.Errorf("expected %s to have %v. saw %v", port, want, got)
+		}
+	}
+
+	for _, r := range []string{"30000", "30010-30000", "0-10", "1-2000", "a-b"} {
+		if _, err := ExpandPortRange(r); err == nil {
+			t.Errorf("expected %s to be refused", r)
+		}
+	}
+	config.Data["green"] = `{"config6": {"2001:db8::1": {"5000-5001": {"namespace": "voice", "service": "rtp", "portName": "rtp"}}}}`
+	if _, err := NewClusterConfig(config, "green"); err == nil {
+		t.Fatal("expected a port range in config6 to be refused")
+	}
+}
+
+func TestRenderConfig(t *testing.T) {
+	config := &v1.ConfigMap{Data: map[string]string{
+		"common": `{
+			"defaults": {"service": {"tcpEnabled": true, "ipvsOptions": {"scheduler": "mh", "flags": "mh-port"}}, "mtu": "9000"},
+			"config": {
+				"10.54.0.1": {"80": {"namespace": "web", "service": "web", "portName": "http"}},
+				"10.54.0.2": {"80": {"namespace": "api", "service": "api", "portName": "http"}}
+			}
+		}`,
+		"prod": `{
+			"base": "common",
+			"defaults": {"communities": ["65000:100"]},
+			"mtuConfig": {"10.54.0.2": "1500"},
+			"config": {
+				"10.54.0.1": {"443": {"namespace": "web", "service": "web", "portName": "https", "ipvsOptions": {"scheduler": "sh", "flags": null}}},
+				"10.54.0.2": null
+			}
+		}`,
+	}}
+	c, err := NewClusterConfig(config, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Config["10.54.0.2"]; ok {
+		t.Error("expected the overlay to remove 10.54.0.2")
+	}
+	ports := c.Config["10.54.0.1"]
+	if len(ports) != 2 {
+		t.Fatalf("expected the ports of the base and the overlay. saw %v", ports)
+	}
+	for port, want := range map[string][3]string{
+		"80":  {"http", "mh", "mh-port"},
+		"443": {"https", "sh", ""},
+	} {
+		def := ports[port]
+		if got := [3]string{def.PortName, def.IPVSOptions.RawScheduler, def.IPVSOptions.Flags}; got != want || !def.TCPEnabled {
+			t.Errorf("expected %s to have %v with tcp. saw %v, tcp %v", port, want, got, def.TCPEnabled)
+		}
+	}
+	if c.MTUConfig["10.54.0.1"] != "9000" {
+		t.Errorf("expected the default mtu. saw %v", c.MTUConfig)
+	}
+	if c.Defaults == nil || len(c.Defaults.Communities) != 1 || c.Defaults.Service == nil {
+		t.Errorf("expected the defaults of the base and the overlay. saw %+v", c.Defaults)
+	}
+
+	for name, data := range map[string]map[string]string{
+		"a cycle":        {"prod": `{"base": "staging"}`, "staging": `{"base": "prod"}`},
+		"a missing base": {"prod": `{"base": "common"}`},
+	} {
+		if _, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "prod"); err == nil {
+			t.Errorf("expected %s to be refused", name)
+		}
+	}
+}
+
+func TestConfigJSON(t *testing.T) {
+	config := &v1.ConfigMap{Data: map[string]string{
+		"json": `{"config": {"10.54.0.1": {"80": {"namespace": "web", "service": "web", "portName": "http", "tcpEnabled": true}}}}`,
+		"yaml": `
+# the web VIP
+config:
+  10.54.0.1:
+    80: {namespace: web, service: web, portName: http, tcpEnabled: true,}
+`,
+	}}
+	fromJSON, err := NewClusterConfig(config, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromYAML, err := NewClusterConfig(config, "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes := Diff(fromJSON, fromYAML); len(changes) > 0 {
+		t.Errorf("expected the yaml to load as the json does. saw %v", changes)
+	}
+
+	for raw, want := range map[string]string{
+		"{\n  \"config\": {},\n}":      "config key 'k' has invalid json at line 3, column 1. invalid character '}' looking for beginning of object key string",
+		"config:\n  a: 1\n  b: c: 2\n": "config key 'k' has invalid yaml at line 3. mapping values are not allowed in this context",
+	} {
+		_, err := ConfigJSON("k", raw)
+		if err == nil || err.Error() != want {
+			t.Errorf("expected %q. saw %v", want, err)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := &ClusterConfig{
+		NodeLabels: map[string]string{"zone": "a"},
+		MTUConfig:  map[ServiceIP]string{"10.0.0.1": "9000"},
+		Config: map[ServiceIP]PortMap{
+			"10.0.0.1": {
+				"80":  &ServiceDef{Namespace: "ns", Service: "web", PortName: "http", TCPEnabled: true},
+				"443": &ServiceDef{Namespace: "ns", Service: "web", PortName: "https", TCPEnabled: true},
+			},
+			"10.0.0.2": {"80": &ServiceDef{Namespace: "ns", Service: "api", PortName: "http"}},
+		},
+	}
+	new := &ClusterConfig{
+		NodeLabels: map[string]string{"zone": "b"},
+		Config: map[ServiceIP]PortMap{
+			"10.0.0.1": {
+				"80":   &ServiceDef{Namespace: "ns", Service: "web", PortName: "http", TCPEnabled: true, IPVSOptions: IPVSOptions{RawScheduler: "mh"}},
+				"8080": &ServiceDef{Namespace: "ns", Service: "web", PortName: "alt"},
+			},
+		},
+		Config6: map[ServiceIP]PortMap{"2001:db8::1": {}},
+	}
+	got := []string{}
+	for _, c := range Diff(old, new) {
+		got = append(got, c.String())
+	}
+	expected := []string{
+		`added 10.0.0.1:80 ipvsOptions.scheduler: "mh"`,
+		`removed port 10.0.0.1:443`,
+		`added port 10.0.0.1:8080`,
+		`removed vip 10.0.0.2`,
+		`added vip 2001:db8::1`,
+		`modified labels.zone: "a" -> "b"`,
+		`removed mtuConfig["10.0.0.1"]: "9000"`,
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected\n%q\ngot\n%q", expected, got)
+	}
+	if s := SummarizeChanges(Diff(old, new)); s != "1 vip added, 1 vip removed, 1 port added, 1 port removed, 1 option added, 1 setting removed, 1 setting modified" {
+		t.Fatalf("unexpected summary %q", s)
+	}
+	if len(Diff(old, old)) != 0 {
+		t.Fatal("expected no changes between a config and itself")
+	}
+}
@@ -22,6 +22,8 @@ import (
 	osexec "os/exec"
 	"syscall"
 	"time"
+
+	"github.com/Comcast/Ravel/pkg/privsep"
 )
 
 // ErrExecutableNotFound is returned if the executable is not found.
@@ -66,7 +68,8 @@ type ExitError interface {
 // Implements Interface in terms of really exec()ing.
 type executor struct{}
 
-// New returns a new Interface which will os/exec to run commands.
+// New returns a new Interface which will os/exec to run commands, through
+// the privileged helper if the process uses one.
 func New() Interface {
 	return &executor{}
 }
@@ -77,12 +80,12 @@ func (executor *executor) Command(cmd string, args ...string) Cmd {
 	// a context is not safe
 	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second*30)
 	defer ctxCancel()
-	return (*cmdWrapper)(osexec.CommandContext(ctx, cmd, args...))
+	return (*cmdWrapper)(privsep.CommandContext(ctx, cmd, args...))
 }
 
 // CommandContext is part of the Interface interface.
 func (executor *executor) CommandContext(ctx context.Context, cmd string, args ...string) Cmd {
-	return (*cmdWrapper)(osexec.CommandContext(ctx, cmd, args...))
+	return (*cmdWrapper)(privsep.CommandContext(ctx, cmd, args...))
 }
 
 // LookPath is part of the Interface interface
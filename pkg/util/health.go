@@ -4,32 +4,91 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
-	"os/exec"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/privsep"
 )
 
-// listens on a port and returns a set of information about the health of the system
-func ListenForHealth(primaryInterface string, port int, logger logrus.FieldLogger) {
-	logger.Infof("initializing /health handler on port %d", port)
+// ListenForHealth listens on a port and serves the health of the system, as
+// HealthHandler does.
+func ListenForHealth(primaryInterface string, port int, checks *health.Registry, logger logging.Logger) {
+	logger.Infof("initializing health handlers on port %d", port)
 
-	http.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
+	err := http.ListenAndServe(fmt.Sprintf(":%d", port), HealthHandler(primaryInterface, checks, logger))
+	if err != nil {
+		logger.Error("running without health checks")
+	}
+}
+
+// ListenForHealthSocket serves handler on a unix socket at path until ctx is
+// done, so that sidecars and commands on the node can query the health of
+// the system without a port open on the host. The socket is replaced if one
+// was left behind, and only the user and group of the process may use it.
+func ListenForHealthSocket(ctx context.Context, path string, handler http.Handler, logger logging.Logger) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("unable to create the directory of status socket %s: %v", path, err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to replace status socket %s: %v", path, err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("unable to listen on status socket %s: %v", path, err)
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return fmt.Errorf("unable to set the mode of status socket %s: %v", path, err)
+	}
+	logger.Infof("serving health and status on %s", path)
+
+	srv := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("status socket server exited with error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// HealthHandler serves the health of the system.
+//
+//	/health   a dump of the ipvs, iptables and interface state
+//	/healthz  process liveness
+//	/readyz   200 when every check in checks is ready, 503 otherwise
+//	/statusz  JSON detail for every check in checks
+func HealthHandler(primaryInterface string, checks *health.Registry, logger logging.Logger) *http.ServeMux {
+	// a private mux keeps anything registered on the default mux, like
+	// net/http/pprof, off of this public listener.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
 		start := time.Now()
 		defer func() {
-			logger.Info("request completed in %v", time.Since(start))
+			logger.Infof("request completed in %v", time.Since(start))
 		}()
-		data := health(primaryInterface, logger)
+		data := healthDump(primaryInterface, logger)
 		b, _ := json.MarshalIndent(data, " ", " ")
 		w.Write(b)
 	})
-
-	err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
-	if err != nil {
-		logger.Error("running without health checks")
+	if checks == nil {
+		checks = health.NewRegistry()
 	}
+	mux.Handle("/healthz", checks.LivenessHandler())
+	mux.Handle("/readyz", checks.ReadinessHandler())
+	mux.Handle("/statusz", checks.StatusHandler())
+	return mux
 }
 
 type healthData struct {
@@ -41,7 +100,7 @@ type healthData struct {
 	Errors []string `json:"errors,omitempty"`
 }
 
-func health(primaryInterface string, logger logrus.FieldLogger) *healthData {
+func healthDump(primaryInterface string, logger logging.Logger) *healthData {
 	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Minute)
 	defer ctxCancel()
 
@@ -52,14 +111,14 @@ func health(primaryInterface string, logger logrus.FieldLogger) *healthData {
 	}
 
 	// what are the ipvsadm rules?
-	out, err := exec.CommandContext(ctx, "ipvsadm").Output()
+	out, err := privsep.CommandContext(ctx, "ipvsadm").Output()
 	if err != nil {
 		h.Errors = append(h.Errors, err.Error())
 	}
 	h.IPVS = strings.Split(string(out), "\n")
 
 	// what are the iptables rules?
-	out, err = exec.CommandContext(ctx, "iptables", "-w", "-t", "nat", "-S", "RDEI-LB").Output()
+	out, err = privsep.CommandContext(ctx, "iptables", "-w", "-t", "nat", "-S", "RDEI-LB").Output()
 	if err != nil {
 		h.Errors = append(h.Errors, err.Error())
 	}
@@ -67,7 +126,7 @@ func health(primaryInterface string, logger logrus.FieldLogger) *healthData {
 
 	// what are the interface rules
 	for _, iface := range []string{"lo", primaryInterface} {
-		out, err = exec.CommandContext(ctx, "ip", "addr", "show", "dev", iface).Output()
+		out, err = privsep.CommandContext(ctx, "ip", "addr", "show", "dev", iface).Output()
 		if err != nil {
 			h.Errors = append(h.Errors, err.Error())
 		}
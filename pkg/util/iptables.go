@@ -28,11 +28,11 @@ import (
 	"github.com/coreos/go-semver/semver"
 	"github.com/golang/glog"
 
+	log "github.com/Comcast/Ravel/pkg/logging"
 	utildbus "github.com/Comcast/Ravel/pkg/util/dbus"
 	utilexec "github.com/Comcast/Ravel/pkg/util/exec"
 	sets "github.com/Comcast/Ravel/pkg/util/sets"
 	godbus "github.com/godbus/dbus"
-	log "github.com/sirupsen/logrus"
 )
 
 type RulePosition string
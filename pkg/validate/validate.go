@@ -0,0 +1,705 @@
+package validate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/Comcast/Ravel/pkg/haproxy"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// Parsing a cluster config works around what is wrong with it: an unknown
+// scheduler becomes wrr, an invalid listener setting is dropped, a VIP given
+// twice keeps one of its definitions. Validating is stricter, for catching
+// those mistakes before the config is applied. A running director or
+// realserver rejects a config with problems unless --strict-config=false.
+// Each problem is reported at the path of the JSON it was found in, such as
+// config["10.0.0.1"]["80"].ipvsOptions.scheduler.
+
+// Problem is something wrong with a cluster config.
+type Problem struct {
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Path == "" {
+		return p.Message
+	}
+	return p.Path + ": " + p.Message
+}
+
+// Error is a cluster config that failed validation.
+type Error struct {
+	Problems []Problem
+}
+
+func (e *Error) Error() string {
+	out := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		out = append(out, p.String())
+	}
+	noun := "problems"
+	if len(out) == 1 {
+		noun = "problem"
+	}
+	return fmt.Sprintf("invalid cluster config with %d %s. %s", len(out), noun, strings.Join(out, "; "))
+}
+
+// schedulers are the ipvs schedulers that services may use.
+var schedulers = map[string]bool{"rr": true, "wrr": true, "lc": true, "wlc": true, "dh": true, "sh": true, "mh": true}
+
+// schedulerFlags are the flags of virtual services, with the scheduler each
+// is for, or blank for any.
+var schedulerFlags = map[string]string{
+	"flag-1":      "",
+	"flag-2":      "",
+	"flag-3":      "",
+	"sh-fallback": "sh",
+	"sh-port":     "sh",
+	"mh-fallback": "mh",
+	"mh-port":     "mh",
+}
+
+// Config validates the JSON of a cluster config. It returns the config, or
+// nil if it doesn't parse, and every problem found.
+func Config(data []byte) (*types.ClusterConfig, []Problem) {
+	return Key(map[string]string{"": string(data)}, "")
+}
+
+// Key validates the cluster config of key in data, the data of a configmap,
+// as it is after merging it over its bases and applying its defaults. The
+// JSON of the key itself is checked for duplicate and unknown fields.
+func Key(data map[string]string, key string) (*types.ClusterConfig, []Problem) {
+	b, err := types.ConfigJSON(key, data[key])
+	var parse *types.ParseError
+	if errors.As(err, &parse) {
+		return nil, []Problem{{Message: parse.Problem()}}
+	}
+	var problems []Problem
+	if types.IsJSON(data[key]) {
+		problems = duplicates(b)
+	} else {
+		problems = yamlDuplicates(data[key])
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, append(problems, Problem{Message: fmt.Sprintf("invalid json. %v", err)})
+	}
+	if _, ok := raw.(map[string]interface{}); !ok && raw != nil {
+		return nil, append(problems, Problem{Message: "is not an object"})
+	}
+	problems = append(problems, unknown("", raw, reflect.TypeOf(types.ClusterConfig{}))...)
+
+	rendered, err := types.RenderConfig(data, key)
+	if err != nil {
+		return nil, append(problems, Problem{"base", err.Error()})
+	}
+	c := &types.ClusterConfig{}
+	if err := json.Unmarshal(rendered, c); err != nil {
+		return nil, append(problems, Problem{Message: fmt.Sprintf("invalid cluster config. %v", err)})
+	}
+	problems = append(problems, check(c)...)
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Path < problems[j].Path })
+	return c, problems
+}
+
+// Check validates the JSON of a cluster config, returning an *Error with
+// every problem found, or nil if it has none.
+func Check(data []byte) error {
+	return CheckKey(map[string]string{"": string(data)}, "")
+}
+
+// CheckKey validates the cluster config of key in data as Key does,
+// returning an *Error with every problem found, or nil if it has none.
+func CheckKey(data map[string]string, key string) error {
+	if _, problems := Key(data, key); len(problems) > 0 {
+		return &Error{Problems: problems}
+	}
+	return nil
+}
+
+// Services checks that the services the config refers to exist, and have the
+// ports it names. lookup returns a service, or nil if it doesn't exist.
+func Services(c *types.ClusterConfig, lookup func(namespace, name string) (*v1.Service, error)) ([]Problem, error) {
+	type ref struct {
+		path                         string
+		namespace, service, portName string
+	}
+	refs := []ref{}
+	for _, section := range []struct {
+		name   string
+		config map[types.ServiceIP]types.PortMap
+	}{{"config", c.Config}, {"config6", c.Config6}} {
+		for _, vip := range sortedVIPs(section.config) {
+			ports := section.config[vip]
+			for _, port := range sortedPorts(ports) {
+				def := ports[port]
+				if def == nil {
+					continue
+				}
+				path := join(join(section.name, string(vip)), port)
+				refs = append(refs, ref{path, def.Namespace, def.Service, def.PortName})
+				for i, route := range def.Routes {
+					refs = append(refs, ref{fmt.Sprintf("%s.routes[%d]", path, i), route.Namespace, route.Service, route.PortName})
+				}
+			}
+		}
+	}
+
+	problems := []Problem{}
+	services := map[string]*v1.Service{}
+	for _, r := range refs {
+		if r.namespace == "" || r.service == "" {
+			continue
+		}
+		key := r.namespace + "/" + r.service
+		svc, ok := services[key]
+		if !ok {
+			var err error
+			if svc, err = lookup(r.namespace, r.service); err != nil {
+				return nil, fmt.Errorf("unable to get service %s. %v", key, err)
+			}
+			services[key] = svc
+		}
+		if svc == nil {
+			problems = append(problems, Problem{r.path, fmt.Sprintf("service %s doesn't exist", key)})
+			continue
+		}
+		found := false
+		names := []string{}
+		for _, p := range svc.Spec.Ports {
+			found = found || p.Name == r.portName
+			names = append(names, strconv.Quote(p.Name))
+		}
+		if !found {
+			problems = append(problems, Problem{r.path, fmt.Sprintf("service %s has no port named %q, only %s", key, r.portName, strings.Join(names, ", "))})
+		}
+	}
+	return problems, nil
+}
+
+// identifier matches keys that a path gives as a field rather than an index.
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// join returns the path of key within the object at path.
+func join(path, key string) string {
+	if !identifier.MatchString(key) {
+		return fmt.Sprintf("%s[%q]", path, key)
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// duplicates finds keys given more than once in an object, of which json
+// keeps the last silently.
+func duplicates(data []byte) []Problem {
+	problems := []Problem{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var walk func(path string) error
+	walk = func(path string) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			seen := map[string]bool{}
+			for dec.More() {
+				tok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key, _ := tok.(string)
+				child := join(path, key)
+				if seen[key] {
+					problems = append(problems, Problem{child, "is given more than once, and only the last is used"})
+				}
+				seen[key] = true
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		default:
+			return nil
+		}
+		// the closing delimiter
+		_, err = dec.Token()
+		return err
+	}
+	// invalid json is reported by decoding it
+	walk("")
+	return problems
+}
+
+// yamlDuplicates finds keys given more than once in a mapping of the YAML of
+// a config, of which the last is used.
+func yamlDuplicates(data string) []Problem {
+	problems := []Problem{}
+	var walk func(path string, v interface{})
+	walk = func(path string, v interface{}) {
+		switch value := v.(type) {
+		case yaml.MapSlice:
+			seen := map[string]bool{}
+			for _, item := range value {
+				key := fmt.Sprint(item.Key)
+				child := join(path, key)
+				if seen[key] {
+					problems = append(problems, Problem{child, "is given more than once, and only the last is used"})
+				}
+				seen[key] = true
+				walk(child, item.Value)
+			}
+		case []interface{}:
+			for i, item := range value {
+				walk(fmt.Sprintf("%s[%d]", path, i), item)
+			}
+		}
+	}
+	// invalid yaml is reported by converting it
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(data), &doc); err == nil {
+		walk("", doc)
+	}
+	return problems
+}
+
+// unknown finds the fields of raw, the decoded json of a t, that t doesn't
+// have. They are most often misspellings, which json ignores.
+func unknown(path string, raw interface{}, t reflect.Type) []Problem {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	problems := []Problem{}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if f.Anonymous || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			fields[strings.ToLower(name)] = f.Type
+		}
+		for _, key := range sortedKeys(obj) {
+			// json matches fields regardless of case
+			ft, ok := fields[strings.ToLower(key)]
+			if !ok {
+				problems = append(problems, Problem{join(path, key), "is not a known field"})
+				continue
+			}
+			problems = append(problems, unknown(join(path, key), obj[key], ft)...)
+		}
+	case reflect.Map:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for _, key := range sortedKeys(obj) {
+			problems = append(problems, unknown(join(path, key), obj[key], t.Elem())...)
+		}
+	case reflect.Slice:
+		arr, ok := raw.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, v := range arr {
+			problems = append(problems, unknown(fmt.Sprintf("%s[%d]", path, i), v, t.Elem())...)
+		}
+	}
+	return problems
+}
+
+// check validates the values of a config.
+func check(c *types.ClusterConfig) []Problem {
+	problems := []Problem{}
+	add := func(path, format string, args ...interface{}) {
+		problems = append(problems, Problem{path, fmt.Sprintf(format, args...)})
+	}
+
+	for i, vip := range c.VIPPool {
+		if types.IsBlock(vip) {
+			if _, err := types.ExpandBlock(vip); err != nil {
+				add(fmt.Sprintf("vipPool[%d]", i), "%v", err)
+			}
+			continue
+		}
+		if net.ParseIP(vip) == nil {
+			add(fmt.Sprintf("vipPool[%d]", i), "%q is not an ip address", vip)
+		}
+	}
+
+	// the VIPs of config, with those of its blocks
+	vips := map[types.ServiceIP]bool{}
+	for vip := range c.Config {
+		if !types.IsBlock(string(vip)) {
+			vips[vip] = true
+			continue
+		}
+		expanded, _ := types.ExpandBlock(string(vip))
+		for _, v := range expanded {
+			vips[v] = true
+		}
+	}
+
+	for _, section := range []struct {
+		name   string
+		config map[types.ServiceIP]types.PortMap
+		v6     bool
+	}{{"config", c.Config, false}, {"config6", c.Config6, true}} {
+		// the same address can be written more than one way
+		seen := map[string]types.ServiceIP{}
+		for _, vip := range sortedVIPs(section.config) {
+			path := join(section.name, string(vip))
+			ip := net.ParseIP(string(vip))
+			if types.IsBlock(string(vip)) {
+				ip = nil
+				if expanded, err := types.ExpandBlock(string(vip)); err != nil {
+					add(path, "%v", err)
+				} else {
+					ip = net.ParseIP(string(expanded[0]))
+				}
+				switch {
+				case ip == nil:
+				case section.v6 && ip.To4() != nil:
+					add(path, "is not an ipv6 block. ipv4 VIPs go in config")
+				case !section.v6 && ip.To4() == nil:
+					add(path, "is not an ipv4 block. ipv6 VIPs go in config6")
+				}
+				problems = append(problems, checkPorts(path, section.config[vip], section.v6)...)
+				continue
+			}
+			switch {
+			case ip == nil:
+				add(path, "is not an ip address")
+			case section.v6 && ip.To4() != nil:
+				add(path, "is not an ipv6 address. ipv4 VIPs go in config")
+			case !section.v6 && ip.To4() == nil:
+				add(path, "is not an ipv4 address. ipv6 VIPs go in config6")
+			default:
+				if other, ok := seen[ip.String()]; ok {
+					add(path, "is the same VIP as %s, and only one of them is used", other)
+				}
+				seen[ip.String()] = vip
+			}
+			problems = append(problems, checkPorts(path, section.config[vip], section.v6)...)
+		}
+	}
+
+	v6s := map[string]types.ServiceIP{}
+	for _, vip := range sortedVIPs(c.IPV6) {
+		path := join("ipv6", string(vip))
+		if !vips[vip] {
+			add(path, "is not a VIP in config")
+		}
+		ip := net.ParseIP(c.IPV6[vip])
+		if ip == nil || ip.To4() != nil {
+			add(path, "%q is not an ipv6 address", c.IPV6[vip])
+			continue
+		}
+		if other, ok := v6s[ip.String()]; ok {
+			add(path, "%s is also the ipv6 address of %s", c.IPV6[vip], other)
+		}
+		v6s[ip.String()] = vip
+	}
+
+	for _, section := range []struct {
+		name   string
+		config map[types.ServiceIP]string
+	}{{"mtuConfig", c.MTUConfig}, {"mtuConfig6", c.MTUConfig6}} {
+		for _, vip := range sortedVIPs(section.config) {
+			path := join(section.name, string(vip))
+			if types.IsBlock(string(vip)) {
+				if _, err := types.ExpandBlock(string(vip)); err != nil {
+					add(path, "%v", err)
+				}
+			} else if net.ParseIP(string(vip)) == nil {
+				add(path, "is not an ip address")
+			}
+			mtu := section.config[vip]
+			if mtu == "" {
+				continue
+			}
+			// the range directors and realservers apply
+			if n, err := strconv.Atoi(mtu); err != nil || n < 1500 || n > 9000 {
+				add(path, "mtu %q is not a number from 1500 to 9000", mtu)
+			}
+		}
+	}
+
+	for _, vip := range sortedVIPs(c.Shards) {
+		path := join("shards", string(vip))
+		if !vips[vip] {
+			add(path, "is not a VIP in config")
+		}
+		if len(c.Shards[vip]) == 0 {
+			add(path, "assigns the VIP to no nodes")
+		}
+	}
+
+	if d := c.Defaults; d != nil {
+		if d.MTU != "" {
+			if n, err := strconv.Atoi(d.MTU); err != nil || n < 1500 || n > 9000 {
+				add("defaults.mtu", "mtu %q is not a number from 1500 to 9000", d.MTU)
+			}
+		}
+		for i, community := range d.Communities {
+			// as gobgp and the bgp overrides take them
+			if community == "" || strings.ContainsAny(community, " ,") {
+				add(fmt.Sprintf("defaults.communities[%d]", i), "%q is not a community", community)
+			}
+		}
+	}
+	return problems
+}
+
+// checkPorts validates the services of a VIP.
+func checkPorts(vipPath string, ports types.PortMap, v6 bool) []Problem {
+	problems := []Problem{}
+	add := func(path, format string, args ...interface{}) {
+		problems = append(problems, Problem{path, fmt.Sprintf(format, args...)})
+	}
+
+	seen := map[int]string{}
+	for _, port := range sortedPorts(ports) {
+		path := join(vipPath, port)
+		n, err := strconv.Atoi(port)
+		switch {
+		case types.IsPortRange(port):
+			if _, err := types.ExpandPortRange(port); err != nil {
+				add(path, "%v", err)
+			} else if v6 {
+				add(path, "is a port range, which is only supported in config")
+			}
+		case err != nil || n < 1 || n > 65535:
+			add(path, "is not a port from 1 to 65535")
+		default:
+			if other, ok := seen[n]; ok {
+				add(path, "is the same port as %q, and only one of them is used", other)
+			}
+			seen[n] = port
+		}
+
+		def := ports[port]
+		if def == nil {
+			add(path, "has no service")
+			continue
+		}
+		for _, field := range []struct{ name, value string }{
+			{"namespace", def.Namespace},
+			{"service", def.Service},
+			{"portName", def.PortName},
+		} {
+			if field.value == "" {
+				add(join(path, field.name), "must be set")
+			}
+		}
+		problems = append(problems, checkOptions(join(path, "ipvsOptions"), def.IPVSOptions, v6)...)
+		if def.PortRange != "" {
+			add(join(path, "portRange"), "is set from the port key, and can't be given")
+		}
+
+		switch def.V6Proxy {
+		case "", haproxy.ProxyHAProxy, haproxy.ProxyNative:
+		default:
+			add(join(path, "v6Proxy"), "%q is not one of %s|%s", def.V6Proxy, haproxy.ProxyHAProxy, haproxy.ProxyNative)
+		}
+
+		routes := []haproxy.Route{}
+		for i, route := range def.Routes {
+			routes = append(routes, haproxy.Route{Host: route.Host})
+			for _, field := range []struct{ name, value string }{
+				{"namespace", route.Namespace},
+				{"service", route.Service},
+				{"portName", route.PortName},
+			} {
+				if field.value == "" {
+					add(join(fmt.Sprintf("%s.routes[%d]", path, i), field.name), "must be set")
+				}
+			}
+		}
+		if err := haproxy.ValidateL7(def.L7Mode, routes); err != nil {
+			add(join(path, "l7Mode"), "%v", err)
+		}
+
+		if def.Listener != nil {
+			limits := haproxy.Limits{MaxConn: def.Listener.MaxConn}
+			for _, timeout := range []struct {
+				name, value string
+				into        *time.Duration
+			}{
+				{"connectTimeout", def.Listener.ConnectTimeout, &limits.ConnectTimeout},
+				{"clientTimeout", def.Listener.ClientTimeout, &limits.ClientTimeout},
+				{"serverTimeout", def.Listener.ServerTimeout, &limits.ServerTimeout},
+				{"httpKeepAliveTimeout", def.Listener.HTTPKeepAliveTimeout, &limits.HTTPKeepAliveTimeout},
+			} {
+				if timeout.value == "" {
+					continue
+				}
+				d, err := time.ParseDuration(timeout.value)
+				if err != nil {
+					add(join(join(path, "listener"), timeout.name), "%q is not a duration", timeout.value)
+					continue
+				}
+				*timeout.into = d
+			}
+			if err := limits.Validate(); err != nil {
+				add(join(path, "listener"), "%v", err)
+			}
+		}
+
+		if def.HealthCheck != nil {
+			hc := haproxy.HealthCheck{
+				Enabled:    true,
+				Rise:       def.HealthCheck.Rise,
+				Fall:       def.HealthCheck.Fall,
+				HTTPPath:   def.HealthCheck.HTTPPath,
+				HTTPExpect: def.HealthCheck.HTTPExpect,
+			}
+			if def.HealthCheck.Interval != "" {
+				d, err := time.ParseDuration(def.HealthCheck.Interval)
+				if err != nil {
+					add(join(join(path, "healthCheck"), "interval"), "%q is not a duration", def.HealthCheck.Interval)
+				}
+				hc.Interval = d
+			}
+			if err := hc.Validate(); err != nil {
+				add(join(path, "healthCheck"), "%v", err)
+			}
+		}
+	}
+	return problems
+}
+
+// maxPersistence is the longest persistence ipvsadm takes, 31 days.
+const maxPersistence = 31 * 24 * 60 * 60
+
+// checkOptions validates the ipvs options of a service.
+func checkOptions(path string, o types.IPVSOptions, v6 bool) []Problem {
+	problems := []Problem{}
+	add := func(path, format string, args ...interface{}) {
+		problems = append(problems, Problem{path, fmt.Sprintf(format, args...)})
+	}
+
+	scheduler := strings.TrimSpace(strings.ToLower(o.RawScheduler))
+	if scheduler != "" && !schedulers[scheduler] {
+		add(join(path, "scheduler"), "%q is not a supported scheduler, and wrr is used instead", o.RawScheduler)
+	}
+	if o.Flags != "" {
+		for _, flag := range strings.Split(o.Flags, ",") {
+			flag = strings.TrimSpace(flag)
+			only, known := schedulerFlags[flag]
+			switch {
+			case !known:
+				add(join(path, "flags"), "%q is not a scheduler flag", flag)
+			case only != "" && only != scheduler:
+				add(join(path, "flags"), "%s only applies to the %s scheduler", flag, only)
+			}
+		}
+	}
+	for _, flag := range []struct {
+		name, scheduler string
+		set             bool
+	}{
+		{"shFallback", "sh", o.SHFallback},
+		{"shPort", "sh", o.SHPort},
+		{"mhFallback", "mh", o.MHFallback},
+		{"mhPort", "mh", o.MHPort},
+	} {
+		if flag.set && flag.scheduler != scheduler {
+			add(join(path, flag.name), "only applies to the %s scheduler", flag.scheduler)
+		}
+	}
+
+	if o.Persistence < 0 || o.Persistence > maxPersistence {
+		add(join(path, "persistence"), "%d is not a number of seconds from 0 to %d", o.Persistence, maxPersistence)
+	}
+	if mask := o.PersistenceNetmask; mask != "" {
+		switch {
+		case o.Persistence == 0:
+			add(join(path, "persistenceNetmask"), "only applies with persistence")
+		case v6:
+			if n, err := strconv.Atoi(mask); err != nil || n < 1 || n > 128 {
+				add(join(path, "persistenceNetmask"), "%q is not a prefix length from 1 to 128", mask)
+			}
+		default:
+			ip := net.ParseIP(mask).To4()
+			if ones, bits := net.IPMask(ip).Size(); ip == nil || ones == 0 && bits == 0 {
+				add(join(path, "persistenceNetmask"), "%q is not an ipv4 netmask, such as 255.255.255.0", mask)
+			}
+		}
+	}
+
+	switch o.RawForwardingMethod {
+	case "", "g", "i":
+	default:
+		add(join(path, "forwardingMethod"), "%q is not one of g|i, and g is used instead", o.RawForwardingMethod)
+	}
+
+	if o.RawUThreshold < 0 {
+		add(join(path, "uThreshold"), "must not be negative")
+	}
+	if o.RawLThreshold < 0 {
+		add(join(path, "lThreshold"), "must not be negative")
+	}
+	if (o.RawUThreshold != 0 || o.RawLThreshold != 0) && o.RawLThreshold >= o.RawUThreshold {
+		add(join(path, "lThreshold"), "must be below uThreshold, or neither is applied")
+	}
+	return problems
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedVIPs(m interface{}) []types.ServiceIP {
+	vips := []types.ServiceIP{}
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		vips = append(vips, types.ServiceIP(k.String()))
+	}
+	sort.Slice(vips, func(i, j int) bool { return vips[i] < vips[j] })
+	return vips
+}
+
+func sortedPorts(ports types.PortMap) []string {
+	keys := make([]string, 0, len(ports))
+	for k := range ports {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,265 @@
+package validate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func messages(problems []Problem) []string {
+	out := []string{}
+	for _, p := range problems {
+		out = append(out, p.String())
+	}
+	return out
+}
+
+func TestConfig(t *testing.T) {
+	c, problems := Config([]byte(`{
+		"vipPool": ["10.0.0.1", "10.0.0.300"],
+		"config": {
+			"10.0.0.1": {
+				"80": {"namespace": "default", "service": "web", "portName": "http", "ipvsOptions": {"scheduler": "mh", "flags": "mh-port,sh-port"}},
+				"080": {"namespace": "default", "service": "web", "portName": "http", "ipvsOptions": {"schedular": "rr"}},
+				"443": {"namespace": "default", "service": "web", "portName": "https", "ipvsOptions": {"scheduler": "lblc", "uThreshold": 10, "lThreshold": 20}}
+			},
+			"10.0.0.1": {}
+		},
+		"config6": {
+			"2001:db8::1": {"80": {"namespace": "default", "service": "web", "portName": "http", "v6Proxy": "envoy", "listener": {"connectTimeout": "5"}}},
+			"10.0.0.2": {}
+		},
+		"ipv6": {"10.0.0.3": "2001:db8::1"},
+		"mtuConfig": {"10.0.0.1": "100000"}
+	}`))
+	if c == nil {
+		t.Fatal("expected the config to parse")
+	}
+	expected := []string{
+		`config6["10.0.0.2"]: is not an ipv6 address. ipv4 VIPs go in config`,
+		`config6["2001:db8::1"]["80"].listener.connectTimeout: "5" is not a duration`,
+		`config6["2001:db8::1"]["80"].v6Proxy: "envoy" is not one of haproxy|native`,
+		`config["10.0.0.1"]: is given more than once, and only the last is used`,
+		`ipv6["10.0.0.3"]: is not a VIP in config`,
+		`mtuConfig["10.0.0.1"]: mtu "100000" is not a number from 1500 to 9000`,
+		`vipPool[1]: "10.0.0.300" is not an ip address`,
+	}
+	if got := messages(problems); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected\n%q\ngot\n%q", expected, got)
+	}
+
+	// VIPs and ports written two ways are the same
+	_, problems = Config([]byte(`{
+		"config": {
+			"10.0.0.1": {
+				"80": {"namespace": "default", "service": "web", "portName": "http", "ipvsOptions": {"scheduler": "mh", "flags": "mh-port,sh-port"}},
+				"080": {"namespace": "default", "service": "web", "portName": "http", "ipvsOptions": {"schedular": "rr"}},
+				"443": {"namespace": "default", "service": "web", "ipvsOptions": {"scheduler": "lblc", "uThreshold": 10, "lThreshold": 20}}
+			},
+			"::ffff:10.0.0.1": {}
+		}
+	}`))
+	expected = []string{
+		`config["10.0.0.1"]["080"].ipvsOptions.schedular: is not a known field`,
+		`config["10.0.0.1"]["443"].ipvsOptions.lThreshold: must be below uThreshold, or neither is applied`,
+		`config["10.0.0.1"]["443"].ipvsOptions.scheduler: "lblc" is not a supported scheduler, and wrr is used instead`,
+		`config["10.0.0.1"]["443"].portName: must be set`,
+		`config["10.0.0.1"]["80"]: is the same port as "080", and only one of them is used`,
+		`config["10.0.0.1"]["80"].ipvsOptions.flags: sh-port only applies to the sh scheduler`,
+		`config["::ffff:10.0.0.1"]: is the same VIP as 10.0.0.1, and only one of them is used`,
+	}
+	if got := messages(problems); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected\n%q\ngot\n%q", expected, got)
+	}
+
+	if c, problems := Config([]byte(`{"config": []}`)); c != nil || len(problems) != 1 {
+		t.Fatalf("expected a config of the wrong shape to be refused, got %q", messages(problems))
+	}
+}
+
+func TestServices(t *testing.T) {
+	c, _ := Config([]byte(`{
+		"config": {
+			"10.0.0.1": {
+				"80": {"namespace": "default", "service": "web", "portName": "http"},
+				"443": {"namespace": "default", "service": "web", "portName": "https"},
+				"8080": {"namespace": "default", "service": "api", "portName": "http"}
+			}
+		}
+	}`))
+	lookups := 0
+	problems, err := Services(c, func(namespace, name string) (*v1.Service, error) {
+		lookups++
+		if name != "web" {
+			return nil, nil
+		}
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http"}}},
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`config["10.0.0.1"]["443"]: service default/web has no port named "https", only "http"`,
+		`config["10.0.0.1"]["8080"]: service default/api doesn't exist`,
+	}
+	if got := messages(problems); !reflect.DeepEqual(got, expected) || lookups != 2 {
+		t.Fatalf("expected\n%q\nafter 2 lookups, got\n%q after %d", expected, got, lookups)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	if err := Check([]byte(`{"config": {"10.0.0.1": {"80": {"namespace": "default", "service": "web", "portName": "http"}}}}`)); err != nil {
+		t.Fatalf("expected a valid config. saw %v", err)
+	}
+	err := Check([]byte(`{"config": {"10.1.2.3": {"443": {"namespace": "default", "service": "web", "portName": "https", "ipvsOptions": {"scheduler": "wrrr"}}}}}`))
+	verr, ok := err.(*Error)
+	if !ok || len(verr.Problems) != 1 {
+		t.Fatalf("expected one problem. saw %v", err)
+	}
+	expected := `invalid cluster config with 1 problem. config["10.1.2.3"]["443"].ipvsOptions.scheduler: "wrrr" is not a supported scheduler, and wrr is used instead`
+	if err.Error() != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, err)
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	_, problems := Config([]byte(`{
+		"vipPool": ["10.0.0.0/28", "10.0.16.0/20"],
+		"config": {
+			"10.0.0.0/28": {"80": {"namespace": "default", "service": "web", "portName": "http"}},
+			"10.0.0.1/30": {"80": {"namespace": "default", "service": "web", "portName": "http"}},
+			"2001:db8::/126": {}
+		},
+		"config6": {
+			"2001:db8::/120": {"80": {"namespace": "default", "service": "web", "portName": "http", "v6Proxy": "envoy"}}
+		},
+		"ipv6": {"10.0.0.3": "2001:db8::3"},
+		"shards": {"10.0.0.4": ["lb01"], "10.0.0.20": ["lb01"]}
+	}`))
+	expected := []string{
+		`config6["2001:db8::/120"]["80"].v6Proxy: "envoy" is not one of haproxy|native`,
+		`config["10.0.0.1/30"]: "10.0.0.1/30" has host bits set. the block is 10.0.0.0/30`,
+		`config["2001:db8::/126"]: is not an ipv4 block. ipv6 VIPs go in config6`,
+		`shards["10.0.0.20"]: is not a VIP in config`,
+		`vipPool[1]: "10.0.16.0/20" has more than 256 addresses`,
+	}
+	if got := messages(problems); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected\n%q\ngot\n%q", expected, got)
+	}
+}
+
+func TestPortRanges(t *testing.T) {
+	_, problems := Config([]byte(`{
+		"config": {
+			"10.0.0.1": {
+				"30000-30100": {"namespace": "voice", "service": "rtp", "portName": "rtp", "udpEnabled": true},
+				"30100-30000": {"namespace": "voice", "service": "rtp", "portName": "rtp"},
+				"5060": {"namespace": "voice", "service": "sip", "portName": "sip", "portRange": "5060-5061"}
+			}
+		},
+		"config6": {
+			"2001:db8::1": {"30000-30100": {"namespace": "voice", "service": "rtp", "portName": "rtp"}}
+		}
+	}`))
+	expected := []string{
+		`config6["2001:db8::1"]["30000-30100"]: is a port range, which is only supported in config`,
+		`config["10.0.0.1"]["30100-30000"]: "30100-30000" does not end after it starts`,
+		`config["10.0.0.1"]["5060"].portRange: is set from the port key, and can't be given`,
+	}
+	if got := messages(problems); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected\n%q\ngot\n%q", expected, got)
+	}
+}
+
+func TestKey(t *testing.T) {
+	data := map[string]string{
+		"common": `{
+			"defaults": {"service": {"ipvsOptions": {"scheduler": "fifo"}}, "mtu": "100", "communities": ["65000:100", "65000 200"]},
+			"config": {"10.0.0.1": {"80": {"namespace": "default", "service": "web", "portName": "http"}}}
+		}`,
+		"prod":    `{"base": "common", "defaults": {"service": {"tcpEnabled": true, "scheduler": "sh"}}}`,
+		"staging": `{"base": "qa"}`,
+		"blocks": `{
+			"defaults": {"mtu": "9000"},
+			"mtuConfig": {"10.54.1.1/30": "1500"},
+			"config": {"10.54.0.0/30": {"80": {"namespace": "default", "service": "web", "portName": "http"}}}
+		}`,
+	}
+	_, problems := Key(data, "prod")
+	expected := []string{
+		`config["10.0.0.1"]["80"].ipvsOptions.scheduler: "fifo" is not a supported scheduler, and wrr is used instead`,
+		`defaults.communities[1]: "65000 200" is not a community`,
+		`defaults.mtu: mtu "100" is not a number from 1500 to 9000`,
+		`defaults.service.scheduler: is not a known field`,
+	}
+	if got := messages(problems); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected\n%q\ngot\n%q", expected, got)
+	}
+
+	_, problems = Key(data, "staging")
+	expected = []string{`base: base 'qa' of 'staging' is not a key of the configmap`}
+	if got := messages(problems); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected\n%q\ngot\n%q", expected, got)
+	}
+
+	// the default mtu is given to a block, as it is expanded
+	_, problems = Key(data, "blocks")
+	expected = []string{`mtuConfig["10.54.1.1/30"]: "10.54.1.1/30" has host bits set. the block is 10.54.1.0/30`}
+	if got := messages(problems); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected\n%q\ngot\n%q", expected, got)
+	}
+}
+
+func TestYAML(t *testing.T) {
+	_, problems := Config([]byte(`
+config:
+  10.0.0.1:
+    80: {namespace: default, service: web, portName: http, tcpEnabled: yes}
+    80: {namespace: default, service: api, portName: http}
+  10.0.0.2:
+    443: {namespace: default, service: web, portName: https, scheduler: sh}
+`))
+	expected := []string{
+		`config["10.0.0.1"]["80"]: is given more than once, and only the last is used`,
+		`config["10.0.0.2"]["443"].scheduler: is not a known field`,
+	}
+	if got := messages(problems); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected\n%q\ngot\n%q", expected, got)
+	}
+
+	_, problems = Config([]byte("config:\n  10.0.0.1: [\n"))
+	if got := messages(problems); len(got) != 1 || !strings.HasPrefix(got[0], "invalid yaml at line") {
+		t.Fatalf("expected the line of the yaml error. saw %q", got)
+	}
+}
+
+func TestSchedulerOptions(t *testing.T) {
+	_, problems := Config([]byte(`{
+		"config": {
+			"10.0.0.1": {
+				"80": {"namespace": "default", "service": "web", "portName": "http", "ipvsOptions": {"scheduler": "sh", "shFallback": true, "mhPort": true, "persistence": 300, "persistenceNetmask": "255.0.255.0"}},
+				"81": {"namespace": "default", "service": "web", "portName": "http", "ipvsOptions": {"scheduler": "mh", "mhFallback": true, "persistenceNetmask": "255.255.255.0"}},
+				"82": {"namespace": "default", "service": "web", "portName": "http", "ipvsOptions": {"persistence": 3000000}}
+			}
+		},
+		"config6": {
+			"2001:db8::1": {"80": {"namespace": "default", "service": "web", "portName": "http", "ipvsOptions": {"persistence": 60, "persistenceNetmask": "255.255.255.0"}}}
+		}
+	}`))
+	expected := []string{
+		`config6["2001:db8::1"]["80"].ipvsOptions.persistenceNetmask: "255.255.255.0" is not a prefix length from 1 to 128`,
+		`config["10.0.0.1"]["80"].ipvsOptions.mhPort: only applies to the mh scheduler`,
+		`config["10.0.0.1"]["80"].ipvsOptions.persistenceNetmask: "255.0.255.0" is not an ipv4 netmask, such as 255.255.255.0`,
+		`config["10.0.0.1"]["81"].ipvsOptions.persistenceNetmask: only applies with persistence`,
+		`config["10.0.0.1"]["82"].ipvsOptions.persistence: 3000000 is not a number of seconds from 0 to 2678400`,
+	}
+	if got := messages(problems); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected\n%q\ngot\n%q", expected, got)
+	}
+}
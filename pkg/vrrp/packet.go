@@ -0,0 +1,115 @@
+package vrrp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	version         = 3
+	typeAdvert      = 1
+	headerLength    = 8
+	maxAddresses    = 255
+	maxCentiseconds = 0x0fff
+)
+
+// Group is the multicast group VRRP adverts are sent to.
+var Group = net.IPv4(224, 0, 0, 18)
+
+// Advert is a VRRPv3 advertisement, as in RFC 5798 section 5.
+type Advert struct {
+	VRID      uint8
+	Priority  uint8
+	Interval  time.Duration
+	Addresses []net.IP
+	// Source is the address the advert came from. It is filled in on
+	// receipt.
+	Source net.IP
+}
+
+// marshal encodes the advert as sent from src to dst, which the checksum
+// covers.
+func (a Advert) marshal(src, dst net.IP) []byte {
+	addrs := a.Addresses
+	if len(addrs) > maxAddresses {
+		addrs = addrs[:maxAddresses]
+	}
+	b := make([]byte, headerLength, headerLength+4*len(addrs))
+	b[0] = version<<4 | typeAdvert
+	b[1] = a.VRID
+	b[2] = a.Priority
+	b[3] = uint8(len(addrs))
+	binary.BigEndian.PutUint16(b[4:], centiseconds(a.Interval))
+	for _, addr := range addrs {
+		b = append(b, addr.To4()...)
+	}
+	binary.BigEndian.PutUint16(b[6:], checksum(b, src, dst))
+	return b
+}
+
+// parseAdvert decodes an advert received from src on dst.
+func parseAdvert(b []byte, src, dst net.IP) (Advert, error) {
+	if len(b) < headerLength {
+		return Advert{}, fmt.Errorf("vrrp: short packet of %d bytes", len(b))
+	}
+	if v := b[0] >> 4; v != version {
+		return Advert{}, fmt.Errorf("vrrp: unsupported version %d", v)
+	}
+	if t := b[0] & 0x0f; t != typeAdvert {
+		return Advert{}, fmt.Errorf("vrrp: unknown type %d", t)
+	}
+	count := int(b[3])
+	if len(b) < headerLength+4*count {
+		return Advert{}, fmt.Errorf("vrrp: packet of %d bytes too short for %d addresses", len(b), count)
+	}
+	if checksum(b, src, dst) != 0 {
+		return Advert{}, fmt.Errorf("vrrp: bad checksum")
+	}
+	a := Advert{
+		VRID:     b[1],
+		Priority: b[2],
+		Interval: time.Duration(binary.BigEndian.Uint16(b[4:])&maxCentiseconds) * 10 * time.Millisecond,
+		Source:   src,
+	}
+	for i := 0; i < count; i++ {
+		off := headerLength + 4*i
+		a.Addresses = append(a.Addresses, net.IPv4(b[off], b[off+1], b[off+2], b[off+3]))
+	}
+	return a, nil
+}
+
+// centiseconds returns d in the 12 bit centisecond field of an advert.
+func centiseconds(d time.Duration) uint16 {
+	cs := d / (10 * time.Millisecond)
+	if cs < 1 {
+		cs = 1
+	}
+	if cs > maxCentiseconds {
+		cs = maxCentiseconds
+	}
+	return uint16(cs)
+}
+
+// checksum is the internet checksum of b with the IPv4 pseudo-header of src
+// and dst. It is 0 for a packet that carries a valid checksum.
+func checksum(b []byte, src, dst net.IP) uint16 {
+	var sum uint32
+	add := func(p []byte) {
+		for i := 0; i+1 < len(p); i += 2 {
+			sum += uint32(p[i])<<8 | uint32(p[i+1])
+		}
+		if len(p)%2 == 1 {
+			sum += uint32(p[len(p)-1]) << 8
+		}
+	}
+	add(src.To4())
+	add(dst.To4())
+	add([]byte{0, protocol, byte(len(b) >> 8), byte(len(b))})
+	add(b)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
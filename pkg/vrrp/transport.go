@@ -0,0 +1,144 @@
+package vrrp
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// protocol is the IP protocol number of VRRP.
+const protocol = 112
+
+// Transport carries adverts between the directors of a virtual router.
+type Transport interface {
+	// Send sends an advert to the group.
+	Send(Advert) error
+	// Receive blocks until an advert arrives, or returns an error once the
+	// transport is closed.
+	Receive() (Advert, error)
+	Close() error
+}
+
+// multicast sends and receives adverts on the VRRP group of an interface.
+type multicast struct {
+	conn   *net.IPConn
+	iface  *net.Interface
+	source net.IP
+}
+
+// NewMulticast returns the transport of the VRRP group on iface, sending
+// from source, which must be an address of the interface.
+func NewMulticast(iface string, source net.IP) (Transport, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	src := source.To4()
+	if src == nil {
+		return nil, fmt.Errorf("vrrp: source %v is not an IPv4 address", source)
+	}
+	conn, err := net.ListenIP(fmt.Sprintf("ip4:%d", protocol), &net.IPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, fmt.Errorf("vrrp: unable to open a raw socket. %v", err)
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		group := &syscall.IPMreqn{Ifindex: int32(ifi.Index)}
+		copy(group.Multiaddr[:], Group.To4())
+		out := &syscall.IPMreqn{Ifindex: int32(ifi.Index)}
+		copy(out.Address[:], src)
+		for _, set := range []func() error{
+			func() error {
+				return syscall.SetsockoptIPMreqn(int(fd), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, group)
+			},
+			func() error {
+				return syscall.SetsockoptIPMreqn(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, out)
+			},
+			// adverts are only valid from the local network
+			func() error { return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, 255) },
+			func() error { return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, 0) },
+			func() error { return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTTL, 1) },
+			func() error { return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1) },
+		} {
+			if serr = set(); serr != nil {
+				return
+			}
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("vrrp: unable to join the vrrp group on %s. %v", iface, err)
+	}
+	return &multicast{conn: conn, iface: ifi, source: src}, nil
+}
+
+func (m *multicast) Send(a Advert) error {
+	_, err := m.conn.WriteToIP(a.marshal(m.source, Group), &net.IPAddr{IP: Group})
+	return err
+}
+
+func (m *multicast) Receive() (Advert, error) {
+	buf := make([]byte, 1500)
+	oob := make([]byte, 128)
+	for {
+		n, oobn, _, src, err := m.conn.ReadMsgIP(buf, oob)
+		if err != nil {
+			return Advert{}, err
+		}
+		if src == nil || src.IP.Equal(m.source) {
+			continue
+		}
+		// RFC 5798 section 7.1: drop adverts that crossed a router, or
+		// arrived on another interface
+		ttl, ifindex, dst := control(oob[:oobn])
+		if ttl != 255 || ifindex != m.iface.Index || dst == nil {
+			continue
+		}
+		a, err := parseAdvert(buf[:n], src.IP, dst)
+		if err != nil {
+			continue
+		}
+		return a, nil
+	}
+}
+
+func (m *multicast) Close() error {
+	return m.conn.Close()
+}
+
+// control reads the ttl, interface and destination of a packet from its
+// control messages.
+func control(oob []byte) (ttl, ifindex int, dst net.IP) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, 0, nil
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level != syscall.IPPROTO_IP {
+			continue
+		}
+		switch msg.Header.Type {
+		case syscall.IP_TTL:
+			if len(msg.Data) >= 4 {
+				ttl = int(*(*int32)(unsafe.Pointer(&msg.Data[0])))
+			}
+		case syscall.IP_PKTINFO:
+			if len(msg.Data) >= syscall.SizeofInet4Pktinfo {
+				info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&msg.Data[0]))
+				ifindex = int(info.Ifindex)
+				dst = net.IPv4(info.Addr[0], info.Addr[1], info.Addr[2], info.Addr[3])
+			}
+		}
+	}
+	return ttl, ifindex, dst
+}
@@ -0,0 +1,512 @@
+package vrrp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Comcast/Ravel/pkg/health"
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// Where directors can't peer with BGP, they can share the VIPs of a config
+// key as a VRRP virtual router: the master holds every VIP on its primary
+// interface and answers ARP for them, and the backups hold none. Every
+// director programs IPVS and iptables as usual, so a backup that becomes
+// master only has to add the VIPs and send gratuitous ARP.
+//
+// VRRP runs in-process, as version 3 of RFC 5798 over IPv4. The director
+// with the highest priority is master, ties going to the highest address, so
+// with several backups the next in line is always the one of highest
+// priority. With preemption a director takes over from a master of lower
+// priority as soon as it hears from it, or once it has been up for the
+// preempt delay, and without it only once the master goes quiet.
+// A master that stops sends an advert of priority 0, so that a backup takes
+// over within the skew time rather than the master down interval.
+//
+// With a Fence, a director must also claim the VIPs before it becomes master,
+// and keep renewing the claim. A director that can't claim them stays backup
+// and tries again every interval, and a master whose claim is lost steps
+// down, so that directors that can't hear each other's adverts don't both
+// hold the VIPs. A director waiting on the claim still advertises, so that a
+// master of lower priority steps down and withdraws the VIPs for it.
+//
+// A director on a node in maintenance is held: a master steps down as it
+// would on stop, and a backup doesn't take over, until it is released.
+
+// State is the state of a virtual router on this director.
+type State int
+
+const (
+	Init State = iota
+	Backup
+	Master
+)
+
+func (s State) String() string {
+	switch s {
+	case Backup:
+		return "backup"
+	case Master:
+		return "master"
+	}
+	return "init"
+}
+
+var (
+	metricsOnce sync.Once
+	master      *prometheus.GaugeVec
+	transitions *prometheus.CounterVec
+	priorities  *prometheus.GaugeVec
+
+	masterDef = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "vrrp_master",
+		Help:   "is 1 while the director is the vrrp master of its config key, and holds the VIPs, and 0 otherwise",
+		Labels: []string{"lb", "seczone"},
+	})
+	transitionsDef = stats.Define(stats.Definition{
+		Type:   stats.Counter,
+		Name:   "vrrp_transitions_total",
+		Help:   "is a count of the vrrp role changes of the director, by the role it changed to",
+		Labels: []string{"lb", "seczone", "role"},
+	})
+	priorityDef = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "vrrp_priority",
+		Help:   "is the vrrp priority of the director. when the master fails, the backup of the highest priority takes over",
+		Labels: []string{"lb", "seczone"},
+	})
+)
+
+func metrics() (*prometheus.GaugeVec, *prometheus.CounterVec, *prometheus.GaugeVec) {
+	metricsOnce.Do(func() {
+		master = masterDef.GaugeVec()
+		transitions = transitionsDef.CounterVec()
+		priorities = priorityDef.GaugeVec()
+	})
+	return master, transitions, priorities
+}
+
+// claimTimeout bounds a call on the fence.
+const claimTimeout = 5 * time.Second
+
+// Fence is a claim on the VIPs that only one director holds at a time.
+type Fence interface {
+	// Claim takes the VIPs, failing while another director holds them.
+	Claim(ctx context.Context) (int64, error)
+	// Renew keeps the claim.
+	Renew(ctx context.Context) error
+	// Release gives the claim up once the VIPs are withdrawn.
+	Release(ctx context.Context) error
+	// Valid reports whether the claim still holds.
+	Valid() bool
+	RenewInterval() time.Duration
+}
+
+// Config is the virtual router of a director.
+type Config struct {
+	// VRID identifies the virtual router on the network, from 1 to 255.
+	VRID uint8
+	// Priority is from 1 to 254 for a backup, or 255 for the owner of the
+	// VIPs, which becomes master at once.
+	Priority uint8
+	Preempt  bool
+	// PreemptDelay holds preemption off for a while after the router
+	// starts, so that a director coming back settles before it takes the
+	// VIPs back.
+	PreemptDelay time.Duration
+	// Interval is how often the master sends adverts, in centiseconds of up
+	// to 40.95s.
+	Interval time.Duration
+	// Address is the primary address of the director.
+	Address net.IP
+	// Fence is claimed before becoming master, if set.
+	Fence Fence
+}
+
+// Validate checks the settings of a virtual router.
+func (c Config) Validate() error {
+	if c.VRID == 0 {
+		return fmt.Errorf("vrrp id must be between 1 and 255")
+	}
+	if c.Priority == 0 {
+		return fmt.Errorf("vrrp priority must be between 1 and 255")
+	}
+	if c.Interval < 10*time.Millisecond || c.Interval > maxCentiseconds*10*time.Millisecond {
+		return fmt.Errorf("vrrp interval must be between 10ms and 40.95s")
+	}
+	if c.PreemptDelay < 0 {
+		return fmt.Errorf("vrrp preempt delay must not be negative")
+	}
+	if c.Address.To4() == nil {
+		return fmt.Errorf("vrrp needs an IPv4 primary address, not %q", c.Address)
+	}
+	return nil
+}
+
+// Router is a director's end of a virtual router.
+type Router struct {
+	sync.Mutex
+	config    Config
+	transport Transport
+	vips      func() []net.IP
+
+	state         State
+	masterAdverts time.Duration
+	master        net.IP
+	changes       []chan bool
+	// claiming is set while the director is waiting on the fence
+	claiming bool
+	started  time.Time
+	// held keeps the director backup, and holds wakes Run when it changes
+	held  bool
+	holds chan struct{}
+
+	gauge       prometheus.Gauge
+	transitions *prometheus.CounterVec
+	lb, seczone string
+	logger      logging.Logger
+}
+
+// New returns the virtual router of a director of configKey, which
+// advertises the VIPs vips returns.
+func New(config Config, transport Transport, vips func() []net.IP, kind stats.LBKind, configKey string, logger logging.Logger) (*Router, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	master, transitions, priorities := metrics()
+	priorities.WithLabelValues(string(kind), configKey).Set(float64(config.Priority))
+	return &Router{
+		config:        config,
+		transport:     transport,
+		vips:          vips,
+		masterAdverts: config.Interval,
+		holds:         make(chan struct{}, 1),
+		gauge:         master.WithLabelValues(string(kind), configKey),
+		transitions:   transitions,
+		lb:            string(kind),
+		seczone:       configKey,
+		logger:        logger.WithFields(logging.Fields{"module": "vrrp", "vrid": config.VRID}),
+	}, nil
+}
+
+// Master reports whether the director holds the VIPs.
+func (r *Router) Master() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.state == Master
+}
+
+// Role is the role of a director, as the health check details it.
+type Role struct {
+	State    string `json:"state"`
+	Priority uint8  `json:"priority"`
+	// Master is the address of the master a backup last heard from.
+	Master net.IP `json:"master,omitempty"`
+	// Held is set while the director is kept from being master.
+	Held bool `json:"held,omitempty"`
+}
+
+// Changes returns a channel that receives whether the director is master,
+// first as it stands once the router has started, and then each time that
+// changes. Only the latest change is kept. Each caller gets its own channel.
+func (r *Router) Changes() <-chan bool {
+	r.Lock()
+	defer r.Unlock()
+	ch := make(chan bool, 1)
+	if r.state != Init {
+		ch <- r.state == Master
+	}
+	r.changes = append(r.changes, ch)
+	return ch
+}
+
+// Health reports the role of the director. Backups are as healthy as
+// masters.
+func (r *Router) Health(context.Context) health.Status {
+	r.Lock()
+	defer r.Unlock()
+	status := health.Status{Ready: r.state != Init, Message: r.state.String(), Detail: Role{State: r.state.String(), Priority: r.config.Priority, Master: r.master, Held: r.held}}
+	if r.state == Backup && r.master != nil {
+		status.Message = fmt.Sprintf("backup of %v", r.master)
+	}
+	if r.held {
+		status.Message += ", held"
+	}
+	return status
+}
+
+// Hold keeps the director from being master while held is set. A master
+// steps down at once, with an advert of priority 0 so that a backup takes
+// over within the skew time.
+func (r *Router) Hold(held bool) {
+	r.Lock()
+	changed := r.held != held
+	r.held = held
+	r.Unlock()
+	if !changed {
+		return
+	}
+	select {
+	case r.holds <- struct{}{}:
+	default:
+	}
+}
+
+// isHeld reports whether the director is kept from being master.
+func (r *Router) isHeld() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.held
+}
+
+// Run takes part in the virtual router until ctx is done, then gives up
+// mastership and closes the transport.
+func (r *Router) Run(ctx context.Context) {
+	adverts := make(chan Advert)
+	go func() {
+		for {
+			a, err := r.transport.Receive()
+			if err != nil {
+				if ctx.Err() == nil {
+					r.logger.Errorf("vrrp: stopped receiving adverts. %v", err)
+				}
+				close(adverts)
+				return
+			}
+			select {
+			case adverts <- a:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var renew <-chan time.Time
+	if r.config.Fence != nil {
+		t := time.NewTicker(r.config.Fence.RenewInterval())
+		defer t.Stop()
+		renew = t.C
+	}
+
+	r.started = time.Now()
+	timer := time.NewTimer(0)
+	<-timer.C
+	if r.config.Priority == 255 && !r.isHeld() {
+		r.becomeMaster(ctx, timer)
+	} else {
+		r.becomeBackup(timer, nil, r.config.Interval)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if r.state == Master {
+				r.send(0)
+			}
+			r.transition(Init, nil)
+			r.transport.Close()
+			return
+
+		case a, ok := <-adverts:
+			if !ok {
+				adverts = nil
+				continue
+			}
+			if a.VRID != r.config.VRID {
+				continue
+			}
+			r.advert(timer, a)
+
+		case <-r.holds:
+			if r.isHeld() {
+				r.logger.Info("vrrp: held")
+				if r.state == Master {
+					r.send(0)
+					r.becomeBackup(timer, nil, r.config.Interval)
+				}
+			} else {
+				r.logger.Info("vrrp: released")
+			}
+
+		case <-timer.C:
+			if r.state == Master {
+				r.send(r.config.Priority)
+				timer.Reset(r.config.Interval)
+			} else if r.isHeld() {
+				reset(timer, r.masterDown())
+			} else {
+				if !r.claiming {
+					r.logger.Warnf("vrrp: master %v went quiet. taking over", r.master)
+				}
+				r.becomeMaster(ctx, timer)
+			}
+
+		case <-renew:
+			if r.state != Master {
+				continue
+			}
+			rctx, cancel := context.WithTimeout(ctx, claimTimeout)
+			err := r.config.Fence.Renew(rctx)
+			cancel()
+			if err != nil && !r.config.Fence.Valid() {
+				r.logger.Errorf("vrrp: lost the claim on the VIPs. stepping down. %v", err)
+				r.becomeBackup(timer, nil, r.config.Interval)
+			} else if err != nil {
+				r.logger.Warnf("vrrp: unable to renew the claim on the VIPs. %v", err)
+			}
+		}
+	}
+}
+
+// advert handles an advert of the virtual router, as in RFC 5798 section
+// 6.4.2 for a backup and 6.4.3 for a master.
+func (r *Router) advert(timer *time.Timer, a Advert) {
+	switch r.state {
+	case Backup:
+		switch {
+		case a.Priority == 0:
+			reset(timer, r.skew())
+		case !r.preempt() || a.Priority >= r.config.Priority:
+			r.Lock()
+			r.master, r.masterAdverts = a.Source, a.Interval
+			r.Unlock()
+			r.claiming = false
+			reset(timer, r.masterDown())
+		}
+	case Master:
+		switch {
+		case a.Priority == 0:
+			r.send(r.config.Priority)
+			reset(timer, r.config.Interval)
+		case a.Priority > r.config.Priority || (a.Priority == r.config.Priority && bytes.Compare(a.Source.To4(), r.config.Address.To4()) > 0):
+			r.logger.Infof("vrrp: %v has priority %d over our %d", a.Source, a.Priority, r.config.Priority)
+			r.becomeBackup(timer, a.Source, a.Interval)
+		}
+	}
+}
+
+// preempt reports whether the director takes over from a master of lower
+// priority.
+func (r *Router) preempt() bool {
+	return r.config.Preempt && time.Since(r.started) >= r.config.PreemptDelay
+}
+
+func (r *Router) becomeMaster(ctx context.Context, timer *time.Timer) {
+	if r.config.Fence != nil {
+		cctx, cancel := context.WithTimeout(ctx, claimTimeout)
+		_, err := r.config.Fence.Claim(cctx)
+		cancel()
+		if err != nil {
+			if !r.claiming {
+				r.logger.Warnf("vrrp: unable to claim the VIPs. staying backup until they are withdrawn. %v", err)
+			}
+			r.claiming = true
+			r.send(r.config.Priority)
+			if r.state == Init {
+				r.transition(Backup, nil)
+			}
+			reset(timer, r.config.Interval)
+			return
+		}
+	}
+	r.claiming = false
+	r.send(r.config.Priority)
+	r.transition(Master, nil)
+	reset(timer, r.config.Interval)
+}
+
+func (r *Router) becomeBackup(timer *time.Timer, master net.IP, interval time.Duration) {
+	r.Lock()
+	r.masterAdverts = interval
+	r.Unlock()
+	r.transition(Backup, master)
+	reset(timer, r.masterDown())
+}
+
+// Withdrawn tells the router that the director no longer holds the VIPs, so
+// that a claim on the fence can be given up. It does nothing while the
+// director is master.
+func (r *Router) Withdrawn(ctx context.Context) {
+	if r.config.Fence == nil || r.Master() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, claimTimeout)
+	defer cancel()
+	if err := r.config.Fence.Release(ctx); err != nil {
+		r.logger.Errorf("vrrp: unable to release the claim on the VIPs. it expires on its own. %v", err)
+	}
+}
+
+// transition records a change of state and passes it on.
+func (r *Router) transition(state State, master net.IP) {
+	r.Lock()
+	defer r.Unlock()
+	previous := r.state
+	r.state, r.master = state, master
+	if previous == state {
+		return
+	}
+	r.logger.Infof("vrrp: %s, was %s", state, previous)
+	r.transitions.WithLabelValues(r.lb, r.seczone, state.String()).Inc()
+	if state == Master {
+		r.gauge.Set(1)
+	} else {
+		r.gauge.Set(0)
+	}
+	if (previous == Master) == (state == Master) && previous != Init {
+		return
+	}
+	for _, ch := range r.changes {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- state == Master
+	}
+}
+
+// send sends an advert with the VIPs.
+func (r *Router) send(priority uint8) {
+	vips := r.vips()
+	sort.Slice(vips, func(i, j int) bool { return bytes.Compare(vips[i].To4(), vips[j].To4()) < 0 })
+	err := r.transport.Send(Advert{VRID: r.config.VRID, Priority: priority, Interval: r.config.Interval, Addresses: vips})
+	if err != nil {
+		r.logger.Errorf("vrrp: unable to send advert. %v", err)
+	}
+}
+
+// skew is the skew time of RFC 5798 section 6.1, by which directors of
+// higher priority take over first.
+func (r *Router) skew() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	return time.Duration(256-int(r.config.Priority)) * r.masterAdverts / 256
+}
+
+// masterDown is how long a backup waits on the master before taking over.
+func (r *Router) masterDown() time.Duration {
+	skew := r.skew()
+	r.Lock()
+	defer r.Unlock()
+	return 3*r.masterAdverts + skew
+}
+
+// reset restarts a timer that may have fired.
+func reset(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
@@ -0,0 +1,368 @@
+package vrrp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// network delivers the adverts of each router to the others.
+type network struct {
+	sync.Mutex
+	ports map[string]*port
+}
+
+type port struct {
+	net    *network
+	source net.IP
+	in     chan Advert
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (n *network) attach(source string) *port {
+	n.Lock()
+	defer n.Unlock()
+	p := &port{net: n, source: net.ParseIP(source), in: make(chan Advert, 64), closed: make(chan struct{})}
+	n.ports[source] = p
+	return p
+}
+
+func (p *port) Send(a Advert) error {
+	// through the wire format, as the group would carry it
+	a, err := parseAdvert(a.marshal(p.source, Group), p.source, Group)
+	if err != nil {
+		return err
+	}
+	p.net.Lock()
+	defer p.net.Unlock()
+	for source, other := range p.net.ports {
+		if source == p.source.String() {
+			continue
+		}
+		select {
+		case other.in <- a:
+		default:
+		}
+	}
+	return nil
+}
+
+func (p *port) Receive() (Advert, error) {
+	select {
+	case a := <-p.in:
+		return a, nil
+	case <-p.closed:
+		return Advert{}, errors.New("closed")
+	}
+}
+
+func (p *port) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	p.net.Lock()
+	delete(p.net.ports, p.source.String())
+	p.net.Unlock()
+	return nil
+}
+
+// claims is a fence shared by the routers of a test.
+type claims struct {
+	sync.Mutex
+	holder string
+}
+
+// claim is a router's end of the shared fence.
+type claim struct {
+	*claims
+	self string
+}
+
+func (c claim) Claim(context.Context) (int64, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.holder != "" && c.holder != c.self {
+		return 0, errors.New("held by " + c.holder)
+	}
+	c.holder = c.self
+	return 1, nil
+}
+
+func (c claim) Renew(context.Context) error {
+	if !c.Valid() {
+		return errors.New("lost")
+	}
+	return nil
+}
+
+func (c claim) Release(context.Context) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.holder == c.self {
+		c.holder = ""
+	}
+	return nil
+}
+
+func (c claim) Valid() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.holder == c.self
+}
+
+func (c claim) RenewInterval() time.Duration { return 20 * time.Millisecond }
+
+func newRouter(t *testing.T, n *network, address string, priority uint8, preempt bool) *Router {
+	return newFencedRouter(t, n, address, priority, preempt, nil)
+}
+
+func newFencedRouter(t *testing.T, n *network, address string, priority uint8, preempt bool, fence Fence) *Router {
+	vips := func() []net.IP { return []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.1")} }
+	r, err := New(Config{VRID: 7, Priority: priority, Preempt: preempt, Interval: 20 * time.Millisecond, Address: net.ParseIP(address), Fence: fence}, n.attach(address), vips, stats.KindIpvsMaster, "green", logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	n := &network{ports: map[string]*port{}}
+	high := newRouter(t, n, "192.0.2.2", 200, true)
+	low := newRouter(t, n, "192.0.2.1", 100, true)
+
+	ctxHigh, stopHigh := context.WithCancel(context.Background())
+	ctxLow, stopLow := context.WithCancel(context.Background())
+	defer stopLow()
+	go high.Run(ctxHigh)
+	go low.Run(ctxLow)
+
+	waitFor(t, "the higher priority to be master", func() bool { return high.Master() && !low.Master() })
+	if changed := <-high.Changes(); !changed {
+		t.Fatal("expected the master to be told it holds the VIPs")
+	}
+
+	// the master gives up on stop, and the backup takes over within the
+	// skew time rather than the master down interval
+	stopped := time.Now()
+	stopHigh()
+	waitFor(t, "the backup to take over", low.Master)
+	if took := time.Since(stopped); took >= 3*20*time.Millisecond {
+		t.Fatalf("expected the backup to take over within the skew time, took %v", took)
+	}
+	if status := low.Health(context.Background()); !status.Ready || status.Message != "master" {
+		t.Fatalf("unexpected health %+v", status)
+	}
+
+	// a returning director of higher priority preempts
+	high = newRouter(t, n, "192.0.2.2", 200, true)
+	ctxHigh, stopHigh = context.WithCancel(context.Background())
+	defer stopHigh()
+	go high.Run(ctxHigh)
+	waitFor(t, "the higher priority to preempt", func() bool { return high.Master() && !low.Master() })
+}
+
+func TestNoPreempt(t *testing.T) {
+	n := &network{ports: map[string]*port{}}
+	low := newRouter(t, n, "192.0.2.1", 100, false)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go low.Run(ctx)
+	waitFor(t, "the only director to be master", low.Master)
+
+	// without preemption, the master keeps the VIPs as long as it is
+	// heard from
+	high := newRouter(t, n, "192.0.2.2", 200, false)
+	go high.Run(ctx)
+	time.Sleep(200 * time.Millisecond)
+	if !low.Master() || high.Master() {
+		t.Fatal("expected the first master to keep the VIPs")
+	}
+	if status := high.Health(context.Background()); status.Message != "backup of 192.0.2.1" {
+		t.Fatalf("unexpected health %+v", status)
+	}
+}
+
+func TestEqualPriority(t *testing.T) {
+	n := &network{ports: map[string]*port{}}
+	a := newRouter(t, n, "192.0.2.1", 255, true)
+	b := newRouter(t, n, "192.0.2.9", 255, true)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go a.Run(ctx)
+	go b.Run(ctx)
+	// both own the VIPs and start as master, and the higher address wins
+	waitFor(t, "the higher address to be master", func() bool { return b.Master() && !a.Master() })
+}
+
+func TestStandbyOrder(t *testing.T) {
+	n := &network{ports: map[string]*port{}}
+	primary := newRouter(t, n, "192.0.2.1", 200, true)
+	next := newRouter(t, n, "192.0.2.2", 150, true)
+	last := newRouter(t, n, "192.0.2.3", 100, true)
+	ctxPrimary, stopPrimary := context.WithCancel(context.Background())
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go primary.Run(ctxPrimary)
+	go next.Run(ctx)
+	go last.Run(ctx)
+	waitFor(t, "the primary to be master", func() bool { return primary.Master() && !next.Master() && !last.Master() })
+
+	// the next in line takes over, whatever the addresses
+	stopPrimary()
+	waitFor(t, "the next in line to take over", func() bool { return next.Master() && !last.Master() })
+	status := next.Health(ctx)
+	if role, ok := status.Detail.(Role); !ok || role.State != "master" || role.Priority != 150 {
+		t.Fatalf("unexpected health %+v", status)
+	}
+
+	// a returning primary waits out the preempt delay before failing back
+	primary = newRouter(t, n, "192.0.2.1", 200, true)
+	primary.config.PreemptDelay = 200 * time.Millisecond
+	go primary.Run(ctx)
+	time.Sleep(100 * time.Millisecond)
+	if primary.Master() || !next.Master() {
+		t.Fatal("expected the primary to hold off within the preempt delay")
+	}
+	waitFor(t, "the primary to fail back", func() bool { return primary.Master() && !next.Master() })
+}
+
+// withdraw stands in for the director, withdrawing the VIPs whenever the
+// router stops being master.
+func withdraw(ctx context.Context, r *Router) {
+	changes := r.Changes()
+	for {
+		select {
+		case master := <-changes:
+			if !master {
+				r.Withdrawn(ctx)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func TestFence(t *testing.T) {
+	shared := &claims{}
+	// the directors can't hear each other, so both would be master
+	high := newFencedRouter(t, &network{ports: map[string]*port{}}, "192.0.2.2", 200, true, claim{shared, "high"})
+	low := newFencedRouter(t, &network{ports: map[string]*port{}}, "192.0.2.1", 100, true, claim{shared, "low"})
+
+	ctxHigh, stopHigh := context.WithCancel(context.Background())
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go high.Run(ctxHigh)
+	waitFor(t, "the first director to be master", high.Master)
+	go low.Run(ctx)
+	go withdraw(ctx, low)
+
+	time.Sleep(200 * time.Millisecond)
+	if low.Master() {
+		t.Fatal("expected the fence to keep the second director backup")
+	}
+
+	// the claim passes over once the master has withdrawn
+	stopHigh()
+	waitFor(t, "the first director to stop", func() bool { return !high.Master() })
+	high.Withdrawn(context.Background())
+	waitFor(t, "the second director to claim the VIPs", low.Master)
+
+	// a director losing its claim steps down
+	shared.Lock()
+	shared.holder = "someone-else"
+	shared.Unlock()
+	waitFor(t, "the director to step down", func() bool { return !low.Master() })
+}
+
+func TestFencedPreempt(t *testing.T) {
+	n := &network{ports: map[string]*port{}}
+	shared := &claims{}
+	low := newFencedRouter(t, n, "192.0.2.1", 100, true, claim{shared, "low"})
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go low.Run(ctx)
+	go withdraw(ctx, low)
+	waitFor(t, "the only director to be master", low.Master)
+
+	// the returning director can't claim the VIPs until they are
+	// withdrawn, but its adverts make the master step down
+	high := newFencedRouter(t, n, "192.0.2.2", 200, true, claim{shared, "high"})
+	go high.Run(ctx)
+	waitFor(t, "the higher priority to preempt", func() bool { return high.Master() && !low.Master() })
+}
+
+func TestHold(t *testing.T) {
+	n := &network{ports: map[string]*port{}}
+	high := newRouter(t, n, "192.0.2.2", 200, true)
+	low := newRouter(t, n, "192.0.2.1", 100, true)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go high.Run(ctx)
+	go low.Run(ctx)
+	waitFor(t, "the higher priority to be master", func() bool { return high.Master() && !low.Master() })
+
+	// a held master steps down within the skew time, and stays backup
+	high.Hold(true)
+	waitFor(t, "the held master to step down", func() bool { return low.Master() && !high.Master() })
+	time.Sleep(200 * time.Millisecond)
+	if high.Master() {
+		t.Fatal("expected the held director to stay backup")
+	}
+	if role := high.Health(ctx).Detail.(Role); !role.Held {
+		t.Fatalf("expected the health to report the hold, got %+v", role)
+	}
+
+	// a held backup doesn't take over from a master that goes quiet
+	low.Hold(true)
+	waitFor(t, "the held master to step down", func() bool { return !low.Master() })
+	time.Sleep(200 * time.Millisecond)
+	if high.Master() || low.Master() {
+		t.Fatal("expected held directors to stay backup")
+	}
+
+	// once released, the higher priority takes over again
+	low.Hold(false)
+	high.Hold(false)
+	waitFor(t, "the higher priority to take over", func() bool { return high.Master() && !low.Master() })
+}
+
+func TestAdvert(t *testing.T) {
+	src, dst := net.ParseIP("192.0.2.1"), Group
+	in := Advert{VRID: 7, Priority: 100, Interval: time.Second, Addresses: []net.IP{net.ParseIP("10.0.0.1")}}
+	b := in.marshal(src, dst)
+	out, err := parseAdvert(b, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.VRID != 7 || out.Priority != 100 || out.Interval != time.Second || len(out.Addresses) != 1 || !out.Addresses[0].Equal(in.Addresses[0]) {
+		t.Fatalf("unexpected advert %+v", out)
+	}
+
+	// the checksum covers the source
+	if _, err := parseAdvert(b, net.ParseIP("192.0.2.2"), dst); err == nil {
+		t.Fatal("expected a bad checksum")
+	}
+	b[0] = 2<<4 | typeAdvert
+	if _, err := parseAdvert(b, src, dst); err == nil {
+		t.Fatal("expected version 2 to be refused")
+	}
+
+	if err := (Config{VRID: 1, Priority: 100, Interval: time.Minute, Address: src}).Validate(); err == nil {
+		t.Fatal("expected an interval over 40.95s to be refused")
+	}
+}
@@ -0,0 +1,226 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// The loops of each worker run forever on tickers, so a loop stuck on a lock
+// or on an exec that never returns stops reconfiguring without anything else
+// noticing: the process stays live and health still reports the outcome of
+// the last reconfigure. Each loop beats once per cycle, and the watchdog
+// reports any loop that hasn't beaten within the deadline. It logs the stack
+// of every goroutine, so that the stuck call can be found, and bumps a stall
+// metric.
+//
+// A stuck goroutine can't be stopped from the outside, so restarting the
+// worker means restarting the process. When restarts are enabled the first
+// stall is sent on Stalled, and the mode exits with it. The worker isn't
+// stopped first: Stop would wait on the stuck loop, and tear down the VIPs the
+// worker serves. Its replacement takes over the configuration as it finds it.
+
+// DefaultDeadline is how long a loop may go without completing a cycle.
+const DefaultDeadline = 5 * time.Minute
+
+// maxStackSize bounds the goroutine dump logged on a stall.
+const maxStackSize = 4 << 20
+
+var (
+	stallTotalDef = stats.Define(stats.Definition{
+		Type:   stats.Counter,
+		Name:   "watchdog_stall_total",
+		Help:   "is a count of the times a worker loop went longer than the watchdog deadline without completing a cycle",
+		Labels: []string{"lb", "loop"},
+	})
+	stalledDef = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "watchdog_stalled",
+		Help:   "is 1 while a worker loop is past the watchdog deadline without completing a cycle, and 0 once it completes one",
+		Labels: []string{"lb", "loop"},
+	})
+)
+
+// Loop is a worker loop supervised by a Watchdog. A nil Loop, as returned
+// when no watchdog is running, does nothing.
+type Loop struct {
+	sync.Mutex
+	name string
+	w    *Watchdog
+
+	last    time.Time
+	stalled bool
+}
+
+// Beat records that the loop completed a cycle.
+func (l *Loop) Beat() {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	stalled, since := l.stalled, time.Since(l.last)
+	l.last = time.Now()
+	l.stalled = false
+	l.Unlock()
+
+	if stalled {
+		l.w.stalled.WithLabelValues(l.w.kind, l.name).Set(0)
+		l.w.logger.WithField("loop", l.name).Warnf("watchdog: %s completed a cycle after %v", l.name, since.Round(time.Second))
+	}
+}
+
+// Done stops supervising the loop, for loops that exit with their worker.
+func (l *Loop) Done() {
+	if l == nil {
+		return
+	}
+	l.w.Lock()
+	delete(l.w.loops, l)
+	l.w.Unlock()
+	l.w.stalled.WithLabelValues(l.w.kind, l.name).Set(0)
+}
+
+// Watchdog supervises the loops registered with it.
+type Watchdog struct {
+	sync.Mutex
+	kind     string
+	deadline time.Duration
+	restart  bool
+	logger   logging.Logger
+
+	loops  map[*Loop]struct{}
+	stalls chan error
+
+	stallTotal *prometheus.CounterVec
+	stalled    *prometheus.GaugeVec
+}
+
+// New returns a Watchdog that reports loops that go longer than deadline
+// without a beat, and sends the first stall on Stalled when restart is set.
+func New(kind stats.LBKind, deadline time.Duration, restart bool, logger logging.Logger) (*Watchdog, error) {
+	if deadline <= 0 {
+		return nil, fmt.Errorf("watchdog deadline must be positive")
+	}
+	return &Watchdog{
+		kind:       string(kind),
+		deadline:   deadline,
+		restart:    restart,
+		logger:     logger.WithFields(logging.Fields{"module": "watchdog"}),
+		loops:      map[*Loop]struct{}{},
+		stalls:     make(chan error, 1),
+		stallTotal: stallTotalDef.CounterVec(),
+		stalled:    stalledDef.GaugeVec(),
+	}, nil
+}
+
+// Register starts supervising a loop. The loop must Beat at least once per
+// deadline from here on.
+func (w *Watchdog) Register(name string) *Loop {
+	if w == nil {
+		return nil
+	}
+	l := &Loop{name: name, w: w, last: time.Now()}
+	w.Lock()
+	w.loops[l] = struct{}{}
+	w.Unlock()
+	w.stalled.WithLabelValues(w.kind, name).Set(0)
+	return l
+}
+
+// Stalled receives the first stall when restarts are enabled. It never
+// receives for a nil Watchdog.
+func (w *Watchdog) Stalled() <-chan error {
+	if w == nil {
+		return nil
+	}
+	return w.stalls
+}
+
+// Run checks the loops several times per deadline until ctx is done.
+func (w *Watchdog) Run(ctx context.Context) {
+	t := time.NewTicker(w.deadline / 4)
+	defer t.Stop()
+	w.logger.Infof("watchdog: supervising worker loops with a deadline of %v", w.deadline)
+	for {
+		select {
+		case <-t.C:
+			w.check(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check reports each loop that has gone past the deadline since its last
+// beat. A loop is reported once per stall.
+func (w *Watchdog) check(now time.Time) {
+	w.Lock()
+	loops := make([]*Loop, 0, len(w.loops))
+	for l := range w.loops {
+		loops = append(loops, l)
+	}
+	w.Unlock()
+	sort.Slice(loops, func(i, j int) bool { return loops[i].name < loops[j].name })
+
+	stalled := []string{}
+	for _, l := range loops {
+		l.Lock()
+		since := now.Sub(l.last)
+		fresh := since > w.deadline && !l.stalled
+		if fresh {
+			l.stalled = true
+		}
+		l.Unlock()
+		if !fresh {
+			continue
+		}
+		w.stallTotal.WithLabelValues(w.kind, l.name).Inc()
+		w.stalled.WithLabelValues(w.kind, l.name).Set(1)
+		w.logger.WithField("loop", l.name).Errorf("watchdog: %s has not completed a cycle in %v", l.name, since.Round(time.Second))
+		stalled = append(stalled, fmt.Sprintf("%s for %v", l.name, since.Round(time.Second)))
+	}
+	if len(stalled) == 0 {
+		return
+	}
+
+	w.logger.Errorf("watchdog: goroutine stacks\n%s", stacks())
+	if w.restart {
+		select {
+		case w.stalls <- fmt.Errorf("watchdog: worker loops stalled: %v. restarting", stalled):
+		default:
+		}
+	}
+}
+
+// stacks returns the stack of every goroutine.
+func stacks() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= maxStackSize {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+var std *Watchdog
+
+// SetDefault sets the watchdog loops are registered with by Register.
+func SetDefault(w *Watchdog) {
+	std = w
+}
+
+// Register starts supervising a loop with the default watchdog. It returns a
+// nil Loop when none is set.
+func Register(name string) *Loop {
+	return std.Register(name)
+}
@@ -0,0 +1,79 @@
+package watchdog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+func TestWatchdog(t *testing.T) {
+	if _, err := New(stats.KindBGPDirector, 0, false, logging.New()); err == nil {
+		t.Fatal("expected a zero deadline to be rejected")
+	}
+
+	w, err := New(stats.KindBGPDirector, time.Minute, true, logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	periodic := w.Register("bgp.periodic")
+	watches := w.Register("bgp.watches")
+
+	stalls := func(loop string) float64 {
+		return testutil.ToFloat64(w.stallTotal.WithLabelValues(string(stats.KindBGPDirector), loop))
+	}
+	stalled := func(loop string) float64 {
+		return testutil.ToFloat64(w.stalled.WithLabelValues(string(stats.KindBGPDirector), loop))
+	}
+
+	// within the deadline
+	w.check(time.Now().Add(30 * time.Second))
+	if stalls("bgp.periodic") != 0 || len(w.Stalled()) != 0 {
+		t.Fatal("expected no stall within the deadline")
+	}
+
+	// periodic is stuck, and watches keeps beating
+	watches.last = time.Now().Add(2 * time.Minute)
+	now := time.Now().Add(90 * time.Second)
+	w.check(now)
+	w.check(now)
+	if stalls("bgp.periodic") != 1 || stalled("bgp.periodic") != 1 {
+		t.Fatalf("expected one stall of bgp.periodic, saw %v", stalls("bgp.periodic"))
+	}
+	if stalls("bgp.watches") != 0 {
+		t.Fatal("expected bgp.watches not to stall")
+	}
+	select {
+	case err := <-w.Stalled():
+		if err == nil {
+			t.Fatal("expected the stall as an error")
+		}
+	default:
+		t.Fatal("expected a stall to be sent with restarts enabled")
+	}
+
+	// periodic recovers
+	periodic.Beat()
+	if stalled("bgp.periodic") != 0 {
+		t.Fatal("expected bgp.periodic to recover after a beat")
+	}
+
+	// a loop that exits with its worker is no longer supervised
+	periodic.Done()
+	w.check(time.Now().Add(time.Hour))
+	if stalls("bgp.periodic") != 1 {
+		t.Fatal("expected no stall of a loop that is done")
+	}
+
+	// without a watchdog, loops are no-ops
+	var none *Watchdog
+	l := none.Register("realserver.periodic")
+	l.Beat()
+	l.Done()
+	if none.Stalled() != nil {
+		t.Fatal("expected a nil channel without a watchdog")
+	}
+}
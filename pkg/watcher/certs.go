@@ -0,0 +1,98 @@
+package watcher
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	log "github.com/Comcast/Ravel/pkg/logging"
+)
+
+// Services can terminate TLS on their v6 listeners with a certificate from a
+// kubernetes.io/tls secret. Secrets aren't watched, as that would take access
+// to every secret in the cluster; the ones the cluster config refers to are
+// read when they are needed and kept for certRefresh, so that a rotated
+// certificate is picked up within that long. A secret that can't be read
+// keeps serving the certificate it last had.
+
+// certRefresh is how long a secret is used before it is read again.
+const certRefresh = time.Minute
+
+// certTimeout bounds reading a secret.
+const certTimeout = 10 * time.Second
+
+type certEntry struct {
+	pem     string
+	fetched time.Time
+}
+
+type certCache struct {
+	sync.Mutex
+	get     func(ctx context.Context, namespace, name string) (*v1.Secret, error)
+	entries map[string]certEntry
+}
+
+func newCertCache(get func(ctx context.Context, namespace, name string) (*v1.Secret, error)) *certCache {
+	return &certCache{get: get, entries: map[string]certEntry{}}
+}
+
+// TLSCertificate returns the certificate chain and key of a kubernetes.io/tls
+// secret as a single PEM bundle, the way haproxy takes them. The secret is
+// "name" in namespace, or "namespace/name".
+func (w *Watcher) TLSCertificate(namespace, secret string) (string, error) {
+	if w.certs == nil {
+		return "", fmt.Errorf("no kubernetes client to read secret %s", secret)
+	}
+	return w.certs.certificate(namespace, secret, time.Now())
+}
+
+func (c *certCache) certificate(namespace, secret string, now time.Time) (string, error) {
+	if i := strings.Index(secret, "/"); i >= 0 {
+		namespace, secret = secret[:i], secret[i+1:]
+	}
+	key := namespace + "/" + secret
+
+	c.Lock()
+	defer c.Unlock()
+	entry, found := c.entries[key]
+	if found && now.Sub(entry.fetched) < certRefresh {
+		return entry.pem, nil
+	}
+
+	pem, err := c.read(namespace, secret)
+	if err != nil {
+		if found {
+			// try again on the next call rather than waiting out the refresh
+			log.Warningln("watcher: keeping the last certificate of secret", key, "after a failed refresh.", err)
+			return entry.pem, nil
+		}
+		return "", err
+	}
+	c.entries[key] = certEntry{pem: pem, fetched: now}
+	return pem, nil
+}
+
+func (c *certCache) read(namespace, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), certTimeout)
+	defer cancel()
+	s, err := c.get(ctx, namespace, name)
+	if err != nil {
+		return "", fmt.Errorf("unable to read secret %s/%s. %v", namespace, name, err)
+	}
+	cert, key := s.Data[v1.TLSCertKey], s.Data[v1.TLSPrivateKeyKey]
+	if _, err := tls.X509KeyPair(cert, key); err != nil {
+		return "", fmt.Errorf("secret %s/%s does not hold a valid certificate and key. %v", namespace, name, err)
+	}
+	return strings.TrimSpace(string(cert)) + "\n" + strings.TrimSpace(string(key)) + "\n", nil
+}
+
+// getSecret reads a secret from the cluster.
+func (w *Watcher) getSecret(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	return w.clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
@@ -0,0 +1,161 @@
+package watcher
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/Comcast/Ravel/pkg/audit"
+	log "github.com/Comcast/Ravel/pkg/logging"
+)
+
+// Every update the watcher receives is assigned a correlation ID. Updates to
+// services, endpoints and the configmap are batched into one cluster config
+// publish, so they share the ID of the batch they land in; node updates are
+// published as they arrive and each get their own. Workers attach the ID of
+// the most recent publish to the logs, spans and audit events of the
+// reconfigure that applies it, and the publishes are kept so that an ID can be
+// resolved back to the updates behind it.
+
+// publicationsSize is the number of publishes kept for lookup.
+const publicationsSize = 100
+
+// Update is a single watch event.
+type Update struct {
+	Time      time.Time       `json:"time"`
+	Source    string          `json:"source"`
+	Type      watch.EventType `json:"type"`
+	Namespace string          `json:"namespace,omitempty"`
+	Name      string          `json:"name"`
+}
+
+// Publication is a set of updates published to the workers together.
+type Publication struct {
+	CorrelationID string    `json:"correlation_id"`
+	Time          time.Time `json:"time"`
+	// Kind is config for a cluster config publish, or nodes.
+	Kind       string   `json:"kind"`
+	ConfigHash string   `json:"config_hash,omitempty"`
+	Updates    []Update `json:"updates"`
+}
+
+type changes struct {
+	sync.Mutex
+
+	// the ID and updates of the batch waiting to be published.
+	pendingID string
+	pending   []Update
+
+	// the ID of the last publish that changed what workers apply.
+	current string
+
+	publications []Publication
+}
+
+// received assigns an ID to an update and logs it. Node updates are published
+// immediately, and the rest join the pending batch.
+func (c *changes) received(source string, eventType watch.EventType, namespace, name string, logger log.Logger) {
+	u := Update{Time: time.Now(), Source: source, Type: eventType, Namespace: namespace, Name: name}
+
+	c.Lock()
+	var id string
+	if source == "nodes" {
+		id = audit.NewCorrelationID()
+		c.add(Publication{CorrelationID: id, Time: u.Time, Kind: "nodes", Updates: []Update{u}})
+	} else {
+		if c.pendingID == "" {
+			c.pendingID = audit.NewCorrelationID()
+		}
+		id = c.pendingID
+		c.pending = append(c.pending, u)
+	}
+	c.Unlock()
+
+	logger.WithFields(log.Fields{
+		"correlation_id": id,
+		"source":         source,
+		"type":           eventType,
+		"namespace":      namespace,
+		"name":           name,
+	}).Debug("watcher: received update")
+}
+
+// published records a cluster config publish and returns its ID. A publish
+// that leaves the config unchanged, such as a resync, keeps the current ID so
+// that reconfigures stay attributed to the updates that changed the config;
+// the updates in its batch changed nothing, and are only in the log.
+func (c *changes) published(hash, lastHash string) string {
+	c.Lock()
+	defer c.Unlock()
+
+	id, updates := c.pendingID, c.pending
+	c.pendingID, c.pending = "", nil
+	if hash == lastHash && c.current != "" {
+		return c.current
+	}
+	if id == "" {
+		id = audit.NewCorrelationID()
+	}
+	c.add(Publication{CorrelationID: id, Time: time.Now(), Kind: "config", ConfigHash: hash, Updates: updates})
+	return id
+}
+
+func (c *changes) add(p Publication) {
+	if p.Updates == nil {
+		p.Updates = []Update{}
+	}
+	c.current = p.CorrelationID
+	c.publications = append(c.publications, p)
+	if len(c.publications) > publicationsSize {
+		c.publications = c.publications[len(c.publications)-publicationsSize:]
+	}
+}
+
+// CorrelationID returns the ID of the most recent publish that changed the
+// cluster config or the nodes.
+func (w *Watcher) CorrelationID() string {
+	w.changes.Lock()
+	defer w.changes.Unlock()
+	return w.changes.current
+}
+
+// Publications returns the recent publishes, oldest first. A non-empty
+// correlationID returns only the publish with that ID.
+func (w *Watcher) Publications(correlationID string) []Publication {
+	w.changes.Lock()
+	defer w.changes.Unlock()
+	out := []Publication{}
+	for _, p := range w.changes.publications {
+		if correlationID == "" || p.CorrelationID == correlationID {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// ChangesHandler serves the recent publishes and their updates as json, for
+// the admin endpoint:
+//
+//	GET /changes[?correlation_id=0123456789abcdef][&limit=10]
+func (w *Watcher) ChangesHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		limit := 0
+		if l := r.URL.Query().Get("limit"); l != "" {
+			var err error
+			if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+				http.Error(rw, "invalid limit "+strconv.Quote(l), http.StatusBadRequest)
+				return
+			}
+		}
+		out := w.Publications(r.URL.Query().Get("correlation_id"))
+		if limit > 0 && len(out) > limit {
+			out = out[len(out)-limit:]
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(out)
+	})
+}
@@ -0,0 +1,234 @@
+package watcher
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	log "github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// Most updates the watcher receives change nothing that workers apply: an
+// endpoints resync, or a configmap rewritten with the same content. Churn
+// compares how often updates arrive with how often the published config hash
+// actually changes, so that a config generator rewriting the configmap in a
+// loop can be told apart from a busy cluster.
+//
+// It also watches the VIPs in each changed config. A VIP that is removed and
+// added back, again and again, usually means two generators are fighting over
+// the configmap. Every return or removal of a VIP within flapWindow of its
+// last one is counted as a flap, and a VIP with flapThreshold of them inside
+// the window is reported as flapping until it settles.
+
+const (
+	// churnWindow is the window the per-minute rates are taken over.
+	churnWindow = time.Minute
+
+	// flapWindow is how long a VIP has to stay put for a change to it not to
+	// count as a flap.
+	flapWindow = 10 * time.Minute
+
+	// flapThreshold is how many flaps within flapWindow make a VIP flapping.
+	flapThreshold = 3
+)
+
+var (
+	configPublishDef = stats.Define(stats.Definition{
+		Type:   stats.Counter,
+		Name:   "config_publish_total",
+		Help:   "is a count of cluster config publishes, with labels denoting whether the config hash changed|unchanged",
+		Labels: []string{"lb", "seczone", "outcome"},
+	})
+	vipFlapsDef = stats.Define(stats.Definition{
+		Type:   stats.Counter,
+		Name:   "config_vip_flaps_total",
+		Help:   "is a count of the times a VIP was added back to or removed from the cluster config within 10 minutes of its last change",
+		Labels: []string{"lb", "seczone", "vip"},
+	})
+	updatesPerMinuteDesc = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "config_updates_per_minute",
+		Help:   "is the number of service, endpoints and configmap updates received in the last minute",
+		Labels: []string{"lb", "seczone"},
+	}).Desc()
+	changesPerMinuteDesc = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "config_changes_per_minute",
+		Help:   "is the number of cluster config publishes in the last minute that changed the config hash",
+		Labels: []string{"lb", "seczone"},
+	}).Desc()
+	vipFlappingDesc = stats.Define(stats.Definition{
+		Type:   stats.Gauge,
+		Name:   "config_vip_flapping",
+		Help:   "is 1 for each VIP that flapped 3 or more times in the last 10 minutes",
+		Labels: []string{"lb", "seczone", "vip"},
+	}).Desc()
+)
+
+// churn tracks the rate of updates and config changes, and the VIPs that
+// flap. A nil churn, as in a Watcher built without NewWatcher, does nothing.
+type churn struct {
+	sync.Mutex
+	kind    string
+	secZone string
+	logger  log.Logger
+
+	updates []time.Time
+	changes []time.Time
+
+	// the VIPs of the last changed config, and the recent flaps of each VIP.
+	vips  map[string]bool
+	flaps map[string][]time.Time
+	// when each VIP was last added or removed.
+	lastChange map[string]time.Time
+
+	publishes *prometheus.CounterVec
+	vipFlaps  *prometheus.CounterVec
+}
+
+func newChurn(kind, secZone string, logger log.Logger) *churn {
+	return &churn{
+		kind:       kind,
+		secZone:    secZone,
+		logger:     logger,
+		flaps:      map[string][]time.Time{},
+		lastChange: map[string]time.Time{},
+		publishes:  configPublishDef.CounterVec(),
+		vipFlaps:   vipFlapsDef.CounterVec(),
+	}
+}
+
+// received records an update that feeds the cluster config.
+func (c *churn) received(now time.Time) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.updates = append(prune(c.updates, now.Add(-churnWindow)), now)
+}
+
+// published records a cluster config publish, and looks for flapping VIPs
+// when the config changed.
+// counter config_publish_total
+// counter config_vip_flaps_total
+func (c *churn) published(cc *types.ClusterConfig, changed bool, now time.Time) {
+	if c == nil {
+		return
+	}
+	outcome := "unchanged"
+	if changed {
+		outcome = "changed"
+	}
+	c.publishes.With(prometheus.Labels{"lb": c.kind, "seczone": c.secZone, "outcome": outcome}).Inc()
+	if !changed {
+		return
+	}
+
+	vips := map[string]bool{}
+	for vip := range cc.Config {
+		vips[string(vip)] = true
+	}
+	for vip := range cc.Config6 {
+		vips[string(vip)] = true
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.changes = append(prune(c.changes, now.Add(-churnWindow)), now)
+
+	// the first config is where the VIPs start from
+	last := c.vips
+	c.vips = vips
+	if last == nil {
+		return
+	}
+	for _, vip := range diffVIPs(last, vips) {
+		prev, ok := c.lastChange[vip]
+		c.lastChange[vip] = now
+		if !ok || now.Sub(prev) > flapWindow {
+			continue
+		}
+		c.vipFlaps.With(prometheus.Labels{"lb": c.kind, "seczone": c.secZone, "vip": vip}).Inc()
+		c.flaps[vip] = append(prune(c.flaps[vip], now.Add(-flapWindow)), now)
+		if len(c.flaps[vip]) == flapThreshold {
+			c.logger.WithField("vip", vip).Warnf("watcher: vip %s flapped %d times in %v. the configmap may have more than one writer", vip, flapThreshold, flapWindow)
+		}
+	}
+}
+
+// flapping returns the VIPs with flapThreshold or more flaps in the window,
+// and forgets VIPs that have settled.
+func (c *churn) flapping(now time.Time) []string {
+	out := []string{}
+	for vip, flaps := range c.flaps {
+		flaps = prune(flaps, now.Add(-flapWindow))
+		if len(flaps) == 0 {
+			delete(c.flaps, vip)
+			continue
+		}
+		c.flaps[vip] = flaps
+		if len(flaps) >= flapThreshold {
+			out = append(out, vip)
+		}
+	}
+	for vip, t := range c.lastChange {
+		if now.Sub(t) > flapWindow {
+			delete(c.lastChange, vip)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Describe implements prometheus.Collector.
+func (c *churn) Describe(ch chan<- *prometheus.Desc) {
+	ch <- updatesPerMinuteDesc
+	ch <- changesPerMinuteDesc
+	ch <- vipFlappingDesc
+}
+
+// Collect implements prometheus.Collector. The rates are taken at the time of
+// the scrape, so that they fall back to 0 once updates stop.
+func (c *churn) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	c.Lock()
+	c.updates = prune(c.updates, now.Add(-churnWindow))
+	c.changes = prune(c.changes, now.Add(-churnWindow))
+	updates, changes := len(c.updates), len(c.changes)
+	flapping := c.flapping(now)
+	c.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(updatesPerMinuteDesc, prometheus.GaugeValue, float64(updates), c.kind, c.secZone)
+	ch <- prometheus.MustNewConstMetric(changesPerMinuteDesc, prometheus.GaugeValue, float64(changes), c.kind, c.secZone)
+	for _, vip := range flapping {
+		ch <- prometheus.MustNewConstMetric(vipFlappingDesc, prometheus.GaugeValue, 1, c.kind, c.secZone, vip)
+	}
+}
+
+// diffVIPs returns the VIPs in only one of a and b.
+func diffVIPs(a, b map[string]bool) []string {
+	out := []string{}
+	for vip := range a {
+		if !b[vip] {
+			out = append(out, vip)
+		}
+	}
+	for vip := range b {
+		if !a[vip] {
+			out = append(out, vip)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// prune drops the times before since from a sorted slice.
+func prune(times []time.Time, since time.Time) []time.Time {
+	i := sort.Search(len(times), func(i int) bool { return !times[i].Before(since) })
+	return times[i:]
+}
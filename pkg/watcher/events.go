@@ -0,0 +1,91 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The watcher posts a warning event on the configmap when it can't use its
+// config key, for whoever edited it to see with kubectl describe configmap.
+// The config is built again on every update the watcher receives, so an
+// event is posted once for each version of the configmap and problem.
+
+const (
+	// EventInvalidConfig is the reason of the events of configs rejected.
+	EventInvalidConfig = "InvalidClusterConfig"
+
+	// maxEventMessage bounds the message of an event, as kubectl shows it.
+	maxEventMessage = 1024
+)
+
+// configEvent posts a warning event with message on cm, unless the same was
+// posted for this version of cm.
+func (w *Watcher) configEvent(cm *v1.ConfigMap, message string) {
+	if cm == nil {
+		return
+	}
+	w.eventMu.Lock()
+	key := cm.ResourceVersion + " " + message
+	if key == w.lastEvent {
+		w.eventMu.Unlock()
+		return
+	}
+	w.lastEvent = key
+	post := w.postEvent
+	w.eventMu.Unlock()
+
+	if post == nil {
+		if w.clientset == nil {
+			return
+		}
+		post = func(ctx context.Context, e *v1.Event) error {
+			_, err := w.clientset.CoreV1().Events(e.Namespace).Create(ctx, e, metav1.CreateOptions{})
+			return err
+		}
+	}
+
+	if len(message) > maxEventMessage {
+		message = message[:maxEventMessage-3] + "..."
+	}
+	host, _ := os.Hostname()
+	now := metav1.Now()
+	e := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: cm.Name + ".", Namespace: cm.Namespace},
+		InvolvedObject: v1.ObjectReference{
+			APIVersion:      "v1",
+			Kind:            "ConfigMap",
+			Namespace:       cm.Namespace,
+			Name:            cm.Name,
+			UID:             cm.UID,
+			ResourceVersion: cm.ResourceVersion,
+			FieldPath:       fmt.Sprintf("data[%s]", w.ConfigKey),
+		},
+		Reason:              EventInvalidConfig,
+		Message:             message,
+		Type:                v1.EventTypeWarning,
+		Source:              v1.EventSource{Component: "ravel", Host: host},
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+		ReportingController: "ravel",
+		ReportingInstance:   host,
+	}
+
+	// the watch loop mustn't wait on the apiserver
+	go func() {
+		ctx := w.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		if err := post(ctx, e); err != nil {
+			w.logger.Warnf("watcher: unable to post an event on configmap %s/%s. %v", cm.Namespace, cm.Name, err)
+		}
+	}()
+}
@@ -0,0 +1,145 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/Comcast/Ravel/pkg/heartbeat"
+	log "github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// A fed watcher takes its cluster config and node list from the config feed
+// of a director rather than watching the configmap and every node itself,
+// which in a large cluster is most of what the realservers ask of the API
+// server. It still watches services, endpoints and pods, which the
+// realserver reads for its own node. A fed watcher that loses the feed can
+// be switched back to its own watches, and back to the feed once it returns.
+//
+// Nodes go into the feed without their status images, managed fields and
+// condition heartbeats, so that a snapshot stays small and is only sent when
+// something a director or realserver reads has changed.
+
+// NewFedWatcher creates a Watcher that takes its cluster config and nodes from
+// ApplySnapshot.
+func NewFedWatcher(ctx context.Context, kubeConfigFile, cmNamespace, cmName, configKey, lbKind string, autoSvc string, autoPort int, logger log.Logger) (*Watcher, error) {
+	return newWatcher(ctx, kubeConfigFile, cmNamespace, cmName, configKey, lbKind, autoSvc, autoPort, true, logger)
+}
+
+// Fed switches the watcher between the feed and its own watches of the
+// configmap and nodes.
+func (w *Watcher) Fed(fed bool) {
+	w.feedMu.Lock()
+	if w.fed == fed {
+		w.feedMu.Unlock()
+		return
+	}
+	w.fed = fed
+	w.feedMu.Unlock()
+	if fed {
+		w.logger.Info("watcher: taking the cluster config and nodes from the config feed")
+	} else {
+		w.logger.Warn("watcher: watching the configmap and nodes instead of the config feed")
+	}
+	select {
+	case w.feedChan <- struct{}{}:
+	default:
+	}
+}
+
+// isFed reports whether the cluster config and nodes come from the feed.
+func (w *Watcher) isFed() bool {
+	w.feedMu.Lock()
+	defer w.feedMu.Unlock()
+	return w.fed
+}
+
+// Snapshot returns the cluster config and nodes of the watcher, for the
+// config feed.
+func (w *Watcher) Snapshot() (heartbeat.Snapshot, error) {
+	if w.ClusterConfig == nil {
+		return heartbeat.Snapshot{}, fmt.Errorf("no cluster config has been published yet")
+	}
+	cc, err := json.Marshal(w.ClusterConfig)
+	if err != nil {
+		return heartbeat.Snapshot{}, err
+	}
+	w.RLock()
+	nodes, err := json.Marshal(feedNodes(w.Nodes))
+	w.RUnlock()
+	if err != nil {
+		return heartbeat.Snapshot{}, err
+	}
+	generation, _ := w.Published()
+	return heartbeat.Snapshot{Generation: generation, ConfigHash: w.ConfigHash(), ClusterConfig: cc, Nodes: nodes}, nil
+}
+
+// ApplySnapshot publishes the cluster config and nodes of a snapshot from the
+// config feed. It is ignored unless the watcher is fed.
+func (w *Watcher) ApplySnapshot(s heartbeat.Snapshot) error {
+	if !w.isFed() {
+		return nil
+	}
+	cc := &types.ClusterConfig{}
+	if err := json.Unmarshal(s.ClusterConfig, cc); err != nil {
+		return fmt.Errorf("unable to decode the cluster config of generation %d. %v", s.Generation, err)
+	}
+	nodes := []*v1.Node{}
+	if err := json.Unmarshal(s.Nodes, &nodes); err != nil {
+		return fmt.Errorf("unable to decode the nodes of generation %d. %v", s.Generation, err)
+	}
+	w.Lock()
+	w.publishNodes(nodes)
+	w.Unlock()
+	if s.ConfigHash != "" && s.ConfigHash == w.ConfigHash() {
+		return nil
+	}
+	w.changes.received("feed", watch.Modified, w.ConfigMapNamespace, w.ConfigMapName, w.logger)
+	w.publishChan <- cc
+	return nil
+}
+
+// feedNodes returns copies of nodes with only what is read of them.
+func feedNodes(nodes []*v1.Node) []*v1.Node {
+	out := make([]*v1.Node, 0, len(nodes))
+	for _, n := range nodes {
+		node := &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        n.Name,
+				UID:         n.UID,
+				Labels:      n.Labels,
+				Annotations: n.Annotations,
+			},
+			Spec: n.Spec,
+			Status: v1.NodeStatus{
+				Addresses: n.Status.Addresses,
+			},
+		}
+		for _, c := range n.Status.Conditions {
+			c.LastHeartbeatTime = metav1.Time{}
+			node.Status.Conditions = append(node.Status.Conditions, c)
+		}
+		out = append(out, node)
+	}
+	return out
+}
+
+// idleWatch stands in for the configmap and node watches of a fed watcher.
+type idleWatch struct {
+	ch chan watch.Event
+}
+
+func newIdleWatch() *idleWatch {
+	return &idleWatch{ch: make(chan watch.Event)}
+}
+
+func (i *idleWatch) Stop() {}
+
+func (i *idleWatch) ResultChan() <-chan watch.Event {
+	return i.ch
+}
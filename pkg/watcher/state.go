@@ -0,0 +1,70 @@
+package watcher
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// NodeState is what the admin endpoint shows of a node.
+type NodeState struct {
+	Name          string   `json:"name"`
+	Addresses     []string `json:"addresses"`
+	IPV6          string   `json:"ipv6,omitempty"`
+	Ready         bool     `json:"ready"`
+	Unschedulable bool     `json:"unschedulable"`
+	// Maintenance and Unhealthy are the reason the node is in maintenance,
+	// and the faults its realserver reported, when they are
+	Maintenance string `json:"maintenance,omitempty"`
+	Unhealthy   string `json:"unhealthy,omitempty"`
+}
+
+// ConfigHandler serves the cluster config the workers apply, and its hash,
+// as json, for the admin endpoint:
+//
+//	GET /config
+func (w *Watcher) ConfigHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		out := struct {
+			Hash   string               `json:"hash"`
+			Config *types.ClusterConfig `json:"config"`
+		}{Hash: w.ConfigHash()}
+		w.RLock()
+		out.Config = w.ClusterConfig
+		b, err := json.Marshal(out)
+		w.RUnlock()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(b)
+	})
+}
+
+// NodesHandler serves the nodes the workers see, as json, for the admin
+// endpoint:
+//
+//	GET /nodes
+func (w *Watcher) NodesHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w.RLock()
+		out := []NodeState{}
+		for _, n := range w.Nodes {
+			state := NodeState{
+				Name:          n.Name,
+				Addresses:     types.Addresses(n),
+				IPV6:          types.IPV6(n),
+				Ready:         types.IsInReadyState(n),
+				Unschedulable: types.IsUnschedulable(n),
+			}
+			state.Maintenance, _ = types.InMaintenance(n)
+			state.Unhealthy, _ = types.RealServerUnhealthy(n)
+			out = append(out, state)
+		}
+		w.RUnlock()
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(out)
+	})
+}
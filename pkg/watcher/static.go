@@ -0,0 +1,60 @@
+package watcher
+
+import (
+	v1 "k8s.io/api/core/v1"
+
+	log "github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// A static watcher holds a listing of the cluster taken once rather than
+// watching it, for working out what a cluster config would do without
+// running a director or realserver. It publishes nothing.
+
+// NewStaticWatcher creates a Watcher of the services, endpoints, pods and
+// nodes listed, for the configKey of a configmap.
+func NewStaticWatcher(configKey string, autoSvc string, autoPort int, services []v1.Service, endpoints []v1.Endpoints, pods []v1.Pod, nodes []v1.Node, logger log.Logger) *Watcher {
+	w := &Watcher{
+		ConfigKey: configKey,
+
+		AllServices:   map[string]*v1.Service{},
+		AllEndpoints:  map[string]*v1.Endpoints{},
+		AllPods:       map[string]*v1.Pod{},
+		AllPodsByNode: map[string][]*v1.Pod{},
+
+		AutoSvc:  autoSvc,
+		AutoPort: autoPort,
+
+		Nodes: []*v1.Node{},
+
+		logger: logger.WithFields(log.Fields{"module": "watcher"}),
+	}
+	for ix := range services {
+		w.AllServices[services[ix].Namespace+"/"+services[ix].Name] = &services[ix]
+	}
+	for ix := range endpoints {
+		w.AllEndpoints[endpoints[ix].Namespace+"/"+endpoints[ix].Name] = &endpoints[ix]
+	}
+	for ix := range pods {
+		p := &pods[ix]
+		w.AllPods[p.Namespace+"/"+p.Name] = p
+		w.AllPodsByNode[p.Spec.NodeName] = append(w.AllPodsByNode[p.Spec.NodeName], p)
+	}
+	for ix := range nodes {
+		w.Nodes = append(w.Nodes, &nodes[ix])
+	}
+	return w
+}
+
+// Build returns the cluster config the watcher would publish for the config
+// key of cm, and holds it as the watcher's cluster config.
+func (w *Watcher) Build(cm *v1.ConfigMap) (*types.ClusterConfig, error) {
+	w.ConfigMapNamespace, w.ConfigMapName = cm.Namespace, cm.Name
+	w.ConfigMap = cm
+	cc, err := w.buildClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	w.ClusterConfig = cc
+	return cc, nil
+}
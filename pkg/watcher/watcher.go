@@ -5,6 +5,7 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"reflect"
@@ -21,9 +22,16 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 	watchtools "k8s.io/client-go/tools/watch"
 
+	"github.com/Comcast/Ravel/pkg/health"
+	log "github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/tracing"
 	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/validate"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Watcher defines an interface for a ConfigMap containing the desired configuration state
@@ -57,6 +65,11 @@ type Watcher struct {
 	configmaps watch.Interface
 	podChan    watch.Interface
 
+	// synced reports whether each watch has listed what it watches. Nothing
+	// is published until they all have, lest a partial view be programmed.
+	syncMu sync.Mutex
+	synced []cache.InformerSynced
+
 	// this is the 'official' configuration
 	ClusterConfig *types.ClusterConfig
 	Nodes         []*v1.Node
@@ -70,16 +83,68 @@ type Watcher struct {
 	// there's another error without an intervening successful event.
 	watchBackoffDuration time.Duration
 
-	publishChan chan *types.ClusterConfig
+	publishChan    chan *types.ClusterConfig
+	publishMetrics *stats.ChannelMetrics
+
+	// span contexts of the most recent watch event and cluster config publish.
+	// workers link their reconfigure spans to the publish that preceded them.
+	traceMu         sync.Mutex
+	lastEventSpan   trace.SpanContext
+	lastPublishSpan trace.SpanContext
+
+	// when and what cluster config was last published, for readiness and
+	// the audit trail.
+	publishMu    sync.Mutex
+	lastPublish  time.Time
+	publishCount uint64
+	configHash   string
+
+	// lenient has cluster configs that fail validation published as they
+	// parse rather than rejected, and rejected are the problems of the last
+	// one rejected.
+	rejectMu sync.Mutex
+	lenient  bool
+	rejected []validate.Problem
+
+	// lastEvent is the version of the configmap and message of the last
+	// event posted on it, and postEvent posts events in place of the
+	// clientset, if set.
+	eventMu   sync.Mutex
+	lastEvent string
+	postEvent func(context.Context, *v1.Event) error
+
+	// stages turn each cluster config built into the one published, in
+	// order, and built is the last one built.
+	stages []func(*types.ClusterConfig) *types.ClusterConfig
+	built  *types.ClusterConfig
+
+	// correlation IDs of the updates received and published.
+	changes changes
+
+	// how often updates arrive and the config changes, and the VIPs that flap.
+	churn *churn
+
+	// the tls secrets referenced by the cluster config.
+	certs *certCache
+
+	// fed is set while the cluster config and nodes come from the config
+	// feed, and feedChan has the watches restarted when it changes.
+	feedMu   sync.Mutex
+	fed      bool
+	feedChan chan struct{}
 
 	ctx     context.Context
-	logger  log.FieldLogger
+	logger  log.Logger
 	metrics WatcherMetrics
 }
 
 
 // NewWatcher creates a new Watcher struct, which is used to watch services, endpoints, and more
-func NewWatcher(ctx context.Context, kubeConfigFile, cmNamespace, cmName, configKey, lbKind string, autoSvc string, autoPort int, logger log.FieldLogger) (*Watcher, error) {
+func NewWatcher(ctx context.Context, kubeConfigFile, cmNamespace, cmName, configKey, lbKind string, autoSvc string, autoPort int, logger log.Logger) (*Watcher, error) {
+	return newWatcher(ctx, kubeConfigFile, cmNamespace, cmName, configKey, lbKind, autoSvc, autoPort, false, logger)
+}
+
+func newWatcher(ctx context.Context, kubeConfigFile, cmNamespace, cmName, configKey, lbKind string, autoSvc string, autoPort int, fed bool, logger log.Logger) (*Watcher, error) {
 
 	config, err := clientcmd.BuildConfigFromFlags("", kubeConfigFile)
 	if err != nil {
@@ -110,11 +175,18 @@ func NewWatcher(ctx context.Context, kubeConfigFile, cmNamespace, cmName, config
 		AutoSvc:  autoSvc,
 		AutoPort: autoPort,
 
-		publishChan: make(chan *types.ClusterConfig),
+		publishChan:    make(chan *types.ClusterConfig),
+		publishMetrics: stats.NewChannelMetrics(lbKind, stats.ChannelPublish),
+
+		fed:      fed,
+		feedChan: make(chan struct{}, 1),
 
 		logger:  logger.WithFields(log.Fields{"module": "watcher"}),
 		metrics: NewWatcherMetrics(lbKind, configKey),
 	}
+	w.churn = newChurn(lbKind, configKey, w.logger)
+	w.certs = newCertCache(w.getSecret)
+	prometheus.MustRegister(w.churn)
 	if err := w.initWatch(); err != nil {
 		log.Errorln("Failed to init watcher with error:", err)
 		return nil, err
@@ -152,6 +224,11 @@ func (w *Watcher) setAllPodsByNode(name string, val []*v1.Pod) {
 	w.AllPodsByNode[name] = val
 }
 
+// Clientset returns the kubernetes client the watcher uses.
+func (w *Watcher) Clientset() kubernetes.Interface {
+	return w.clientset
+}
+
 // StartDebugWebService starts an http server for pprof and other debugging
 func (w *Watcher) StartDebugWebServer() {
 	go func() {
@@ -323,8 +400,9 @@ func (w *Watcher) initWatch() error {
 
 	// TODO - optimize by limiting fields that are watched
 	serviceListWatcher := cache.NewListWatchFromClient(w.clientset.CoreV1().RESTClient(), "services", v1.NamespaceAll, fields.Everything())
-	_, _, servicesChan, _ := watchtools.NewIndexerInformerWatcher(serviceListWatcher, &v1.Service{})
+	_, servicesInformer, servicesChan, _ := watchtools.NewIndexerInformerWatcher(serviceListWatcher, &v1.Service{})
 	w.services = servicesChan
+	synced := []cache.InformerSynced{servicesInformer.HasSynced}
 
 	// services, err := w.clientset.CoreV1().Services("").Watch(w.ctx, metav1.ListOptions{})
 	// w.metrics.WatchErr("services", err)
@@ -333,8 +411,9 @@ func (w *Watcher) initWatch() error {
 	// }
 
 	endpointListWatcher := cache.NewListWatchFromClient(w.clientset.CoreV1().RESTClient(), "endpoints", v1.NamespaceAll, fields.Everything())
-	_, _, endpointChan, _ := watchtools.NewIndexerInformerWatcher(endpointListWatcher, &v1.Endpoints{})
+	_, endpointInformer, endpointChan, _ := watchtools.NewIndexerInformerWatcher(endpointListWatcher, &v1.Endpoints{})
 	w.endpoints = endpointChan
+	synced = append(synced, endpointInformer.HasSynced)
 
 	// endpoints, err := w.clientset.CoreV1().Endpoints("").Watch(w.ctx, metav1.ListOptions{})
 	// w.metrics.WatchErr("endpoints", err)
@@ -343,9 +422,16 @@ func (w *Watcher) initWatch() error {
 	// 	return fmt.Errorf("watcher: error starting watch on endpoints. %v", err)
 	// }
 
-	configmapListWatcher := cache.NewListWatchFromClient(w.clientset.CoreV1().RESTClient(), "configmaps", "platform-load-balancer", fields.Everything())
-	_, _, configmapChan, _ := watchtools.NewIndexerInformerWatcher(configmapListWatcher, &v1.ConfigMap{})
-	w.configmaps = configmapChan
+	// a fed watcher leaves the configmap and nodes to the director
+	fed := w.isFed()
+	if fed {
+		w.configmaps = newIdleWatch()
+	} else {
+		configmapListWatcher := cache.NewListWatchFromClient(w.clientset.CoreV1().RESTClient(), "configmaps", "platform-load-balancer", fields.Everything())
+		_, configmapInformer, configmapChan, _ := watchtools.NewIndexerInformerWatcher(configmapListWatcher, &v1.ConfigMap{})
+		w.configmaps = configmapChan
+		synced = append(synced, configmapInformer.HasSynced)
+	}
 
 	// configmaps, err := w.clientset.CoreV1().ConfigMaps(w.configMapNamespace).Watch(w.ctx, metav1.ListOptions{})
 	// w.metrics.WatchErr("configmaps", err)
@@ -355,9 +441,14 @@ func (w *Watcher) initWatch() error {
 	// 	return fmt.Errorf("error starting watch on configmap. %v", err)
 	// }
 
-	nodesListWatcher := cache.NewListWatchFromClient(w.clientset.CoreV1().RESTClient(), "nodes", v1.NamespaceAll, fields.Everything())
-	_, _, nodeChan, _ := watchtools.NewIndexerInformerWatcher(nodesListWatcher, &v1.Node{})
-	w.nodeWatch = nodeChan
+	if fed {
+		w.nodeWatch = newIdleWatch()
+	} else {
+		nodesListWatcher := cache.NewListWatchFromClient(w.clientset.CoreV1().RESTClient(), "nodes", v1.NamespaceAll, fields.Everything())
+		_, nodeInformer, nodeChan, _ := watchtools.NewIndexerInformerWatcher(nodesListWatcher, &v1.Node{})
+		w.nodeWatch = nodeChan
+		synced = append(synced, nodeInformer.HasSynced)
+	}
 
 	// nodes, err := w.clientset.CoreV1().Nodes().Watch(w.ctx, metav1.ListOptions{})
 	// w.metrics.WatchErr("nodes", err)
@@ -369,8 +460,13 @@ func (w *Watcher) initWatch() error {
 	// }
 
 	podsListWatcher := cache.NewListWatchFromClient(w.clientset.CoreV1().RESTClient(), "pods", v1.NamespaceAll, fields.Everything())
-	_, _, podChan, _ := watchtools.NewIndexerInformerWatcher(podsListWatcher, &v1.Pod{})
+	_, podInformer, podChan, _ := watchtools.NewIndexerInformerWatcher(podsListWatcher, &v1.Pod{})
 	w.podChan = podChan
+	synced = append(synced, podInformer.HasSynced)
+
+	w.syncMu.Lock()
+	w.synced = synced
+	w.syncMu.Unlock()
 
 	// w.services = services
 	// w.endpoints = endpoints
@@ -380,6 +476,19 @@ func (w *Watcher) initWatch() error {
 	return nil
 }
 
+// Synced reports whether every watch has listed what it watches since it
+// was last started.
+func (w *Watcher) Synced() bool {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	for _, synced := range w.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
 // ingestPodWatchEvents maintains a cache of all pods in the cluster
 func (w *Watcher) ingestPodWatchEvents() {
 	log.Debugln("watcher: ingestPodWatchEvents: starting up ...")
@@ -505,6 +614,8 @@ func (w *Watcher) watches() {
 	defer metricsUpdateTicker.Stop()
 
 	for {
+		// source is the watch that delivered the event handled in this iteration
+		source := "resync"
 
 		select {
 		case <-w.ctx.Done():
@@ -530,10 +641,13 @@ func (w *Watcher) watches() {
 			w.watchBackoffDuration = 0
 			svcUpdates++
 			w.metrics.WatchData("services")
+			source = "services"
 			svc := evt.Object.(*v1.Service)
 			// log.Debugln("watcher: services chan got an event:", svc.Name, evt.Type)
 
 			w.processService(evt.Type, svc.DeepCopy())
+			w.changes.received(source, evt.Type, svc.Namespace, svc.Name, w.logger)
+			w.churn.received(time.Now())
 
 		case evt, ok := <-w.endpoints.ResultChan():
 			if !ok || evt.Object == nil {
@@ -567,8 +681,11 @@ func (w *Watcher) watches() {
 			w.watchBackoffDuration = 0
 			epUpdates++
 			w.metrics.WatchData("endpoints")
+			source = "endpoints"
 			// w.logger.Debugf("got new endpoints from result chan")
 			w.processEndpoint(evt.Type, ep.DeepCopy())
+			w.changes.received(source, evt.Type, ep.Namespace, ep.Name, w.logger)
+			w.churn.received(time.Now())
 
 		case evt, ok := <-w.configmaps.ResultChan():
 			if !ok || evt.Object == nil {
@@ -587,11 +704,14 @@ func (w *Watcher) watches() {
 			w.watchBackoffDuration = 0
 			cmUpdates++
 			w.metrics.WatchData("configmaps")
+			source = "configmaps"
 			// w.logger.Debugf("got new configmap from result chan")
 
 			cm := evt.Object.(*v1.ConfigMap)
 			log.Debugln("watcher: configmaps chan got an event:", cm.Name, evt.Type)
 			w.processConfigMap(evt.Type, cm)
+			w.changes.received(source, evt.Type, cm.Namespace, cm.Name, w.logger)
+			w.churn.received(time.Now())
 
 		case evt, ok := <-w.nodeWatch.ResultChan():
 			if !ok || evt.Object == nil {
@@ -615,6 +735,7 @@ func (w *Watcher) watches() {
 			log.Debugln("watcher: nodeWatch chan got an event:", n.Name, evt.Type)
 
 			w.processNode(evt.Type, n.DeepCopy())
+			w.changes.received("nodes", evt.Type, "", n.Name, w.logger)
 
 			// Compute a new set of nodes and node endpoints. Compare that set of info to the
 			// set of info that was last transmitted.  If it changed, publish it.
@@ -631,6 +752,19 @@ func (w *Watcher) watches() {
 			// here we continue becase node changes do not require checking if the cluster config has changed
 			continue
 
+		case <-w.feedChan:
+			// switch between the config feed and watching the configmap
+			// and nodes. a fed watcher stops building the cluster config
+			// until the feed brings the next one.
+			if w.isFed() {
+				w.ConfigMap = nil
+			}
+			w.stopWatch()
+			if err := w.initWatch(); err != nil {
+				w.logger.Errorf("watcher: initWatch() failed: %v", err)
+			}
+			continue
+
 		case <-metricsUpdateTicker.C:
 
 			w.metrics.WatchBackoffDuration(w.watchBackoffDuration)
@@ -649,16 +783,43 @@ func (w *Watcher) watches() {
 		// log.Debugln("watcher: update count is now:", totalUpdates)
 
 		if w.ConfigMap == nil {
-			w.logger.Warnf("configmap is nil. skipping publication")
+			// a fed watcher publishes what the feed brings instead
+			if !w.isFed() {
+				w.logger.Warnf("configmap is nil. skipping publication")
+			}
 			continue
 		}
 
+		// trace the event from receipt until its config is handed off for publishing
+		_, span := tracing.Start(w.ctx, "watcher.event", attribute.String("watch.source", source))
+
 		// Build a new cluster config and publish it if it changed
 		newConfig, err := w.buildClusterConfig()
-		if err != nil {
+		var invalid *validate.Error
+		var parse *types.ParseError
+		switch {
+		case errors.As(err, &invalid):
+			// the last valid config stays in effect
+			for _, p := range invalid.Problems {
+				w.logger.Errorf("watcher: rejected the cluster config. %s", p)
+			}
+			w.metrics.WatchClusterConfig("rejected")
+			w.setRejected(invalid.Problems)
+			w.configEvent(w.ConfigMap, fmt.Sprintf("config key '%s' was rejected. %v", w.ConfigKey, invalid))
+		case errors.As(err, &parse):
+			w.logger.Errorf("watcher: rejected the cluster config. %v", parse)
+			w.metrics.WatchClusterConfig("rejected")
+			w.setRejected([]validate.Problem{{Message: parse.Problem()}})
+			w.configEvent(w.ConfigMap, parse.Error())
+		case err != nil:
 			log.Errorln("watcher: error building cluster config:", err)
 			w.metrics.WatchClusterConfig("error")
 		}
+		if err != nil || newConfig == nil {
+			tracing.End(span, err)
+			continue
+		}
+		w.setRejected(nil)
 		// log.Debugln("watcher: buildClusterConfig returning values:", newConfig, err)
 
 		// determine if the config has changed. if it has not, then we just return
@@ -688,7 +849,18 @@ func (w *Watcher) watches() {
 			newPortConfigCount += len(portConfigs)
 		}
 		log.Println("watcher: cluster config was changed. Old ip count:", oldPortConfigCount, "New ip count:", newPortConfigCount)
-		w.publishChan <- newConfig
+		w.traceMu.Lock()
+		w.lastEventSpan = span.SpanContext()
+		w.traceMu.Unlock()
+		select {
+		case w.publishChan <- newConfig:
+		default:
+			// the publisher is busy publishing the last batch
+			sendStart := time.Now()
+			w.publishChan <- newConfig
+			w.publishMetrics.Blocked(time.Since(sendStart))
+		}
+		tracing.End(span, err)
 	}
 }
 
@@ -859,6 +1031,26 @@ func (w *Watcher) GetEndpointAddressesForService(serviceName string, namespace s
 	return allAddresses
 }
 
+// GetEndpointTargetPort returns the port that the endpoints of a service
+// listen on for portName, or an empty string if there is none.
+func (w *Watcher) GetEndpointTargetPort(serviceName string, namespace string, portName string) string {
+	w.RLock()
+	defer w.RUnlock()
+
+	ep, ok := w.AllEndpoints[namespace+"/"+serviceName]
+	if !ok {
+		return ""
+	}
+	for _, subset := range ep.Subsets {
+		for _, p := range subset.Ports {
+			if p.Name == portName {
+				return strconv.Itoa(int(p.Port))
+			}
+		}
+	}
+	return ""
+}
+
 // GetEndpointAddressesForNode fetches all the subset addresses known by the watcher
 // for a specific node.
 func (w *Watcher) GetEndpointAddressesForNode(nodeName string) []v1.EndpointAddress {
@@ -937,14 +1129,25 @@ func (w *Watcher) watchPublish() {
 
 					// log.Debugln("watcher: publishChan got a config to publish but batched it")
 					configToPublish = c
+					w.publishMetrics.Coalesced(1)
 					// for every additional new publish config that comes in,
 					// we reset the publish delay timer
 					publishDelayTimer.Reset(publishDelay)
 				case <-maxTimeoutTimer.C:
+					if !w.Synced() {
+						log.Debugln("watcher: holding the publish until the watches have synced")
+						maxTimeoutTimer.Reset(publishDelay)
+						continue
+					}
 					log.Debugln("watcher: publishChan published due to max timeout")
 					w.publish(configToPublish)
 					publishComplete = true
 				case <-publishDelayTimer.C:
+					if !w.Synced() {
+						log.Debugln("watcher: holding the publish until the watches have synced")
+						publishDelayTimer.Reset(publishDelay)
+						continue
+					}
 					log.Debugln("watcher: publishChan published due to max delay timeout")
 					w.publish(configToPublish)
 					publishComplete = true
@@ -981,14 +1184,183 @@ func (w *Watcher) watchPublish() {
 // 	}
 // }
 
+// Stage has the watcher publish what stage returns for each cluster config it
+// builds, in place of it. Configs published before it is set aren't staged.
+// Stages run in the order they are added, each given what the one before
+// returned.
+func (w *Watcher) Stage(stage func(*types.ClusterConfig) *types.ClusterConfig) {
+	w.publishMu.Lock()
+	defer w.publishMu.Unlock()
+	w.stages = append(w.stages, stage)
+}
+
+// Republish publishes the last cluster config built again, for the stage to
+// decide afresh what to publish of it.
+func (w *Watcher) Republish() {
+	w.publishMu.Lock()
+	cc := w.built
+	w.publishMu.Unlock()
+	if cc == nil {
+		return
+	}
+	select {
+	case w.publishChan <- cc:
+	case <-w.ctx.Done():
+	}
+}
+
 func (w *Watcher) publish(cc *types.ClusterConfig) {
+	w.publishMu.Lock()
+	stages := w.stages
+	w.built = cc
+	w.publishMu.Unlock()
+	for _, stage := range stages {
+		cc = stage(cc)
+	}
+
 	log.Debugln("watcher: publishing new cluster config with", len(cc.Config), "IPv4 addresses and", len(cc.Config6), "IPv6 addresses")
+
+	w.traceMu.Lock()
+	_, span := tracing.StartLinked(w.ctx, "watcher.publish", w.lastEventSpan,
+		attribute.Int("config.ipv4", len(cc.Config)),
+		attribute.Int("config.ipv6", len(cc.Config6)))
+	w.lastPublishSpan = span.SpanContext()
+	w.traceMu.Unlock()
+	defer span.End()
+
+	changes := types.Diff(w.ClusterConfig, cc)
 	w.ClusterConfig = cc
 
 	// generate a new full config record
 	b, _ := json.Marshal(w.ClusterConfig)
 	sha := sha1.Sum(b)
-	w.metrics.ClusterConfigInfo(base64.StdEncoding.EncodeToString(sha[:]), string(b))
+	hash := base64.StdEncoding.EncodeToString(sha[:])
+	w.metrics.ClusterConfigInfo(hash, string(b))
+
+	w.publishMu.Lock()
+	id := w.changes.published(hash, w.configHash)
+	changed := hash != w.configHash
+	w.lastPublish = time.Now()
+	w.publishCount++
+	w.configHash = hash
+	w.publishMu.Unlock()
+	w.churn.published(cc, changed, time.Now())
+
+	span.SetAttributes(attribute.String("ravel.correlation_id", id))
+	w.logger.WithFields(log.Fields{"correlation_id": id, "config_hash": hash}).Debug("watcher: published cluster config")
+	w.metrics.ConfigChanges(changes)
+	if len(changes) > 0 {
+		w.logger.WithFields(log.Fields{"correlation_id": id, "config_hash": hash}).Infof("watcher: cluster config changed: %s", types.SummarizeChanges(changes))
+		for _, c := range changes {
+			w.logger.WithField("correlation_id", id).Debugf("watcher: cluster config change: %s", c)
+		}
+	}
+}
+
+// Published returns how many cluster configs have been published, and when
+// the most recent one was. Workers compare the count between reconfigures to
+// find publishes they never applied on their own.
+func (w *Watcher) Published() (uint64, time.Time) {
+	w.publishMu.Lock()
+	defer w.publishMu.Unlock()
+	return w.publishCount, w.lastPublish
+}
+
+// ConfigHash returns the hash of the most recently published cluster config,
+// as reported by the cluster config info metric.
+func (w *Watcher) ConfigHash() string {
+	w.publishMu.Lock()
+	defer w.publishMu.Unlock()
+	return w.configHash
+}
+
+// Reason returns reason, the cause of a reconfigure, with a summary of how
+// the cluster config it applies differs from applied, the config the worker
+// applied before, and the config it applies, for the audit trail.
+func (w *Watcher) Reason(reason string, applied *types.ClusterConfig) (string, *types.ClusterConfig) {
+	cc := w.ClusterConfig
+	if applied == nil || cc == applied {
+		return reason, cc
+	}
+	if summary := types.SummarizeChanges(types.Diff(applied, cc)); summary != "" {
+		reason += ". config: " + summary
+	}
+	return reason, cc
+}
+
+// PublishSpanContext returns the span context of the most recent cluster config
+// publish, so that reconfigure spans can be linked back to the change that
+// caused them.
+func (w *Watcher) PublishSpanContext() trace.SpanContext {
+	w.traceMu.Lock()
+	defer w.traceMu.Unlock()
+	return w.lastPublishSpan
+}
+
+// Health reports the watcher ready once it has synced and published a
+// cluster config.
+func (w *Watcher) Health(context.Context) health.Status {
+	w.publishMu.Lock()
+	lastPublish := w.lastPublish
+	w.publishMu.Unlock()
+	synced := w.Synced()
+
+	detail := map[string]interface{}{
+		"synced":     synced,
+		"services":   w.ServiceCount(),
+		"endpoints":  w.EndpointCount(),
+		"ipv4VIPs":   w.ConfigIPCount(),
+		"ipv6VIPs":   w.ConfigIPCount6(),
+		"configHash": w.ConfigHash(),
+	}
+	rejected := w.Rejected()
+	if len(rejected) > 0 {
+		detail["rejected"] = rejected
+	}
+	if lastPublish.IsZero() {
+		if !synced {
+			return health.Status{Message: "the watches have not synced yet", Detail: detail}
+		}
+		if len(rejected) > 0 {
+			return health.Status{Message: "the cluster config was rejected as invalid", Detail: detail}
+		}
+		return health.Status{Message: "no cluster config has been published yet", Detail: detail}
+	}
+	detail["lastPublish"] = lastPublish.UTC().Format(time.RFC3339)
+	return health.Status{Ready: true, Detail: detail}
+}
+
+// SetStrict sets whether cluster configs that fail validation are rejected,
+// keeping the last valid config in effect, or published as they parse.
+// Watchers are strict unless set otherwise.
+func (w *Watcher) SetStrict(strict bool) {
+	w.rejectMu.Lock()
+	defer w.rejectMu.Unlock()
+	w.lenient = !strict
+}
+
+func (w *Watcher) isStrict() bool {
+	w.rejectMu.Lock()
+	defer w.rejectMu.Unlock()
+	return !w.lenient
+}
+
+// Rejected returns the problems of the cluster config rejected since the last
+// one published, as path: message.
+func (w *Watcher) Rejected() []string {
+	w.rejectMu.Lock()
+	defer w.rejectMu.Unlock()
+	out := make([]string, 0, len(w.rejected))
+	for _, p := range w.rejected {
+		out = append(out, p.String())
+	}
+	return out
+}
+
+func (w *Watcher) setRejected(problems []validate.Problem) {
+	w.rejectMu.Lock()
+	defer w.rejectMu.Unlock()
+	w.rejected = problems
 }
 
 func (w *Watcher) publishNodes(nodes []*v1.Node) {
@@ -1109,6 +1481,30 @@ func (w *Watcher) HasConfigChanged(currentConfig *types.ClusterConfig, newConfig
 				log.Infoln("watcher:", currentKey, currentPortMapKey, "ProxyProtocolEnabled has changed")
 				return true
 			}
+			if newConfig.Config[currentKey][currentPortMapKey].AcceptProxyProtocol != currentPortMapValue.AcceptProxyProtocol {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "AcceptProxyProtocol has changed")
+				return true
+			}
+			if !reflect.DeepEqual(newConfig.Config[currentKey][currentPortMapKey].HealthCheck, currentPortMapValue.HealthCheck) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "HealthCheck has changed")
+				return true
+			}
+			if newConfig.Config[currentKey][currentPortMapKey].V6Proxy != currentPortMapValue.V6Proxy {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "V6Proxy has changed")
+				return true
+			}
+			if newConfig.Config[currentKey][currentPortMapKey].LocalBackend != currentPortMapValue.LocalBackend {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "LocalBackend has changed")
+				return true
+			}
+			if newConfig.Config[currentKey][currentPortMapKey].L7Mode != currentPortMapValue.L7Mode || !reflect.DeepEqual(newConfig.Config[currentKey][currentPortMapKey].Routes, currentPortMapValue.Routes) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "L7 routes have changed")
+				return true
+			}
+			if !reflect.DeepEqual(newConfig.Config[currentKey][currentPortMapKey].Listener, currentPortMapValue.Listener) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "Listener settings have changed")
+				return true
+			}
 			if newConfig.Config[currentKey][currentPortMapKey].TCPEnabled != currentPortMapValue.TCPEnabled {
 				log.Infoln("watcher:", currentKey, currentPortMapKey, "TCPEnabled has changed")
 				return true
@@ -1191,6 +1587,30 @@ func (w *Watcher) HasConfigChanged(currentConfig *types.ClusterConfig, newConfig
 				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 ProxyProtocolEnabled has changed")
 				return true
 			}
+			if newConfig.Config6[currentKey][currentPortMapKey].AcceptProxyProtocol != currentPortMapValue.AcceptProxyProtocol {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 AcceptProxyProtocol has changed")
+				return true
+			}
+			if !reflect.DeepEqual(newConfig.Config6[currentKey][currentPortMapKey].HealthCheck, currentPortMapValue.HealthCheck) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 HealthCheck has changed")
+				return true
+			}
+			if newConfig.Config6[currentKey][currentPortMapKey].V6Proxy != currentPortMapValue.V6Proxy {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 V6Proxy has changed")
+				return true
+			}
+			if newConfig.Config6[currentKey][currentPortMapKey].LocalBackend != currentPortMapValue.LocalBackend {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 LocalBackend has changed")
+				return true
+			}
+			if newConfig.Config6[currentKey][currentPortMapKey].L7Mode != currentPortMapValue.L7Mode || !reflect.DeepEqual(newConfig.Config6[currentKey][currentPortMapKey].Routes, currentPortMapValue.Routes) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 L7 routes have changed")
+				return true
+			}
+			if !reflect.DeepEqual(newConfig.Config6[currentKey][currentPortMapKey].Listener, currentPortMapValue.Listener) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 Listener settings have changed")
+				return true
+			}
 			if newConfig.Config6[currentKey][currentPortMapKey].TCPEnabled != currentPortMapValue.TCPEnabled {
 				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 TCPEnabled has changed")
 				return true
@@ -1458,6 +1878,11 @@ func (w *Watcher) processEndpoint(eventType watch.EventType, endpoints *v1.Endpo
 func (w *Watcher) extractConfigKey(configmap *v1.ConfigMap) (*types.ClusterConfig, error) {
 	w.RLock()
 	defer w.RUnlock()
+	if _, ok := configmap.Data[w.ConfigKey]; ok && w.isStrict() {
+		if err := validate.CheckKey(configmap.Data, w.ConfigKey); err != nil {
+			return nil, fmt.Errorf("watcher: configmap %s has an invalid config key %s. %w", configmap.Name, w.ConfigKey, err)
+		}
+	}
 	// Unmarshal the config map, retrieving only the configuration matching the configKey
 	clusterConfig, err := types.NewClusterConfig(configmap, w.ConfigKey)
 	if err != nil {
@@ -7,6 +7,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
 )
 
 type WatcherMetrics interface {
@@ -15,24 +16,28 @@ type WatcherMetrics interface {
 	WatchBackoffDuration(d time.Duration)
 
 	// indicates that an error on initialization has occurred
-	// counter rdel_lb_kube_connect_err_count
+	// counter ravel_kube_connect_errors_total
 	WatchErr(endpoint string, err error)
 
 	// indicates that the watcher has been reinitialized
-	// counter rdel_lb_watch_init_count
-	// bucket rdei_lb_watch_init_microseconds
+	// counter ravel_watch_init_total
+	// bucket ravel_watch_init_latency_microseconds
 	WatchInit(d time.Duration)
 
 	// indicates how often new data arrives through each of the watch channels
-	// counter rdei_lb_watch_data_count
+	// counter ravel_watch_data_total
 	WatchData(endpoint string)
 
 	// indicator of how often the cluster config is rebuilt and re-sent to the client
-	// counter rdei_lb_watch_cluster_config_count
+	// counter ravel_watch_cluster_config_total
 	WatchClusterConfig(event string)
 
 	// contains the full applied configutration and a hash of it
 	ClusterConfigInfo(sha string, info string)
+
+	// counts the changes of each cluster config published from the last
+	// counter ravel_cluster_config_changes_total
+	ConfigChanges(changes []types.ConfigChange)
 }
 
 type Metrics struct {
@@ -48,6 +53,7 @@ type Metrics struct {
 	dataCount       *prometheus.CounterVec
 	configCount     *prometheus.CounterVec
 	configInfo      *prometheus.GaugeVec
+	configChanges   *prometheus.CounterVec
 }
 
 func (m *Metrics) WatchBackoffDuration(d time.Duration) {
@@ -73,6 +79,11 @@ func (m *Metrics) WatchData(endpoint string) {
 func (m *Metrics) WatchClusterConfig(event string) {
 	m.configCount.With(prometheus.Labels{"lb": m.kind, "seczone": m.secZone, "event": event}).Add(1)
 }
+func (m *Metrics) ConfigChanges(changes []types.ConfigChange) {
+	for _, c := range changes {
+		m.configChanges.With(prometheus.Labels{"lb": m.kind, "seczone": m.secZone, "change": c.Kind, "op": c.Op}).Add(1)
+	}
+}
 func (m *Metrics) ClusterConfigInfo(sha string, info string) {
 	// because this has potential to be a high-cardinality metric,
 	// clearing the metrics every few minutes. Note that this may result
@@ -95,64 +106,73 @@ func (m *Metrics) ClusterConfigInfo(sha string, info string) {
 	// 	"date":    time.Now().Format(time.RFC3339)}).Set(1)
 }
 
+var (
+	watcherLabels  = []string{"lb", "seczone"}
+	endpointLabels = []string{"lb", "seczone", "endpoint"}
+)
+
+var (
+	watchErrDef = stats.Define(stats.Definition{
+		Type:     stats.Counter,
+		Name:     "kube_connect_errors_total",
+		Help:     "is a count of errors connecting to kube, broken out by labels indicating the endpoint",
+		Labels:   endpointLabels,
+		Replaces: "rdei_lb_kube_connect_err_count",
+	})
+	watchInitDef = stats.Define(stats.Definition{
+		Type:     stats.Counter,
+		Name:     "watch_init_total",
+		Help:     "is a count of watch init events.",
+		Labels:   watcherLabels,
+		Replaces: "rdei_lb_watch_init_count",
+	})
+	watchInitLatencyDef = stats.Define(stats.Definition{
+		Type:     stats.Histogram,
+		Name:     "watch_init_latency_microseconds",
+		Help:     "is a histogram denoting the amount of time it took to reestablish all of the watches",
+		Labels:   watcherLabels,
+		Buckets:  stats.LatencyBuckets,
+		Replaces: "rdei_lb_watch_init_latency_microseconds",
+	})
+	watchDataDef = stats.Define(stats.Definition{
+		Type:     stats.Counter,
+		Name:     "watch_data_total",
+		Help:     "is a count of data inbound from the kuberntes watch events, broken out by endpoint",
+		Labels:   endpointLabels,
+		Replaces: "rdei_lb_watch_data_count",
+	})
+	watchClusterConfigDef = stats.Define(stats.Definition{
+		Type:     stats.Counter,
+		Name:     "watch_cluster_config_total",
+		Help:     "is a count of how often a cluster config is regenerated, broken out by event - noop|publish|rejected|error",
+		Labels:   []string{"lb", "seczone", "event"},
+		Replaces: "rdei_lb_watch_cluster_config_count",
+	})
+	configChangesDef = stats.Define(stats.Definition{
+		Type:   stats.Counter,
+		Name:   "cluster_config_changes_total",
+		Help:   "is a count of the changes of each cluster config published from the one before, broken out by what changed and how",
+		Labels: []string{"lb", "seczone", "change", "op"},
+	})
+	clusterConfigInfoDef = stats.Define(stats.Definition{
+		Type:     stats.Gauge,
+		Name:     "cluster_config_info",
+		Help:     "contains the current cluster config and a sha hash of the config",
+		Labels:   []string{"lb", "seczone", "sha", "info", "date"},
+		Replaces: "rdei_lb_cluster_config_info",
+	})
+	watchBackoffDef = stats.Define(stats.Definition{
+		Type:     stats.Gauge,
+		Name:     "watch_backoff_duration_seconds",
+		Help:     "returns the current value of the watch backoff duration. a non-1s duration indicates that the backoff is present and the load balancer is unable to communicate with the api server",
+		Labels:   watcherLabels,
+		Replaces: "rdei_lb_watch_backoff_duration",
+	})
+)
+
 // NewWatcherMetrics creates a new watcherMetrics struct
 func NewWatcherMetrics(kind, secZone string) WatcherMetrics {
-	defaultLabels := []string{"lb", "seczone"}
-	endpointLabels := append(defaultLabels, []string{"endpoint"}...)
-	eventLabels := append(defaultLabels, []string{"event"}...)
-	infoLabels := append(defaultLabels, []string{"sha", "info", "date"}...)
-
-	// counter reconfigure_count
-	watchErr := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: stats.Prefix + "kube_connect_err_count",
-		Help: "is a count of errors connecting to kube, broken out by labels indicating the endpoint",
-	}, endpointLabels)
-
-	// counter watch_init_count
-	initCount := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: stats.Prefix + "watch_init_count",
-		Help: "is a count of watch init events.",
-	}, defaultLabels)
-
-	// histogram watch_init_latency_microseconds
-	watchLatency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name:    stats.Prefix + "watch_init_latency_microseconds",
-		Help:    "is a histogram denoting the amount of time it took to reestablish all of the watches",
-		Buckets: stats.LatencyBuckets,
-	}, defaultLabels)
-
-	// counter watch_data_count
-	dataCount := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: stats.Prefix + "watch_data_count",
-		Help: "is a count of data inbound from the kuberntes watch events, broken out by endpoint",
-	}, endpointLabels)
-
-	// counter watch_cluster_config_count
-	reconfigCount := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: stats.Prefix + "watch_cluster_config_count",
-		Help: "is a count of how often a cluster config is regenerated, broken out by event - noop|publis|error",
-	}, eventLabels)
-
-	// gauge config_info
-	configInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: stats.Prefix + "cluster_config_info",
-		Help: "contains the current cluster config and a sha hash of the config",
-	}, infoLabels)
-
-	// gauge config_info
-	backoffDuration := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: stats.Prefix + "watch_backoff_duration",
-		Help: "returns the current value of the watch backoff duration. a non-1s duration indicates that the backoff is present and the load balancer is unable to communicate with the api server",
-	}, defaultLabels)
-
-	prometheus.MustRegister(configInfo)
-	prometheus.MustRegister(reconfigCount)
-	prometheus.MustRegister(dataCount)
-	prometheus.MustRegister(watchLatency)
-	prometheus.MustRegister(initCount)
-	prometheus.MustRegister(watchErr)
-	prometheus.MustRegister(backoffDuration)
-
+	backoffDuration := watchBackoffDef.GaugeVec()
 	backoffDuration.With(prometheus.Labels{"lb": kind, "seczone": secZone})
 
 	return &Metrics{
@@ -160,11 +180,12 @@ func NewWatcherMetrics(kind, secZone string) WatcherMetrics {
 		secZone: secZone,
 
 		backoffDuration: backoffDuration,
-		configInfo:      configInfo,
-		configCount:     reconfigCount,
-		dataCount:       dataCount,
-		initLatency:     watchLatency,
-		initCount:       initCount,
-		errCount:        watchErr,
+		configInfo:      clusterConfigInfoDef.GaugeVec(),
+		configCount:     watchClusterConfigDef.CounterVec(),
+		configChanges:   configChangesDef.CounterVec(),
+		dataCount:       watchDataDef.CounterVec(),
+		initLatency:     watchInitLatencyDef.HistogramVec(),
+		initCount:       watchInitDef.CounterVec(),
+		errCount:        watchErrDef.CounterVec(),
 	}
 }
@@ -1,11 +1,30 @@
 package watcher
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math/big"
+	"strings"
 	"testing"
+	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+
+	log "github.com/Comcast/Ravel/pkg/logging"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/validate"
 )
 
 func loadTestWatcherJSON(filePath string) (*Watcher, error) {
@@ -41,7 +60,7 @@ func TestServiceInEndpoints(t *testing.T) {
 }
 
 func TestBuildClusterConfig(t *testing.T) {
-	log.SetLevel(log.DebugLevel)
+	logrus.SetLevel(logrus.DebugLevel)
 
 	w, err := loadTestWatcherJSON("watcher.json")
 	if err != nil {
@@ -91,3 +110,250 @@ func TestUserServiceInEndpoints(t *testing.T) {
 		t.Fatal("no endpoints found for service, but there should be")
 	}
 }
+
+func TestCorrelationIDs(t *testing.T) {
+	w := &Watcher{}
+	logger := log.New()
+
+	// updates batched into a publish share its id
+	w.changes.received("services", watch.Modified, "default", "web", logger)
+	w.changes.received("endpoints", watch.Modified, "default", "web", logger)
+	first := w.changes.published("abc=", "")
+	if w.CorrelationID() != first {
+		t.Fatalf("expected the publish to be current. saw %s, want %s", w.CorrelationID(), first)
+	}
+	p := w.Publications(first)
+	if len(p) != 1 || len(p[0].Updates) != 2 || p[0].ConfigHash != "abc=" {
+		t.Fatalf("expected one publish with both updates. saw %+v", p)
+	}
+
+	// a resync that changes nothing keeps the id
+	w.changes.received("endpoints", watch.Modified, "default", "web", logger)
+	if id := w.changes.published("abc=", "abc="); id != first {
+		t.Fatalf("expected an unchanged config to keep id %s. saw %s", first, id)
+	}
+
+	// node updates are published on their own
+	w.changes.received("nodes", watch.Modified, "", "node-1", logger)
+	if w.CorrelationID() == first || len(w.Publications("")) != 2 {
+		t.Fatalf("expected a node update to be published with a new id. saw %+v", w.Publications(""))
+	}
+}
+
+func TestChurn(t *testing.T) {
+	c := newChurn("director", "green", log.New())
+	now := time.Now()
+	config := func(vips ...string) *types.ClusterConfig {
+		cc := &types.ClusterConfig{Config: map[types.ServiceIP]types.PortMap{}}
+		for _, vip := range vips {
+			cc.Config[types.ServiceIP(vip)] = types.PortMap{}
+		}
+		return cc
+	}
+
+	// updates that change nothing are churn, but not changes
+	for i := 0; i < 5; i++ {
+		c.received(now)
+	}
+	c.published(config("10.0.0.1", "10.0.0.2"), true, now)
+	c.published(config("10.0.0.1", "10.0.0.2"), false, now)
+	if len(c.updates) != 5 || len(c.changes) != 1 {
+		t.Fatalf("expected 5 updates and 1 change. saw %d and %d", len(c.updates), len(c.changes))
+	}
+	if v := testutil.ToFloat64(c.publishes.WithLabelValues("director", "green", "unchanged")); v != 1 {
+		t.Fatalf("expected one unchanged publish. saw %v", v)
+	}
+
+	// 10.0.0.2 goes out and comes back every minute
+	for i := 1; i <= 4; i++ {
+		vips := []string{"10.0.0.1"}
+		if i%2 == 0 {
+			vips = append(vips, "10.0.0.2")
+		}
+		c.published(config(vips...), true, now.Add(time.Duration(i)*time.Minute))
+	}
+	if v := testutil.ToFloat64(c.vipFlaps.WithLabelValues("director", "green", "10.0.0.2")); v != 3 {
+		t.Fatalf("expected 3 flaps of 10.0.0.2. saw %v", v)
+	}
+	if f := c.flapping(now.Add(5 * time.Minute)); len(f) != 1 || f[0] != "10.0.0.2" {
+		t.Fatalf("expected 10.0.0.2 to be flapping. saw %v", f)
+	}
+
+	// it settles once the flaps fall out of the window
+	if f := c.flapping(now.Add(20 * time.Minute)); len(f) != 0 {
+		t.Fatalf("expected no flapping vips. saw %v", f)
+	}
+
+	// the rates fall back to 0 once updates stop
+	c.updates = prune(c.updates, now.Add(2*time.Minute).Add(-churnWindow))
+	if len(c.updates) != 0 {
+		t.Fatalf("expected old updates to be pruned. saw %d", len(c.updates))
+	}
+
+	// without a tracker, churn is a no-op
+	var none *churn
+	none.received(now)
+	none.published(config("10.0.0.1"), true, now)
+}
+
+func TestTLSCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	reads := 0
+	var fail error
+	secret := &v1.Secret{Data: map[string][]byte{v1.TLSCertKey: certPEM, v1.TLSPrivateKeyKey: keyPEM}}
+	c := newCertCache(func(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+		reads++
+		if namespace != "web" {
+			t.Fatalf("expected the web namespace, saw %s/%s", namespace, name)
+		}
+		return secret, fail
+	})
+
+	now := time.Now()
+	bundle, err := c.certificate("default", "web/web-tls", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle != string(certPEM)+string(keyPEM) {
+		t.Fatalf("expected the certificate followed by the key. saw\n%s", bundle)
+	}
+
+	// the secret is kept until it is due a refresh
+	c.certificate("web", "web-tls", now.Add(30*time.Second))
+	if reads != 1 {
+		t.Fatalf("expected one read of the secret, saw %d", reads)
+	}
+
+	// a failed refresh keeps the last certificate
+	fail = fmt.Errorf("forbidden")
+	if b, err := c.certificate("web", "web-tls", now.Add(2*time.Minute)); err != nil || b != bundle {
+		t.Fatalf("expected the last certificate after a failed refresh. saw %v", err)
+	}
+
+	// a secret without a valid key pair is rejected
+	fail = nil
+	secret.Data[v1.TLSPrivateKeyKey] = []byte("not a key")
+	if _, err := c.certificate("web", "other", now); err == nil {
+		t.Fatal("expected a secret without a valid key to be rejected")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	director := &Watcher{
+		ClusterConfig: &types.ClusterConfig{VIPPool: []string{"10.0.0.1"}, Config: map[types.ServiceIP]types.PortMap{"10.0.0.1": {}}},
+		Nodes: []*v1.Node{{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-1", Annotations: map[string]string{"ravel.comcast.com/maintenance": "upgrade"}},
+			Status: v1.NodeStatus{
+				Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue, LastHeartbeatTime: metav1.Now()}},
+				Images:     []v1.ContainerImage{{Names: []string{"nginx"}}},
+			},
+		}},
+	}
+	s, err := director.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	realserver := &Watcher{fed: true, publishChan: make(chan *types.ClusterConfig, 1), feedChan: make(chan struct{}, 1), logger: log.New()}
+	if err := realserver.ApplySnapshot(s); err != nil {
+		t.Fatal(err)
+	}
+	cc := <-realserver.publishChan
+	if len(cc.VIPPool) != 1 || len(cc.Config) != 1 {
+		t.Fatalf("expected the director's cluster config, got %+v", cc)
+	}
+	n := realserver.Nodes
+	if len(n) != 1 || n[0].Annotations["ravel.comcast.com/maintenance"] != "upgrade" || len(n[0].Status.Conditions) != 1 {
+		t.Fatalf("expected the director's nodes, got %+v", n)
+	}
+	if len(n[0].Status.Images) != 0 || !n[0].Status.Conditions[0].LastHeartbeatTime.IsZero() {
+		t.Fatalf("expected the images and heartbeats left out of the feed, got %+v", n[0].Status)
+	}
+
+	// once it watches for itself, the feed is ignored
+	realserver.Fed(false)
+	realserver.Nodes = nil
+	if err := realserver.ApplySnapshot(s); err != nil || realserver.Nodes != nil || len(realserver.publishChan) != 0 {
+		t.Fatalf("expected the snapshot to be ignored, got %v", err)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	w := NewStaticWatcher("test", "", 0, nil, nil, nil, nil, log.Discard())
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "ravel"},
+		Data:       map[string]string{"test": `{"config": {"10.1.2.3": {"443": {"namespace": "ns", "service": "web", "portName": "https", "ipvsOptions": {"scheduler": "wrrr"}}}}, "config6": {}}`},
+	}
+	_, err := w.Build(cm)
+	var invalid *validate.Error
+	if !errors.As(err, &invalid) || invalid.Problems[0].Path != `config["10.1.2.3"]["443"].ipvsOptions.scheduler` {
+		t.Fatalf("expected the config to be rejected at its scheduler. saw %v", err)
+	}
+
+	w.SetStrict(false)
+	if _, err := w.Build(cm); err != nil {
+		t.Fatalf("expected a lenient watcher to build the config. saw %v", err)
+	}
+}
+
+func TestConfigEvent(t *testing.T) {
+	w := NewStaticWatcher("test", "", 0, nil, nil, nil, nil, log.Discard())
+	posted := make(chan *v1.Event, 4)
+	w.postEvent = func(_ context.Context, e *v1.Event) error {
+		posted <- e
+		return nil
+	}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "ravel", ResourceVersion: "1"},
+		Data:       map[string]string{"test": "config:\n  10.1.2.3:\n    443: {namespace: ns\n"},
+	}
+	_, err := w.Build(cm)
+	var invalid *validate.Error
+	if !errors.As(err, &invalid) || !strings.Contains(invalid.Error(), "invalid yaml at line 3") {
+		t.Fatalf("expected the yaml to be rejected at its line. saw %v", err)
+	}
+	w.configEvent(cm, invalid.Error())
+	w.configEvent(cm, invalid.Error())
+	select {
+	case e := <-posted:
+		if e.Type != v1.EventTypeWarning || e.Reason != EventInvalidConfig || e.InvolvedObject.Name != "ravel" || e.Message != invalid.Error() {
+			t.Errorf("expected a warning on the configmap. saw %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected an event")
+	}
+	// events are posted in the background, so give a second one time to come
+	select {
+	case e := <-posted:
+		t.Fatalf("expected one event for each version of the configmap. saw another %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cm.ResourceVersion = "2"
+	w.configEvent(cm, invalid.Error())
+	select {
+	case <-posted:
+	case <-time.After(time.Second):
+		t.Fatal("expected an event for the new version of the configmap")
+	}
+	select {
+	case e := <-posted:
+		t.Fatalf("expected one event for each version of the configmap. saw another %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}